@@ -17,8 +17,15 @@
 package agent
 
 import (
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/romana/core/common"
+	"github.com/romana/core/common/features"
+	"github.com/romana/core/pkg/util/bgp"
+	"github.com/romana/core/pkg/util/firewall"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	"github.com/romana/core/pkg/util/platform"
 )
 
 // Agent provides access to configuration and helper functions, shared across
@@ -33,6 +40,9 @@ type Agent struct {
 	// Leasefile is a type that manages DHCP leases in the file
 	leaseFile *LeaseFile
 
+	// DHCP server managed by the agent, if configured (see dhcp.go).
+	dhcp *dhcpServer
+
 	// Helper here is a type that organizes swappable interfaces for 3rd
 	// party libraries (e.g. os.exec), and some functions that are using
 	// those interfaces directly. Main purpose is to support unit testing.
@@ -45,11 +55,69 @@ type Agent struct {
 
 	waitForIfaceTry int
 
+	// Number of endpoints of a bulk request
+	// provisioned concurrently (see bulk.go).
+	provisionWorkers int
+
 	// Whether this is running in test mode.
 	testMode bool
 
 	// Agent store to keep records about managed resources.
 	store agentStore
+
+	// Unix socket to serve Docker plugin API on, if any.
+	dockerPluginSocket string
+
+	metrics *agentMetrics
+
+	// Addresses to use for the romana gateway and for
+	// routes to other hosts (see interfaces.go).
+	gatewaySelector addrSelector
+	hostSelector    addrSelector
+
+	// Registration of the host with topology,
+	// if enabled (see register.go).
+	registration *hostRegistration
+
+	// File to keep local state in, if any (see state.go).
+	stateFile string
+
+	// How often to reconcile routes to other
+	// hosts with topology (see reconcile.go).
+	reconcileInterval time.Duration
+	// Whether to also reconcile them on host events.
+	watchTopology bool
+	// Bus to receive host events from, if configured.
+	bus common.EventBus
+
+	// Whether to protect endpoints against using addresses
+	// not allocated to them (see spoofing.go).
+	antiSpoofing bool
+
+	// Recorder of firewall rules instead of iptables,
+	// if configured (see firewall.go).
+	firewallRecorder *firewall.Recorder
+
+	// Advertisement of the Romana CIDR via BGP,
+	// if configured (see bgp.go).
+	bgp        *bgpConfig
+	bgpSpeaker *bgp.Speaker
+
+	// Whether to exit without losing endpoints being provisioned,
+	// and how long to wait for them (see restart.go).
+	gracefulRestart        bool
+	gracefulRestartTimeout time.Duration
+	requests               *endpointRequests
+
+	// VXLAN interface carrying inter-host traffic,
+	// if configured (see vxlan.go).
+	vxlan *utilnetlink.Vxlan
+
+	// Provisions endpoints again when their interfaces are restored.
+	linkMonitor *linkMonitor
+
+	// Applied policies and ipsets they use (see policy.go).
+	policies *policySets
 }
 
 // SetConfig implements SetConfig function of the Service interface.
@@ -61,10 +129,70 @@ func (a *Agent) SetConfig(config common.ServiceConfig) error {
 	a.leaseFile = &lf
 
 	a.waitForIfaceTry = int(config.ServiceSpecific["wait_for_iface_try"].(float64))
+	if workers, ok := config.ServiceSpecific["provision_workers"].(float64); ok {
+		a.provisionWorkers = int(workers)
+	}
 	a.networkConfig = &NetworkConfig{}
 
 	a.store = *NewStore(config)
 
+	a.stateFile, _ = config.ServiceSpecific["state_file"].(string)
+
+	var err error
+	a.gracefulRestart, a.gracefulRestartTimeout, err = parseGracefulRestartConfig(config.ServiceSpecific, a.stateFile)
+	if err != nil {
+		return err
+	}
+	a.reconcileInterval, err = parseReconcileInterval(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	a.watchTopology, err = parseWatchTopology(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	a.antiSpoofing, err = parseAntiSpoofing(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	a.firewallRecorder, err = parseFirewallProvider(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	iptablesWait, iptablesLockRetries, err := parseIPtablesLock(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	if a.firewallRecorder == nil && a.Helper != nil {
+		a.Helper.Executor = firewall.NewIPtablesQueue(a.Helper.Executor, iptablesWait, iptablesLockRetries)
+	}
+	a.registration, err = parseRegistrationConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	a.bgp, err = parseBGPConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	a.gatewaySelector, err = parseAddrSelector(config.ServiceSpecific, "gateway")
+	if err != nil {
+		return err
+	}
+	a.hostSelector, err = parseAddrSelector(config.ServiceSpecific, "host_routes")
+	if err != nil {
+		return err
+	}
+
+	a.vxlan, err = parseOverlayConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+
+	a.dhcp, err = parseDhcpConfig(config.ServiceSpecific, a)
+	if err != nil {
+		return err
+	}
+
 	glog.Infof("Agent.SetConfig() finished.")
 	return nil
 }
@@ -113,6 +241,30 @@ func (a *Agent) Routes() common.Routes {
 				return &NetworkRequest{}
 			},
 		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/netns",
+			Handler: a.netnsUpHandler,
+			MakeMessage: func() interface{} {
+				return &NamespaceRequest{}
+			},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/netns",
+			Handler: a.netnsDownHandler,
+			MakeMessage: func() interface{} {
+				return &NamespaceRequest{}
+			},
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/endpoints",
+			Handler: a.bulkProvisionHandler,
+			MakeMessage: func() interface{} {
+				return &BulkProvisionRequest{}
+			},
+		},
 		common.Route{
 			Method:  "POST",
 			Pattern: "/policies",
@@ -135,12 +287,35 @@ func (a *Agent) Routes() common.Routes {
 			Pattern: "/policies",
 			Handler: a.listPolicies,
 		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/routes/reconcile",
+			Handler: a.reconcileHandler,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/routes",
+			Handler: a.routesHandler,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/firewall/operations",
+			Handler: a.firewallOperationsHandler,
+		},
+		a.metrics.Route(),
 	}
 	return routes
 }
 
 // Run starts the agent service.
 func Run(rootServiceURL string, cred *common.Credential, testMode bool) (*common.RestServiceInfo, error) {
+	return RunWithDockerPlugin(rootServiceURL, cred, testMode, "")
+}
+
+// RunWithDockerPlugin is like Run, but the agent also serves Docker
+// libnetwork remote network and IPAM driver API (see docker.go) on the
+// provided unix socket, unless it is empty.
+func RunWithDockerPlugin(rootServiceURL string, cred *common.Credential, testMode bool, dockerPluginSocket string) (*common.RestServiceInfo, error) {
 	clientConfig := common.GetDefaultRestClientConfig(rootServiceURL)
 	clientConfig.TestMode = testMode
 	client, err := common.NewRestClient(clientConfig)
@@ -150,9 +325,13 @@ func Run(rootServiceURL string, cred *common.Credential, testMode bool) (*common
 		return nil, err
 	}
 
-	agent := &Agent{testMode: testMode}
+	agent := &Agent{testMode: testMode, dockerPluginSocket: dockerPluginSocket, requests: &endpointRequests{}, policies: newPolicySets()}
+	agent.metrics = newAgentMetrics(agent)
 	helper := NewAgentHelper(agent)
 	agent.Helper = &helper
+	if !platform.Supported && !testMode {
+		glog.Warningf("Agent: %v, endpoints will not be wired", platform.ErrNotSupported)
+	}
 	glog.Infof("Agent: Getting configuration from %s", rootServiceURL)
 
 	config, err := client.GetServiceConfig(agent.Name())
@@ -167,6 +346,11 @@ func (a *Agent) Name() string {
 	return "agent"
 }
 
+// CheckHealth implements common.HealthChecker by checking the database.
+func (a *Agent) CheckHealth() error {
+	return a.store.Ping()
+}
+
 // Initialize implements the Initialize method of common.Service
 // interface.
 func (a *Agent) Initialize() error {
@@ -177,10 +361,31 @@ func (a *Agent) Initialize() error {
 		return err
 	}
 
-	glog.Infof("Attempting to identify current host.")
-	if err := a.identifyCurrentHost(); err != nil {
-		glog.Error("Agent: ", agentError(err))
-		return agentError(err)
+	a.linkMonitor = newLinkMonitor(a)
+	endpoints, restored := a.restoreState()
+	if a.registration != nil {
+		glog.Info("Agent: registering host with topology")
+		if err := a.registerHost(); err != nil {
+			glog.Error("Agent: ", err)
+			// With the state restored the agent can work without
+			// topology; heartbeats will register the host later.
+			if !restored {
+				return err
+			}
+		}
+		go a.heartbeatLoop(a.registration.interval, nil)
+	}
+	if !restored {
+		glog.Infof("Attempting to identify current host.")
+		if err := a.identifyCurrentHost(); err != nil {
+			glog.Error("Agent: ", agentError(err))
+			return agentError(err)
+		}
+	}
+
+	if err := a.selectHostInterface(); err != nil {
+		glog.Error("Agent: ", err)
+		return err
 	}
 
 	// Ensure we have all the routes to our neighbours
@@ -189,6 +394,66 @@ func (a *Agent) Initialize() error {
 		glog.Error("Agent: ", agentError(err))
 		return agentError(err)
 	}
+
+	// Not being able to monitor interfaces should not prevent
+	// the agent from provisioning them.
+	glog.Info("Agent: monitoring interfaces")
+	if err := a.linkMonitor.start(nil); err != nil {
+		glog.Error("Agent: cannot monitor interfaces: ", agentError(err))
+	}
+
+	if a.dhcp != nil {
+		glog.Info("Agent: starting DHCP server")
+		if err := a.dhcp.start(); err != nil {
+			glog.Error("Agent: ", err)
+			return err
+		}
+	}
+
+	if restored {
+		a.resumeEndpoints(endpoints)
+		go a.refreshNetworkConfig()
+	} else {
+		a.saveState()
+	}
+
+	if a.bgp != nil {
+		if err := a.startBGP(); err != nil {
+			glog.Error("Agent: ", err)
+			return err
+		}
+	}
+
+	go a.policyStatusLoop(policyStatusInterval, nil)
+
+	a.bus, err = common.NewEventBus(a.Name(), a.config.ServiceSpecific)
+	if err != nil {
+		glog.Error("Agent: ", err)
+		return err
+	}
+
+	if a.reconcileInterval > 0 {
+		go a.reconcileLoop(a.reconcileInterval, nil)
+		if a.watchTopology && a.bus != nil && features.Enabled(a.Name(), "push_events") {
+			if err := followBusHostEvents(a.bus, a.reconcileRoutes, nil); err != nil {
+				glog.Error("Agent: ", err)
+				return err
+			}
+		} else if a.watchTopology {
+			go a.watchHostEvents(nil)
+		}
+	}
+
+	if a.gracefulRestart {
+		common.AddShutdownHook(a.shutdown)
+	}
+
+	if a.dockerPluginSocket != "" {
+		if err := a.serveDockerPlugin(a.dockerPluginSocket); err != nil {
+			glog.Error("Agent: ", agentError(err))
+			return agentError(err)
+		}
+	}
 	return nil
 }
 
@@ -32,6 +32,8 @@ func main() {
 	var version = flag.Bool("version", false, "Build Information.")
 	username := flag.String("username", "", "Username")
 	password := flag.String("password", "", "Password")
+	dockerPlugin := flag.Bool("dockerPlugin", false, "Serve Docker network and IPAM driver plugin API")
+	dockerPluginSocket := flag.String("dockerPluginSocket", agent.DefaultDockerPluginSocket, "Unix socket to serve Docker plugin API on")
 
 	flag.Parse()
 
@@ -53,7 +55,11 @@ func main() {
 		return
 	}
 	cred := common.MakeCredentialFromCliArgs(*username, *password)
-	svcInfo, err := agent.Run(*rootURL, cred, false)
+	socket := ""
+	if *dockerPlugin {
+		socket = *dockerPluginSocket
+	}
+	svcInfo, err := agent.RunWithDockerPlugin(*rootURL, cred, false, socket)
 	if err != nil {
 		panic(err)
 	}
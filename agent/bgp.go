@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Advertisement of the host's Romana CIDR via BGP, so that routes to
+// hosts do not have to be configured on the network fabric. If
+// bgp_asn is configured, the agent establishes sessions with
+//
+//   bgp_peers        - list of peers, each with address (IP address,
+//                      optionally with a port) and asn
+//
+// and announces the Romana CIDR of the host with the host's IP as
+// the next hop and the communities in bgp_communities (as ASN:value,
+// or no-export or no-advertise), if any. bgp_router_id defaults to
+// the host's IP, bgp_hold_time to 90 seconds.
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/pkg/util/bgp"
+)
+
+// bgpConfig is the configuration of BGP advertisement.
+type bgpConfig struct {
+	asn         uint32
+	routerID    net.IP
+	holdTime    time.Duration
+	peers       []bgp.Peer
+	communities []uint32
+}
+
+// parseASN parses an AS number from JSON configuration.
+func parseASN(key string, value interface{}) (uint32, error) {
+	asn, ok := value.(float64)
+	if !ok || asn < 1 || asn > 0xffffffff || asn != float64(uint32(asn)) {
+		return 0, agentErrorString(fmt.Sprintf("Invalid %s %v", key, value))
+	}
+	return uint32(asn), nil
+}
+
+// parseBGPConfig returns the configuration of BGP advertisement,
+// or nil if the Romana CIDR should not be advertised.
+func parseBGPConfig(serviceSpecific map[string]interface{}) (*bgpConfig, error) {
+	value, ok := serviceSpecific["bgp_asn"]
+	if !ok {
+		return nil, nil
+	}
+	var err error
+	config := &bgpConfig{holdTime: bgp.DefaultHoldTime}
+	config.asn, err = parseASN("bgp_asn", value)
+	if err != nil {
+		return nil, err
+	}
+	if routerID, ok := serviceSpecific["bgp_router_id"].(string); ok {
+		config.routerID = net.ParseIP(routerID).To4()
+		if config.routerID == nil {
+			return nil, agentErrorString(fmt.Sprintf("Invalid bgp_router_id %s", routerID))
+		}
+	}
+	if seconds, ok := serviceSpecific["bgp_hold_time"].(float64); ok {
+		if seconds != 0 && (seconds < 3 || seconds > 65535) {
+			return nil, agentErrorString(fmt.Sprintf("Invalid bgp_hold_time %v", seconds))
+		}
+		config.holdTime = time.Duration(seconds) * time.Second
+	}
+	peers, _ := serviceSpecific["bgp_peers"].([]interface{})
+	if len(peers) == 0 {
+		return nil, agentErrorString("bgp_asn is configured, but bgp_peers are not")
+	}
+	for _, p := range peers {
+		peerMap, _ := p.(map[string]interface{})
+		address, _ := peerMap["address"].(string)
+		if address == "" {
+			return nil, agentErrorString(fmt.Sprintf("Invalid BGP peer %v, expected address and asn", p))
+		}
+		peer := bgp.Peer{Address: address}
+		peer.ASN, err = parseASN("asn of BGP peer "+address, peerMap["asn"])
+		if err != nil {
+			return nil, err
+		}
+		config.peers = append(config.peers, peer)
+	}
+	communities, _ := serviceSpecific["bgp_communities"].([]interface{})
+	for _, c := range communities {
+		s, _ := c.(string)
+		community, err := bgp.ParseCommunity(s)
+		if err != nil {
+			return nil, agentError(err)
+		}
+		config.communities = append(config.communities, community)
+	}
+	return config, nil
+}
+
+// bgpRoute returns the route to the current host to advertise.
+func (a *Agent) bgpRoute() (bgp.Route, error) {
+	host := a.networkConfig.currentHost
+	_, prefix, err := net.ParseCIDR(host.RomanaIp)
+	if err != nil {
+		return bgp.Route{}, agentErrorString(fmt.Sprintf("Invalid Romana CIDR %s of host %s", host.RomanaIp, host.Name))
+	}
+	nextHop := net.ParseIP(host.Ip).To4()
+	if nextHop == nil {
+		return bgp.Route{}, agentErrorString(fmt.Sprintf("Invalid IP %s of host %s", host.Ip, host.Name))
+	}
+	return bgp.Route{Prefix: prefix, NextHop: nextHop, Communities: a.bgp.communities}, nil
+}
+
+// startBGP starts advertising the Romana CIDR of the current host.
+func (a *Agent) startBGP() error {
+	route, err := a.bgpRoute()
+	if err != nil {
+		return err
+	}
+	routerID := a.bgp.routerID
+	if routerID == nil {
+		routerID = route.NextHop
+	}
+	a.bgpSpeaker, err = bgp.NewSpeaker(a.bgp.asn, routerID, a.bgp.holdTime)
+	if err != nil {
+		return agentError(err)
+	}
+	a.bgpSpeaker.Announce(route)
+	for _, peer := range a.bgp.peers {
+		if err := a.bgpSpeaker.AddPeer(peer); err != nil {
+			return agentError(err)
+		}
+	}
+	glog.Infof("Agent: advertising %s via BGP to %d peer(s)", route.Prefix, len(a.bgp.peers))
+	return nil
+}
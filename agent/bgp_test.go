@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+func TestBGP(t *testing.T) {
+	config, err := parseBGPConfig(map[string]interface{}{})
+	if config != nil || err != nil {
+		t.Errorf("Expected BGP disabled, got %v, %v", config, err)
+	}
+	for _, invalid := range []map[string]interface{}{
+		{"bgp_asn": float64(65001)},
+		{"bgp_asn": float64(0), "bgp_peers": []interface{}{map[string]interface{}{"address": "192.168.0.1", "asn": float64(65000)}}},
+		{"bgp_asn": float64(65001), "bgp_peers": []interface{}{map[string]interface{}{"address": "192.168.0.1"}}},
+		{"bgp_asn": float64(65001), "bgp_peers": []interface{}{"192.168.0.1"}},
+		{"bgp_asn": float64(65001), "bgp_hold_time": float64(1)},
+	} {
+		if _, err := parseBGPConfig(invalid); err == nil {
+			t.Errorf("Expected error for %v", invalid)
+		}
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.bgp, err = parseBGPConfig(map[string]interface{}{
+		"bgp_asn":         float64(65001),
+		"bgp_peers":       []interface{}{map[string]interface{}{"address": "192.168.0.1", "asn": float64(65000)}},
+		"bgp_communities": []interface{}{"65000:100", "no-export"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.bgp.holdTime != 90*time.Second || len(agent.bgp.peers) != 1 || agent.bgp.peers[0].ASN != 65000 {
+		t.Errorf("Unexpected BGP configuration %+v", agent.bgp)
+	}
+	agent.networkConfig.currentHost = common.Host{Name: "host1", Ip: "192.168.0.11", RomanaIp: "10.64.0.1/16"}
+	route, err := agent.bgpRoute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Prefix.String() != "10.64.0.0/16" || route.NextHop.String() != "192.168.0.11" {
+		t.Errorf("Expected route to 10.64.0.0/16 via 192.168.0.11, got %v", route)
+	}
+	if !reflect.DeepEqual(route.Communities, []uint32{65000<<16 | 100, 0xFFFFFF01}) {
+		t.Errorf("Unexpected communities %v", route.Communities)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Bulk provisioning of endpoints. Provisioning a large batch of VMs
+// or pods one HTTP request at a time serializes on the client; a bulk
+// request instead hands the agent the whole batch, which provisions
+// the endpoints with a pool of workers and responds once all of them
+// are done, with the outcome for each.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+)
+
+// Number of endpoints provisioned concurrently, unless
+// configured with provision_workers.
+const defaultProvisionWorkers = 8
+
+// BulkEndpoint is an endpoint in a BulkProvisionRequest.
+type BulkEndpoint struct {
+	// Kind of the endpoint, "pod" or "vm".
+	Kind  string `json:"kind"`
+	NetIf NetIf  `json:"net_if"`
+	// Options as in NetworkRequest, for pods.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// BulkProvisionRequest is sent to the agent to provision
+// a number of endpoints at once.
+type BulkProvisionRequest struct {
+	Endpoints []BulkEndpoint `json:"endpoints"`
+}
+
+// BulkEndpointResult is the outcome of provisioning
+// one endpoint of a BulkProvisionRequest.
+type BulkEndpointResult struct {
+	Name string `json:"interface_name"`
+	Kind string `json:"kind"`
+	// Empty if the endpoint was provisioned.
+	Error string `json:"error,omitempty"`
+}
+
+// BulkProvisionResponse lists the outcome for each endpoint,
+// in the order of the request.
+type BulkProvisionResponse struct {
+	Results []BulkEndpointResult `json:"results"`
+}
+
+// parseEndpointKind returns the kind named as in the API.
+func parseEndpointKind(kind string) (endpointKind, error) {
+	switch kind {
+	case "pod":
+		return podEndpoint, nil
+	case "vm":
+		return vmEndpoint, nil
+	}
+	return podEndpoint, agentErrorString(fmt.Sprintf("Unknown kind of endpoint '%s'", kind))
+}
+
+// provisionEndpoint provisions the endpoint as appropriate for its kind.
+func (a *Agent) provisionEndpoint(ep provisionedEndpoint, options map[string]string) error {
+	if ep.kind == vmEndpoint {
+		return a.vmUpHandlerAsync(ep.netif)
+	}
+	return a.podUpHandlerAsync(NetworkRequest{NetIf: ep.netif, Options: options})
+}
+
+// bulkProvisionHandler handles HTTP requests to provision
+// a number of endpoints.
+func (a *Agent) bulkProvisionHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*BulkProvisionRequest)
+	glog.Infof("Agent: Got request to provision %d endpoint(s)", len(req.Endpoints))
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer a.requests.end()
+	jobs := make([]func() error, len(req.Endpoints))
+	results := make([]BulkEndpointResult, len(req.Endpoints))
+	for i, endpoint := range req.Endpoints {
+		endpoint := endpoint
+		results[i] = BulkEndpointResult{Name: endpoint.NetIf.Name, Kind: endpoint.Kind}
+		kind, err := parseEndpointKind(endpoint.Kind)
+		if err != nil {
+			jobs[i] = func() error { return err }
+			continue
+		}
+		jobs[i] = func() error {
+			// Do not start on endpoints the client has given up on.
+			if err := common.CheckContext(ctx.Context); err != nil {
+				return err
+			}
+			return a.provisionEndpoint(provisionedEndpoint{netif: endpoint.NetIf, kind: kind}, endpoint.Options)
+		}
+	}
+	for i, err := range a.runWorkers(jobs) {
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return BulkProvisionResponse{Results: results}, nil
+}
+
+// runWorkers runs the jobs with at most provisionWorkers of them
+// at a time, and returns their errors in the order of the jobs.
+func (a *Agent) runWorkers(jobs []func() error) []error {
+	errs := make([]error, len(jobs))
+	workers := a.provisionWorkers
+	if workers <= 0 {
+		workers = defaultProvisionWorkers
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	a.metrics.queueDepth.Add(float64(len(jobs)))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = jobs[i]()
+				a.metrics.queueDepth.Add(-1)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
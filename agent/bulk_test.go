@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// TestBulkProvision is checking that endpoints of a bulk request are
+// provisioned by a limited number of workers, with results reported
+// in the order of the request.
+func TestBulkProvision(t *testing.T) {
+	agent := mockAgent()
+	agent.provisionWorkers = 3
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	jobs := make([]func() error, 10)
+	for i := range jobs {
+		i := i
+		jobs[i] = func() error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if i%2 == 1 {
+				return fmt.Errorf("job %d failed", i)
+			}
+			return nil
+		}
+	}
+	errs := agent.runWorkers(jobs)
+	for i, err := range errs {
+		if (i%2 == 1) != (err != nil) || (err != nil && err.Error() != fmt.Sprintf("job %d failed", i)) {
+			t.Errorf("Unexpected error of job %d: %v", i, err)
+		}
+	}
+	if maxRunning != 3 {
+		t.Errorf("Expected 3 jobs to run at once, got %d", maxRunning)
+	}
+	if depth := agent.metrics.queueDepth.Value(); depth != 0 {
+		t.Errorf("Expected empty queue, got %v", depth)
+	}
+
+	// Endpoints of an unknown kind, or left after the request
+	// is gone, fail without being provisioned.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := &BulkProvisionRequest{Endpoints: []BulkEndpoint{
+		{Kind: "vm", NetIf: NetIf{Name: "tap1"}},
+		{Kind: "container", NetIf: NetIf{Name: "veth1"}},
+	}}
+	resp, err := agent.bulkProvisionHandler(req, common.RestContext{Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := resp.(BulkProvisionResponse).Results
+	if len(results) != 2 || results[0].Name != "tap1" || results[0].Kind != "vm" || results[1].Name != "veth1" {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	if !strings.Contains(results[0].Error, "canceled") {
+		t.Errorf("Expected tap1 to be canceled, got %s", results[0].Error)
+	}
+	if !strings.Contains(results[1].Error, "Unknown kind of endpoint 'container'") {
+		t.Errorf("Expected veth1 to be of unknown kind, got %s", results[1].Error)
+	}
+}
@@ -18,6 +18,7 @@ package agent
 import (
 	"github.com/golang/glog"
 	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
 	"net"
 )
 
@@ -29,10 +30,15 @@ import (
 // firewall.NetConfig interface.
 type NetworkConfig struct {
 	// Current host network configuration
+	currentHost  common.Host
 	romanaGW     net.IP
 	romanaGWMask net.IPMask
 	otherHosts   []common.Host
 	dc           common.Datacenter
+	// Interface and address to route to other hosts through,
+	// if selected in configuration (see interfaces.go).
+	hostLink string
+	hostAddr net.IP
 }
 
 // EndpointNetmaskSize returns integer value (aka size) of endpoint netmask.
@@ -109,12 +115,18 @@ func (a Agent) identifyCurrentHost() error {
 	}
 	glog.Infoln("Retrieved hosts list, found", len(hosts), "hosts")
 
-	addrs, err := net.InterfaceAddrs()
+	addrs, err := a.Helper.Netlink.AddrList()
 	if err != nil {
 		return err
 	}
+	return a.networkConfig.matchCurrentHost(hosts, addrs, a.gatewaySelector)
+}
 
-	glog.Infof("Searching %d interfaces for a matching host configuration: %v", len(addrs), addrs)
+// matchCurrentHost finds the host whose Romana CIDR contains one of
+// the addresses matching the selector, and stores that address as
+// the romana gateway. The rest of the hosts are retained as other hosts.
+func (c *NetworkConfig) matchCurrentHost(hosts []common.Host, addrs []utilnetlink.Addr, selector addrSelector) error {
+	glog.Infof("Searching %d addresses matching %s for a matching host configuration: %v", len(addrs), selector, addrs)
 
 	// Find an interface that matches a Romana CIDR
 	// and store that interface's IP address.
@@ -126,10 +138,10 @@ func (a Agent) identifyCurrentHost() error {
 			continue
 		}
 		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if !ok {
+			if !selector.matches(addr) {
 				continue
 			}
+			ipnet := addr.IPNet
 			if romanaCIDR.Contains(ipnet.IP) {
 				// Check that it's the same subnet size
 				s1, _ := romanaCIDR.Mask.Size()
@@ -138,13 +150,14 @@ func (a Agent) identifyCurrentHost() error {
 					continue
 				}
 				// OK, we're happy with this result
-				a.networkConfig.romanaGW = ipnet.IP
-				a.networkConfig.romanaGWMask = ipnet.Mask
+				c.currentHost = host
+				c.romanaGW = ipnet.IP
+				c.romanaGWMask = ipnet.Mask
 				// Retain the other hosts that were listed.
 				// This will be used for creating inter-host routes.
-				a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[0:i]...)
-				a.networkConfig.otherHosts = append(a.networkConfig.otherHosts, hosts[i+1:]...)
-				glog.Infoln("Found match for CIDR", romanaCIDR, "using address", ipnet.IP)
+				c.otherHosts = append(c.otherHosts, hosts[0:i]...)
+				c.otherHosts = append(c.otherHosts, hosts[i+1:]...)
+				glog.Infoln("Found match for CIDR", romanaCIDR, "using address", ipnet.IP, "on", addr.LinkName)
 				return nil
 			}
 		}
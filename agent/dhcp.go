@@ -0,0 +1,287 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Managed DHCP server. By default the agent expects a DHCP server for
+// VMs to be running already, and only adds static leases to lease_file.
+// When configured with
+//
+//   dhcp: managed
+//   dhcp_dir: /var/lib/romana/dhcp   # optional
+//   dnsmasq: /usr/sbin/dnsmasq       # optional
+//
+// the agent runs dnsmasq itself, with configuration, static hosts,
+// leases and pid files in dhcp_dir. Every VM endpoint gets a static
+// lease for the address IPAM allocated to it, and dnsmasq is reloaded
+// whenever the endpoints change. Requests arriving on VM interfaces
+// are answered as if they arrived on the interface with the romana
+// gateway address, which the VMs use as their default router.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultDhcpDir = "/var/lib/romana/dhcp"
+	defaultDnsmasq = "dnsmasq"
+	// Interfaces of VMs, as created by the OpenStack driver.
+	vmInterfaces = "tap*"
+)
+
+// dhcpServer is a dnsmasq instance managed by the agent.
+type dhcpServer struct {
+	sync.Mutex
+	agent      *Agent
+	executable string
+	dir        string
+	// Name of the interface with the romana gateway address,
+	// found when the server is started unless set.
+	gatewayLink string
+	// Static leases, IP addresses by MAC address.
+	hosts map[string]net.IP
+	// signal sends a signal to the process. It is a field
+	// so that tests can replace it.
+	signal func(pid int, sig syscall.Signal) error
+}
+
+// parseDhcpConfig returns the DHCP server to manage according to
+// the agent configuration, or nil if DHCP is managed externally.
+func parseDhcpConfig(serviceSpecific map[string]interface{}, agent *Agent) (*dhcpServer, error) {
+	switch mode := serviceSpecific["dhcp"]; mode {
+	case nil, "", "external":
+		return nil, nil
+	case "managed":
+	default:
+		return nil, agentErrorString(fmt.Sprintf("Unknown dhcp mode %v", mode))
+	}
+	d := &dhcpServer{
+		agent:      agent,
+		executable: defaultDnsmasq,
+		dir:        defaultDhcpDir,
+		hosts:      make(map[string]net.IP),
+		signal: func(pid int, sig syscall.Signal) error {
+			return agent.Helper.OS.Signal(pid, sig)
+		},
+	}
+	if dir, ok := serviceSpecific["dhcp_dir"].(string); ok && dir != "" {
+		d.dir = dir
+	}
+	if executable, ok := serviceSpecific["dnsmasq"].(string); ok && executable != "" {
+		d.executable = executable
+	}
+	return d, nil
+}
+
+func (d *dhcpServer) configFile() string { return filepath.Join(d.dir, "dnsmasq.conf") }
+func (d *dhcpServer) hostsFile() string  { return filepath.Join(d.dir, "dnsmasq.hosts") }
+func (d *dhcpServer) leaseFile() string  { return filepath.Join(d.dir, "dnsmasq.leases") }
+func (d *dhcpServer) pidFile() string    { return filepath.Join(d.dir, "dnsmasq.pid") }
+
+// config returns the content of the dnsmasq configuration file.
+func (d *dhcpServer) config() string {
+	gw := d.agent.networkConfig.RomanaGW()
+	mask := d.agent.networkConfig.RomanaGWMask()
+	lines := []string{
+		"# Generated by romana agent, changes will be lost.",
+		// DNS is not served.
+		"port=0",
+		"bind-dynamic",
+		"interface=" + d.gatewayLink,
+		"bridge-interface=" + d.gatewayLink + "," + vmInterfaces,
+		"dhcp-authoritative",
+		fmt.Sprintf("dhcp-range=%s,static,%s", gw.Mask(mask), net.IP(mask)),
+		fmt.Sprintf("dhcp-option=option:router,%s", gw),
+		"dhcp-hostsfile=" + d.hostsFile(),
+		"dhcp-leasefile=" + d.leaseFile(),
+		"pid-file=" + d.pidFile(),
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// start (re)starts dnsmasq with freshly generated configuration,
+// keeping static leases from the previous run. If dnsmasq is already
+// running with the same configuration, it is only reloaded.
+func (d *dhcpServer) start() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.gatewayLink == "" {
+		d.gatewayLink = gatewayLinkName(d.agent.networkConfig.RomanaGW())
+		if d.gatewayLink == "" {
+			return agentErrorString(fmt.Sprintf("No interface with romana gateway address %s to serve DHCP on", d.agent.networkConfig.RomanaGW()))
+		}
+	}
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return agentError(err)
+	}
+	if err := d.readHosts(); err != nil {
+		return agentError(err)
+	}
+	config := d.config()
+	if pid, err := d.pid(); err == nil {
+		// An agent restarting does not need to disturb dnsmasq.
+		if old, err := ioutil.ReadFile(d.configFile()); err == nil && string(old) == config {
+			glog.Infof("Agent: dnsmasq (pid %d) is already running with current configuration", pid)
+			return d.reload()
+		}
+		glog.Infof("Agent: stopping dnsmasq (pid %d) left from a previous run", pid)
+		if err := d.signal(pid, syscall.SIGTERM); err != nil {
+			glog.Warningf("Agent: cannot stop dnsmasq (pid %d): %s", pid, err)
+		}
+		os.Remove(d.pidFile())
+	}
+	if err := d.writeFile(d.hostsFile(), d.hostsContent()); err != nil {
+		return agentError(err)
+	}
+	if err := d.writeFile(d.configFile(), config); err != nil {
+		return agentError(err)
+	}
+	// dnsmasq daemonizes, so this returns once it is running.
+	args := []string{"--conf-file=" + d.configFile()}
+	if out, err := d.agent.Helper.Executor.Exec(d.executable, args); err != nil {
+		glog.Errorf("Agent: dnsmasq failed: %s", out)
+		return shelloutError(err, d.executable, args)
+	}
+	glog.Infof("Agent: started dnsmasq with configuration in %s", d.configFile())
+	return nil
+}
+
+// pid returns the pid of running dnsmasq.
+func (d *dhcpServer) pid() (int, error) {
+	data, err := ioutil.ReadFile(d.pidFile())
+	if err != nil {
+		return -1, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, err
+	}
+	// Signal 0 only checks that the process exists.
+	if err := d.signal(pid, 0); err != nil {
+		return -1, err
+	}
+	return pid, nil
+}
+
+// addHost adds a static lease for the endpoint and reloads dnsmasq.
+func (d *dhcpServer) addHost(netif NetIf) error {
+	mac := strings.ToLower(netif.Mac)
+	if _, err := net.ParseMAC(mac); err != nil {
+		return agentErrorString(fmt.Sprintf("Invalid MAC address %s of %s", netif.Mac, netif.Name))
+	}
+	d.Lock()
+	defer d.Unlock()
+	if ip, ok := d.hosts[mac]; ok && ip.Equal(netif.IP) {
+		return nil
+	}
+	d.hosts[mac] = netif.IP
+	return d.reload()
+}
+
+// removeHost removes the static lease of the endpoint and reloads
+// dnsmasq.
+func (d *dhcpServer) removeHost(netif NetIf) error {
+	mac := strings.ToLower(netif.Mac)
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.hosts[mac]; !ok {
+		return nil
+	}
+	delete(d.hosts, mac)
+	return d.reload()
+}
+
+// reload writes static leases and makes dnsmasq read them.
+// Must be called with the lock held.
+func (d *dhcpServer) reload() error {
+	if err := d.writeFile(d.hostsFile(), d.hostsContent()); err != nil {
+		return agentError(err)
+	}
+	pid, err := d.pid()
+	if err != nil {
+		return agentErrorString(fmt.Sprintf("dnsmasq is not running: %s", err))
+	}
+	if err := d.signal(pid, syscall.SIGHUP); err != nil {
+		return agentError(err)
+	}
+	return nil
+}
+
+// hostsContent returns static leases in dhcp-hostsfile format.
+func (d *dhcpServer) hostsContent() string {
+	var lines []string
+	for mac, ip := range d.hosts {
+		lines = append(lines, fmt.Sprintf("%s,%s", mac, ip))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// readHosts adds static leases from the hosts file, if it exists.
+func (d *dhcpServer) readHosts() error {
+	file, err := os.Open(d.hostsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(fields) != 2 {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			d.hosts[fields[0]] = ip
+		}
+	}
+	return scanner.Err()
+}
+
+// writeFile replaces the file, so that dnsmasq never reads
+// it half-written.
+func (d *dhcpServer) writeFile(path string, content string) error {
+	tmpFile := path + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// provisionLease provisions a static DHCP lease for the endpoint,
+// with the managed DHCP server if any, or in the lease file.
+func (a *Agent) provisionLease(netif *NetIf) error {
+	if a.dhcp != nil {
+		return a.dhcp.addHost(*netif)
+	}
+	return a.leaseFile.provisionLease(netif)
+}
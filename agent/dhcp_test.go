@@ -0,0 +1,145 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+	utilos "github.com/romana/core/pkg/util/os"
+)
+
+// TestDhcpServer is checking that the managed dnsmasq is configured
+// and reloaded with static leases of VM endpoints.
+func TestDhcpServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := parseDhcpConfig(map[string]interface{}{"dhcp": "bootp"}, nil); err == nil {
+		t.Error("Expected error for unknown dhcp mode")
+	}
+	if d, err := parseDhcpConfig(map[string]interface{}{}, nil); d != nil || err != nil {
+		t.Errorf("Expected no managed DHCP server by default, got %v, %v", d, err)
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.networkConfig.romanaGW = net.ParseIP("10.64.0.1")
+	agent.networkConfig.romanaGWMask = net.CIDRMask(16, 32)
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+	agent.dhcp, err = parseDhcpConfig(map[string]interface{}{"dhcp": "managed", "dhcp_dir": dir}, &agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := agent.dhcp
+	d.gatewayLink = "romana-gw"
+	var signals []syscall.Signal
+	d.signal = func(pid int, sig syscall.Signal) error {
+		if pid != 4242 {
+			return fmt.Errorf("No process %d", pid)
+		}
+		signals = append(signals, sig)
+		return nil
+	}
+
+	// Leases from a previous run are kept.
+	ioutil.WriteFile(d.hostsFile(), []byte("52:54:00:00:00:01,10.64.0.3\n"), 0644)
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	expectCmd := "dnsmasq --conf-file=" + filepath.Join(dir, "dnsmasq.conf")
+	if *exec.Commands != expectCmd {
+		t.Errorf("Expected %s, got %s", expectCmd, *exec.Commands)
+	}
+	config, _ := ioutil.ReadFile(d.configFile())
+	for _, line := range []string{
+		"bridge-interface=romana-gw,tap*",
+		"dhcp-range=10.64.0.0,static,255.255.0.0",
+		"dhcp-option=option:router,10.64.0.1",
+		"dhcp-leasefile=" + filepath.Join(dir, "dnsmasq.leases"),
+	} {
+		if !strings.Contains(string(config), line+"\n") {
+			t.Errorf("Expected %s in configuration:\n%s", line, config)
+		}
+	}
+
+	netif := NetIf{Name: "tap1", Mac: "52:54:00:00:00:02", IP: net.ParseIP("10.64.0.19")}
+	if err := agent.provisionLease(&netif); err == nil {
+		t.Error("Expected error with dnsmasq not running")
+	}
+	ioutil.WriteFile(d.pidFile(), []byte("4242\n"), 0644)
+	netif.Mac = "52:54:00:00:00:03"
+	if err := agent.provisionLease(&netif); err != nil {
+		t.Fatal(err)
+	}
+	hosts, _ := ioutil.ReadFile(d.hostsFile())
+	expect := "52:54:00:00:00:01,10.64.0.3\n52:54:00:00:00:02,10.64.0.19\n52:54:00:00:00:03,10.64.0.19\n"
+	if string(hosts) != expect {
+		t.Errorf("Expected hosts\n%s, got\n%s", expect, hosts)
+	}
+	if err := d.removeHost(NetIf{Mac: "52:54:00:00:00:01"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.removeHost(NetIf{Mac: "52:54:00:00:00:01"}); err != nil {
+		t.Fatal(err)
+	}
+	hosts, _ = ioutil.ReadFile(d.hostsFile())
+	expect = "52:54:00:00:00:02,10.64.0.19\n52:54:00:00:00:03,10.64.0.19\n"
+	if string(hosts) != expect {
+		t.Errorf("Expected hosts\n%s, got\n%s", expect, hosts)
+	}
+	if fmt.Sprint(signals) != fmt.Sprint([]syscall.Signal{0, syscall.SIGHUP, 0, syscall.SIGHUP}) {
+		t.Errorf("Unexpected signals %v", signals)
+	}
+
+	// A restarted agent only reloads dnsmasq running
+	// with the same configuration.
+	signals = nil
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	if *exec.Commands != expectCmd {
+		t.Errorf("Expected dnsmasq not to be started again, got %s", *exec.Commands)
+	}
+	if fmt.Sprint(signals) != fmt.Sprint([]syscall.Signal{0, 0, syscall.SIGHUP}) {
+		t.Errorf("Unexpected signals %v", signals)
+	}
+}
+
+// TestSendSighup is checking that sendSighup signals the process
+// through the OS interface.
+func TestSendSighup(t *testing.T) {
+	fOS := &utilos.FakeOS{}
+	helper := Helper{OS: fOS}
+
+	if err := helper.sendSighup(1); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(fOS.Signals) != fmt.Sprint([]syscall.Signal{syscall.SIGHUP}) {
+		t.Errorf("Expected SIGHUP to be sent, got %v", fOS.Signals)
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Docker libnetwork remote driver. When enabled (see
+// RunWithDockerPlugin), the agent serves the network and IPAM driver
+// plugin API on a unix socket, so that containers on plain Docker
+// hosts can be attached to Romana segments:
+//
+//   docker network create -d romana --ipam-driver romana \
+//       --ipam-opt tenant=t1 --ipam-opt segment=s1 t1-s1
+//
+// Addresses are allocated by the ipam service; the interfaces are
+// set up the same way as for pods (see podUpHandlerAsync).
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultDockerPluginSocket is where Docker looks for the plugin
+	// named "romana".
+	DefaultDockerPluginSocket = "/run/docker/plugins/romana.sock"
+
+	dockerPluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+	// The only address space there is.
+	dockerAddressSpace = "romana"
+
+	// Option of RequestAddress marking request for the gateway address.
+	dockerGatewayAddressType = "com.docker.network.gateway"
+)
+
+// dockerDriver implements libnetwork remote network and IPAM drivers.
+type dockerDriver struct {
+	agent *Agent
+	sync.Mutex
+	// Addresses of endpoints, by endpoint ID.
+	endpoints map[string]net.IP
+}
+
+// Requests and responses of the plugin API that we use.
+type dockerPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type dockerPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type dockerAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type dockerAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type dockerEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *struct {
+		Address     string
+		AddressIPv6 string
+		MacAddress  string
+	}
+	Options map[string]interface{}
+}
+
+type dockerJoinRequest struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Options    map[string]interface{}
+}
+
+type dockerJoinResponse struct {
+	InterfaceName struct {
+		SrcName   string
+		DstPrefix string
+	}
+	Gateway string
+}
+
+type dockerErrorResponse struct {
+	Err string
+}
+
+// serveDockerPlugin serves the plugin API on the unix socket.
+func (a *Agent) serveDockerPlugin(socketPath string) error {
+	d := &dockerDriver{agent: a, endpoints: make(map[string]net.IP)}
+	err := os.MkdirAll(filepath.Dir(socketPath), 0755)
+	if err != nil {
+		return err
+	}
+	// Left over from a previous run.
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Agent: serving Docker plugin API on %s", socketPath)
+	go func() {
+		err := http.Serve(listener, d.mux())
+		glog.Errorf("Agent: Docker plugin API stopped: %s", err)
+	}()
+	return nil
+}
+
+// mux routes plugin API calls to handlers.
+func (d *dockerDriver) mux() *http.ServeMux {
+	handlers := map[string]func(data []byte) (interface{}, error){
+		"/Plugin.Activate": func([]byte) (interface{}, error) {
+			return map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}, nil
+		},
+		"/NetworkDriver.GetCapabilities": func([]byte) (interface{}, error) {
+			return map[string]string{"Scope": "local"}, nil
+		},
+		"/NetworkDriver.CreateNetwork":               d.noop,
+		"/NetworkDriver.DeleteNetwork":               d.noop,
+		"/NetworkDriver.CreateEndpoint":              d.createEndpoint,
+		"/NetworkDriver.DeleteEndpoint":              d.deleteEndpoint,
+		"/NetworkDriver.EndpointOperInfo":            d.endpointInfo,
+		"/NetworkDriver.Join":                        d.join,
+		"/NetworkDriver.Leave":                       d.leave,
+		"/NetworkDriver.DiscoverNew":                 d.noop,
+		"/NetworkDriver.DiscoverDelete":              d.noop,
+		"/NetworkDriver.ProgramExternalConnectivity": d.noop,
+		"/NetworkDriver.RevokeExternalConnectivity":  d.noop,
+		"/IpamDriver.GetCapabilities": func([]byte) (interface{}, error) {
+			return map[string]bool{"RequiresMACAddress": false}, nil
+		},
+		"/IpamDriver.GetDefaultAddressSpaces": func([]byte) (interface{}, error) {
+			return map[string]string{"LocalDefaultAddressSpace": dockerAddressSpace, "GlobalDefaultAddressSpace": dockerAddressSpace}, nil
+		},
+		"/IpamDriver.RequestPool":    d.requestPool,
+		"/IpamDriver.ReleasePool":    d.noop,
+		"/IpamDriver.RequestAddress": d.requestAddress,
+		"/IpamDriver.ReleaseAddress": d.releaseAddress,
+	}
+	mux := http.NewServeMux()
+	for path, handler := range handlers {
+		mux.Handle(path, dockerHandler(handler))
+	}
+	return mux
+}
+
+// dockerHandler adapts a plugin API handler to http.Handler.
+func dockerHandler(handler func(data []byte) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dockerPluginContentType)
+		data, err := ioutil.ReadAll(r.Body)
+		var result interface{}
+		if err == nil {
+			result, err = handler(data)
+		}
+		if err != nil {
+			glog.Errorf("Agent: Docker plugin %s: %s", r.URL.Path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			result = dockerErrorResponse{Err: err.Error()}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func (d *dockerDriver) noop(data []byte) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+// requestPool accepts a pool for the tenant and segment given as
+// options. The pool is the whole Romana CIDR; which addresses in it
+// the containers get is decided by ipam.
+func (d *dockerDriver) requestPool(data []byte) (interface{}, error) {
+	req := dockerPoolRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.V6 {
+		return nil, agentErrorString("IPv6 is not supported")
+	}
+	if req.Pool != "" || req.SubPool != "" {
+		return nil, agentErrorString("Pools are assigned by Romana and cannot be specified")
+	}
+	tenant := req.Options["tenant"]
+	segment := req.Options["segment"]
+	if tenant == "" || segment == "" || strings.Contains(tenant, "/") {
+		return nil, agentErrorString("Options tenant and segment are required (--ipam-opt tenant=... --ipam-opt segment=...)")
+	}
+	return dockerPoolResponse{PoolID: tenant + "/" + segment, Pool: d.agent.networkConfig.dc.Cidr}, nil
+}
+
+// poolPrefix returns the prefix length of the pool,
+// which is that of the Romana CIDR.
+func (d *dockerDriver) poolPrefix() (int, error) {
+	cidr, err := d.agent.networkConfig.PNetCIDR()
+	if err != nil {
+		return 0, err
+	}
+	prefix, _ := cidr.Mask.Size()
+	return prefix, nil
+}
+
+// requestAddress allocates an address from ipam, or returns the
+// Romana gateway of this host if the gateway address is requested.
+func (d *dockerDriver) requestAddress(data []byte) (interface{}, error) {
+	req := dockerAddressRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := d.poolPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if req.Options["RequestAddressType"] == dockerGatewayAddressType {
+		return dockerAddressResponse{Address: fmt.Sprintf("%s/%d", d.agent.networkConfig.RomanaGW(), prefix)}, nil
+	}
+	if req.Address != "" {
+		return nil, agentErrorString("Addresses are assigned by Romana and cannot be specified")
+	}
+	idx := strings.Index(req.PoolID, "/")
+	if idx < 0 {
+		return nil, agentErrorString(fmt.Sprintf("Unknown pool %s", req.PoolID))
+	}
+	client, err := common.NewRestClient(common.GetRestClientConfig(d.agent.config))
+	if err != nil {
+		return nil, err
+	}
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/allocateIP?tenantName=%s&segmentName=%s&hostName=%s",
+		strings.TrimRight(ipamURL, "/"), req.PoolID[0:idx], req.PoolID[idx+1:], d.agent.networkConfig.currentHost.Name)
+	endpoint := struct {
+		Ip string `json:"ip"`
+	}{}
+	err = client.Get(url, &endpoint)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Agent: allocated %s in pool %s", endpoint.Ip, req.PoolID)
+	return dockerAddressResponse{Address: fmt.Sprintf("%s/%d", endpoint.Ip, prefix)}, nil
+}
+
+// releaseAddress returns the address to ipam.
+func (d *dockerDriver) releaseAddress(data []byte) (interface{}, error) {
+	req := dockerAddressRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(req.Address).Equal(d.agent.networkConfig.RomanaGW()) {
+		return struct{}{}, nil
+	}
+	client, err := common.NewRestClient(common.GetRestClientConfig(d.agent.config))
+	if err != nil {
+		return nil, err
+	}
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, err
+	}
+	err = client.Delete(strings.TrimRight(ipamURL, "/")+"/endpoints/"+req.Address, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// createEndpoint remembers the address (allocated by requestAddress)
+// of the endpoint, for join.
+func (d *dockerDriver) createEndpoint(data []byte) (interface{}, error) {
+	req := dockerEndpointRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Interface == nil || req.Interface.Address == "" {
+		return nil, agentErrorString("Endpoint has no address, is the network using romana IPAM driver?")
+	}
+	ip, _, err := net.ParseCIDR(req.Interface.Address)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.endpoints[req.EndpointID] = ip
+	d.Unlock()
+	// The interface is as Docker requested, so nothing is returned.
+	return struct{}{}, nil
+}
+
+func (d *dockerDriver) deleteEndpoint(data []byte) (interface{}, error) {
+	req := dockerEndpointRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	delete(d.endpoints, req.EndpointID)
+	d.Unlock()
+	return struct{}{}, nil
+}
+
+func (d *dockerDriver) endpointInfo(data []byte) (interface{}, error) {
+	return map[string]interface{}{"Value": map[string]string{}}, nil
+}
+
+// endpointNetIf returns the interface on this host for the endpoint.
+func (d *dockerDriver) endpointNetIf(endpointID string) (NetIf, error) {
+	d.Lock()
+	ip, ok := d.endpoints[endpointID]
+	d.Unlock()
+	if !ok {
+		return NetIf{}, agentErrorString(fmt.Sprintf("Unknown endpoint %s", endpointID))
+	}
+	if len(endpointID) > 8 {
+		endpointID = endpointID[0:8]
+	}
+	return NetIf{Name: "romana" + endpointID, IP: ip}, nil
+}
+
+// join creates a veth pair for the endpoint, the end of which Docker
+// moves into the container, and sets up routes and firewall for the
+// other end as for pods.
+func (d *dockerDriver) join(data []byte) (interface{}, error) {
+	req := dockerJoinRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	netif, err := d.endpointNetIf(req.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.agent.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer d.agent.requests.end()
+	peer := netif.Name + "p"
+	nl := d.agent.Helper.Netlink
+	err = nl.VethAdd(netif.Name, peer)
+	if err != nil && !utilnetlink.IsExist(err) {
+		return nil, agentError(err)
+	}
+	err = nl.LinkSetUp(netif.Name)
+	if err == nil {
+		err = d.agent.podUpHandlerAsync(NetworkRequest{NetIf: netif})
+	}
+	if err != nil {
+		utilnetlink.EnsureLinkDeleted(nl, netif.Name)
+		return nil, err
+	}
+	resp := dockerJoinResponse{Gateway: d.agent.networkConfig.RomanaGW().String()}
+	resp.InterfaceName.SrcName = peer
+	resp.InterfaceName.DstPrefix = "eth"
+	return resp, nil
+}
+
+// leave removes firewall rules and interfaces of the endpoint.
+func (d *dockerDriver) leave(data []byte) (interface{}, error) {
+	req := dockerJoinRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	netif, err := d.endpointNetIf(req.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.agent.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer d.agent.requests.end()
+	fw, err := d.agent.newFirewall(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	err = fw.Cleanup(netif)
+	if err != nil {
+		return nil, err
+	}
+	d.agent.untrackEndpoint(netif)
+	// Deleting one end of the veth pair deletes the other.
+	err = utilnetlink.EnsureLinkDeleted(d.agent.Helper.Netlink, netif.Name)
+	if err != nil {
+		return nil, agentError(err)
+	}
+	return struct{}{}, nil
+}
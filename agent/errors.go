@@ -88,10 +88,6 @@ func ensureLineError(err error) error {
 	return NewError(EcodeShelloutFailed, fmt.Sprintf("Failed to provision static lease: %v", err))
 }
 
-func noSuchRouteError() error {
-	return NewError(EcodeShelloutFailed, fmt.Sprintf("ERROR: No such route"))
-}
-
 func wrongHostError() error {
 	return NewError(EcodeDefault, fmt.Sprintf("ERROR: Can't resolve internal IPs. It looks like we're running on the host outside of Romana config"))
 }
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Choice of what applies firewall rules of endpoints. iptables does,
+// unless firewall_provider is set to "recording": then rules are only
+// kept in memory by a firewall.Recorder, so that the agent can run
+// without root privileges or iptables, such as in CI, and changes to
+// rules it recorded are served at /firewall/operations.
+//
+// iptables commands of the agent are queued, to be run one at a time,
+// and wait for the xtables lock held by other programs of the host
+// (see firewall.IPtablesQueue).
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/romana/core/common"
+	utilexec "github.com/romana/core/pkg/util/exec"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+const (
+	firewallProviderIPtables  = "iptables"
+	firewallProviderRecording = "recording"
+
+	defaultIPtablesWait        = 5 * time.Second
+	defaultIPtablesLockRetries = 5
+)
+
+// parseFirewallProvider returns the recorder of firewall rules
+// if the recording provider is configured, nil for iptables.
+func parseFirewallProvider(serviceSpecific map[string]interface{}) (*firewall.Recorder, error) {
+	value, ok := serviceSpecific["firewall_provider"]
+	if !ok {
+		return nil, nil
+	}
+	switch value {
+	case firewallProviderIPtables:
+		return nil, nil
+	case firewallProviderRecording:
+		return firewall.NewRecorder(), nil
+	}
+	return nil, agentErrorString(fmt.Sprintf("Invalid firewall_provider %v, expected %s or %s", value, firewallProviderIPtables, firewallProviderRecording))
+}
+
+// parseIPtablesLock returns how long iptables commands wait for the
+// xtables lock (iptables_wait seconds, 0 to not pass -w to iptables
+// versions without it) and how many times commands still failing to
+// get it are run again (iptables_lock_retries).
+func parseIPtablesLock(serviceSpecific map[string]interface{}) (time.Duration, int, error) {
+	wait, retries := defaultIPtablesWait, defaultIPtablesLockRetries
+	if value, ok := serviceSpecific["iptables_wait"]; ok {
+		seconds, ok := value.(float64)
+		if !ok || seconds < 0 {
+			return 0, 0, agentErrorString(fmt.Sprintf("Invalid iptables_wait %v", value))
+		}
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+	if value, ok := serviceSpecific["iptables_lock_retries"]; ok {
+		n, ok := value.(float64)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return 0, 0, agentErrorString(fmt.Sprintf("Invalid iptables_lock_retries %v", value))
+		}
+		retries = int(n)
+	}
+	return wait, retries, nil
+}
+
+// newFirewall returns a firewall of the configured provider
+// whose database operations are abandoned once ctx is done.
+func (a *Agent) newFirewall(ctx context.Context) (firewall.Firewall, error) {
+	var executor utilexec.Executable = a.Helper.Executor
+	if a.firewallRecorder != nil {
+		executor = a.firewallRecorder
+	}
+	return firewall.NewFirewallWithContext(ctx, executor, firewall.NewDbRuleRepository(a.store), a.networkConfig)
+}
+
+// firewallOperationsHandler lists changes to firewall rules
+// recorded by the recording provider, oldest first.
+func (a *Agent) firewallOperationsHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if a.firewallRecorder == nil {
+		return nil, common.NewError400(fmt.Sprintf("Firewall operations are only recorded with firewall_provider %s", firewallProviderRecording))
+	}
+	return a.firewallRecorder.Operations(), nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+	utilexec "github.com/romana/core/pkg/util/exec"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+// TestFirewallProvider tests that with the recording provider,
+// rules are recorded instead of being applied with iptables.
+func TestFirewallProvider(t *testing.T) {
+	for _, tc := range []struct {
+		ss        map[string]interface{}
+		recording bool
+		ok        bool
+	}{
+		{map[string]interface{}{}, false, true},
+		{map[string]interface{}{"firewall_provider": "iptables"}, false, true},
+		{map[string]interface{}{"firewall_provider": "recording"}, true, true},
+		{map[string]interface{}{"firewall_provider": "nftables"}, false, false},
+	} {
+		recorder, err := parseFirewallProvider(tc.ss)
+		if (recorder != nil) != tc.recording || (err == nil) != tc.ok {
+			t.Errorf("Unexpected result for %v: %v, %v", tc.ss, recorder, err)
+		}
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+	agent.antiSpoofing = true
+	if _, err := agent.firewallOperationsHandler(nil, common.RestContext{}); err == nil {
+		t.Error("Expected error listing operations without recording provider")
+	}
+
+	agent.firewallRecorder = firewall.NewRecorder()
+	fw, err := agent.newFirewall(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	netif := NetIf{Name: "eth0.100", Mac: "02:00:0a:00:00:05", IP: net.ParseIP("10.0.0.5")}
+	if err := agent.protectEndpoint(fw, netif); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(*exec.Commands, "iptables") {
+		t.Errorf("Expected no iptables commands, got\n%s", *exec.Commands)
+	}
+	ops, err := agent.firewallOperationsHandler(nil, common.RestContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := ops.([]firewall.RuleOperation)
+	if len(recorded) != 5 || recorded[1].String() != "-I FORWARD -i eth0.100 ! -s 10.0.0.5/32 -j DROP" {
+		t.Errorf("Unexpected operations %v", recorded)
+	}
+}
+
+// TestIPtablesLock tests configuration of waiting for the xtables lock.
+func TestIPtablesLock(t *testing.T) {
+	for _, tc := range []struct {
+		ss      map[string]interface{}
+		wait    time.Duration
+		retries int
+		ok      bool
+	}{
+		{map[string]interface{}{}, defaultIPtablesWait, defaultIPtablesLockRetries, true},
+		{map[string]interface{}{"iptables_wait": 0.0, "iptables_lock_retries": 2.0}, 0, 2, true},
+		{map[string]interface{}{"iptables_wait": 10.0}, 10 * time.Second, defaultIPtablesLockRetries, true},
+		{map[string]interface{}{"iptables_wait": -1.0}, 0, 0, false},
+		{map[string]interface{}{"iptables_lock_retries": 1.5}, 0, 0, false},
+	} {
+		wait, retries, err := parseIPtablesLock(tc.ss)
+		if wait != tc.wait || retries != tc.retries || (err == nil) != tc.ok {
+			t.Errorf("Unexpected result for %v: %v, %v, %v", tc.ss, wait, retries, err)
+		}
+	}
+}
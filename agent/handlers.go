@@ -1,32 +1,17 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/romana/core/common"
 	"github.com/romana/core/pkg/util/firewall"
+	"time"
 )
 
-// addPolicy is a placeholder. TODO
-func (a *Agent) addPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
-	//	policy := input.(*common.Policy)
-	return nil, nil
-}
-
-// deletePolicy is a placeholder. TODO
-func (a *Agent) deletePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
-	//	policyId := ctx.PathVariables["policyID"]
-	return nil, nil
-}
-
-// listPolicies is a placeholder. TODO.
-func (a *Agent) listPolicies(input interface{}, ctx common.RestContext) (interface{}, error) {
-	return nil, nil
-}
-
 // statusHandler reports operational statistics.
 func (a *Agent) statusHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
-	fw, err := firewall.NewFirewall(a.Helper.Executor, a.store, a.networkConfig)
+	fw, err := a.newFirewall(ctx.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -43,10 +28,14 @@ func (a *Agent) podDownHandler(input interface{}, ctx common.RestContext) (inter
 	glog.V(1).Infoln("Agent: Entering podDownHandler()")
 	netReq := input.(*NetworkRequest)
 	netif := netReq.NetIf
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer a.requests.end()
 
 	// We need new firewall instance here to use it's Cleanup()
 	// to uninstall firewall rules related to the endpoint.
-	fw, err := firewall.NewFirewall(a.Helper.Executor, a.store, a.networkConfig)
+	fw, err := a.newFirewall(ctx.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +44,7 @@ func (a *Agent) podDownHandler(input interface{}, ctx common.RestContext) (inter
 	if err != nil {
 		return nil, err
 	}
+	a.untrackEndpoint(netif)
 
 	// Spawn new thread to process the request
 	glog.Infof("Agent: Got request for pod teardown %v\n", netReq)
@@ -72,7 +62,13 @@ func (a *Agent) podUpHandler(input interface{}, ctx common.RestContext) (interfa
 
 	// TODO don't know if fork-bombs are possible in go but if they are this
 	// need to be refactored as buffered channel with fixed pool of workers
-	go a.podUpHandlerAsync(*netReq)
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	a.metrics.enqueue(func() error {
+		defer a.requests.end()
+		return a.podUpHandlerAsync(*netReq)
+	})
 
 	// TODO I wonder if this should actually return something like a
 	// link to a status of this request which will later get updated
@@ -84,10 +80,14 @@ func (a *Agent) podUpHandler(input interface{}, ctx common.RestContext) (interfa
 func (a *Agent) vmDownHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
 	netif := input.(*NetIf)
 	glog.V(1).Infof("In vmDownHandler() with Name %s, IP %s Mac %s\n", netif.Name, netif.IP, netif.Mac)
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer a.requests.end()
 
 	// We need new firewall instance here to use it's Cleanup()
 	// to uninstall firewall rules related to the endpoint.
-	fw, err := firewall.NewFirewall(a.Helper.Executor, a.store, a.networkConfig)
+	fw, err := a.newFirewall(ctx.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +96,12 @@ func (a *Agent) vmDownHandler(input interface{}, ctx common.RestContext) (interf
 	if err != nil {
 		return nil, err
 	}
+	if a.dhcp != nil {
+		if err := a.dhcp.removeHost(*netif); err != nil {
+			glog.Errorf("Agent: cannot remove DHCP lease of %s: %s", netif.Name, err)
+		}
+	}
+	a.untrackEndpoint(*netif)
 
 	return "OK", nil
 }
@@ -111,7 +117,13 @@ func (a *Agent) vmUpHandler(input interface{}, ctx common.RestContext) (interfac
 
 	// TODO don't know if fork-bombs are possible in go but if they are this
 	// need to be refactored as buffered channel with fixed pool of workers
-	go a.vmUpHandlerAsync(*netif)
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	a.metrics.enqueue(func() error {
+		defer a.requests.end()
+		return a.vmUpHandlerAsync(*netif)
+	})
 
 	// TODO I wonder if this should actually return something like a
 	// link to a status of this request which will later get updated
@@ -124,8 +136,11 @@ func (a *Agent) vmUpHandler(input interface{}, ctx common.RestContext) (interfac
 // 1. Ensures interface is ready
 // 2. Creates ip route pointing new interface
 // 3. Provisions firewall rules
-func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
+// 4. Protects endpoint against spoofing
+func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) (err error) {
 	glog.V(1).Info("Agent: Entering podUpHandlerAsync()")
+	start := time.Now()
+	defer func() { a.metrics.observeProvision(podEndpoint, start, err) }()
 
 	netif := netReq.NetIf
 	if netif.Name == "" {
@@ -147,13 +162,15 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 	}
 
 	glog.Info("Agent: provisioning firewall")
-	fw, err := firewall.NewFirewall(a.Helper.Executor, a.store, a.networkConfig)
+	fw, err := a.newFirewall(context.Background())
 	if err != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 
 	if err1 := fw.Init(netif); err1 != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
@@ -191,10 +208,18 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 	fw.SetDefaultRules(defaultRules)
 
 	if err := fw.ProvisionEndpoint(); err != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 
+	if err := a.protectEndpoint(fw, netif); err != nil {
+		a.metrics.firewallFailures.Inc()
+		glog.Error(agentError(err))
+		return agentError(err)
+	}
+
+	a.trackEndpoint(netif, podEndpoint)
 	glog.Info("Agent: All good", netif)
 	return nil
 }
@@ -206,8 +231,11 @@ func (a *Agent) podUpHandlerAsync(netReq NetworkRequest) error {
 // 3. Creates ip route pointing new interface
 // 4. Provisions static DHCP lease for new interface
 // 5. Provisions firewall rules
-func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
+// 6. Protects endpoint against spoofing
+func (a *Agent) vmUpHandlerAsync(netif NetIf) (err error) {
 	glog.V(1).Info("Agent: Entering interfaceHandle()")
+	start := time.Now()
+	defer func() { a.metrics.observeProvision(vmEndpoint, start, err) }()
 	if !a.Helper.waitForIface(netif.Name) {
 		// TODO should we resubmit failed interface in queue for later
 		// retry ? ... considering oenstack will give up as well after
@@ -217,11 +245,13 @@ func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 
 	// dhcpPid is only needed here for fail fast check
 	// will try to poll the pid again in provisionLease
-	glog.Info("Agent: checking if DHCP is running")
-	_, err := a.Helper.DhcpPid()
-	if err != nil {
-		glog.Error(agentError(err))
-		return agentError(err)
+	if a.dhcp == nil {
+		glog.Info("Agent: checking if DHCP is running")
+		_, err = a.Helper.DhcpPid()
+		if err != nil {
+			glog.Error(agentError(err))
+			return agentError(err)
+		}
 	}
 	glog.Info("Agent: creating endpoint routes")
 	if err := a.Helper.ensureRouteToEndpoint(&netif); err != nil {
@@ -229,19 +259,21 @@ func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 		return agentError(err)
 	}
 	glog.Info("Agent: provisioning DHCP")
-	if err := a.leaseFile.provisionLease(&netif); err != nil {
+	if err := a.provisionLease(&netif); err != nil {
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 
 	glog.Info("Agent: provisioning firewall")
-	fw, err := firewall.NewFirewall(a.Helper.Executor, a.store, a.networkConfig)
+	fw, err := a.newFirewall(context.Background())
 	if err != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 
 	if err1 := fw.Init(netif); err1 != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
@@ -299,14 +331,23 @@ func (a *Agent) vmUpHandlerAsync(netif NetIf) error {
 	fw.SetDefaultRules(defaultRules)
 
 	if err := fw.ProvisionEndpoint(); err != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 	if err := fw.ProvisionEndpoint(); err != nil {
+		a.metrics.firewallFailures.Inc()
+		glog.Error(agentError(err))
+		return agentError(err)
+	}
+
+	if err := a.protectEndpoint(fw, netif); err != nil {
+		a.metrics.firewallFailures.Inc()
 		glog.Error(agentError(err))
 		return agentError(err)
 	}
 
+	a.trackEndpoint(netif, vmEndpoint)
 	glog.Info("All good", netif)
 	return nil
 }
@@ -22,23 +22,24 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	utilexec "github.com/romana/core/pkg/util/exec"
-	utilos "github.com/romana/core/pkg/util/os"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	"github.com/romana/core/pkg/util/platform"
 )
 
 // NewAgentHelper returns Helper with initialized default implementations
 // for all interfaces.
 func NewAgentHelper(agent *Agent) Helper {
 	helper := new(Helper)
-	helper.Executor = new(utilexec.DefaultExecutor)
-	helper.OS = new(utilos.DefaultOS)
+	p := platform.Default()
+	helper.Executor = p.Executor
+	helper.OS = p.OS
+	helper.Netlink = p.Netlink
 	helper.Agent = agent
 	helper.ensureLineMutex = &sync.Mutex{}
 	helper.ensureRouteToEndpointMutex = &sync.Mutex{}
@@ -47,16 +48,8 @@ func NewAgentHelper(agent *Agent) Helper {
 }
 
 // sendSighup is attempting to send SIGHUP signal to the process.
-// TODO Maybe mock os. and proc.
 func (h Helper) sendSighup(pid int) error {
-	proc, err := os.FindProcess(pid)
-	if err != nil {
-		return err
-	}
-	if err := proc.Signal(syscall.SIGHUP); err != nil {
-		return err
-	}
-	return nil
+	return h.OS.Signal(pid, syscall.SIGHUP)
 }
 
 // DhcpPid function checks if dnsmasq is running, it returns pid on succes
@@ -81,41 +74,9 @@ func (h Helper) DhcpPid() (int, error) {
 	return pid, nil
 }
 
-// isRouteExist checks if route exists, returns nil if it is and error otherwise.
-// Idea is - `ip ro show A.B.C.D/M` will came up empty if route does not exist.
-func (h Helper) isRouteExist(ip net.IP, netmask string) error {
-	cmd := "/sbin/ip"
-	target := fmt.Sprintf("%s/%v", ip, netmask)
-	args := []string{"ro", "show", target}
-	out, err := h.Executor.Exec(cmd, args)
-	if err != nil {
-		return shelloutError(err, cmd, args)
-	}
-
-	if l := len(out); l > 0 {
-		return nil // success
-	}
-
-	return noSuchRouteError()
-}
-
-// createRoute creates IP route, returns nil if success and error otherwise.
-func (h Helper) createRoute(ip net.IP, netmask string, via string, dest string, extraArgs ...string) error {
-	glog.Info("Helper: creating route")
-	cmd := "/sbin/ip"
-	targetIP := fmt.Sprintf("%s/%v", ip, netmask)
-	args := []string{"ro", "add", targetIP, via, dest}
-	args = append(args, extraArgs...)
-	if _, err := h.Executor.Exec(cmd, args); err != nil {
-		return shelloutError(err, cmd, args)
-	}
-	return nil // success
-}
-
 // ensureRouteToEndpoint verifies that ip route to endpoint interface exists, creates it otherwise.
 // Error if failed, nil if success.
 func (h Helper) ensureRouteToEndpoint(netif *NetIf) error {
-	mask := fmt.Sprintf("%d", h.Agent.networkConfig.EndpointNetmaskSize())
 	glog.V(1).Infoln("Ensuring routes for ", netif.IP, " ", netif.Name)
 	glog.V(1).Info("Acquiring mutex ensureRouteToEndpoint")
 	h.ensureRouteToEndpointMutex.Lock()
@@ -124,17 +85,15 @@ func (h Helper) ensureRouteToEndpoint(netif *NetIf) error {
 		h.ensureRouteToEndpointMutex.Unlock()
 	}()
 	glog.V(1).Info("Acquired mutex ensureRouteToEndpoint")
-	// If route not exist
-	if err := h.isRouteExist(netif.IP, mask); err != nil {
-
-		// Create route
-		via := "dev"
-		dest := netif.Name
-
-		err := h.createRoute(netif.IP, mask, via, dest, "src", h.Agent.networkConfig.romanaGW.String())
-		if err != nil {
-			return netIfRouteCreateError(err, *netif)
-		}
+	mask := net.CIDRMask(int(h.Agent.networkConfig.EndpointNetmaskSize()), 32)
+	route := utilnetlink.Route{
+		Dst:      &net.IPNet{IP: netif.IP.Mask(mask), Mask: mask},
+		LinkName: netif.Name,
+		Src:      h.Agent.networkConfig.romanaGW,
+	}
+	if err := utilnetlink.EnsureRoute(h.Netlink, route); err != nil {
+		h.Agent.metrics.routeErrors.Inc()
+		return netIfRouteCreateError(err, *netif)
 	}
 	return nil
 }
@@ -216,27 +175,52 @@ func (h Helper) ensureInterHostRoutes() error {
 	}()
 	glog.V(1).Info("Acquired mutex ensureInterhostRoutes")
 
-	via := "via"
+	if h.Agent.vxlan != nil {
+		return h.ensureOverlayRoutes()
+	}
+
 	glog.V(1).Infof("In ensureInterHostRoutes over %v\n", h.Agent.networkConfig.otherHosts)
+	routes, err := h.interHostRoutes()
+	if err != nil {
+		return err
+	}
+	return h.ensureRoutes(routes)
+}
+
+// interHostRoutes returns routes to Romana CIDRs of other hosts, via
+// the hosts or, in overlay mode, via their romana gateways over VXLAN.
+func (h Helper) interHostRoutes() ([]utilnetlink.Route, error) {
+	var routes []utilnetlink.Route
 	for _, host := range h.Agent.networkConfig.otherHosts {
-		glog.V(2).Infof("In ensureInterHostRoutes ensuring route for %v\n", host)
-		_, romanaCidr, err := net.ParseCIDR(host.RomanaIp)
+		romanaGW, romanaCidr, err := net.ParseCIDR(host.RomanaIp)
 		if err != nil {
-			return failedToParseOtherHosts(host.RomanaIp)
+			return nil, failedToParseOtherHosts(host.RomanaIp)
 		}
-		romanaMaskInt, _ := romanaCidr.Mask.Size()
-		romanaMask := fmt.Sprintf("%d", romanaMaskInt)
-		dest := host.Ip
-
-		// wait until no one messing with routes
-		// If route doesn't exist yet
-		if err := h.isRouteExist(romanaCidr.IP, romanaMask); err != nil {
-
-			// Create it
-			err2 := h.createRoute(romanaCidr.IP, romanaMask, via, dest)
-			if err2 != nil {
-				return routeCreateError(err, romanaCidr.IP.String(), romanaMask, dest)
+		route := utilnetlink.Route{Dst: romanaCidr}
+		if h.Agent.vxlan != nil {
+			route.Gw = romanaGW
+			route.LinkName = h.Agent.vxlan.Name
+			route.OnLink = true
+		} else {
+			route.Gw = net.ParseIP(host.Ip)
+			if route.Gw == nil {
+				return nil, failedToParseOtherHosts(host.Ip)
 			}
+			route.LinkName = h.Agent.networkConfig.hostLink
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// ensureRoutes ensures the routes to other hosts exist.
+func (h Helper) ensureRoutes(routes []utilnetlink.Route) error {
+	for _, route := range routes {
+		glog.V(2).Infof("In ensureInterHostRoutes ensuring route %s\n", route)
+		if err := utilnetlink.EnsureRoute(h.Netlink, route); err != nil {
+			h.Agent.metrics.routeErrors.Inc()
+			romanaMask, _ := route.Dst.Mask.Size()
+			return routeCreateError(err, route.Dst.IP.String(), fmt.Sprintf("%d", romanaMask), route.Gw.String())
 		}
 	}
 	return nil
@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	utilexec "github.com/romana/core/pkg/util/exec"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
 	utilos "github.com/romana/core/pkg/util/os"
 )
 
@@ -136,77 +137,24 @@ func TestDhcpPid(t *testing.T) {
 	}
 }
 
-// TestIsRouteExist is checking that isRouteExist detects correctly if given
-// ip route already exist.
-func TestIsRouteExist(t *testing.T) {
-	agent := Agent{Helper: &Helper{}}
-	// when
-
-	// IsRouteExist treats non empty output as a success
-	E := &utilexec.FakeExecutor{Output: []byte("route exist")}
-	agent.Helper.Executor = E
-	ip := net.ParseIP("127.0.0.1")
-	err := agent.Helper.isRouteExist(ip, "32")
-
-	// expect
-	if err != nil {
-		t.Errorf("TestIsRouteExist failed with %q", err)
-	}
-
-	expect := "/sbin/ip ro show 127.0.0.1/32"
-	got := *E.Commands
-	if expect != got {
-		t.Errorf("TestIsRouteExist returned unexpected command, expect %s, got %s", expect, got)
-	}
-
-	// when
-	// for this test we want to fail isRouteExist by providing nil output
-	E = &utilexec.FakeExecutor{}
-	agent.Helper.Executor = E
-	err = agent.Helper.isRouteExist(ip, "32")
-
-	// expect
-	if err == nil {
-		t.Error("TestIsRouteExist failed to detect 'No such route' condition")
-	}
-}
-
-// TestCreateRoute is checking that createRoute generates correct OS commands
-// to create ip routes for given endopoint.
-func TestCreateRoute(t *testing.T) {
-	agent := Agent{Helper: &Helper{}}
-	// when
-
-	// we only care for recorded commands, no need for fake output or errors
-	E := &utilexec.FakeExecutor{}
-	agent.Helper.Executor = E
-	ip := net.ParseIP("127.0.0.1")
-	_ = agent.Helper.createRoute(ip, "0", "dev", "eth0")
-
-	// expect
-	expect := "/sbin/ip ro add 127.0.0.1/0 dev eth0"
-	got := *E.Commands
-	if expect != got {
-		t.Errorf("TestIsRouteExist returned unexpected command, expect %s, got %s", expect, got)
-	}
-}
-
-// TestCreateInterhostRoutes is checking that ensureInterHostRoutes generates
-// correct commands to create IP routes to other romana hosts.
+// TestCreateInterhostRoutes is checking that ensureInterHostRoutes creates
+// IP routes to other romana hosts, replacing routes via wrong gateways.
 func TestCreateInterhostRoutes(t *testing.T) {
 	agent := mockAgent()
-	// when
+	_, dst, _ := net.ParseCIDR("10.65.0.0/16")
+	nl := &utilnetlink.FakeNetlink{Routes: []utilnetlink.Route{
+		{Dst: dst, Gw: net.ParseIP("192.168.0.99")},
+	}}
+	agent.Helper.Netlink = nl
 
-	// we only care for recorded commands, no need for fake output or errors
-	E := &utilexec.FakeExecutor{}
-	agent.Helper.Executor = E
+	// when
+	_ = agent.Helper.ensureInterHostRoutes()
 	_ = agent.Helper.ensureInterHostRoutes()
 
 	// expect
-	expect := strings.Join([]string{"/sbin/ip ro show 10.65.0.0/16",
-		"/sbin/ip ro add 10.65.0.0/16 via 192.168.0.12"}, "\n")
-	got := *E.Commands
+	expect := "route replace 10.65.0.0/16 via 192.168.0.12"
+	got := strings.Join(nl.Commands, "\n")
 	if expect != got {
-		t.Errorf("TestCreateInterhostRoutes returned unexpected command, expect %s, got %s", expect, got)
+		t.Errorf("TestCreateInterhostRoutes returned unexpected operations, expect %s, got %s", expect, got)
 	}
 }
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Selection of interfaces. On hosts with several interfaces, the
+// agent can be told which addresses to use for the romana gateway
+// and for routes to other hosts, as in
+//
+//   gateway:
+//     interface: romana-gw     # on the interface with the name
+//   host_routes:
+//     cidr: 192.168.10.0/24    # within the CIDR
+//     label: eth1:romana       # with the label (see ip-address(8))
+//
+// An address must match everything given. By default, the gateway is
+// any address within the host's Romana CIDR, and routes to other hosts
+// go through whichever interface the kernel chooses.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// addrSelector selects addresses of interfaces. The
+// zero value selects every address.
+type addrSelector struct {
+	linkName string
+	cidr     *net.IPNet
+	label    string
+}
+
+// parseAddrSelector parses the selector under the key
+// in the agent configuration.
+func parseAddrSelector(serviceSpecific map[string]interface{}, key string) (addrSelector, error) {
+	selector := addrSelector{}
+	value, ok := serviceSpecific[key]
+	if !ok {
+		return selector, nil
+	}
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return selector, agentErrorString(fmt.Sprintf("Expected %s to be a map, got %v", key, value))
+	}
+	for k, v := range config {
+		s, ok := v.(string)
+		if !ok {
+			return selector, agentErrorString(fmt.Sprintf("Expected %s.%s to be a string, got %v", key, k, v))
+		}
+		switch k {
+		case "interface":
+			selector.linkName = s
+		case "label":
+			selector.label = s
+		case "cidr":
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return selector, agentErrorString(fmt.Sprintf("Invalid %s.cidr: %s", key, err))
+			}
+			selector.cidr = cidr
+		default:
+			return selector, agentErrorString(fmt.Sprintf("Unknown option %s.%s", key, k))
+		}
+	}
+	return selector, nil
+}
+
+// isSet returns true if the selector does not select every address.
+func (s addrSelector) isSet() bool {
+	return s.linkName != "" || s.cidr != nil || s.label != ""
+}
+
+func (s addrSelector) matches(addr utilnetlink.Addr) bool {
+	return (s.linkName == "" || addr.LinkName == s.linkName) &&
+		(s.cidr == nil || s.cidr.Contains(addr.IP)) &&
+		(s.label == "" || addr.Label == s.label)
+}
+
+func (s addrSelector) String() string {
+	var parts []string
+	if s.linkName != "" {
+		parts = append(parts, "interface "+s.linkName)
+	}
+	if s.cidr != nil {
+		parts = append(parts, "cidr "+s.cidr.String())
+	}
+	if s.label != "" {
+		parts = append(parts, "label "+s.label)
+	}
+	if len(parts) == 0 {
+		return "any address"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// selectHostInterface finds the interface and address to route
+// to other hosts through, if selected in configuration.
+func (a *Agent) selectHostInterface() error {
+	if !a.hostSelector.isSet() {
+		return nil
+	}
+	addrs, err := a.Helper.Netlink.AddrList()
+	if err != nil {
+		return agentError(err)
+	}
+	for _, addr := range addrs {
+		if a.hostSelector.matches(addr) {
+			a.networkConfig.hostLink = addr.LinkName
+			a.networkConfig.hostAddr = addr.IP
+			return nil
+		}
+	}
+	return agentErrorString(fmt.Sprintf("No address matching host_routes (%s)", a.hostSelector))
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestInterfaceSelection is checking that addresses for the romana gateway
+// and for routes to other hosts are selected according to configuration.
+func TestInterfaceSelection(t *testing.T) {
+	addr := func(cidr string, linkName string, label string) utilnetlink.Addr {
+		ip, ipnet, _ := net.ParseCIDR(cidr)
+		ipnet.IP = ip
+		return utilnetlink.Addr{IPNet: ipnet, LinkName: linkName, Label: label}
+	}
+	addrs := []utilnetlink.Addr{
+		addr("192.168.0.11/24", "eth0", "eth0"),
+		addr("10.64.0.1/16", "docker0", "docker0"),
+		addr("10.65.0.1/16", "romana-gw", "romana-gw"),
+		addr("172.16.0.11/24", "eth1", "eth1:romana"),
+	}
+	hosts := []common.Host{
+		{Name: "host1", Ip: "192.168.0.11", RomanaIp: "10.64.0.1/16"},
+		{Name: "host2", Ip: "192.168.0.12", RomanaIp: "10.65.0.1/16"},
+	}
+	for _, c := range []struct {
+		config  map[string]interface{}
+		gateway string
+		host    string
+	}{
+		{map[string]interface{}{}, "10.64.0.1", "host1"},
+		{map[string]interface{}{"interface": "romana-gw"}, "10.65.0.1", "host2"},
+		{map[string]interface{}{"cidr": "10.65.0.0/24"}, "10.65.0.1", "host2"},
+	} {
+		selector, err := parseAddrSelector(map[string]interface{}{"gateway": c.config}, "gateway")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc := &NetworkConfig{}
+		err = nc.matchCurrentHost(hosts, addrs, selector)
+		if err != nil || nc.romanaGW.String() != c.gateway || nc.currentHost.Name != c.host || len(nc.otherHosts) != 1 {
+			t.Errorf("%v: expected gateway %s of %s, got %s of %s (%v)", c.config, c.gateway, c.host, nc.romanaGW, nc.currentHost.Name, err)
+		}
+	}
+	selector, _ := parseAddrSelector(map[string]interface{}{"gateway": map[string]interface{}{"interface": "eth0"}}, "gateway")
+	if err := (&NetworkConfig{}).matchCurrentHost(hosts, addrs, selector); err == nil {
+		t.Error("Expected no host to match eth0")
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	nl := &utilnetlink.FakeNetlink{Addrs: addrs}
+	agent.Helper.Netlink = nl
+	agent.hostSelector, _ = parseAddrSelector(map[string]interface{}{"host_routes": map[string]interface{}{"label": "eth1:romana"}}, "host_routes")
+	if err := agent.selectHostInterface(); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Helper.ensureInterHostRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "route replace 10.65.0.0/16 via 192.168.0.12 dev eth1"
+	if got := strings.Join(nl.Commands, "\n"); got != expect {
+		t.Errorf("Expected %s, got %s", expect, got)
+	}
+	if agent.networkConfig.hostAddr.String() != "172.16.0.11" {
+		t.Errorf("Unexpected host address %s", agent.networkConfig.hostAddr)
+	}
+
+	for _, bad := range []interface{}{
+		"eth0",
+		map[string]interface{}{"cidr": "10.0.0.0"},
+		map[string]interface{}{"name": "eth0"},
+	} {
+		if _, err := parseAddrSelector(map[string]interface{}{"gateway": bad}, "gateway"); err == nil {
+			t.Errorf("Expected error for %v", bad)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Metrics of the agent, exposed at common.MetricsPath.
+
+import (
+	"github.com/romana/core/common"
+	"time"
+)
+
+// agentMetrics are metrics of endpoint provisioning.
+type agentMetrics struct {
+	*common.Metrics
+	// By kind of endpoint.
+	provisioned       *common.Counter
+	provisionFailures *common.Counter
+	provisionDuration *common.Histogram
+	firewallFailures  *common.Counter
+	routeErrors       *common.Counter
+	// Routes to other hosts found missing or stale, by kind.
+	routeDrift *common.Counter
+	// Provisioning requests accepted but not yet processed.
+	queueDepth *common.Gauge
+}
+
+func newAgentMetrics(a *Agent) *agentMetrics {
+	m := &agentMetrics{Metrics: common.NewMetrics()}
+	m.provisioned = m.NewCounter("romana_agent_endpoints_provisioned_total",
+		"Endpoints provisioned successfully.", "kind")
+	m.provisionFailures = m.NewCounter("romana_agent_endpoint_provision_failures_total",
+		"Endpoints that failed to be provisioned.", "kind")
+	m.provisionDuration = m.NewHistogram("romana_agent_endpoint_provision_duration_seconds",
+		"Time to provision an endpoint, including waiting for its interface.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "kind")
+	m.firewallFailures = m.NewCounter("romana_agent_firewall_failures_total",
+		"Failures to apply firewall rules for an endpoint.")
+	m.routeErrors = m.NewCounter("romana_agent_route_errors_total",
+		"Failures to program routes.")
+	m.routeDrift = m.NewCounter("romana_agent_route_drift_total",
+		"Routes to other hosts found missing or stale when reconciling with topology.", "kind")
+	m.queueDepth = m.NewGauge("romana_agent_provision_queue_depth",
+		"Provisioning requests waiting to be processed.")
+	m.NewGaugeFunc("romana_agent_endpoints",
+		"Endpoints currently provisioned on the host.",
+		func() float64 {
+			if a.linkMonitor == nil {
+				return 0
+			}
+			a.linkMonitor.Lock()
+			defer a.linkMonitor.Unlock()
+			return float64(len(a.linkMonitor.endpoints))
+		})
+	return m
+}
+
+// observeProvision records the outcome of provisioning
+// an endpoint that started at the time.
+func (m *agentMetrics) observeProvision(kind endpointKind, start time.Time, err error) {
+	m.provisionDuration.Observe(time.Now().Sub(start).Seconds(), kind.String())
+	if err != nil {
+		m.provisionFailures.Inc(kind.String())
+	} else {
+		m.provisioned.Inc(kind.String())
+	}
+}
+
+// enqueue runs the provisioning function in the background,
+// counting it in the queue depth until it is done.
+func (m *agentMetrics) enqueue(provision func() error) {
+	m.queueDepth.Add(1)
+	go func() {
+		defer m.queueDepth.Add(-1)
+		provision()
+	}()
+}
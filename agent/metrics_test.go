@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestAgentMetrics is checking that provisioning outcomes
+// and route errors are counted.
+func TestAgentMetrics(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.Helper.Netlink = &utilnetlink.FakeNetlink{Error: utilnetlink.Error{Op: "route replace", Errno: syscall.EPERM}}
+
+	// when
+	agent.podUpHandlerAsync(NetworkRequest{})
+	agent.Helper.ensureRouteToEndpoint(&NetIf{Name: "eth0", IP: net.ParseIP("10.0.0.5")})
+	done := make(chan struct{})
+	agent.metrics.enqueue(func() error {
+		<-done
+		return nil
+	})
+	buf := &bytes.Buffer{}
+	agent.metrics.Write(buf)
+	close(done)
+
+	// expect
+	for _, line := range []string{
+		`romana_agent_endpoint_provision_failures_total{kind="pod"} 1`,
+		`romana_agent_endpoint_provision_duration_seconds_count{kind="pod"} 1`,
+		`romana_agent_route_errors_total 1`,
+		`romana_agent_provision_queue_depth 1`,
+		`romana_agent_endpoints 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected %s in metrics, got\n%s", line, buf)
+		}
+	}
+}
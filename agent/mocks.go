@@ -18,8 +18,9 @@
 //
 // - OS interface used to access filesystem, write and read files.
 // - Executable interface is used to execute commands in operation system.
+// - Netlink interface is used to manage interfaces and routes.
 //
-// Both interfaces has default and fake implementations, default implementation
+// All interfaces have default and fake implementations, default implementation
 // will usually just proxy calls to standard library while test implemetation
 // will allow mocking all interactions.
 
@@ -31,6 +32,7 @@ import (
 
 	"github.com/romana/core/common"
 	utilexec "github.com/romana/core/pkg/util/exec"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
 	utilos "github.com/romana/core/pkg/util/os"
 )
 
@@ -44,6 +46,7 @@ import (
 type Helper struct {
 	Executor                   utilexec.Executable
 	OS                         utilos.OS
+	Netlink                    utilnetlink.Netlink
 	Agent                      *Agent //access field for Agent
 	ensureRouteToEndpointMutex *sync.Mutex
 	ensureLineMutex            *sync.Mutex
@@ -74,14 +77,15 @@ func mockAgent() Agent {
 	dc.EndpointBits = 8
 
 	networkConfig.dc = dc
-	agent := &Agent{networkConfig: networkConfig}
+	agent := &Agent{networkConfig: networkConfig, requests: &endpointRequests{}, policies: newPolicySets()}
+	agent.metrics = newAgentMetrics(agent)
 	helper := NewAgentHelper(agent)
 	agent.Helper = &helper
 
 	storeConfig := common.ServiceConfig{ServiceSpecific: map[string]interface{}{
 		"type":     "sqlite3",
 		"database": "/tmp/agent.db"}}
-	agent.store = agentStore{}
+	agent.store = agentStore{mu: &sync.Mutex{}}
 	agent.store.ServiceStore = &agent.store
 	agent.store.SetConfig(storeConfig.ServiceSpecific)
 
@@ -0,0 +1,225 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Monitoring of interfaces. An endpoint's interface or the interface
+// with the romana gateway address can go down, or be deleted and
+// created again (e.g. when a hypervisor or network manager restarts),
+// which loses routes through it. The agent subscribes to interface
+// changes and provisions affected endpoints again when this happens.
+
+import (
+	"github.com/golang/glog"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	"net"
+	"sync"
+)
+
+// endpointKind is what kind of endpoint was provisioned, which
+// determines how to provision it again.
+type endpointKind int
+
+const (
+	podEndpoint endpointKind = iota
+	vmEndpoint
+)
+
+func (k endpointKind) String() string {
+	if k == vmEndpoint {
+		return "vm"
+	}
+	return "pod"
+}
+
+// provisionedEndpoint is an endpoint successfully provisioned
+// on this host.
+type provisionedEndpoint struct {
+	netif NetIf
+	kind  endpointKind
+}
+
+// linkMonitor keeps track of provisioned endpoints and of the
+// state of their interfaces.
+type linkMonitor struct {
+	agent *Agent
+	sync.Mutex
+	// Provisioned endpoints by interface name.
+	endpoints map[string]provisionedEndpoint
+	// Last known state of interfaces that are watched by name;
+	// no entry means the interface does not exist.
+	links map[string]utilnetlink.Link
+	// Name of the interface with the romana gateway address.
+	gatewayLink string
+	// provision provisions the endpoint again; ensureRoutes
+	// ensures inter-host routes. They are fields so that tests
+	// can replace them.
+	provision    func(ep provisionedEndpoint) error
+	ensureRoutes func() error
+}
+
+func newLinkMonitor(agent *Agent) *linkMonitor {
+	m := &linkMonitor{
+		agent:     agent,
+		endpoints: make(map[string]provisionedEndpoint),
+		links:     make(map[string]utilnetlink.Link),
+	}
+	m.provision = func(ep provisionedEndpoint) error {
+		return agent.provisionEndpoint(ep, nil)
+	}
+	m.ensureRoutes = func() error {
+		return agent.Helper.ensureInterHostRoutes()
+	}
+	return m
+}
+
+// start subscribes to interface changes and handles them
+// until done is closed.
+func (m *linkMonitor) start(done <-chan struct{}) error {
+	m.Lock()
+	m.gatewayLink = gatewayLinkName(m.agent.networkConfig.RomanaGW())
+	if m.gatewayLink == "" {
+		glog.Warningf("Agent: no interface with address %s, not monitoring it", m.agent.networkConfig.RomanaGW())
+	} else {
+		m.watch(m.gatewayLink)
+	}
+	m.Unlock()
+	updates := make(chan utilnetlink.LinkUpdate, 64)
+	err := m.agent.Helper.Netlink.LinkSubscribe(updates, done)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for update := range updates {
+			m.handle(update)
+		}
+		glog.Info("Agent: stopped monitoring interfaces")
+	}()
+	return nil
+}
+
+// gatewayLinkName returns the name of the interface with
+// the address, or an empty string if there is none.
+func gatewayLinkName(gw net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(gw) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// watch records the current state of the interface.
+// Must be called with the lock held.
+func (m *linkMonitor) watch(name string) {
+	link, err := m.agent.Helper.Netlink.LinkByName(name)
+	if err != nil {
+		delete(m.links, name)
+		return
+	}
+	m.links[name] = link
+}
+
+// track records the endpoint as provisioned.
+func (m *linkMonitor) track(netif NetIf, kind endpointKind) {
+	m.Lock()
+	defer m.Unlock()
+	m.endpoints[netif.Name] = provisionedEndpoint{netif: netif, kind: kind}
+	m.watch(netif.Name)
+}
+
+// untrack forgets the endpoint.
+func (m *linkMonitor) untrack(name string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.endpoints, name)
+	if name != m.gatewayLink {
+		delete(m.links, name)
+	}
+}
+
+// handle provisions endpoints again if the update is about an
+// interface that came up, or was created again, since last seen.
+func (m *linkMonitor) handle(update utilnetlink.LinkUpdate) {
+	m.Lock()
+	ep, isEndpoint := m.endpoints[update.Name]
+	isGateway := update.Name == m.gatewayLink
+	if !isEndpoint && !isGateway {
+		m.Unlock()
+		return
+	}
+	prev, existed := m.links[update.Name]
+	if update.Deleted {
+		glog.Infof("Agent: interface %s deleted", update.Name)
+		delete(m.links, update.Name)
+		m.Unlock()
+		return
+	}
+	m.links[update.Name] = update.Link
+	restored := update.Up && (!existed || !prev.Up || prev.Index != update.Index)
+	var affected []provisionedEndpoint
+	if restored && isGateway {
+		for _, ep := range m.endpoints {
+			affected = append(affected, ep)
+		}
+	} else if restored {
+		affected = append(affected, ep)
+	}
+	m.Unlock()
+	if !restored {
+		return
+	}
+
+	glog.Infof("Agent: interface %s is up again, provisioning %d endpoint(s)", update.Name, len(affected))
+	if isGateway {
+		if err := m.ensureRoutes(); err != nil {
+			glog.Error("Agent: ", agentError(err))
+		}
+	}
+	for _, ep := range affected {
+		if err := m.provision(ep); err != nil {
+			glog.Errorf("Agent: failed to provision %s again: %s", ep.netif.Name, err)
+		}
+	}
+}
+
+// trackEndpoint records the endpoint as provisioned, to provision
+// it again if its interface is restored.
+func (a *Agent) trackEndpoint(netif NetIf, kind endpointKind) {
+	a.syncEndpointSets(netif.IP, true)
+	if a.linkMonitor != nil {
+		a.linkMonitor.track(netif, kind)
+		a.saveState()
+	}
+}
+
+// untrackEndpoint forgets the endpoint when it is torn down.
+func (a *Agent) untrackEndpoint(netif NetIf) {
+	a.syncEndpointSets(netif.IP, false)
+	if a.linkMonitor != nil {
+		a.linkMonitor.untrack(netif.Name)
+		a.saveState()
+	}
+}
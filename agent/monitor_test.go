@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestLinkMonitor is checking that endpoints are provisioned again
+// when their interfaces, or the gateway interface, are restored.
+func TestLinkMonitor(t *testing.T) {
+	agent := mockAgent()
+	nl := &utilnetlink.FakeNetlink{Links: map[string]utilnetlink.Link{
+		"romana-gw": {Name: "romana-gw", Index: 1, Up: true},
+		"tap1":      {Name: "tap1", Index: 2, Up: true},
+		"veth2":     {Name: "veth2", Index: 3, Up: true},
+	}}
+	agent.Helper.Netlink = nl
+	m := newLinkMonitor(&agent)
+	m.gatewayLink = "romana-gw"
+	m.watch("romana-gw")
+	var provisioned []string
+	routesEnsured := 0
+	m.provision = func(ep provisionedEndpoint) error {
+		provisioned = append(provisioned, ep.netif.Name)
+		return nil
+	}
+	m.ensureRoutes = func() error {
+		routesEnsured++
+		return nil
+	}
+	m.track(NetIf{Name: "tap1", IP: net.ParseIP("10.0.0.1")}, vmEndpoint)
+	m.track(NetIf{Name: "veth2", IP: net.ParseIP("10.0.0.2")}, podEndpoint)
+
+	expect := func(step string, names ...string) {
+		sort.Strings(provisioned)
+		if strings.Join(provisioned, ",") != strings.Join(names, ",") {
+			t.Errorf("%s: expected %v provisioned, got %v", step, names, provisioned)
+		}
+		provisioned = nil
+	}
+
+	// Unrelated changes and interfaces are ignored.
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "tap1", Index: 2, Up: true}})
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "eth0", Index: 4, Up: true}})
+	expect("no change")
+
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "tap1", Index: 2}})
+	expect("down")
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "tap1", Index: 2, Up: true}})
+	expect("up", "tap1")
+
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "veth2", Index: 3}, Deleted: true})
+	expect("deleted")
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "veth2", Index: 5, Up: true}})
+	expect("recreated", "veth2")
+
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "romana-gw", Index: 6, Up: true}})
+	expect("gateway recreated", "tap1", "veth2")
+	if routesEnsured != 1 {
+		t.Errorf("Expected inter-host routes to be ensured once, got %d", routesEnsured)
+	}
+
+	m.untrack("tap1")
+	m.handle(utilnetlink.LinkUpdate{Link: utilnetlink.Link{Name: "tap1", Index: 7, Up: true}})
+	expect("untracked")
+}
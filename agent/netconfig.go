@@ -41,7 +41,7 @@ type NetworkRequest struct {
 // together with basic methods operating on this structure.
 type NetIf struct {
 	Name string `form:"interface_name" json:"interface_name"`
-	Mac  string `form:"mac_address" json:"interface_name,omitempty"`
+	Mac  string `form:"mac_address" json:"mac_address,omitempty"`
 	IP   net.IP `form:"ip_address" json:"ip_address,omitempty"`
 }
 
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestEnsureRouteToEndpoint is checking that ensureRouteToEndpoint creates
+// the route to the endpoint only if it does not exist yet.
+func TestEnsureRouteToEndpoint(t *testing.T) {
+	agent := mockAgent()
+	nl := &utilnetlink.FakeNetlink{}
+	agent.Helper.Netlink = nl
+	netif := NetIf{Name: "eth0", IP: net.ParseIP("10.0.0.5")}
+
+	// when
+	err := agent.Helper.ensureRouteToEndpoint(&netif)
+
+	// expect
+	if err != nil {
+		t.Fatalf("TestEnsureRouteToEndpoint failed with %q", err)
+	}
+	expect := "route replace 10.0.0.5/32 dev eth0 src 172.17.0.1"
+	got := strings.Join(nl.Commands, "\n")
+	if expect != got {
+		t.Errorf("TestEnsureRouteToEndpoint returned unexpected operations, expect %s, got %s", expect, got)
+	}
+
+	// when
+	// route already exists
+	err = agent.Helper.ensureRouteToEndpoint(&netif)
+
+	// expect
+	if err != nil {
+		t.Fatalf("TestEnsureRouteToEndpoint failed with %q", err)
+	}
+	if len(nl.Commands) != 1 {
+		t.Errorf("TestEnsureRouteToEndpoint modified existing route: %v", nl.Commands)
+	}
+
+	// when
+	nl.Error = utilnetlink.Error{Op: "route replace", Errno: syscall.EPERM}
+	err = agent.Helper.ensureRouteToEndpoint(&netif)
+
+	// expect
+	if err == nil {
+		t.Error("TestEnsureRouteToEndpoint failed to detect netlink error")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Network namespace plumbing. Instead of having a CNI plugin or other
+// tooling create interfaces in the namespace of a pod (or of a VM
+// runtime) and then calling the agent, the namespace, given by path
+// or by PID of a process in it, can be handed to the agent, which
+// creates a veth pair, moves one end into the namespace, configures
+// the allocated address and the default route via the romana gateway
+// there, and provisions the other end as it would any endpoint.
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// Name of the interface in the namespace, unless requested otherwise.
+const defaultNetnsIfName = "eth0"
+
+// NamespaceRequest is sent to the agent to connect a network
+// namespace (POST /netns) or to disconnect it (DELETE /netns).
+type NamespaceRequest struct {
+	// Name of the interface on the host side and the
+	// address allocated to the endpoint.
+	NetIf NetIf `json:"net_if"`
+	// Path the namespace is bound at, such as /var/run/netns/foo.
+	Netns string `json:"netns,omitempty"`
+	// Process in the namespace, if Netns is not given.
+	Pid int `json:"pid,omitempty"`
+	// Name of the interface in the namespace, eth0 by default.
+	IfName string `json:"if_name,omitempty"`
+	// Kind of the endpoint, "pod" (default) or "vm".
+	Kind string `json:"kind,omitempty"`
+	// Options as in NetworkRequest, for pods.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// NamespaceResponse describes how the namespace was connected.
+type NamespaceResponse struct {
+	// Interface in the namespace and its address in CIDR notation.
+	IfName  string `json:"if_name"`
+	Address string `json:"address"`
+	Gateway string `json:"gateway"`
+}
+
+// netnsPath returns the path of the requested namespace.
+func (req NamespaceRequest) netnsPath() (string, error) {
+	if req.Netns != "" {
+		return req.Netns, nil
+	}
+	if req.Pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", req.Pid), nil
+	}
+	return "", common.NewError400("Either netns or pid is required")
+}
+
+// netnsUpHandler handles HTTP requests to connect a network namespace.
+func (a *Agent) netnsUpHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*NamespaceRequest)
+	netns, err := req.netnsPath()
+	if err != nil {
+		return nil, err
+	}
+	if req.NetIf.Name == "" || req.NetIf.IP == nil {
+		return nil, common.NewError400("Interface name and IP address are required")
+	}
+	if req.Kind == "" {
+		req.Kind = podEndpoint.String()
+	}
+	kind, err := parseEndpointKind(req.Kind)
+	if err != nil {
+		return nil, common.NewError400(err.Error())
+	}
+	if req.IfName == "" {
+		req.IfName = defaultNetnsIfName
+	}
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer a.requests.end()
+
+	glog.Infof("Agent: connecting %s in %s to %s", req.IfName, netns, req.NetIf.Name)
+	gateway := a.networkConfig.RomanaGW()
+	err = a.Helper.plumbNetns(netns, req.NetIf.Name, req.IfName, req.NetIf.IP, gateway)
+	if err == nil {
+		err = a.provisionEndpoint(provisionedEndpoint{netif: req.NetIf, kind: kind}, req.Options)
+	}
+	if err != nil {
+		// Deleting one end of the veth pair deletes the other.
+		utilnetlink.EnsureLinkDeleted(a.Helper.Netlink, req.NetIf.Name)
+		return nil, err
+	}
+	address := net.IPNet{IP: req.NetIf.IP, Mask: net.CIDRMask(32, 32)}
+	return NamespaceResponse{IfName: req.IfName, Address: address.String(), Gateway: gateway.String()}, nil
+}
+
+// netnsDownHandler handles HTTP requests to disconnect a network
+// namespace. The namespace itself need not exist anymore.
+func (a *Agent) netnsDownHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*NamespaceRequest)
+	if req.NetIf.Name == "" {
+		return nil, common.NewError400("Interface name is required")
+	}
+	if err := a.requests.begin(); err != nil {
+		return nil, err
+	}
+	defer a.requests.end()
+
+	fw, err := a.newFirewall(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	if err := fw.Cleanup(req.NetIf); err != nil {
+		return nil, err
+	}
+	if a.dhcp != nil {
+		if err := a.dhcp.removeHost(req.NetIf); err != nil {
+			glog.Errorf("Agent: cannot remove DHCP lease of %s: %s", req.NetIf.Name, err)
+		}
+	}
+	a.untrackEndpoint(req.NetIf)
+	if err := utilnetlink.EnsureLinkDeleted(a.Helper.Netlink, req.NetIf.Name); err != nil {
+		return nil, agentError(err)
+	}
+	return "OK", nil
+}
+
+// plumbNetns creates a veth pair with one end in the namespace,
+// named ifName there and configured with the address and the default
+// route via the gateway. The host end is left to be provisioned.
+func (h Helper) plumbNetns(netns string, hostIface string, ifName string, ip net.IP, gateway net.IP) error {
+	// The peer is renamed in the namespace, where the
+	// name does not clash with interfaces on the host.
+	peer := hostIface + "p"
+	if err := h.Netlink.VethAdd(hostIface, peer); err != nil {
+		return agentError(err)
+	}
+	if err := h.Netlink.LinkSetUp(hostIface); err != nil {
+		return agentError(err)
+	}
+	if err := h.Netlink.LinkSetNs(peer, netns); err != nil {
+		return agentError(err)
+	}
+	gatewayNet := &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)}
+	err := h.Netlink.InNetns(netns, func() error {
+		if err := h.Netlink.LinkSetName(peer, ifName); err != nil {
+			return err
+		}
+		if err := h.Netlink.AddrAdd(ifName, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+			return err
+		}
+		if err := h.Netlink.LinkSetUp(ifName); err != nil {
+			return err
+		}
+		// The gateway is not in the subnet of the /32 address,
+		// so it has to be reachable on the link first.
+		if err := utilnetlink.EnsureRoute(h.Netlink, utilnetlink.Route{Dst: gatewayNet, LinkName: ifName}); err != nil {
+			return err
+		}
+		_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+		return utilnetlink.EnsureRoute(h.Netlink, utilnetlink.Route{Dst: defaultNet, Gw: gateway, LinkName: ifName})
+	})
+	if err != nil {
+		return agentError(err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestNetnsPlumbing is checking that a veth pair is created with one
+// end moved into and configured in the requested namespace.
+func TestNetnsPlumbing(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	nl := &utilnetlink.FakeNetlink{Netns: map[string]*utilnetlink.FakeNetns{"/proc/42/ns/net": {}}}
+	agent.Helper.Netlink = nl
+
+	netns, err := NamespaceRequest{Pid: 42}.netnsPath()
+	if err != nil || netns != "/proc/42/ns/net" {
+		t.Fatalf("Unexpected namespace %s (%v)", netns, err)
+	}
+	err = agent.Helper.plumbNetns(netns, "romana1", "eth0", net.ParseIP("10.0.0.5"), agent.networkConfig.RomanaGW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"link add veth romana1 peer romana1p",
+		"link set up romana1",
+		"link set netns romana1p /proc/42/ns/net",
+		"netns /proc/42/ns/net link set name romana1p eth0",
+		"netns /proc/42/ns/net addr add 10.0.0.5/32 dev eth0",
+		"netns /proc/42/ns/net link set up eth0",
+		"netns /proc/42/ns/net route replace 172.17.0.1/32 dev eth0",
+		"netns /proc/42/ns/net route replace 0.0.0.0/0 via 172.17.0.1 dev eth0",
+	}
+	if got := strings.Join(nl.Commands, "\n"); got != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), got)
+	}
+	if _, ok := nl.Links["romana1p"]; ok {
+		t.Error("Expected romana1p to be gone from the host")
+	}
+	if link, ok := nl.Netns[netns].Links["eth0"]; !ok || !link.Up {
+		t.Errorf("Expected eth0 up in the namespace, got %v", nl.Netns[netns].Links)
+	}
+
+	for _, req := range []NamespaceRequest{
+		{NetIf: NetIf{Name: "romana2", IP: net.ParseIP("10.0.0.6")}},
+		{NetIf: NetIf{Name: "romana2"}, Pid: 42},
+		{NetIf: NetIf{Name: "romana2", IP: net.ParseIP("10.0.0.6")}, Pid: 42, Kind: "container"},
+	} {
+		_, err := agent.netnsUpHandler(&req, common.RestContext{})
+		if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != 400 {
+			t.Errorf("Expected 400 for %+v, got %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,796 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Enforcement of policies sent by the policy service. Each ingress
+// policy gets its own chain, ROMANA-P<id>, accepting (or, for deny
+// policies, dropping) traffic that matches any of its peers and any of
+// its rules. ROMANA-INGRESS, which FORWARD jumps into, jumps into that
+// chain for traffic to the endpoints the policy is applied to.
+//
+// Egress policies share ROMANA-EGRESS, which FORWARD jumps into first.
+// Traffic from endpoints egress policies are applied to returns from
+// it if a policy allows it, to be checked by ingress policies of its
+// destination, and is dropped otherwise; replies to established
+// connections always return.
+//
+// In both chains, policies are checked in order of precedence (see
+// common.PoliciesByPrecedence), so the first one matching decides.
+//
+// Tenants and segments are matched by ipsets, romana-t<tenant> and
+// romana-t<tenant>s<segment>, rather than enumerated in the chains.
+// A set holds addresses of local endpoints of the tenant or segment,
+// added and removed as the endpoints come and go, and the blocks of
+// addresses it has on other hosts, updated when routes are reconciled
+// (see reconcile.go). Membership changes only add or delete entries of
+// the sets in use; policy chains are written only when policies change.
+//
+// Peers given as CIDRs are matched directly, or, if blocks are
+// excepted from them, by a set holding the CIDR and the excepted
+// blocks as nomatch entries, named after a hash of both.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+	"github.com/romana/core/pkg/util/ipset"
+)
+
+const (
+	iptablesCmd  = "/sbin/iptables"
+	ingressChain = "ROMANA-INGRESS"
+	egressChain  = "ROMANA-EGRESS"
+	// multiportMax is how many ports the iptables multiport match takes.
+	multiportMax = 15
+)
+
+// membershipSet is an ipset matching endpoints of a tenant
+// or, if hasSegment is set, of a segment of the tenant. If cidr
+// is set, it matches addresses of that block instead, except for
+// those in the blocks listed in except, separated by commas.
+type membershipSet struct {
+	tenant     uint64
+	segment    uint64
+	hasSegment bool
+	cidr       string
+	except     string
+}
+
+func (m membershipSet) name() string {
+	if m.cidr != "" {
+		// Set names are limited to 31 characters.
+		h := fnv.New32a()
+		h.Write([]byte(m.cidr + " " + m.except))
+		return fmt.Sprintf("romana-c%08x", h.Sum32())
+	}
+	if m.hasSegment {
+		return fmt.Sprintf("romana-t%ds%d", m.tenant, m.segment)
+	}
+	return fmt.Sprintf("romana-t%d", m.tenant)
+}
+
+// policySets keeps policies applied by the agent and
+// the ipsets they use.
+type policySets struct {
+	sync.Mutex
+	// Applied policies by ID.
+	policies map[uint64]common.Policy
+	// Addresses of local endpoints.
+	endpoints map[string]net.IP
+	// Entries of the sets used by applied policies.
+	members map[membershipSet]map[string]bool
+	// Whether FORWARD jumps into egressChain.
+	egressHooked bool
+	// Policies which failed to apply, by ID.
+	failed map[uint64]common.AppliedPolicy
+	// Signalled when applied policies change (see policystatus.go).
+	changed chan struct{}
+}
+
+func newPolicySets() *policySets {
+	return &policySets{
+		policies:  make(map[uint64]common.Policy),
+		endpoints: make(map[string]net.IP),
+		members:   make(map[membershipSet]map[string]bool),
+		failed:    make(map[uint64]common.AppliedPolicy),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// notifyChanged signals that applied policies changed, unless
+// that is already pending. Must be called with a.policies locked.
+func (p *policySets) notifyChanged() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// policyChain returns name of the chain of the policy.
+func policyChain(policy common.Policy) string {
+	return fmt.Sprintf("ROMANA-P%d", policy.ID)
+}
+
+// tenantAndSegment extracts tenant and segment IDs encoded in the address.
+func (a *Agent) tenantAndSegment(ip net.IP) (uint64, uint64, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, 0, false
+	}
+	nc := a.networkConfig
+	addr := uint64(binary.BigEndian.Uint32(ip4))
+	endpointBits := nc.EndpointBits()
+	segmentBits := nc.SegmentBits()
+	segment := (addr >> endpointBits) & (1<<segmentBits - 1)
+	tenant := (addr >> (endpointBits + segmentBits)) & (1<<nc.TenantBits() - 1)
+	return tenant, segment, true
+}
+
+// setEntries returns what the set should contain: addresses of
+// matching local endpoints and blocks of addresses of the tenant
+// or segment on other hosts.
+func (a *Agent) setEntries(set membershipSet) map[string]bool {
+	entries := make(map[string]bool)
+	if set.cidr != "" {
+		entries[set.cidr] = true
+		for _, except := range strings.Split(set.except, ",") {
+			if except != "" {
+				entries[except+" nomatch"] = true
+			}
+		}
+		return entries
+	}
+	for key, ip := range a.policies.endpoints {
+		tenant, segment, ok := a.tenantAndSegment(ip)
+		if ok && tenant == set.tenant && (!set.hasSegment || segment == set.segment) {
+			entries[key] = true
+		}
+	}
+	nc := a.networkConfig
+	bits := nc.TenantBits()
+	shift := nc.EndpointBits() + nc.SegmentBits()
+	value := set.tenant << shift
+	if set.hasSegment {
+		bits += nc.SegmentBits()
+		shift = nc.EndpointBits()
+		value |= set.segment << shift
+	}
+	for _, host := range nc.otherHosts {
+		_, hostNet, err := net.ParseCIDR(host.RomanaIp)
+		if err != nil || hostNet.IP.To4() == nil {
+			glog.Warningf("Agent: skipping host %s with invalid romana CIDR %s", host.Ip, host.RomanaIp)
+			continue
+		}
+		ones, _ := hostNet.Mask.Size()
+		if ones+int(bits) > 32 {
+			continue
+		}
+		block := make(net.IP, 4)
+		binary.BigEndian.PutUint32(block, binary.BigEndian.Uint32(hostNet.IP.To4())|uint32(value))
+		entries[fmt.Sprintf("%s/%d", block, ones+int(bits))] = true
+	}
+	return entries
+}
+
+// syncSet brings the set in line with setEntries, creating it if it
+// is not in use yet. Must be called with a.policies locked.
+func (a *Agent) syncSet(set membershipSet) error {
+	sets := ipset.NewIpset(a.Helper.Executor)
+	name := set.name()
+	current, ok := a.policies.members[set]
+	if !ok {
+		if err := sets.Create(name, ipset.HashNet); err != nil {
+			return agentError(err)
+		}
+		// The set may be left from before the agent restarted.
+		members, err := sets.Members(name)
+		if err != nil {
+			return agentError(err)
+		}
+		current = make(map[string]bool)
+		for _, member := range members {
+			current[member] = true
+		}
+		a.policies.members[set] = current
+	}
+	desired := a.setEntries(set)
+	for _, entry := range sortedKeys(desired) {
+		if !current[entry] {
+			if err := sets.Add(name, entry); err != nil {
+				return agentError(err)
+			}
+			current[entry] = true
+		}
+	}
+	for _, entry := range sortedKeys(current) {
+		if !desired[entry] {
+			if err := sets.Del(name, entry); err != nil {
+				return agentError(err)
+			}
+			delete(current, entry)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syncEndpointSets updates sets in use which the
+// local endpoint with the address belongs to.
+func (a *Agent) syncEndpointSets(ip net.IP, present bool) {
+	if ip == nil || a.policies == nil {
+		return
+	}
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	if present {
+		a.policies.endpoints[ip.String()] = ip
+	} else {
+		delete(a.policies.endpoints, ip.String())
+	}
+	tenant, segment, ok := a.tenantAndSegment(ip)
+	if !ok {
+		return
+	}
+	for set := range a.policies.members {
+		if set.cidr == "" && set.tenant == tenant && (!set.hasSegment || set.segment == segment) {
+			if err := a.syncSet(set); err != nil {
+				glog.Errorf("Agent: cannot update %s for %s: %s", set.name(), ip, err)
+			}
+		}
+	}
+}
+
+// syncPolicySets updates all sets in use, e.g. after other hosts
+// joined or left.
+func (a *Agent) syncPolicySets() {
+	if a.policies == nil {
+		return
+	}
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	for set := range a.policies.members {
+		if err := a.syncSet(set); err != nil {
+			glog.Errorf("Agent: cannot update %s: %s", set.name(), err)
+		}
+	}
+}
+
+// endpointMatch returns iptables match for the policy endpoint as
+// source ("src") or destination ("dst") of traffic, and the set it
+// uses, if any.
+func endpointMatch(endpoint common.Endpoint, dir string) (string, *membershipSet, error) {
+	switch {
+	case endpoint.Peer == common.Wildcard:
+		return "", nil, nil
+	case endpoint.Peer != "":
+		return "", nil, common.NewError400(fmt.Sprintf("Unsupported peer %s", endpoint.Peer))
+	case endpoint.Cidr != "":
+		_, cidr, err := net.ParseCIDR(endpoint.Cidr)
+		if err != nil {
+			return "", nil, common.NewError400(fmt.Sprintf("Invalid CIDR %s", endpoint.Cidr))
+		}
+		if len(endpoint.Except) == 0 {
+			return fmt.Sprintf("-%c %s", dir[0], endpoint.Cidr), nil, nil
+		}
+		// ipset skips addresses matching nomatch entries.
+		except := make([]string, len(endpoint.Except))
+		for i, block := range endpoint.Except {
+			_, exceptNet, err := net.ParseCIDR(block)
+			if err != nil || !cidr.Contains(exceptNet.IP) {
+				return "", nil, common.NewError400(fmt.Sprintf("Invalid CIDR %s excepted from %s", block, endpoint.Cidr))
+			}
+			except[i] = exceptNet.String()
+		}
+		sort.Strings(except)
+		set := &membershipSet{cidr: cidr.String(), except: strings.Join(except, ",")}
+		return fmt.Sprintf("-m set --match-set %s %s", set.name(), dir), set, nil
+	case endpoint.TenantNetworkID != nil:
+		set := &membershipSet{tenant: *endpoint.TenantNetworkID}
+		if endpoint.SegmentNetworkID != nil {
+			set.segment = *endpoint.SegmentNetworkID
+			set.hasSegment = true
+		}
+		return fmt.Sprintf("-m set --match-set %s %s", set.name(), dir), set, nil
+	}
+	return "", nil, common.NewError400(fmt.Sprintf("Cannot match endpoint %s", endpoint))
+}
+
+// ruleMatches returns iptables matches for protocols and ports of the rule.
+func ruleMatches(rule common.Rule) ([]string, error) {
+	if rule.IsStateful {
+		return nil, common.NewError400("Stateful rules are not supported")
+	}
+	proto := strings.ToLower(rule.Protocol)
+	switch proto {
+	case common.Wildcard:
+		return []string{""}, nil
+	case "icmp":
+		switch {
+		case rule.IcmpTypeName != "":
+			name, _, _, ok := common.IcmpTypeByName(rule.IcmpTypeName)
+			if !ok {
+				return nil, common.NewError400(fmt.Sprintf("Unknown ICMP type %s", rule.IcmpTypeName))
+			}
+			return []string{"-p icmp --icmp-type " + name}, nil
+		case rule.IcmpType != 0 && rule.IcmpCode != 0:
+			return []string{fmt.Sprintf("-p icmp --icmp-type %d/%d", rule.IcmpType, rule.IcmpCode)}, nil
+		case rule.IcmpType != 0:
+			return []string{fmt.Sprintf("-p icmp --icmp-type %d", rule.IcmpType)}, nil
+		}
+		return []string{"-p icmp"}, nil
+	case "tcp", "udp":
+		if len(rule.Ports) == 0 && len(rule.PortRanges) == 0 {
+			return []string{"-p " + proto}, nil
+		}
+		if len(rule.Ports) == 1 && len(rule.PortRanges) == 0 {
+			return []string{fmt.Sprintf("-p %s --dport %d", proto, rule.Ports[0])}, nil
+		}
+		// multiport takes up to multiportMax ports,
+		// a range counting as two.
+		var matches, dports []string
+		slots := 0
+		add := func(dport string, n int) {
+			if slots+n > multiportMax {
+				matches = append(matches, fmt.Sprintf("-p %s -m multiport --dports %s", proto, strings.Join(dports, ",")))
+				dports, slots = nil, 0
+			}
+			dports = append(dports, dport)
+			slots += n
+		}
+		for _, port := range rule.Ports {
+			add(fmt.Sprintf("%d", port), 1)
+		}
+		for _, r := range rule.PortRanges {
+			add(fmt.Sprintf("%d:%d", r[0], r[1]), 2)
+		}
+		matches = append(matches, fmt.Sprintf("-p %s -m multiport --dports %s", proto, strings.Join(dports, ",")))
+		return matches, nil
+	}
+	return nil, common.NewError400(fmt.Sprintf("Unknown protocol %s", rule.Protocol))
+}
+
+// isEgress returns true for policies enforced in egressChain.
+func isEgress(policy common.Policy) bool {
+	return policy.Direction == common.PolicyDirectionEgress
+}
+
+// policyRules returns rules of the policy's chain, rules of
+// ingressChain jumping into it, and the sets they use. Rules of
+// egress policies go into egressChain, with no jumps.
+func policyRules(policy common.Policy) ([]string, []string, []membershipSet, error) {
+	if policy.ID == 0 {
+		return nil, nil, nil, common.NewError400("Policy ID is required")
+	}
+	if len(policy.AppliedTo) == 0 || len(policy.Peers) == 0 || len(policy.Rules) == 0 {
+		return nil, nil, nil, common.NewError400("Policy must have applied_to, peers and rules")
+	}
+	targetDir, peerDir := "dst", "src"
+	switch policy.Direction {
+	case "", common.PolicyDirectionIngress:
+	case common.PolicyDirectionEgress:
+		targetDir, peerDir = peerDir, targetDir
+	default:
+		return nil, nil, nil, common.NewError400(fmt.Sprintf("Unknown direction %s", policy.Direction))
+	}
+	switch strings.ToLower(policy.Action) {
+	case "", common.PolicyActionAllow, common.PolicyActionDeny:
+	default:
+		return nil, nil, nil, common.NewError400(fmt.Sprintf("Unknown action %s", policy.Action))
+	}
+	chain := policyChain(policy)
+	var sets []membershipSet
+	var jumps []string
+	// Egress rules match the target themselves.
+	var targetMatches []string
+	for _, target := range policy.AppliedTo {
+		if target.TenantNetworkID == nil {
+			return nil, nil, nil, common.NewError400(fmt.Sprintf("Policy can only be applied to tenants and segments, not %s", target))
+		}
+		match, set, err := endpointMatch(target, targetDir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		sets = append(sets, *set)
+		if isEgress(policy) {
+			targetMatches = append(targetMatches, match)
+		} else {
+			jumps = append(jumps, fmt.Sprintf("%s %s -j %s", ingressChain, match, chain))
+		}
+	}
+	target := "ACCEPT"
+	if isEgress(policy) {
+		chain, target = egressChain, "RETURN"
+	} else {
+		targetMatches = []string{""}
+	}
+	if policy.IsDeny() {
+		target = "DROP"
+	}
+	var rules []string
+	for _, peer := range policy.Peers {
+		peerMatch, set, err := endpointMatch(peer, peerDir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if set != nil {
+			sets = append(sets, *set)
+		}
+		for _, rule := range policy.Rules {
+			matches, err := ruleMatches(rule)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, targetMatch := range targetMatches {
+				for _, match := range matches {
+					fields := strings.Fields(fmt.Sprintf("%s %s %s %s -j %s", chain, targetMatch, peerMatch, match, target))
+					rules = append(rules, strings.Join(fields, " "))
+				}
+			}
+		}
+	}
+	return rules, jumps, sets, nil
+}
+
+// ingressRules returns rules of ingressChain for the
+// ingress policies, or none if there are none.
+func ingressRules(policies []common.Policy) []string {
+	var ingress []common.Policy
+	for _, policy := range policies {
+		if !isEgress(policy) {
+			ingress = append(ingress, policy)
+		}
+	}
+	sort.Sort(common.PoliciesByPrecedence(ingress))
+	var rules []string
+	for _, policy := range ingress {
+		_, jumps, _, err := policyRules(policy)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, jumps...)
+	}
+	return rules
+}
+
+// egressRules returns rules of egressChain for the egress policies,
+// or none if there are none.
+func egressRules(policies []common.Policy) []string {
+	var egress []common.Policy
+	for _, policy := range policies {
+		if isEgress(policy) {
+			egress = append(egress, policy)
+		}
+	}
+	if len(egress) == 0 {
+		return nil
+	}
+	sort.Sort(common.PoliciesByPrecedence(egress))
+	rules := []string{egressChain + " -m state --state RELATED,ESTABLISHED -j RETURN"}
+	var drops []string
+	for _, policy := range egress {
+		policyRules, _, sets, err := policyRules(policy)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, policyRules...)
+		// Sets of targets come first.
+		for _, set := range sets[:len(policy.AppliedTo)] {
+			drop := fmt.Sprintf("%s -m set --match-set %s src -j DROP", egressChain, set.name())
+			if !containsString(drops, drop) {
+				drops = append(drops, drop)
+			}
+		}
+	}
+	return append(rules, drops...)
+}
+
+// iptables runs iptables with the rule split into arguments.
+func (h Helper) iptables(op string, rule string) error {
+	args := append([]string{op}, strings.Fields(rule)...)
+	if _, err := h.Executor.Exec(iptablesCmd, args); err != nil {
+		return shelloutError(err, iptablesCmd, args)
+	}
+	return nil
+}
+
+// iptablesInsert inserts the rule at the position (from 1) of its chain.
+func (h Helper) iptablesInsert(rule string, position int) error {
+	fields := strings.Fields(rule)
+	args := append([]string{"-I", fields[0], strconv.Itoa(position)}, fields[1:]...)
+	if _, err := h.Executor.Exec(iptablesCmd, args); err != nil {
+		return shelloutError(err, iptablesCmd, args)
+	}
+	return nil
+}
+
+// applyPolicy (re)writes the policy's chain and jumps into it.
+// Must be called with a.policies locked.
+func (a *Agent) applyPolicy(policy common.Policy) error {
+	rules, _, sets, err := policyRules(policy)
+	if err != nil {
+		return err
+	}
+	old, replacing := a.policies.policies[policy.ID]
+	if replacing && isEgress(old) != isEgress(policy) {
+		if err := a.removePolicy(old); err != nil {
+			return err
+		}
+		replacing = false
+	}
+	for _, set := range sets {
+		if err := a.syncSet(set); err != nil {
+			return err
+		}
+	}
+	sync := a.syncEgress
+	if !isEgress(policy) {
+		chain := policyChain(policy)
+		if err := a.Helper.iptables("-F", chain); err != nil {
+			if err := a.Helper.iptables("-N", chain); err != nil {
+				return err
+			}
+		}
+		for _, rule := range rules {
+			if err := a.Helper.iptables("-A", rule); err != nil {
+				return err
+			}
+		}
+		sync = a.syncIngress
+	}
+	a.policies.policies[policy.ID] = policy
+	if err := sync(); err != nil {
+		if replacing {
+			a.policies.policies[policy.ID] = old
+		} else {
+			delete(a.policies.policies, policy.ID)
+		}
+		return err
+	}
+	a.destroyUnusedSets()
+	return nil
+}
+
+// removePolicy deletes the policy's chain and jumps into it.
+// Must be called with a.policies locked.
+func (a *Agent) removePolicy(policy common.Policy) error {
+	if _, _, _, err := policyRules(policy); err != nil {
+		return err
+	}
+	delete(a.policies.policies, policy.ID)
+	if isEgress(policy) {
+		if err := a.syncEgress(); err != nil {
+			return err
+		}
+		a.destroyUnusedSets()
+		return nil
+	}
+	if err := a.syncIngress(); err != nil {
+		return err
+	}
+	chain := policyChain(policy)
+	if a.Helper.iptables("-F", chain) == nil {
+		if err := a.Helper.iptables("-X", chain); err != nil {
+			return err
+		}
+	}
+	a.destroyUnusedSets()
+	return nil
+}
+
+// appliedPolicies returns the applied policies.
+// Must be called with a.policies locked.
+func (a *Agent) appliedPolicies() []common.Policy {
+	policies := make([]common.Policy, 0, len(a.policies.policies))
+	for _, policy := range a.policies.policies {
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// syncIngress rewrites ingressChain for the applied ingress policies,
+// or removes it if there are none. Its hook stays below the one of
+// egressChain. Must be called with a.policies locked.
+func (a *Agent) syncIngress() error {
+	position := 1
+	if a.policies.egressHooked {
+		position = 2
+	}
+	return a.syncChain(ingressChain, ingressRules(a.appliedPolicies()), position)
+}
+
+// syncEgress rewrites egressChain for the applied egress policies,
+// or removes it if there are none. Must be called with a.policies locked.
+func (a *Agent) syncEgress() error {
+	rules := egressRules(a.appliedPolicies())
+	if err := a.syncChain(egressChain, rules, 1); err != nil {
+		return err
+	}
+	a.policies.egressHooked = len(rules) > 0
+	return nil
+}
+
+// syncChain rewrites the chain with the rules and makes sure FORWARD
+// jumps into it, inserting the jump at the position if missing.
+// Without rules, the chain and the jump are removed.
+func (a *Agent) syncChain(chain string, rules []string, position int) error {
+	hook := "FORWARD -j " + chain
+	if len(rules) == 0 {
+		if a.Helper.iptables("-C", hook) == nil {
+			if err := a.Helper.iptables("-D", hook); err != nil {
+				return err
+			}
+		}
+		if a.Helper.iptables("-F", chain) == nil {
+			if err := a.Helper.iptables("-X", chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := a.Helper.iptables("-F", chain); err != nil {
+		if err := a.Helper.iptables("-N", chain); err != nil {
+			return err
+		}
+	}
+	for _, rule := range rules {
+		if err := a.Helper.iptables("-A", rule); err != nil {
+			return err
+		}
+	}
+	if a.Helper.iptables("-C", hook) != nil {
+		if err := a.Helper.iptablesInsert(hook, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyUnusedSets destroys sets not used by any applied policy.
+// Must be called with a.policies locked.
+func (a *Agent) destroyUnusedSets() {
+	used := make(map[membershipSet]bool)
+	for _, policy := range a.policies.policies {
+		_, _, sets, _ := policyRules(policy)
+		for _, set := range sets {
+			used[set] = true
+		}
+	}
+	sets := ipset.NewIpset(a.Helper.Executor)
+	for set := range a.policies.members {
+		if used[set] {
+			continue
+		}
+		if err := sets.Destroy(set.name()); err != nil {
+			glog.Errorf("Agent: cannot destroy %s: %s", set.name(), err)
+			continue
+		}
+		delete(a.policies.members, set)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// policiesByID sorts policies by ID.
+type policiesByID []common.Policy
+
+func (p policiesByID) Len() int           { return len(p) }
+func (p policiesByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p policiesByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// addPolicy applies the policy, replacing the one with the same ID.
+func (a *Agent) addPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policy := input.(*common.Policy)
+	glog.Infof("Agent: applying policy %d (%s)", policy.ID, policy.Name)
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	defer a.policies.notifyChanged()
+	if err := a.applyPolicy(*policy); err != nil {
+		glog.Errorf("Agent: cannot apply policy %d: %s", policy.ID, err)
+		if policy.ID != 0 {
+			a.policies.failed[policy.ID] = common.AppliedPolicy{ID: policy.ID, Revision: policy.Revision, Error: err.Error()}
+		}
+		return nil, err
+	}
+	delete(a.policies.failed, policy.ID)
+	return policy, nil
+}
+
+// deletePolicy removes the policy with the ID of the provided one.
+func (a *Agent) deletePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policy := input.(*common.Policy)
+	glog.Infof("Agent: removing policy %d (%s)", policy.ID, policy.Name)
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	defer a.policies.notifyChanged()
+	delete(a.policies.failed, policy.ID)
+	// The policy may have been applied before the agent restarted,
+	// in which case only the provided definition is known.
+	if applied, ok := a.policies.policies[policy.ID]; ok {
+		policy = &applied
+	}
+	if err := a.removePolicy(*policy); err != nil {
+		glog.Errorf("Agent: cannot remove policy %d: %s", policy.ID, err)
+		return nil, err
+	}
+	return policy, nil
+}
+
+// listPolicies lists applied policies.
+func (a *Agent) listPolicies(input interface{}, ctx common.RestContext) (interface{}, error) {
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	policies := a.appliedPolicies()
+	sort.Sort(policiesByID(policies))
+	return policies, nil
+}
+
+// PolicyRules returns the rules the agent enforces the policies with,
+// as iptables -S lists them without the leading -A: jumps from FORWARD,
+// then rules of ROMANA-EGRESS, ROMANA-INGRESS and of chains of ingress
+// policies in order of their IDs. It fails if the agent would reject
+// any of the policies.
+func PolicyRules(policies []common.Policy) ([]string, error) {
+	for _, policy := range policies {
+		if _, _, _, err := policyRules(policy); err != nil {
+			return nil, err
+		}
+	}
+	egress := egressRules(policies)
+	ingress := ingressRules(policies)
+	var rules []string
+	if len(egress) > 0 {
+		rules = append(rules, "FORWARD -j "+egressChain)
+	}
+	if len(ingress) > 0 {
+		rules = append(rules, "FORWARD -j "+ingressChain)
+	}
+	rules = append(rules, egress...)
+	rules = append(rules, ingress...)
+	sorted := make([]common.Policy, len(policies))
+	copy(sorted, policies)
+	sort.Sort(policiesByID(sorted))
+	for _, policy := range sorted {
+		if isEgress(policy) {
+			continue
+		}
+		chainRules, _, _, _ := policyRules(policy)
+		rules = append(rules, chainRules...)
+	}
+	return rules, nil
+}
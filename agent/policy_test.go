@@ -0,0 +1,437 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common"
+	utilexec "github.com/romana/core/pkg/util/exec"
+)
+
+// TestPolicySets is checking that policies are applied with chains
+// matching ipsets, and that the sets follow endpoints.
+func TestPolicySets(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+
+	tenant, segment := uint64(1), uint64(2)
+	policy := &common.Policy{
+		ID:        7,
+		Name:      "web",
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant, SegmentNetworkID: &segment}},
+		Peers:     []common.Endpoint{{TenantNetworkID: &tenant}, {Cidr: "192.168.0.0/16"}},
+		Rules:     []common.Rule{{Protocol: "TCP", Ports: []uint{80}}},
+	}
+	if _, err := agent.addPolicy(policy, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"/sbin/ipset create -exist romana-t1s2 hash:net",
+		"/sbin/ipset list romana-t1s2",
+		"/sbin/ipset add -exist romana-t1s2 10.65.18.0/24",
+		"/sbin/ipset create -exist romana-t1 hash:net",
+		"/sbin/ipset list romana-t1",
+		"/sbin/ipset add -exist romana-t1 10.65.16.0/20",
+		"/sbin/iptables -F ROMANA-P7",
+		"/sbin/iptables -A ROMANA-P7 -m set --match-set romana-t1 src -p tcp --dport 80 -j ACCEPT",
+		"/sbin/iptables -A ROMANA-P7 -s 192.168.0.0/16 -p tcp --dport 80 -j ACCEPT",
+		"/sbin/iptables -F ROMANA-INGRESS",
+		"/sbin/iptables -A ROMANA-INGRESS -m set --match-set romana-t1s2 dst -j ROMANA-P7",
+		"/sbin/iptables -C FORWARD -j ROMANA-INGRESS",
+	}
+	if *exec.Commands != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), *exec.Commands)
+	}
+
+	// Local endpoints of the segment join both sets,
+	// endpoints of other tenants join none.
+	exec.Commands = nil
+	agent.trackEndpoint(NetIf{Name: "eth1", IP: net.ParseIP("10.0.18.5")}, podEndpoint)
+	agent.trackEndpoint(NetIf{Name: "eth2", IP: net.ParseIP("10.0.34.5")}, podEndpoint)
+	got := strings.Split(*exec.Commands, "\n")
+	sort.Strings(got)
+	expect = []string{
+		"/sbin/ipset add -exist romana-t1 10.0.18.5",
+		"/sbin/ipset add -exist romana-t1s2 10.0.18.5",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+	}
+
+	exec.Commands = nil
+	agent.untrackEndpoint(NetIf{Name: "eth1", IP: net.ParseIP("10.0.18.5")})
+	got = strings.Split(*exec.Commands, "\n")
+	sort.Strings(got)
+	expect = []string{
+		"/sbin/ipset del -exist romana-t1 10.0.18.5",
+		"/sbin/ipset del -exist romana-t1s2 10.0.18.5",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+	}
+
+	policies, _ := agent.listPolicies(nil, common.RestContext{})
+	if len(policies.([]common.Policy)) != 1 {
+		t.Errorf("Expected policy 7 listed, got %v", policies)
+	}
+
+	exec.Commands = nil
+	if _, err := agent.deletePolicy(&common.Policy{ID: 7}, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Split(*exec.Commands, "\n")
+	for _, cmd := range []string{
+		"/sbin/iptables -D FORWARD -j ROMANA-INGRESS",
+		"/sbin/iptables -X ROMANA-INGRESS",
+		"/sbin/iptables -X ROMANA-P7",
+		"/sbin/ipset destroy romana-t1",
+		"/sbin/ipset destroy romana-t1s2",
+	} {
+		if !containsString(got, cmd) {
+			t.Errorf("Expected %s among\n%s", cmd, *exec.Commands)
+		}
+	}
+
+	for _, invalid := range []common.Policy{
+		{Name: "no-id", AppliedTo: policy.AppliedTo, Peers: policy.Peers, Rules: policy.Rules},
+		{ID: 8, AppliedTo: []common.Endpoint{{Cidr: "10.0.0.0/8"}}, Peers: policy.Peers, Rules: policy.Rules},
+		{ID: 8, AppliedTo: policy.AppliedTo, Peers: policy.Peers, Rules: []common.Rule{{Protocol: "sctp"}}},
+	} {
+		_, err := agent.addPolicy(&invalid, common.RestContext{})
+		if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != 400 {
+			t.Errorf("Expected 400 for %v, got %v", invalid, err)
+		}
+	}
+}
+
+// TestPortRuleMatches tests that ports and port ranges of
+// rules are matched with as few multiport matches as possible.
+func TestPortRuleMatches(t *testing.T) {
+	many := make([]uint, 16)
+	for i := range many {
+		many[i] = uint(8000 + i)
+	}
+	for _, tc := range []struct {
+		rule   common.Rule
+		expect []string
+	}{
+		{common.Rule{Protocol: "udp"}, []string{"-p udp"}},
+		{common.Rule{Protocol: "TCP", Ports: []uint{80}}, []string{"-p tcp --dport 80"}},
+		{common.Rule{Protocol: "tcp", Ports: []uint{80, 443}, PortRanges: []common.PortRange{{30000, 32767}}},
+			[]string{"-p tcp -m multiport --dports 80,443,30000:32767"}},
+		{common.Rule{Protocol: "tcp", Ports: many[:14], PortRanges: []common.PortRange{{9000, 9100}}},
+			[]string{"-p tcp -m multiport --dports 8000,8001,8002,8003,8004,8005,8006,8007,8008,8009,8010,8011,8012,8013",
+				"-p tcp -m multiport --dports 9000:9100"}},
+		{common.Rule{Protocol: "udp", Ports: many},
+			[]string{"-p udp -m multiport --dports 8000,8001,8002,8003,8004,8005,8006,8007,8008,8009,8010,8011,8012,8013,8014",
+				"-p udp -m multiport --dports 8015"}},
+	} {
+		matches, err := ruleMatches(tc.rule)
+		if err != nil || strings.Join(matches, "\n") != strings.Join(tc.expect, "\n") {
+			t.Errorf("Expected %v for %v, got %v, %v", tc.expect, tc.rule, matches, err)
+		}
+	}
+}
+
+// TestIcmpRuleMatches tests iptables matches of ICMP rules.
+func TestIcmpRuleMatches(t *testing.T) {
+	for _, tc := range []struct {
+		rule   common.Rule
+		expect string
+	}{
+		{common.Rule{Protocol: "icmp"}, "-p icmp"},
+		{common.Rule{Protocol: "icmp", IcmpType: 8}, "-p icmp --icmp-type 8"},
+		{common.Rule{Protocol: "icmp", IcmpType: 3, IcmpCode: 4}, "-p icmp --icmp-type 3/4"},
+		{common.Rule{Protocol: "ICMP", IcmpTypeName: "echo-reply"}, "-p icmp --icmp-type echo-reply"},
+		{common.Rule{Protocol: "icmp", IcmpTypeName: "Fragmentation-Needed"}, "-p icmp --icmp-type fragmentation-needed"},
+	} {
+		matches, err := ruleMatches(tc.rule)
+		if err != nil || len(matches) != 1 || matches[0] != tc.expect {
+			t.Errorf("Expected %s for %v, got %v, %v", tc.expect, tc.rule, matches, err)
+		}
+	}
+	if _, err := ruleMatches(common.Rule{Protocol: "icmp", IcmpTypeName: "ping"}); err == nil {
+		t.Errorf("Expected error for unknown ICMP type")
+	}
+}
+
+// TestEgressPolicy tests that egress policies share ROMANA-EGRESS,
+// which drops traffic from their targets that none of them allows.
+func TestEgressPolicy(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+	iptablesCommands := func() string {
+		var commands []string
+		for _, cmd := range strings.Split(*exec.Commands, "\n") {
+			if strings.HasPrefix(cmd, iptablesCmd) {
+				commands = append(commands, cmd)
+			}
+		}
+		return strings.Join(commands, "\n")
+	}
+
+	tenant, segment := uint64(1), uint64(2)
+	policy := &common.Policy{
+		ID:        9,
+		Direction: common.PolicyDirectionEgress,
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant, SegmentNetworkID: &segment}},
+		Peers:     []common.Endpoint{{TenantNetworkID: &tenant}, {Cidr: "8.8.8.8/32"}},
+		Rules:     []common.Rule{{Protocol: "UDP", Ports: []uint{53}}},
+	}
+	if _, err := agent.addPolicy(policy, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"/sbin/iptables -F ROMANA-EGRESS",
+		"/sbin/iptables -A ROMANA-EGRESS -m state --state RELATED,ESTABLISHED -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -m set --match-set romana-t1 dst -p udp --dport 53 -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -d 8.8.8.8/32 -p udp --dport 53 -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -j DROP",
+		"/sbin/iptables -C FORWARD -j ROMANA-EGRESS",
+	}
+	if iptablesCommands() != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), iptablesCommands())
+	}
+	if !agent.policies.egressHooked {
+		t.Errorf("Expected FORWARD to jump into ROMANA-EGRESS")
+	}
+
+	// A deny policy of the same priority is checked first.
+	exec.Commands = nil
+	deny := *policy
+	deny.ID, deny.Action, deny.Rules = 10, common.PolicyActionDeny, []common.Rule{{Protocol: common.Wildcard}}
+	if _, err := agent.addPolicy(&deny, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{
+		"/sbin/iptables -F ROMANA-EGRESS",
+		"/sbin/iptables -A ROMANA-EGRESS -m state --state RELATED,ESTABLISHED -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -m set --match-set romana-t1 dst -j DROP",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -d 8.8.8.8/32 -j DROP",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -m set --match-set romana-t1 dst -p udp --dport 53 -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -d 8.8.8.8/32 -p udp --dport 53 -j RETURN",
+		"/sbin/iptables -A ROMANA-EGRESS -m set --match-set romana-t1s2 src -j DROP",
+		"/sbin/iptables -C FORWARD -j ROMANA-EGRESS",
+	}
+	if iptablesCommands() != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), iptablesCommands())
+	}
+	if _, err := agent.deletePolicy(&deny, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	exec.Commands = nil
+	if _, err := agent.deletePolicy(&common.Policy{ID: 9}, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{
+		"/sbin/iptables -C FORWARD -j ROMANA-EGRESS",
+		"/sbin/iptables -D FORWARD -j ROMANA-EGRESS",
+		"/sbin/iptables -F ROMANA-EGRESS",
+		"/sbin/iptables -X ROMANA-EGRESS",
+	}
+	if iptablesCommands() != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), iptablesCommands())
+	}
+	if agent.policies.egressHooked || len(agent.policies.policies) != 0 {
+		t.Errorf("Expected no egress policies left")
+	}
+}
+
+// TestCidrPeers tests that peers given as CIDRs with blocks excepted
+// from them are matched by sets not following endpoints.
+func TestCidrPeers(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+
+	tenant := uint64(1)
+	policy := &common.Policy{
+		ID:        11,
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant}},
+		Peers: []common.Endpoint{
+			{Cidr: "172.16.0.0/12", Except: []string{"172.16.9.0/24", "172.16.5.0/24"}},
+			{Cidr: "203.0.113.0/24"},
+		},
+		Rules: []common.Rule{{Protocol: "TCP", Ports: []uint{5432}}},
+	}
+	set := membershipSet{cidr: "172.16.0.0/12", except: "172.16.5.0/24,172.16.9.0/24"}
+	if _, err := agent.addPolicy(policy, common.RestContext{}); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(*exec.Commands, "\n")
+	for _, cmd := range []string{
+		"/sbin/ipset create -exist " + set.name() + " hash:net",
+		"/sbin/ipset add -exist " + set.name() + " 172.16.0.0/12",
+		"/sbin/ipset add -exist " + set.name() + " 172.16.5.0/24 nomatch",
+		"/sbin/ipset add -exist " + set.name() + " 172.16.9.0/24 nomatch",
+		"/sbin/iptables -A ROMANA-P11 -m set --match-set " + set.name() + " src -p tcp --dport 5432 -j ACCEPT",
+		"/sbin/iptables -A ROMANA-P11 -s 203.0.113.0/24 -p tcp --dport 5432 -j ACCEPT",
+	} {
+		if !containsString(got, cmd) {
+			t.Errorf("Expected %s among\n%s", cmd, *exec.Commands)
+		}
+	}
+
+	// Tenant 0 endpoints do not join the set.
+	exec.Commands = nil
+	agent.trackEndpoint(NetIf{Name: "eth1", IP: net.ParseIP("10.0.2.5")}, podEndpoint)
+	if exec.Commands != nil && strings.Contains(*exec.Commands, set.name()) {
+		t.Errorf("Unexpected %s", *exec.Commands)
+	}
+
+	invalid := *policy
+	invalid.ID = 12
+	invalid.Peers = []common.Endpoint{{Cidr: "172.16.0.0/12", Except: []string{"10.0.0.0/8"}}}
+	_, err := agent.addPolicy(&invalid, common.RestContext{})
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != 400 {
+		t.Errorf("Expected 400 for %v, got %v", invalid, err)
+	}
+}
+
+// TestPolicyPrecedence tests that policies are checked by priority,
+// with deny policies overriding allow ones of the same priority.
+func TestPolicyPrecedence(t *testing.T) {
+	tenant := uint64(1)
+	policy := func(id uint64, action string, priority int) common.Policy {
+		return common.Policy{
+			ID:        id,
+			Action:    action,
+			Priority:  priority,
+			AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant}},
+			Peers:     []common.Endpoint{{Cidr: fmt.Sprintf("10.%d.0.0/16", id)}},
+			Rules:     []common.Rule{{Protocol: common.Wildcard}},
+		}
+	}
+	policies := []common.Policy{
+		policy(1, common.PolicyActionAllow, 0),
+		policy(2, common.PolicyActionDeny, 100),
+		policy(3, common.PolicyActionAllow, 10),
+		policy(4, "", 10),
+		policy(5, "Deny", 10),
+	}
+	// Chains are entered in this order, for peers to be matched in it.
+	var got []string
+	for _, jump := range ingressRules(policies) {
+		got = append(got, jump[strings.LastIndex(jump, " ")+1:])
+	}
+	expect := []string{"ROMANA-P1", "ROMANA-P5", "ROMANA-P3", "ROMANA-P4", "ROMANA-P2"}
+	if strings.Join(got, " ") != strings.Join(expect, " ") {
+		t.Errorf("Expected %v, got %v", expect, got)
+	}
+	rules, _, _, _ := policyRules(policies[4])
+	if expect := "ROMANA-P5 -s 10.5.0.0/16 -j DROP"; len(rules) != 1 || rules[0] != expect {
+		t.Errorf("Expected %s, got %v", expect, rules)
+	}
+}
+
+// TestPolicyRules is checking rules listed for
+// ingress and egress policies together.
+func TestPolicyRules(t *testing.T) {
+	tenant, segment := uint64(1), uint64(2)
+	policies := []common.Policy{
+		{
+			ID:        7,
+			AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant, SegmentNetworkID: &segment}},
+			Peers:     []common.Endpoint{{TenantNetworkID: &tenant}},
+			Rules:     []common.Rule{{Protocol: "TCP", Ports: []uint{80}}},
+		},
+		{
+			ID:        3,
+			Direction: common.PolicyDirectionEgress,
+			AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant}},
+			Peers:     []common.Endpoint{{Cidr: "8.8.8.8/32"}},
+			Rules:     []common.Rule{{Protocol: "UDP", Ports: []uint{53}}},
+		},
+	}
+	rules, err := PolicyRules(policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"FORWARD -j ROMANA-EGRESS",
+		"FORWARD -j ROMANA-INGRESS",
+		"ROMANA-EGRESS -m state --state RELATED,ESTABLISHED -j RETURN",
+		"ROMANA-EGRESS -m set --match-set romana-t1 src -d 8.8.8.8/32 -p udp --dport 53 -j RETURN",
+		"ROMANA-EGRESS -m set --match-set romana-t1 src -j DROP",
+		"ROMANA-INGRESS -m set --match-set romana-t1s2 dst -j ROMANA-P7",
+		"ROMANA-P7 -m set --match-set romana-t1 src -p tcp --dport 80 -j ACCEPT",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(rules, "\n"))
+	}
+
+	policies[0].Peers = nil
+	if _, err := PolicyRules(policies); err == nil {
+		t.Errorf("Expected error for policy without peers")
+	}
+}
+
+// benchmarkPolicy returns a distinct policy for benchmarks,
+// spreading policies over tenants and segments of mockAgent.
+func benchmarkPolicy(id uint64) *common.Policy {
+	tenant, segment := id%15+1, id/15%15+1
+	return &common.Policy{
+		ID:        id,
+		Name:      fmt.Sprintf("bench%d", id),
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant, SegmentNetworkID: &segment}},
+		Peers:     []common.Endpoint{{TenantNetworkID: &tenant}, {Cidr: "192.168.0.0/16"}},
+		Rules:     []common.Rule{{Protocol: "TCP", Ports: []uint{uint(80 + id%1000)}}},
+	}
+}
+
+// BenchmarkApplyPolicy measures applying one more policy on top of
+// the number of policies already applied, which is dominated by
+// rewriting ROMANA-INGRESS.
+func BenchmarkApplyPolicy(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("policies=%d", n), func(b *testing.B) {
+			agent := mockAgent()
+			agent.Helper.Agent = &agent
+			exec := &utilexec.FakeExecutor{}
+			agent.Helper.Executor = exec
+			for i := 1; i <= n; i++ {
+				exec.Commands = nil
+				if _, err := agent.addPolicy(benchmarkPolicy(uint64(i)), common.RestContext{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			policy := benchmarkPolicy(uint64(n + 1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				exec.Commands = nil
+				if _, err := agent.addPolicy(policy, common.RestContext{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Reporting of applied policies to the policy service, which shows
+// operators how far policies have rolled out (see common.PolicyRollout).
+// The agent reports the revisions of the policies it applied and the
+// errors of those it failed to apply as soon as they change, and again
+// every policyStatusInterval in case a report was lost or the policy
+// service restarted.
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+)
+
+const policyStatusInterval = 60 * time.Second
+
+// hostPolicyStatus returns the status of policies on this host.
+func (a *Agent) hostPolicyStatus() common.HostPolicyStatus {
+	a.policies.Lock()
+	defer a.policies.Unlock()
+	host := a.networkConfig.currentHost
+	status := common.HostPolicyStatus{Host: host.Name, Ip: host.Ip, Policies: []common.AppliedPolicy{}}
+	if status.Host == "" {
+		status.Host = host.Ip
+	}
+	for _, policy := range a.policies.policies {
+		status.Policies = append(status.Policies, common.AppliedPolicy{ID: policy.ID, Revision: policy.Revision})
+	}
+	for _, failed := range a.policies.failed {
+		status.Policies = append(status.Policies, failed)
+	}
+	sort.Sort(appliedByID(status.Policies))
+	return status
+}
+
+// appliedByID sorts applied policies by ID.
+type appliedByID []common.AppliedPolicy
+
+func (p appliedByID) Len() int           { return len(p) }
+func (p appliedByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p appliedByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// reportPolicyStatus sends the status of policies
+// on this host to the policy service.
+func (a *Agent) reportPolicyStatus() error {
+	client, err := common.NewRestClient(common.GetRestClientConfig(a.config))
+	if err != nil {
+		return agentError(err)
+	}
+	policyURL, err := client.GetServiceUrl("policy")
+	if err != nil {
+		return agentError(err)
+	}
+	status := a.hostPolicyStatus()
+	if err := client.Post(strings.TrimRight(policyURL, "/")+"/policies/status", status, nil); err != nil {
+		return agentError(err)
+	}
+	glog.V(1).Infof("Agent: reported %d policies to the policy service", len(status.Policies))
+	return nil
+}
+
+// policyStatusLoop reports the status of policies when they change
+// and every interval until done is closed.
+func (a *Agent) policyStatusLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.reportPolicyStatus(); err != nil {
+			glog.Warningf("Agent: cannot report policies: %s", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-a.policies.changed:
+		case <-ticker.C:
+		}
+	}
+}
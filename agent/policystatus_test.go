@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/romana/core/common"
+	utilexec "github.com/romana/core/pkg/util/exec"
+)
+
+// TestPolicyStatus is checking that failures to apply a policy
+// are reported until the policy is applied or deleted.
+func TestPolicyStatus(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.Helper.Executor = &utilexec.FakeExecutor{}
+
+	tenant, segment := uint64(1), uint64(2)
+	invalid := &common.Policy{
+		ID:        8,
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant, SegmentNetworkID: &segment}},
+		Peers:     []common.Endpoint{{TenantNetworkID: &tenant}},
+		Rules:     []common.Rule{{Protocol: "sctp"}},
+	}
+	if _, err := agent.addPolicy(invalid, common.RestContext{}); err == nil {
+		t.Fatalf("Expected policy 8 refused")
+	}
+
+	status := agent.hostPolicyStatus()
+	if status.Host != "" || len(status.Policies) != 1 || status.Policies[0].ID != 8 || status.Policies[0].Error == "" {
+		t.Errorf("Expected policy 8 failed, got %v", status)
+	}
+	select {
+	case <-agent.policies.changed:
+	default:
+		t.Errorf("Expected change of policies signalled")
+	}
+	agent.deletePolicy(&common.Policy{ID: 8}, common.RestContext{})
+	if status := agent.hostPolicyStatus(); len(status.Policies) != 0 {
+		t.Errorf("Expected no policies, got %v", status)
+	}
+}
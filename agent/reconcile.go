@@ -0,0 +1,333 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Reconciliation of routes to other hosts with the topology. Hosts
+// join and leave the topology while the agent runs; every
+// reconcile_interval seconds (60 by default, 0 disables it) the agent
+// gets the current list of hosts from the topology service, adds
+// routes to hosts that are missing them and removes routes to hosts
+// that are gone. Routes added or removed are counted as drift.
+//
+// A route is taken to be a route to another host if it goes via a
+// gateway and its destination is within the datacenter CIDR. Routes
+// to local endpoints have no gateway and are left alone.
+//
+// Unless watch_topology is false, the agent also watches the host
+// events of the topology service and reconciles routes as soon as
+// hosts are added, updated or removed. With an event bus configured
+// (see common/bus.go) and the push_events feature enabled (see
+// common/features), host events are received from the bus instead
+// of being long-polled from topology.
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+const (
+	defaultReconcileInterval = 60 * time.Second
+
+	// How long to wait before watching host events again
+	// after the topology service could not be reached.
+	hostEventsRetryInterval = 10 * time.Second
+)
+
+// parseReconcileInterval returns how often to reconcile routes,
+// or 0 if they should not be reconciled.
+func parseReconcileInterval(serviceSpecific map[string]interface{}) (time.Duration, error) {
+	seconds, ok := serviceSpecific["reconcile_interval"].(float64)
+	if !ok {
+		return defaultReconcileInterval, nil
+	}
+	if seconds < 0 {
+		return 0, agentErrorString(fmt.Sprintf("Invalid reconcile_interval %v", seconds))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseWatchTopology returns whether to watch host events.
+func parseWatchTopology(serviceSpecific map[string]interface{}) (bool, error) {
+	value, ok := serviceSpecific["watch_topology"]
+	if !ok {
+		return true, nil
+	}
+	enabled, ok := value.(bool)
+	if !ok {
+		return false, agentErrorString(fmt.Sprintf("Invalid watch_topology %v, expected true or false", value))
+	}
+	return enabled, nil
+}
+
+// watchHostEvents reconciles routes on every change to hosts
+// in topology until done is closed.
+func (a *Agent) watchHostEvents(done <-chan struct{}) {
+	for {
+		err := a.followTopology(done)
+		if err == nil {
+			return
+		}
+		glog.Warningf("Agent: cannot watch host events, retrying in %v: %s", hostEventsRetryInterval, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(hostEventsRetryInterval):
+		}
+	}
+}
+
+// followBusHostEvents calls onChange on host events from the bus until
+// done is closed. Events arriving while onChange runs are coalesced
+// into one more call.
+func followBusHostEvents(bus common.EventBus, onChange func(), done <-chan struct{}) error {
+	changed := make(chan struct{}, 1)
+	err := bus.Subscribe(common.BusTopicHosts, func(event common.BusEvent) {
+		glog.V(1).Infof("Agent: host event %s from %s on the bus", event.Type, event.Source)
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return agentError(err)
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-changed:
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+// followTopology finds the host events of the topology service
+// and follows them (see followHostEvents).
+func (a *Agent) followTopology(done <-chan struct{}) error {
+	client, err := common.NewRestClient(common.GetRestClientConfig(a.config))
+	if err != nil {
+		return agentError(err)
+	}
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return agentError(err)
+	}
+	index := common.IndexResponse{}
+	if err := client.Get(topologyURL, &index); err != nil {
+		return agentError(err)
+	}
+	eventsURL := index.Links.FindByRel("host-events")
+	if eventsURL == "" {
+		return agentErrorString("Topology service does not provide host events")
+	}
+	return followHostEvents(client, eventsURL, a.reconcileRoutes, done)
+}
+
+// followHostEvents calls onChange whenever there are new host
+// events at eventsURL, until done is closed (returning nil)
+// or events cannot be read.
+func followHostEvents(client *common.RestClient, eventsURL string, onChange func(), done <-chan struct{}) error {
+	list := common.HostEventList{}
+	if err := client.Get(eventsURL, &list); err != nil {
+		return agentError(err)
+	}
+	seq := list.Seq
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		list = common.HostEventList{}
+		err := client.Get(fmt.Sprintf("%s?watch=true&since=%d", eventsURL, seq), &list)
+		if err != nil {
+			return agentError(err)
+		}
+		if list.Reset || len(list.Events) > 0 {
+			glog.V(1).Infof("Agent: %d host event(s) since %d (reset: %t), reconciling routes", len(list.Events), seq, list.Reset)
+			onChange()
+		}
+		seq = list.Seq
+	}
+}
+
+// reconcileLoop reconciles routes every interval until done is closed.
+func (a *Agent) reconcileLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			a.reconcileRoutes()
+		}
+	}
+}
+
+// reconcileHandler handles requests to reconcile routes right away,
+// which the topology service sends when a host is removed.
+func (a *Agent) reconcileHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	go a.reconcileRoutes()
+	return nil, nil
+}
+
+// reconcileRoutes updates network configuration from the topology
+// service and reconciles routes to other hosts with it.
+func (a *Agent) reconcileRoutes() {
+	networkConfig, err := a.fetchNetworkConfig()
+	if err != nil {
+		glog.Warningf("Agent: cannot get hosts from topology, not reconciling routes: %s", err)
+		return
+	}
+	*a.networkConfig = *networkConfig
+	if err := a.Helper.reconcileInterHostRoutes(); err != nil {
+		glog.Error("Agent: ", err)
+	}
+	a.syncPolicySets()
+	a.saveState()
+}
+
+// reconcileInterHostRoutes ensures routes to exactly the other hosts exist.
+func (h Helper) reconcileInterHostRoutes() error {
+	expected, err := h.interHostRoutes()
+	if err != nil {
+		return err
+	}
+	for _, route := range expected {
+		existing, err := h.Netlink.RouteList(route.Dst)
+		if err != nil {
+			return agentError(err)
+		}
+		if !containsRoute(existing, route) {
+			glog.Infof("Agent: route %s is missing", route)
+			h.Agent.metrics.routeDrift.Inc("missing")
+		}
+	}
+	if err := h.ensureInterHostRoutes(); err != nil {
+		return err
+	}
+
+	h.ensureInterHostRoutesMutex.Lock()
+	defer h.ensureInterHostRoutesMutex.Unlock()
+	stale, err := h.staleInterHostRoutes(expected)
+	if err != nil {
+		return err
+	}
+	for _, route := range stale {
+		glog.Infof("Agent: removing stale route %s", route)
+		if err := h.Netlink.RouteDel(route); err != nil && !utilnetlink.IsNotExist(err) {
+			h.Agent.metrics.routeErrors.Inc()
+			return agentError(err)
+		}
+		h.Agent.metrics.routeDrift.Inc("stale")
+	}
+	return nil
+}
+
+// staleInterHostRoutes returns routes to other hosts
+// which exist but are not among the expected ones.
+func (h Helper) staleInterHostRoutes(expected []utilnetlink.Route) ([]utilnetlink.Route, error) {
+	_, dcNet, err := net.ParseCIDR(h.Agent.networkConfig.dc.Cidr)
+	if err != nil {
+		return nil, agentError(err)
+	}
+	dcLen, _ := dcNet.Mask.Size()
+	routes, err := h.Netlink.RouteList(nil)
+	if err != nil {
+		return nil, agentError(err)
+	}
+	var stale []utilnetlink.Route
+	for _, route := range routes {
+		dstLen, _ := route.Dst.Mask.Size()
+		if route.Gw == nil || dstLen < dcLen || !dcNet.Contains(route.Dst.IP) || containsRoute(expected, route) {
+			continue
+		}
+		stale = append(stale, route)
+	}
+	return stale, nil
+}
+
+// RouteStatus is a route to another host, as reported on GET
+// to /routes. Expected routes which are not present are missing,
+// and present ones which are not expected are stale; the agent
+// fixes both when it next reconciles routes.
+type RouteStatus struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+	Interface   string `json:"interface,omitempty"`
+	Expected    bool   `json:"expected"`
+	Present     bool   `json:"present"`
+}
+
+// routesHandler reports routes to other hosts.
+func (a *Agent) routesHandler(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return a.Helper.interHostRouteStatus()
+}
+
+// interHostRouteStatus compares routes to other
+// hosts with those the topology calls for.
+func (h Helper) interHostRouteStatus() ([]RouteStatus, error) {
+	expected, err := h.interHostRoutes()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]RouteStatus, 0, len(expected))
+	for _, route := range expected {
+		existing, err := h.Netlink.RouteList(route.Dst)
+		if err != nil {
+			return nil, agentError(err)
+		}
+		status = append(status, RouteStatus{
+			Destination: route.Dst.String(),
+			Gateway:     route.Gw.String(),
+			Interface:   route.LinkName,
+			Expected:    true,
+			Present:     containsRoute(existing, route),
+		})
+	}
+	stale, err := h.staleInterHostRoutes(expected)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range stale {
+		status = append(status, RouteStatus{
+			Destination: route.Dst.String(),
+			Gateway:     route.Gw.String(),
+			Interface:   route.LinkName,
+			Present:     true,
+		})
+	}
+	return status, nil
+}
+
+// containsRoute returns true if one of the routes is the route.
+func containsRoute(routes []utilnetlink.Route, route utilnetlink.Route) bool {
+	for _, r := range routes {
+		if r.Equal(route) {
+			return true
+		}
+	}
+	return false
+}
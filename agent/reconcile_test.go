@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestReconcileRoutes is checking that missing routes to other hosts
+// are reported and added and stale ones reported and removed, leaving
+// other routes alone.
+func TestReconcileRoutes(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	route := func(dst string, gw string, linkName string) utilnetlink.Route {
+		_, dstNet, _ := net.ParseCIDR(dst)
+		return utilnetlink.Route{Dst: dstNet, Gw: net.ParseIP(gw), LinkName: linkName}
+	}
+	nl := &utilnetlink.FakeNetlink{Routes: []utilnetlink.Route{
+		route("0.0.0.0/0", "192.168.0.1", "eth0"),
+		route("172.16.0.0/12", "192.168.0.1", "eth0"),
+		route("10.0.0.5/32", "", "tap1"),
+		route("10.66.0.0/16", "192.168.0.13", ""),
+	}}
+	agent.Helper.Netlink = nl
+
+	status, err := agent.Helper.interHostRouteStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || !status[0].Expected || status[0].Present || status[1].Expected || !status[1].Present {
+		t.Errorf("Expected a missing and a stale route, got %+v", status)
+	}
+
+	if err := agent.Helper.reconcileInterHostRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "route replace 10.65.0.0/16 via 192.168.0.12\nroute del 10.66.0.0/16 via 192.168.0.13"
+	if got := strings.Join(nl.Commands, "\n"); got != expect {
+		t.Errorf("Expected\n%s\ngot\n%s", expect, got)
+	}
+	if len(nl.Routes) != 4 {
+		t.Errorf("Expected 4 routes left, got %v", nl.Routes)
+	}
+
+	// Nothing to do when routes match the topology.
+	nl.Commands = nil
+	if err := agent.Helper.reconcileInterHostRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(nl.Commands) != 0 {
+		t.Errorf("Expected no changes, got %v", nl.Commands)
+	}
+	status, err = agent.Helper.interHostRouteStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || !status[0].Present {
+		t.Errorf("Expected the route present, got %+v", status)
+	}
+	missing := agent.metrics.routeDrift.Value("missing")
+	stale := agent.metrics.routeDrift.Value("stale")
+	if missing != 1 || stale != 1 {
+		t.Errorf("Expected 1 missing and 1 stale route, got %v and %v", missing, stale)
+	}
+}
+
+func TestFollowHostEvents(t *testing.T) {
+	if watch, err := parseWatchTopology(map[string]interface{}{}); !watch || err != nil {
+		t.Errorf("Expected watch_topology enabled by default, got %t, %v", watch, err)
+	}
+	if _, err := parseWatchTopology(map[string]interface{}{"watch_topology": "yes"}); err == nil {
+		t.Error("Expected error for invalid watch_topology")
+	}
+
+	var requests []string
+	topology := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		requests = append(requests, r.URL.RawQuery)
+		list := common.HostEventList{Seq: 3, Events: []common.HostEvent{}}
+		switch r.URL.Query().Get("since") {
+		case "3":
+			list.Seq = 4
+			list.Events = []common.HostEvent{{Seq: 4, Type: common.HostRemoved, Host: common.Host{Name: "host2"}}}
+		case "4":
+			// Topology restarted.
+			list.Seq = 1
+			list.Reset = true
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer topology.Close()
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(topology.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := 0
+	done := make(chan struct{})
+	onChange := func() {
+		changes++
+		if changes == 2 {
+			close(done)
+		}
+	}
+	if err := followHostEvents(client, topology.URL+"/events", onChange, done); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"", "watch=true&since=3", "watch=true&since=4"}
+	if !reflect.DeepEqual(requests, expect) {
+		t.Errorf("Expected requests %v, got %v", expect, requests)
+	}
+}
+
+// fakeBus is an event bus delivering events published on it.
+type fakeBus struct {
+	handlers map[string]func(common.BusEvent)
+}
+
+func (bus *fakeBus) Publish(topic string, eventType string, resource interface{}) error {
+	bus.handlers[topic](common.BusEvent{Type: eventType, Source: "topology"})
+	return nil
+}
+
+func (bus *fakeBus) Subscribe(topic string, handler func(common.BusEvent)) error {
+	bus.handlers[topic] = handler
+	return nil
+}
+
+func (bus *fakeBus) Close() error {
+	return nil
+}
+
+// TestFollowBusHostEvents tests that host events from the bus
+// arriving during reconciliation are coalesced.
+func TestFollowBusHostEvents(t *testing.T) {
+	bus := &fakeBus{handlers: make(map[string]func(common.BusEvent))}
+	done := make(chan struct{})
+	defer close(done)
+	calls := make(chan int, 10)
+	release := make(chan struct{})
+	n := 0
+	onChange := func() {
+		n++
+		calls <- n
+		<-release
+	}
+	if err := followBusHostEvents(bus, onChange, done); err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(common.BusTopicHosts, common.HostAdded, nil)
+	<-calls
+	for i := 0; i < 3; i++ {
+		bus.Publish(common.BusTopicHosts, common.HostUpdated, nil)
+	}
+	release <- struct{}{}
+	if call := <-calls; call != 2 {
+		t.Errorf("Expected second call, got %d", call)
+	}
+	release <- struct{}{}
+	select {
+	case call := <-calls:
+		t.Errorf("Expected events to be coalesced, got call %d", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
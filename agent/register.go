@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Registration of the host with the topology service. If the agent is
+// configured with bootstrap_token, it registers its host on startup
+// instead of relying on the host being added to topology by hand, and
+// then registers it again every heartbeat_interval seconds (30 by
+// default) so that topology knows the host is alive. The record is
+//
+//   host_name     - defaults to the system hostname
+//   host_ip       - defaults to the address selected for host_routes
+//                   (see interfaces.go) or else the address the host
+//                   reaches the root service from
+//   romana_cidr   - defaults to the network of the address selected
+//                   for the gateway, if the gateway is selected
+//
+// and the port the agent listens on.
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+)
+
+const defaultHeartbeatInterval = 30 * time.Second
+
+// hostRegistration is the configuration of host registration.
+type hostRegistration struct {
+	token      string
+	name       string
+	ip         string
+	romanaCIDR string
+	interval   time.Duration
+}
+
+// parseRegistrationConfig returns the configuration of host
+// registration, or nil if the host should not register itself.
+func parseRegistrationConfig(serviceSpecific map[string]interface{}) (*hostRegistration, error) {
+	token, _ := serviceSpecific["bootstrap_token"].(string)
+	if token == "" {
+		return nil, nil
+	}
+	reg := &hostRegistration{token: token, interval: defaultHeartbeatInterval}
+	reg.name, _ = serviceSpecific["host_name"].(string)
+	reg.ip, _ = serviceSpecific["host_ip"].(string)
+	if reg.ip != "" && net.ParseIP(reg.ip) == nil {
+		return nil, agentErrorString(fmt.Sprintf("Invalid host_ip %s", reg.ip))
+	}
+	reg.romanaCIDR, _ = serviceSpecific["romana_cidr"].(string)
+	if reg.romanaCIDR != "" {
+		if _, _, err := net.ParseCIDR(reg.romanaCIDR); err != nil {
+			return nil, agentErrorString(fmt.Sprintf("Invalid romana_cidr %s", reg.romanaCIDR))
+		}
+	}
+	if seconds, ok := serviceSpecific["heartbeat_interval"].(float64); ok {
+		if seconds <= 0 {
+			return nil, agentErrorString(fmt.Sprintf("Invalid heartbeat_interval %v", seconds))
+		}
+		reg.interval = time.Duration(seconds * float64(time.Second))
+	}
+	return reg, nil
+}
+
+// registrationHost returns the host record to register,
+// filling in what is not configured.
+func (a *Agent) registrationHost() (common.Host, error) {
+	reg := a.registration
+	host := common.Host{Name: reg.name, Ip: reg.ip, RomanaIp: reg.romanaCIDR, AgentPort: a.config.Common.Api.Port}
+	if host.AgentPort == 0 {
+		return host, agentErrorString("Cannot register host without agent port configured")
+	}
+	if host.Name == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return host, agentError(err)
+		}
+		host.Name = name
+	}
+	if host.Ip != "" && host.RomanaIp != "" {
+		return host, nil
+	}
+	addrs, err := a.Helper.Netlink.AddrList()
+	if err != nil {
+		return host, agentError(err)
+	}
+	if host.Ip == "" && a.hostSelector != (addrSelector{}) {
+		for _, addr := range addrs {
+			if a.hostSelector.matches(addr) {
+				host.Ip = addr.IPNet.IP.String()
+				break
+			}
+		}
+	}
+	if host.Ip == "" {
+		ip, err := a.rootSourceAddr()
+		if err != nil {
+			return host, err
+		}
+		host.Ip = ip.String()
+	}
+	if host.RomanaIp == "" && a.gatewaySelector != (addrSelector{}) {
+		for _, addr := range addrs {
+			if a.gatewaySelector.matches(addr) {
+				network := net.IPNet{IP: addr.IPNet.IP.Mask(addr.IPNet.Mask), Mask: addr.IPNet.Mask}
+				host.RomanaIp = network.String()
+				break
+			}
+		}
+	}
+	if host.RomanaIp == "" {
+		return host, agentErrorString("Cannot register host: romana_cidr is not configured and no gateway address is selected")
+	}
+	return host, nil
+}
+
+// rootSourceAddr returns the local address used to reach the root service.
+func (a *Agent) rootSourceAddr() (net.IP, error) {
+	rootURL, err := url.Parse(a.config.Common.Api.RootServiceUrl)
+	if err != nil || rootURL.Host == "" {
+		return nil, agentErrorString(fmt.Sprintf("Cannot determine host_ip from root URL %s", a.config.Common.Api.RootServiceUrl))
+	}
+	hostPort := rootURL.Host
+	if rootURL.Port() == "" {
+		hostPort = net.JoinHostPort(rootURL.Hostname(), "80")
+	}
+	// Nothing is sent over UDP, this only picks the route.
+	conn, err := net.Dial("udp", hostPort)
+	if err != nil {
+		return nil, agentError(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// registerHost registers the host with the topology service.
+func (a *Agent) registerHost() error {
+	client, err := common.NewRestClient(common.GetRestClientConfig(a.config))
+	if err != nil {
+		return agentError(err)
+	}
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return agentError(err)
+	}
+	return a.postRegistration(client, topologyURL)
+}
+
+// postRegistration sends the host record to the topology service at the URL.
+func (a *Agent) postRegistration(client *common.RestClient, topologyURL string) error {
+	host, err := a.registrationHost()
+	if err != nil {
+		return err
+	}
+	index := common.IndexResponse{}
+	if err := client.Get(topologyURL, &index); err != nil {
+		return agentError(err)
+	}
+	regURL := index.Links.FindByRel("host-registration")
+	if regURL == "" {
+		return agentErrorString("Topology service does not support host registration")
+	}
+	registered := common.Host{}
+	err = client.Post(regURL, common.HostRegistration{Host: host, Token: a.registration.token}, &registered)
+	if err != nil {
+		return agentError(err)
+	}
+	glog.V(1).Infof("Agent: registered host %s (%s, %s) as %d", host.Name, host.Ip, host.RomanaIp, registered.ID)
+	return nil
+}
+
+// heartbeatLoop registers the host every interval until done is closed.
+func (a *Agent) heartbeatLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := a.registerHost(); err != nil {
+				glog.Warningf("Agent: heartbeat to topology failed: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestHostRegistration is checking that the agent registers
+// its host with topology using the bootstrap token.
+func TestHostRegistration(t *testing.T) {
+	reg, err := parseRegistrationConfig(map[string]interface{}{})
+	if reg != nil || err != nil {
+		t.Errorf("Expected registration disabled, got %v, %v", reg, err)
+	}
+	for _, invalid := range []map[string]interface{}{
+		{"bootstrap_token": "secret", "host_ip": "host1"},
+		{"bootstrap_token": "secret", "romana_cidr": "10.65.0.1"},
+		{"bootstrap_token": "secret", "heartbeat_interval": float64(0)},
+	} {
+		if _, err := parseRegistrationConfig(invalid); err == nil {
+			t.Errorf("Expected error for %v", invalid)
+		}
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.config.Common.Api = &common.Api{Port: 9604}
+	ip, ipnet, _ := net.ParseCIDR("10.65.0.1/16")
+	ipnet.IP = ip
+	hostIP, hostNet, _ := net.ParseCIDR("192.168.0.11/24")
+	hostNet.IP = hostIP
+	agent.Helper.Netlink = &utilnetlink.FakeNetlink{Addrs: []utilnetlink.Addr{
+		{IPNet: hostNet, LinkName: "eth0", Label: "eth0"},
+		{IPNet: ipnet, LinkName: "romana-gw", Label: "romana-gw"},
+	}}
+	agent.gatewaySelector = addrSelector{linkName: "romana-gw"}
+	agent.hostSelector = addrSelector{linkName: "eth0"}
+	agent.registration, err = parseRegistrationConfig(map[string]interface{}{
+		"bootstrap_token": "secret",
+		"host_name":       "host1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received common.HostRegistration
+	topology := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			json.NewEncoder(w).Encode(common.IndexResponse{
+				ServiceName: "topology",
+				Links:       common.Links{{Href: "/hosts/register", Rel: "host-registration"}},
+			})
+		case "/hosts/register":
+			json.NewDecoder(r.Body).Decode(&received)
+			host := received.Host
+			host.ID = 1
+			json.NewEncoder(w).Encode(host)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer topology.Close()
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(topology.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.postRegistration(client, topology.URL); err != nil {
+		t.Fatal(err)
+	}
+	expect := common.HostRegistration{
+		Host:  common.Host{Name: "host1", Ip: "192.168.0.11", RomanaIp: "10.65.0.0/16", AgentPort: 9604},
+		Token: "secret",
+	}
+	if !reflect.DeepEqual(received, expect) {
+		t.Errorf("Expected %+v, got %+v", expect, received)
+	}
+
+	// Without the gateway selected, the Romana CIDR must be configured.
+	agent.gatewaySelector = addrSelector{}
+	if _, err := agent.registrationHost(); err == nil {
+		t.Error("Expected error without romana_cidr")
+	}
+}
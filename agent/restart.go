@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Graceful restart. Routes and firewall rules the agent programs
+// stay in place when it exits, and provisioning them again is
+// idempotent, so an agent resuming from its state file (see state.go)
+// does not disturb traffic. What can be lost is an endpoint whose
+// provisioning was interrupted by the exit. When configured with
+//
+//   graceful_restart: true
+//   graceful_restart_timeout: 30   # optional, seconds
+//
+// the agent, on SIGINT or SIGTERM, stops accepting requests to
+// provision or tear down endpoints, waits for those in progress to
+// finish, and writes the state file before exiting, so that the
+// next agent (e.g. after an upgrade) picks up exactly where it left.
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+)
+
+const defaultGracefulRestartTimeout = 30 * time.Second
+
+// parseGracefulRestartConfig returns whether graceful restart
+// is configured, and how long to wait for endpoints being
+// provisioned when shutting down.
+func parseGracefulRestartConfig(serviceSpecific map[string]interface{}, stateFile string) (bool, time.Duration, error) {
+	enabled, _ := serviceSpecific["graceful_restart"].(bool)
+	if !enabled {
+		return false, 0, nil
+	}
+	if stateFile == "" {
+		return false, 0, agentErrorString("graceful_restart requires state_file")
+	}
+	timeout := defaultGracefulRestartTimeout
+	if seconds, ok := serviceSpecific["graceful_restart_timeout"].(float64); ok {
+		if seconds <= 0 {
+			return false, 0, agentErrorString(fmt.Sprintf("Invalid graceful_restart_timeout %v", seconds))
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return true, timeout, nil
+}
+
+// endpointRequests tracks requests that change endpoints,
+// so that the agent can wait for them before exiting.
+type endpointRequests struct {
+	sync.Mutex
+	shuttingDown bool
+	inProgress   sync.WaitGroup
+}
+
+// begin registers a request, or returns an error if the
+// agent is shutting down. Every successful begin must
+// be followed by end.
+func (r *endpointRequests) begin() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.shuttingDown {
+		return common.NewHttpError(http.StatusServiceUnavailable, "Agent is restarting")
+	}
+	r.inProgress.Add(1)
+	return nil
+}
+
+func (r *endpointRequests) end() {
+	r.inProgress.Done()
+}
+
+// drain rejects new requests and waits for requests in progress
+// for at most the timeout, returning false if they did not finish.
+func (r *endpointRequests) drain(timeout time.Duration) bool {
+	r.Lock()
+	r.shuttingDown = true
+	r.Unlock()
+	done := make(chan struct{})
+	go func() {
+		r.inProgress.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown prepares the agent to exit without disrupting traffic.
+func (a *Agent) shutdown() {
+	glog.Infof("Agent: shutting down, waiting for endpoints being provisioned")
+	if !a.requests.drain(a.gracefulRestartTimeout) {
+		glog.Warningf("Agent: endpoints still being provisioned after %v may have to be provisioned again", a.gracefulRestartTimeout)
+	}
+	a.saveState()
+	glog.Infof("Agent: saved state to %s, leaving routes and firewall rules in place", a.stateFile)
+}
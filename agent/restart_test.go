@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// TestGracefulRestart is checking that the agent waits for endpoints
+// being provisioned and saves its state before exiting.
+func TestGracefulRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	if _, _, err := parseGracefulRestartConfig(map[string]interface{}{"graceful_restart": true}, ""); err == nil {
+		t.Error("Expected error for graceful restart without state file")
+	}
+	enabled, timeout, err := parseGracefulRestartConfig(map[string]interface{}{"graceful_restart": true, "graceful_restart_timeout": 0.5}, stateFile)
+	if !enabled || timeout != 500*time.Millisecond || err != nil {
+		t.Errorf("Unexpected configuration %v, %v, %v", enabled, timeout, err)
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.stateFile = stateFile
+	agent.gracefulRestartTimeout = time.Second
+	agent.linkMonitor = newLinkMonitor(&agent)
+
+	if err := agent.requests.begin(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		agent.shutdown()
+		close(done)
+	}()
+	// Wait for shutdown to start rejecting requests.
+	for i := 0; ; i++ {
+		agent.requests.Lock()
+		shuttingDown := agent.requests.shuttingDown
+		agent.requests.Unlock()
+		if shuttingDown {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Agent is not shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = agent.vmUpHandler(&NetIf{Name: "tap2"}, common.RestContext{})
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != 503 {
+		t.Errorf("Expected 503 while shutting down, got %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected shutdown to wait for the endpoint being provisioned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	agent.trackEndpoint(NetIf{Name: "tap1", IP: net.ParseIP("10.0.0.5")}, vmEndpoint)
+	agent.requests.end()
+	<-done
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil || !strings.Contains(string(data), `"tap1"`) {
+		t.Errorf("Expected tap1 in saved state, got %s (%v)", data, err)
+	}
+
+	// Endpoints taking too long do not prevent the exit.
+	agent.requests = &endpointRequests{}
+	agent.gracefulRestartTimeout = 10 * time.Millisecond
+	agent.requests.begin()
+	agent.shutdown()
+}
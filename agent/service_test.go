@@ -17,9 +17,16 @@ package agent
 // Some comments on use of mocking framework in helpers_test.go.
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
 	// Dependencies for disabled test below
 	// "github.com/romana/core/common"
 	// "log"
@@ -64,3 +71,63 @@ func TestK8SHandler(t *testing.T) {
 	log.Printf("Sent to agent %v, agent returned %v", nr, result)
 }
 */
+
+// TestDockerPlugin tests the Docker plugin API.
+func TestDockerPlugin(t *testing.T) {
+	agent := mockAgent()
+	agent.Helper.Executor = &utilexec.FakeExecutor{}
+	d := &dockerDriver{agent: &agent, endpoints: make(map[string]net.IP)}
+	server := httptest.NewServer(d.mux())
+	defer server.Close()
+
+	call := func(method string, req string, result interface{}) int {
+		resp, err := http.Post(server.URL+"/"+method, dockerPluginContentType, strings.NewReader(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	activate := struct{ Implements []string }{}
+	call("Plugin.Activate", "", &activate)
+	if strings.Join(activate.Implements, ",") != "NetworkDriver,IpamDriver" {
+		t.Errorf("Unexpected activation response %v", activate)
+	}
+
+	errResp := dockerErrorResponse{}
+	if call("IpamDriver.RequestPool", `{"AddressSpace": "romana", "Options": {"tenant": "t1"}}`, &errResp) != http.StatusInternalServerError || errResp.Err == "" {
+		t.Errorf("Expected error without segment, got %v", errResp)
+	}
+	pool := dockerPoolResponse{}
+	call("IpamDriver.RequestPool", `{"AddressSpace": "romana", "Options": {"tenant": "t1", "segment": "s1"}}`, &pool)
+	if pool.PoolID != "t1/s1" || pool.Pool != "10.0.0.0/8" {
+		t.Errorf("Unexpected pool %v", pool)
+	}
+	addr := dockerAddressResponse{}
+	call("IpamDriver.RequestAddress", `{"PoolID": "t1/s1", "Options": {"RequestAddressType": "com.docker.network.gateway"}}`, &addr)
+	if addr.Address != "172.17.0.1/8" {
+		t.Errorf("Expected gateway address 172.17.0.1/8, got %s", addr.Address)
+	}
+
+	errResp = dockerErrorResponse{}
+	if call("NetworkDriver.Join", `{"EndpointID": "0123456789abcdef"}`, &errResp) != http.StatusInternalServerError {
+		t.Error("Expected error joining unknown endpoint")
+	}
+	call("NetworkDriver.CreateEndpoint", `{"EndpointID": "0123456789abcdef", "Interface": {"Address": "10.1.2.3/8"}}`, &struct{}{})
+	netif, err := d.endpointNetIf("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if netif.Name != "romana01234567" || netif.IP.String() != "10.1.2.3" {
+		t.Errorf("Unexpected interface %v", netif)
+	}
+	call("NetworkDriver.DeleteEndpoint", `{"EndpointID": "0123456789abcdef"}`, &struct{}{})
+	if _, err := d.endpointNetIf("0123456789abcdef"); err == nil {
+		t.Error("Expected endpoint to be forgotten")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Protection against endpoints using addresses that were not
+// allocated to them. Unless anti_spoofing is set to false, the
+// interface of every provisioned endpoint gets
+//   - proxy_arp, so that the host answers the endpoint's ARP
+//     requests for the romana gateway, which has no address
+//     on the endpoint's link;
+//   - strict rp_filter, so that the kernel drops packets whose
+//     source address is not routed back via the interface;
+//   - iptables rules dropping packets from the interface with source
+//     IP or MAC other than those of the endpoint's IPAM record.
+// Endpoints are routed, not bridged, so frames from them never
+// reach other endpoints at layer 2 and ebtables is not needed.
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+// parseAntiSpoofing returns whether endpoints should be
+// protected against spoofing, which they are by default.
+func parseAntiSpoofing(serviceSpecific map[string]interface{}) (bool, error) {
+	value, ok := serviceSpecific["anti_spoofing"]
+	if !ok {
+		return true, nil
+	}
+	enabled, ok := value.(bool)
+	if !ok {
+		return false, agentErrorString(fmt.Sprintf("Invalid anti_spoofing %v, expected true or false", value))
+	}
+	return enabled, nil
+}
+
+// protectEndpoint configures the endpoint's interface and the
+// firewall so that the endpoint can only use its own addresses.
+func (a *Agent) protectEndpoint(fw firewall.Firewall, netif NetIf) error {
+	if !a.antiSpoofing {
+		return nil
+	}
+	glog.Infof("Agent: enabling anti-spoofing for %s", netif.Name)
+	if err := a.Helper.setEndpointSysctls(netif.Name); err != nil {
+		return err
+	}
+	return fw.ProvisionAntiSpoofing(netif)
+}
+
+// setEndpointSysctls enables proxy ARP and strict reverse
+// path filtering on the interface.
+func (h Helper) setEndpointSysctls(ifaceName string) error {
+	cmd := "sysctl"
+	// Slashes rather than dots separate the key, as the
+	// interface name may contain dots (e.g. eth0.100).
+	args := []string{"-w",
+		fmt.Sprintf("net/ipv4/conf/%s/proxy_arp=1", ifaceName),
+		fmt.Sprintf("net/ipv4/conf/%s/rp_filter=1", ifaceName),
+	}
+	if _, err := h.Executor.Exec(cmd, args); err != nil {
+		return shelloutError(err, cmd, args)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+// TestAntiSpoofing is checking that endpoints get proxy ARP, strict
+// reverse path filtering and anti-spoofing rules unless disabled.
+func TestAntiSpoofing(t *testing.T) {
+	for _, tc := range []struct {
+		ss      map[string]interface{}
+		enabled bool
+		ok      bool
+	}{
+		{map[string]interface{}{}, true, true},
+		{map[string]interface{}{"anti_spoofing": false}, false, true},
+		{map[string]interface{}{"anti_spoofing": "no"}, false, false},
+	} {
+		enabled, err := parseAntiSpoofing(tc.ss)
+		if enabled != tc.enabled || (err == nil) != tc.ok {
+			t.Errorf("Unexpected result for %v: %v, %v", tc.ss, enabled, err)
+		}
+	}
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	exec := &utilexec.FakeExecutor{}
+	agent.Helper.Executor = exec
+	fw, err := firewall.NewFirewall(exec, firewall.NewDbRuleRepository(agent.store), agent.networkConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netif := NetIf{Name: "eth0.100", Mac: "02:00:0a:00:00:05", IP: net.ParseIP("10.0.0.5")}
+
+	if err := agent.protectEndpoint(fw, netif); err != nil {
+		t.Fatal(err)
+	}
+	if exec.Commands != nil {
+		t.Errorf("Expected no commands with anti-spoofing disabled, got\n%s", *exec.Commands)
+	}
+
+	agent.antiSpoofing = true
+	if err := agent.protectEndpoint(fw, netif); err != nil {
+		t.Fatal(err)
+	}
+	commands := strings.Split(*exec.Commands, "\n")
+	expect := "sysctl -w net/ipv4/conf/eth0.100/proxy_arp=1 net/ipv4/conf/eth0.100/rp_filter=1"
+	if commands[0] != expect {
+		t.Errorf("Expected %s, got %s", expect, commands[0])
+	}
+	expect = "/sbin/iptables -C FORWARD -i eth0.100 ! -s 10.0.0.5/32 -j DROP"
+	if !strings.Contains(*exec.Commands, expect) {
+		t.Errorf("Expected %s among\n%s", expect, *exec.Commands)
+	}
+}
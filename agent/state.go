@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// Local state of the agent. If configured with state_file, the agent
+// saves what it learned about the network from the topology service,
+// along with the endpoints it has provisioned, to that file. After a
+// restart it resumes from the saved state right away, reconciling
+// routes and endpoints without waiting for the topology service,
+// which is queried again in the background.
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/romana/core/common"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+)
+
+// agentState is the content of the state file.
+type agentState struct {
+	Datacenter  common.Datacenter `json:"datacenter"`
+	CurrentHost common.Host       `json:"current_host"`
+	OtherHosts  []common.Host     `json:"other_hosts"`
+	// Address and mask of the romana gateway, in CIDR notation.
+	RomanaGW  string          `json:"romana_gw"`
+	Endpoints []endpointState `json:"endpoints"`
+}
+
+// endpointState is a provisioned endpoint in the state file.
+type endpointState struct {
+	NetIf NetIf        `json:"netif"`
+	Kind  endpointKind `json:"kind"`
+}
+
+type endpointsByName []endpointState
+
+func (e endpointsByName) Len() int           { return len(e) }
+func (e endpointsByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e endpointsByName) Less(i, j int) bool { return e[i].NetIf.Name < e[j].NetIf.Name }
+
+// saveState writes the current state to the state file, if any.
+func (a *Agent) saveState() {
+	if a.stateFile == "" {
+		return
+	}
+	gw := net.IPNet{IP: a.networkConfig.romanaGW, Mask: a.networkConfig.romanaGWMask}
+	state := agentState{
+		Datacenter:  a.networkConfig.dc,
+		CurrentHost: a.networkConfig.currentHost,
+		OtherHosts:  a.networkConfig.otherHosts,
+		RomanaGW:    gw.String(),
+		Endpoints:   []endpointState{},
+	}
+	if a.linkMonitor != nil {
+		a.linkMonitor.Lock()
+		for _, ep := range a.linkMonitor.endpoints {
+			state.Endpoints = append(state.Endpoints, endpointState{NetIf: ep.netif, Kind: ep.kind})
+		}
+		a.linkMonitor.Unlock()
+	}
+	sort.Sort(endpointsByName(state.Endpoints))
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		glog.Errorf("Agent: cannot save state: %s", err)
+		return
+	}
+	// Write to another file first so that a crash while
+	// writing does not leave a corrupt state file behind.
+	tmpFile := a.stateFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, a.stateFile)
+	}
+	if err != nil {
+		glog.Errorf("Agent: cannot save state to %s: %s", a.stateFile, err)
+	}
+}
+
+// restoreState restores network configuration from the state file,
+// returning the endpoints that were provisioned, or false if there
+// is no usable saved state.
+func (a *Agent) restoreState() ([]provisionedEndpoint, bool) {
+	if a.stateFile == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(a.stateFile)
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		glog.Warningf("Agent: cannot read state from %s: %s", a.stateFile, err)
+		return nil, false
+	}
+	state := agentState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		glog.Warningf("Agent: cannot parse state in %s: %s", a.stateFile, err)
+		return nil, false
+	}
+	gw, gwNet, err := net.ParseCIDR(state.RomanaGW)
+	if err != nil {
+		glog.Warningf("Agent: invalid romana gateway in %s: %s", a.stateFile, err)
+		return nil, false
+	}
+	a.networkConfig.dc = state.Datacenter
+	a.networkConfig.currentHost = state.CurrentHost
+	a.networkConfig.otherHosts = state.OtherHosts
+	a.networkConfig.romanaGW = gw
+	a.networkConfig.romanaGWMask = gwNet.Mask
+	var endpoints []provisionedEndpoint
+	for _, ep := range state.Endpoints {
+		endpoints = append(endpoints, provisionedEndpoint{netif: ep.NetIf, kind: ep.Kind})
+	}
+	glog.Infof("Agent: restored state of host %s with %d endpoint(s) from %s", state.CurrentHost.Name, len(endpoints), a.stateFile)
+	return endpoints, true
+}
+
+// resumeEndpoints provisions again, in the background, endpoints
+// that were provisioned before a restart and whose interfaces
+// still exist. Endpoints whose interfaces are gone were torn down
+// while the agent was not running, and are forgotten.
+func (a *Agent) resumeEndpoints(endpoints []provisionedEndpoint) {
+	var resumed []provisionedEndpoint
+	for _, ep := range endpoints {
+		if _, err := a.Helper.Netlink.LinkByName(ep.netif.Name); err != nil {
+			glog.Infof("Agent: forgetting endpoint %s: %s", ep.netif.Name, err)
+			continue
+		}
+		a.linkMonitor.track(ep.netif, ep.kind)
+		resumed = append(resumed, ep)
+	}
+	a.saveState()
+	go func() {
+		for _, ep := range resumed {
+			if err := a.linkMonitor.provision(ep); err != nil {
+				glog.Errorf("Agent: failed to resume endpoint %s: %s", ep.netif.Name, err)
+			}
+		}
+	}()
+}
+
+// refreshNetworkConfig queries the topology service for network
+// configuration that was restored from the saved state, in case it
+// changed while the agent was not running.
+func (a *Agent) refreshNetworkConfig() {
+	networkConfig, err := a.fetchNetworkConfig()
+	if err != nil {
+		glog.Warningf("Agent: cannot refresh network configuration, using saved: %s", err)
+		return
+	}
+	*a.networkConfig = *networkConfig
+	if err := a.Helper.ensureInterHostRoutes(); err != nil {
+		glog.Error("Agent: ", agentError(err))
+	}
+	a.saveState()
+}
+
+// fetchNetworkConfig gets network configuration from the topology
+// service, keeping the interface selected for routes to other hosts.
+func (a *Agent) fetchNetworkConfig() (*NetworkConfig, error) {
+	fresh := Agent{config: a.config, networkConfig: &NetworkConfig{}, Helper: a.Helper, gatewaySelector: a.gatewaySelector}
+	if err := fresh.identifyCurrentHost(); err != nil {
+		return nil, err
+	}
+	fresh.networkConfig.hostLink = a.networkConfig.hostLink
+	fresh.networkConfig.hostAddr = a.networkConfig.hostAddr
+	return fresh.networkConfig, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestAgentState is checking that the agent saves its network
+// configuration and endpoints, and resumes from them after restart.
+func TestAgentState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	agent := mockAgent()
+	agent.Helper.Agent = &agent
+	agent.stateFile = stateFile
+	agent.networkConfig.currentHost = common.Host{Name: "host1", Ip: "192.168.0.11", RomanaIp: "10.64.0.1/16"}
+	agent.networkConfig.romanaGWMask = net.CIDRMask(16, 32)
+	nl := &utilnetlink.FakeNetlink{Links: map[string]utilnetlink.Link{
+		"veth1": {Name: "veth1", Index: 1, Up: true},
+		"tap2":  {Name: "tap2", Index: 2, Up: true},
+	}}
+	agent.Helper.Netlink = nl
+	agent.linkMonitor = newLinkMonitor(&agent)
+	agent.trackEndpoint(NetIf{Name: "veth1", IP: net.ParseIP("10.64.0.5")}, podEndpoint)
+	agent.trackEndpoint(NetIf{Name: "tap2", IP: net.ParseIP("10.64.0.6")}, vmEndpoint)
+	agent.trackEndpoint(NetIf{Name: "veth3", IP: net.ParseIP("10.64.0.7")}, podEndpoint)
+	agent.untrackEndpoint(NetIf{Name: "veth3"})
+
+	// when
+	// restarted, and tap2 was deleted in the meantime
+	delete(nl.Links, "tap2")
+	restarted := Agent{stateFile: stateFile, networkConfig: &NetworkConfig{}}
+	helper := NewAgentHelper(&restarted)
+	helper.Netlink = nl
+	restarted.Helper = &helper
+	restarted.linkMonitor = newLinkMonitor(&restarted)
+	provisioned := make(chan string, 3)
+	restarted.linkMonitor.provision = func(ep provisionedEndpoint) error {
+		provisioned <- ep.netif.Name
+		return nil
+	}
+	endpoints, ok := restarted.restoreState()
+	if !ok {
+		t.Fatal("Expected state to be restored")
+	}
+	restarted.resumeEndpoints(endpoints)
+
+	// expect
+	if len(endpoints) != 2 || endpoints[0].netif.Name != "tap2" || endpoints[1].kind != podEndpoint {
+		t.Errorf("Unexpected endpoints restored: %v", endpoints)
+	}
+	if name := <-provisioned; name != "veth1" {
+		t.Errorf("Expected veth1 to be provisioned again, got %s", name)
+	}
+	nc := restarted.networkConfig
+	if nc.currentHost.Name != "host1" || len(nc.otherHosts) != 1 || nc.otherHosts[0].Ip != "192.168.0.12" ||
+		nc.dc.Cidr != "10.0.0.0/8" || nc.romanaGW.String() != "172.17.0.1" || nc.RomanaGWMask().String() != "ffff0000" {
+		t.Errorf("Unexpected network configuration restored: %+v", nc)
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "tap2") {
+		t.Errorf("Expected tap2 to be forgotten, got %s", data)
+	}
+
+	// when
+	// there is no state
+	restarted.stateFile = filepath.Join(dir, "missing.json")
+	if _, ok := restarted.restoreState(); ok {
+		t.Error("Expected no state to be restored")
+	}
+}
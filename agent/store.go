@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"github.com/golang/glog"
 	"github.com/romana/core/common"
 	"github.com/romana/core/pkg/util/firewall"
@@ -67,10 +68,10 @@ const (
 // CreateSchemaPostProcess implements CreateSchemaPostProcess method of
 // Service interface.
 func (agentStore *agentStore) CreateSchemaPostProcess() error {
-	return nil
+	return firewall.AddRuleIndexes(agentStore.Db)
 }
 
-func (agentStore *agentStore) deleteRoute(route *Route) error {
+func (agentStore *agentStore) deleteRoute(ctx context.Context, route *Route) error {
 	glog.V(1).Info("Acquiring store mutex for deleteRoute")
 	agentStore.mu.Lock()
 	defer func() {
@@ -78,6 +79,9 @@ func (agentStore *agentStore) deleteRoute(route *Route) error {
 		agentStore.mu.Unlock()
 	}()
 	glog.V(1).Info("Acquired store mutex for deleteRoute")
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 
 	db := agentStore.DbStore.Db
 	agentStore.DbStore.Db.Delete(route)
@@ -92,7 +96,7 @@ func (agentStore *agentStore) deleteRoute(route *Route) error {
 	return nil
 }
 
-func (agentStore *agentStore) findRouteByIface(routeIface string) (*Route, error) {
+func (agentStore *agentStore) findRouteByIface(ctx context.Context, routeIface string) (*Route, error) {
 	glog.V(1).Info("Acquiring store mutex for findRoute")
 	agentStore.mu.Lock()
 	defer func() {
@@ -100,6 +104,9 @@ func (agentStore *agentStore) findRouteByIface(routeIface string) (*Route, error
 		agentStore.mu.Unlock()
 	}()
 	glog.V(1).Info("Acquired store mutex for findRoute")
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 
 	var route Route
 	db := agentStore.DbStore.Db
@@ -114,7 +121,7 @@ func (agentStore *agentStore) findRouteByIface(routeIface string) (*Route, error
 	return &route, nil
 }
 
-func (agentStore *agentStore) addRoute(route *Route) error {
+func (agentStore *agentStore) addRoute(ctx context.Context, route *Route) error {
 	glog.V(1).Info("Acquiring store mutex for addRoute")
 	agentStore.mu.Lock()
 	defer func() {
@@ -122,6 +129,9 @@ func (agentStore *agentStore) addRoute(route *Route) error {
 		agentStore.mu.Unlock()
 	}()
 	glog.V(1).Info("Acquired store mutex for addRoute")
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 
 	db := agentStore.DbStore.Db
 	agentStore.DbStore.Db.Create(route)
@@ -139,7 +149,7 @@ func (agentStore *agentStore) addRoute(route *Route) error {
 	return nil
 }
 
-func (agentStore *agentStore) listRoutes() ([]Route, error) {
+func (agentStore *agentStore) listRoutes(ctx context.Context) ([]Route, error) {
 	glog.V(1).Info("Acquiring store mutex for listRoutes")
 	agentStore.mu.Lock()
 	defer func() {
@@ -147,6 +157,9 @@ func (agentStore *agentStore) listRoutes() ([]Route, error) {
 		agentStore.mu.Unlock()
 	}()
 	glog.V(1).Info("Acquired store mutex for listRoutes")
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 
 	var routes []Route
 	agentStore.DbStore.Db.Find(&routes)
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+// VXLAN overlay. Where the underlay cannot route Romana CIDRs, the
+// agent can carry inter-host traffic over VXLAN instead, when
+// configured with
+//
+//   overlay: vxlan
+//   vxlan_id: 1        # optional, VXLAN network identifier
+//   vxlan_port: 4789   # optional, UDP port
+//
+// The agent creates the VXLAN interface, adds a forwarding entry to
+// every other host in the topology, and routes each host's Romana
+// CIDR via its Romana gateway address through the interface.
+
+import (
+	"fmt"
+	"net"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+const (
+	vxlanDevice      = "romana-vxlan"
+	defaultVxlanID   = 1
+	defaultVxlanPort = 4789
+)
+
+// parseOverlayConfig returns the VXLAN interface to create
+// according to the agent configuration, or nil if
+// inter-host traffic is routed natively.
+func parseOverlayConfig(serviceSpecific map[string]interface{}) (*utilnetlink.Vxlan, error) {
+	switch overlay := serviceSpecific["overlay"]; overlay {
+	case nil, "", "none":
+		return nil, nil
+	case "vxlan":
+	default:
+		return nil, agentErrorString(fmt.Sprintf("Unknown overlay %v", overlay))
+	}
+	vxlan := &utilnetlink.Vxlan{Name: vxlanDevice, VNI: defaultVxlanID, Port: defaultVxlanPort}
+	if id, ok := serviceSpecific["vxlan_id"].(float64); ok {
+		vxlan.VNI = int(id)
+	}
+	if port, ok := serviceSpecific["vxlan_port"].(float64); ok {
+		vxlan.Port = int(port)
+	}
+	if vxlan.VNI <= 0 || vxlan.VNI >= 1<<24 {
+		return nil, agentErrorString(fmt.Sprintf("Invalid vxlan_id %d", vxlan.VNI))
+	}
+	if vxlan.Port <= 0 || vxlan.Port > 65535 {
+		return nil, agentErrorString(fmt.Sprintf("Invalid vxlan_port %d", vxlan.Port))
+	}
+	return vxlan, nil
+}
+
+// ensureOverlayRoutes ensures the VXLAN interface exists and has
+// forwarding entries and routes to exactly the other hosts.
+func (h Helper) ensureOverlayRoutes() error {
+	vxlan := *h.Agent.vxlan
+	vxlan.Local = h.Agent.networkConfig.hostAddr
+	if vxlan.Local == nil {
+		vxlan.Local = net.ParseIP(h.Agent.networkConfig.currentHost.Ip)
+	}
+	if err := utilnetlink.EnsureVxlan(h.Netlink, vxlan); err != nil {
+		return agentError(err)
+	}
+
+	var dsts []net.IP
+	for _, host := range h.Agent.networkConfig.otherHosts {
+		hostIP := net.ParseIP(host.Ip)
+		if hostIP == nil {
+			return failedToParseOtherHosts(host.Ip)
+		}
+		dsts = append(dsts, hostIP)
+	}
+	routes, err := h.interHostRoutes()
+	if err != nil {
+		return err
+	}
+	if err := utilnetlink.EnsureFdb(h.Netlink, vxlan.Name, dsts); err != nil {
+		return agentError(err)
+	}
+	return h.ensureRoutes(routes)
+}
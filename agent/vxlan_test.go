@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+)
+
+// TestOverlayRoutes is checking that with VXLAN overlay configured,
+// ensureInterHostRoutes creates the VXLAN interface, forwarding entries
+// for other hosts and routes through it.
+func TestOverlayRoutes(t *testing.T) {
+	agent := mockAgent()
+	vxlan, err := parseOverlayConfig(map[string]interface{}{"overlay": "vxlan", "vxlan_id": float64(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.vxlan = vxlan
+	agent.Helper.Agent = &agent
+	agent.networkConfig.currentHost.Ip = "192.168.0.11"
+	nl := &utilnetlink.FakeNetlink{Fdb: map[string][]net.IP{
+		vxlanDevice: {net.ParseIP("192.168.0.99")},
+	}}
+	agent.Helper.Netlink = nl
+
+	// when
+	if err := agent.Helper.ensureInterHostRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Helper.ensureInterHostRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	// expect
+	expect := strings.Join([]string{
+		"link add vxlan romana-vxlan id 7 dstport 4789 local 192.168.0.11",
+		"link set up romana-vxlan",
+		"fdb append 192.168.0.12 dev romana-vxlan",
+		"fdb del 192.168.0.99 dev romana-vxlan",
+		"route replace 10.65.0.0/16 via 10.65.0.0 dev romana-vxlan onlink",
+		"link set up romana-vxlan",
+	}, "\n")
+	got := strings.Join(nl.Commands, "\n")
+	if expect != got {
+		t.Errorf("TestOverlayRoutes returned unexpected operations, expect\n%s\ngot\n%s", expect, got)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"overlay": "gre"},
+		{"overlay": "vxlan", "vxlan_id": float64(1 << 24)},
+		{"overlay": "vxlan", "vxlan_port": float64(0)},
+	} {
+		if _, err := parseOverlayConfig(bad); err == nil {
+			t.Errorf("Expected error for %v", bad)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package allinone runs root, topology, tenant, IPAM and policy
+// services in one process, for development, demos and small
+// deployments. Services find each other through root as usual,
+// but stores of services configured with the same database share
+// connections to it.
+package allinone
+
+import (
+	"log"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/policy"
+	"github.com/romana/core/root"
+	"github.com/romana/core/tenant"
+	"github.com/romana/core/topology"
+)
+
+// service is a service run in the process.
+type service struct {
+	name         string
+	run          func(rootURL string, cred *common.Credential) (*common.RestServiceInfo, error)
+	createSchema func(rootURL string, overwrite bool) error
+}
+
+// services are run in this order, dependencies first.
+var services = []service{
+	{"topology", topology.Run, topology.CreateSchema},
+	{"tenant", tenant.Run, tenant.CreateSchema},
+	{"ipam", ipam.Run, ipam.CreateSchema},
+	{"policy", policy.Run, policy.CreateSchema},
+}
+
+// Schema says whether Run creates schemas of the services.
+type Schema int
+
+const (
+	// KeepSchema uses the schemas as they are.
+	KeepSchema Schema = iota
+	// CreateSchema creates schemas of the services first.
+	CreateSchema
+	// OverwriteSchema drops and creates schemas of the services first.
+	OverwriteSchema
+)
+
+// Run starts root with the configuration at configLocation (see
+// root.Run), then the rest of the services, each once the previous
+// one is serving. It returns the information of the running services
+// by name, and the URL of root.
+func Run(configLocation string, schema Schema) (map[string]*common.RestServiceInfo, string, error) {
+	// systemd is to be notified once all services are ready,
+	// not as soon as root is.
+	ready := common.DelayReadyNotification()
+	defer ready()
+	infos := make(map[string]*common.RestServiceInfo)
+	rootInfo, err := root.Run(configLocation)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Println(<-rootInfo.Channel)
+	infos[common.ServiceRoot] = rootInfo
+	rootURL := "http://" + rootInfo.Address
+
+	if schema != KeepSchema {
+		for _, svc := range services {
+			log.Printf("All-in-one: creating schema of %s", svc.name)
+			err = svc.createSchema(rootURL, schema == OverwriteSchema)
+			if err != nil {
+				return infos, rootURL, err
+			}
+		}
+	}
+
+	// Only once schemas are created, as creating those
+	// of SQLite databases replaces their files.
+	common.ShareStoreConnections()
+	for _, svc := range services {
+		log.Printf("All-in-one: starting %s", svc.name)
+		info, err := svc.run(rootURL, nil)
+		if err != nil {
+			return infos, rootURL, err
+		}
+		log.Println(<-info.Channel)
+		infos[svc.name] = info
+	}
+	return infos, rootURL, nil
+}
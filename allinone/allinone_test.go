@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package allinone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romana/core/common"
+)
+
+const configTemplate = `services:
+  - service: root
+    api:
+      host: 127.0.0.1
+      port: 0
+  - service: ipam
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/ipam.sqlite3
+  - service: tenant
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/tenant.sqlite3
+  - service: topology
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/topology.sqlite3
+      datacenter:
+        ip_version: 4
+        cidr: 10.0.0.0/8
+        host_bits: 8
+        tenant_bits: 4
+        segment_bits: 4
+        endpoint_space_bits: 0
+        endpoint_bits: 8
+  - service: policy
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/policy.sqlite3
+`
+
+// TestRun tests that all services run in one process
+// and register with root.
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allinone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "romana.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(configTemplate, dir)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, rootURL, err := Run(configFile, CreateSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 5 {
+		t.Errorf("Expected 5 services, got %v", infos)
+	}
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.GetClusterStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Healthy || len(status.Services) != 5 {
+		t.Errorf("Expected 5 healthy services, got %+v", status)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command to run Romana services in one process.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/romana/core/allinone"
+	"github.com/romana/core/common"
+)
+
+// Main entry point for running services all in one
+func main() {
+	all := flag.Bool("all", false, "Run root, topology, tenant, IPAM and policy services in this process")
+	configFileName := flag.String("c", "", "Configuration file, or etcd key as etcd://host:port/key")
+	createSchema := flag.Bool("createSchema", false, "Create schemas of the services first")
+	overwriteSchema := flag.Bool("overwriteSchema", false, "Overwrite schemas of the services first")
+	version := flag.Bool("version", false, "Build Information.")
+	flag.Parse()
+	if *version {
+		fmt.Println(common.BuildInfo())
+		return
+	}
+	if !*all {
+		fmt.Fprintln(os.Stderr, "Only running all services with --all is supported.")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	schema := allinone.KeepSchema
+	if *overwriteSchema {
+		schema = allinone.OverwriteSchema
+	} else if *createSchema {
+		schema = allinone.CreateSchema
+	}
+	infos, rootURL, err := allinone.Run(*configFileName, schema)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("All services are running, root is at %s", rootURL)
+	for name, info := range infos {
+		go func(name string, info *common.RestServiceInfo) {
+			for {
+				msg := <-info.Channel
+				log.Printf("%s: %v", name, msg)
+			}
+		}(name, info)
+	}
+	select {}
+}
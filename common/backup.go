@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Backups of stores of services, taken together so that references
+// between records of different services can be checked before they
+// are restored.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// BackupVersion is the version of the format of Backup.
+// Backups of other versions are not restored.
+const BackupVersion = 1
+
+// BackupServices are the services whose stores are backed up, in
+// the order they are restored: services referred to come first.
+var BackupServices = []string{"tenant", "topology", "ipam", "policy"}
+
+// Backup is a versioned archive of snapshots of the stores
+// of BackupServices.
+type Backup struct {
+	Version int `json:"version"`
+	// When the backup was taken, in seconds since the epoch.
+	Created int64 `json:"created"`
+	// Build of the tool that took it.
+	Build     string          `json:"build"`
+	Snapshots []StoreSnapshot `json:"snapshots"`
+}
+
+// Snapshot returns the snapshot of the service in
+// the backup, or nil if there is none.
+func (b Backup) Snapshot(service string) *StoreSnapshot {
+	for i := range b.Snapshots {
+		if b.Snapshots[i].Service == service {
+			return &b.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// table returns the table of the snapshot of the service,
+// which is empty if the backup does not have it.
+func (b Backup) table(service string, name string) *TableSnapshot {
+	if snapshot := b.Snapshot(service); snapshot != nil {
+		if table := snapshot.Table(name); table != nil {
+			return table
+		}
+	}
+	return &TableSnapshot{Name: name}
+}
+
+// Validate checks that the backup can be restored: it is of
+// BackupVersion, has snapshots of all BackupServices, and records
+// refer only to records the backup has. Segments refer to their
+// tenants, labels of hosts to the hosts, endpoints in use to their
+// tenants, segments and hosts, and policies to tenants and segments
+// they apply to or peer with. All dangling references are reported.
+func (b Backup) Validate() error {
+	if b.Version != BackupVersion {
+		return NewError400(fmt.Sprintf("Cannot restore backup of version %d, expected version %d", b.Version, BackupVersion))
+	}
+	for _, service := range BackupServices {
+		if b.Snapshot(service) == nil {
+			return NewError400(fmt.Sprintf("Backup has no snapshot of %s", service))
+		}
+	}
+	var errs []error
+	dangling := func(format string, args ...interface{}) {
+		errs = append(errs, errors.New(fmt.Sprintf(format, args...)))
+	}
+
+	tenants := b.table("tenant", "tenants")
+	segments := b.table("tenant", "segments")
+	hosts := b.table("topology", "hosts")
+	tenantIDs := tenants.values("id")
+	segmentIDs := segments.values("id")
+	hostIDs := hosts.values("id")
+
+	for _, row := range segments.Rows {
+		if tenantID := snapshotString(segments.Value(row, "tenant_id")); !tenantIDs[tenantID] {
+			dangling("Segment %s refers to tenant %s, which is not in the backup", snapshotString(segments.Value(row, "id")), tenantID)
+		}
+	}
+	labels := b.table("topology", "host_labels")
+	for _, row := range labels.Rows {
+		if hostID := snapshotString(labels.Value(row, "host_id")); !hostIDs[hostID] {
+			dangling("Label %s refers to host %s, which is not in the backup", snapshotString(labels.Value(row, "key")), hostID)
+		}
+	}
+
+	endpoints := b.table("ipam", "endpoints")
+	for _, row := range endpoints.Rows {
+		if !snapshotTrue(endpoints.Value(row, "in_use")) {
+			continue
+		}
+		ip := snapshotString(endpoints.Value(row, "ip"))
+		if id := snapshotString(endpoints.Value(row, "tenant_id")); !tenantIDs[id] {
+			dangling("Endpoint %s refers to tenant %s, which is not in the backup", ip, id)
+		}
+		if id := snapshotString(endpoints.Value(row, "segment_id")); !segmentIDs[id] {
+			dangling("Endpoint %s refers to segment %s, which is not in the backup", ip, id)
+		}
+		if id := snapshotString(endpoints.Value(row, "host_id")); !hostIDs[id] {
+			dangling("Endpoint %s refers to host %s, which is not in the backup", ip, id)
+		}
+	}
+
+	// Policies refer to tenants and segments by the network IDs
+	// they were augmented with; segments are kept by tenant.
+	tenantsByNetwork := make(map[string]string)
+	for _, row := range tenants.Rows {
+		tenantsByNetwork[snapshotString(tenants.Value(row, "network_id"))] = snapshotString(tenants.Value(row, "id"))
+	}
+	segmentNetworks := make(map[string]bool)
+	for _, row := range segments.Rows {
+		segmentNetworks[snapshotString(segments.Value(row, "tenant_id"))+"/"+snapshotString(segments.Value(row, "network_id"))] = true
+	}
+	policies := b.table("policy", "policies")
+	for _, row := range policies.Rows {
+		if policies.Value(row, "deleted_at") != nil {
+			continue
+		}
+		policy := Policy{}
+		if err := json.Unmarshal([]byte(snapshotString(policies.Value(row, "policy"))), &policy); err != nil {
+			dangling("Policy %s cannot be read: %v", snapshotString(policies.Value(row, "id")), err)
+			continue
+		}
+		for _, endpoint := range append(policy.AppliedTo, policy.Peers...) {
+			if endpoint.TenantNetworkID == nil {
+				continue
+			}
+			tenantID, ok := tenantsByNetwork[fmt.Sprint(*endpoint.TenantNetworkID)]
+			if !ok {
+				dangling("Policy %s refers to tenant with network ID %d, which is not in the backup", policy.Name, *endpoint.TenantNetworkID)
+				continue
+			}
+			if endpoint.SegmentNetworkID != nil && !segmentNetworks[fmt.Sprintf("%s/%d", tenantID, *endpoint.SegmentNetworkID)] {
+				dangling("Policy %s refers to segment with network ID %d of tenant %s, which is not in the backup", policy.Name, *endpoint.SegmentNetworkID, tenantID)
+			}
+		}
+	}
+	return MakeMultiError(errs)
+}
+
+// values returns the values of the column in
+// rows of the table, as snapshotString does.
+func (t TableSnapshot) values(column string) map[string]bool {
+	values := make(map[string]bool)
+	for _, row := range t.Rows {
+		values[snapshotString(t.Value(row, column))] = true
+	}
+	return values
+}
+
+// snapshotString returns the value in a snapshot as a string, so that
+// IDs kept as integers and as strings compare equal.
+func snapshotString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// snapshotTrue returns whether the value in a snapshot is true,
+// as databases keep booleans as booleans or integers.
+func snapshotTrue(value interface{}) bool {
+	switch snapshotString(value) {
+	case "true", "1":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestBackupValidate tests checks of references
+// between services in backups.
+func TestBackupValidate(t *testing.T) {
+	policy := func(tenantNetworkID uint64, segmentNetworkID uint64) string {
+		data, _ := json.Marshal(Policy{
+			Name:      "web",
+			AppliedTo: []Endpoint{{TenantNetworkID: &tenantNetworkID, SegmentNetworkID: &segmentNetworkID}},
+			Peers:     []Endpoint{{Cidr: "10.0.0.0/8"}},
+		})
+		return string(data)
+	}
+	backup := func(segmentTenant int64, endpointHost string, policyDoc string) Backup {
+		return Backup{
+			Version: BackupVersion,
+			Snapshots: []StoreSnapshot{
+				{Service: "tenant", Tables: []TableSnapshot{
+					{Name: "tenants", Columns: []string{"id", "network_id"}, Rows: [][]interface{}{{int64(1), int64(0)}}},
+					{Name: "segments", Columns: []string{"id", "tenant_id", "network_id"}, Rows: [][]interface{}{{int64(2), segmentTenant, int64(1)}}},
+				}},
+				{Service: "topology", Tables: []TableSnapshot{
+					{Name: "hosts", Columns: []string{"id"}, Rows: [][]interface{}{{int64(3)}}},
+				}},
+				{Service: "ipam", Tables: []TableSnapshot{
+					{Name: "endpoints", Columns: []string{"ip", "tenant_id", "segment_id", "host_id", "in_use"}, Rows: [][]interface{}{
+						{"10.0.0.3", "1", "2", endpointHost, true},
+						// Released endpoints may refer to anything.
+						{"10.0.0.4", "9", "9", "9", int64(0)},
+					}},
+				}},
+				{Service: "policy", Tables: []TableSnapshot{
+					{Name: "policies", Columns: []string{"id", "policy", "deleted_at"}, Rows: [][]interface{}{
+						{int64(1), policyDoc, nil},
+						{int64(2), policy(7, 7), "2017-03-01 10:00:00"},
+					}},
+				}},
+			},
+		}
+	}
+	if err := backup(1, "3", policy(0, 1)).Validate(); err != nil {
+		t.Errorf("Expected valid backup, got %v", err)
+	}
+	for _, invalid := range []Backup{
+		backup(5, "3", policy(0, 1)),
+		backup(1, "4", policy(0, 1)),
+		backup(1, "3", policy(1, 1)),
+		backup(1, "3", policy(0, 2)),
+		backup(1, "3", "{"),
+		{Version: BackupVersion + 1},
+		{Version: BackupVersion, Snapshots: []StoreSnapshot{{Service: "tenant"}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", invalid)
+		}
+	}
+	// All dangling references are reported.
+	err := backup(5, "4", policy(0, 1)).Validate()
+	if multi, ok := err.(*MultiError); !ok || len(multi.GetErrors()) != 3 {
+		t.Errorf("Expected 3 errors, got %v", err)
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Optional fan-out of domain events through a message bus. Services
+// publish events such as hosts added, endpoints allocated or policies
+// changed to NATS or Kafka, and agents and listeners subscribe to
+// them instead of polling, which matters in large clusters. The bus
+// is configured per service in a "bus" section:
+//
+//   "bus": {
+//     "type": "nats",
+//     "url": "nats://nats.example.com:4222",
+//     "topic_prefix": "romana"
+//   }
+//
+// NATS is spoken over its text protocol directly. Kafka is reached
+// through the Confluent REST Proxy (API v2), with "url" pointing at
+// the proxy; subscribers join the consumer group "group", which
+// defaults to one per service and host, so that every subscriber
+// receives every event.
+//
+// Delivery is best effort: events published while the bus cannot
+// be reached are lost, so subscribers should still reconcile from
+// time to time.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topics of events.
+const (
+	BusTopicHosts     = "hosts"
+	BusTopicEndpoints = "endpoints"
+	BusTopicPolicies  = "policies"
+)
+
+// Types of events on BusTopicEndpoints and BusTopicPolicies; events
+// on BusTopicHosts are of the types of HostEvent.
+const (
+	EndpointAllocated = "allocated"
+	EndpointReleased  = "released"
+	PolicyAdded       = "added"
+	PolicyUpdated     = "updated"
+	PolicyDeleted     = "deleted"
+)
+
+const (
+	defaultBusTopicPrefix = "romana"
+	// Timeout of a single operation on the bus.
+	busTimeout = 5 * time.Second
+	// How long to wait before connecting again
+	// to a bus that cannot be reached.
+	busRetryInterval = 2 * time.Second
+	// How long the Kafka REST proxy may hold a fetch of records.
+	kafkaFetchTimeout = time.Second
+
+	kafkaContentType     = "application/vnd.kafka.v2+json"
+	kafkaJSONContentType = "application/vnd.kafka.json.v2+json"
+)
+
+// BusEvent is a domain event published on a topic of the bus.
+type BusEvent struct {
+	Type string `json:"type"`
+	// Service that published the event.
+	Source    string `json:"source"`
+	Timestamp int64  `json:"timestamp"`
+	// The resource the event is about, such as a Host.
+	Data json.RawMessage `json:"data"`
+}
+
+// Decode decodes the resource the event is about into v.
+func (e BusEvent) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// EventBus publishes events to and receives events from a message bus.
+type EventBus interface {
+	// Publish publishes an event of the given type about
+	// the resource on the topic.
+	Publish(topic string, eventType string, resource interface{}) error
+	// Subscribe calls handler with every event published on
+	// the topic from now on, until the bus is closed. handler
+	// must not block.
+	Subscribe(topic string, handler func(BusEvent)) error
+	// Close closes the connection to the bus.
+	Close() error
+}
+
+// PublishEvent publishes an event on the bus, if there is one,
+// logging rather than returning failures, as events are only
+// notifications of changes already made.
+func PublishEvent(bus EventBus, topic string, eventType string, resource interface{}) {
+	if bus == nil {
+		return
+	}
+	if err := bus.Publish(topic, eventType, resource); err != nil {
+		log.Printf("Cannot publish %s event on %s: %s", eventType, topic, err)
+	}
+}
+
+// NewEventBus connects the named service to the bus configured in the
+// "bus" section of its service-specific configuration, returning nil
+// if there is none. A bus that cannot be reached yet is connected to
+// in the background.
+func NewEventBus(service string, serviceSpecific map[string]interface{}) (EventBus, error) {
+	busConfig, ok := serviceSpecific["bus"].(map[string]interface{})
+	if !ok {
+		if _, ok := serviceSpecific["bus"]; ok {
+			return nil, NewError("Invalid bus configuration %v", serviceSpecific["bus"])
+		}
+		return nil, nil
+	}
+	if err := validateBusConfig(busConfig); err != nil {
+		return nil, err
+	}
+	busURL := busConfig["url"].(string)
+	prefix, _ := busConfig["topic_prefix"].(string)
+	if prefix == "" {
+		prefix = defaultBusTopicPrefix
+	}
+	if busConfig["type"] == "nats" {
+		return newNatsBus(service, busURL, prefix)
+	}
+	group, _ := busConfig["group"].(string)
+	if group == "" {
+		hostname, _ := os.Hostname()
+		group = fmt.Sprintf("%s-%s-%s", prefix, service, hostname)
+	}
+	return newKafkaBus(service, busURL, prefix, group), nil
+}
+
+// validateBusConfig checks the "bus" section of a service configuration.
+func validateBusConfig(busConfig map[string]interface{}) error {
+	switch busConfig["type"] {
+	case "nats", "kafka":
+	default:
+		return NewError("Unsupported bus type %v", busConfig["type"])
+	}
+	busURL, _ := busConfig["url"].(string)
+	if busURL == "" {
+		return errors.New("Bus url is required")
+	}
+	if _, err := url.Parse(busURL); err != nil {
+		return NewError("Invalid bus url %s: %s", busURL, err)
+	}
+	return nil
+}
+
+// newBusEvent returns the encoded event.
+func newBusEvent(source string, eventType string, resource interface{}) ([]byte, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(BusEvent{Type: eventType, Source: source, Timestamp: time.Now().Unix(), Data: data})
+}
+
+// natsBus is an EventBus on a NATS server.
+type natsBus struct {
+	source string
+	addr   string
+	user   *url.Userinfo
+	prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// Handlers by subscription ID.
+	subs    map[int]func(BusEvent)
+	subject map[int]string
+	nextSid int
+	closed  bool
+}
+
+func newNatsBus(source string, busURL string, prefix string) (*natsBus, error) {
+	u, err := url.Parse(busURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, NewError("Invalid NATS url %s, expected nats://host:port", busURL)
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(u.Host, "4222")
+	}
+	bus := &natsBus{source: source, addr: addr, user: u.User, prefix: prefix, subs: make(map[int]func(BusEvent)), subject: make(map[int]string)}
+	conn, reader, err := bus.connect()
+	if err != nil {
+		log.Printf("Cannot connect to NATS at %s, retrying in the background: %s", addr, err)
+	}
+	go bus.run(conn, reader)
+	return bus, nil
+}
+
+func (bus *natsBus) subjectOf(topic string) string {
+	return bus.prefix + "." + topic
+}
+
+// connect connects to the server and subscribes to all subjects
+// subscribed to so far.
+func (bus *natsBus) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", bus.addr, busTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(busTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, NewError("Unexpected greeting from NATS: %s", strings.TrimSpace(line))
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "romana-" + bus.source}
+	if bus.user != nil {
+		options["user"] = bus.user.Username()
+		options["pass"], _ = bus.user.Password()
+	}
+	connect, _ := json.Marshal(options)
+	var cmds bytes.Buffer
+	fmt.Fprintf(&cmds, "CONNECT %s\r\n", connect)
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if bus.closed {
+		conn.Close()
+		return nil, nil, errors.New("Bus is closed")
+	}
+	for sid, subject := range bus.subject {
+		fmt.Fprintf(&cmds, "SUB %s %d\r\n", subject, sid)
+	}
+	cmds.WriteString("PING\r\n")
+	if _, err := conn.Write(cmds.Bytes()); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// The server answers PING once CONNECT succeeded.
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, nil, NewError("NATS refused connection: %s", strings.TrimSpace(line))
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	bus.conn = conn
+	return conn, reader, nil
+}
+
+// run reads messages from the server, connecting
+// again whenever the connection is lost.
+func (bus *natsBus) run(conn net.Conn, reader *bufio.Reader) {
+	for {
+		if conn != nil {
+			err := bus.read(conn, reader)
+			bus.mu.Lock()
+			closed := bus.closed
+			if bus.conn == conn {
+				bus.conn = nil
+			}
+			bus.mu.Unlock()
+			conn.Close()
+			if closed {
+				return
+			}
+			log.Printf("Lost connection to NATS at %s: %s", bus.addr, err)
+		}
+		time.Sleep(busRetryInterval)
+		bus.mu.Lock()
+		closed := bus.closed
+		bus.mu.Unlock()
+		if closed {
+			return
+		}
+		var err error
+		conn, reader, err = bus.connect()
+		if err != nil {
+			log.Printf("Cannot connect to NATS at %s: %s", bus.addr, err)
+		}
+	}
+}
+
+// read dispatches messages until the connection fails.
+func (bus *natsBus) read(conn net.Conn, reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if err := bus.write(conn, []byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case "-ERR":
+			log.Printf("NATS at %s: %s", bus.addr, line)
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			if len(fields) < 4 {
+				return NewError("Malformed message from NATS: %s", line)
+			}
+			sid, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return NewError("Malformed message from NATS: %s", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return NewError("Malformed message from NATS: %s", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			bus.mu.Lock()
+			handler := bus.subs[sid]
+			bus.mu.Unlock()
+			event := BusEvent{}
+			if err := json.Unmarshal(payload[:size], &event); err != nil {
+				log.Printf("Ignoring malformed event on %s: %s", fields[1], err)
+				continue
+			}
+			if handler != nil {
+				handler(event)
+			}
+		}
+	}
+}
+
+func (bus *natsBus) write(conn net.Conn, data []byte) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(busTimeout))
+	_, err := conn.Write(data)
+	return err
+}
+
+// Publish implements EventBus.
+func (bus *natsBus) Publish(topic string, eventType string, resource interface{}) error {
+	payload, err := newBusEvent(bus.source, eventType, resource)
+	if err != nil {
+		return err
+	}
+	bus.mu.Lock()
+	conn := bus.conn
+	bus.mu.Unlock()
+	if conn == nil {
+		return NewError("Not connected to NATS at %s", bus.addr)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "PUB %s %d\r\n", bus.subjectOf(topic), len(payload))
+	msg.Write(payload)
+	msg.WriteString("\r\n")
+	return bus.write(conn, msg.Bytes())
+}
+
+// Subscribe implements EventBus. The subscription is made
+// again whenever the bus is connected again.
+func (bus *natsBus) Subscribe(topic string, handler func(BusEvent)) error {
+	bus.mu.Lock()
+	bus.nextSid++
+	sid := bus.nextSid
+	bus.subs[sid] = handler
+	bus.subject[sid] = bus.subjectOf(topic)
+	conn := bus.conn
+	bus.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return bus.write(conn, []byte(fmt.Sprintf("SUB %s %d\r\n", bus.subjectOf(topic), sid)))
+}
+
+// Close implements EventBus.
+func (bus *natsBus) Close() error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.closed = true
+	if bus.conn != nil {
+		return bus.conn.Close()
+	}
+	return nil
+}
+
+// kafkaBus is an EventBus on Kafka, through the Kafka REST proxy.
+type kafkaBus struct {
+	source string
+	url    string
+	prefix string
+	group  string
+	client *http.Client
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newKafkaBus(source string, busURL string, prefix string, group string) *kafkaBus {
+	return &kafkaBus{
+		source: source,
+		url:    strings.TrimRight(busURL, "/"),
+		prefix: prefix,
+		group:  group,
+		client: &http.Client{Timeout: busTimeout + kafkaFetchTimeout},
+		done:   make(chan struct{}),
+	}
+}
+
+func (bus *kafkaBus) topicOf(topic string) string {
+	return bus.prefix + "." + topic
+}
+
+// request sends a request to the proxy and decodes the response
+// into result, unless it is nil.
+func (bus *kafkaBus) request(method string, url string, contentType string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", contentType)
+	resp, err := bus.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return NewError("Kafka REST proxy returned %s for %s %s: %s", resp.Status, method, url, strings.TrimSpace(string(data)))
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Publish implements EventBus.
+func (bus *kafkaBus) Publish(topic string, eventType string, resource interface{}) error {
+	payload, err := newBusEvent(bus.source, eventType, resource)
+	if err != nil {
+		return err
+	}
+	records := map[string]interface{}{
+		"records": []map[string]interface{}{{"value": json.RawMessage(payload)}},
+	}
+	return bus.request("POST", bus.url+"/topics/"+bus.topicOf(topic), kafkaJSONContentType, records, nil)
+}
+
+// Subscribe implements EventBus. Each subscription is a consumer
+// of its own in the group of the bus.
+func (bus *kafkaBus) Subscribe(topic string, handler func(BusEvent)) error {
+	consumer, err := bus.subscribe(topic)
+	if err != nil {
+		return err
+	}
+	go bus.consume(topic, consumer, handler)
+	return nil
+}
+
+// subscribe creates a consumer subscribed to the topic,
+// returning its URL.
+func (bus *kafkaBus) subscribe(topic string) (string, error) {
+	instance := struct {
+		InstanceID string `json:"instance_id"`
+		BaseURI    string `json:"base_uri"`
+	}{}
+	request := map[string]string{"format": "json", "auto.offset.reset": "latest"}
+	err := bus.request("POST", bus.url+"/consumers/"+bus.group, kafkaContentType, request, &instance)
+	if err != nil {
+		return "", err
+	}
+	subscription := map[string][]string{"topics": {bus.topicOf(topic)}}
+	err = bus.request("POST", instance.BaseURI+"/subscription", kafkaContentType, subscription, nil)
+	if err != nil {
+		bus.request("DELETE", instance.BaseURI, kafkaContentType, nil, nil)
+		return "", err
+	}
+	return instance.BaseURI, nil
+}
+
+// consume fetches records for the consumer until the bus is closed,
+// creating the consumer again if the proxy lost it.
+func (bus *kafkaBus) consume(topic string, consumer string, handler func(BusEvent)) {
+	for {
+		records := []struct {
+			Value BusEvent `json:"value"`
+		}{}
+		fetchURL := fmt.Sprintf("%s/records?timeout=%d", consumer, kafkaFetchTimeout/time.Millisecond)
+		err := bus.request("GET", fetchURL, kafkaJSONContentType, nil, &records)
+		if err == nil {
+			for _, record := range records {
+				handler(record.Value)
+			}
+		}
+		select {
+		case <-bus.done:
+			bus.request("DELETE", consumer, kafkaContentType, nil, nil)
+			return
+		default:
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("Cannot fetch events on %s from Kafka REST proxy: %s", topic, err)
+		for {
+			select {
+			case <-bus.done:
+				return
+			case <-time.After(busRetryInterval):
+			}
+			bus.request("DELETE", consumer, kafkaContentType, nil, nil)
+			consumer, err = bus.subscribe(topic)
+			if err == nil {
+				break
+			}
+			log.Printf("Cannot subscribe to %s through Kafka REST proxy: %s", topic, err)
+		}
+	}
+}
+
+// Close implements EventBus.
+func (bus *kafkaBus) Close() error {
+	bus.once.Do(func() { close(bus.done) })
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNats is a NATS server delivering messages published
+// by its clients to their subscriptions.
+type fakeNats struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	subjects []string
+}
+
+func newFakeNats(t *testing.T) *fakeNats {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeNats{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeNats) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\"}\r\n")
+	reader := bufio.NewReader(conn)
+	sids := make(map[string][]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "SUB":
+			sids[fields[1]] = append(sids[fields[1]], fields[2])
+			srv.mu.Lock()
+			srv.subjects = append(srv.subjects, fields[1])
+			srv.mu.Unlock()
+		case "PUB":
+			var size int
+			fmt.Sscan(fields[2], &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			for _, sid := range sids[fields[1]] {
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s", fields[1], sid, size, payload)
+			}
+		}
+	}
+}
+
+// disconnect closes connections of all clients.
+func (srv *fakeNats) disconnect() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+// expectBusEvent waits for an event about a host.
+func expectBusEvent(t *testing.T, events <-chan BusEvent, eventType string, hostName string) {
+	select {
+	case event := <-events:
+		host := Host{}
+		if err := event.Decode(&host); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != eventType || event.Source != "topology" || event.Timestamp == 0 || host.Name != hostName {
+			t.Errorf("Expected %s event for %s from topology, got %+v (%s)", eventType, hostName, event, host.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected %s event for %s", eventType, hostName)
+	}
+}
+
+// TestNatsBus tests publishing and subscribing to events on NATS.
+func TestNatsBus(t *testing.T) {
+	srv := newFakeNats(t)
+	defer srv.listener.Close()
+	busConfig := map[string]interface{}{"type": "nats", "url": "nats://" + srv.listener.Addr().String()}
+	bus, err := NewEventBus("topology", map[string]interface{}{"bus": busConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	events := make(chan BusEvent, 10)
+	if err := bus.Subscribe(BusTopicHosts, func(event BusEvent) { events <- event }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(BusTopicHosts, HostAdded, Host{Name: "host1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectBusEvent(t, events, HostAdded, "host1")
+
+	// Subscriptions are made again after reconnecting.
+	srv.disconnect()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		srv.mu.Lock()
+		subjects := srv.subjects
+		srv.mu.Unlock()
+		if len(subjects) == 2 && bus.Publish(BusTopicHosts, HostRemoved, Host{Name: "host1"}) == nil {
+			if subjects[0] != "romana.hosts" || subjects[1] != "romana.hosts" {
+				t.Errorf("Unexpected subscriptions %v", subjects)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected bus to reconnect")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	expectBusEvent(t, events, HostRemoved, "host1")
+}
+
+// TestKafkaBus tests publishing and subscribing
+// to events through the Kafka REST proxy.
+func TestKafkaBus(t *testing.T) {
+	var mu sync.Mutex
+	var records []json.RawMessage
+	offset := -1
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		consumer := "/consumers/romana-topology-test/instances/c1"
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/topics/romana.hosts":
+			if ct := r.Header.Get("Content-Type"); ct != kafkaJSONContentType {
+				t.Errorf("Unexpected content type %s", ct)
+			}
+			body := struct {
+				Records []struct {
+					Value json.RawMessage `json:"value"`
+				} `json:"records"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			for _, record := range body.Records {
+				records = append(records, record.Value)
+			}
+			fmt.Fprintf(w, `{"offsets":[]}`)
+		case r.Method == "POST" && r.URL.Path == "/consumers/romana-topology-test":
+			fmt.Fprintf(w, `{"instance_id":"c1","base_uri":"%s%s"}`, srv.URL, consumer)
+		case r.Method == "POST" && r.URL.Path == consumer+"/subscription":
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"topics":["romana.hosts"]}` {
+				t.Errorf("Unexpected subscription %s", body)
+			}
+			offset = len(records)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "GET" && r.URL.Path == consumer+"/records" && offset >= 0:
+			fetched := make([]map[string]json.RawMessage, 0)
+			for _, record := range records[offset:] {
+				fetched = append(fetched, map[string]json.RawMessage{"value": record})
+			}
+			offset = len(records)
+			json.NewEncoder(w).Encode(fetched)
+		case r.Method == "DELETE" && r.URL.Path == consumer:
+			offset = -1
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	busConfig := map[string]interface{}{"type": "kafka", "url": srv.URL, "group": "romana-topology-test"}
+	bus, err := NewEventBus("topology", map[string]interface{}{"bus": busConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(BusTopicHosts, HostAdded, Host{Name: "host1"}); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan BusEvent, 10)
+	if err := bus.Subscribe(BusTopicHosts, func(event BusEvent) { events <- event }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(BusTopicHosts, HostUpdated, Host{Name: "host2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Only events published after subscribing are received.
+	expectBusEvent(t, events, HostUpdated, "host2")
+	bus.Close()
+
+	for _, invalid := range []map[string]interface{}{
+		{"type": "amqp", "url": "amqp://localhost"},
+		{"type": "kafka"},
+		{"type": "nats", "url": "http://localhost:4222"},
+	} {
+		if _, err := NewEventBus("topology", map[string]interface{}{"bus": invalid}); err == nil {
+			t.Errorf("Expected error for %v", invalid)
+		}
+	}
+	if bus, err := NewEventBus("topology", map[string]interface{}{}); bus != nil || err != nil {
+		t.Errorf("Expected no bus, got %v, %v", bus, err)
+	}
+}
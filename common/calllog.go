@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Correlation of calls between services. Each REST request served
+// carries a request ID, taken from the X-Request-Id header or made up
+// if the caller did not send one, which is kept in the context of the
+// request (see RestContext.Context). RestClient passes it on to the
+// services it calls with that context (see RestClient.WithContext),
+// and logs each call it makes, as in
+//
+//   RestClient: call service=ipam method=POST route=/endpoints status=200 latency=12ms request_id=...
+//
+// so that grepping the logs of all services for a request ID traces
+// the request through them. How much is logged is set by the call_log
+// field of the api section of the configuration: CallLogAll (the
+// default), CallLogErrors or CallLogNone.
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// RequestIDHeader is the header carrying the request ID
+	// in requests and responses.
+	RequestIDHeader = "X-Request-Id"
+
+	// Values of Api.CallLog.
+	CallLogAll    = "all"
+	CallLogErrors = "errors"
+	CallLogNone   = "none"
+)
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID ctx carries,
+// or an empty string if it carries none.
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// requestID returns the request ID sent with the request,
+// or a new one if there is none, and the context of the
+// request carrying it.
+func requestID(request *http.Request) (string, context.Context) {
+	id := request.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = uuid.New()
+	}
+	return id, WithRequestID(request.Context(), id)
+}
+
+// validCallLog returns true if level is a valid value of Api.CallLog.
+func validCallLog(level string) bool {
+	switch level {
+	case "", CallLogAll, CallLogErrors, CallLogNone:
+		return true
+	}
+	return false
+}
+
+// serviceNames maps addresses (host:port) of services a RestClient
+// has looked up (see GetServiceUrl) to their names, for logging calls.
+// Copies of a client (see WithContext) share it.
+type serviceNames struct {
+	sync.Mutex
+	names map[string]string
+}
+
+// add adds the service at the URL, if it can be parsed.
+func (s *serviceNames) add(serviceURL string, name string) {
+	u, err := url.Parse(serviceURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.names == nil {
+		s.names = make(map[string]string)
+	}
+	s.names[u.Host] = name
+}
+
+// find returns the name of the service at u, or its address
+// if it is not a known service.
+func (s *serviceNames) find(u *url.URL) string {
+	s.Lock()
+	defer s.Unlock()
+	if name, ok := s.names[u.Host]; ok {
+		return name
+	}
+	return u.Host
+}
+
+// logCall logs a call made by the client, if the call log
+// level of the client is such that it should be.
+func (rc *RestClient) logCall(method string, requestID string, start time.Time, err error) {
+	level := rc.config.CallLog
+	if level == CallLogNone || (level == CallLogErrors && err == nil) || rc.url == nil {
+		return
+	}
+	service := rc.services.find(rc.url)
+	latency := time.Since(start)
+	if err != nil {
+		log.Printf("RestClient: call service=%s method=%s route=%s status=%d latency=%v request_id=%s error=%q", service, method, rc.url.Path, rc.lastStatusCode, latency, requestID, err)
+		return
+	}
+	log.Printf("RestClient: call service=%s method=%s route=%s status=%d latency=%v request_id=%s", service, method, rc.url.Path, rc.lastStatusCode, latency, requestID)
+}
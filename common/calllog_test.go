@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCallLog tests propagation of request IDs
+// and logging of calls by RestClient.
+func TestCallLog(t *testing.T) {
+	router := newRouter(Routes{
+		Route{
+			Method:  "GET",
+			Pattern: "/id",
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				return map[string]string{"request_id": ctx.RequestID, "context": RequestIDFromContext(ctx.Context)}, nil
+			},
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// As negotiated by the Negotiator middleware.
+		w.Header().Set("Content-Type", "application/json")
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// The service responds with the request ID it was sent.
+	req, _ := http.NewRequest("GET", server.URL+"/id", nil)
+	req.Header.Set(RequestIDHeader, "req-0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect(t, resp.Header.Get(RequestIDHeader), "req-0")
+
+	client, err := NewRestClient(GetDefaultRestClientConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	result := make(map[string]string)
+	err = client.WithContext(WithRequestID(context.Background(), "req-1")).Get("/id", &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, result["request_id"], "req-1")
+	expect(t, result["context"], "req-1")
+	logged := out.String()
+	if !strings.Contains(logged, "service=root method=GET route=/id status=200") || !strings.Contains(logged, "request_id=req-1") {
+		t.Errorf("Expected call to be logged, got %s", logged)
+	}
+
+	// A call not made on behalf of a request starts a new one.
+	err = client.Get("/id", &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["request_id"] == "" || result["request_id"] == "req-1" {
+		t.Errorf("Expected a new request ID, got %s", result["request_id"])
+	}
+
+	// Only failed calls are logged at CallLogErrors.
+	config := GetDefaultRestClientConfig(server.URL)
+	config.CallLog = CallLogErrors
+	client, err = NewRestClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	client.Get("/id", &result)
+	if strings.Contains(out.String(), "RestClient: call") {
+		t.Errorf("Expected successful call not to be logged, got %s", out.String())
+	}
+	client.Get("/nothere", &result)
+	if !strings.Contains(out.String(), "route=/nothere status=404") {
+		t.Errorf("Expected failed call to be logged, got %s", out.String())
+	}
+
+	if validCallLog("verbose") {
+		t.Error("Expected verbose to be an invalid call_log")
+	}
+	parsed, err := ParseConfig([]byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n      call_log: errors\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, parsed.Services["root"].Common.Api.CallLog, CallLogErrors)
+}
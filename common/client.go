@@ -19,10 +19,12 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/pborman/uuid"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -38,18 +40,41 @@ import (
 type RestClient struct {
 	url            *url.URL
 	client         *http.Client
-	token          string
 	config         *RestClientConfig
 	lastStatusCode int
+	// If set, requests are bound to this context (see WithContext).
+	ctx context.Context
+	// All known root service URLs, if more than one
+	// is available (see RestClientConfig.RootURL).
+	rootURLs []string
+	// Names of services the client knows the URLs of.
+	services *serviceNames
+	// Token requests are authenticated with, if the client
+	// has a credential (see tokens.go).
+	tokens *tokenSource
 }
 
 // RestClientConfig holds configuration for restful client.
 type RestClientConfig struct {
 	TimeoutMillis int64
 	Retries       int
-	Credential    *Credential
-	TestMode      bool
-	RootURL       string
+	// Credential, if set, is used to get tokens from root that
+	// requests carry. Tokens are refreshed before they expire,
+	// and when a request with one is refused.
+	Credential *Credential
+	TestMode   bool
+	// RootURL is the URL of the root service. Several root service
+	// instances can be given as a comma-separated list, in which case
+	// the client fails over to the next one when the current one
+	// is unreachable.
+	RootURL string
+	// Transport, if set, carries requests of the client instead of
+	// http.DefaultTransport; tests use it to stub other services
+	// (see package commontest).
+	Transport http.RoundTripper
+	// CallLog is which calls the client logs: CallLogAll
+	// (the default), CallLogErrors or CallLogNone.
+	CallLog string
 }
 
 // GetDefaultRestClientConfig gets a RestClientConfig with specified rootURL
@@ -62,7 +87,7 @@ func GetDefaultRestClientConfig(rootURL string) RestClientConfig {
 // the information provided in the service configuration is used for the client
 // configuration.
 func GetRestClientConfig(config ServiceConfig) RestClientConfig {
-	return RestClientConfig{TimeoutMillis: config.Common.Api.RestTimeoutMillis, Retries: config.Common.Api.RestRetries, RootURL: config.Common.Api.RootServiceUrl}
+	return RestClientConfig{TimeoutMillis: config.Common.Api.RestTimeoutMillis, Retries: config.Common.Api.RestRetries, RootURL: config.Common.Api.RootServiceUrl, CallLog: config.Common.Api.CallLog}
 }
 
 // NewRestClient creates a new Romana REST client. It provides convenience
@@ -72,7 +97,7 @@ func GetRestClientConfig(config ServiceConfig) RestClientConfig {
 // If the root URL does not point to the Romana service, the generic REST operations
 // still work, but Romana-specific functionality does not.
 func NewRestClient(config RestClientConfig) (*RestClient, error) {
-	rc := &RestClient{client: &http.Client{}, config: &config}
+	rc := &RestClient{client: &http.Client{Transport: config.Transport}, config: &config, services: &serviceNames{}, tokens: newTokenSource()}
 	timeoutMillis := config.TimeoutMillis
 
 	if timeoutMillis <= 0 {
@@ -97,13 +122,19 @@ func NewRestClient(config RestClientConfig) (*RestClient, error) {
 		// trying to resolve things.
 		myUrl = "http://localhost"
 	} else {
-		u, err := url.Parse(config.RootURL)
-		if err != nil {
-			return nil, err
-		}
-		if !u.IsAbs() {
-			return nil, NewError("Expected absolute URL for root, received %s", config.RootURL)
+		for _, rootURL := range strings.Split(config.RootURL, ",") {
+			rootURL = strings.TrimSpace(rootURL)
+			u, err := url.Parse(rootURL)
+			if err != nil {
+				return nil, err
+			}
+			if !u.IsAbs() {
+				return nil, NewError("Expected absolute URL for root, received %s", rootURL)
+			}
+			rc.rootURLs = append(rc.rootURLs, rootURL)
+			rc.services.add(rootURL, ServiceRoot)
 		}
+		config.RootURL = rc.rootURLs[0]
 		myUrl = config.RootURL
 	}
 	err := rc.NewUrl(myUrl)
@@ -120,6 +151,67 @@ func (rc *RestClient) NewUrl(dest string) error {
 	return rc.modifyUrl(dest, nil)
 }
 
+// WithContext returns a copy of the client whose requests are bound
+// to ctx: an in-flight request is abandoned, and no further retries
+// are attempted, once ctx is done. This is typically used by handlers
+// to pass on the deadline of the REST request being served
+// (see RestContext.Context).
+func (rc *RestClient) WithContext(ctx context.Context) *RestClient {
+	rc2 := *rc
+	rc2.ctx = ctx
+	return &rc2
+}
+
+// addRootURLs adds root service URLs that the client
+// does not yet know about to the list of those to fail over to.
+func (rc *RestClient) addRootURLs(rootURLs []string) {
+	for _, rootURL := range rootURLs {
+		known := false
+		for _, knownURL := range rc.rootURLs {
+			if strings.TrimRight(knownURL, "/") == strings.TrimRight(rootURL, "/") {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Printf("RestClient: learned of root service at %s", rootURL)
+			rc.rootURLs = append(rc.rootURLs, rootURL)
+			rc.services.add(rootURL, ServiceRoot)
+		}
+	}
+}
+
+// failoverRoot switches the client to the next known root service
+// URL, provided the current request is to the root service. It returns
+// false if there is nowhere to fail over to.
+func (rc *RestClient) failoverRoot() bool {
+	if len(rc.rootURLs) < 2 || rc.url == nil {
+		return false
+	}
+	current, err := url.Parse(rc.config.RootURL)
+	if err != nil || current.Host != rc.url.Host {
+		return false
+	}
+	next := rc.rootURLs[0]
+	for i, rootURL := range rc.rootURLs {
+		if rootURL == rc.config.RootURL {
+			next = rc.rootURLs[(i+1)%len(rc.rootURLs)]
+			break
+		}
+	}
+	nextUrl, err := url.Parse(next)
+	if err != nil {
+		return false
+	}
+	log.Printf("RestClient: failing over from root service at %s to %s", rc.config.RootURL, next)
+	rc.config.RootURL = next
+	newUrl := *rc.url
+	newUrl.Scheme = nextUrl.Scheme
+	newUrl.Host = nextUrl.Host
+	rc.url = &newUrl
+	return true
+}
+
 // GetStatusCode returns status code of last executed request.
 // As stated above, it is not recommended to share RestClient between
 // goroutines. 0 is returned if no previous requests have been yet
@@ -255,6 +347,7 @@ func (rc *RestClient) GetServiceUrl(name string) (string, error) {
 	if err != nil {
 		return ErrorNoValue, err
 	}
+	rc.addRootURLs(resp.Links.FindAllByRel(RootLinkRel))
 	for i := range resp.Services {
 		service := resp.Services[i]
 		//		log.Println("Checking", service.Name, "against", name, "links:", service.Links)
@@ -268,6 +361,7 @@ func (rc *RestClient) GetServiceUrl(name string) (string, error) {
 				if err != nil {
 					return ErrorNoValue, err
 				}
+				rc.services.add(rc.url.String(), name)
 				return rc.url.String(), nil
 			}
 			return ErrorNoValue, errors.New(fmt.Sprintf("Cannot find service %s at %s", name, resp))
@@ -336,8 +430,21 @@ func (rc *RestClient) modifyUrl(dest string, queryMod url.Values) error {
 //    to generate a uuid and add it to the query as RequestToken=<UUID>. It will then be up to the service
 //    to ensure idempotence or not.
 func (rc *RestClient) execMethod(method string, dest string, data interface{}, result interface{}) error {
-	// TODO check if token expired, if yes, reauthenticate... But this needs
-	// more state here (knowledge of Root service by Rest client...)
+	// The request being served, if any, is passed on,
+	// otherwise this call starts a new one.
+	requestID := RequestIDFromContext(rc.ctx)
+	if requestID == "" {
+		requestID = uuid.New()
+	}
+	start := time.Now()
+	err := rc.exec(method, dest, data, result, requestID)
+	rc.logCall(method, requestID, start, err)
+	return err
+}
+
+// exec does the work of execMethod, sending
+// the request ID with the request.
+func (rc *RestClient) exec(method string, dest string, data interface{}, result interface{}, requestID string) error {
 	rc.lastStatusCode = 0
 	var queryMod url.Values
 	queryMod = nil
@@ -400,16 +507,41 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 		if err != nil {
 			return err
 		}
+		if rc.ctx != nil {
+			req = req.WithContext(rc.ctx)
+		}
 		req.Header.Set("accept", "application/json")
-		if rc.token != "" {
-			req.Header.Set("authorization", rc.token)
+		req.Header.Set(RequestIDHeader, requestID)
+		if token := rc.url.Query().Get(RequestTokenQueryParameter); token != "" {
+			// Retries below reuse the same request, so the service
+			// can recognize them by this key.
+			req.Header.Set(IdempotencyKeyHeader, token)
+		}
+		var token string
+		if rc.authenticates() {
+			token, err = rc.tokens.get(rc.fetchToken)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("authorization", token)
 		}
 		for i := 0; i < rc.config.Retries; i++ {
 			log.Printf("Try %d for %s", (i + 1), rc.url)
 			if i > 0 {
 				sleepTime, _ := time.ParseDuration(fmt.Sprintf("%ds", int(math.Pow(2, (float64(i-1))))))
 				log.Printf("Sleeping for %v before retrying %d time\n", sleepTime, i)
-				time.Sleep(sleepTime)
+				if rc.ctx == nil {
+					time.Sleep(sleepTime)
+				} else {
+					select {
+					case <-time.After(sleepTime):
+					case <-rc.ctx.Done():
+						return rc.ctx.Err()
+					}
+				}
+			}
+			if reqBodyReader != nil {
+				reqBodyReader.Seek(0, io.SeekStart)
 			}
 			resp, err = rc.client.Do(req)
 			if err != nil {
@@ -417,18 +549,42 @@ func (rc *RestClient) execMethod(method string, dest string, data interface{}, r
 					return err
 				}
 				log.Println(err)
-				continue
-			} else {
-				// If service unavailable we may still retry...
-				if resp.StatusCode != http.StatusServiceUnavailable {
-					break
+			} else if resp.StatusCode != http.StatusServiceUnavailable {
+				break
+			}
+			// If service unavailable we may still retry, possibly
+			// with another root service instance.
+			if i < rc.config.Retries-1 && rc.failoverRoot() {
+				if resp != nil {
+					resp.Body.Close()
 				}
+				req.URL = rc.url
+				req.Host = rc.url.Host
 			}
 		}
 
 		if err != nil {
 			return err
 		}
+		if token != "" && isAuthFailure(resp.StatusCode) {
+			// The token may have expired or root may have been
+			// restarted with another key: try once with a new one.
+			log.Printf("RestClient: %s refused token with %d, authenticating again", rc.url, resp.StatusCode)
+			resp.Body.Close()
+			rc.tokens.invalidate(token)
+			token, err = rc.tokens.get(rc.fetchToken)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("authorization", token)
+			if reqBodyReader != nil {
+				reqBodyReader.Seek(0, io.SeekStart)
+			}
+			resp, err = rc.client.Do(req)
+			if err != nil {
+				return err
+			}
+		}
 		defer resp.Body.Close()
 		body, err = ioutil.ReadAll(resp.Body)
 
@@ -547,21 +703,18 @@ func (rc *RestClient) GetServiceConfig(name string) (*ServiceConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	rc.addRootURLs(rootIndexResponse.Links.FindAllByRel(RootLinkRel))
 
-	if rc.config.Credential != nil && rc.config.Credential.Type != CredentialNone {
+	if rc.authenticates() {
 		// First things first - authenticate
-		authUrl := rootIndexResponse.Links.FindByRel("auth")
-		log.Printf("Authenticating to %s", authUrl)
-		tokenMsg := &TokenMessage{}
-		err = rc.Post(authUrl, rc.config.Credential, tokenMsg)
+		_, err = rc.tokens.get(rc.fetchToken)
 		if err != nil {
 			return nil, err
 		}
-		rc.token = tokenMsg.Token
 	}
 
 	config := &ServiceConfig{}
-	config.Common.Api = &Api{RootServiceUrl: rc.config.RootURL}
+	config.Common.Api = &Api{RootServiceUrl: strings.Join(rc.rootURLs, ",")}
 	relName := name + "-config"
 	configUrl := rootIndexResponse.Links.FindByRel(relName)
 	if configUrl == "" {
@@ -579,3 +732,126 @@ func (rc *RestClient) GetServiceConfig(name string) (*ServiceConfig, error) {
 	log.Printf("Saved from %v to %v", rc.config.Credential, config.Common.Credential)
 	return config, nil
 }
+
+// RegisterService registers the service described by reg
+// with the root service, so that it is advertised to clients
+// at its actual URL. Registering again under the same name
+// replaces the previous registration.
+func (rc *RestClient) RegisterService(reg ServiceRegistration) error {
+	if rc.config.RootURL == "" {
+		return errors.New("RootURL not set")
+	}
+	url := strings.TrimRight(rc.config.RootURL, "/") + ServicesPath
+	result := &ServiceRegistration{}
+	return rc.Post(url, reg, result)
+}
+
+// DeregisterService removes the registration of the named service
+// from the root service.
+func (rc *RestClient) DeregisterService(name string) error {
+	if rc.config.RootURL == "" {
+		return errors.New("RootURL not set")
+	}
+	url := fmt.Sprintf("%s%s/%s", strings.TrimRight(rc.config.RootURL, "/"), ServicesPath, name)
+	return rc.Delete(url, nil, nil)
+}
+
+// leaseUrl returns the URL of the named lease on root.
+func (rc *RestClient) leaseUrl(name string) (string, error) {
+	if rc.config.RootURL == "" {
+		return "", errors.New("RootURL not set")
+	}
+	return fmt.Sprintf("%s%s/%s", strings.TrimRight(rc.config.RootURL, "/"), LeasesPath, name), nil
+}
+
+// AcquireLease acquires the lease for lease.Holder, or renews it if
+// already held by it, with Data replacing that of the lease unless
+// nil. It fails with 409 Conflict if the lease is held by another.
+func (rc *RestClient) AcquireLease(lease Lease) (*Lease, error) {
+	url, err := rc.leaseUrl(lease.Name)
+	if err != nil {
+		return nil, err
+	}
+	result := &Lease{}
+	err = rc.Post(url, lease, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReleaseLease releases the lease held by lease.Holder,
+// with Data replacing that of the lease unless nil.
+func (rc *RestClient) ReleaseLease(lease Lease) error {
+	url, err := rc.leaseUrl(lease.Name)
+	if err != nil {
+		return err
+	}
+	return rc.Delete(url, lease, &Lease{})
+}
+
+// GetLease returns the named lease, with an empty
+// Holder if nobody holds it.
+func (rc *RestClient) GetLease(name string) (*Lease, error) {
+	url, err := rc.leaseUrl(name)
+	if err != nil {
+		return nil, err
+	}
+	result := &Lease{}
+	err = rc.Get(url, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetClusterStatus returns health of all services registered with root.
+func (rc *RestClient) GetClusterStatus() (*ClusterStatus, error) {
+	if rc.config.RootURL == "" {
+		return nil, errors.New("RootURL not set")
+	}
+	status := &ClusterStatus{}
+	err := rc.Get(strings.TrimRight(rc.config.RootURL, "/")+StatusPath, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WatchConfig blocks until the version of the configuration served
+// by root becomes greater than since, and returns the new version.
+// Root may return earlier with the current version (to keep within
+// request timeouts), so callers should compare the result with since
+// and call WatchConfig again if it has not changed.
+func (rc *RestClient) WatchConfig(since uint64) (uint64, error) {
+	if rc.config.RootURL == "" {
+		return 0, errors.New("RootURL not set")
+	}
+	url := fmt.Sprintf("%s%s?watch=true&since=%d", strings.TrimRight(rc.config.RootURL, "/"), ConfigPath, since)
+	resp := &ConfigVersionResponse{}
+	err := rc.Get(url, resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Version, nil
+}
+
+// WatchServiceConfig is like GetServiceConfig, but blocks until the
+// configuration of the service changes after version since (see
+// ServiceConfig.Version). As with WatchConfig, root may return
+// before that (to keep within request timeouts) with the unchanged
+// configuration, in which case WatchServiceConfig should be called
+// again with the version returned.
+func (rc *RestClient) WatchServiceConfig(name string, since uint64) (*ServiceConfig, error) {
+	if rc.config.RootURL == "" {
+		return nil, errors.New("RootURL not set")
+	}
+	url := fmt.Sprintf("%s%s/%s?watch=true&since=%d", strings.TrimRight(rc.config.RootURL, "/"), ConfigPath, name, since)
+	config := &ServiceConfig{}
+	err := rc.Get(url, config)
+	if err != nil {
+		return nil, err
+	}
+	config.Common.Credential = rc.config.Credential
+	return config, nil
+}
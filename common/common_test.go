@@ -17,6 +17,7 @@ package common
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -182,6 +183,98 @@ func TestPolicyValidation(t *testing.T) {
 	log.Printf("Bad tenant: %v", err2)
 	det = (err2.Details).([]string)
 	expect(t, det[0], "applied_to entry #2: at least one of: tenant, tenant_id, tenant_external_id or tenant_network_id must be specified.")
+
+	goodRules := Rules{Rule{Ports: []uint{80}, Protocol: "tcp"}}
+	policy = Policy{Name: "p", Rules: goodRules, Direction: PolicyDirectionEgress, AppliedTo: badAppliedTo[:1], Action: "Reject", Priority: -1}
+	err = policy.Validate()
+	if err == nil {
+		t.Error("Unexpected nil")
+	}
+	det = (err.(HttpError).Details).([]string)
+	expect(t, det[0], "Unknown action 'reject', allowed 'allow' or 'deny'.")
+	expect(t, det[1], "Invalid priority -1, must not be negative.")
+	policy = Policy{Name: "p", Rules: goodRules, Direction: PolicyDirectionEgress, AppliedTo: badAppliedTo[:1], Action: " Deny", Priority: 10}
+	err = policy.Validate()
+	if err != nil {
+		t.Errorf("Unexpected %s", err)
+	}
+	expect(t, policy.Action, PolicyActionDeny)
+
+	// 6. Test CIDR peers.
+	peers := []Endpoint{
+		Endpoint{Cidr: "172.16.0.0/12", Except: []string{"172.16.5.0/24"}},
+		Endpoint{Cidr: "10.0.0.0/33"},
+		Endpoint{Cidr: "192.168.0.0/16", Except: []string{"10.1.0.0/16", "192.168.0.0/16"}},
+		Endpoint{Except: []string{"10.1.0.0/16"}},
+		Endpoint{Cidr: "10.0.0.0/8", TenantID: 2},
+	}
+	policy = Policy{Name: "p", Rules: goodRules, Direction: PolicyDirectionIngress, AppliedTo: badAppliedTo[:1], Peers: peers}
+	err = policy.Validate()
+	if err == nil {
+		t.Error("Unexpected nil")
+	}
+	det = (err.(HttpError).Details).([]string)
+	if len(det) != 5 {
+		t.Fatalf("Expected 5 errors, got %v", det)
+	}
+	expect(t, det[0], "peers entry #2: Invalid CIDR 10.0.0.0/33.")
+	expect(t, det[1], "peers entry #3: Excepted 10.1.0.0/16 is not within 192.168.0.0/16.")
+	expect(t, det[2], "peers entry #3: Excepted 192.168.0.0/16 is not within 192.168.0.0/16.")
+	expect(t, det[3], "peers entry #4: 'except' requires 'cidr'.")
+	expect(t, det[4], "peers entry #5: 'cidr' cannot be combined with peer or tenant.")
+
+	// 7. Test ICMP type names.
+	rules = Rules{
+		Rule{Protocol: "icmp", IcmpTypeName: "ping"},
+		Rule{Protocol: "tcp", IcmpTypeName: "echo-reply"},
+		Rule{Protocol: "icmp", IcmpTypeName: "echo-reply", IcmpCode: 1},
+	}
+	policy = Policy{Name: "p", Rules: rules, Direction: PolicyDirectionIngress, AppliedTo: badAppliedTo[:1]}
+	err = policy.Validate()
+	if err == nil {
+		t.Error("Unexpected nil")
+	}
+	det = (err.(HttpError).Details).([]string)
+	if len(det) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", det)
+	}
+	expect(t, det[0], "Rule #1: Invalid ICMP type name: ping.")
+	expect(t, det[1], "Rule #2: ICMP protocol is not specified but ICMP Code and/or ICMP Type are also specified.")
+	expect(t, det[2], "Rule #3: ICMP type name cannot be combined with ICMP Code or ICMP Type.")
+	policy.Rules = Rules{Rule{Protocol: "icmp", IcmpTypeName: " Echo-Reply"}, Rule{Protocol: "icmp", IcmpTypeName: "tos-host-redirect"}}
+	if err = policy.Validate(); err != nil {
+		t.Errorf("Unexpected %s", err)
+	}
+	expect(t, policy.Rules[0].IcmpTypeName, "echo-reply")
+	expect(t, policy.Rules[1].IcmpTypeName, "TOS-host-redirect")
+
+	// 8. Test port lists and ranges.
+	rule := Rule{}
+	if err = json.Unmarshal([]byte(`{"protocol": "tcp", "port_ranges": ["30000-32767", [80, 90]], "port_lists": ["web"]}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.PortRanges) != 2 || rule.PortRanges[0] != (PortRange{30000, 32767}) || rule.PortRanges[1] != (PortRange{80, 90}) {
+		t.Errorf("Unexpected port ranges %v", rule.PortRanges)
+	}
+	if err = json.Unmarshal([]byte(`{"port_ranges": ["30000:32767"]}`), &Rule{}); err == nil {
+		t.Error("Unexpected nil")
+	}
+	policy.Rules = Rules{rule, Rule{Protocol: "icmp", PortLists: []string{"web"}}}
+	err = policy.Validate()
+	if err == nil {
+		t.Fatal("Unexpected nil")
+	}
+	det = (err.(HttpError).Details).([]string)
+	expect(t, det[0], "Rule #2: ICMP protocol is specified but ports are also specified.")
+	err = PortList{Name: "web", PortRanges: []PortRange{{90, 80}}}.Validate()
+	if err == nil {
+		t.Fatal("Unexpected nil")
+	}
+	det = (err.(HttpError).Details).([]string)
+	expect(t, det[0], "Port list: The following port ranges are invalid: 90-80.")
+	if err = (PortList{Name: "web", Ports: []uint{80}}).Validate(); err != nil {
+		t.Errorf("Unexpected %s", err)
+	}
 }
 
 // TestClientNoHost just tests that we don't hang forever
@@ -259,25 +352,23 @@ func (s timeoutService) Initialize() error {
 func (s timeoutService) Routes() Routes {
 	routes := Routes{
 		Route{
-			"GET",
-			"/normal",
-			func(input interface{}, ctx RestContext) (interface{}, error) {
+			Method:  "GET",
+			Pattern: "/normal",
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
 				inp := input.(UnwrappedRestHandlerInput)
 				writer := inp.ResponseWriter
 				c, err := writer.Write([]byte("hello world"))
 				log.Printf("/normal: Wrote output count %d, error %v, now is %v\n", c, err, time.Now())
 				return nil, nil
 			},
-			func() interface{} {
+			MakeMessage: func() interface{} {
 				return http.Request{}
 			},
-			false,
-			nil,
 		},
 		Route{
-			"GET",
-			"/sleepy",
-			func(input interface{}, ctx RestContext) (interface{}, error) {
+			Method:  "GET",
+			Pattern: "/sleepy",
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
 				inp := input.(UnwrappedRestHandlerInput)
 				writer := inp.ResponseWriter
 				req := inp.Request
@@ -289,11 +380,9 @@ func (s timeoutService) Routes() Routes {
 				log.Printf("/sleepy: Wrote output count %d, error %v, now is %v\n", c, err, time.Now())
 				return nil, nil
 			},
-			func() interface{} {
+			MakeMessage: func() interface{} {
 				return http.Request{}
 			},
-			false,
-			nil,
 		},
 	}
 	return routes
@@ -0,0 +1,35 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commontest
+
+import (
+	"testing"
+
+	"github.com/romana/core/common"
+)
+
+// Handler returns the handler of the route with the method and
+// pattern among routes of a service, so that tests can call it
+// directly; the test fails if there is no such route.
+func Handler(t testing.TB, routes common.Routes, method string, pattern string) common.RestHandler {
+	for _, r := range routes {
+		if r.Method == method && r.Pattern == pattern {
+			return r.Handler
+		}
+	}
+	t.Fatalf("No route %s %s", method, pattern)
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package commontest provides test doubles for common.RestClient,
+// so that services can be tested without running the services
+// they call.
+package commontest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/romana/core/common"
+)
+
+// RootURL is the URL of the root service for clients of Client.
+const RootURL = "http://root"
+
+// Request is a request recorded by Transport.
+type Request struct {
+	Method string
+	// URL of the request, with the query.
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// Decode unmarshals the JSON body of the request into v.
+func (r Request) Decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+type response struct {
+	status int
+	body   []byte
+}
+
+// Transport is an http.RoundTripper that serves canned responses
+// to requests of RestClients (see common.RestClientConfig.Transport)
+// and records the requests.
+type Transport struct {
+	// Next, if set, carries requests there is no response for,
+	// which otherwise get 404.
+	Next http.RoundTripper
+
+	mu        sync.Mutex
+	responses map[string][]response
+	requests  []Request
+}
+
+// NewTransport returns a Transport with no responses.
+func NewTransport() *Transport {
+	return &Transport{responses: make(map[string][]response)}
+}
+
+// Client returns a RestClient whose requests go to the transport,
+// with RootURL as the root service URL and no retries.
+func (t *Transport) Client() (*common.RestClient, error) {
+	config := common.GetDefaultRestClientConfig(RootURL)
+	config.Retries = 1
+	config.Transport = t
+	return common.NewRestClient(config)
+}
+
+// Respond makes the transport answer requests with the method to
+// the URL with the status and body marshaled to JSON. The URL is
+// either absolute, or a path matching requests to any host; its
+// query is ignored. Responses given several times for the same
+// request are served in turn, the last one repeatedly.
+func (t *Transport) Respond(method string, url string, status int, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := method + " " + normalize(url)
+	t.responses[key] = append(t.responses[key], response{status: status, body: data})
+	return nil
+}
+
+// RespondError makes the transport answer requests with the
+// method to the URL with the error, as services do.
+func (t *Transport) RespondError(method string, url string, err common.HttpError) error {
+	return t.Respond(method, url, err.StatusCode, err)
+}
+
+// RespondServices makes the root service at RootURL list the services,
+// each at http://<name>, so that RestClient.GetServiceUrl finds them.
+func (t *Transport) RespondServices(names ...string) error {
+	index := common.RootIndexResponse{ServiceName: "root"}
+	for _, name := range names {
+		index.Services = append(index.Services, common.ServiceResponse{
+			Name:  name,
+			Links: common.Links{{Href: "http://" + name, Rel: "service"}},
+		})
+	}
+	return t.Respond("GET", RootURL, http.StatusOK, index)
+}
+
+// Requests returns requests recorded so far, oldest first.
+func (t *Transport) Requests() []Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Request{}, t.requests...)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := Request{Method: req.Method, URL: req.URL.String(), Header: req.Header}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		recorded.Body = body
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	t.mu.Lock()
+	t.requests = append(t.requests, recorded)
+	resp, ok := t.next(req.Method + " " + req.URL.Scheme + "://" + req.URL.Host + path)
+	if !ok {
+		resp, ok = t.next(req.Method + " " + path)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		if t.Next != nil {
+			return t.Next.RoundTrip(req)
+		}
+		resp.status = http.StatusNotFound
+		resp.body, _ = json.Marshal(common.NewError404("response", req.Method+" "+req.URL.String()))
+	}
+	return &http.Response{
+		Status:        http.StatusText(resp.status),
+		StatusCode:    resp.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(resp.body)),
+		ContentLength: int64(len(resp.body)),
+		Request:       req,
+	}, nil
+}
+
+// next returns the response to serve for the key, if any.
+func (t *Transport) next(key string) (response, bool) {
+	responses := t.responses[key]
+	if len(responses) == 0 {
+		return response{}, false
+	}
+	if len(responses) > 1 {
+		t.responses[key] = responses[1:]
+	}
+	return responses[0], true
+}
+
+// normalize strips the query from the URL, and gives
+// URLs without a path the root path.
+func normalize(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	if i := strings.Index(url, "://"); i >= 0 && !strings.Contains(url[i+3:], "/") {
+		url += "/"
+	}
+	return url
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commontest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/romana/core/common"
+)
+
+// TestTransport tests canned responses and recording of requests.
+func TestTransport(t *testing.T) {
+	transport := NewTransport()
+	client, err := transport.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.RespondServices("ipam", "topology"); err != nil {
+		t.Fatal(err)
+	}
+	url, err := client.GetServiceUrl("topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://topology" {
+		t.Errorf("Expected http://topology, got %s", url)
+	}
+
+	transport.Respond("POST", "http://topology/hosts", http.StatusOK, common.Host{Ip: "10.0.0.3"})
+	transport.Respond("POST", "http://topology/hosts", http.StatusOK, common.Host{Ip: "10.0.0.4"})
+	for _, expect := range []string{"10.0.0.3", "10.0.0.4", "10.0.0.4"} {
+		host := common.Host{}
+		if err := client.Post("http://topology/hosts", common.Host{Name: "host1"}, &host); err != nil {
+			t.Fatal(err)
+		}
+		if host.Ip != expect {
+			t.Errorf("Expected %s, got %s", expect, host.Ip)
+		}
+	}
+	requests := transport.Requests()
+	if len(requests) != 4 || requests[1].Method != "POST" {
+		t.Fatalf("Unexpected requests %+v", requests)
+	}
+	sent := common.Host{}
+	if err := requests[1].Decode(&sent); err != nil || sent.Name != "host1" {
+		t.Errorf("Expected host1 to be sent, got %+v, %v", sent, err)
+	}
+
+	// Paths match requests to any host.
+	transport.RespondError("DELETE", "/hosts/9", common.NewError404("host", "9"))
+	err = client.Delete("http://topology/hosts/9", nil, nil)
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %v", err)
+	}
+	err = client.Get("http://topology/hosts/2", nil)
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without a response, got %v", err)
+	}
+
+	// Without a response, requests go to Next.
+	next := NewTransport()
+	next.Respond("GET", "/hosts/2", http.StatusOK, common.Host{Name: "host2"})
+	transport.Next = next
+	found := common.Host{}
+	if err := client.Get("http://topology/hosts/2", &found); err != nil || found.Name != "host2" {
+		t.Errorf("Expected host2, got %+v, %v", found, err)
+	}
+	if n := len(next.Requests()); n != 1 {
+		t.Errorf("Expected 1 request to go to Next, got %d", n)
+	}
+}
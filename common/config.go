@@ -23,8 +23,13 @@ import (
 	"github.com/go-yaml/yaml"
 	"io/ioutil"
 	"log"
+	"net"
+	"sort"
+	"strings"
 
 	"path/filepath"
+
+	"github.com/romana/core/common/features"
 )
 
 // Hook defines an executable to run before or after any
@@ -43,6 +48,18 @@ type Hook struct {
 	Output string
 }
 
+// validate checks values of When and Method.
+func (hook Hook) validate() error {
+	if strings.ToLower(hook.When) != "before" && strings.ToLower(hook.When) != "after" {
+		return errors.New(fmt.Sprintf("Invalid value for when: %s", hook.When))
+	}
+	m := strings.ToUpper(hook.Method)
+	if m != "POST" && m != "PUT" && m != "GET" && m != "DELETE" && m != "HEAD" {
+		return errors.New(fmt.Sprintf("Invalid method: %s", m))
+	}
+	return nil
+}
+
 // Api part of service configuration (host/port).
 type Api struct {
 	// Host to listen on.
@@ -58,6 +75,23 @@ type Api struct {
 	AuthPublic   string `yaml:"auth_public"`
 	RestTestMode bool   `yaml:"rest_test_mode,omitempty" json:"rest_test_mode,omitempty"`
 	Hooks        []Hook
+	// Address (host:port) to serve runtime diagnostics on, if any
+	// (see diagnostics.go).
+	Diagnostics string `yaml:"diagnostics,omitempty" json:"diagnostics,omitempty"`
+	// CallLog is which calls to other services are logged
+	// (see calllog.go).
+	CallLog string `yaml:"call_log,omitempty" json:"call_log,omitempty"`
+	// Address (host:port) of a StatsD server to push metrics to,
+	// if any, their names prefixed with StatsdPrefix and labels
+	// sent as tags if DogStatsD is set (see statsd.go).
+	Statsd       string `yaml:"statsd,omitempty" json:"statsd,omitempty"`
+	StatsdPrefix string `yaml:"statsd_prefix,omitempty" json:"statsd_prefix,omitempty"`
+	DogStatsD    bool   `yaml:"dogstatsd,omitempty" json:"dogstatsd,omitempty"`
+	// Largest body of a request accepted, DefaultMaxRequestBytes
+	// if 0, and whether unknown fields of JSON input are refused
+	// (see limits.go).
+	MaxRequestBytes int64 `yaml:"max_request_bytes,omitempty" json:"max_request_bytes,omitempty"`
+	StrictJSON      bool  `yaml:"strict_json,omitempty" json:"strict_json,omitempty"`
 }
 
 func (api Api) GetHostPort() string {
@@ -73,6 +107,16 @@ type CommonConfig struct {
 	// configuration that is passed around in JSON.
 	Credential *Credential `yaml:"-" json:"-"`
 	PublicKey  []byte      `yaml:"-" json:"-"`
+	// Names of services this service needs to be running
+	// before it can start.
+	DependsOn []string `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	// Executable that runs the service, used by the root
+	// service in supervisor mode. If omitted, defaults to
+	// the name of the service.
+	Executable string `yaml:"executable,omitempty" json:"executable,omitempty"`
+	// Features are the feature flags of the service
+	// (see package features).
+	Features map[string]bool `yaml:"features,omitempty" json:"features,omitempty"`
 }
 
 // ServiceConfig contains common configuration
@@ -87,6 +131,9 @@ type ServiceConfig struct {
 	// to all services, and something service-specific
 	// that we in common do not need to know about.
 	ServiceSpecific map[string]interface{} `json:"config" yaml:"config,omitempty"`
+	// Version of the configuration, as served by the root service
+	// (see ConfigVersionResponse).
+	Version uint64 `json:"version,omitempty" yaml:"-"`
 }
 
 // Config provides the main configuration object
@@ -99,9 +146,12 @@ type yamlConfig struct {
 }
 
 type yamlServiceConfig struct {
-	Service string
-	Api     *Api
-	Config  map[string]interface{} `yaml:"config,omitempty"`
+	Service    string
+	Api        *Api
+	DependsOn  []string               `yaml:"depends_on,omitempty"`
+	Executable string                 `yaml:"executable,omitempty"`
+	Features   map[string]bool        `yaml:"features,omitempty"`
+	Config     map[string]interface{} `yaml:"config,omitempty"`
 }
 
 // cleanupMap ensures that map[string]interface{}'s children
@@ -115,6 +165,8 @@ func cleanupMap(m map[string]interface{}) map[string]interface{} {
 		case map[interface{}]interface{}:
 			newVal := cleanupMap2(vt)
 			retval[k] = newVal
+		case []interface{}:
+			retval[k] = cleanupList(vt)
 		default:
 			retval[k] = v
 		}
@@ -131,6 +183,8 @@ func cleanupMap2(ifcIfc map[interface{}]interface{}) map[string]interface{} {
 		case map[interface{}]interface{}:
 			newVal := cleanupMap2(vt)
 			retval[kStr] = newVal
+		case []interface{}:
+			retval[kStr] = cleanupList(vt)
 		default:
 			retval[kStr] = v
 		}
@@ -138,6 +192,164 @@ func cleanupMap2(ifcIfc map[interface{}]interface{}) map[string]interface{} {
 	return retval
 }
 
+// cleanupList is called from cleanupMap and cleanupMap2 for
+// lists, which may contain maps.
+func cleanupList(list []interface{}) []interface{} {
+	retval := make([]interface{}, len(list))
+	for i, v := range list {
+		switch vt := v.(type) {
+		case map[interface{}]interface{}:
+			retval[i] = cleanupMap2(vt)
+		case []interface{}:
+			retval[i] = cleanupList(vt)
+		default:
+			retval[i] = v
+		}
+	}
+	return retval
+}
+
+// ValidateConfig checks configuration of each service, as well as
+// things that span services, returning all problems found rather
+// than stopping at the first one. Dependencies between services
+// are checked by the root service.
+func ValidateConfig(config Config) []error {
+	var errs []error
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, errors.New(fmt.Sprintf(format, args...)))
+	}
+	if _, ok := config.Services[ServiceRoot]; !ok {
+		addError("No configuration for %s service", ServiceRoot)
+	}
+	var names []string
+	for name := range config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hostPorts := make(map[string]string)
+	for _, name := range names {
+		serviceConfig := config.Services[name]
+		api := serviceConfig.Common.Api
+		if api == nil {
+			addError("%s: no api section", name)
+			continue
+		}
+		if api.Port > MaxPortNumber {
+			addError("%s: invalid port %d", name, api.Port)
+		}
+		// Port 0 means any port, so cannot conflict.
+		if api.Port != 0 {
+			hostPort := api.GetHostPort()
+			if other, ok := hostPorts[hostPort]; ok {
+				addError("%s: %s is already used by %s", name, hostPort, other)
+			} else {
+				hostPorts[hostPort] = name
+			}
+		}
+		var flags []string
+		for flag := range serviceConfig.Common.Features {
+			flags = append(flags, flag)
+		}
+		sort.Strings(flags)
+		for _, flag := range flags {
+			if !features.ValidName(flag) {
+				addError("%s: invalid feature flag name %s", name, flag)
+			}
+		}
+		if !validCallLog(api.CallLog) {
+			addError("%s: invalid call_log %s, expected one of %s, %s or %s", name, api.CallLog, CallLogAll, CallLogErrors, CallLogNone)
+		}
+		if api.MaxRequestBytes < 0 {
+			addError("%s: invalid max_request_bytes %d", name, api.MaxRequestBytes)
+		}
+		if api.Statsd != "" {
+			if _, _, err := net.SplitHostPort(api.Statsd); err != nil {
+				addError("%s: invalid statsd address %s", name, api.Statsd)
+			}
+		}
+		if api.Diagnostics != "" {
+			if _, _, err := net.SplitHostPort(api.Diagnostics); err != nil {
+				addError("%s: invalid diagnostics address %s", name, api.Diagnostics)
+			} else if other, ok := hostPorts[api.Diagnostics]; ok {
+				addError("%s: %s is already used by %s", name, api.Diagnostics, other)
+			} else {
+				hostPorts[api.Diagnostics] = name
+			}
+		}
+		for _, hook := range api.Hooks {
+			err := hook.validate()
+			if err != nil {
+				addError("%s: hook for %s %s: %s", name, hook.Method, hook.Pattern, err)
+			}
+		}
+		if storeConfig, ok := serviceConfig.ServiceSpecific["store"].(map[string]interface{}); ok {
+			switch storeConfig["type"] {
+			case "sqlite3", "mysql":
+			default:
+				addError("%s: unsupported store type %v", name, storeConfig["type"])
+			}
+			if database, _ := storeConfig["database"].(string); database == "" {
+				addError("%s: store database is required", name)
+			}
+			if _, err := parseStoreFaults(storeConfig); err != nil {
+				addError("%s: store: %s", name, err)
+			}
+			if _, err := parseSlowQueries(storeConfig); err != nil {
+				addError("%s: store: %s", name, err)
+			}
+			if _, err := parseDeletionGrace(storeConfig); err != nil {
+				addError("%s: store: %s", name, err)
+			}
+			if _, err := parseDbCredentials(storeConfig); err != nil {
+				addError("%s: store: %s", name, err)
+			}
+			// Keys given as secrets are only known to the service.
+			if key, ok := storeConfig["encryption_key"]; ok && !IsSecret(key) {
+				if _, err := parseFieldEncryption(storeConfig); err != nil {
+					addError("%s: store: %s", name, err)
+				}
+			}
+		}
+		if busConfig, ok := serviceConfig.ServiceSpecific["bus"]; ok {
+			busMap, ok := busConfig.(map[string]interface{})
+			if !ok {
+				addError("%s: invalid bus configuration %v", name, busConfig)
+			} else if err := validateBusConfig(busMap); err != nil {
+				addError("%s: %s", name, err)
+			}
+		}
+		if _, err := parseRestFaults(serviceConfig.ServiceSpecific); err != nil {
+			addError("%s: %s", name, err)
+		}
+		if _, err := parseMaintenance(serviceConfig.ServiceSpecific); err != nil {
+			addError("%s: %s", name, err)
+		}
+		for _, err := range validateSecrets(serviceConfig.ServiceSpecific) {
+			addError("%s: %s", name, err)
+		}
+	}
+	return errs
+}
+
+// validateSecrets checks that secret references (see secrets.go)
+// in the configuration map are well-formed, without resolving them.
+func validateSecrets(configMap map[string]interface{}) []error {
+	var errs []error
+	for _, v := range configMap {
+		switch vt := v.(type) {
+		case string:
+			if IsSecret(vt) {
+				if _, _, err := parseSecret(vt); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		case map[string]interface{}:
+			errs = append(errs, validateSecrets(vt)...)
+		}
+	}
+	return errs
+}
+
 // ReadConfig parses the configuration file provided and returns
 // ReadConfig reads config from file to structure
 func ReadConfig(fname string) (Config, error) {
@@ -153,37 +365,49 @@ func ReadConfig(fname string) (Config, error) {
 		fname = absFname
 	}
 
-	yamlConfig := yamlConfig{}
 	if fname != "" {
 		data, err := ioutil.ReadFile(fname)
 		if err != nil {
 			return *config, err
 		}
 		log.Printf("Reading config from %s", fname)
-		err = yaml.Unmarshal([]byte(data), &yamlConfig)
+		parsedConfig, err := ParseConfig(data)
 		if err != nil {
-			log.Printf("Error reading config: %v", err)
 			return *config, err
 		}
-		log.Printf("Read config from %s", fname)
-		serviceConfigs := yamlConfig.Services
-		config.Services = make(map[string]ServiceConfig)
-		// Now convert this to map for easier reading...
-		for i := range serviceConfigs {
-			c := serviceConfigs[i]
-			api := Api{Host: c.Api.Host, Port: c.Api.Port, Hooks: c.Api.Hooks}
-			cleanedConfig := cleanupMap(c.Config)
-			commonConfig := CommonConfig{Api: &api, Credential: nil, PublicKey: nil}
-			config.Services[c.Service] = ServiceConfig{Common: commonConfig, ServiceSpecific: cleanedConfig}
-		}
 		log.Println("Read configuration from", fname)
-		return *config, nil
+		return parsedConfig, nil
 	}
 	return *config, errors.New("Empty filename.")
 }
 
-// WriteConfig writes config from file to structure
-func WriteConfig(config Config, fname string) error {
+// ParseConfig parses configuration in YAML format (the format
+// of the configuration file).
+func ParseConfig(data []byte) (Config, error) {
+	config := &Config{}
+	yamlConfig := yamlConfig{}
+	err := yaml.Unmarshal(data, &yamlConfig)
+	if err != nil {
+		log.Printf("Error reading config: %v", err)
+		return *config, err
+	}
+	serviceConfigs := yamlConfig.Services
+	config.Services = make(map[string]ServiceConfig)
+	// Now convert this to map for easier reading...
+	for i := range serviceConfigs {
+		c := serviceConfigs[i]
+		// All of the api section, so that options added to Api
+		// are read without changes here.
+		api := *c.Api
+		cleanedConfig := cleanupMap(c.Config)
+		commonConfig := CommonConfig{Api: &api, Credential: nil, PublicKey: nil, DependsOn: c.DependsOn, Executable: c.Executable, Features: c.Features}
+		config.Services[c.Service] = ServiceConfig{Common: commonConfig, ServiceSpecific: cleanedConfig}
+	}
+	return *config, nil
+}
+
+// MarshalConfig is the reverse of ParseConfig.
+func MarshalConfig(config Config) ([]byte, error) {
 	yamlConfig := &yamlConfig{}
 	yamlConfig.Services = make([]yamlServiceConfig, len(config.Services))
 	i := 0
@@ -191,12 +415,19 @@ func WriteConfig(config Config, fname string) error {
 		ysc := &yamlServiceConfig{}
 		ysc.Service = k
 		ysc.Api = v.Common.Api
+		ysc.DependsOn = v.Common.DependsOn
+		ysc.Executable = v.Common.Executable
+		ysc.Features = v.Common.Features
 		ysc.Config = v.ServiceSpecific
 		yamlConfig.Services[i] = *ysc
 		i++
 	}
+	return yaml.Marshal(yamlConfig)
+}
 
-	b, err := yaml.Marshal(yamlConfig)
+// WriteConfig writes config from file to structure
+func WriteConfig(config Config, fname string) error {
+	b, err := MarshalConfig(config)
 	if err != nil {
 		return err
 	}
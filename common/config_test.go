@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFeatureConfig tests reading and validation
+// of feature flags in the configuration.
+func TestFeatureConfig(t *testing.T) {
+	data := []byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n    features:\n      push_events: true\n      Bad-Name: true\n")
+	config, err := ParseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, config.Services["root"].Common.Features["push_events"], true)
+	marshaled, err := MarshalConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ParseConfig(marshaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, config.Services["root"].Common.Features["push_events"], true)
+	errs := ValidateConfig(config)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "invalid feature flag name Bad-Name") {
+		t.Errorf("Expected error for invalid flag name, got %v", errs)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Credentials a store connects to its database with that are not
+// fixed in its configuration, but obtained from a provider and
+// replaced when they expire. Dynamic credentials of the database
+// secrets engine of Vault are used when set in the "store" section:
+//
+//   "store": {
+//     "type": "mysql",
+//     ...
+//     "vault_credentials": "database/creds/romana-ipam"
+//   }
+//
+// with Vault at VAULT_ADDR, authenticated to with VAULT_TOKEN (see
+// secrets.go). The lease of the credentials is renewed while Vault
+// allows it, after which new credentials are obtained. Connections
+// are opened with the credentials current at the time, and those
+// opened with previous ones are closed once they are idle.
+//
+// The schema is still created with username and password of the
+// store configuration.
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// credentialsDriverName is the name the driver opening connections
+	// with provided credentials is registered under.
+	credentialsDriverName = "romana-credentials"
+
+	// dbCredentialsMinTTL is how long renewed credentials must be
+	// valid for at least; credentials Vault does not extend further
+	// (past their max TTL) are replaced instead.
+	dbCredentialsMinTTL = time.Minute
+
+	// dbCredentialsRetryDelay is how long to wait before trying
+	// again to get credentials after failing to.
+	dbCredentialsRetryDelay = 10 * time.Second
+)
+
+// DbCredentials are what a store connects to its database with.
+type DbCredentials struct {
+	Username string
+	Password string
+	// TTL is how long the credentials are valid for,
+	// 0 if they do not expire.
+	TTL time.Duration
+}
+
+// DbCredentialProvider provides credentials a DbStore connects to
+// its database with, in place of username and password of its
+// configuration (see DbStore.SetCredentialProvider).
+type DbCredentialProvider interface {
+	// Credentials returns new credentials.
+	Credentials() (DbCredentials, error)
+	// Renew extends validity of credentials returned last, returning
+	// how long they are valid for now. An error means they cannot be
+	// extended, and new ones are to be obtained.
+	Renew() (time.Duration, error)
+}
+
+// SetCredentialProvider makes the store connect with credentials
+// from the provider, replacing any configured with vault_credentials.
+// It is to be called after SetConfig and before Connect.
+func (dbStore *DbStore) SetCredentialProvider(provider DbCredentialProvider) {
+	dbStore.credentials = &dbCredentials{provider: provider, sleep: time.Sleep}
+}
+
+// parseDbCredentials parses vault_credentials of the
+// store configuration, returning nil if it is not set.
+func parseDbCredentials(storeConfig map[string]interface{}) (*dbCredentials, error) {
+	value, ok := storeConfig["vault_credentials"]
+	if !ok {
+		return nil, nil
+	}
+	path, ok := value.(string)
+	if !ok || path == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid vault_credentials %v", value))
+	}
+	return &dbCredentials{provider: &vaultDbCredentials{path: path}, sleep: time.Sleep}, nil
+}
+
+// dbCredentials are the credentials of a store,
+// and the pool of connections opened with them.
+type dbCredentials struct {
+	provider DbCredentialProvider
+
+	sync.Mutex
+	current DbCredentials
+	config  StoreConfig
+	// driver opens connections to the database.
+	driver driver.Driver
+	pool   *sql.DB
+	// sleep is time.Sleep, replaced by tests.
+	sleep func(time.Duration)
+}
+
+// Stores connecting with provided credentials, by the name the
+// pool of each opens connections with credentialsDriver.
+var credentialStores = struct {
+	sync.Mutex
+	byName map[string]*dbCredentials
+}{byName: make(map[string]*dbCredentials)}
+
+// registerCredentialsDriver registers credentialsDriver, once.
+var registerCredentialsDriver sync.Once
+
+// credentialsDriver opens connections to databases of stores
+// with their current credentials.
+type credentialsDriver struct{}
+
+// Open implements driver.Driver. The name is
+// that of the store in credentialStores.
+func (credentialsDriver) Open(name string) (driver.Conn, error) {
+	credentialStores.Lock()
+	c, ok := credentialStores.byName[name]
+	credentialStores.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown store %s", name))
+	}
+	c.Lock()
+	config := c.config
+	config.Username = c.current.Username
+	config.Password = c.current.Password
+	c.Unlock()
+	return c.driver.Open(makeConnString(&config))
+}
+
+// open returns the pool of connections to the database described
+// by config, opened with provided credentials, and starts renewing
+// them. The pool is opened once, later calls return it.
+func (c *dbCredentials) open(config StoreConfig) (*sql.DB, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.pool != nil {
+		return c.pool, nil
+	}
+	credentials, err := c.provider.Credentials()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot get credentials for %s: %s", config, err))
+	}
+	// Connections are opened by the driver of the database type,
+	// found by opening (but not connecting) a pool with it.
+	typed, err := sql.Open(config.Type, "")
+	if err != nil {
+		return nil, err
+	}
+	c.driver = typed.Driver()
+	typed.Close()
+
+	registerCredentialsDriver.Do(func() {
+		sql.Register(credentialsDriverName, credentialsDriver{})
+	})
+	credentialStores.Lock()
+	name := strconv.Itoa(len(credentialStores.byName))
+	credentialStores.byName[name] = c
+	credentialStores.Unlock()
+	pool, err := sql.Open(credentialsDriverName, name)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.TTL > 0 {
+		// Connections opened with credentials about to expire
+		// are not kept for long either.
+		pool.SetConnMaxLifetime(credentials.TTL)
+	}
+	c.config = config
+	c.current = credentials
+	c.pool = pool
+	log.Printf("DB: connecting to %s with %s, valid for %v", config, credentials.Username, credentials.TTL)
+	go c.renew()
+	return pool, nil
+}
+
+// renew keeps credentials valid, renewing them before they expire
+// and getting new ones when they cannot be renewed any more.
+func (c *dbCredentials) renew() {
+	for {
+		c.Lock()
+		ttl := c.current.TTL
+		c.Unlock()
+		if ttl <= 0 {
+			return
+		}
+		// Renewed with a third of the time left, so that
+		// there is time to get new ones if that fails.
+		c.sleep(ttl * 2 / 3)
+		renewed, err := c.provider.Renew()
+		if err == nil && renewed >= dbCredentialsMinTTL {
+			c.Lock()
+			c.current.TTL = renewed
+			c.Unlock()
+			continue
+		}
+		if err != nil {
+			log.Printf("DB: cannot renew credentials: %s", err)
+		}
+		c.rotate()
+	}
+}
+
+// rotate replaces credentials with new ones, trying until it gets
+// them, and closes idle connections opened with the previous ones.
+func (c *dbCredentials) rotate() {
+	for {
+		credentials, err := c.provider.Credentials()
+		if err != nil {
+			log.Printf("DB: cannot get new credentials, trying again in %v: %s", dbCredentialsRetryDelay, err)
+			c.sleep(dbCredentialsRetryDelay)
+			continue
+		}
+		c.Lock()
+		c.current = credentials
+		pool := c.pool
+		c.Unlock()
+		log.Printf("DB: connecting with new credentials %s, valid for %v", credentials.Username, credentials.TTL)
+		pool.SetMaxIdleConns(0)
+		pool.SetMaxIdleConns(defaultMaxIdleConns)
+		return
+	}
+}
+
+// defaultMaxIdleConns is the default of database/sql.
+const defaultMaxIdleConns = 2
+
+// vaultDbCredentials are dynamic credentials from the
+// database secrets engine of Vault, read at the path.
+type vaultDbCredentials struct {
+	path string
+	// leaseID is the lease of credentials read last.
+	leaseID string
+}
+
+// Credentials implements DbCredentialProvider.
+func (v *vaultDbCredentials) Credentials() (DbCredentials, error) {
+	resp := struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}{}
+	if err := vaultRequest("GET", v.path, nil, &resp); err != nil {
+		return DbCredentials{}, NewError("Error reading credentials %s from Vault: %s", v.path, err)
+	}
+	if resp.Data.Username == "" {
+		return DbCredentials{}, NewError("No username in credentials %s from Vault", v.path)
+	}
+	v.leaseID = resp.LeaseID
+	return DbCredentials{
+		Username: resp.Data.Username,
+		Password: resp.Data.Password,
+		TTL:      time.Duration(resp.LeaseDuration) * time.Second,
+	}, nil
+}
+
+// Renew implements DbCredentialProvider.
+func (v *vaultDbCredentials) Renew() (time.Duration, error) {
+	if v.leaseID == "" {
+		return 0, NewError("Credentials %s from Vault have no lease", v.path)
+	}
+	resp := struct {
+		LeaseDuration int64 `json:"lease_duration"`
+	}{}
+	err := vaultRequest("PUT", "sys/leases/renew", map[string]string{"lease_id": v.leaseID}, &resp)
+	if err != nil {
+		return 0, NewError("Error renewing lease %s in Vault: %s", v.leaseID, err)
+	}
+	return time.Duration(resp.LeaseDuration) * time.Second, nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDbCredentials provides credentials
+// that cannot be renewed after the first time.
+type fakeDbCredentials struct {
+	sync.Mutex
+	issued  int
+	renewed int
+}
+
+func (f *fakeDbCredentials) Credentials() (DbCredentials, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.issued++
+	return DbCredentials{Username: fmt.Sprintf("user%d", f.issued), TTL: time.Hour}, nil
+}
+
+func (f *fakeDbCredentials) Renew() (time.Duration, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.renewed++
+	if f.renewed > 1 {
+		return 0, errors.New("lease expired")
+	}
+	return time.Hour, nil
+}
+
+// TestDbCredentials tests connecting stores with
+// provided credentials, renewed and rotated.
+func TestDbCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &DbStore{}
+	if err := store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/db.sqlite3"}); err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeDbCredentials{}
+	store.SetCredentialProvider(provider)
+	// Renewal waits in sleep until the test is done checking.
+	sleeps := make(chan time.Duration)
+	resume := make(chan struct{})
+	store.credentials.sleep = func(d time.Duration) {
+		sleeps <- d
+		<-resume
+	}
+	if err := store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	store.Db.CreateTable(&uniqueRecord{})
+	if err := store.CreateAll(nil, []uniqueRecord{{Name: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewed once, then rotated as the second renewal fails.
+	for i := 0; i < 3; i++ {
+		expect(t, <-sleeps, 40*time.Minute)
+		provider.Lock()
+		expect(t, provider.renewed, i)
+		expect(t, provider.issued, 1+i/2)
+		provider.Unlock()
+		if i < 2 {
+			resume <- struct{}{}
+		}
+	}
+	store.credentials.Lock()
+	expect(t, store.credentials.current.Username, "user2")
+	store.credentials.Unlock()
+
+	var found []uniqueRecord
+	store.Db.Find(&found)
+	expect(t, len(found), 1)
+}
+
+// TestVaultDbCredentials tests getting and renewing
+// credentials from the database secrets engine of Vault.
+func TestVaultDbCredentials(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/database/creds/romana":
+			w.Write([]byte(`{"lease_id": "database/creds/romana/1", "lease_duration": 3600, "data": {"username": "v-romana", "password": "pw"}}`))
+		case r.Method == "PUT" && r.URL.Path == "/v1/sys/leases/renew":
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["lease_id"] != "database/creds/romana/1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"lease_id": "database/creds/romana/1", "lease_duration": 1800}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv(VaultAddrEnv, vault.URL)
+	defer os.Unsetenv(VaultAddrEnv)
+	os.Setenv(VaultTokenEnv, "token")
+	defer os.Unsetenv(VaultTokenEnv)
+
+	credentials, err := parseDbCredentials(map[string]interface{}{"vault_credentials": "database/creds/romana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := credentials.provider
+	if _, err := provider.Renew(); err == nil {
+		t.Error("Expected error renewing credentials not read yet")
+	}
+	creds, err := provider.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, creds, DbCredentials{Username: "v-romana", Password: "pw", TTL: time.Hour})
+	ttl, err := provider.Renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ttl, 30*time.Minute)
+
+	if _, err := parseDbCredentials(map[string]interface{}{"vault_credentials": 1.0}); err == nil {
+		t.Error("Expected error for invalid vault_credentials")
+	}
+}
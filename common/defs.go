@@ -20,7 +20,11 @@ package common
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/romana/core/common/netutil"
 )
 
 // Here we only keep type definitions and struct definitions with no behavior.
@@ -68,6 +72,37 @@ const (
 	// we are attempting to get a token at this point).
 	AuthPath = "/auth"
 
+	// Path on root service where services register
+	// and deregister themselves.
+	ServicesPath = "/services"
+
+	// Path on root service to watch for configuration changes.
+	ConfigPath = "/config"
+
+	// Path on every service that reports its health (see ServiceHealth).
+	HealthPath = "/health"
+
+	// Path on root service that reports health of all
+	// registered services (see ClusterStatus).
+	StatusPath = "/status"
+
+	// Path on services that expose metrics (see Metrics).
+	MetricsPath = "/metrics"
+
+	// Path on root service of leases used to elect
+	// leaders (see Lease and LeaderElection).
+	LeasesPath = "/leases"
+
+	// Reported as health of a database that is usable.
+	HealthOK = "ok"
+
+	// Rel of links in root service index to all root service
+	// instances (see RestClientConfig.RootURL).
+	RootLinkRel = "root"
+	// Rel of link in root service index to the root service
+	// instance currently elected as the leader.
+	RootLeaderLinkRel = "root-leader"
+
 	// Body provided.
 	HookExecutableBodyArgument = "body"
 
@@ -109,7 +144,73 @@ type Host struct {
 	Ip        string `json:"ip,omitempty"`
 	RomanaIp  string `json:"romana_ip,omitempty"`
 	AgentPort uint64 `json:"agent_port,omitempty"`
-	Links     Links  `json:"links,omitempty" sql:"-"`
+	// LastHeartbeat is when the agent on a self-registered host
+	// last registered it (Unix time); 0 for hosts added by hand.
+	LastHeartbeat int64 `json:"last_heartbeat,omitempty"`
+	// Draining is set when the host is about to be removed:
+	// no more endpoints are allocated on it.
+	Draining bool `json:"draining,omitempty"`
+	// Zone is the name of the zone (see Datacenter) of the host;
+	// empty for the datacenter itself.
+	Zone string `json:"zone,omitempty"`
+	// Status is the health of a self-registered host
+	// (HostHealthy, HostUnreachable or HostDown), which
+	// topology derives from LastHeartbeat.
+	Status string `json:"status,omitempty" sql:"-"`
+	// Labels are arbitrary key/value pairs, such as rack or
+	// hardware class, by which hosts can be selected.
+	Labels map[string]string `json:"labels,omitempty" sql:"-"`
+	Links  Links             `json:"links,omitempty" sql:"-"`
+	// Version is incremented on each update of the host,
+	// which must give the version it changes (see CheckVersion).
+	Version uint64 `sql:"not null;default:1" json:"version,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by the store.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Values of Host.Status.
+const (
+	HostHealthy     = "healthy"
+	HostUnreachable = "unreachable"
+	HostDown        = "down"
+)
+
+// Types of HostEvent.
+const (
+	HostAdded   = "added"
+	HostUpdated = "updated"
+	HostRemoved = "removed"
+)
+
+// HostEvent is a change to a host in the topology service.
+type HostEvent struct {
+	// Seq orders events; each event has a Seq one
+	// greater than the previous one.
+	Seq       uint64 `json:"seq"`
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	Host      Host   `json:"host"`
+}
+
+// HostEventList is returned by the topology service for a
+// request for host events since a given sequence number.
+type HostEventList struct {
+	// Seq of the latest event, to ask for events since next time.
+	Seq uint64 `json:"seq"`
+	// Reset is set when some events since the requested one are
+	// no longer available, so the full host list must be fetched.
+	Reset  bool        `json:"reset,omitempty"`
+	Events []HostEvent `json:"events"`
+}
+
+// HostRegistration is sent by an agent to the topology service to
+// register its host, and then periodically as a heartbeat.
+type HostRegistration struct {
+	Host Host `json:"host"`
+	// Token the topology service is configured to accept
+	// registrations with (bootstrap_token).
+	Token string `json:"token"`
 }
 
 // Message to register with the root service the actual
@@ -118,20 +219,147 @@ type PortUpdateMessage struct {
 	Port uint64 `json:"port"`
 }
 
+// ServiceRegistration is sent by a service to the root service
+// to announce itself at startup (see RestClient.RegisterService).
+type ServiceRegistration struct {
+	Name         string   `json:"name"`
+	Url          string   `json:"url"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Set by root service upon registration.
+	RegisteredAt int64 `json:"registered_at,omitempty"`
+}
+
+// Lease is held by one instance of a replicated service at a time,
+// the leader, until it expires or is released (see LeaderElection).
+// Root service keeps Data across holders, so that a leader can hand
+// off its state to the next one.
+type Lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder,omitempty"`
+	// Seconds for which the lease is held unless renewed.
+	TTL  int64             `json:"ttl,omitempty"`
+	Data map[string]string `json:"data,omitempty"`
+	// Set by root service, in seconds since the epoch.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// ServiceHealth is returned by every service on GET to HealthPath.
+type ServiceHealth struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+	// Seconds since the service started.
+	Uptime int64 `json:"uptime"`
+	// HealthOK or the problem with the database, if the
+	// service uses one (see HealthChecker).
+	Database string `json:"database,omitempty"`
+	// Last error the service returned to a request, and
+	// when (as Unix time).
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorAt int64  `json:"last_error_at,omitempty"`
+	// Maintenance jobs the service runs (see Maintainer).
+	Maintenance []MaintenanceStatus `json:"maintenance,omitempty"`
+	// Feature flags enabled (see package features).
+	Features []string `json:"features,omitempty"`
+}
+
+// MaintenanceStatus is the last run of a maintenance job of a service.
+type MaintenanceStatus struct {
+	Job string `json:"job"`
+	// Seconds between runs.
+	Interval int64 `json:"interval_seconds"`
+	Runs     int64 `json:"runs"`
+	Failures int64 `json:"failures,omitempty"`
+	// When the job last ran (as Unix time), and for how long.
+	LastRun            int64 `json:"last_run,omitempty"`
+	LastDurationMillis int64 `json:"last_duration_millis,omitempty"`
+	// What the last run did, or the error it failed with.
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ServiceStatus is the health of a service as seen by the root service.
+type ServiceStatus struct {
+	ServiceHealth
+	Url string `json:"url"`
+	// Healthy is false if the service cannot be reached
+	// or its database is not usable.
+	Healthy bool `json:"healthy"`
+	// Error reaching the service, if any.
+	Error string `json:"error,omitempty"`
+	// How the service has been running, if root
+	// started it (see root.RunSupervised).
+	Supervisor *SupervisedStatus `json:"supervisor,omitempty"`
+}
+
+// SupervisedStatus is how a service started by root has been
+// running, as reported in ServiceStatus.
+type SupervisedStatus struct {
+	Running bool `json:"running"`
+	// Restarts after the service exited.
+	Restarts int `json:"restarts"`
+	// Why the service last exited, and when (as Unix time).
+	LastExit   string `json:"last_exit,omitempty"`
+	LastExitAt int64  `json:"last_exit_at,omitempty"`
+}
+
+// ClusterStatus is returned by the root service on GET to StatusPath.
+type ClusterStatus struct {
+	// Healthy is true if all services are.
+	Healthy bool `json:"healthy"`
+	// Time of the status, as Unix time.
+	Timestamp int64           `json:"timestamp"`
+	Services  []ServiceStatus `json:"services"`
+}
+
+// ConfigVersionResponse is returned by the root service on GET to
+// ConfigPath. Version increases every time any configuration served
+// by root changes.
+type ConfigVersionResponse struct {
+	Version uint64 `json:"version"`
+}
+
+// ConfigValidationRequest is sent to the root service to validate
+// candidate configuration, in the same format as the configuration
+// file, without applying it.
+type ConfigValidationRequest struct {
+	Config string `json:"config"`
+}
+
+// ConfigValidationResponse lists all problems found
+// in the configuration validated.
+type ConfigValidationResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ConfigHistoryEntry describes one version of the configuration
+// kept by the root service.
+type ConfigHistoryEntry struct {
+	Version uint64 `json:"version"`
+	// Time of the change, as Unix time.
+	Timestamp int64  `json:"timestamp"`
+	Reason    string `json:"reason"`
+	Config    Config `json:"config"`
+}
+
 // Endpoint represents an endpoint - that is, something that
 // has an IP address and routes to/from. It can be a container,
-// a Kubernetes POD, a VM, etc.
+// a Kubernetes POD, a VM, etc. As a policy peer it can also be
+// a block of addresses, Cidr, such as an external network, less
+// the blocks within it listed in Except.
 type Endpoint struct {
-	Peer              string  `json:"peer,omitempty"`
-	Cidr              string  `json:"cidr,omitempty"`
-	TenantID          uint64  `json:"tenant_id,omitempty"`
-	TenantName        string  `json:"tenant,omitempty"`
-	TenantExternalID  string  `json:"tenant_external_id,omitempty"`
-	TenantNetworkID   *uint64 `json:"tenant_network_id,omitempty"`
-	SegmentID         uint64  `json:"segment_id,omitempty"`
-	SegmentName       string  `json:"segment,omitempty"`
-	SegmentExternalID string  `json:"segment_external_id,omitempty"`
-	SegmentNetworkID  *uint64 `json:"segment_network_id,omitempty"`
+	Peer              string   `json:"peer,omitempty"`
+	Cidr              string   `json:"cidr,omitempty"`
+	Except            []string `json:"except,omitempty"`
+	TenantID          uint64   `json:"tenant_id,omitempty"`
+	TenantName        string   `json:"tenant,omitempty"`
+	TenantExternalID  string   `json:"tenant_external_id,omitempty"`
+	TenantNetworkID   *uint64  `json:"tenant_network_id,omitempty"`
+	SegmentID         uint64   `json:"segment_id,omitempty"`
+	SegmentName       string   `json:"segment,omitempty"`
+	SegmentExternalID string   `json:"segment_external_id,omitempty"`
+	SegmentNetworkID  *uint64  `json:"segment_network_id,omitempty"`
 }
 
 func (e Endpoint) String() string {
@@ -143,28 +371,101 @@ const (
 	PolicyDirectionEgress  = "egress"
 )
 
+const (
+	PolicyActionAllow = "allow"
+	PolicyActionDeny  = "deny"
+	// PolicyVerdictNone is the verdict of PolicyEvaluation
+	// when no policy decides the fate of the flow.
+	PolicyVerdictNone = "none"
+)
+
+// PortRange is an inclusive range of ports. In JSON it is
+// either an array of two ports or a string such as "30000-32767".
 type PortRange [2]uint
 
 func (p PortRange) String() string {
 	return fmt.Sprintf("%d-%d", p[0], p[1])
 }
 
+// UnmarshalJSON implements json.Unmarshaler, accepting
+// both forms of the range.
+func (p *PortRange) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var ports [2]uint
+		if err := json.Unmarshal(data, &ports); err != nil {
+			return err
+		}
+		*p = PortRange(ports)
+		return nil
+	}
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return fmt.Errorf("Invalid port range %s, expected <from>-<to>", s)
+	}
+	for i, bound := range bounds {
+		port, err := strconv.ParseUint(strings.TrimSpace(bound), 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid port range %s, expected <from>-<to>", s)
+		}
+		p[i] = uint(port)
+	}
+	return nil
+}
+
+// PortList is a named list of ports and port ranges, which rules
+// of policies refer to in PortLists instead of repeating the ports.
+type PortList struct {
+	ID          uint64      `json:"id,omitempty"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Ports       []uint      `json:"ports,omitempty"`
+	PortRanges  []PortRange `json:"port_ranges,omitempty"`
+}
+
+// Validate returns an Unprocessable Entity (422) HttpError
+// if the port list has no name or no valid ports.
+func (l PortList) Validate() error {
+	var errMsg []string
+	if strings.TrimSpace(l.Name) == "" {
+		errMsg = append(errMsg, "Name is required.")
+	}
+	if len(l.Ports) == 0 && len(l.PortRanges) == 0 {
+		errMsg = append(errMsg, "No ports specified.")
+	}
+	errMsg = append(errMsg, validatePorts("Port list", l.Ports, l.PortRanges)...)
+	if len(errMsg) == 0 {
+		return nil
+	}
+	return NewUnprocessableEntityError(errMsg)
+}
+
 // Rule describes a rule of the policy. The following requirements apply
 // (the policy would not be validated otherwise):
 // 1. Protocol must be specified.
 // 2. Protocol must be one of those validated by isValidProto().
 // 3. Ports cannot be negative or greater than 65535.
-// 4. If Protocol specified is "icmp", Ports and PortRanges fields should be blank.
-// 5. If Protocol specified is not "icmp", Icmptype and IcmpCode should be unspecified.
+// 4. If Protocol specified is "icmp", Ports, PortRanges and PortLists fields should be blank.
+// 5. If Protocol specified is not "icmp", Icmptype, IcmpCode and IcmpTypeName
+//    should be unspecified.
+// 6. IcmpTypeName must be known to IcmpTypeByName and cannot be combined
+//    with IcmpType or IcmpCode.
 type Rule struct {
 	Protocol   string      `json:"protocol,omitempty"`
 	Ports      []uint      `json:"ports,omitempty"`
 	PortRanges []PortRange `json:"port_ranges,omitempty"`
+	// PortLists names PortLists whose ports the policy service
+	// adds to Ports and PortRanges when it stores the policy.
+	PortLists []string `json:"port_lists,omitempty"`
 	// IcmpType only applies if Protocol value is ICMP and
 	// is mutually exclusive with Ports or PortRanges
-	IcmpType   uint `json:"icmp_type,omitempty"`
-	IcmpCode   uint `json:"icmp_code,omitempty"`
-	IsStateful bool `json:"is_stateful,omitempty"`
+	IcmpType uint `json:"icmp_type,omitempty"`
+	IcmpCode uint `json:"icmp_code,omitempty"`
+	// IcmpTypeName names the ICMP type (and code) the way iptables
+	// does, e.g. "echo-reply" or "fragmentation-needed". Unlike
+	// IcmpType and IcmpCode it can express type and code 0.
+	IcmpTypeName string `json:"icmp_type_name,omitempty"`
+	IsStateful   bool   `json:"is_stateful,omitempty"`
 }
 
 func (r Rule) String() string {
@@ -202,6 +503,21 @@ type Policy struct {
 	AppliedTo  []Endpoint  `json:"applied_to,omitempty"`
 	Peers      []Endpoint  `json:"peers,omitempty"`
 	Rules      []Rule      `json:"rules,omitempty"`
+	// Action is PolicyActionAllow (the default) to allow traffic matching
+	// peers and rules, or PolicyActionDeny to drop it.
+	Action string `json:"action,omitempty"`
+	// Priority orders policies applied to the same endpoints: those with
+	// lower values are checked first, and of policies with the same
+	// priority, deny policies are checked before allow ones.
+	Priority int `json:"priority,omitempty"`
+	// Revision is the version of the policy, set by the policy service
+	// when the policy is stored, starting at 1. Agents report the
+	// revision they applied (see HostPolicyStatus).
+	Revision uint64 `json:"revision,omitempty"`
+	// CreatedAt and UpdatedAt are set by the policy service from
+	// the stored policy; they are ignored when set by user.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 	//	Tags       []Tag      `json:"tags,omitempty"`
 }
 
@@ -209,6 +525,126 @@ func (p Policy) String() string {
 	return String(p)
 }
 
+// IsDeny returns true if the policy drops the traffic it matches.
+func (p Policy) IsDeny() bool {
+	return strings.ToLower(p.Action) == PolicyActionDeny
+}
+
+// PoliciesByPrecedence sorts policies in the order they are checked:
+// by priority, lowest first, then deny policies before allow ones, so
+// that deny overrides allow within a priority, then by ID.
+type PoliciesByPrecedence []Policy
+
+func (p PoliciesByPrecedence) Len() int      { return len(p) }
+func (p PoliciesByPrecedence) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p PoliciesByPrecedence) Less(i, j int) bool {
+	if p[i].Priority != p[j].Priority {
+		return p[i].Priority < p[j].Priority
+	}
+	if p[i].IsDeny() != p[j].IsDeny() {
+		return p[i].IsDeny()
+	}
+	return p[i].ID < p[j].ID
+}
+
+// PolicyValidationResponse lists all problems found
+// in the policy validated.
+type PolicyValidationResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// PolicyRevision is a version of a policy kept by the policy service.
+type PolicyRevision struct {
+	Revision uint64 `json:"revision"`
+	// Time the revision was stored, as Unix time.
+	Timestamp int64  `json:"timestamp"`
+	Policy    Policy `json:"policy"`
+}
+
+// PolicyChange is a difference between two revisions of a policy in
+// one of its fields, named as in JSON. For fields holding lists
+// (applied_to, peers and rules), From lists entries removed and To
+// entries added, otherwise they are the values before and after.
+type PolicyChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// PolicyDiff lists changes between two revisions of a policy.
+type PolicyDiff struct {
+	ID      uint64         `json:"id"`
+	From    uint64         `json:"from"`
+	To      uint64         `json:"to"`
+	Changes []PolicyChange `json:"changes"`
+}
+
+// PolicyRollback requests that a policy be rolled back to the revision.
+type PolicyRollback struct {
+	Revision uint64 `json:"revision"`
+}
+
+// AppliedPolicy is a revision of a policy an agent applied
+// or, if Error is set, failed to apply.
+type AppliedPolicy struct {
+	ID       uint64 `json:"id"`
+	Revision uint64 `json:"revision"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HostPolicyStatus is reported by the agent of a host to the
+// policy service whenever policies it applies change.
+type HostPolicyStatus struct {
+	Host     string          `json:"host"`
+	Ip       string          `json:"ip"`
+	Policies []AppliedPolicy `json:"policies"`
+	// Time the report was received, as Unix time.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// PolicyRollout shows which hosts have applied
+// the current revision of a policy.
+type PolicyRollout struct {
+	ID       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Revision uint64 `json:"revision"`
+	// Complete is set once all hosts have applied the revision.
+	Complete bool     `json:"complete"`
+	Applied  []string `json:"applied"`
+	// Pending lists hosts which have not reported the revision.
+	Pending []string `json:"pending,omitempty"`
+	// Failed maps hosts which failed to apply the revision to errors.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// PolicyFlow describes traffic to evaluate against the stored
+// policies: its protocol, addresses and ports, and its source and
+// destination, identified as policy endpoints are. Endpoints outside
+// of tenants, such as external networks, are identified by address.
+type PolicyFlow struct {
+	Protocol    string   `json:"protocol"`
+	SrcIP       string   `json:"src_ip,omitempty"`
+	SrcPort     uint     `json:"src_port,omitempty"`
+	DstIP       string   `json:"dst_ip,omitempty"`
+	DstPort     uint     `json:"dst_port,omitempty"`
+	IcmpType    uint     `json:"icmp_type,omitempty"`
+	IcmpCode    uint     `json:"icmp_code,omitempty"`
+	Source      Endpoint `json:"source"`
+	Destination Endpoint `json:"destination"`
+}
+
+// PolicyEvaluation is the verdict of the stored policies on a
+// PolicyFlow: PolicyActionAllow, PolicyActionDeny or PolicyVerdictNone.
+type PolicyEvaluation struct {
+	Verdict string `json:"verdict"`
+	// Policies matching the flow, in the order they are checked:
+	// an egress policy of the source, then an ingress policy
+	// of the destination.
+	Policies []Policy `json:"policies,omitempty"`
+	Reason   string   `json:"reason"`
+}
+
 // isValidProto checks if the Protocol specified in Rule is valid.
 // The following protocols are recognized:
 // - any -- see Wildcard
@@ -226,6 +662,63 @@ func isValidProto(proto string) bool {
 	return false
 }
 
+// validateCidrPeer validates the block of addresses of peer #epNo
+// and the blocks excepted from it.
+func validateCidrPeer(epNo int, endpoint Endpoint) []string {
+	var errMsg []string
+	if endpoint.Cidr == "" {
+		if len(endpoint.Except) > 0 {
+			errMsg = append(errMsg, fmt.Sprintf("peers entry #%d: 'except' requires 'cidr'.", epNo))
+		}
+		return errMsg
+	}
+	if endpoint.Peer != "" || endpoint.TenantID != 0 || endpoint.TenantName != "" ||
+		endpoint.TenantExternalID != "" || endpoint.TenantNetworkID != nil {
+		errMsg = append(errMsg, fmt.Sprintf("peers entry #%d: 'cidr' cannot be combined with peer or tenant.", epNo))
+	}
+	cidr, err := netutil.ParseCIDR(endpoint.Cidr)
+	if err != nil {
+		return append(errMsg, fmt.Sprintf("peers entry #%d: %v.", epNo, err))
+	}
+	for _, except := range endpoint.Except {
+		exceptNet, err := netutil.ParseCIDR(except)
+		if err != nil {
+			errMsg = append(errMsg, fmt.Sprintf("peers entry #%d: %v.", epNo, err))
+			continue
+		}
+		// Excepting the whole block leaves nothing to match.
+		if !netutil.Contains(cidr, exceptNet) || netutil.Size(exceptNet).Cmp(netutil.Size(cidr)) == 0 {
+			errMsg = append(errMsg, fmt.Sprintf("peers entry #%d: Excepted %s is not within %s.", epNo, except, endpoint.Cidr))
+		}
+	}
+	return errMsg
+}
+
+// validatePorts returns errors, prefixed with the prefix,
+// for ports and port ranges out of bounds.
+func validatePorts(prefix string, ports []uint, portRanges []PortRange) []string {
+	var errMsg []string
+	badRanges := make([]string, 0)
+	for _, portRange := range portRanges {
+		if portRange[0] > portRange[1] || portRange[0] < 0 || portRange[1] < 0 || portRange[0] > MaxPortNumber || portRange[1] > MaxPortNumber {
+			badRanges = append(badRanges, portRange.String())
+		}
+	}
+	if len(badRanges) > 0 {
+		errMsg = append(errMsg, fmt.Sprintf("%s: The following port ranges are invalid: %s.", prefix, strings.Join(badRanges, ", ")))
+	}
+	badPorts := make([]string, 0)
+	for _, port := range ports {
+		if port < 0 || port > MaxPortNumber {
+			badPorts = append(badPorts, fmt.Sprintf("%d", port))
+		}
+	}
+	if len(badPorts) > 0 {
+		errMsg = append(errMsg, fmt.Sprintf("%s: The following ports are invalid: %s.", prefix, strings.Join(badPorts, ", ")))
+	}
+	return errMsg
+}
+
 // validate validates Rules.
 func validateRules(rules Rules) []string {
 	errMsg := make([]string, 0)
@@ -243,33 +736,32 @@ func validateRules(rules Rules) []string {
 			errMsg = append(errMsg, fmt.Sprintf("Rule #%d: Invalid protocol: %s.", ruleNo, r.Protocol))
 		}
 		if r.Protocol == "tcp" || r.Protocol == "udp" {
-			badRanges := make([]string, 0)
-			for _, portRange := range r.PortRanges {
-				if portRange[0] > portRange[1] || portRange[0] < 0 || portRange[1] < 0 || portRange[0] > MaxPortNumber || portRange[1] > MaxPortNumber {
-					badRanges = append(badRanges, portRange.String())
+			errMsg = append(errMsg, validatePorts(fmt.Sprintf("Rule #%d", ruleNo), r.Ports, r.PortRanges)...)
+			for _, name := range r.PortLists {
+				if strings.TrimSpace(name) == "" {
+					errMsg = append(errMsg, fmt.Sprintf("Rule #%d: Empty port list name.", ruleNo))
 				}
 			}
-			if len(badRanges) > 0 {
-				errMsg = append(errMsg, fmt.Sprintf("Rule #%d: The following port ranges are invalid: %s.", ruleNo, strings.Join(badRanges, ", ")))
-			}
-			badPorts := make([]string, 0)
-			for _, port := range r.Ports {
-				if port < 0 || port > MaxPortNumber {
-					badPorts = append(badPorts, fmt.Sprintf("%d", port))
-				}
-			}
-			if len(badPorts) > 0 {
-				errMsg = append(errMsg, fmt.Sprintf("Rule #%d: The following ports are invalid: %s.", ruleNo, strings.Join(badPorts, ", ")))
-			}
 		}
 		if r.Protocol != "icmp" {
-			if r.IcmpCode > 0 || r.IcmpType > 0 {
+			if r.IcmpCode > 0 || r.IcmpType > 0 || r.IcmpTypeName != "" {
 				errMsg = append(errMsg, fmt.Sprintf("Rule #%d: ICMP protocol is not specified but ICMP Code and/or ICMP Type are also specified.", ruleNo))
 			}
 		} else {
-			if len(r.Ports) > 0 || len(r.PortRanges) > 0 {
+			if len(r.Ports) > 0 || len(r.PortRanges) > 0 || len(r.PortLists) > 0 {
 				errMsg = append(errMsg, fmt.Sprintf("Rule #%d: ICMP protocol is specified but ports are also specified.", ruleNo))
 			}
+			if r.IcmpTypeName != "" {
+				name, _, _, ok := IcmpTypeByName(r.IcmpTypeName)
+				if !ok {
+					errMsg = append(errMsg, fmt.Sprintf("Rule #%d: Invalid ICMP type name: %s.", ruleNo, r.IcmpTypeName))
+				} else if r.IcmpType > 0 || r.IcmpCode > 0 {
+					errMsg = append(errMsg, fmt.Sprintf("Rule #%d: ICMP type name cannot be combined with ICMP Code or ICMP Type.", ruleNo))
+				} else {
+					rules[i].IcmpTypeName = name
+				}
+				continue
+			}
 			if r.IcmpType < 0 || r.IcmpType > MaxIcmpType {
 				errMsg = append(errMsg, fmt.Sprintf("Rule #%d: Invalid ICMP type: %d.", ruleNo, r.IcmpType))
 			}
@@ -353,6 +845,7 @@ func (p *Policy) Validate() error {
 		if endpoint.Peer != "" && endpoint.Peer != Wildcard {
 			errMsg = append(errMsg, fmt.Sprintf("peers entry #%d: Invalid value for Any: '%s', only '' and %s allowed.", epNo, endpoint.Peer, Wildcard))
 		}
+		errMsg = append(errMsg, validateCidrPeer(epNo, endpoint)...)
 		if endpoint.SegmentID != 0 || endpoint.SegmentExternalID != "" {
 			if endpoint.TenantExternalID == "" &&
 				endpoint.TenantID == 0 &&
@@ -367,7 +860,16 @@ func (p *Policy) Validate() error {
 		}
 	}
 
-	// 5. Validate name/external ID
+	// 5. Validate action
+	p.Action = strings.TrimSpace(strings.ToLower(p.Action))
+	if p.Action != "" && p.Action != PolicyActionAllow && p.Action != PolicyActionDeny {
+		errMsg = append(errMsg, fmt.Sprintf("Unknown action '%s', allowed '%s' or '%s'.", p.Action, PolicyActionAllow, PolicyActionDeny))
+	}
+	if p.Priority < 0 {
+		errMsg = append(errMsg, fmt.Sprintf("Invalid priority %d, must not be negative.", p.Priority))
+	}
+
+	// 6. Validate name/external ID
 	// TODO add test
 	if p.Name == "" && p.ExternalID == "" {
 		errMsg = append(errMsg, "At least one of name, external_id must be specified.")
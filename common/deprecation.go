@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Deprecation of routes. A route that is to be removed is marked as
+//
+//   Route{
+//     Method:  "GET",
+//     Pattern: "/hostsByName/{name}",
+//     Handler: ...,
+//     Deprecation: &Deprecation{
+//       Since:       time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+//       Sunset:      time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+//       Replacement: "/hosts?name={name}",
+//     },
+//   }
+//
+// Responses of such a route carry the Deprecation header (see RFC 9745),
+// the Sunset header (RFC 8594) if it is given and a Link to the
+// replacement, so that clients can tell they should move on. Requests
+// to deprecated routes are counted in the
+// romana_deprecated_requests_total metric, served at MetricsPath by
+// services having such routes, so that operators can tell when no
+// client uses a route anymore and it is safe to remove.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Deprecation describes a deprecated route.
+type Deprecation struct {
+	// Since is when the route was deprecated, if known.
+	Since time.Time
+	// Sunset is when the route is going to be removed, if known.
+	Sunset time.Time
+	// Replacement is the URL of what to use instead, if anything.
+	Replacement string
+}
+
+// setHeaders sets the headers announcing the deprecation
+// in the response.
+func (d Deprecation) setHeaders(header http.Header) {
+	if d.Since.IsZero() {
+		header.Set("Deprecation", "true")
+	} else {
+		header.Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+	}
+	if !d.Sunset.IsZero() {
+		header.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Replacement != "" {
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, d.Replacement))
+	}
+}
+
+// frameworkMetrics are metrics kept for all services,
+// served along with those of the service (see Metrics.Route).
+var frameworkMetrics = NewMetrics()
+
+// deprecatedRequests counts requests to deprecated routes. It is only
+// added to frameworkMetrics once a service has deprecated routes.
+var deprecatedRequests struct {
+	sync.Once
+	*Counter
+}
+
+// trackDeprecation returns the routes with handlers of deprecated
+// ones wrapped to count requests to them and, if there are any and
+// the service does not serve metrics, the MetricsPath route added.
+func trackDeprecation(service Service, routes Routes) Routes {
+	retval := make(Routes, 0, len(routes)+1)
+	deprecated := false
+	hasMetrics := false
+	for _, route := range routes {
+		if route.Pattern == MetricsPath && route.Method == "GET" {
+			hasMetrics = true
+		}
+		if route.Deprecation != nil {
+			deprecated = true
+			deprecatedRequests.Do(func() {
+				deprecatedRequests.Counter = frameworkMetrics.NewCounter("romana_deprecated_requests_total",
+					"Requests to deprecated routes.", "service", "method", "route")
+			})
+			log.Printf("%s: Route %s %s is deprecated (sunset: %v, replacement: %s)", service.Name(), route.Method, route.Pattern, route.Deprecation.Sunset, route.Deprecation.Replacement)
+			route.Handler = countDeprecated(service.Name(), route.Method, route.Pattern, route.Handler)
+		}
+		retval = append(retval, route)
+	}
+	if deprecated && !hasMetrics {
+		retval = append(retval, NewMetrics().Route())
+	}
+	return retval
+}
+
+// countDeprecated wraps the handler of a deprecated route
+// to count requests to it.
+func countDeprecated(service string, method string, pattern string, handler RestHandler) RestHandler {
+	return func(input interface{}, ctx RestContext) (interface{}, error) {
+		deprecatedRequests.Inc(service, method, pattern)
+		return handler(input, ctx)
+	}
+}
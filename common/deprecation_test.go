@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeprecation tests headers of responses of deprecated
+// routes and counting of requests to them.
+func TestDeprecation(t *testing.T) {
+	handler := func(input interface{}, ctx RestContext) (interface{}, error) {
+		return "ok", nil
+	}
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	routes := trackDeprecation(&timeoutService{}, Routes{
+		Route{Method: "GET", Pattern: "/new", Handler: handler},
+		Route{Method: "GET", Pattern: "/old", Handler: handler, Deprecation: &Deprecation{
+			Since:       time.Unix(1700000000, 0),
+			Sunset:      sunset,
+			Replacement: "/new",
+		}},
+	})
+	if len(routes) != 3 || routes[2].Pattern != MetricsPath {
+		t.Fatalf("Expected metrics route to be added, got %v", routes)
+	}
+	router := newRouter(routes)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect(t, resp.Header.Get("Deprecation"), "")
+	for i := 0; i < 2; i++ {
+		resp, err = http.Get(server.URL + "/old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expect(t, resp.StatusCode, http.StatusOK)
+	expect(t, resp.Header.Get("Deprecation"), "@1700000000")
+	expect(t, resp.Header.Get("Sunset"), "Tue, 01 Jan 2030 00:00:00 GMT")
+	expect(t, resp.Header.Get("Link"), `</new>; rel="successor-version"`)
+
+	resp, err = http.Get(server.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `romana_deprecated_requests_total{service="mock",method="GET",route="/old"} 2`) {
+		t.Errorf("Expected requests to /old to be counted, got\n%s", body)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Runtime diagnostics of services: profiles of net/http/pprof under
+// /debug/pprof/ and variables of expvar, such as memstats, at
+// /debug/vars. They are served, if the api section of a service sets
+// an address for them,
+//
+//   api:
+//     host: 192.168.0.10
+//     port: 9600
+//     diagnostics: 127.0.0.1:6060
+//
+// on a listener of their own, without the timeouts of REST requests,
+// so that a CPU profile can be collected with
+//
+//   go tool pprof http://127.0.0.1:6060/debug/pprof/profile?seconds=30
+//
+// Requests need a token of root as other requests if auth_public is set.
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/codegangsta/negroni"
+)
+
+// Paths of diagnostics.
+const (
+	PprofPath  = "/debug/pprof/"
+	ExpvarPath = "/debug/vars"
+)
+
+// diagnosticsHandler returns the handler of diagnostics.
+func diagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	// Index also serves named profiles, such as /debug/pprof/heap.
+	mux.HandleFunc(PprofPath, pprof.Index)
+	mux.HandleFunc(PprofPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(PprofPath+"profile", pprof.Profile)
+	mux.HandleFunc(PprofPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(PprofPath+"trace", pprof.Trace)
+	mux.HandleFunc(ExpvarPath, writeExpvars)
+	return mux
+}
+
+// writeExpvars writes all expvar variables as a JSON object.
+func writeExpvars(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(writer, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(writer, ",\n")
+		}
+		first = false
+		fmt.Fprintf(writer, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(writer, "\n}\n")
+}
+
+// serveDiagnostics serves diagnostics at the address, checking tokens
+// with the public key if there is one, and returns the address
+// listened on.
+func serveDiagnostics(addr string, publicKey []byte) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	n := negroni.New()
+	// AuthMiddleware writes errors in the negotiated content type.
+	n.Use(NewNegotiator())
+	n.Use(AuthMiddleware{PublicKey: publicKey})
+	n.UseHandler(diagnosticsHandler())
+	svr := &http.Server{Handler: n}
+	go func() {
+		if err := svr.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)}); err != nil {
+			log.Printf("Diagnostics at %s stopped: %v", ln.Addr(), err)
+		}
+	}()
+	return ln.Addr().String(), nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDiagnostics tests serving of profiles and expvar variables.
+func TestDiagnostics(t *testing.T) {
+	addr, err := serveDiagnostics("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		ExpvarPath:                      `"memstats"`,
+		PprofPath + "goroutine?debug=1": "goroutine profile",
+		PprofPath + "cmdline":           os.Args[0],
+		PprofPath + "profile?seconds=1": "",
+	} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), expected) {
+			t.Errorf("%s: expected 200 with %s, got %d %s", path, expected, resp.StatusCode, body)
+		}
+	}
+
+	publicKey, err := ioutil.ReadFile("testdata/demo.rsa.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err = serveDiagnostics("127.0.0.1:0", publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr + ExpvarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect(t, resp.StatusCode, http.StatusForbidden)
+
+	parsed, err := ParseConfig([]byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n      diagnostics: 127.0.0.1:9700\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, parsed.Services["root"].Common.Api.Diagnostics, "127.0.0.1:9700")
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Leader election among replicas of a service, through leases on the
+// root service (see Lease). A replica that acquires the lease leads
+// until it fails to renew it, such as when root cannot be reached,
+// in which case it stops leading before the lease can expire and
+// another replica acquire it.
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LeaderElection campaigns for a lease on behalf of a replica.
+type LeaderElection struct {
+	client *RestClient
+	name   string
+	id     string
+	ttl    time.Duration
+
+	mu sync.Mutex
+	// Data to record in the lease on the next renewal,
+	// nil when not leading.
+	data map[string]string
+}
+
+// NewLeaderElection returns a LeaderElection for the named lease,
+// held by the replica identified by id for ttl unless renewed.
+func NewLeaderElection(client *RestClient, name string, id string, ttl time.Duration) *LeaderElection {
+	return &LeaderElection{client: client, name: name, id: id, ttl: ttl}
+}
+
+// ID returns the identity of the replica.
+func (le *LeaderElection) ID() string {
+	return le.id
+}
+
+// SetData sets the data to record in the lease while leading,
+// which the next leader receives when it starts leading.
+func (le *LeaderElection) SetData(data map[string]string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.data != nil {
+		le.data = data
+	}
+}
+
+func (le *LeaderElection) lease(data map[string]string) Lease {
+	return Lease{Name: le.name, Holder: le.id, TTL: int64(le.ttl / time.Second), Data: data}
+}
+
+// Run campaigns for the lease until done is closed. While the lease is
+// held, it runs lead, with the data recorded in the lease by the
+// previous leader, until stop is closed because the lease was lost or
+// done was closed. lead must return after stop is closed. When done is
+// closed while leading, the lease is released after lead returns, so
+// that another replica can take over right away.
+func (le *LeaderElection) Run(done <-chan struct{}, lead func(data map[string]string, stop <-chan struct{})) {
+	// Renew well before the lease expires.
+	interval := le.ttl / 3
+	for {
+		lease, err := le.client.AcquireLease(le.lease(nil))
+		if err == nil {
+			log.Printf("LeaderElection: %s is the leader for %s", le.id, le.name)
+			if !le.leadTerm(lease.Data, interval, done, lead) {
+				return
+			}
+		} else if httpErr, ok := err.(HttpError); !ok || httpErr.StatusCode != http.StatusConflict {
+			log.Printf("LeaderElection: cannot acquire lease %s: %s", le.name, err)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// leadTerm runs lead while the lease is renewed. It returns false
+// if done was closed, after releasing the lease.
+func (le *LeaderElection) leadTerm(data map[string]string, interval time.Duration, done <-chan struct{}, lead func(map[string]string, <-chan struct{})) bool {
+	le.mu.Lock()
+	le.data = data
+	if le.data == nil {
+		le.data = make(map[string]string)
+	}
+	le.mu.Unlock()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		lead(data, stop)
+	}()
+
+	finished := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !finished {
+		select {
+		case <-done:
+			finished = true
+		case <-stopped:
+			log.Printf("LeaderElection: %s stopped leading %s", le.id, le.name)
+			finished = true
+		case <-ticker.C:
+			le.mu.Lock()
+			lease := le.lease(le.data)
+			le.mu.Unlock()
+			_, err := le.client.AcquireLease(lease)
+			if err != nil {
+				log.Printf("LeaderElection: %s lost lease %s: %s", le.id, le.name, err)
+				close(stop)
+				<-stopped
+				le.mu.Lock()
+				le.data = nil
+				le.mu.Unlock()
+				return true
+			}
+		}
+	}
+	close(stop)
+	<-stopped
+	le.mu.Lock()
+	lease := le.lease(le.data)
+	le.data = nil
+	le.mu.Unlock()
+	err := le.client.ReleaseLease(lease)
+	if err != nil {
+		log.Printf("LeaderElection: %s cannot release lease %s: %s", le.id, le.name, err)
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Optional encryption of sensitive fields, such as request
+// tokens, in the database. It is enabled in the "store" section with
+// a base64-encoded key of 16, 24 or 32 bytes (for AES-128, AES-192 or
+// AES-256), best given as a reference to a secret (see secrets.go):
+//
+//   "store": {
+//     "type": "mysql",
+//     ...
+//     "encryption_key": "secret:file:/etc/romana/store.key"
+//   }
+//
+// string and sql.NullString fields tagged `romana:"encrypted"` of
+// records created or saved through gorm are then kept encrypted with
+// AES-GCM, and decrypted as they are read. Values stored before are
+// read as they are, and encrypted when next saved. Values given to
+// Update, Updates or Where are not encrypted, so encrypted fields
+// cannot be compared by the database. Passwords are not tagged: they
+// are kept hashed, since encryption, unlike hashing, can be undone.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// encryptedPrefix starts encrypted values, followed by
+// the nonce and the sealed value, base64 encoded.
+const encryptedPrefix = "enc:1:"
+
+// fieldEncryption encrypts and decrypts tagged fields.
+type fieldEncryption struct {
+	aead cipher.AEAD
+}
+
+// parseFieldEncryption parses encryption_key of the store
+// configuration, returning nil if it is not set.
+func parseFieldEncryption(storeConfig map[string]interface{}) (*fieldEncryption, error) {
+	value, ok := storeConfig["encryption_key"]
+	if !ok {
+		return nil, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid encryption_key %v", value))
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("encryption_key is not base64 encoded: %s", err))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid encryption_key: %s", err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldEncryption{aead: aead}, nil
+}
+
+// encrypt encrypts the value of the column. The column is
+// authenticated along with it, so that encrypted values
+// cannot be moved to other columns.
+func (e *fieldEncryption) encrypt(column string, value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(value), []byte(column))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts the value of the column,
+// if it is encrypted.
+func (e *fieldEncryption) decrypt(column string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < e.aead.NonceSize() {
+		return "", errors.New(fmt.Sprintf("Invalid encrypted value of %s", column))
+	}
+	nonce := sealed[:e.aead.NonceSize()]
+	plain, err := e.aead.Open(nil, nonce, sealed[len(nonce):], []byte(column))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Cannot decrypt value of %s: %s", column, err))
+	}
+	return string(plain), nil
+}
+
+// register makes the database encrypt tagged fields of records
+// before they are written, and decrypt them after they are
+// written or read.
+func (e *fieldEncryption) register(db *gorm.DB) {
+	encrypt := func(scope *gorm.Scope) {
+		e.apply(scope, e.encrypt)
+	}
+	decrypt := func(scope *gorm.Scope) {
+		e.apply(scope, e.decrypt)
+	}
+	db.Callback().Create().Before("gorm:create").Register("romana:encrypt", encrypt)
+	db.Callback().Create().After("gorm:create").Register("romana:decrypt", decrypt)
+	db.Callback().Update().Before("gorm:update").Register("romana:encrypt", encrypt)
+	db.Callback().Update().After("gorm:update").Register("romana:decrypt", decrypt)
+	db.Callback().Query().After("gorm:query").Register("romana:decrypt", decrypt)
+}
+
+// apply replaces values of tagged fields of the record, or
+// records, of the scope with what f returns for them. Records
+// that cannot be changed in place (those passed by value to
+// Model) are left alone.
+func (e *fieldEncryption) apply(scope *gorm.Scope, f func(column string, value string) (string, error)) {
+	value := scope.IndirectValue()
+	switch value.Kind() {
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			record := value.Index(i)
+			if record.Kind() == reflect.Ptr {
+				if record.IsNil() {
+					continue
+				}
+				record = record.Elem()
+			}
+			if record.Kind() == reflect.Struct && record.CanAddr() {
+				applyFields(scope, scope.New(record.Addr().Interface()), f)
+			}
+		}
+	case reflect.Struct:
+		if value.CanAddr() {
+			applyFields(scope, scope, f)
+		}
+	}
+}
+
+// applyFields replaces values of tagged fields of the record. Errors
+// are added to the scope, failing the statement.
+func applyFields(scope *gorm.Scope, record *gorm.Scope, f func(column string, value string) (string, error)) {
+	table := record.TableName()
+	for _, field := range record.Fields() {
+		if field.Tag.Get("romana") != "encrypted" {
+			continue
+		}
+		column := table + "." + field.DBName
+		switch value := field.Field.Interface().(type) {
+		case string:
+			s, err := f(column, value)
+			if err != nil {
+				scope.Err(err)
+				return
+			}
+			field.Field.SetString(s)
+		case sql.NullString:
+			if !value.Valid {
+				continue
+			}
+			s, err := f(column, value.String)
+			if err != nil {
+				scope.Err(err)
+				return
+			}
+			field.Field.Set(reflect.ValueOf(sql.NullString{String: s, Valid: true}))
+		}
+	}
+}
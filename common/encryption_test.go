@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type secretRecord struct {
+	ID     uint64 `sql:"AUTO_INCREMENT"`
+	Name   string
+	Secret string         `romana:"encrypted"`
+	Token  sql.NullString `romana:"encrypted"`
+}
+
+// TestFieldEncryption tests that tagged fields are kept
+// encrypted in the database and decrypted as read.
+func TestFieldEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	connect := func(config map[string]interface{}) *DbStore {
+		config["type"] = "sqlite3"
+		config["database"] = dir + "/encryption.sqlite3"
+		store := &DbStore{}
+		if err := store.SetConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	store := connect(map[string]interface{}{"encryption_key": key})
+	if !store.IsEncrypted() {
+		t.Fatal("Expected store to be encrypted")
+	}
+	store.Db.CreateTable(&secretRecord{})
+
+	record := secretRecord{Name: "a", Secret: "password", Token: sql.NullString{String: "token", Valid: true}}
+	if err := store.Db.Create(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if record.Secret != "password" || record.Token.String != "token" {
+		t.Errorf("Expected record created to be left decrypted, got %+v", record)
+	}
+	// Stored before encryption was enabled.
+	store.Db.Exec("INSERT INTO secret_records (name, secret) VALUES ('b', 'plain')")
+	raw := func() []string {
+		var values []string
+		rows, err := store.Db.DB().Query("SELECT secret, COALESCE(token, '') FROM secret_records ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var secret, token string
+			rows.Scan(&secret, &token)
+			values = append(values, secret, token)
+		}
+		return values
+	}
+	values := raw()
+	if !strings.HasPrefix(values[0], encryptedPrefix) || !strings.HasPrefix(values[1], encryptedPrefix) || strings.Contains(values[0]+values[1], "password") {
+		t.Errorf("Expected encrypted values, got %v", values)
+	}
+	expect(t, values[2], "plain")
+
+	var records []secretRecord
+	if err := store.Db.Order("id").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Secret != "password" || records[0].Token.String != "token" || records[1].Secret != "plain" {
+		t.Errorf("Unexpected records read %+v", records)
+	}
+	records[1].Secret = "changed"
+	if err := store.Db.Save(&records[1]).Error; err != nil {
+		t.Fatal(err)
+	}
+	expect(t, records[1].Secret, "changed")
+	if values = raw(); !strings.HasPrefix(values[2], encryptedPrefix) {
+		t.Errorf("Expected value saved encrypted, got %s", values[2])
+	}
+	found := secretRecord{}
+	store.Db.Where("name = ?", "b").First(&found)
+	expect(t, found.Secret, "changed")
+
+	// Encrypted values cannot be moved to other records' columns,
+	// or read with another key.
+	store.Db.Exec("UPDATE secret_records SET token = secret WHERE name = 'b'")
+	if err := store.Db.Where("name = ?", "b").First(&found).Error; err == nil {
+		t.Errorf("Expected error decrypting value moved to another column, got %+v", found)
+	}
+	other := connect(map[string]interface{}{"encryption_key": base64.StdEncoding.EncodeToString(make([]byte, 16))})
+	if err := other.Db.Where("name = ?", "a").First(&found).Error; err == nil {
+		t.Errorf("Expected error decrypting with another key, got %+v", found)
+	}
+
+	for _, invalid := range []interface{}{"not base64!", base64.StdEncoding.EncodeToString([]byte("short")), float64(1)} {
+		if _, err := parseFieldEncryption(map[string]interface{}{"encryption_key": invalid}); err == nil {
+			t.Errorf("Expected error for encryption_key %v", invalid)
+		}
+	}
+}
@@ -56,6 +56,12 @@ const (
 	// 422 (unprocessable entity http://www.restpatterns.org/HTTP_Status_Codes/422_-_Unprocessable_Entity)
 	// is not in net/http yet.
 	StatusUnprocessableEntity = 422
+	// 428 (precondition required, RFC 6585) is returned for updates
+	// that do not say which version of the object they change.
+	StatusPreconditionRequired = 428
+	// 429 (too many requests, RFC 6585) is returned to tenants
+	// over the rate limit of a service (see RateLimiter).
+	StatusTooManyRequests = 429
 )
 
 type ExecErrorDetails struct {
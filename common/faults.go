@@ -0,0 +1,205 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Optional injection of faults, to exercise how services and their
+// clients cope with failures, e.g. retries and reconciliation, in
+// tests. Faults of the REST layer are configured per service in a
+// "faults" section:
+//
+//   "faults": {
+//     "response_delay_millis": 200,
+//     "fail_routes": ["POST /tenants", "/hosts/{hostId}"]
+//   }
+//
+// Every response is delayed by response_delay_millis, and requests to
+// the listed routes, given by pattern and, optionally, method, fail
+// with 500. Faults of the database are configured in a "faults"
+// section of the "store" section:
+//
+//   "store": {
+//     "type": "sqlite3",
+//     "database": "/var/tmp/tenant.sqlite3",
+//     "faults": {
+//       "write_failure_percent": 50,
+//       "seed": 1
+//     }
+//   }
+//
+// That many percent of creates, updates and deletes made through
+// gorm fail without reaching the database; raw statements are not
+// affected. Which ones fail is decided by a random number generator
+// seeded with seed (1 by default), so that a test sees the same
+// failures every time it runs.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// InjectedFaultMessage is the message of errors of
+// operations failed on purpose.
+const InjectedFaultMessage = "Injected fault"
+
+// restFaults are faults injected into handling of REST requests.
+type restFaults struct {
+	delay time.Duration
+	// Routes to fail, as "METHOD pattern" or just pattern.
+	failRoutes []string
+}
+
+// parseRestFaults parses the "faults" section of the service-specific
+// configuration, returning nil if there is none.
+func parseRestFaults(serviceSpecific map[string]interface{}) (*restFaults, error) {
+	faultsConfig, err := faultsSection(serviceSpecific, "response_delay_millis", "fail_routes")
+	if faultsConfig == nil || err != nil {
+		return nil, err
+	}
+	faults := &restFaults{}
+	if delay, ok := faultsConfig["response_delay_millis"]; ok {
+		millis, ok := delay.(float64)
+		if !ok || millis < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid response_delay_millis %v", delay))
+		}
+		faults.delay = time.Duration(millis) * time.Millisecond
+	}
+	if routes, ok := faultsConfig["fail_routes"]; ok {
+		list, ok := routes.([]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid fail_routes %v", routes))
+		}
+		for _, route := range list {
+			s, _ := route.(string)
+			fields := strings.Fields(s)
+			if len(fields) == 0 || len(fields) > 2 {
+				return nil, errors.New(fmt.Sprintf("Invalid route %v in fail_routes", route))
+			}
+			if len(fields) == 2 {
+				fields[0] = strings.ToUpper(fields[0])
+			}
+			faults.failRoutes = append(faults.failRoutes, strings.Join(fields, " "))
+		}
+	}
+	return faults, nil
+}
+
+// fails returns true if requests to the route are to fail.
+func (f *restFaults) fails(route Route) bool {
+	for _, failRoute := range f.failRoutes {
+		if failRoute == route.Pattern || failRoute == strings.ToUpper(route.Method)+" "+route.Pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns the routes with handlers wrapped to inject the faults.
+func (f *restFaults) wrap(routes Routes) Routes {
+	retval := make(Routes, len(routes))
+	for i, route := range routes {
+		handler, fail := route.Handler, f.fails(route)
+		route.Handler = func(input interface{}, ctx RestContext) (interface{}, error) {
+			time.Sleep(f.delay)
+			if fail {
+				return nil, NewError500(InjectedFaultMessage)
+			}
+			return handler(input, ctx)
+		}
+		retval[i] = route
+	}
+	return retval
+}
+
+// storeFaults are faults injected into writes to the database.
+type storeFaults struct {
+	writeFailurePercent float64
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// parseStoreFaults parses the "faults" section of the
+// store configuration, returning nil if there is none.
+func parseStoreFaults(storeConfig map[string]interface{}) (*storeFaults, error) {
+	faultsConfig, err := faultsSection(storeConfig, "write_failure_percent", "seed")
+	if faultsConfig == nil || err != nil {
+		return nil, err
+	}
+	faults := &storeFaults{}
+	if percent, ok := faultsConfig["write_failure_percent"]; ok {
+		faults.writeFailurePercent, ok = percent.(float64)
+		if !ok || faults.writeFailurePercent < 0 || faults.writeFailurePercent > 100 {
+			return nil, errors.New(fmt.Sprintf("Invalid write_failure_percent %v", percent))
+		}
+	}
+	seed := float64(1)
+	if s, ok := faultsConfig["seed"]; ok {
+		if seed, ok = s.(float64); !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid seed %v", s))
+		}
+	}
+	faults.random = rand.New(rand.NewSource(int64(seed)))
+	return faults, nil
+}
+
+// failWrite decides whether the next write is to fail.
+func (f *storeFaults) failWrite() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.random.Float64()*100 < f.writeFailurePercent
+}
+
+// register makes the database fail writes
+// before gorm makes them.
+func (f *storeFaults) register(db *gorm.DB) {
+	inject := func(scope *gorm.Scope) {
+		if f.failWrite() {
+			scope.Err(NewError500(InjectedFaultMessage))
+		}
+	}
+	db.Callback().Create().Before("gorm:create").Register("romana:faults", inject)
+	db.Callback().Update().Before("gorm:update").Register("romana:faults", inject)
+	db.Callback().Delete().Before("gorm:delete").Register("romana:faults", inject)
+}
+
+// faultsSection returns the "faults" section of the configuration
+// map, or nil if there is none, checking it has only the keys given.
+func faultsSection(configMap map[string]interface{}, keys ...string) (map[string]interface{}, error) {
+	section, ok := configMap["faults"]
+	if !ok {
+		return nil, nil
+	}
+	faultsConfig, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid faults configuration %v", section))
+	}
+	for key := range faultsConfig {
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, errors.New(fmt.Sprintf("Unknown fault %s, expected one of %s", key, strings.Join(keys, ", ")))
+		}
+	}
+	return faultsConfig, nil
+}
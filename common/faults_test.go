@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type faultRecord struct {
+	ID   uint64 `sql:"AUTO_INCREMENT"`
+	Name string
+}
+
+// TestFaults tests injection of faults into REST
+// handlers and database writes.
+func TestFaults(t *testing.T) {
+	for _, invalid := range []map[string]interface{}{
+		{"faults": "yes"},
+		{"faults": map[string]interface{}{"write_failure_percent": float64(10)}},
+		{"faults": map[string]interface{}{"response_delay_millis": float64(-1)}},
+		{"faults": map[string]interface{}{"fail_routes": []interface{}{"GET /a b"}}},
+	} {
+		if _, err := parseRestFaults(invalid); err == nil {
+			t.Errorf("Expected error for %v", invalid)
+		}
+	}
+	faults, err := parseRestFaults(map[string]interface{}{
+		"faults": map[string]interface{}{
+			"response_delay_millis": float64(10),
+			"fail_routes":           []interface{}{"post  /tenants", "/hosts"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := func(input interface{}, ctx RestContext) (interface{}, error) {
+		return "ok", nil
+	}
+	routes := faults.wrap(Routes{
+		Route{Method: "POST", Pattern: "/tenants", Handler: ok},
+		Route{Method: "GET", Pattern: "/tenants", Handler: ok},
+		Route{Method: "DELETE", Pattern: "/hosts", Handler: ok},
+	})
+	for i, fail := range []bool{true, false, true} {
+		start := time.Now()
+		out, err := routes[i].Handler(nil, RestContext{})
+		if time.Since(start) < 10*time.Millisecond {
+			t.Errorf("Expected %s %s to be delayed", routes[i].Method, routes[i].Pattern)
+		}
+		if !fail {
+			expect(t, out, "ok")
+		} else if httpErr, ok := err.(HttpError); !ok || httpErr.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected %s %s to fail with 500, got %v", routes[i].Method, routes[i].Pattern, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Writes fail in the same order with the same seed.
+	var failures []string
+	for run := 0; run < 2; run++ {
+		store := &DbStore{}
+		err = store.SetConfig(map[string]interface{}{
+			"type":     "sqlite3",
+			"database": fmt.Sprintf("%s/faults%d.sqlite3", dir, run),
+			"faults":   map[string]interface{}{"write_failure_percent": float64(50), "seed": float64(7)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		store.Db.CreateTable(&faultRecord{})
+		var failed []string
+		for i := 0; i < 20; i++ {
+			if store.Db.Create(&faultRecord{Name: fmt.Sprint(i)}).Error != nil {
+				failed = append(failed, fmt.Sprint(i))
+			}
+		}
+		var records []faultRecord
+		store.Db.Find(&records)
+		if len(failed) == 0 || len(failed) == 20 || len(records) != 20-len(failed) {
+			t.Errorf("Expected some of 20 writes to fail, %d failed and %d made", len(failed), len(records))
+		}
+		failures = append(failures, strings.Join(failed, " "))
+	}
+	expect(t, failures[1], failures[0])
+	if _, err := parseStoreFaults(map[string]interface{}{"faults": map[string]interface{}{"write_failure_percent": float64(101)}}); err == nil {
+		t.Errorf("Expected error for write_failure_percent over 100")
+	}
+}
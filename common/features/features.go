@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package features keeps the feature flags of the services running in
+// the process, by service name, since romanad --all runs all services
+// in one process. Risky new behavior is shipped disabled behind a
+// flag, checked as in
+//
+//	if features.Enabled("agent", "nftables") {
+//	    ...
+//	}
+//
+// and enabled per deployment in the features section of the
+// configuration of the service:
+//
+//	services:
+//	  - service: agent
+//	    features:
+//	      nftables: true
+//
+// Flags not in the configuration are disabled. The flags enabled
+// are reported in the health of the service.
+package features
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var (
+	mu sync.RWMutex
+	// Flags as configured by service, including disabled ones.
+	flags = make(map[string]map[string]bool)
+)
+
+// validName matches names of flags.
+var validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ValidName returns true if name is a valid name of a flag: lowercase
+// letters, digits and underscores, starting with a letter.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Set replaces the flags of the service with those given.
+func Set(service string, newFlags map[string]bool) {
+	copied := make(map[string]bool, len(newFlags))
+	for name, enabled := range newFlags {
+		copied[name] = enabled
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	flags[service] = copied
+}
+
+// Enabled returns true if the flag is enabled for the service.
+func Enabled(service string, name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return flags[service][name]
+}
+
+// List returns the names of flags enabled for the service, sorted.
+func List(service string) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var names []string
+	for name, enabled := range flags[service] {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
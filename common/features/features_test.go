@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package features
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	configured := map[string]bool{"nftables": true, "push_events": false, "bitmap_allocator": true}
+	Set("agent", configured)
+	// Later changes to the configuration do not change the flags.
+	configured["push_events"] = true
+	if !Enabled("agent", "nftables") || Enabled("agent", "push_events") || Enabled("agent", "unknown") {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+	if enabled := List("agent"); !reflect.DeepEqual(enabled, []string{"bitmap_allocator", "nftables"}) {
+		t.Errorf("Unexpected enabled flags %v", enabled)
+	}
+
+	// Services in the same process have flags of their own.
+	Set("ipam", map[string]bool{"push_events": true})
+	if Enabled("agent", "push_events") || !Enabled("ipam", "push_events") || Enabled("topology", "push_events") {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+	if enabled := List("agent"); len(enabled) != 2 {
+		t.Errorf("Expected flags of agent to be kept, got %v", enabled)
+	}
+	Set("agent", nil)
+	if Enabled("agent", "nftables") || len(List("agent")) != 0 {
+		t.Errorf("Expected no flags enabled, got %v", List("agent"))
+	}
+
+	for name, valid := range map[string]bool{"nftables": true, "push_events2": true, "": false, "Push": false, "2fast": false, "a-b": false} {
+		if ValidName(name) != valid {
+			t.Errorf("Expected ValidName(%q) to be %t", name, valid)
+		}
+	}
+}
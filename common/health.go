@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Health of running services, reported by every service at
+// HealthPath and aggregated by the root service at StatusPath.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/romana/core/common/features"
+)
+
+// HealthChecker may be implemented by a Service that uses a database
+// (or another backend), so that its health is reported at HealthPath.
+type HealthChecker interface {
+	// CheckHealth returns an error if the backend is not usable.
+	CheckHealth() error
+}
+
+// serviceHealth tracks health of one running service.
+type serviceHealth struct {
+	sync.Mutex
+	service     Service
+	started     time.Time
+	lastError   string
+	lastErrorAt time.Time
+	// Maintenance jobs of the service, see maintenance.go.
+	maintenance []*scheduledJob
+	// Address the service is served at, once it is
+	// (see systemd.go).
+	addr string
+}
+
+// Health of services started in this process by InitializeService.
+var runningServices = struct {
+	sync.Mutex
+	health map[Service]*serviceHealth
+}{health: make(map[Service]*serviceHealth)}
+
+// trackHealth starts tracking health of the service, and returns its
+// routes with the HealthPath route added (unless the service provides
+// its own) and handlers wrapped to record errors.
+func trackHealth(service Service, routes Routes) Routes {
+	h := &serviceHealth{service: service, started: time.Now()}
+	runningServices.Lock()
+	runningServices.health[service] = h
+	runningServices.Unlock()
+
+	retval := make(Routes, 0, len(routes)+1)
+	hasHealth := false
+	for _, route := range routes {
+		if route.Pattern == HealthPath && route.Method == "GET" {
+			hasHealth = true
+		}
+		route.Handler = h.recordErrors(route.Handler)
+		retval = append(retval, route)
+	}
+	if !hasHealth {
+		retval = append(retval, Route{
+			Method:  "GET",
+			Pattern: HealthPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				return h.report(), nil
+			},
+		})
+	}
+	return retval
+}
+
+// recordErrors wraps the handler to remember the last server-side
+// error it returned. Client errors (4xx) do not say anything about
+// health of the service and are not recorded.
+func (h *serviceHealth) recordErrors(handler RestHandler) RestHandler {
+	return func(input interface{}, ctx RestContext) (interface{}, error) {
+		result, err := handler(input, ctx)
+		if err != nil {
+			if httpErr, ok := err.(HttpError); !ok || httpErr.StatusCode >= 500 {
+				h.Lock()
+				h.lastError = err.Error()
+				h.lastErrorAt = time.Now()
+				h.Unlock()
+			}
+		}
+		return result, err
+	}
+}
+
+// report returns the current health of the service.
+func (h *serviceHealth) report() ServiceHealth {
+	retval := ServiceHealth{
+		Service: h.service.Name(),
+		Version: buildInfo,
+		Uptime:  int64(time.Now().Sub(h.started).Seconds()),
+	}
+	retval.Features = features.List(h.service.Name())
+	if checker, ok := h.service.(HealthChecker); ok {
+		retval.Database = HealthOK
+		if err := checker.CheckHealth(); err != nil {
+			retval.Database = err.Error()
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	retval.LastError = h.lastError
+	if h.lastError != "" {
+		retval.LastErrorAt = h.lastErrorAt.Unix()
+	}
+	for _, job := range h.maintenance {
+		retval.Maintenance = append(retval.Maintenance, job.status)
+	}
+	return retval
+}
+
+// GetServiceHealth returns health of the service started in this
+// process by InitializeService. The second value is false if the
+// service was not started.
+func GetServiceHealth(service Service) (ServiceHealth, bool) {
+	runningServices.Lock()
+	h, ok := runningServices.health[service]
+	runningServices.Unlock()
+	if !ok {
+		return ServiceHealth{}, false
+	}
+	return h.report(), true
+}
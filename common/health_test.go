@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// TestHealth tests health reported by services.
+func TestHealth(t *testing.T) {
+	svc := &timeoutService{}
+	routes := Routes{
+		Route{
+			Method:  "GET",
+			Pattern: "/fail",
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				if ctx.QueryVariables.Get("client") != "" {
+					return nil, NewError400("bad request")
+				}
+				return nil, errors.New("server failure")
+			},
+		},
+	}
+	routes = trackHealth(svc, routes)
+	if len(routes) != 2 || routes[1].Pattern != HealthPath {
+		t.Fatalf("Expected health route to be added, got %v", routes)
+	}
+	health, ok := GetServiceHealth(svc)
+	if !ok {
+		t.Fatal("Expected health of the service to be tracked")
+	}
+	if health.Service != "mock" || health.LastError != "" || health.Database != "" {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	routes[0].Handler(nil, RestContext{QueryVariables: url.Values{"client": {"1"}}})
+	health, _ = GetServiceHealth(svc)
+	if health.LastError != "" {
+		t.Errorf("Expected client error not to be recorded, got %s", health.LastError)
+	}
+	routes[0].Handler(nil, RestContext{})
+	out, err := routes[1].Handler(nil, RestContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health = out.(ServiceHealth)
+	if health.LastError != "server failure" || health.LastErrorAt == 0 {
+		t.Errorf("Expected last error to be recorded, got %+v", health)
+	}
+}
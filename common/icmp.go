@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"strings"
+)
+
+// IcmpAnyCode is the code of ICMP type names matching any code of the type.
+const IcmpAnyCode = -1
+
+type icmpType struct {
+	name string
+	typ  uint
+	code int
+}
+
+// icmpTypes are the ICMP type names iptables understands
+// (see iptables -p icmp -h).
+var icmpTypes = []icmpType{
+	{"echo-reply", 0, IcmpAnyCode},
+	{"destination-unreachable", 3, IcmpAnyCode},
+	{"network-unreachable", 3, 0},
+	{"host-unreachable", 3, 1},
+	{"protocol-unreachable", 3, 2},
+	{"port-unreachable", 3, 3},
+	{"fragmentation-needed", 3, 4},
+	{"source-route-failed", 3, 5},
+	{"network-unknown", 3, 6},
+	{"host-unknown", 3, 7},
+	{"network-prohibited", 3, 9},
+	{"host-prohibited", 3, 10},
+	{"TOS-network-unreachable", 3, 11},
+	{"TOS-host-unreachable", 3, 12},
+	{"communication-prohibited", 3, 13},
+	{"host-precedence-violation", 3, 14},
+	{"precedence-cutoff", 3, 15},
+	{"source-quench", 4, IcmpAnyCode},
+	{"redirect", 5, IcmpAnyCode},
+	{"network-redirect", 5, 0},
+	{"host-redirect", 5, 1},
+	{"TOS-network-redirect", 5, 2},
+	{"TOS-host-redirect", 5, 3},
+	{"echo-request", 8, IcmpAnyCode},
+	{"router-advertisement", 9, IcmpAnyCode},
+	{"router-solicitation", 10, IcmpAnyCode},
+	{"time-exceeded", 11, IcmpAnyCode},
+	{"ttl-zero-during-transit", 11, 0},
+	{"ttl-zero-during-reassembly", 11, 1},
+	{"parameter-problem", 12, IcmpAnyCode},
+	{"ip-header-bad", 12, 0},
+	{"required-option-missing", 12, 1},
+	{"timestamp-request", 13, IcmpAnyCode},
+	{"timestamp-reply", 14, IcmpAnyCode},
+	{"address-mask-request", 17, IcmpAnyCode},
+	{"address-mask-reply", 18, IcmpAnyCode},
+}
+
+// IcmpTypeByName looks up an ICMP type name, ignoring case. It returns
+// the name as iptables spells it, the type and the code, which is
+// IcmpAnyCode for names of whole types. The last value is false
+// if the name is unknown.
+func IcmpTypeByName(name string) (string, uint, int, bool) {
+	name = strings.TrimSpace(name)
+	for _, t := range icmpTypes {
+		if strings.EqualFold(t.name, name) {
+			return t.name, t.typ, t.code, true
+		}
+	}
+	return "", 0, 0, false
+}
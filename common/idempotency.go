@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Support for the Idempotency-Key request header.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header a client sets so that
+	// retries of the same request are not executed twice.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// DefaultIdempotencyTTL is how long a stored response is replayed
+	// for a given key.
+	DefaultIdempotencyTTL = 24 * time.Hour
+)
+
+// idempotentResponse is the response recorded for the first
+// successful execution of a request with a given key.
+type idempotentResponse struct {
+	key         string
+	contentType string
+	body        []byte
+	created     time.Time
+	// bodyHash is the hash of the body of the request (see
+	// idempotencyBodyHash), which retries have to send unchanged.
+	bodyHash string
+	// inFlight is true while the first request is still being processed.
+	inFlight bool
+}
+
+// IdempotencyStore keeps responses of requests that carried an
+// Idempotency-Key header so that they can be replayed for retries.
+type IdempotencyStore struct {
+	sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+	// queue holds entries in the order they were created, the oldest
+	// first, so that expired ones are found without looking at others.
+	// Entries released or replaced since stay queued until they expire
+	// but are no longer in responses.
+	queue []*idempotentResponse
+}
+
+// NewIdempotencyStore creates an IdempotencyStore which remembers
+// responses for the provided duration. If ttl is not positive,
+// DefaultIdempotencyTTL is used.
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &IdempotencyStore{ttl: ttl, responses: make(map[string]*idempotentResponse)}
+}
+
+// idempotencyStore is used by all routes that have Idempotent set.
+var idempotencyStore = NewIdempotencyStore(DefaultIdempotencyTTL)
+
+// idempotencyStoreKey scopes the client-provided key to the method and
+// the path requested, so that the same key sent for different resources,
+// such as to the same route for different tenants, does not collide.
+func idempotencyStoreKey(method string, path string, key string) string {
+	return fmt.Sprintf("%s %s %s", method, path, key)
+}
+
+// idempotencyBodyHash returns the hash of the body of a request
+// stored along with its key.
+func idempotencyBodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// reserve looks up a key. If a completed response exists it is returned.
+// If no entry exists, the key is marked as in-flight and nil is returned,
+// meaning the caller should execute the request and then call either
+// complete or release. If another request with the same key is in flight,
+// a 409 error is returned. If the key was used for a request with another
+// body, a 422 error is returned, as the key cannot be reused.
+func (s *IdempotencyStore) reserve(key string, bodyHash string) (*idempotentResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	resp, ok := s.responses[key]
+	if !ok {
+		s.add(&idempotentResponse{key: key, bodyHash: bodyHash, inFlight: true})
+		return nil, nil
+	}
+	if resp.bodyHash != bodyHash {
+		return nil, NewUnprocessableEntityError(fmt.Sprintf("%s %s was used for a request with another body", IdempotencyKeyHeader, key))
+	}
+	if resp.inFlight {
+		return nil, NewErrorConflict(fmt.Sprintf("Request with %s %s is already in progress", IdempotencyKeyHeader, key))
+	}
+	return resp, nil
+}
+
+// complete records the response for the key.
+func (s *IdempotencyStore) complete(key string, contentType string, body []byte) {
+	s.Lock()
+	defer s.Unlock()
+	resp := &idempotentResponse{key: key, contentType: contentType, body: body}
+	if reserved, ok := s.responses[key]; ok {
+		resp.bodyHash = reserved.bodyHash
+	}
+	s.add(resp)
+}
+
+// release forgets the key; used when the request did not succeed, so that
+// it can be retried.
+func (s *IdempotencyStore) release(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.responses, key)
+}
+
+// add stores the entry, replacing any other of its key, and queues
+// it for expiry. Must be called with the lock held.
+func (s *IdempotencyStore) add(resp *idempotentResponse) {
+	resp.created = time.Now()
+	s.responses[resp.key] = resp
+	s.queue = append(s.queue, resp)
+}
+
+// expire removes entries older than the TTL from the front of the
+// queue. Must be called with the lock held.
+func (s *IdempotencyStore) expire() {
+	now := time.Now()
+	for len(s.queue) > 0 && now.Sub(s.queue[0].created) > s.ttl {
+		resp := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		if s.responses[resp.key] == resp {
+			log.Printf("IdempotencyStore: expiring %s", resp.key)
+			delete(s.responses, resp.key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestIdempotencyStore tests reserving, completing and releasing keys.
+func TestIdempotencyStore(t *testing.T) {
+	store := NewIdempotencyStore(time.Minute)
+	resp, err := store.reserve("key1", "hash1")
+	if err != nil {
+		t.Error(err)
+	}
+	expect(t, resp == nil, true)
+
+	// Same key while in flight is a conflict.
+	_, err = store.reserve("key1", "hash1")
+	if err == nil {
+		t.Error("Expected conflict for in-flight key")
+	}
+	expect(t, err.(HttpError).StatusCode, http.StatusConflict)
+
+	store.complete("key1", "application/json", []byte("{}"))
+	resp, err = store.reserve("key1", "hash1")
+	if err != nil {
+		t.Error(err)
+	}
+	expect(t, string(resp.body), "{}")
+
+	// Released key can be reserved again.
+	store.reserve("key2", "hash2")
+	store.release("key2")
+	resp, err = store.reserve("key2", "hash2")
+	if err != nil {
+		t.Error(err)
+	}
+	expect(t, resp == nil, true)
+
+	// A key cannot be reused for another body.
+	_, err = store.reserve("key1", "hash2")
+	if err == nil {
+		t.Error("Expected key1 to be refused for another body")
+	}
+	expect(t, err.(HttpError).StatusCode, StatusUnprocessableEntity)
+}
+
+// TestIdempotencyExpiry tests that responses are forgotten after the TTL,
+// and that a key reserved again is not expired with its earlier entry.
+func TestIdempotencyExpiry(t *testing.T) {
+	store := NewIdempotencyStore(100 * time.Millisecond)
+	store.reserve("key1", "hash1")
+	store.release("key1")
+	store.reserve("key2", "hash2")
+	store.complete("key2", "application/json", []byte("{}"))
+	time.Sleep(60 * time.Millisecond)
+	store.reserve("key1", "hash1")
+	store.complete("key1", "application/json", []byte("[]"))
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err := store.reserve("key1", "hash1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, string(resp.body), "[]")
+	_, ok := store.responses["key2"]
+	expect(t, ok, false)
+	expect(t, len(store.queue), 2)
+}
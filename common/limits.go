@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Limits on input of requests, set in the api section:
+//
+//   api:
+//     host: 192.168.0.10
+//     port: 9600
+//     max_request_bytes: 1048576
+//     strict_json: true
+//
+// Requests with bodies larger than max_request_bytes (by default
+// DefaultMaxRequestBytes) are refused with 413 before they are read
+// whole. With strict_json, JSON input with fields the route does not
+// expect is refused with 400, rather than the fields being ignored.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DefaultMaxRequestBytes is the largest body of a request
+// a service accepts, unless configured otherwise.
+const DefaultMaxRequestBytes = 16 << 20
+
+// errRequestTooLarge is returned reading bodies
+// larger than allowed by RequestLimitMiddleware.
+var errRequestTooLarge = errors.New("Request body too large")
+
+// RequestLimitMiddleware refuses requests whose
+// bodies are larger than MaxBytes.
+type RequestLimitMiddleware struct {
+	MaxBytes int64
+}
+
+// ServeHTTP implements negroni.Handler. Requests telling their length
+// are refused right away, reading bodies of others fails once it
+// goes over the limit (see UnmarshallerMiddleware).
+func (m RequestLimitMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
+	if request.ContentLength > m.MaxBytes {
+		writeTooLarge(writer, m.MaxBytes)
+		return
+	}
+	request.Body = &limitedBody{ReadCloser: request.Body, limit: m.MaxBytes, remaining: m.MaxBytes}
+	next(writer, request)
+}
+
+// writeTooLarge writes out a 413 error.
+func writeTooLarge(writer http.ResponseWriter, maxBytes int64) {
+	writer.WriteHeader(http.StatusRequestEntityTooLarge)
+	httpErr := NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxBytes))
+	outData, _ := ContentTypeMarshallers["application/json"].Marshal(httpErr)
+	writer.Write(outData)
+}
+
+// limitedBody is a request body that fails
+// with errRequestTooLarge past the limit.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	// remaining is how many bytes may still be read,
+	// -1 once more than allowed was.
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestTooLarge
+	}
+	// One byte more than remaining tells whether there is more.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[0 : b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, errRequestTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// checkKnownFields returns an error naming fields of the JSON input
+// that would be ignored when unmarshaled into v.
+func checkKnownFields(input []byte, v interface{}) error {
+	var data interface{}
+	if err := json.Unmarshal(input, &data); err != nil {
+		return err
+	}
+	var unknown []string
+	findUnknownFields(data, reflect.TypeOf(v), "", &unknown)
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return NewHttpError(http.StatusBadRequest, fmt.Sprintf("Unknown fields: %s", strings.Join(unknown, ", ")))
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// findUnknownFields adds paths of fields of data, as unmarshaled
+// into interface{}, that have no counterpart in type t to unknown.
+func findUnknownFields(data interface{}, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		// Unmarshaled its own way.
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		for key, value := range object {
+			field, ok := findJSONField(fields, key)
+			if !ok {
+				*unknown = append(*unknown, path+key)
+				continue
+			}
+			findUnknownFields(value, field.Type, path+key+".", unknown)
+		}
+	case reflect.Map:
+		if object, ok := data.(map[string]interface{}); ok {
+			for key, value := range object {
+				findUnknownFields(value, t.Elem(), path+key+".", unknown)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if array, ok := data.([]interface{}); ok {
+			for i, value := range array {
+				findUnknownFields(value, t.Elem(), fmt.Sprintf("%s%d.", path, i), unknown)
+			}
+		}
+	}
+}
+
+// jsonFields returns fields of the struct type that
+// are unmarshaled, by their names in JSON.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for name, field := range jsonFields(embedded) {
+					if _, ok := fields[name]; !ok {
+						fields[name] = field
+					}
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// findJSONField finds the field for the key of a JSON object,
+// preferring an exact match as encoding/json does.
+func findJSONField(fields map[string]reflect.StructField, key string) (reflect.StructField, bool) {
+	if field, ok := fields[key]; ok {
+		return field, true
+	}
+	for name, field := range fields {
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequestLimits tests refusing large request bodies
+// and unknown fields of JSON input.
+func TestRequestLimits(t *testing.T) {
+	limit := RequestLimitMiddleware{MaxBytes: 10}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		limit.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			NewUnmarshaller().ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+	}
+	for body, status := range map[string]int{
+		"0123456789":  http.StatusOK,
+		"0123456789x": http.StatusRequestEntityTooLarge,
+	} {
+		// Told length.
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		expect(t, recorder.Code, status)
+
+		// Chunked.
+		request := httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader(body)))
+		request.ContentLength = -1
+		recorder = httptest.NewRecorder()
+		handler(recorder, request)
+		expect(t, recorder.Code, status)
+	}
+
+	type address struct {
+		City string `json:"city"`
+	}
+	type person struct {
+		Name      string    `json:"name"`
+		Addresses []address `json:"addresses"`
+		Age       int
+		secret    string
+	}
+	err := checkKnownFields([]byte(`{"NAME": "a", "age": 1, "addresses": [{"city": "b"}]}`), &person{})
+	expect(t, err, nil)
+	err = checkKnownFields([]byte(`{"name": "a", "secret": "s", "addresses": [{"city": "b", "zip": 1}]}`), &person{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	expect(t, err.Error(), "400 Bad Request\nDetails: Unknown fields: addresses.0.zip, secret")
+
+	parsed, err := ParseConfig([]byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n      max_request_bytes: 1024\n      strict_json: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := parsed.Services["root"].Common.Api
+	expect(t, api.MaxRequestBytes, int64(1024))
+	expect(t, api.StrictJSON, true)
+}
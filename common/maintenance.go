@@ -0,0 +1,276 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Periodic maintenance of the stores of services. A service that
+// implements Maintainer offers jobs by name, which InitializeService
+// runs at the intervals configured in the "maintenance" section of
+// the service configuration:
+//
+//   "maintenance": {
+//     "purge_deleted": {"interval_seconds": 600},
+//     "compact_history": {"interval_seconds": 86400, "keep_revisions": 20},
+//     "analyze": {"interval_seconds": 604800}
+//   }
+//
+// Jobs that are not configured run at their default interval, if
+// they have one; an interval_seconds of 0 disables a job. Other keys
+// of a job's section are passed to the job. Each job runs in its own
+// goroutine, so that a slow one does not hold up others, and the last
+// run of every job is reported at HealthPath.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of maintenance jobs provided by StoreMaintenanceJobs.
+const (
+	MaintenancePurgeDeleted = "purge_deleted"
+	MaintenanceAnalyze      = "analyze"
+)
+
+// MaintenanceJob is a task run periodically on the store of a service.
+type MaintenanceJob struct {
+	// Interval is how often the job runs unless configured
+	// otherwise; 0 for it to run only if configured.
+	Interval time.Duration
+	// Run runs the job with the keys of its section of the
+	// configuration, if any, and returns what it did.
+	Run func(ctx context.Context, config map[string]interface{}) (string, error)
+}
+
+// Maintainer may be implemented by a Service whose store
+// needs periodic maintenance.
+type Maintainer interface {
+	// MaintenanceJobs returns the jobs of the service by name.
+	MaintenanceJobs() map[string]MaintenanceJob
+}
+
+// Analyzer is implemented by stores that can update the statistics
+// their database uses to plan queries (see DbStore.Analyze).
+type Analyzer interface {
+	Analyze(ctx context.Context) (string, error)
+}
+
+// softDeleter is implemented by DbStore, which only
+// needs purging if it has soft-deleted entities.
+type softDeleter interface {
+	hasSoftDeleted() bool
+}
+
+// hasSoftDeleted implements softDeleter.
+func (dbStore *DbStore) hasSoftDeleted() bool {
+	for _, entity := range dbStore.ServiceStore.Entities() {
+		if softDeleted(entity) {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreMaintenanceJobs returns the jobs a store supports: purging of
+// deleted entities if it is a Purger (of a database with entities
+// deleted softly), and analysis of its tables if it is an Analyzer,
+// which only runs if configured.
+func StoreMaintenanceJobs(store interface{}) map[string]MaintenanceJob {
+	jobs := make(map[string]MaintenanceJob)
+	purger, ok := store.(Purger)
+	if s, isDb := store.(softDeleter); isDb && !s.hasSoftDeleted() {
+		ok = false
+	}
+	if ok {
+		grace := purger.DeletionGrace()
+		jobs[MaintenancePurgeDeleted] = MaintenanceJob{
+			Interval: purgeInterval(grace),
+			Run: func(ctx context.Context, config map[string]interface{}) (string, error) {
+				purged, err := purger.PurgeDeleted(ctx, time.Now().Add(-grace))
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Purged %d entities deleted more than %v ago", purged, grace), nil
+			},
+		}
+	}
+	if analyzer, ok := store.(Analyzer); ok {
+		jobs[MaintenanceAnalyze] = MaintenanceJob{
+			Run: func(ctx context.Context, config map[string]interface{}) (string, error) {
+				return analyzer.Analyze(ctx)
+			},
+		}
+	}
+	return jobs
+}
+
+// Analyze implements Analyzer, analyzing the tables of the store.
+func (dbStore *DbStore) Analyze(ctx context.Context) (string, error) {
+	if err := CheckContext(ctx); err != nil {
+		return "", err
+	}
+	var tables []string
+	for _, entity := range dbStore.ServiceStore.Entities() {
+		tables = append(tables, dbStore.Db.NewScope(entity).TableName())
+	}
+	switch dbStore.Config.Type {
+	case "mysql":
+		if err := GetDbErrors(dbStore.Db.Exec("ANALYZE TABLE " + strings.Join(tables, ", "))); err != nil {
+			return "", err
+		}
+	default:
+		// SQLite analyzes all tables at once.
+		if err := GetDbErrors(dbStore.Db.Exec("ANALYZE")); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("Analyzed %d tables", len(tables)), nil
+}
+
+// parseMaintenance parses the maintenance section of the service
+// configuration, returning the sections of the jobs by name.
+func parseMaintenance(serviceSpecific map[string]interface{}) (map[string]map[string]interface{}, error) {
+	section, ok := serviceSpecific["maintenance"]
+	if !ok {
+		return nil, nil
+	}
+	sectionMap, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid maintenance configuration %v", section))
+	}
+	jobs := make(map[string]map[string]interface{})
+	for name, value := range sectionMap {
+		jobConfig, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid configuration of maintenance job %s: %v", name, value))
+		}
+		if interval, ok := jobConfig["interval_seconds"]; ok {
+			seconds, ok := interval.(float64)
+			if !ok || seconds < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid interval_seconds %v of maintenance job %s", interval, name))
+			}
+		}
+		jobs[name] = jobConfig
+	}
+	return jobs, nil
+}
+
+// scheduledJob is a maintenance job with the
+// interval it runs at, and its last run.
+type scheduledJob struct {
+	MaintenanceJob
+	name   string
+	config map[string]interface{}
+	status MaintenanceStatus
+}
+
+// scheduleMaintenance returns the jobs of the service to run, at the
+// intervals configured for them or by default, ordered by name.
+func scheduleMaintenance(service Service, serviceSpecific map[string]interface{}) ([]*scheduledJob, error) {
+	maintainer, ok := service.(Maintainer)
+	if !ok {
+		return nil, nil
+	}
+	configs, err := parseMaintenance(serviceSpecific)
+	if err != nil {
+		return nil, err
+	}
+	jobs := maintainer.MaintenanceJobs()
+	for name := range configs {
+		if _, ok := jobs[name]; !ok {
+			var names []string
+			for name := range jobs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, errors.New(fmt.Sprintf("Unknown maintenance job %s, expected one of %s", name, strings.Join(names, ", ")))
+		}
+	}
+	var scheduled []*scheduledJob
+	for name, job := range jobs {
+		config := configs[name]
+		if seconds, ok := config["interval_seconds"].(float64); ok {
+			job.Interval = time.Duration(seconds * float64(time.Second))
+		}
+		if job.Interval <= 0 {
+			continue
+		}
+		sj := &scheduledJob{MaintenanceJob: job, name: name, config: config}
+		sj.status = MaintenanceStatus{Job: name, Interval: int64(job.Interval.Seconds())}
+		scheduled = append(scheduled, sj)
+	}
+	sort.Sort(jobsByName(scheduled))
+	return scheduled, nil
+}
+
+// jobsByName sorts scheduled jobs by their name.
+type jobsByName []*scheduledJob
+
+func (j jobsByName) Len() int           { return len(j) }
+func (j jobsByName) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
+func (j jobsByName) Less(a, b int) bool { return j[a].name < j[b].name }
+
+// runMaintenance runs the job of the service every interval,
+// recording the outcome of each run in the health of the service.
+func (h *serviceHealth) runMaintenance(job *scheduledJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.runJob(job)
+	}
+}
+
+// runJob runs the job once and records the outcome.
+func (h *serviceHealth) runJob(job *scheduledJob) {
+	start := time.Now()
+	result, err := job.Run(context.Background(), job.config)
+	h.Lock()
+	defer h.Unlock()
+	job.status.Runs++
+	job.status.LastRun = start.Unix()
+	job.status.LastDurationMillis = int64(time.Since(start) / time.Millisecond)
+	job.status.Result = result
+	job.status.Error = ""
+	if err != nil {
+		job.status.Error = err.Error()
+		job.status.Failures++
+		log.Printf("%s: Maintenance job %s failed: %v", h.service.Name(), job.name, err)
+	} else if result != "" {
+		log.Printf("%s: Maintenance job %s: %s", h.service.Name(), job.name, result)
+	}
+}
+
+// startMaintenance schedules the maintenance jobs of the service.
+func startMaintenance(service Service, serviceSpecific map[string]interface{}) error {
+	jobs, err := scheduleMaintenance(service, serviceSpecific)
+	if err != nil || len(jobs) == 0 {
+		return err
+	}
+	runningServices.Lock()
+	h := runningServices.health[service]
+	runningServices.Unlock()
+	h.Lock()
+	h.maintenance = jobs
+	h.Unlock()
+	for _, job := range jobs {
+		log.Printf("%s: Running maintenance job %s every %v", service.Name(), job.name, job.Interval)
+		go h.runMaintenance(job)
+	}
+	return nil
+}
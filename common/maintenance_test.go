@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// maintainedService is a service with maintenance jobs.
+type maintainedService struct {
+	timeoutService
+	jobs map[string]MaintenanceJob
+}
+
+func (s *maintainedService) MaintenanceJobs() map[string]MaintenanceJob {
+	return s.jobs
+}
+
+// TestMaintenance tests scheduling of maintenance jobs
+// and reporting of their runs in the health of the service.
+func TestMaintenance(t *testing.T) {
+	runs := make(chan map[string]interface{}, 10)
+	svc := &maintainedService{jobs: map[string]MaintenanceJob{
+		"compact": {
+			Run: func(ctx context.Context, config map[string]interface{}) (string, error) {
+				select {
+				case runs <- config:
+				default:
+				}
+				return "compacted", nil
+			},
+		},
+		"purge": {
+			Interval: time.Hour,
+			Run: func(ctx context.Context, config map[string]interface{}) (string, error) {
+				return "", errors.New("purge failed")
+			},
+		},
+		"analyze": {
+			Interval: time.Hour,
+		},
+	}}
+
+	for _, invalid := range []map[string]interface{}{
+		{"maintenance": "daily"},
+		{"maintenance": map[string]interface{}{"compact": 5.0}},
+		{"maintenance": map[string]interface{}{"compact": map[string]interface{}{"interval_seconds": -1.0}}},
+		{"maintenance": map[string]interface{}{"vacuum": map[string]interface{}{"interval_seconds": 60.0}}},
+	} {
+		if _, err := scheduleMaintenance(svc, invalid); err == nil {
+			t.Errorf("Expected error scheduling %v", invalid)
+		}
+	}
+
+	// Jobs run at their default interval unless configured;
+	// those with none only run if configured.
+	jobs, err := scheduleMaintenance(svc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].name != "analyze" || jobs[1].name != "purge" {
+		t.Fatalf("Expected analyze and purge to be scheduled, got %v", jobs)
+	}
+	config := map[string]interface{}{"maintenance": map[string]interface{}{
+		"compact": map[string]interface{}{"interval_seconds": 0.01, "keep": 3.0},
+		"analyze": map[string]interface{}{"interval_seconds": 0.0},
+	}}
+	jobs, err = scheduleMaintenance(svc, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].name != "compact" || jobs[0].Interval != 10*time.Millisecond || jobs[1].name != "purge" {
+		t.Fatalf("Expected compact and purge to be scheduled, got %v", jobs)
+	}
+
+	trackHealth(svc, nil)
+	if err := startMaintenance(svc, config); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case jobConfig := <-runs:
+		expect(t, jobConfig["keep"], 3.0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected compact job to run")
+	}
+	var health ServiceHealth
+	for i := 0; i < 100; i++ {
+		health, _ = GetServiceHealth(svc)
+		if len(health.Maintenance) == 2 && health.Maintenance[0].Runs > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(health.Maintenance) != 2 {
+		t.Fatalf("Expected 2 maintenance jobs in health, got %+v", health.Maintenance)
+	}
+	compact := health.Maintenance[0]
+	if compact.Job != "compact" || compact.Runs == 0 || compact.LastRun == 0 || compact.Result != "compacted" || compact.Error != "" {
+		t.Errorf("Unexpected status of compact job %+v", compact)
+	}
+	expect(t, health.Maintenance[1].Interval, int64(3600))
+
+	// Failures are recorded along with the error.
+	h := runningServices.health[svc]
+	h.runJob(h.maintenance[1])
+	health, _ = GetServiceHealth(svc)
+	purge := health.Maintenance[1]
+	if purge.Runs != 1 || purge.Failures != 1 || purge.Error != "purge failed" {
+		t.Errorf("Unexpected status of purge job %+v", purge)
+	}
+}
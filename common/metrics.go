@@ -0,0 +1,341 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Metrics of services, exposed at MetricsPath in the Prometheus
+// text format, as in
+//
+//   metrics := NewMetrics()
+//   requests := metrics.NewCounter("romana_x_requests_total", "Requests handled.", "method")
+//   requests.Inc("GET")
+//
+// with metrics.Route() added to the service's routes. They may also
+// be pushed to StatsD (see statsd.go).
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4"
+
+// DefaultBuckets are upper bounds of Histogram buckets suitable
+// for durations, in seconds, of operations such as requests.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics is a set of metrics of a service.
+type Metrics struct {
+	sync.Mutex
+	metrics []metric
+}
+
+// metric is a named metric with values for combinations of labels.
+type metric interface {
+	// write writes the metric in the Prometheus text format.
+	write(buf *bytes.Buffer)
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) add(metric metric) {
+	m.Lock()
+	defer m.Unlock()
+	m.metrics = append(m.metrics, metric)
+}
+
+// NewCounter adds a counter with the labels to the metrics.
+func (m *Metrics) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{desc: metricDesc{name: name, help: help, labels: labels}, values: make(map[string]float64)}
+	m.add(c)
+	return c
+}
+
+// NewGauge adds a gauge with the labels to the metrics.
+func (m *Metrics) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: metricDesc{name: name, help: help, labels: labels}, values: make(map[string]float64)}
+	m.add(g)
+	return g
+}
+
+// NewGaugeFunc adds a gauge whose value is returned by the
+// function whenever metrics are collected.
+func (m *Metrics) NewGaugeFunc(name string, help string, value func() float64) {
+	m.add(&gaugeFunc{desc: metricDesc{name: name, help: help}, value: value})
+}
+
+// NewHistogram adds a histogram with the buckets (see
+// DefaultBuckets) and labels to the metrics.
+func (m *Metrics) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    metricDesc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	m.add(h)
+	return h
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (m *Metrics) Write(buf *bytes.Buffer) {
+	m.Lock()
+	metrics := append([]metric{}, m.metrics...)
+	m.Unlock()
+	for _, metric := range metrics {
+		metric.write(buf)
+	}
+}
+
+// Route returns the route serving the metrics at MetricsPath,
+// along with those kept by the framework for all services
+// (see deprecation.go).
+func (m *Metrics) Route() Route {
+	return Route{
+		Method:  "GET",
+		Pattern: MetricsPath,
+		Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+			writer := input.(UnwrappedRestHandlerInput).ResponseWriter
+			buf := &bytes.Buffer{}
+			m.Write(buf)
+			frameworkMetrics.Write(buf)
+			writer.Header().Set("Content-Type", metricsContentType)
+			writer.WriteHeader(http.StatusOK)
+			writer.Write(buf.Bytes())
+			return nil, nil
+		},
+		MakeMessage: func() interface{} {
+			return http.Request{}
+		},
+	}
+}
+
+// metricDesc describes a metric.
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key returns the key of values of the metric for the label values.
+func (d metricDesc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("Metric %s has labels %v, got values %v", d.name, d.labels, labelValues))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// labelString returns labels for the key (see key()), with
+// the extra label if not empty, as in {method="GET"}.
+func (d metricDesc) labelString(key string, extraName string, extraValue string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", d.labels[i], strconv.Quote(value)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d metricDesc) writeHeader(buf *bytes.Buffer, metricType string) {
+	help := strings.Replace(strings.Replace(d.help, `\`, `\\`, -1), "\n", `\n`, -1)
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, metricType)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeValues writes values of a counter or gauge, sorted by labels.
+func (d metricDesc) writeValues(buf *bytes.Buffer, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s%s %s\n", d.name, d.labelString(key, "", ""), formatValue(values[key]))
+	}
+}
+
+// Counter is a metric that only increases.
+type Counter struct {
+	desc metricDesc
+	sync.Mutex
+	values map[string]float64
+}
+
+// Inc increments the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds to the counter for the label values.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	key := c.desc.key(labelValues)
+	c.Lock()
+	c.values[key] += value
+	c.Unlock()
+	pushMetric(pushCount, c.desc, labelValues, value)
+}
+
+// Value returns the value of the counter for the label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.desc.key(labelValues)
+	c.Lock()
+	defer c.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.Lock()
+	defer c.Unlock()
+	c.desc.writeHeader(buf, "counter")
+	c.desc.writeValues(buf, c.values)
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	desc metricDesc
+	sync.Mutex
+	values map[string]float64
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.desc.key(labelValues)
+	g.Lock()
+	g.values[key] = value
+	g.Unlock()
+	pushMetric(pushGauge, g.desc, labelValues, value)
+}
+
+// Add adds to (or, if negative, subtracts from) the
+// gauge for the label values.
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	key := g.desc.key(labelValues)
+	g.Lock()
+	g.values[key] += value
+	value = g.values[key]
+	g.Unlock()
+	pushMetric(pushGauge, g.desc, labelValues, value)
+}
+
+// Value returns the value of the gauge for the label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := g.desc.key(labelValues)
+	g.Lock()
+	defer g.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(buf *bytes.Buffer) {
+	g.Lock()
+	defer g.Unlock()
+	g.desc.writeHeader(buf, "gauge")
+	g.desc.writeValues(buf, g.values)
+}
+
+type gaugeFunc struct {
+	desc  metricDesc
+	value func() float64
+}
+
+func (g *gaugeFunc) write(buf *bytes.Buffer) {
+	g.desc.writeHeader(buf, "gauge")
+	g.desc.writeValues(buf, map[string]float64{"": g.value()})
+}
+
+// Histogram is a metric that counts observed values in buckets.
+type Histogram struct {
+	desc    metricDesc
+	buckets []float64
+	sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// Count of observations in each bucket; the
+	// last is for values above all buckets.
+	counts []uint64
+	sum    float64
+}
+
+// Observe records the value for the label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.desc.key(labelValues)
+	h.Lock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = v
+	}
+	i := sort.SearchFloat64s(h.buckets, value)
+	v.counts[i]++
+	v.sum += value
+	h.Unlock()
+	pushMetric(pushObserve, h.desc, labelValues, value)
+}
+
+// Count returns the number of values observed for the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.desc.key(labelValues)
+	h.Lock()
+	defer h.Unlock()
+	var count uint64
+	if v, ok := h.values[key]; ok {
+		for _, c := range v.counts {
+			count += c
+		}
+	}
+	return count
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	h.desc.writeHeader(buf, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.desc.name, h.desc.labelString(key, "le", formatValue(bound)), cumulative)
+		}
+		cumulative += v.counts[len(h.buckets)]
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.desc.name, h.desc.labelString(key, "le", "+Inf"), cumulative)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.desc.name, h.desc.labelString(key, "", ""), formatValue(v.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.desc.name, h.desc.labelString(key, "", ""), cumulative)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestMetrics tests exposition of metrics in the Prometheus format.
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	requests := metrics.NewCounter("test_requests_total", "Requests\nhandled.", "method", "code")
+	inFlight := metrics.NewGauge("test_in_flight", "Requests in flight.")
+	metrics.NewGaugeFunc("test_answer", "The answer.", func() float64 { return 42 })
+	latency := metrics.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+
+	requests.Inc("GET", "200")
+	requests.Add(2, "POST", `5"0"0`)
+	requests.Inc("GET", "200")
+	inFlight.Add(3)
+	inFlight.Add(-1)
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(5)
+
+	route := metrics.Route()
+	recorder := httptest.NewRecorder()
+	route.Handler(UnwrappedRestHandlerInput{ResponseWriter: recorder}, RestContext{})
+	if ct := recorder.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+	expect := `# HELP test_requests_total Requests\nhandled.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 2
+test_requests_total{method="POST",code="5\"0\"0"} 2
+# HELP test_in_flight Requests in flight.
+# TYPE test_in_flight gauge
+test_in_flight 2
+# HELP test_answer The answer.
+# TYPE test_answer gauge
+test_answer 42
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.15
+test_latency_seconds_count 3
+`
+	if got := recorder.Body.String(); got != expect {
+		t.Errorf("Expected\n%s\ngot\n%s", expect, got)
+	}
+	if requests.Value("GET", "200") != 2 || latency.Count() != 3 {
+		t.Errorf("Unexpected values %v, %v", requests.Value("GET", "200"), latency.Count())
+	}
+}
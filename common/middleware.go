@@ -19,6 +19,7 @@ package common
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/K-Phoen/negotiation"
@@ -41,6 +42,10 @@ import (
 // RestContext contains the context of the REST request other
 // than the body data that has been unmarshaled.
 type RestContext struct {
+	// Context of the underlying HTTP request. It is done when the client
+	// goes away or the REST timeout expires, and should be passed
+	// to store methods.
+	Context gocontext.Context
 	// Path variables as described in https://godoc.org/code.google.com/p/gorilla/mux
 	PathVariables map[string]string
 	// QueryVariables stores key-value-list map of query variables, see url.Values
@@ -51,6 +56,14 @@ type RestContext struct {
 	Roles        []Role
 	// Output of the hook if any run before the execution of the handler.
 	HookOutput string
+	// IdempotencyKey is the value of the Idempotency-Key header, if sent.
+	IdempotencyKey string
+	// IfMatch is the value of the If-Match header, if sent
+	// (see CheckVersion).
+	IfMatch string
+	// RequestID identifies the request in logs of all services
+	// involved in serving it (see calllog.go); Context carries it.
+	RequestID string
 }
 
 // RestHandler specifies type of a function that each Route provides.
@@ -103,6 +116,21 @@ type Route struct {
 	UseRequestToken bool
 
 	Hook *Hook
+
+	// Whether this route honors the Idempotency-Key header. If true,
+	// the response of the first successful execution for a given key
+	// is stored by the framework and replayed for subsequent requests
+	// with the same key, without invoking the Handler again.
+	Idempotent bool
+
+	// Deprecation, if set, marks the route as deprecated
+	// (see deprecation.go).
+	Deprecation *Deprecation
+
+	// Whether JSON input with fields the message does not have is
+	// refused rather than the fields ignored. It is set for all
+	// routes of services configured with strict_json (see limits.go).
+	StrictJSON bool
 }
 
 // Routes provided by each service.
@@ -236,7 +264,12 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 				writer.Write([]byte(err.Error()))
 				return
 			}
-			restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form}
+			id, ctx := requestID(request)
+			writer.Header().Set(RequestIDHeader, id)
+			if route.Deprecation != nil {
+				route.Deprecation.setHeaders(writer.Header())
+			}
+			restContext := RestContext{Context: ctx, PathVariables: mux.Vars(request), QueryVariables: request.Form, RequestID: id}
 			respReq := UnwrappedRestHandlerInput{writer, request}
 
 			marshaller := ContentTypeMarshallers["application/json"]
@@ -259,6 +292,11 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 		return RomanaHandler{httpHandler}
 	}
 	httpHandler := func(writer http.ResponseWriter, request *http.Request) {
+		id, ctx := requestID(request)
+		writer.Header().Set(RequestIDHeader, id)
+		if route.Deprecation != nil {
+			route.Deprecation.setHeaders(writer.Header())
+		}
 		bufStr := ""
 		var inData interface{}
 		if makeMessage == nil {
@@ -306,6 +344,15 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 						write400(writer, marshaller, err)
 						return
 					}
+					if _, isJSON := unmarshaller.(jsonMarshaller); isJSON && route.StrictJSON {
+						err = checkKnownFields(buf, inData)
+						if err != nil {
+							writer.WriteHeader(http.StatusBadRequest)
+							outData, _ := marshaller.Marshal(err)
+							writer.Write(outData)
+							return
+						}
+					}
 				} else {
 					// Cannot unmarshal
 					dataOut, _ := marshaller.Marshal(supportedContentTypesMessage)
@@ -347,7 +394,37 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 				}
 			}
 		}
-		restContext := RestContext{PathVariables: mux.Vars(request), QueryVariables: request.Form, RequestToken: token}
+		restContext := RestContext{Context: ctx, PathVariables: mux.Vars(request), QueryVariables: request.Form, RequestToken: token, RequestID: id}
+		restContext.IfMatch = request.Header.Get(IfMatchHeader)
+		var idempotencyKey string
+		if route.Idempotent {
+			restContext.IdempotencyKey = request.Header.Get(IdempotencyKeyHeader)
+			if restContext.IdempotencyKey != "" {
+				idempotencyKey = idempotencyStoreKey(request.Method, request.URL.Path, restContext.IdempotencyKey)
+				stored, err := idempotencyStore.reserve(idempotencyKey, idempotencyBodyHash(bufStr))
+				if err != nil {
+					httpErr := err.(HttpError)
+					writer.WriteHeader(httpErr.StatusCode)
+					outData, _ := marshaller.Marshal(httpErr)
+					writer.Write(outData)
+					return
+				}
+				if stored != nil {
+					log.Printf("Replaying stored response for %s", idempotencyKey)
+					writer.Header().Set("Content-Type", stored.contentType)
+					writer.WriteHeader(http.StatusOK)
+					writer.Write(stored.body)
+					return
+				}
+				// Unless the response is recorded below, forget the key
+				// so the request can be retried.
+				defer func() {
+					if idempotencyKey != "" {
+						idempotencyStore.release(idempotencyKey)
+					}
+				}()
+			}
+		}
 		if route.Hook != nil {
 			log.Printf("doHook() will be called before %s %s: %s", route.Method, route.Pattern, route.Hook.Executable)
 		}
@@ -376,6 +453,10 @@ func wrapHandler(restHandler RestHandler, route Route) http.Handler {
 			}
 			//				log.Printf("Out data: %s, wire data: %s, error %s\n", outData, wireData, err)
 			if err == nil {
+				if idempotencyKey != "" {
+					idempotencyStore.complete(idempotencyKey, contentType, wireData)
+					idempotencyKey = ""
+				}
 				writer.WriteHeader(http.StatusOK)
 				writer.Write(wireData)
 				return
@@ -659,6 +740,10 @@ func (m UnmarshallerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request
 	ct := r.Header.Get(HeaderContentType)
 
 	buf, err := ioutil.ReadAll(r.Body)
+	if err == errRequestTooLarge {
+		writeTooLarge(w, r.Body.(*limitedBody).limit)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -0,0 +1,163 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package netutil provides arithmetic on IPv4 and IPv6 addresses
+// and on blocks of addresses given in CIDR notation.
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// maxSplit limits the number of blocks Split returns.
+const maxSplit = 1 << 16
+
+// IPv4ToInt returns the IPv4 address ip as an integer. Of IPv6
+// addresses, only the last four bytes are taken.
+func IPv4ToInt(ip net.IP) uint64 {
+	switch len(ip) {
+	case net.IPv4len:
+		return uint64(ip[0])<<24 | uint64(ip[1])<<16 | uint64(ip[2])<<8 | uint64(ip[3])
+	case net.IPv6len:
+		return uint64(ip[12])<<24 | uint64(ip[13])<<16 | uint64(ip[14])<<8 | uint64(ip[15])
+	default:
+		return 0
+	}
+}
+
+// IntToIPv4 returns the IPv4 address of the lower 32 bits of ipInt.
+func IntToIPv4(ipInt uint64) net.IP {
+	return net.IPv4(byte(ipInt>>24), byte(ipInt>>16), byte(ipInt>>8), byte(ipInt))
+}
+
+// IPToInt returns the address ip, IPv4 or IPv6, as an integer.
+func IPToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+// IntToIP returns the address of the integer i, in the
+// address family with the number of bits given (32 or 128).
+// It returns nil if i is negative or does not fit.
+func IntToIP(i *big.Int, bits int) net.IP {
+	if bits != 8*net.IPv4len && bits != 8*net.IPv6len {
+		return nil
+	}
+	if i.Sign() < 0 || i.BitLen() > bits {
+		return nil
+	}
+	b := i.Bytes()
+	ip := make(net.IP, bits/8)
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// ParseCIDR parses s as a block of addresses in CIDR notation,
+// returning the block with the address masked to its prefix.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid CIDR %s", s))
+	}
+	return ipNet, nil
+}
+
+// Contains returns true if the block inner lies within outer.
+// Blocks of different address families contain none of each other.
+func Contains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// Overlaps returns true if the blocks a and b have addresses in
+// common, that is, if either contains the other.
+func Overlaps(a, b *net.IPNet) bool {
+	return Contains(a, b) || Contains(b, a)
+}
+
+// Size returns the number of addresses in the block.
+func Size(ipNet *net.IPNet) *big.Int {
+	ones, bits := ipNet.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// First returns the first address of the block.
+func First(ipNet *net.IPNet) net.IP {
+	_, bits := ipNet.Mask.Size()
+	return IntToIP(IPToInt(ipNet.IP.Mask(ipNet.Mask)), bits)
+}
+
+// Last returns the last address of the block, which for
+// IPv4 blocks is their broadcast address.
+func Last(ipNet *net.IPNet) net.IP {
+	_, bits := ipNet.Mask.Size()
+	last := new(big.Int).Add(IPToInt(First(ipNet)), Size(ipNet))
+	return IntToIP(last.Sub(last, big.NewInt(1)), bits)
+}
+
+// Add returns the address n addresses after ip (before ip, if n
+// is negative), or nil if that is outside the address space.
+func Add(ip net.IP, n int64) net.IP {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return IntToIP(new(big.Int).Add(IPToInt(ip), big.NewInt(n)), bits)
+}
+
+// Next returns the address following ip, or nil for
+// the last address of the address space.
+func Next(ip net.IP) net.IP {
+	return Add(ip, 1)
+}
+
+// Split splits the block into the blocks of prefix length ones
+// it consists of, in order of their addresses.
+func Split(ipNet *net.IPNet, ones int) ([]*net.IPNet, error) {
+	netOnes, bits := ipNet.Mask.Size()
+	if ones < netOnes || ones > bits {
+		return nil, errors.New(fmt.Sprintf("Cannot split %s into blocks of prefix length %d", ipNet, ones))
+	}
+	if ones-netOnes > 16 {
+		return nil, errors.New(fmt.Sprintf("Splitting %s into blocks of prefix length %d exceeds %d blocks", ipNet, ones, maxSplit))
+	}
+	count := 1 << uint(ones-netOnes)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	mask := net.CIDRMask(ones, bits)
+	ip := IPToInt(First(ipNet))
+	blocks := make([]*net.IPNet, 0, count)
+	for i := 0; i < count; i++ {
+		blocks = append(blocks, &net.IPNet{IP: IntToIP(ip, bits), Mask: mask})
+		ip.Add(ip, step)
+	}
+	return blocks, nil
+}
+
+// Each calls fn with the addresses of the block in order,
+// until fn returns false or the addresses are exhausted.
+func Each(ipNet *net.IPNet, fn func(ip net.IP) bool) {
+	last := IPToInt(Last(ipNet))
+	for ip := First(ipNet); ip != nil; ip = Next(ip) {
+		if !fn(ip) || IPToInt(ip).Cmp(last) >= 0 {
+			return
+		}
+	}
+}
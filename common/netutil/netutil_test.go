@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package netutil
+
+import (
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+)
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	ipNet, err := ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipNet
+}
+
+// TestIntConversions tests conversions of addresses to integers and back.
+func TestIntConversions(t *testing.T) {
+	ip := net.ParseIP("10.1.2.3")
+	if i := IPv4ToInt(ip); i != 0x0a010203 {
+		t.Errorf("Expected 0x0a010203, got %x", i)
+	}
+	if i := IPv4ToInt(ip.To4()); i != 0x0a010203 {
+		t.Errorf("Expected 0x0a010203, got %x", i)
+	}
+	if back := IntToIPv4(0x0a010203); !back.Equal(ip) {
+		t.Errorf("Expected %s, got %s", ip, back)
+	}
+	for _, s := range []string{"0.0.0.0", "10.1.2.3", "255.255.255.255", "::", "fd00::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		ip := net.ParseIP(s)
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		if back := IntToIP(IPToInt(ip), bits); !back.Equal(ip) {
+			t.Errorf("Expected %s, got %s", s, back)
+		}
+	}
+	if ip := IntToIP(new(big.Int).Lsh(big.NewInt(1), 32), 32); ip != nil {
+		t.Errorf("Expected nil for integer out of IPv4 range, got %s", ip)
+	}
+	if ip := IntToIP(big.NewInt(-1), 128); ip != nil {
+		t.Errorf("Expected nil for negative integer, got %s", ip)
+	}
+}
+
+// TestContainsOverlaps tests containment and overlap of blocks.
+func TestContainsOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		contains bool
+		overlaps bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true, true},
+		{"10.1.0.0/16", "10.0.0.0/8", false, true},
+		{"10.0.0.0/8", "10.0.0.0/8", true, true},
+		{"10.0.0.0/16", "10.1.0.0/16", false, false},
+		{"0.0.0.0/0", "192.168.1.1/32", true, true},
+		{"fd00::/8", "fd00:1::/32", true, true},
+		{"fd00::/8", "fe80::/10", false, false},
+		{"::/0", "10.0.0.0/8", false, false},
+	}
+	for _, test := range tests {
+		a, b := cidr(t, test.a), cidr(t, test.b)
+		if Contains(a, b) != test.contains {
+			t.Errorf("Expected Contains(%s, %s) to be %t", a, b, test.contains)
+		}
+		if Overlaps(a, b) != test.overlaps {
+			t.Errorf("Expected Overlaps(%s, %s) to be %t", a, b, test.overlaps)
+		}
+	}
+	if _, err := ParseCIDR("10.0.0.0"); err == nil {
+		t.Error("Expected error parsing address without prefix length")
+	}
+}
+
+// TestBlockBounds tests sizes and bounds of blocks.
+func TestBlockBounds(t *testing.T) {
+	tests := []struct {
+		cidr, first, last, size string
+	}{
+		{"10.1.2.3/24", "10.1.2.0", "10.1.2.255", "256"},
+		{"10.1.2.3/32", "10.1.2.3", "10.1.2.3", "1"},
+		{"0.0.0.0/0", "0.0.0.0", "255.255.255.255", "4294967296"},
+		{"fd00::1/64", "fd00::", "fd00::ffff:ffff:ffff:ffff", "18446744073709551616"},
+	}
+	for _, test := range tests {
+		ipNet := cidr(t, test.cidr)
+		if first := First(ipNet).String(); first != test.first {
+			t.Errorf("Expected first of %s %s, got %s", test.cidr, test.first, first)
+		}
+		if last := Last(ipNet).String(); last != test.last {
+			t.Errorf("Expected last of %s %s, got %s", test.cidr, test.last, last)
+		}
+		if size := Size(ipNet).String(); size != test.size {
+			t.Errorf("Expected size of %s %s, got %s", test.cidr, test.size, size)
+		}
+	}
+	if ip := Add(net.ParseIP("10.0.0.255"), 2); ip.String() != "10.0.1.1" {
+		t.Errorf("Expected 10.0.1.1, got %s", ip)
+	}
+	if ip := Add(net.ParseIP("fd00::1"), -2); ip.String() != "fcff:ffff:ffff:ffff:ffff:ffff:ffff:ffff" {
+		t.Errorf("Expected fcff:ffff:ffff:ffff:ffff:ffff:ffff:ffff, got %s", ip)
+	}
+	if ip := Next(net.ParseIP("255.255.255.255")); ip != nil {
+		t.Errorf("Expected nil after the last address, got %s", ip)
+	}
+}
+
+// TestSplitEach tests splitting blocks and iterating their addresses.
+func TestSplitEach(t *testing.T) {
+	blocks, err := Split(cidr(t, "10.0.0.0/22"), 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, block := range blocks {
+		names = append(names, block.String())
+	}
+	if got := strings.Join(names, " "); got != "10.0.0.0/24 10.0.1.0/24 10.0.2.0/24 10.0.3.0/24" {
+		t.Errorf("Unexpected blocks %s", got)
+	}
+	blocks, err = Split(cidr(t, "fd00::/62"), 64)
+	if err != nil || len(blocks) != 4 || blocks[3].String() != "fd00:0:0:3::/64" {
+		t.Errorf("Unexpected blocks %v, error %v", blocks, err)
+	}
+	for _, ones := range []int{21, 33} {
+		if _, err := Split(cidr(t, "10.0.0.0/22"), ones); err == nil {
+			t.Errorf("Expected error splitting into prefix length %d", ones)
+		}
+	}
+	if _, err := Split(cidr(t, "fd00::/8"), 64); err == nil {
+		t.Error("Expected error splitting into too many blocks")
+	}
+
+	names = nil
+	Each(cidr(t, "10.0.0.254/31"), func(ip net.IP) bool {
+		names = append(names, ip.String())
+		return true
+	})
+	if got := strings.Join(names, " "); got != "10.0.0.254 10.0.0.255" {
+		t.Errorf("Unexpected addresses %s", got)
+	}
+	count := 0
+	Each(cidr(t, "255.255.255.0/24"), func(ip net.IP) bool {
+		count++
+		return true
+	})
+	if count != 256 {
+		t.Errorf("Expected 256 addresses, got %d", count)
+	}
+	count = 0
+	Each(cidr(t, "fd00::/64"), func(ip net.IP) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("Expected iteration to stop after 3 addresses, got %d", count)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// templateParameter matches references to parameters,
+// such as ${segment}, in string fields of templates.
+var templateParameter = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// PolicyTemplate is a policy whose string fields may refer to the
+// Parameters as ${name}. Policies are created from it by giving
+// values to the parameters (see PolicyTemplateInstance).
+type PolicyTemplate struct {
+	ID          uint64   `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Parameters  []string `json:"parameters,omitempty"`
+	Policy      Policy   `json:"policy"`
+}
+
+// PolicyTemplateInstance gives values to parameters of a template.
+type PolicyTemplateInstance struct {
+	Parameters map[string]string `json:"parameters"`
+}
+
+// usedParameters returns parameters the policy of the template refers to, sorted.
+func (t PolicyTemplate) usedParameters() ([]string, error) {
+	doc, err := json.Marshal(t.Policy)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var used []string
+	for _, match := range templateParameter.FindAllStringSubmatch(string(doc), -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			used = append(used, match[1])
+		}
+	}
+	sort.Strings(used)
+	return used, nil
+}
+
+// Validate returns an Unprocessable Entity (422) HttpError if the
+// template has no name or its parameters and the references to them
+// in the policy do not match.
+func (t PolicyTemplate) Validate() error {
+	var errMsg []string
+	if strings.TrimSpace(t.Name) == "" {
+		errMsg = append(errMsg, "Name is required.")
+	}
+	declared := make(map[string]bool)
+	for _, param := range t.Parameters {
+		if !templateParameter.MatchString("${" + param + "}") {
+			errMsg = append(errMsg, fmt.Sprintf("Invalid parameter name '%s'.", param))
+		}
+		declared[param] = true
+	}
+	used, err := t.usedParameters()
+	if err != nil {
+		return err
+	}
+	for _, param := range used {
+		if !declared[param] {
+			errMsg = append(errMsg, fmt.Sprintf("Parameter %s is used but not declared.", param))
+		}
+		delete(declared, param)
+	}
+	for _, param := range t.Parameters {
+		if declared[param] {
+			errMsg = append(errMsg, fmt.Sprintf("Parameter %s is declared but not used.", param))
+		}
+	}
+	if len(errMsg) == 0 {
+		return nil
+	}
+	return NewUnprocessableEntityError(errMsg)
+}
+
+// Instantiate returns the policy of the template with references
+// to parameters replaced by their values. All parameters of the
+// template, and no others, must be given.
+func (t PolicyTemplate) Instantiate(params map[string]string) (Policy, error) {
+	policy := Policy{}
+	var errMsg []string
+	for _, param := range t.Parameters {
+		if _, ok := params[param]; !ok {
+			errMsg = append(errMsg, fmt.Sprintf("Parameter %s is required.", param))
+		}
+	}
+	var unknown []string
+	for param := range params {
+		if !containsString(t.Parameters, param) {
+			unknown = append(unknown, param)
+		}
+	}
+	sort.Strings(unknown)
+	for _, param := range unknown {
+		errMsg = append(errMsg, fmt.Sprintf("Unknown parameter %s.", param))
+	}
+	if len(errMsg) > 0 {
+		return policy, NewUnprocessableEntityError(errMsg)
+	}
+	doc, err := json.Marshal(t.Policy)
+	if err != nil {
+		return policy, err
+	}
+	// Values are substituted within JSON strings, so they are
+	// escaped as JSON strings, without the quotes.
+	doc = templateParameter.ReplaceAllFunc(doc, func(ref []byte) []byte {
+		value, _ := json.Marshal(params[string(ref[2:len(ref)-1])])
+		return value[1 : len(value)-1]
+	})
+	if err := json.Unmarshal(doc, &policy); err != nil {
+		return policy, err
+	}
+	policy.ID = 0
+	policy.Revision = 0
+	return policy, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
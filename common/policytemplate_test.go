@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"testing"
+)
+
+// TestPolicyTemplate tests validation of templates
+// and substitution of their parameters.
+func TestPolicyTemplate(t *testing.T) {
+	template := PolicyTemplate{
+		Name:       "web",
+		Parameters: []string{"segment", "tier"},
+		Policy: Policy{
+			Name:      "${segment}-web",
+			AppliedTo: []Endpoint{{TenantName: "${segment}", SegmentName: "${segment}"}},
+			Rules:     Rules{Rule{Protocol: "tcp", Ports: []uint{80}}},
+		},
+	}
+	err := template.Validate()
+	if err == nil {
+		t.Fatal("Unexpected nil")
+	}
+	det := (err.(HttpError).Details).([]string)
+	expect(t, det[0], "Parameter tier is declared but not used.")
+	template.Parameters = []string{"segment", "a-b"}
+	template.Policy.Description = "${tier}"
+	det = (template.Validate().(HttpError).Details).([]string)
+	expect(t, det[0], "Invalid parameter name 'a-b'.")
+	expect(t, det[1], "Parameter tier is used but not declared.")
+	expect(t, det[2], "Parameter a-b is declared but not used.")
+
+	template.Parameters = []string{"segment", "tier"}
+	if err = template.Validate(); err != nil {
+		t.Fatalf("Unexpected %s", err)
+	}
+	_, err = template.Instantiate(map[string]string{"segment": "x", "zone": "y"})
+	det = (err.(HttpError).Details).([]string)
+	expect(t, det[0], "Parameter tier is required.")
+	expect(t, det[1], "Unknown parameter zone.")
+	policy, err := template.Instantiate(map[string]string{"segment": `front"end`, "tier": "web & api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, policy.Name, `front"end-web`)
+	expect(t, policy.AppliedTo[0].SegmentName, `front"end`)
+	expect(t, policy.Description, "web & api")
+	expect(t, template.Policy.Name, "${segment}-web")
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is how many rate limiter buckets are kept
+// before buckets of keys that have not been limited lately
+// are dropped.
+const maxIdleBuckets = 1024
+
+// RateLimiter limits the rate of requests of each tenant (or other
+// key) with a token bucket per key: requests of a key may burst up to
+// burst requests, after which they are allowed at rate requests per
+// second. A nil *RateLimiter allows every request, so that services
+// may call it whether or not limiting is configured.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	// now is time.Now, replaced by tests.
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate requests per
+// second of each key, with bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow reports whether a request of the key is allowed now,
+// taking a token from its bucket if it is.
+func (l *RateLimiter) Allow(key string) bool {
+	_, ok := l.allowAll([]string{key})
+	return ok
+}
+
+// allowAll reports whether a request of all the keys, which are
+// distinct, is allowed now, taking a token from the bucket of each
+// only if it is. Otherwise it returns the first key not allowed.
+func (l *RateLimiter) allowAll(keys []string) (string, bool) {
+	if l == nil {
+		return "", true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = l.bucket(key, now)
+		if buckets[i].tokens < 1 {
+			return key, false
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return "", true
+}
+
+// bucket returns the bucket of the key, refilled until now.
+// The caller holds mu.
+func (l *RateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFull(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// dropFull forgets buckets that would have refilled by now, which are
+// the same as the new buckets of their keys.
+func (l *RateLimiter) dropFull(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Check returns an HttpError with status 429 (too many requests)
+// if a request of the key, such as "tenant 3", is not allowed now,
+// and nil otherwise.
+func (l *RateLimiter) Check(key string) error {
+	return l.CheckAll([]string{key})
+}
+
+// CheckAll is Check of a request counting against all the keys,
+// which are distinct: either each key is charged for the request,
+// or, if any of them is not allowed now, none is.
+func (l *RateLimiter) CheckAll(keys []string) error {
+	key, ok := l.allowAll(keys)
+	if ok {
+		return nil
+	}
+	details := fmt.Sprintf("Too many requests of %s: the limit is %g per second with bursts of %g", key, l.rate, l.burst)
+	return NewHttpError(StatusTooManyRequests, details)
+}
+
+// ParseRateLimit returns the RateLimiter configured by the
+// rate_limit section of the service-specific configuration, such as
+//
+//	rate_limit:
+//	  requests_per_second: 10
+//	  burst: 20
+//
+// or nil if there is no such section. Burst defaults to
+// requests_per_second, rounded up.
+func ParseRateLimit(serviceSpecific map[string]interface{}) (*RateLimiter, error) {
+	section, ok := serviceSpecific["rate_limit"]
+	if !ok {
+		return nil, nil
+	}
+	sectionMap, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid rate_limit configuration %v", section))
+	}
+	rate, ok := sectionMap["requests_per_second"].(float64)
+	if !ok || rate <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid requests_per_second %v of rate_limit", sectionMap["requests_per_second"]))
+	}
+	burst := math.Ceil(rate)
+	if value, ok := sectionMap["burst"]; ok {
+		burst, ok = value.(float64)
+		if !ok || burst < 1 || burst != math.Floor(burst) {
+			return nil, errors.New(fmt.Sprintf("Invalid burst %v of rate_limit", value))
+		}
+	}
+	return NewRateLimiter(rate, int(burst)), nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	var nilLimiter *RateLimiter
+	expect(t, nilLimiter.Check("tenant 1"), nil)
+
+	now := time.Unix(1000, 0)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+	// A burst of 3, then nothing until the bucket refills.
+	for i := 0; i < 3; i++ {
+		expect2(t, fmt.Sprintf("request %d", i), limiter.Allow("tenant 1"), true)
+	}
+	expect(t, limiter.Allow("tenant 1"), false)
+	// Other tenants are not limited by tenant 1.
+	expect(t, limiter.Allow("tenant 2"), true)
+	err := limiter.Check("tenant 1")
+	if httpErr, ok := err.(HttpError); !ok || httpErr.StatusCode != StatusTooManyRequests {
+		t.Errorf("Expected 429, got %v", err)
+	}
+	// A request of several keys is charged to all of them or,
+	// if any is not allowed, to none.
+	err = limiter.CheckAll([]string{"tenant 2", "tenant 1"})
+	if httpErr, ok := err.(HttpError); !ok || httpErr.StatusCode != StatusTooManyRequests {
+		t.Errorf("Expected 429, got %v", err)
+	}
+	expect(t, limiter.CheckAll([]string{"tenant 2", "tenant 3"}), nil)
+	expect(t, limiter.Allow("tenant 2"), true)
+	expect(t, limiter.Allow("tenant 2"), false)
+	// Two more requests are allowed every second.
+	now = now.Add(time.Second)
+	expect(t, limiter.Allow("tenant 1"), true)
+	expect(t, limiter.Allow("tenant 1"), true)
+	expect(t, limiter.Allow("tenant 1"), false)
+
+	limiter, err = ParseRateLimit(map[string]interface{}{})
+	if limiter != nil || err != nil {
+		t.Errorf("Expected no limiter, got %v, %v", limiter, err)
+	}
+	limiter, err = ParseRateLimit(map[string]interface{}{"rate_limit": map[string]interface{}{"requests_per_second": 2.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, limiter.burst, 3.0)
+	_, err = ParseRateLimit(map[string]interface{}{"rate_limit": map[string]interface{}{"requests_per_second": 1.0, "burst": 0.5}})
+	if err == nil {
+		t.Error("Expected error for invalid burst")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Registration of services with the root service.
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// registeredServices holds, for every service started in this process
+// that registered with root, the client to deregister it with.
+var registeredServices = struct {
+	sync.Mutex
+	clients map[string]*RestClient
+	once    sync.Once
+}{clients: make(map[string]*RestClient)}
+
+// registerService registers the service with root, and arranges for it to
+// be deregistered when the process receives SIGINT or SIGTERM. The addr
+// is host:port the service can be reached at (see advertisedAddress).
+func registerService(name string, addr string, clientConfig RestClientConfig) error {
+	client, err := NewRestClient(clientConfig)
+	if err != nil {
+		log.Printf("Error attempting to register service %s with root: %+v", name, err)
+		return err
+	}
+	reg := ServiceRegistration{Name: name, Url: "http://" + addr, Version: buildInfo}
+	err = client.RegisterService(reg)
+	if err != nil {
+		log.Printf("Error attempting to register service %s with root: %+v", name, err)
+		return err
+	}
+	log.Printf("Registered service %s with root: %+v", name, reg)
+
+	registeredServices.Lock()
+	registeredServices.clients[name] = client
+	registeredServices.Unlock()
+
+	handleShutdownSignals()
+	return nil
+}
+
+// shutdownHooks are run, in the order they were added, when
+// the process receives SIGINT or SIGTERM.
+var shutdownHooks = struct {
+	sync.Mutex
+	hooks []func()
+}{}
+
+// AddShutdownHook arranges for the hook to be run when the process
+// receives SIGINT or SIGTERM, after services are deregistered and
+// before the process exits.
+func AddShutdownHook(hook func()) {
+	shutdownHooks.Lock()
+	shutdownHooks.hooks = append(shutdownHooks.hooks, hook)
+	shutdownHooks.Unlock()
+	handleShutdownSignals()
+}
+
+// handleShutdownSignals deregisters services, runs shutdown hooks
+// and exits when the process receives SIGINT or SIGTERM.
+func handleShutdownSignals() {
+	registeredServices.once.Do(func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-sigChan
+			log.Printf("Received %s, deregistering services", sig)
+			DeregisterServices()
+			runShutdownHooks()
+			// An orderly stop, not a failure, for
+			// systemd and supervisors.
+			os.Exit(0)
+		}()
+	})
+}
+
+func runShutdownHooks() {
+	shutdownHooks.Lock()
+	defer shutdownHooks.Unlock()
+	for _, hook := range shutdownHooks.hooks {
+		hook()
+	}
+}
+
+// DeregisterServices deregisters from root all services
+// that registered themselves from this process.
+func DeregisterServices() {
+	registeredServices.Lock()
+	defer registeredServices.Unlock()
+	for name, client := range registeredServices.clients {
+		err := client.DeregisterService(name)
+		if err != nil {
+			log.Printf("Error deregistering service %s: %v", name, err)
+		} else {
+			log.Printf("Deregistered service %s", name)
+		}
+		delete(registeredServices.clients, name)
+	}
+}
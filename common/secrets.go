@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Secrets in configuration. Instead of the value itself, a sensitive
+// configuration value (such as a DB password) can be given as a
+// reference of the form
+//
+//   secret:env:VARIABLE          - value of environment variable
+//   secret:file:/path/to/file    - contents of the file
+//   secret:vault:path#field      - field of a Vault secret (field
+//                                  defaults to "value")
+//
+// The root service only ever stores and serves the reference; it is
+// resolved by the service using the value (see ResolveSecrets), so
+// that the value is not sent over the config API or logged.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// SecretPrefix starts a reference to a secret.
+	SecretPrefix = "secret:"
+
+	// Environment variables with the address of Vault server and
+	// token to authenticate to it with.
+	VaultAddrEnv  = "VAULT_ADDR"
+	VaultTokenEnv = "VAULT_TOKEN"
+
+	// Default field of a Vault secret.
+	defaultVaultField = "value"
+)
+
+// IsSecret returns true if the value is a reference to a secret.
+func IsSecret(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && strings.HasPrefix(s, SecretPrefix)
+}
+
+// parseSecret splits a secret reference into the source
+// of the secret and the reference within that source.
+func parseSecret(value string) (string, string, error) {
+	ref := strings.TrimPrefix(value, SecretPrefix)
+	idx := strings.Index(ref, ":")
+	if idx < 0 || idx == len(ref)-1 {
+		return "", "", NewError("Invalid secret reference %s", value)
+	}
+	source := ref[0:idx]
+	if source != "env" && source != "file" && source != "vault" {
+		return "", "", NewError("Unknown source of secret %s in %s", source, value)
+	}
+	return source, ref[idx+1:], nil
+}
+
+// ResolveSecret returns the value referenced by the provided secret
+// reference. Values that are not secret references are returned as is.
+func ResolveSecret(value string) (string, error) {
+	if !IsSecret(value) {
+		return value, nil
+	}
+	source, name, err := parseSecret(value)
+	if err != nil {
+		return "", err
+	}
+	switch source {
+	case "env":
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", NewError("Environment variable %s for secret is not set", name)
+		}
+		return secret, nil
+	case "file":
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		return readVaultSecret(name)
+	}
+}
+
+// ResolveSecrets returns a copy of the provided configuration map,
+// including nested maps, with secret references replaced with the
+// values they reference.
+func ResolveSecrets(configMap map[string]interface{}) (map[string]interface{}, error) {
+	if configMap == nil {
+		return nil, nil
+	}
+	retval := make(map[string]interface{})
+	for k, v := range configMap {
+		switch vt := v.(type) {
+		case string:
+			secret, err := ResolveSecret(vt)
+			if err != nil {
+				return nil, NewError("Cannot resolve %s: %s", k, err)
+			}
+			retval[k] = secret
+		case map[string]interface{}:
+			nested, err := ResolveSecrets(vt)
+			if err != nil {
+				return nil, err
+			}
+			retval[k] = nested
+		default:
+			retval[k] = v
+		}
+	}
+	return retval, nil
+}
+
+// readVaultSecret reads a field of a secret from Vault
+// (either version 1 or version 2 of the KV secrets engine).
+func readVaultSecret(ref string) (string, error) {
+	path := ref
+	field := defaultVaultField
+	if idx := strings.LastIndex(ref, "#"); idx >= 0 {
+		path = ref[0:idx]
+		field = ref[idx+1:]
+	}
+	vaultResp := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := vaultRequest("GET", path, nil, &vaultResp); err != nil {
+		return "", NewError("Error reading secret %s from Vault: %s", path, err)
+	}
+	data := vaultResp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		// KV version 2
+		data = nested
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", NewError("No field %s in secret %s", field, path)
+	}
+	return secret, nil
+}
+
+// vaultRequest sends a request with the body, if not nil, to the path
+// of the Vault API at VAULT_ADDR, authenticated with VAULT_TOKEN, and
+// decodes the response into result.
+func vaultRequest(method string, path string, body interface{}, result interface{}) error {
+	addr := os.Getenv(VaultAddrEnv)
+	if addr == "" {
+		return NewError("%s is not set", VaultAddrEnv)
+	}
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimRight(addr, "/"), strings.TrimLeft(path, "/"))
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv(VaultTokenEnv))
+	client := &http.Client{Timeout: DefaultRestTimeout * time.Millisecond}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewError("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSecrets(t *testing.T) {
+	os.Setenv("ROMANA_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("ROMANA_TEST_SECRET")
+	secretFile, err := ioutil.TempFile("", "romana_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString("filesecret\n")
+	secretFile.Close()
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/db":
+			w.Write([]byte(`{"data": {"password": "v1secret"}}`))
+		case "/v1/secret/data/db":
+			w.Write([]byte(`{"data": {"data": {"value": "v2secret"}, "metadata": {"version": 1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv(VaultAddrEnv, vault.URL)
+	defer os.Unsetenv(VaultAddrEnv)
+	os.Setenv(VaultTokenEnv, "token")
+	defer os.Unsetenv(VaultTokenEnv)
+
+	configMap := map[string]interface{}{
+		"plain": "value",
+		"port":  3306,
+		"store": map[string]interface{}{
+			"password": "secret:env:ROMANA_TEST_SECRET",
+			"token":    "secret:file:" + secretFile.Name(),
+			"vault1":   "secret:vault:secret/db#password",
+			"vault2":   "secret:vault:secret/data/db",
+		},
+	}
+	resolved, err := ResolveSecrets(configMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, resolved["plain"], "value")
+	expect(t, resolved["port"], 3306)
+	store := resolved["store"].(map[string]interface{})
+	expect(t, store["password"], "s3cret")
+	expect(t, store["token"], "filesecret")
+	expect(t, store["vault1"], "v1secret")
+	expect(t, store["vault2"], "v2secret")
+	// Original is not modified.
+	expect(t, configMap["store"].(map[string]interface{})["password"], "secret:env:ROMANA_TEST_SECRET")
+
+	for _, bad := range []string{"secret:env:ROMANA_NO_SUCH_VAR", "secret:nosuchsource:x", "secret:vault:secret/nothere", "secret:"} {
+		_, err = ResolveSecret(bad)
+		if err == nil {
+			t.Errorf("Expected error resolving %s", bad)
+		}
+	}
+}
@@ -34,6 +34,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/romana/core/common/features"
 )
 
 // ServiceUtils represents functionality common to various services.
@@ -71,7 +73,7 @@ type ServiceUtils struct {
 // of entities to find (for example, it has to be &[]Tenant{}, not Tenant{}),
 // which will then create /findOne/tenants (returning Tenant structure}
 // and /findAll/tenants (returning []Tenant array) routes.
-func CreateFindRoutes(entities interface{}, store Store) Routes {
+func CreateFindRoutes(entities interface{}, store Finder) Routes {
 	entityName := reflect.TypeOf(entities).Elem().Elem().String()
 	entityNameElements := strings.Split(entityName, ".")
 	if len(entityNameElements) == 2 {
@@ -85,28 +87,28 @@ func CreateFindRoutes(entities interface{}, store Store) Routes {
 			Method:  "GET",
 			Pattern: "/" + FindAll + pathSuffix,
 			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
-				return store.Find(ctx.QueryVariables, entities, FindAll)
+				return store.Find(ctx.Context, ctx.QueryVariables, entities, FindAll)
 			},
 		},
 		Route{
 			Method:  "GET",
 			Pattern: "/" + FindExactlyOne + pathSuffix,
 			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
-				return store.Find(ctx.QueryVariables, entities, FindExactlyOne)
+				return store.Find(ctx.Context, ctx.QueryVariables, entities, FindExactlyOne)
 			},
 		},
 		Route{
 			Method:  "GET",
 			Pattern: "/" + FindFirst + pathSuffix,
 			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
-				return store.Find(ctx.QueryVariables, entities, FindFirst)
+				return store.Find(ctx.Context, ctx.QueryVariables, entities, FindFirst)
 			},
 		},
 		Route{
 			Method:  "GET",
 			Pattern: "/" + FindLast + pathSuffix,
 			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
-				return store.Find(ctx.QueryVariables, entities, FindLast)
+				return store.Find(ctx.Context, ctx.QueryVariables, entities, FindLast)
 			},
 		},
 	}
@@ -149,6 +151,18 @@ func (links Links) FindByRel(rel string) string {
 
 }
 
+// FindAllByRel is like FindByRel but returns hrefs
+// of all links with the given rel value.
+func (links Links) FindAllByRel(rel string) []string {
+	var retval []string
+	for i := range links {
+		if links[i].Rel == rel {
+			retval = append(retval, links[i].Href)
+		}
+	}
+	return retval
+}
+
 // Service is the interface that microservices implement.
 type Service interface {
 	// SetConfig sets the configuration, validating it if needed
@@ -177,18 +191,17 @@ type Service interface {
 func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo, error) {
 	log.Printf("Initializing service %s with %v", service.Name(), config.Common.Api)
 
-	routes := service.Routes()
+	routes := trackHealth(service, trackDeprecation(service, addSnapshotRoutes(service, service.Routes())))
+	startingService()
 
 	// Validate hooks
 	hooks := config.Common.Api.Hooks
 	for i, hook := range hooks {
-		if strings.ToLower(hook.When) != "before" && strings.ToLower(hook.When) != "after" {
-			return nil, errors.New(fmt.Sprintf("InitializeService(): Invalid value for when: %s", hook.When))
+		err := hook.validate()
+		if err != nil {
+			return nil, err
 		}
 		m := strings.ToUpper(hook.Method)
-		if m != "POST" && m != "PUT" && m != "GET" && m != "DELETE" && m != "HEAD" {
-			return nil, errors.New(fmt.Sprintf("Invalid method: %s", m))
-		}
 		found := false
 		for j, _ := range routes {
 			r := &routes[j]
@@ -215,7 +228,25 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 			return nil, errors.New(fmt.Sprintf("%s is not an executable", hook.Executable))
 		}
 	}
-	err := service.SetConfig(config)
+	// Values of secrets are only ever known to the service itself.
+	serviceSpecific, err := ResolveSecrets(config.ServiceSpecific)
+	if err != nil {
+		return nil, err
+	}
+	config.ServiceSpecific = serviceSpecific
+	features.Set(service.Name(), config.Common.Features)
+	if enabled := features.List(service.Name()); len(enabled) > 0 {
+		log.Printf("%s: Enabled features: %s", service.Name(), strings.Join(enabled, ", "))
+	}
+	faults, err := parseRestFaults(config.ServiceSpecific)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		log.Printf("%s: Injecting faults into handling of requests", service.Name())
+		routes = faults.wrap(routes)
+	}
+	err = service.SetConfig(config)
 	if err != nil {
 		return nil, err
 	}
@@ -223,6 +254,10 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 	if err != nil {
 		return nil, err
 	}
+	err = startMaintenance(service, config.ServiceSpecific)
+	if err != nil {
+		return nil, err
+	}
 	// Create negroni
 	negroni := negroni.New()
 
@@ -234,6 +269,13 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 	// where w is http.ResponseWriter
 	negroni.Use(NewNegotiator())
 
+	// Refuse bodies too large before they are read.
+	maxRequestBytes := config.Common.Api.MaxRequestBytes
+	if maxRequestBytes <= 0 {
+		maxRequestBytes = DefaultMaxRequestBytes
+	}
+	negroni.Use(RequestLimitMiddleware{MaxBytes: maxRequestBytes})
+
 	// Unmarshal data from the content-type format
 	// into a map
 	negroni.Use(NewUnmarshaller())
@@ -248,7 +290,26 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 	// We use the public key of root server to check the token.
 	authMiddleware := AuthMiddleware{PublicKey: config.Common.PublicKey}
 	negroni.Use(authMiddleware)
+	if config.Common.Api.Diagnostics != "" {
+		addr, err := serveDiagnostics(config.Common.Api.Diagnostics, config.Common.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%s: Serving diagnostics at %s", service.Name(), addr)
+	}
+	if config.Common.Api.Statsd != "" {
+		err = pushMetricsToStatsd(config.Common.Api.Statsd, config.Common.Api.StatsdPrefix, config.Common.Api.DogStatsD)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%s: Pushing metrics to StatsD at %s", service.Name(), config.Common.Api.Statsd)
+	}
 
+	if config.Common.Api.StrictJSON {
+		for i := range routes {
+			routes[i].StrictJSON = true
+		}
+	}
 	router := newRouter(routes)
 
 	timeoutMillis := config.Common.Api.RestTimeoutMillis
@@ -275,13 +336,23 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 	svcInfo, err := RunNegroni(negroni, hostPort, readWriteDur)
 
 	if err == nil {
-		addr := svcInfo.Address
+		runningServices.Lock()
+		h := runningServices.health[service]
+		runningServices.Unlock()
+		h.Lock()
+		h.addr = servingAddress(svcInfo.Address)
+		h.Unlock()
+
+		addr := advertisedAddress(hostPort, svcInfo.Address)
 		if addr != hostPort {
-			log.Printf("Requested address %s, real %s\n", hostPort, addr)
-			idx := strings.LastIndex(addr, ":")
-			config.Common.Api.Host = addr[0:idx]
-			port, _ := strconv.Atoi(addr[idx+1:])
-			port64 := uint64(port)
+			log.Printf("Requested address %s, real %s, advertising %s\n", hostPort, svcInfo.Address, addr)
+		}
+		idx := strings.LastIndex(addr, ":")
+		config.Common.Api.Host = addr[0:idx]
+		port, _ := strconv.Atoi(addr[idx+1:])
+		port64 := uint64(port)
+		if port64 != config.Common.Api.Port {
+			// Port was assigned by the system (port 0 was requested).
 			config.Common.Api.Port = port64
 			// Also register this with root service if we are not root ourselves.
 			if service.Name() != ServiceRoot {
@@ -291,7 +362,7 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 				if retries <= 0 {
 					retries = DefaultRestRetries
 				}
-				clientConfig := RestClientConfig{TimeoutMillis: timeoutMillis, Retries: retries, RootURL: config.Common.Api.RootServiceUrl, TestMode: config.Common.Api.RestTestMode}
+				clientConfig := RestClientConfig{TimeoutMillis: timeoutMillis, Retries: retries, RootURL: config.Common.Api.RootServiceUrl, TestMode: config.Common.Api.RestTestMode, CallLog: config.Common.Api.CallLog}
 				log.Printf("InitializeService() : Initializing Rest client with %v", clientConfig)
 				client, err := NewRestClient(clientConfig)
 				if err != nil {
@@ -307,10 +378,43 @@ func InitializeService(service Service, config ServiceConfig) (*RestServiceInfo,
 				}
 			}
 		}
+		rootURL := config.Common.Api.RootServiceUrl
+		if service.Name() != ServiceRoot && rootURL != "" && !config.Common.Api.RestTestMode {
+			clientConfig := GetRestClientConfig(config)
+			clientConfig.Credential = config.Common.Credential
+			// Do not hold up startup of the service if root is slow;
+			// the service is only ready once registered, though.
+			go func() {
+				if registerService(service.Name(), config.Common.Api.GetHostPort(), clientConfig) == nil {
+					serviceReady(service.Name())
+				}
+			}()
+		} else {
+			serviceReady(service.Name())
+		}
 	}
 	return svcInfo, err
 }
 
+// advertisedAddress returns host:port at which other services can reach
+// a service that asked to listen on requested and is listening on
+// actual. The port is the actual one (which differs from requested when
+// port 0 was asked for); the host is the requested one unless it means
+// "all interfaces", in which case it is this machine's hostname.
+func advertisedAddress(requested string, actual string) string {
+	host := requested[0:strings.LastIndex(requested, ":")]
+	port := actual[strings.LastIndex(actual, ":")+1:]
+	if ip := net.ParseIP(strings.Trim(host, "[]")); host == "" || (ip != nil && ip.IsUnspecified()) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Cannot determine hostname, advertising %s: %s", actual, err)
+			return actual
+		}
+		host = hostname
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
 // RunNegroni is a convenience function that runs the negroni stack as a
 // provided HTTP server, with the following caveats:
 // 1. the Handler field of the provided serverConfig should be nil,
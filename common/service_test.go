@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+// TestAdvertisedAddress tests the address services advertise to root.
+func TestAdvertisedAddress(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct{ requested, actual, expected string }{
+		{"localhost:0", "127.0.0.1:4567", "localhost:4567"},
+		{"10.1.1.1:9600", "10.1.1.1:9600", "10.1.1.1:9600"},
+		{":0", "[::]:4567", hostname + ":4567"},
+		{"0.0.0.0:9600", "0.0.0.0:9600", hostname + ":9600"},
+		{"[::1]:0", "[::1]:4567", "[::1]:4567"},
+	}
+	for _, c := range cases {
+		addr := advertisedAddress(c.requested, c.actual)
+		if addr != c.expected {
+			t.Errorf("Expected %s for %s listening on %s, got %s", c.expected, c.requested, c.actual, addr)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Optional logging of slow database statements, to find those in need
+// of an index. It is enabled in the "store" section:
+//
+//   "store": {
+//     "type": "mysql",
+//     ...
+//     "slow_query_millis": 100
+//   }
+//
+// Queries, creates, updates and deletes made through gorm that take
+// longer than slow_query_millis are logged with their arguments and
+// query plan, as given by EXPLAIN (EXPLAIN QUERY PLAN in SQLite).
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// slowQueryStartKey is the scope setting keeping
+// when the statement of the scope started.
+const slowQueryStartKey = "romana:slow_query_start"
+
+// slowQueries logs slow statements.
+type slowQueries struct {
+	threshold time.Duration
+	dbType    string
+}
+
+// parseSlowQueries parses slow_query_millis of the store
+// configuration, returning nil if it is not set.
+func parseSlowQueries(storeConfig map[string]interface{}) (*slowQueries, error) {
+	value, ok := storeConfig["slow_query_millis"]
+	if !ok {
+		return nil, nil
+	}
+	millis, ok := value.(float64)
+	if !ok || millis < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid slow_query_millis %v", value))
+	}
+	dbType, _ := storeConfig["type"].(string)
+	return &slowQueries{threshold: time.Duration(millis) * time.Millisecond, dbType: dbType}, nil
+}
+
+// register makes the database time statements made
+// through gorm and log the slow ones.
+func (q *slowQueries) register(db *gorm.DB) {
+	start := func(scope *gorm.Scope) {
+		scope.Set(slowQueryStartKey, time.Now())
+	}
+	end := func(scope *gorm.Scope) {
+		value, ok := scope.Get(slowQueryStartKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(value.(time.Time))
+		if elapsed < q.threshold {
+			return
+		}
+		// The plan is read on a connection of its own, since the
+		// statement may be in a transaction with rows still open.
+		plan, err := q.explain(db.DB(), scope.SQL, scope.SQLVars)
+		if err != nil {
+			plan = fmt.Sprintf("cannot explain: %s", err)
+		}
+		log.Printf("Slow query (%v): %s %v\n%s", elapsed, scope.SQL, scope.SQLVars, plan)
+	}
+	db.Callback().Query().Before("gorm:query").Register(slowQueryStartKey, start)
+	db.Callback().Query().After("gorm:query").Register("romana:slow_query_log", end)
+	db.Callback().RowQuery().Before("gorm:row_query").Register(slowQueryStartKey, start)
+	db.Callback().RowQuery().After("gorm:row_query").Register("romana:slow_query_log", end)
+	db.Callback().Create().Before("gorm:create").Register(slowQueryStartKey, start)
+	db.Callback().Create().After("gorm:create").Register("romana:slow_query_log", end)
+	db.Callback().Update().Before("gorm:update").Register(slowQueryStartKey, start)
+	db.Callback().Update().After("gorm:update").Register("romana:slow_query_log", end)
+	db.Callback().Delete().Before("gorm:delete").Register(slowQueryStartKey, start)
+	db.Callback().Delete().After("gorm:delete").Register("romana:slow_query_log", end)
+}
+
+// explain returns the query plan of the statement,
+// one line per row of the result of EXPLAIN.
+func (q *slowQueries) explain(db *sql.DB, statement string, vars []interface{}) (string, error) {
+	explain := "EXPLAIN "
+	if q.dbType == "sqlite3" {
+		explain = "EXPLAIN QUERY PLAN "
+	}
+	rows, err := db.Query(explain+statement, vars...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		fields := make([]string, len(values))
+		for i, value := range values {
+			fields[i] = value.String
+		}
+		lines = append(lines, strings.Join(fields, " "))
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSlowQueries tests logging of slow statements with their plans.
+func TestSlowQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slowqueries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &DbStore{}
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/slow.sqlite3", "slow_query_millis": float64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	store.Db.CreateTable(&uniqueRecord{})
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	var found []uniqueRecord
+	store.Db.Where("name = ?", "a").Find(&found)
+	log.SetOutput(os.Stderr)
+	logged := out.String()
+	if !strings.Contains(logged, "Slow query") || !strings.Contains(logged, "[a]") {
+		t.Errorf("Expected query to be logged, got %s", logged)
+	}
+	// The unique name has an index to search.
+	if !strings.Contains(logged, "INDEX") {
+		t.Errorf("Expected query plan using an index, got %s", logged)
+	}
+
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "x", "slow_query_millis": "fast"})
+	if err == nil {
+		t.Error("Expected error for invalid slow_query_millis")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Snapshots of stores of services, taken and restored at SnapshotPath
+// for backups (see Backup).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SnapshotPath is where a Service implementing Snapshotter serves
+// snapshots of its store (GET) and restores them (PUT).
+const SnapshotPath = "/snapshot"
+
+// snapshotTimeFormat is how times are kept in snapshots, in UTC,
+// so that both SQLite and MySQL take them back.
+const snapshotTimeFormat = "2006-01-02 15:04:05.999999"
+
+// Snapshotter may be implemented by a Service, or by a store, that
+// keeps its state in a database, so that the state can be backed up
+// and restored.
+type Snapshotter interface {
+	// Snapshot returns the content of all tables of the store.
+	Snapshot(ctx context.Context) (StoreSnapshot, error)
+	// Restore replaces the content of all tables of the
+	// store with that of the snapshot, or changes nothing.
+	Restore(ctx context.Context, snapshot StoreSnapshot) error
+}
+
+// StoreSnapshot is the content of the tables of the store
+// of a service.
+type StoreSnapshot struct {
+	Service string          `json:"service"`
+	Tables  []TableSnapshot `json:"tables"`
+}
+
+// Table returns the table of the snapshot with the
+// name, or nil if there is none.
+func (s StoreSnapshot) Table(name string) *TableSnapshot {
+	for i := range s.Tables {
+		if s.Tables[i].Name == name {
+			return &s.Tables[i]
+		}
+	}
+	return nil
+}
+
+// TableSnapshot is the rows of a table, each with the values
+// of the columns in the order of Columns. Values are strings,
+// integers, floats, booleans or nil.
+type TableSnapshot struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, keeping integers
+// as integers rather than floats, which may not hold them.
+func (t *TableSnapshot) UnmarshalJSON(data []byte) error {
+	// Without methods, so as not to recurse.
+	type table TableSnapshot
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode((*table)(t)); err != nil {
+		return err
+	}
+	for _, row := range t.Rows {
+		for i, value := range row {
+			n, ok := value.(json.Number)
+			if !ok {
+				continue
+			}
+			if row[i], ok = numberValue(n); !ok {
+				return errors.New(fmt.Sprintf("Invalid number %s in table %s", n, t.Name))
+			}
+		}
+	}
+	return nil
+}
+
+// numberValue returns n as an int64 if it is an integer,
+// as a float64 otherwise.
+func numberValue(n json.Number) (interface{}, bool) {
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// Value returns the value of the column in the row
+// of the table, or nil if there is no such column.
+func (t TableSnapshot) Value(row []interface{}, column string) interface{} {
+	for i, c := range t.Columns {
+		if c == column && i < len(row) {
+			return row[i]
+		}
+	}
+	return nil
+}
+
+// Snapshot implements Snapshotter, reading the tables of the entities
+// of the ServiceStore in a transaction, so that they are consistent.
+func (dbStore *DbStore) Snapshot(ctx context.Context) (StoreSnapshot, error) {
+	snapshot := StoreSnapshot{}
+	tx := dbStore.Db.Begin()
+	if tx.Error != nil {
+		return snapshot, tx.Error
+	}
+	defer tx.Rollback()
+	for _, entity := range dbStore.ServiceStore.Entities() {
+		if err := CheckContext(ctx); err != nil {
+			return snapshot, err
+		}
+		table, err := snapshotTable(tx, entity)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Tables = append(snapshot.Tables, table)
+	}
+	return snapshot, nil
+}
+
+// snapshotTable reads the table of the entity.
+func snapshotTable(tx *gorm.DB, entity interface{}) (TableSnapshot, error) {
+	scope := tx.NewScope(entity)
+	table := TableSnapshot{Name: scope.TableName()}
+	rows, err := tx.Raw(fmt.Sprintf("SELECT * FROM %s", scope.Quote(table.Name))).Rows()
+	if err != nil {
+		return table, err
+	}
+	defer rows.Close()
+	if table.Columns, err = rows.Columns(); err != nil {
+		return table, err
+	}
+	for rows.Next() {
+		row := make([]interface{}, len(table.Columns))
+		dest := make([]interface{}, len(row))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return table, err
+		}
+		for i, value := range row {
+			switch value := value.(type) {
+			case []byte:
+				row[i] = string(value)
+			case time.Time:
+				row[i] = value.UTC().Format(snapshotTimeFormat)
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, rows.Err()
+}
+
+// Restore implements Snapshotter in a transaction. Tables of the
+// ServiceStore the snapshot does not have are emptied; columns
+// it does not have get their defaults.
+func (dbStore *DbStore) Restore(ctx context.Context, snapshot StoreSnapshot) error {
+	entities := dbStore.ServiceStore.Entities()
+	known := make(map[string]bool)
+	for _, entity := range entities {
+		known[dbStore.Db.NewScope(entity).TableName()] = true
+	}
+	for _, table := range snapshot.Tables {
+		if !known[table.Name] {
+			return NewError400(fmt.Sprintf("Unknown table %s", table.Name))
+		}
+		for _, row := range table.Rows {
+			if len(row) != len(table.Columns) {
+				return NewError400(fmt.Sprintf("Expected %d values in rows of table %s, got %d", len(table.Columns), table.Name, len(row)))
+			}
+		}
+	}
+	tx := dbStore.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, entity := range entities {
+		if err := restoreTable(ctx, tx, entity, snapshot); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// restoreTable replaces the rows of the table of the
+// entity with those in the snapshot.
+func restoreTable(ctx context.Context, tx *gorm.DB, entity interface{}, snapshot StoreSnapshot) error {
+	if err := CheckContext(ctx); err != nil {
+		return err
+	}
+	scope := tx.NewScope(entity)
+	name := scope.Quote(scope.TableName())
+	// Not through gorm, which would only mark records
+	// of entities with DeletedAt as deleted.
+	if err := tx.Exec(fmt.Sprintf("DELETE FROM %s", name)).Error; err != nil {
+		return err
+	}
+	table := snapshot.Table(scope.TableName())
+	if table == nil || len(table.Rows) == 0 {
+		return nil
+	}
+	columns := make([]string, len(table.Columns))
+	params := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = scope.Quote(column)
+		params[i] = "?"
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", name, strings.Join(columns, ","), strings.Join(params, ","))
+	for _, row := range table.Rows {
+		if err := CheckContext(ctx); err != nil {
+			return err
+		}
+		if err := tx.Exec(insert, row...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotStore returns the snapshot of the store, if it
+// implements Snapshotter, for a Service to implement it.
+func SnapshotStore(ctx context.Context, store interface{}) (StoreSnapshot, error) {
+	snapshotter, ok := store.(Snapshotter)
+	if !ok {
+		return StoreSnapshot{}, errNoSnapshots(store)
+	}
+	return snapshotter.Snapshot(ctx)
+}
+
+// RestoreStore restores the snapshot into the store, if it
+// implements Snapshotter, for a Service to implement it.
+func RestoreStore(ctx context.Context, store interface{}, snapshot StoreSnapshot) error {
+	snapshotter, ok := store.(Snapshotter)
+	if !ok {
+		return errNoSnapshots(store)
+	}
+	return snapshotter.Restore(ctx, snapshot)
+}
+
+func errNoSnapshots(store interface{}) error {
+	return NewHttpError(http.StatusNotImplemented, fmt.Sprintf("Store %T cannot be backed up", store))
+}
+
+// addSnapshotRoutes returns the routes with the SnapshotPath
+// routes added if the service implements Snapshotter.
+func addSnapshotRoutes(service Service, routes Routes) Routes {
+	snapshotter, ok := service.(Snapshotter)
+	if !ok {
+		return routes
+	}
+	return append(routes,
+		Route{
+			Method:  "GET",
+			Pattern: SnapshotPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				snapshot, err := snapshotter.Snapshot(ctx.Context)
+				if err != nil {
+					return nil, err
+				}
+				snapshot.Service = service.Name()
+				return snapshot, nil
+			},
+		},
+		Route{
+			Method:  "PUT",
+			Pattern: SnapshotPath,
+			Handler: func(input interface{}, ctx RestContext) (interface{}, error) {
+				snapshot := input.(*StoreSnapshot)
+				if snapshot.Service != service.Name() {
+					return nil, NewError400(fmt.Sprintf("Snapshot of %s cannot be restored into %s", snapshot.Service, service.Name()))
+				}
+				if err := snapshotter.Restore(ctx.Context, *snapshot); err != nil {
+					return nil, err
+				}
+				return snapshotSummary(*snapshot), nil
+			},
+			MakeMessage: func() interface{} { return &StoreSnapshot{} },
+		},
+	)
+}
+
+// snapshotSummary returns the number of rows in
+// each table of the snapshot.
+func snapshotSummary(snapshot StoreSnapshot) map[string]int {
+	summary := make(map[string]int)
+	for _, table := range snapshot.Tables {
+		summary[table.Name] = len(table.Rows)
+	}
+	return summary
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type snapshotRecord struct {
+	ID        uint64 `sql:"AUTO_INCREMENT"`
+	Name      string
+	Big       uint64
+	Active    bool
+	Seen      time.Time
+	DeletedAt *time.Time
+}
+
+// snapshotStore is a ServiceStore of snapshotRecords.
+type snapshotStore struct {
+	DbStore
+}
+
+func (s *snapshotStore) Entities() []interface{} {
+	return []interface{}{&snapshotRecord{}}
+}
+
+func (s *snapshotStore) CreateSchemaPostProcess() error {
+	return nil
+}
+
+// TestSnapshotRestore tests restoring tables of
+// a store from a snapshot taken of them.
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &snapshotStore{}
+	store.ServiceStore = store
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/snapshot.sqlite3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateSchema(true); err != nil {
+		t.Fatal(err)
+	}
+	seen := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	records := []snapshotRecord{
+		{Name: "a", Big: 1<<60 + 1, Active: true, Seen: seen},
+		{Name: "b", Seen: seen},
+	}
+	if err := store.CreateAll(nil, records); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted records are kept too.
+	store.Db.Delete(&records[1])
+
+	snapshot, err := store.Snapshot(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As sent to the service.
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot = StoreSnapshot{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, len(snapshot.Tables), 1)
+
+	store.Db.Exec("DELETE FROM snapshot_records")
+	store.Db.Create(&snapshotRecord{Name: "c"})
+	if err := store.Restore(nil, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var restored []snapshotRecord
+	store.Db.Unscoped().Order("id").Find(&restored)
+	if len(restored) != 2 {
+		t.Fatalf("Expected 2 records restored, got %v", restored)
+	}
+	a, b := restored[0], restored[1]
+	if a.ID != records[0].ID || a.Name != "a" || a.Big != 1<<60+1 || !a.Active || !a.Seen.Equal(seen) || a.DeletedAt != nil {
+		t.Errorf("Unexpected record restored %+v", a)
+	}
+	if b.Name != "b" || b.Active || b.DeletedAt == nil {
+		t.Errorf("Unexpected record restored %+v", b)
+	}
+	// New records do not reuse IDs of those restored.
+	c := snapshotRecord{Name: "c"}
+	store.Db.Create(&c)
+	if c.ID <= b.ID {
+		t.Errorf("Expected ID after %d, got %d", b.ID, c.ID)
+	}
+
+	// Snapshots not matching the store change nothing.
+	for _, invalid := range []StoreSnapshot{
+		{Tables: []TableSnapshot{{Name: "other"}}},
+		{Tables: []TableSnapshot{{Name: "snapshot_records", Columns: []string{"id", "name"}, Rows: [][]interface{}{{int64(1)}}}}},
+		{Tables: []TableSnapshot{{Name: "snapshot_records", Columns: []string{"id", "missing"}, Rows: [][]interface{}{{int64(1), "x"}}}}},
+	} {
+		if err := store.Restore(nil, invalid); err == nil {
+			t.Errorf("Expected error restoring %+v", invalid)
+		}
+	}
+	var count int
+	store.Db.Unscoped().Model(&snapshotRecord{}).Count(&count)
+	expect(t, count, 3)
+}
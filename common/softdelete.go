@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Soft deletion of entities with a DeletedAt field:
+//
+//   DeletedAt *time.Time `json:"deleted_at,omitempty"`
+//
+// gorm marks such entities deleted rather than removing them, and
+// leaves them out of queries that are not Unscoped. Deleted entities
+// can be restored with Undelete for the grace period configured in
+// the "store" section, a day by default:
+//
+//   "store": {
+//     "type": "mysql",
+//     ...
+//     "deletion_grace_seconds": 3600
+//   }
+//
+// after which PurgeDeleted, run periodically as the purge_deleted
+// maintenance job (see maintenance.go), removes them.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultDeletionGrace is how long deleted entities
+// are kept unless configured otherwise.
+const DefaultDeletionGrace = 24 * time.Hour
+
+// Purger is implemented by stores that keep deleted
+// entities for a grace period.
+type Purger interface {
+	// DeletionGrace returns how long deleted entities are kept.
+	DeletionGrace() time.Duration
+	// PurgeDeleted removes entities deleted before the time,
+	// returning how many were removed.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
+
+// parseDeletionGrace parses deletion_grace_seconds
+// of the store configuration.
+func parseDeletionGrace(storeConfig map[string]interface{}) (time.Duration, error) {
+	value, ok := storeConfig["deletion_grace_seconds"]
+	if !ok {
+		return DefaultDeletionGrace, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok || seconds < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid deletion_grace_seconds %v", value))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// DeletionGrace implements Purger.
+func (dbStore *DbStore) DeletionGrace() time.Duration {
+	return dbStore.deletionGrace
+}
+
+// DeletionTime returns the time to mark entities deleted at with
+// SoftDelete. It is whole seconds, for it to be kept exactly by
+// databases that keep no fractions of seconds.
+func DeletionTime() time.Time {
+	return gorm.NowFunc().Truncate(time.Second)
+}
+
+// SoftDelete marks the entities of value's table matching the
+// condition deleted at the time, so that entities deleted together
+// can be found, and restored, together.
+func SoftDelete(db *gorm.DB, value interface{}, at time.Time, query string, args ...interface{}) error {
+	db = db.Model(value).Where(query, args...).UpdateColumn("deleted_at", at)
+	return GetDbErrors(db)
+}
+
+// Undelete restores the deleted entities of value's table matching
+// the condition, returning how many were restored.
+func Undelete(db *gorm.DB, value interface{}, query string, args ...interface{}) (int64, error) {
+	db = db.Unscoped().Model(value).Where("deleted_at IS NOT NULL").Where(query, args...).UpdateColumn("deleted_at", nil)
+	if err := GetDbErrors(db); err != nil {
+		return 0, err
+	}
+	return db.RowsAffected, nil
+}
+
+// softDeleted returns true if the entity is deleted softly.
+func softDeleted(entity interface{}) bool {
+	t := reflect.Indirect(reflect.ValueOf(entity)).Type()
+	field, ok := t.FieldByName("DeletedAt")
+	return ok && field.Type == reflect.TypeOf(&time.Time{})
+}
+
+// PurgeDeleted implements Purger, removing the entities of the
+// store that were deleted before the time.
+func (dbStore *DbStore) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	if err := CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	var purged int64
+	tx := dbStore.Db.Begin()
+	for _, entity := range dbStore.ServiceStore.Entities() {
+		if !softDeleted(entity) {
+			continue
+		}
+		db := tx.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before).Delete(entity)
+		if err := GetDbErrors(db); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		purged += db.RowsAffected
+	}
+	if err := GetDbErrors(tx.Commit()); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// purgeInterval returns how often entities deleted for the grace
+// period are purged by default: often enough for them not to be kept
+// much longer, but no more than once a second.
+func purgeInterval(grace time.Duration) time.Duration {
+	interval := grace / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
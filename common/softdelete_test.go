@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSoftDelete tests deleting records softly, restoring
+// them and purging them after the grace period.
+func TestSoftDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "softdelete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &snapshotStore{}
+	store.ServiceStore = store
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/softdelete.sqlite3", "deletion_grace_seconds": float64(60)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, store.DeletionGrace(), time.Minute)
+	if err = store.CreateSchema(true); err != nil {
+		t.Fatal(err)
+	}
+	records := []snapshotRecord{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	if err := store.CreateAll(nil, records); err != nil {
+		t.Fatal(err)
+	}
+	names := func() string {
+		var found []snapshotRecord
+		store.Db.Order("id").Find(&found)
+		var names []string
+		for _, r := range found {
+			names = append(names, r.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	deletedAt := DeletionTime()
+	if err := SoftDelete(store.Db, &snapshotRecord{}, deletedAt, "name IN (?)", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, names(), "c")
+	// Deleting again keeps the time of the first deletion.
+	if err := SoftDelete(store.Db, &snapshotRecord{}, deletedAt.Add(time.Hour), "name = ?", "a"); err != nil {
+		t.Fatal(err)
+	}
+	deleted := snapshotRecord{}
+	store.Db.Unscoped().Where("name = ?", "a").First(&deleted)
+	if deleted.DeletedAt == nil || !deleted.DeletedAt.Equal(deletedAt) {
+		t.Errorf("Expected a deleted at %v, got %v", deletedAt, deleted.DeletedAt)
+	}
+
+	n, err := Undelete(store.Db, &snapshotRecord{}, "name = ?", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, n, int64(1))
+	expect(t, names(), "b,c")
+	// Only deleted records are restored.
+	if n, _ = Undelete(store.Db, &snapshotRecord{}, "name = ?", "c"); n != 0 {
+		t.Errorf("Expected no record restored, got %d", n)
+	}
+
+	// Records deleted within the grace period are kept.
+	purged, err := store.PurgeDeleted(nil, deletedAt.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, purged, int64(0))
+	purged, err = store.PurgeDeleted(nil, deletedAt.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, purged, int64(1))
+	if n, _ = Undelete(store.Db, &snapshotRecord{}, "name = ?", "a"); n != 0 {
+		t.Errorf("Expected purged record not to be restored, got %d", n)
+	}
+	expect(t, names(), "b,c")
+
+	for _, invalid := range []interface{}{"60", float64(-1)} {
+		if _, err := parseDeletionGrace(map[string]interface{}{"deletion_grace_seconds": invalid}); err == nil {
+			t.Errorf("Expected error for deletion_grace_seconds %v", invalid)
+		}
+	}
+	if grace, _ := parseDeletionGrace(map[string]interface{}{}); grace != DefaultDeletionGrace {
+		t.Errorf("Expected default grace %v, got %v", DefaultDeletionGrace, grace)
+	}
+	expect(t, purgeInterval(time.Minute), 15*time.Second)
+	expect(t, purgeInterval(0), time.Second)
+	expect(t, purgeInterval(DefaultDeletionGrace), time.Hour)
+}
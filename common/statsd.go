@@ -0,0 +1,269 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Pushing metrics to StatsD, for monitoring that cannot scrape
+// MetricsPath of services. It is enabled in the api section:
+//
+//   api:
+//     host: 192.168.0.10
+//     port: 9600
+//     statsd: 127.0.0.1:8125
+//     statsd_prefix: prod.
+//     dogstatsd: true
+//
+// Increments of counters are sent as StatsD counters, values of
+// gauges as gauges and observations of histograms as timings (in
+// milliseconds for metrics in seconds) or, with DogStatsD, as
+// histograms. Labels are sent as tags with DogStatsD, and appended
+// to the name otherwise, in the order of labels of the metric, as
+// in prod.romana_deprecated_requests_total.tenant.GET./tenants:1|c.
+// Gauges whose values are computed when metrics are collected
+// (see NewGaugeFunc) are only served at MetricsPath.
+//
+// All metrics of the process are pushed to every StatsD server
+// configured for a service running in it.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statsdFlushInterval is how often metrics
+	// buffered by StatsdSink are sent.
+	statsdFlushInterval = time.Second
+
+	// statsdMaxPacket is the size of the largest packet StatsdSink
+	// sends, which fits the MTU of most networks.
+	statsdMaxPacket = 1432
+)
+
+// MetricLabel is a label of a metric with its value.
+type MetricLabel struct {
+	Name  string
+	Value string
+}
+
+// MetricsSink is pushed values of metrics of the process
+// as they are recorded (see AddMetricsSink).
+type MetricsSink interface {
+	// Count is called with an increment of a counter.
+	Count(name string, labels []MetricLabel, value float64)
+	// Gauge is called with a new value of a gauge.
+	Gauge(name string, labels []MetricLabel, value float64)
+	// Observe is called with a value observed by a histogram.
+	Observe(name string, labels []MetricLabel, value float64)
+}
+
+// Sinks metrics are pushed to.
+var metricsSinks struct {
+	sync.RWMutex
+	sinks []MetricsSink
+	// statsd are StatsdSinks by address (see pushMetricsToStatsd).
+	statsd map[string]*StatsdSink
+}
+
+// AddMetricsSink makes metrics of the process
+// be pushed to the sink from now on.
+func AddMetricsSink(sink MetricsSink) {
+	metricsSinks.Lock()
+	defer metricsSinks.Unlock()
+	metricsSinks.sinks = append(metricsSinks.sinks, sink)
+}
+
+// pushMetricsToStatsd pushes metrics to the StatsD server at addr,
+// unless they are pushed there already.
+func pushMetricsToStatsd(addr string, prefix string, dogStatsD bool) error {
+	metricsSinks.Lock()
+	defer metricsSinks.Unlock()
+	if _, ok := metricsSinks.statsd[addr]; ok {
+		return nil
+	}
+	sink, err := NewStatsdSink(addr, prefix, dogStatsD)
+	if err != nil {
+		return err
+	}
+	if metricsSinks.statsd == nil {
+		metricsSinks.statsd = make(map[string]*StatsdSink)
+	}
+	metricsSinks.statsd[addr] = sink
+	metricsSinks.sinks = append(metricsSinks.sinks, sink)
+	return nil
+}
+
+// Kinds of values pushed to sinks.
+const (
+	pushCount = iota
+	pushGauge
+	pushObserve
+)
+
+// pushMetric pushes a value of the metric to the sinks, if any.
+func pushMetric(kind int, desc metricDesc, labelValues []string, value float64) {
+	metricsSinks.RLock()
+	sinks := metricsSinks.sinks
+	metricsSinks.RUnlock()
+	if len(sinks) == 0 {
+		return
+	}
+	labels := make([]MetricLabel, len(desc.labels))
+	for i, label := range desc.labels {
+		labels[i] = MetricLabel{Name: label, Value: labelValues[i]}
+	}
+	for _, sink := range sinks {
+		switch kind {
+		case pushCount:
+			sink.Count(desc.name, labels, value)
+		case pushGauge:
+			sink.Gauge(desc.name, labels, value)
+		default:
+			sink.Observe(desc.name, labels, value)
+		}
+	}
+}
+
+// StatsdSink is a MetricsSink sending metrics to a StatsD server
+// over UDP, in the DogStatsD format (with tags) if asked to. Metrics
+// are buffered, and sent every statsdFlushInterval or once they fill
+// a packet. Metrics that cannot be sent are dropped.
+type StatsdSink struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+
+	sync.Mutex
+	buf bytes.Buffer
+	// lastErr is the last error sending metrics, logged only
+	// when it is different from that of the previous packet.
+	lastErr string
+}
+
+// NewStatsdSink returns a StatsdSink sending metrics to the server
+// at addr, their names prefixed with the prefix.
+func NewStatsdSink(addr string, prefix string, dogStatsD bool) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsdSink{conn: conn, prefix: prefix, dogStatsD: dogStatsD}
+	go func() {
+		for range time.Tick(statsdFlushInterval) {
+			s.Flush()
+		}
+	}()
+	return s, nil
+}
+
+// Count implements MetricsSink.
+func (s *StatsdSink) Count(name string, labels []MetricLabel, value float64) {
+	s.write(name, labels, formatValue(value), "c")
+}
+
+// Gauge implements MetricsSink.
+func (s *StatsdSink) Gauge(name string, labels []MetricLabel, value float64) {
+	if value < 0 {
+		// A leading sign would make it a change of the gauge.
+		s.write(name, labels, "0", "g")
+	}
+	s.write(name, labels, formatValue(value), "g")
+}
+
+// Observe implements MetricsSink.
+func (s *StatsdSink) Observe(name string, labels []MetricLabel, value float64) {
+	if strings.HasSuffix(name, "_seconds") {
+		s.write(name, labels, formatValue(value*1000), "ms")
+	} else if s.dogStatsD {
+		s.write(name, labels, formatValue(value), "h")
+	} else {
+		s.write(name, labels, formatValue(value), "ms")
+	}
+}
+
+// write buffers the metric in the StatsD format.
+func (s *StatsdSink) write(name string, labels []MetricLabel, value string, statsdType string) {
+	line := s.prefix + name
+	if s.dogStatsD {
+		line = fmt.Sprintf("%s:%s|%s", line, value, statsdType)
+		for i, label := range labels {
+			if i == 0 {
+				line += "|#"
+			} else {
+				line += ","
+			}
+			line += label.Name + ":" + statsdEscape(label.Value, false)
+		}
+	} else {
+		for _, label := range labels {
+			line += "." + statsdEscape(label.Value, true)
+		}
+		line = fmt.Sprintf("%s:%s|%s", line, value, statsdType)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > statsdMaxPacket {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// Flush sends the buffered metrics.
+func (s *StatsdSink) Flush() {
+	s.Lock()
+	defer s.Unlock()
+	s.flush()
+}
+
+func (s *StatsdSink) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	if errStr != s.lastErr && errStr != "" {
+		log.Printf("Error sending metrics to StatsD: %s", errStr)
+	}
+	s.lastErr = errStr
+}
+
+// statsdEscape replaces characters of the value that have a meaning
+// in the StatsD format; dots too if it is part of the name.
+func statsdEscape(value string, inName bool) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		case '.':
+			if inName {
+				return '_'
+			}
+		}
+		return r
+	}, value)
+}
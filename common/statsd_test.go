@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatsdSink tests pushing metrics to StatsD.
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expected := map[bool]string{
+		false: "prod.requests_total.ipam./endpoints:2|c\nprod.hosts:0|g\nprod.hosts:-3|g\nprod.duration_seconds:250|ms",
+		true:  "prod.requests_total:2|c|#service:ipam,route:/endpoints\nprod.hosts:0|g\nprod.hosts:-3|g\nprod.duration_seconds:250|ms",
+	}
+	for _, dogStatsD := range []bool{false, true} {
+		sink, err := NewStatsdSink(conn.LocalAddr().String(), "prod.", dogStatsD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AddMetricsSink(sink)
+		m := NewMetrics()
+		m.NewCounter("requests_total", "Requests.", "service", "route").Add(2, "ipam", "/endpoints")
+		m.NewGauge("hosts", "Hosts.").Set(-3)
+		m.NewHistogram("duration_seconds", "Durations.", DefaultBuckets).Observe(0.25)
+		sink.Flush()
+		metricsSinks.Lock()
+		metricsSinks.sinks = nil
+		metricsSinks.Unlock()
+
+		// Metrics may have been sent in more than one packet.
+		var lines []string
+		buf := make([]byte, statsdMaxPacket)
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			lines = append(lines, string(buf[:n]))
+		}
+		expect(t, strings.Join(lines, "\n"), expected[dogStatsD])
+	}
+
+	parsed, err := ParseConfig([]byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n      statsd: 127.0.0.1:8125\n      statsd_prefix: prod.\n      dogstatsd: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := parsed.Services["root"].Common.Api
+	expect(t, api.Statsd, "127.0.0.1:8125")
+	expect(t, api.StatsdPrefix, "prod.")
+	expect(t, api.DogStatsD, true)
+	parsed, err = ParseConfig([]byte("services:\n  - service: root\n    api:\n      host: localhost\n      port: 9600\n      statsd: localhost\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := ValidateConfig(parsed)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "invalid statsd address") {
+		t.Errorf("Expected invalid statsd address, got %v", errs)
+	}
+}
@@ -18,17 +18,22 @@
 package common
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // StoreConfig stores information needed for a DB connection.
@@ -93,6 +98,11 @@ type Store interface {
 	Connect() error
 	// Create the schema, dropping existing one if the force flag is specified
 	CreateSchema(bool) error
+	Finder
+}
+
+// Finder finds entities, for find routes (see CreateFindRoutes).
+type Finder interface {
 	// Find finds entries in the store based on the query string. The meaning of the
 	// flags is as follows:
 	// 1. FindFirst - the first entity (as ordered by primary key) is returned.
@@ -102,7 +112,27 @@ type Store interface {
 	// 4. FindAll - returns all.
 	// Here "entities" *must* be a pointer to an array
 	// of entities to find (for example, it has to be &[]Tenant{}, not Tenant{}).
-	Find(query url.Values, entities interface{}, flag FindFlag) (interface{}, error)
+	// If ctx is done (cancelled or past its deadline), no query is made.
+	Find(ctx context.Context, query url.Values, entities interface{}, flag FindFlag) (interface{}, error)
+}
+
+// CheckContext returns an error if the provided context is done,
+// that is, it has been cancelled or its deadline has passed. Stores
+// call it before (and between) DB operations so that work is not
+// done on behalf of a request that nobody is waiting for anymore.
+// A nil context is never done.
+func CheckContext(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		// Same status as returned by http.TimeoutHandler when the
+		// REST timeout expires.
+		return NewHttpError(http.StatusServiceUnavailable, ctx.Err().Error())
+	default:
+		return nil
+	}
 }
 
 // ServiceStore interface is what each service's store needs to implement.
@@ -126,10 +156,24 @@ type DbStore struct {
 	Config            *StoreConfig
 	Db                *gorm.DB
 	createSchemaFuncs map[string]createSchema
+	// Faults injected into writes, if configured (see faults.go).
+	faults *storeFaults
+	// Logging of slow statements, if configured (see slowqueries.go).
+	slowQueries *slowQueries
+	// Encryption of sensitive fields, if configured (see encryption.go).
+	encryption *fieldEncryption
+	// How long deleted entities are kept (see softdelete.go).
+	deletionGrace time.Duration
+	// Credentials to connect with in place of those in Config,
+	// if provided (see dbcredentials.go).
+	credentials *dbCredentials
 }
 
 // Find generically implements Find() of store interface.
-func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFlag) (interface{}, error) {
+func (dbStore *DbStore) Find(ctx context.Context, query url.Values, entities interface{}, flag FindFlag) (interface{}, error) {
+	if err := CheckContext(ctx); err != nil {
+		return nil, err
+	}
 	queryStringFieldToDbField := make(map[string]string)
 
 	t := reflect.TypeOf(entities).Elem().Elem()
@@ -242,16 +286,119 @@ func (dbStore *DbStore) Find(query url.Values, entities interface{}, flag FindFl
 	return entities, nil
 }
 
+// FindIn implements Find of Store over all, a slice of entities,
+// for stores keeping entities in memory rather than in a database,
+// such as those of testing packages. Query variables are matched
+// against struct fields, named as in Find, by their string values.
+func FindIn(ctx context.Context, query url.Values, all interface{}, flag FindFlag) (interface{}, error) {
+	if err := CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	allVal := reflect.ValueOf(all)
+	t := allVal.Type().Elem()
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		name := strings.ToLower(structField.Name)
+		if jTag := structField.Tag.Get("json"); jTag != "" {
+			name = strings.Split(jTag, ",")[0]
+		}
+		fields[name] = i
+	}
+	where := make(map[int]string)
+	for k, v := range query {
+		i, ok := fields[strings.ToLower(k)]
+		if !ok {
+			return nil, NewError400(fmt.Sprintf("Unknown field %s in %v", k, t))
+		}
+		if len(v) > 1 {
+			return nil, NewError400("Did not expect multiple values in " + k)
+		}
+		where[i] = v[0]
+	}
+
+	found := reflect.MakeSlice(allVal.Type(), 0, allVal.Len())
+	for j := 0; j < allVal.Len(); j++ {
+		entity := allVal.Index(j)
+		matches := true
+		for i, value := range where {
+			if fmt.Sprint(entity.Field(i).Interface()) != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = reflect.Append(found, entity)
+		}
+	}
+	if found.Len() == 0 {
+		return nil, NewError404(t.String(), fmt.Sprintf("%+v", query))
+	}
+	switch flag {
+	case FindFirst, FindLast:
+		entityPtr := reflect.New(t)
+		if flag == FindFirst {
+			entityPtr.Elem().Set(found.Index(0))
+		} else {
+			entityPtr.Elem().Set(found.Index(found.Len() - 1))
+		}
+		return entityPtr.Interface(), nil
+	case FindExactlyOne:
+		if found.Len() == 1 {
+			return found.Index(0).Interface(), nil
+		}
+		return nil, NewError500(fmt.Sprintf("Multiple results found for %+v", query))
+	}
+	entities := reflect.New(found.Type())
+	entities.Elem().Set(found)
+	return entities.Interface(), nil
+}
+
 // SetConfig sets the config object from a map.
 func (dbStore *DbStore) SetConfig(configMap map[string]interface{}) error {
+	// Password and such may be given as secret references.
+	configMap, err := ResolveSecrets(configMap)
+	if err != nil {
+		return err
+	}
 	config := makeStoreConfig(configMap)
 	dbStore.Config = &config
+	dbStore.faults, err = parseStoreFaults(configMap)
+	if err != nil {
+		return err
+	}
+	dbStore.slowQueries, err = parseSlowQueries(configMap)
+	if err != nil {
+		return err
+	}
+	dbStore.encryption, err = parseFieldEncryption(configMap)
+	if err != nil {
+		return err
+	}
+	dbStore.deletionGrace, err = parseDeletionGrace(configMap)
+	if err != nil {
+		return err
+	}
+	dbStore.credentials, err = parseDbCredentials(configMap)
+	if err != nil {
+		return err
+	}
 	dbStore.createSchemaFuncs = make(map[string]createSchema)
 	dbStore.createSchemaFuncs["mysql"] = createSchemaMysql
 	dbStore.createSchemaFuncs["sqlite3"] = createSchemaSqlite3
 	return nil
 }
 
+// IsEncrypted returns true if fields tagged to be
+// encrypted are kept encrypted (see encryption.go).
+func (dbStore *DbStore) IsEncrypted() bool {
+	return dbStore.encryption != nil
+}
+
 // GetPasswordFunction returns appropriate function to hash
 // password depending on the underlying DB (note that in sqlite
 // it is plain text).
@@ -272,8 +419,13 @@ func (dbStore *DbStore) DbStore() DbStore {
 // getConnString returns the appropriate GORM connection string for
 // the given DB.
 func (dbStore *DbStore) getConnString() string {
+	return makeConnString(dbStore.Config)
+}
+
+// makeConnString returns the GORM connection string
+// for the DB described by info.
+func makeConnString(info *StoreConfig) string {
 	var connStr string
-	info := dbStore.Config
 	switch info.Type {
 	case "sqlite3":
 		connStr = info.Database
@@ -291,18 +443,136 @@ func (dbStore *DbStore) getConnString() string {
 	return connStr
 }
 
+// Ping returns an error if the DB is not connected or cannot be reached.
+func (dbStore *DbStore) Ping() error {
+	if dbStore.Db == nil {
+		return errors.New("Not connected to database")
+	}
+	return dbStore.Db.DB().Ping()
+}
+
 // Connect connects to the appropriate DB (mutating dbStore's state with
 // the connection information), or returns an error.
 func (dbStore *DbStore) Connect() error {
 	if dbStore.Config == nil {
 		return errors.New("No configuration specified.")
 	}
-	connStr := dbStore.getConnString()
-	db, err := gorm.Open(dbStore.Config.Type, connStr)
+	var source interface{}
+	if dbStore.credentials != nil {
+		// Not shared, as credentials are the store's own.
+		pool, err := dbStore.credentials.open(*dbStore.Config)
+		if err != nil {
+			return err
+		}
+		source = pool
+	} else {
+		connStr := dbStore.getConnString()
+		source = connStr
+		shared, err := sharedConnection(dbStore.Config.Type, connStr)
+		if err != nil {
+			return err
+		}
+		if shared != nil {
+			source = shared
+		}
+	}
+	db, err := gorm.Open(dbStore.Config.Type, source)
 	if err != nil {
 		return err
 	}
 	dbStore.Db = &db
+	if dbStore.faults != nil {
+		dbStore.faults.register(dbStore.Db)
+	}
+	if dbStore.slowQueries != nil {
+		dbStore.slowQueries.register(dbStore.Db)
+	}
+	if dbStore.encryption != nil {
+		dbStore.encryption.register(dbStore.Db)
+	}
+	return nil
+}
+
+// sharedConnections are connections to databases shared by all
+// stores of the process, by type and connection string, once
+// ShareStoreConnections is called.
+var sharedConnections struct {
+	sync.Mutex
+	dbs map[string]*sql.DB
+}
+
+// ShareStoreConnections makes stores connecting to the same database
+// from now on share a pool of connections to it, rather than each
+// opening its own. This is for several services running in the same
+// process (see package allinone).
+func ShareStoreConnections() {
+	sharedConnections.Lock()
+	defer sharedConnections.Unlock()
+	if sharedConnections.dbs == nil {
+		sharedConnections.dbs = make(map[string]*sql.DB)
+	}
+}
+
+// sharedConnection returns the pool of connections to the database
+// of the type at connStr, opening it if needed, or nil if stores
+// do not share connections.
+func sharedConnection(dbType string, connStr string) (*sql.DB, error) {
+	sharedConnections.Lock()
+	defer sharedConnections.Unlock()
+	if sharedConnections.dbs == nil {
+		return nil, nil
+	}
+	key := dbType + " " + connStr
+	if db, ok := sharedConnections.dbs[key]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(dbType, connStr)
+	if err != nil {
+		return nil, err
+	}
+	sharedConnections.dbs[key] = db
+	return db, nil
+}
+
+// CreateAll creates the records, a slice of entities or of pointers
+// to them, in a single transaction: either all of them are created or
+// none is. Created records get their IDs as with Create.
+func (dbStore *DbStore) CreateAll(ctx context.Context, records interface{}) error {
+	if err := CheckContext(ctx); err != nil {
+		return err
+	}
+	tx := dbStore.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := CreateAll(ctx, tx, records); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// CreateAll creates the records, as DbStore.CreateAll does, in the
+// transaction tx, which the caller commits or rolls back.
+func CreateAll(ctx context.Context, tx *gorm.DB, records interface{}) error {
+	v := reflect.ValueOf(records)
+	if v.Kind() != reflect.Slice {
+		return errors.New(fmt.Sprintf("Expected a slice of records, got %T", records))
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := CheckContext(ctx); err != nil {
+			return err
+		}
+		record := v.Index(i)
+		if record.Kind() != reflect.Ptr {
+			// Elements of a slice are addressable, so
+			// the record in it gets its ID.
+			record = record.Addr()
+		}
+		if err := tx.Create(record.Interface()).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -365,7 +635,6 @@ func createSchemaMysql(dbStore *DbStore, force bool) error {
 	schemaName := dbStore.Config.Database
 	dbStore.Config.Database = "mysql"
 	connStr := dbStore.getConnString()
-	log.Printf("DB: Connecting to %s", connStr)
 	db, err := gorm.Open("mysql", connStr)
 
 	if err != nil {
@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// TestFindIn tests finding entities kept in memory.
+func TestFindIn(t *testing.T) {
+	type entity struct {
+		ID   uint64 `json:"id"`
+		Name string `json:"name"`
+		Zone string
+	}
+	all := []entity{{1, "a", "z1"}, {2, "b", "z1"}, {3, "a", "z2"}}
+
+	found, err := FindIn(nil, url.Values{"name": {"a"}}, all, FindAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, len(*found.(*[]entity)), 2)
+	found, err = FindIn(nil, url.Values{"name": {"a"}}, all, FindLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, found.(*entity).ID, uint64(3))
+	found, err = FindIn(nil, url.Values{"zone": {"z2"}}, all, FindExactlyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, found.(entity).ID, uint64(3))
+
+	_, err = FindIn(nil, url.Values{"name": {"a"}}, all, FindExactlyOne)
+	expect(t, err.(HttpError).StatusCode, http.StatusInternalServerError)
+	_, err = FindIn(nil, url.Values{"name": {"c"}}, all, FindFirst)
+	expect(t, err.(HttpError).StatusCode, http.StatusNotFound)
+	_, err = FindIn(nil, url.Values{"color": {"red"}}, all, FindAll)
+	expect(t, err.(HttpError).StatusCode, http.StatusBadRequest)
+}
+
+type uniqueRecord struct {
+	ID   uint64 `sql:"AUTO_INCREMENT"`
+	Name string `sql:"unique"`
+}
+
+// TestCreateAll tests creating records in one transaction.
+func TestCreateAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "createall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &DbStore{}
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/createall.sqlite3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	store.Db.CreateTable(&uniqueRecord{})
+
+	records := []uniqueRecord{{Name: "a"}, {Name: "b"}}
+	if err := store.CreateAll(nil, records); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].ID == 0 || records[1].ID == 0 {
+		t.Errorf("Expected records to get IDs, got %v", records)
+	}
+	// Either all records are created or none is.
+	if err := store.CreateAll(nil, []*uniqueRecord{{Name: "c"}, {Name: "a"}}); err == nil {
+		t.Error("Expected error for duplicate name")
+	}
+	var found []uniqueRecord
+	store.Db.Find(&found)
+	expect(t, len(found), 2)
+	if err := store.CreateAll(nil, uniqueRecord{Name: "d"}); err == nil {
+		t.Error("Expected error for a record not in a slice")
+	}
+}
+
+// TestShareStoreConnections tests that stores of the same
+// database share connections once that is enabled.
+func TestShareStoreConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	connect := func(name string) *DbStore {
+		store := &DbStore{}
+		err := store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	if connect("a.sqlite3").Db.DB() == connect("a.sqlite3").Db.DB() {
+		t.Error("Expected stores not to share connections")
+	}
+
+	ShareStoreConnections()
+	defer func() { sharedConnections.dbs = nil }()
+	a1, a2, b := connect("a.sqlite3"), connect("a.sqlite3"), connect("b.sqlite3")
+	if a1.Db.DB() != a2.Db.DB() {
+		t.Error("Expected stores of a.sqlite3 to share connections")
+	}
+	if a1.Db.DB() == b.Db.DB() {
+		t.Error("Expected stores of different databases not to share connections")
+	}
+	a1.Db.CreateTable(&uniqueRecord{})
+	if err := a1.CreateAll(nil, []uniqueRecord{{Name: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	var found []uniqueRecord
+	a2.Db.Find(&found)
+	expect(t, len(found), 1)
+}
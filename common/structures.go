@@ -17,6 +17,8 @@ package common
 
 import (
 	"net"
+
+	"github.com/romana/core/common/netutil"
 )
 
 type IP struct {
@@ -29,17 +31,12 @@ func MakeIPv4(a, b, c, d byte) IP {
 	return ip
 }
 
+// IPv4ToInt is kept for existing callers; see netutil.IPv4ToInt.
 func IPv4ToInt(ip net.IP) uint64 {
-	switch len(ip) {
-	case 4: // IPv4
-		return uint64(ip[0])<<24 | uint64(ip[1])<<16 | uint64(ip[2])<<8 | uint64(ip[3])
-	case 16: // IPv6
-		return uint64(ip[12])<<24 | uint64(ip[13])<<16 | uint64(ip[14])<<8 | uint64(ip[15])
-	default:
-		return 0
-	}
+	return netutil.IPv4ToInt(ip)
 }
 
+// IntToIPv4 is kept for existing callers; see netutil.IntToIPv4.
 func IntToIPv4(ipInt uint64) net.IP {
-	return net.IPv4(byte(ipInt>>24), byte(ipInt>>16), byte(ipInt>>8), byte(ipInt))
+	return netutil.IntToIPv4(ipInt)
 }
@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Notifications of systemd about services started by InitializeService
+// (see sd_notify(3)), for units of Type=notify: the process is ready
+// once all its services connected to their databases, are serving
+// and registered with root. With WatchdogSec set, systemd is pinged
+// for as long as every service answers at HealthPath with a usable
+// database, so that hung services are restarted.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sdReady    = "READY=1"
+	sdWatchdog = "WATCHDOG=1"
+)
+
+// readinessTracker counts services of the process that are not
+// ready yet, to notify systemd once all of them are.
+type readinessTracker struct {
+	sync.Mutex
+	pending int
+	// notified is true once systemd was told the process is ready.
+	notified bool
+}
+
+// readiness tracks services started by InitializeService.
+var readiness = &readinessTracker{}
+
+// startWatchdog starts pinging the systemd watchdog, once.
+var startWatchdog sync.Once
+
+// sdNotify sends the state, such as READY=1, to systemd at
+// NOTIFY_SOCKET. It does nothing if the process was not started
+// by systemd expecting notifications.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Names starting with @ are abstract, which net handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// startingService records that a service of the process is starting,
+// and starts pinging the systemd watchdog if it is enabled.
+func startingService() {
+	readiness.starting()
+	startWatchdog.Do(func() {
+		interval, ok := watchdogInterval()
+		if ok {
+			log.Printf("Pinging systemd watchdog every %v", interval)
+			go runWatchdog(interval)
+		}
+	})
+}
+
+// serviceReady records that the named service of the process is ready.
+func serviceReady(name string) {
+	readiness.ready(name)
+}
+
+func (r *readinessTracker) starting() {
+	r.Lock()
+	defer r.Unlock()
+	r.pending++
+}
+
+// ready notifies systemd that the process is ready
+// once no service is starting any more.
+func (r *readinessTracker) ready(name string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pending--
+	if r.pending > 0 || r.notified {
+		return
+	}
+	r.notified = true
+	err := sdNotify(fmt.Sprintf("%s\nSTATUS=%s is ready", sdReady, name))
+	if err != nil {
+		log.Printf("Error notifying systemd that %s is ready: %v", name, err)
+	}
+}
+
+// DelayReadyNotification keeps systemd from being notified that the
+// process is ready until the returned function is called, for callers
+// starting several services one after another (see package allinone).
+func DelayReadyNotification() func() {
+	return readiness.delay()
+}
+
+func (r *readinessTracker) delay() func() {
+	r.starting()
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.ready("process") })
+	}
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog,
+// which is half the timeout in WATCHDOG_USEC, and whether the
+// watchdog is enabled for this process.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// runWatchdog pings the systemd watchdog every interval for as
+// long as running services are healthy (see checkRunningServices).
+func runWatchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := checkRunningServices(interval)
+		if err != nil {
+			log.Printf("Not pinging systemd watchdog: %v", err)
+			continue
+		}
+		err = sdNotify(sdWatchdog)
+		if err != nil {
+			log.Printf("Error pinging systemd watchdog: %v", err)
+		}
+	}
+}
+
+// checkRunningServices returns an error if a service started in this
+// process does not respond at HealthPath within the timeout, or its
+// database is not usable. Services not serving yet are not checked.
+func checkRunningServices(timeout time.Duration) error {
+	runningServices.Lock()
+	var services []*serviceHealth
+	for _, h := range runningServices.health {
+		services = append(services, h)
+	}
+	runningServices.Unlock()
+
+	client := &http.Client{Timeout: timeout}
+	for _, h := range services {
+		h.Lock()
+		addr := h.addr
+		h.Unlock()
+		if addr == "" {
+			continue
+		}
+		name := h.service.Name()
+		// Any response will do, it may be refused without a token.
+		resp, err := client.Get("http://" + addr + HealthPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s does not respond: %v", name, err))
+		}
+		resp.Body.Close()
+		health := h.report()
+		if health.Database != "" && health.Database != HealthOK {
+			return errors.New(fmt.Sprintf("Database of %s is not usable: %s", name, health.Database))
+		}
+	}
+	return nil
+}
+
+// servingAddress returns the address to reach a service
+// listening on addr at from this host.
+func servingAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSystemdNotify tests notifying systemd once all
+// services of the process are ready.
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := dir + "/notify"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	received := func() string {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+
+	r := &readinessTracker{}
+	release := r.delay()
+	r.starting()
+	r.ready("tenant")
+	expect2(t, "notification before release", received(), "")
+	release()
+	release()
+	expect(t, received(), "READY=1\nSTATUS=process is ready")
+	r.starting()
+	r.ready("ipam")
+	expect2(t, "notification after ready", received(), "")
+
+	expect(t, sdNotify(sdWatchdog), nil)
+	expect(t, received(), "WATCHDOG=1")
+
+	os.Setenv("WATCHDOG_USEC", "3000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	interval, ok := watchdogInterval()
+	if !ok || interval != 1500*time.Millisecond {
+		t.Errorf("Expected watchdog every 1.5s, got %v, %t", interval, ok)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if _, ok := watchdogInterval(); ok {
+		t.Error("Expected no watchdog for another process")
+	}
+
+	expect(t, servingAddress("[::]:9600"), "localhost:9600")
+	expect(t, servingAddress("127.0.0.1:9600"), "127.0.0.1:9600")
+}
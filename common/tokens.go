@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Tokens RestClient authenticates its requests with, obtained
+// from root with the credential of the client and refreshed
+// before they expire.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before a token
+// expires RestClient gets a new one.
+const tokenRefreshMargin = time.Minute
+
+// tokenSource keeps the token of a RestClient, shared by its copies
+// (see WithContext), so that only one of them asks root for a new
+// token at a time.
+type tokenSource struct {
+	sync.Mutex
+	token string
+	// expires is when the token expires, zero if unknown.
+	expires time.Time
+	// refresh is the request for a new token in flight, if any.
+	refresh *tokenRefresh
+	// now is time.Now, replaced by tests.
+	now func() time.Time
+}
+
+// tokenRefresh is a request for a new token,
+// done once token or err are set.
+type tokenRefresh struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func newTokenSource() *tokenSource {
+	return &tokenSource{now: time.Now}
+}
+
+// get returns the token, calling fetch for a new one if there is
+// none or it is about to expire. Callers asking for a token while
+// fetch is in flight wait for it rather than call it again.
+func (ts *tokenSource) get(fetch func() (string, error)) (string, error) {
+	ts.Lock()
+	if ts.token != "" && (ts.expires.IsZero() || ts.now().Add(tokenRefreshMargin).Before(ts.expires)) {
+		token := ts.token
+		ts.Unlock()
+		return token, nil
+	}
+	refresh := ts.refresh
+	if refresh == nil {
+		refresh = &tokenRefresh{done: make(chan struct{})}
+		ts.refresh = refresh
+		ts.Unlock()
+		refresh.token, refresh.err = fetch()
+		ts.Lock()
+		ts.refresh = nil
+		if refresh.err == nil {
+			ts.token = refresh.token
+			ts.expires = tokenExpiry(refresh.token)
+		}
+		ts.Unlock()
+		close(refresh.done)
+	} else {
+		ts.Unlock()
+		<-refresh.done
+	}
+	return refresh.token, refresh.err
+}
+
+// invalidate forgets the token, which was rejected, unless
+// it has been replaced with a new one already.
+func (ts *tokenSource) invalidate(token string) {
+	ts.Lock()
+	defer ts.Unlock()
+	if ts.token == token {
+		ts.token = ""
+	}
+}
+
+// tokenExpiry returns when the token expires, as claimed in it, or
+// zero time if it does not tell. The signature is not verified, that
+// is for services the token is sent to.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	claims := struct {
+		Exp float64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// isAuthFailure returns true if the status a request was answered
+// with may mean its token was rejected: besides 401, services
+// answer with 403 to expired or otherwise invalid tokens.
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// authenticates returns true if requests of the client are
+// to carry a token obtained with its credential from root.
+func (rc *RestClient) authenticates() bool {
+	return rc.config.RootURL != "" && rc.config.Credential != nil && rc.config.Credential.Type != CredentialNone
+}
+
+// fetchToken authenticates with root, with a client of its own
+// as the token is not needed for that.
+func (rc *RestClient) fetchToken() (string, error) {
+	authClient, err := NewRestClient(RestClientConfig{
+		TimeoutMillis: rc.config.TimeoutMillis,
+		Retries:       rc.config.Retries,
+		RootURL:       strings.Join(rc.rootURLs, ","),
+		Transport:     rc.config.Transport,
+		CallLog:       rc.config.CallLog,
+	})
+	if err != nil {
+		return "", err
+	}
+	rootIndexResponse := &RootIndexResponse{}
+	if err := authClient.Get(authClient.config.RootURL, rootIndexResponse); err != nil {
+		return "", err
+	}
+	authUrl := rootIndexResponse.Links.FindByRel("auth")
+	if authUrl == "" {
+		return "", errors.New(fmt.Sprintf("Could not find auth at %s", authClient.config.RootURL))
+	}
+	log.Printf("RestClient: authenticating to %s as %s", authUrl, rc.config.Credential.Username)
+	tokenMsg := &TokenMessage{}
+	if err := authClient.Post(authUrl, rc.config.Credential, tokenMsg); err != nil {
+		return "", err
+	}
+	return tokenMsg.Token, nil
+}
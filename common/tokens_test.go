@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRestClientTokens tests authenticating requests of RestClient
+// with tokens from root, refreshed when they are refused.
+func TestRestClientTokens(t *testing.T) {
+	var mu sync.Mutex
+	valid := "token1"
+	auths := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			json.NewEncoder(w).Encode(RootIndexResponse{Links: Links{{Href: "/auth", Rel: "auth"}}})
+		case "/auth":
+			cred := Credential{}
+			json.NewDecoder(r.Body).Decode(&cred)
+			if cred.Username != "admin" || cred.Password != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			auths++
+			json.NewEncoder(w).Encode(TokenMessage{Token: valid})
+		default:
+			if r.Header.Get("authorization") != valid {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(NewHttpError(http.StatusForbidden, "Invalid token."))
+				return
+			}
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+
+	config := GetDefaultRestClientConfig(server.URL)
+	config.Credential = &Credential{Type: CredentialUsernamePassword, Username: "admin", Password: "secret"}
+	client, err := NewRestClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := client.Get("/tenants", &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Get("/tenants", &result); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	expect(t, auths, 1)
+	mu.Unlock()
+
+	// Once the token is refused, concurrent requests get
+	// a new one once and are sent again.
+	mu.Lock()
+	valid = "token2"
+	mu.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result map[string]interface{}
+			errs <- client.WithContext(context.Background()).Get(server.URL+"/tenants", &result)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	mu.Lock()
+	expect(t, auths, 2)
+	mu.Unlock()
+}
+
+// TestTokenExpiry tests refreshing tokens about to expire.
+func TestTokenExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	makeToken := func(exp time.Time) string {
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+		return "header." + claims + ".signature"
+	}
+	expect(t, tokenExpiry(makeToken(now)), now)
+	expect(t, tokenExpiry("opaque"), time.Time{})
+
+	ts := newTokenSource()
+	ts.now = func() time.Time { return now }
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return makeToken(now.Add(time.Hour)), nil
+	}
+	ts.get(fetch)
+	ts.get(fetch)
+	expect(t, fetches, 1)
+	now = now.Add(time.Hour - tokenRefreshMargin/2)
+	ts.get(fetch)
+	expect(t, fetches, 2)
+}
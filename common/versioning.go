@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+// Optimistic concurrency control of updates. Entities that can be
+// changed through the API carry a version, incremented on each update:
+//
+//   Version uint64 `sql:"not null;default:1" json:"version,omitempty"`
+//
+// A client updating such an entity says which version it read, either
+// in the If-Match header or in the version of the request body, and
+// the update is refused with 409 if the entity has changed since, so
+// that two operators editing the same object do not silently overwrite
+// each other. Updates that do not say are refused with 428.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// IfMatchHeader is the request header with the
+// version of the entity the client updates.
+const IfMatchHeader = "If-Match"
+
+// parseIfMatch parses the value of the If-Match header: "*" matches
+// any version, otherwise it is the version, optionally quoted and
+// weak as for an ETag (W/"3").
+func parseIfMatch(value string) (version uint64, any bool, err error) {
+	value = strings.TrimSpace(value)
+	if value == "*" {
+		return 0, true, nil
+	}
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), "\"")
+	version, err = strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, NewError400(fmt.Sprintf("Invalid %s header %s", IfMatchHeader, value))
+	}
+	return version, false, nil
+}
+
+// CheckVersion checks that a client updating an entity of the type,
+// which is at the current version, read that version. The version
+// the client read is in the If-Match header or, failing that, in the
+// request body (bodyVersion, 0 if none).
+func CheckVersion(ctx RestContext, resourceType string, current uint64, bodyVersion uint64) error {
+	expected := bodyVersion
+	if ctx.IfMatch != "" {
+		version, any, err := parseIfMatch(ctx.IfMatch)
+		if err != nil {
+			return err
+		}
+		if any {
+			return nil
+		}
+		expected = version
+	} else if bodyVersion == 0 {
+		return NewHttpError(StatusPreconditionRequired, fmt.Sprintf("Update of %s requires its version in the %s header or the request", resourceType, IfMatchHeader))
+	}
+	if expected != current {
+		return NewErrorConflict(fmt.Sprintf("Version %d of %s is out of date, it is at version %d", expected, resourceType, current))
+	}
+	return nil
+}
+
+// UpdateVersioned updates the columns of the rows of value's table
+// matching the query that are at the version, and increments their
+// version. It returns 409 if the row has been changed since (or
+// deleted), so the caller should have loaded it in the same request.
+func UpdateVersioned(db *gorm.DB, value interface{}, version uint64, columns map[string]interface{}, query string, args ...interface{}) error {
+	if version == 0 {
+		return errors.New("UpdateVersioned: no version to update")
+	}
+	updates := make(map[string]interface{})
+	for column, v := range columns {
+		updates[column] = v
+	}
+	updates["version"] = version + 1
+	db = db.Model(value).Where(query, args...).Where("version = ?", version).UpdateColumns(updates)
+	if err := GetDbErrors(db); err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return NewErrorConflict(fmt.Sprintf("%s changed concurrently, reload it and retry", db.NewScope(value).TableName()))
+	}
+	return nil
+}
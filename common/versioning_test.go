@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+type versionedRecord struct {
+	ID      uint64 `sql:"AUTO_INCREMENT"`
+	Name    string
+	Version uint64 `sql:"not null;default:1"`
+}
+
+// TestVersioning tests checking the versions given by
+// clients and updating versioned records.
+func TestVersioning(t *testing.T) {
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(HttpError); ok {
+			return httpErr.StatusCode
+		}
+		t.Fatalf("Expected HttpError, got %v", err)
+		return 0
+	}
+	ctx := RestContext{}
+	expect(t, CheckVersion(ctx, "record", 2, 2), nil)
+	expect(t, statusOf(CheckVersion(ctx, "record", 2, 1)), http.StatusConflict)
+	expect(t, statusOf(CheckVersion(ctx, "record", 2, 0)), StatusPreconditionRequired)
+	// If-Match takes precedence over the version in the body.
+	for _, ifMatch := range []string{"2", `"2"`, `W/"2"`, "*"} {
+		ctx.IfMatch = ifMatch
+		expect2(t, ifMatch, CheckVersion(ctx, "record", 2, 1), nil)
+	}
+	ctx.IfMatch = `"3"`
+	expect(t, statusOf(CheckVersion(ctx, "record", 2, 2)), http.StatusConflict)
+	ctx.IfMatch = "two"
+	expect(t, statusOf(CheckVersion(ctx, "record", 2, 2)), http.StatusBadRequest)
+
+	dir, err := ioutil.TempDir("", "versioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &snapshotStore{}
+	store.ServiceStore = store
+	err = store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": dir + "/versioning.sqlite3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	store.Db.CreateTable(&versionedRecord{})
+	record := versionedRecord{Name: "a", Version: 1}
+	if err := GetDbErrors(store.Db.Create(&record)); err != nil {
+		t.Fatal(err)
+	}
+	columns := map[string]interface{}{"name": "b"}
+	if err := UpdateVersioned(store.Db, &versionedRecord{}, 1, columns, "id = ?", record.ID); err != nil {
+		t.Fatal(err)
+	}
+	// An update of the version read before is refused.
+	columns["name"] = "c"
+	expect(t, statusOf(UpdateVersioned(store.Db, &versionedRecord{}, 1, columns, "id = ?", record.ID)), http.StatusConflict)
+	found := versionedRecord{}
+	store.Db.First(&found, "id = ?", record.ID)
+	expect(t, found.Name, "b")
+	expect(t, found.Version, uint64(2))
+}
@@ -0,0 +1,505 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+// Endpoints are allocated in memory: allocatorStore keeps, for every
+// tenant segment on a host, a bitmap of the network IDs in use, so that
+// allocating an address takes no queries. Releasing an address clears
+// its bit, and the lowest free network ID is allocated next, reusing
+// the record of the released endpoint.
+//
+// Changes are written to the endpoints table, which the bitmaps are
+// rebuilt from on startup. By default they are written before a request
+// returns. If a journal is configured in the store section,
+//
+//   "store": {
+//     "type": "mysql",
+//     ...
+//     "journal": "/var/lib/romana/ipam.journal"
+//   }
+//
+// changes are appended to the journal instead and written to the
+// database behind, in batches (see journal.go). The allocator owns the
+// endpoints table: only one IPAM service may use the database.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/netutil"
+)
+
+// segmentKey identifies endpoints of a tenant segment
+// on a host, which network IDs are allocated among.
+type segmentKey struct {
+	hostID    string
+	tenantID  string
+	segmentID string
+}
+
+// segmentBitmap tracks network IDs of a segmentKey.
+type segmentBitmap struct {
+	// Bit n is set if network ID n is in use.
+	used []uint64
+	// Number of bits set in used.
+	count uint64
+	// No network ID below 64*free is free.
+	free int
+	// Addresses of endpoint records by network ID, in use or not;
+	// empty for network IDs without records.
+	ips []string
+}
+
+// next returns the lowest network ID not in use.
+func (b *segmentBitmap) next() uint64 {
+	for b.free < len(b.used) && b.used[b.free] == ^uint64(0) {
+		b.free++
+	}
+	if b.free == len(b.used) {
+		return uint64(64 * b.free)
+	}
+	bit := uint(0)
+	for b.used[b.free]&(1<<bit) != 0 {
+		bit++
+	}
+	return uint64(64*b.free) + uint64(bit)
+}
+
+// isSet returns true if the network ID is in use.
+func (b *segmentBitmap) isSet(id uint64) bool {
+	word := int(id / 64)
+	return word < len(b.used) && b.used[word]&(1<<(id%64)) != 0
+}
+
+// set marks the network ID in use.
+func (b *segmentBitmap) set(id uint64) {
+	if b.isSet(id) {
+		return
+	}
+	word := int(id / 64)
+	for len(b.used) <= word {
+		b.used = append(b.used, 0)
+	}
+	b.used[word] |= 1 << (id % 64)
+	b.count++
+}
+
+// clear marks the network ID free.
+func (b *segmentBitmap) clear(id uint64) {
+	if !b.isSet(id) {
+		return
+	}
+	word := int(id / 64)
+	b.used[word] &^= 1 << (id % 64)
+	b.count--
+	if word < b.free {
+		b.free = word
+	}
+}
+
+// ip returns the address of the record with the network ID, if any.
+func (b *segmentBitmap) ip(id uint64) string {
+	if id < uint64(len(b.ips)) {
+		return b.ips[id]
+	}
+	return ""
+}
+
+// setIP records the address of the record with the network ID.
+func (b *segmentBitmap) setIP(id uint64, ip string) {
+	for uint64(len(b.ips)) <= id {
+		b.ips = append(b.ips, "")
+	}
+	b.ips[id] = ip
+}
+
+// allocation is an endpoint record kept in memory.
+type allocation struct {
+	endpoint Endpoint
+	// Endpoints are listed in the order their records were created.
+	order uint64
+}
+
+// allocationsByOrder sorts allocations in the order
+// their records were created.
+type allocationsByOrder []*allocation
+
+func (a allocationsByOrder) Len() int           { return len(a) }
+func (a allocationsByOrder) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a allocationsByOrder) Less(i, j int) bool { return a[i].order < a[j].order }
+
+// usageByKey sorts segment usage by host, tenant and segment.
+type usageByKey []SegmentUsage
+
+func (u usageByKey) Len() int      { return len(u) }
+func (u usageByKey) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u usageByKey) Less(i, j int) bool {
+	if u[i].HostId != u[j].HostId {
+		return u[i].HostId < u[j].HostId
+	}
+	if u[i].TenantID != u[j].TenantID {
+		return u[i].TenantID < u[j].TenantID
+	}
+	return u[i].SegmentID < u[j].SegmentID
+}
+
+// allocatorStore implements Store, allocating endpoints in memory
+// and keeping them, along with mappings of Neutron subnets, in the
+// database of ipamStore.
+type allocatorStore struct {
+	*ipamStore
+	journalPath string
+
+	mu       sync.Mutex
+	segments map[segmentKey]*segmentBitmap
+	// Endpoint records by address.
+	endpoints map[string]*allocation
+	// Addresses of endpoints in use by request token.
+	tokens    map[string]string
+	nextOrder uint64
+
+	// Set if a journal is configured.
+	journal *journal
+}
+
+// newAllocatorStore returns an allocatorStore
+// to be configured with SetConfig.
+func newAllocatorStore() *allocatorStore {
+	store := &allocatorStore{ipamStore: &ipamStore{}}
+	store.ipamStore.ServiceStore = store.ipamStore
+	return store
+}
+
+// SetConfig implements Store.SetConfig, taking the path of
+// the journal, if any, from the store configuration.
+func (store *allocatorStore) SetConfig(config map[string]interface{}) error {
+	if err := store.ipamStore.SetConfig(config); err != nil {
+		return err
+	}
+	if path, ok := config["journal"]; ok {
+		if store.journalPath, ok = path.(string); !ok {
+			return errors.New(fmt.Sprintf("Invalid journal %v", path))
+		}
+	}
+	return nil
+}
+
+// Connect implements Store.Connect. Changes left in the journal are
+// written to the database, then endpoints are loaded from it.
+func (store *allocatorStore) Connect() error {
+	err := store.ipamStore.Connect()
+	if err != nil {
+		return err
+	}
+	if store.journalPath != "" {
+		store.journal, err = openJournal(store.journalPath, store.apply)
+		if err != nil {
+			return err
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.load()
+}
+
+// load rebuilds the bitmaps from the endpoints
+// table. The caller holds mu.
+func (store *allocatorStore) load() error {
+	var records []Endpoint
+	if err := store.Db.Order("id").Find(&records).Error; err != nil {
+		return err
+	}
+	store.segments = make(map[segmentKey]*segmentBitmap)
+	store.endpoints = make(map[string]*allocation)
+	store.tokens = make(map[string]string)
+	// Records created get IDs in memory, following those in
+	// the table, so that they are known before the journal
+	// writes them. IDs start at 1, as in the database.
+	store.nextOrder = 1
+	for _, record := range records {
+		store.record(record, record.Id)
+	}
+	log.Printf("IpamStore: Loaded %d endpoints in %d segments", len(records), len(store.segments))
+	return nil
+}
+
+// segment returns the bitmap of the segmentKey of the endpoint.
+func (store *allocatorStore) segment(endpoint *Endpoint) *segmentBitmap {
+	key := segmentKey{hostID: endpoint.HostId, tenantID: endpoint.TenantID, segmentID: endpoint.SegmentID}
+	b, ok := store.segments[key]
+	if !ok {
+		b = &segmentBitmap{}
+		store.segments[key] = b
+	}
+	return b
+}
+
+// record keeps the endpoint record in memory.
+func (store *allocatorStore) record(endpoint Endpoint, order uint64) {
+	b := store.segment(&endpoint)
+	b.setIP(endpoint.NetworkID, endpoint.Ip)
+	if endpoint.InUse {
+		b.set(endpoint.NetworkID)
+		if endpoint.RequestToken.Valid {
+			store.tokens[endpoint.RequestToken.String] = endpoint.Ip
+		}
+	}
+	if a, ok := store.endpoints[endpoint.Ip]; ok {
+		a.endpoint = endpoint
+		return
+	}
+	store.endpoints[endpoint.Ip] = &allocation{endpoint: endpoint, order: order}
+	if order >= store.nextOrder {
+		store.nextOrder = order + 1
+	}
+}
+
+// persist writes the changes to the journal, if there is one,
+// or to the database.
+func (store *allocatorStore) persist(entries []journalEntry) error {
+	if store.journal != nil {
+		return store.journal.append(entries)
+	}
+	return store.apply(entries)
+}
+
+// apply writes the changes to the database in a transaction.
+// Writing changes already written has no effect.
+func (store *allocatorStore) apply(entries []journalEntry) error {
+	tx := store.Db.Begin()
+	for i := range entries {
+		if err := entries[i].apply(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Snapshot implements common.Snapshotter, writing changes
+// in the journal to the database first.
+func (store *allocatorStore) Snapshot(ctx context.Context) (common.StoreSnapshot, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.journal != nil {
+		if err := store.journal.flush(); err != nil {
+			return common.StoreSnapshot{}, err
+		}
+	}
+	return store.ipamStore.Snapshot(ctx)
+}
+
+// Restore implements common.Snapshotter. Changes in the journal are
+// written to the database first, so that they are not written over
+// the snapshot later, and the bitmaps are rebuilt from it after.
+func (store *allocatorStore) Restore(ctx context.Context, snapshot common.StoreSnapshot) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.journal != nil {
+		if err := store.journal.flush(); err != nil {
+			return err
+		}
+	}
+	if err := store.ipamStore.Restore(ctx, snapshot); err != nil {
+		return err
+	}
+	return store.load()
+}
+
+// AddEndpoint implements Store.AddEndpoint.
+func (store *allocatorStore) AddEndpoint(ctx context.Context, endpoint *Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error {
+	return store.AddEndpoints(ctx, []*Endpoint{endpoint}, upToEndpointIpInt, stride, slots)
+}
+
+// AddEndpoints implements Store.AddEndpoints. Each endpoint gets the
+// lowest network ID not in use; addresses of released endpoints are
+// reused.
+func (store *allocatorStore) AddEndpoints(ctx context.Context, endpoints []*Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	b := store.segment(endpoints[0])
+	// Checked under mu, so that concurrent
+	// allocations cannot overflow the segment.
+	if b.count+uint64(len(endpoints)) > slots {
+		return noAddresses(endpoints[0], b.count, slots)
+	}
+	entries := make([]journalEntry, 0, len(endpoints))
+	// Network IDs and tokens are taken as they are allocated,
+	// and given back if not all endpoints get addresses.
+	undo := func() {
+		for _, entry := range entries {
+			b.clear(entry.NetworkID)
+			if entry.Endpoint.RequestToken.Valid {
+				delete(store.tokens, entry.Endpoint.RequestToken.String)
+			}
+		}
+	}
+	now := time.Now()
+	nextID := store.nextOrder
+	for _, endpoint := range endpoints {
+		if token := endpoint.RequestToken; token.Valid {
+			if ip, ok := store.tokens[token.String]; ok {
+				undo()
+				return common.NewErrorConflict(fmt.Sprintf("Request token %s is in use by %s", token.String, ip))
+			}
+		}
+		endpoint.InUse = true
+		endpoint.CreatedAt = &now
+		endpoint.UpdatedAt = &now
+		endpoint.NetworkID = b.next()
+		endpoint.EffectiveNetworkID = GetEffectiveNetworkID(endpoint.NetworkID, stride)
+		endpoint.Ip = b.ip(endpoint.NetworkID)
+		if endpoint.Ip == "" {
+			endpoint.Ip = netutil.IntToIPv4(upToEndpointIpInt | endpoint.EffectiveNetworkID).String()
+		}
+		// The record of a released endpoint is reused;
+		// a new one gets the next ID.
+		if a, ok := store.endpoints[endpoint.Ip]; ok {
+			endpoint.Id = a.endpoint.Id
+		} else {
+			endpoint.Id = nextID
+			nextID++
+		}
+		b.set(endpoint.NetworkID)
+		if endpoint.RequestToken.Valid {
+			store.tokens[endpoint.RequestToken.String] = endpoint.Ip
+		}
+		entries = append(entries, journalEntry{Op: journalAllocate, Endpoint: *endpoint, ID: endpoint.Id, NetworkID: endpoint.NetworkID, EffectiveNetworkID: endpoint.EffectiveNetworkID})
+	}
+	if err := store.persist(entries); err != nil {
+		log.Printf("IpamStore: Cannot allocate %d endpoints: %v", len(endpoints), err)
+		undo()
+		return err
+	}
+	for _, endpoint := range endpoints {
+		store.record(*endpoint, endpoint.Id)
+	}
+	log.Printf("IpamStore: Allocated %d endpoints from %s", len(endpoints), endpoints[0].Ip)
+	return nil
+}
+
+// DeleteEndpoint implements Store.DeleteEndpoint, releasing the
+// endpoint with the address. The record is kept for reuse.
+func (store *allocatorStore) DeleteEndpoint(ctx context.Context, ip string) (Endpoint, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := common.CheckContext(ctx); err != nil {
+		return Endpoint{}, err
+	}
+	a, ok := store.endpoints[ip]
+	if !ok {
+		return Endpoint{}, common.NewError404("endpoint", ip)
+	}
+	now := time.Now()
+	released := a.endpoint
+	released.UpdatedAt = &now
+	if err := store.persist([]journalEntry{{Op: journalRelease, Endpoint: released}}); err != nil {
+		return Endpoint{}, err
+	}
+	// The request token goes with the allocation, so that the
+	// address can later be reused under another token.
+	if released.InUse {
+		store.segment(&released).clear(released.NetworkID)
+		if released.RequestToken.Valid {
+			delete(store.tokens, released.RequestToken.String)
+		}
+	}
+	a.endpoint.InUse = false
+	a.endpoint.RequestToken = sql.NullString{}
+	a.endpoint.UpdatedAt = &now
+	return released, nil
+}
+
+// list returns endpoints in use the filter accepts, in the order
+// their records were created.
+func (store *allocatorStore) list(filter func(endpoint *Endpoint) bool) []Endpoint {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var found []*allocation
+	for _, a := range store.endpoints {
+		if a.endpoint.InUse && filter(&a.endpoint) {
+			found = append(found, a)
+		}
+	}
+	sort.Sort(allocationsByOrder(found))
+	endpoints := make([]Endpoint, len(found))
+	for i, a := range found {
+		endpoints[i] = a.endpoint
+	}
+	return endpoints
+}
+
+// ListHostEndpoints implements Store.ListHostEndpoints.
+func (store *allocatorStore) ListHostEndpoints(ctx context.Context, hostId string) ([]Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	return store.list(func(endpoint *Endpoint) bool { return endpoint.HostId == hostId }), nil
+}
+
+// ListTenantEndpoints implements Store.ListTenantEndpoints.
+func (store *allocatorStore) ListTenantEndpoints(ctx context.Context, tenantId string) ([]Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	return store.list(func(endpoint *Endpoint) bool { return endpoint.TenantID == tenantId }), nil
+}
+
+// FindEndpointByRequestToken implements Store.FindEndpointByRequestToken.
+func (store *allocatorStore) FindEndpointByRequestToken(ctx context.Context, token string) (Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Endpoint{}, err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ip, ok := store.tokens[token]
+	if !ok {
+		return Endpoint{}, common.NewError404("endpoint", token)
+	}
+	return store.endpoints[ip].endpoint, nil
+}
+
+// CountEndpoints implements Store.CountEndpoints
+// from the bitmaps.
+func (store *allocatorStore) CountEndpoints(ctx context.Context, hostId string) ([]SegmentUsage, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var retval []SegmentUsage
+	for key, b := range store.segments {
+		if b.count == 0 || (hostId != "" && key.hostID != hostId) {
+			continue
+		}
+		retval = append(retval, SegmentUsage{HostId: key.hostID, TenantID: key.tenantID, SegmentID: key.segmentID, Used: b.count})
+	}
+	sort.Sort(usageByKey(retval))
+	return retval, nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// testStore returns a connected allocatorStore with n endpoints
+// in use in one segment, writing through a journal if asked to.
+func testStore(tb testing.TB, dir string, n int, journal bool) *allocatorStore {
+	config := map[string]interface{}{
+		"type":     "sqlite3",
+		"database": filepath.Join(dir, "ipam.db"),
+	}
+	if journal {
+		config["journal"] = filepath.Join(dir, "ipam.journal")
+	}
+	store := newAllocatorStore()
+	if err := store.SetConfig(config); err != nil {
+		tb.Fatal(err)
+	}
+	if err := store.CreateSchema(true); err != nil {
+		tb.Fatal(err)
+	}
+	if err := store.Connect(); err != nil {
+		tb.Fatal(err)
+	}
+	endpoints := make([]*Endpoint, n)
+	for i := range endpoints {
+		endpoints[i] = testEndpoint()
+	}
+	if err := store.AddEndpoints(context.Background(), endpoints, testSegment, 0, testSlots); err != nil {
+		tb.Fatal(err)
+	}
+	drainJournal(store)
+	return store
+}
+
+// testSegment is the address of the segment endpoints
+// of tests are allocated from.
+var testSegment = common.IPv4ToInt(net.ParseIP("10.0.0.0"))
+
+// testSlots is how many endpoints the segment of
+// tests can have, more than they allocate.
+const testSlots = 1 << 24
+
+// drainJournal waits for the journal of the store,
+// if any, to be written to the database.
+func drainJournal(store *allocatorStore) {
+	for store.journal != nil {
+		store.journal.mu.Lock()
+		pending := len(store.journal.pending)
+		store.journal.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testEndpoint() *Endpoint {
+	return &Endpoint{HostId: "1", TenantID: "1", SegmentID: "1"}
+}
+
+// BenchmarkAddEndpoint measures allocating an endpoint in a segment
+// with the number of endpoints already in use, writing to the
+// database or to the journal. Releasing the endpoint again is
+// not measured.
+func BenchmarkAddEndpoint(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, journal := range []bool{false, true} {
+		for _, n := range []int{0, 1000, 10000} {
+			b.Run(fmt.Sprintf("journal=%t/endpoints=%d", journal, n), func(b *testing.B) {
+				dir, err := ioutil.TempDir("", "romana-ipam")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				store := testStore(b, dir, n, journal)
+				defer store.Db.Close()
+				defer drainJournal(store)
+				ctx := context.Background()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					endpoint := testEndpoint()
+					if err := store.AddEndpoint(ctx, endpoint, testSegment, 0, testSlots); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					if _, err := store.DeleteEndpoint(ctx, endpoint.Ip); err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+// TestJournalEndpointIDs tests that endpoints allocated through the
+// journal get the IDs of their records before these are written.
+func TestJournalEndpointIDs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, err := ioutil.TempDir("", "romana-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := testStore(t, dir, 2, true)
+	defer store.Db.Close()
+
+	ctx := context.Background()
+	endpoints := []*Endpoint{testEndpoint(), testEndpoint()}
+	if err := store.AddEndpoints(ctx, endpoints, testSegment, 0, testSlots); err != nil {
+		t.Fatal(err)
+	}
+	if endpoints[0].Id != 3 || endpoints[1].Id != 4 {
+		t.Errorf("Expected endpoints 3 and 4, got %d and %d", endpoints[0].Id, endpoints[1].Id)
+	}
+	// The record of a released endpoint is reused.
+	if _, err := store.DeleteEndpoint(ctx, endpoints[0].Ip); err != nil {
+		t.Fatal(err)
+	}
+	endpoint := testEndpoint()
+	if err := store.AddEndpoint(ctx, endpoint, testSegment, 0, testSlots); err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Id != 3 || endpoint.Ip != endpoints[0].Ip {
+		t.Errorf("Expected endpoint 3 with %s, got %d with %s", endpoints[0].Ip, endpoint.Id, endpoint.Ip)
+	}
+
+	drainJournal(store)
+	var records []Endpoint
+	if err := store.Db.Order("id").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+	for _, e := range []*Endpoint{endpoint, endpoints[1]} {
+		if record := records[e.Id-1]; record.Ip != e.Ip {
+			t.Errorf("Expected record %d with %s, got %s", e.Id, e.Ip, record.Ip)
+		}
+	}
+}
+
+// TestSegmentSlots tests that endpoints are not allocated
+// beyond the slots of their segment.
+func TestSegmentSlots(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, err := ioutil.TempDir("", "romana-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := testStore(t, dir, 2, false)
+	defer store.Db.Close()
+
+	ctx := context.Background()
+	endpoints := []*Endpoint{testEndpoint(), testEndpoint()}
+	err = store.AddEndpoints(ctx, endpoints, testSegment, 0, 3)
+	if !isNoAddresses(err) || err.(common.HttpError).Details.(NoAddresses).Available != 1 {
+		t.Errorf("Expected no addresses left, got %v", err)
+	}
+	if err := store.AddEndpoints(ctx, endpoints[:1], testSegment, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddEndpoint(ctx, endpoints[1], testSegment, 0, 3); !isNoAddresses(err) {
+		t.Errorf("Expected no addresses left, got %v", err)
+	}
+	// Released addresses can be allocated again.
+	if _, err := store.DeleteEndpoint(ctx, endpoints[0].Ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddEndpoint(ctx, endpoints[1], testSegment, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+// Capacity of hosts: how many endpoints each host can have given the
+// bit allocation of its datacenter or zone, and how many it has. On
+// a host, every segment of every tenant has its own range of
+// addresses, of which the first three are reserved (see
+// getEffectiveNetworkID) and every endpoint takes 2^stride
+// (endpoint_space_bits) addresses.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+)
+
+// HostCapacity is the capacity of a host.
+type HostCapacity struct {
+	HostID   string `json:"host_id"`
+	HostName string `json:"host_name"`
+	// Endpoints a single tenant segment can have on the host.
+	SegmentSlots uint64 `json:"segment_slots"`
+	// Endpoints the host can have in all tenant segments.
+	Slots uint64 `json:"slots"`
+	// Endpoints the host has.
+	Used uint64 `json:"used"`
+	// Slots - Used.
+	Available uint64 `json:"available"`
+	// Segments with endpoints on the host.
+	Segments []SegmentCapacity `json:"segments"`
+}
+
+// SegmentCapacity is the capacity of a tenant segment on a host.
+type SegmentCapacity struct {
+	TenantID  string `json:"tenant_id"`
+	SegmentID string `json:"segment_id"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+}
+
+// segmentSlots returns the number of endpoints a tenant segment
+// on a host can have with the datacenter's bit allocation.
+func segmentSlots(dc common.Datacenter) uint64 {
+	endpointBits := 32 - dc.PrefixBits - dc.PortBits - dc.TenantBits - dc.SegmentBits - dc.EndpointSpaceBits
+	addresses := uint64(1) << endpointBits
+	if addresses <= 3 {
+		return 0
+	}
+	// Endpoint n gets address 3 + n * 2^stride.
+	return (addresses - 3 + (1 << dc.EndpointSpaceBits) - 1) >> dc.EndpointSpaceBits
+}
+
+// hostCapacity computes the capacity of the host from its usage.
+func hostCapacity(host common.Host, dc common.Datacenter, usage []SegmentUsage) HostCapacity {
+	capacity := HostCapacity{
+		HostID:       fmt.Sprintf("%d", host.ID),
+		HostName:     host.Name,
+		SegmentSlots: segmentSlots(dc),
+		Segments:     make([]SegmentCapacity, 0),
+	}
+	capacity.Slots = capacity.SegmentSlots << (dc.TenantBits + dc.SegmentBits)
+	for _, u := range usage {
+		if u.HostId != capacity.HostID {
+			continue
+		}
+		segment := SegmentCapacity{TenantID: u.TenantID, SegmentID: u.SegmentID, Used: u.Used}
+		if u.Used < capacity.SegmentSlots {
+			segment.Available = capacity.SegmentSlots - u.Used
+		}
+		capacity.Segments = append(capacity.Segments, segment)
+		capacity.Used += u.Used
+	}
+	if capacity.Used < capacity.Slots {
+		capacity.Available = capacity.Slots - capacity.Used
+	}
+	return capacity
+}
+
+// topologyHosts returns the hosts in topology, or only the host
+// with the given ID if it is not empty, with the topology index.
+func (ipam *IPAM) topologyHosts(client *common.RestClient, hostId string) ([]common.Host, common.IndexResponse, error) {
+	index := common.IndexResponse{}
+	topoURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return nil, index, err
+	}
+	err = client.Get(topoURL, &index)
+	if err != nil {
+		return nil, index, err
+	}
+	hostsURL := index.Links.FindByRel("host-list")
+	if hostId != "" {
+		host := common.Host{}
+		err = client.Get(fmt.Sprintf("%s/%s", hostsURL, hostId), &host)
+		return []common.Host{host}, index, err
+	}
+	var hosts []common.Host
+	err = client.Get(hostsURL, &hosts)
+	return hosts, index, err
+}
+
+// capacity returns the capacity of all hosts, or of the one
+// with the given ID if it is not empty.
+func (ipam *IPAM) capacity(ctx common.RestContext, hostId string) ([]HostCapacity, error) {
+	client, err := common.NewRestClient(common.GetRestClientConfig(ipam.config))
+	if err != nil {
+		return nil, err
+	}
+	client = client.WithContext(ctx.Context)
+	hosts, index, err := ipam.topologyHosts(client, hostId)
+	if err != nil {
+		log.Printf("IPAM encountered an error querying topology for hosts: %v", err)
+		return nil, err
+	}
+	usage, err := ipam.endpoints.CountEndpoints(ctx.Context, hostId)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]HostCapacity, len(hosts))
+	for i, host := range hosts {
+		dc, err := ipam.hostDatacenter(client, index, host)
+		if err != nil {
+			return nil, err
+		}
+		retval[i] = hostCapacity(host, dc, usage)
+	}
+	return retval, nil
+}
+
+// listCapacity reports the capacity of all hosts.
+func (ipam *IPAM) listCapacity(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.capacity(ctx, "")
+}
+
+// getHostCapacity reports the capacity of a host.
+func (ipam *IPAM) getHostCapacity(input interface{}, ctx common.RestContext) (interface{}, error) {
+	capacity, err := ipam.capacity(ctx, ctx.PathVariables["hostId"])
+	if err != nil {
+		return nil, err
+	}
+	return capacity[0], nil
+}
@@ -49,7 +49,50 @@
 //        "name"       : "Endpoint name",
 //    }
 //
+//If the host has no addresses left for the segment, 409 is returned.
+//With failover=true, as in POST /endpoints?failover=true, the endpoint
+//is instead allocated on another healthy host of the same zone, and
+//the response tells which (see failover.go):
+//
+//    {
+//        "endpoint"          : { "ip" : "10.0.1.3", "host_id" : "Other host ID", ... },
+//        "host"              : { "id" : 2, "name" : "host2", ... },
+//        "failed_over"       : true,
+//        "requested_host_id" : "Host ID"
+//    }
+//
+//The same goes for GET /allocateIP, and for POST /endpoints/bulk
+//with "endpoints" in the response.
+//
 //2. Deallocate an IP for an endpoint.
 //
 //To deallocate an IP, issue a DELETE request to /endpoints/<ip>.
+//
+//3. Report host capacity.
+//
+//GET /capacity lists, for every host, how many endpoints it can have
+//given the stride configuration (slots), how many it has (used) and
+//how many more fit (available), with usage per tenant segment.
+//GET /hosts/<id>/capacity reports the same for one host.
+//
+//4. Neutron ML2 integration
+//
+//A Neutron ML2 mechanism driver maps networks and subnets and
+//allocates addresses for ports under /neutron:
+//
+//  1. PUT /neutron/networks/<network UUID> with {"project_id", "name"}
+//     maps the network to a segment, with the network UUID as external ID,
+//     of the tenant whose external ID is the project; the segment is created
+//     if needed. DELETE deletes the segment and its subnet mappings.
+//  2. PUT /neutron/subnets/<subnet UUID> with {"network_id", "cidr"} maps
+//     the subnet to the segment of its network. DELETE removes the mapping.
+//  3. POST /neutron/ports with {"id", "subnet_id" or "network_id", "host_id", "name"}
+//     allocates an address for the port on the host named by host_id
+//     (binding:host_id). The port UUID is the endpoint's request token, so
+//     posting the same port again returns the same endpoint.
+//  4. PUT /neutron/ports/<port UUID>/binding with {"host_id"} is the
+//     port-binding callback: it allocates the address if the port has none
+//     and moves it if the port was bound to another host.
+//  5. GET and DELETE /neutron/ports/<port UUID> return and release the
+//     port's endpoint.
 package ipam
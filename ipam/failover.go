@@ -0,0 +1,236 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+// Failover of allocations. A host has no addresses left for a tenant
+// segment once it has as many endpoints of the segment as its
+// segment_slots (see capacity.go); allocating more fails with 409 and
+// NoAddresses as details. The store enforces this as it allocates
+// (see Store.AddEndpoints).
+//
+// With failover=true, as in POST /endpoints?failover=true, endpoints
+// are instead allocated on another host of the same zone that is
+// neither draining nor unreachable or down, the one with the most
+// addresses left for the segment, and the response is an Allocation
+// telling the host they were allocated on.
+
+import (
+	"context"
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"sort"
+)
+
+// NoAddresses are the details of the error returned when a
+// host has no addresses left for endpoints of a tenant segment.
+type NoAddresses struct {
+	HostID    string `json:"host_id"`
+	HostName  string `json:"host_name"`
+	TenantID  string `json:"tenant_id"`
+	SegmentID string `json:"segment_id"`
+	// Available is how many endpoints of the
+	// segment the host can still have.
+	Available uint64 `json:"available"`
+}
+
+func (n NoAddresses) String() string {
+	return fmt.Sprintf("Host %s has %d addresses left for segment %s of tenant %s", n.HostName, n.Available, n.SegmentID, n.TenantID)
+}
+
+// isNoAddresses returns true if the error is that
+// a host has no addresses left for a segment.
+func isNoAddresses(err error) bool {
+	httpErr, ok := err.(common.HttpError)
+	if !ok {
+		return false
+	}
+	_, ok = httpErr.Details.(NoAddresses)
+	return ok
+}
+
+// Allocation is the response to allocations with failover=true.
+type Allocation struct {
+	// Endpoint is the endpoint allocated by POST /endpoints
+	// or /allocateIP.
+	Endpoint *Endpoint `json:"endpoint,omitempty"`
+	// Endpoints are the endpoints allocated by POST /endpoints/bulk.
+	Endpoints []*Endpoint `json:"endpoints,omitempty"`
+	// Host is the host the endpoints were allocated on.
+	Host common.Host `json:"host"`
+	// FailedOver is set if Host is not the one asked for,
+	// which had no addresses left.
+	FailedOver      bool   `json:"failed_over"`
+	RequestedHostID string `json:"requested_host_id"`
+}
+
+// noAddresses returns the error of allocatorStore refusing to allocate
+// more endpoints of the segment of the endpoint on its host, where used
+// of the slots of the segment are taken. The store does not know the
+// name of the host; allocateOn adds it.
+func noAddresses(endpoint *Endpoint, used uint64, slots uint64) error {
+	available := uint64(0)
+	if used < slots {
+		available = slots - used
+	}
+	return common.NewErrorConflict(NoAddresses{HostID: endpoint.HostId, TenantID: endpoint.TenantID, SegmentID: endpoint.SegmentID, Available: available})
+}
+
+// segmentAvailable returns how many more endpoints of
+// the segment the host can have, given the usage.
+func segmentAvailable(dc common.Datacenter, usage []SegmentUsage, hostID string, tenantID string, segmentID string) uint64 {
+	slots := segmentSlots(dc)
+	for _, u := range usage {
+		if u.HostId == hostID && u.TenantID == tenantID && u.SegmentID == segmentID {
+			if u.Used >= slots {
+				return 0
+			}
+			return slots - u.Used
+		}
+	}
+	return slots
+}
+
+// allocate allocates addresses to endpoints of a tenant segment on
+// their host or, with failover, on another host of its zone if it has
+// no addresses left. It returns the host they were allocated on.
+func (ipam *IPAM) allocate(ctx context.Context, client *common.RestClient, endpoints []*Endpoint, failover bool) (common.Host, error) {
+	first := endpoints[0]
+	hostID, count := first.HostId, len(endpoints)
+	host, err := ipam.allocateOn(ctx, client, hostID, endpoints)
+	if err == nil || !failover || !isNoAddresses(err) {
+		return host, err
+	}
+	candidates, err2 := ipam.failoverHosts(ctx, client, hostID, first.TenantID, first.SegmentID, count)
+	if err2 != nil {
+		log.Printf("IPAM encountered an error looking for hosts to fail over to from %s: %v", hostID, err2)
+		return host, err2
+	}
+	for _, candidate := range candidates {
+		_, err2 = ipam.allocateOn(ctx, client, fmt.Sprintf("%d", candidate.ID), endpoints)
+		if err2 == nil {
+			log.Printf("IPAM failed over allocation of %d addresses from host %s to %s", count, host.Name, candidate.Name)
+			return candidate, nil
+		}
+		// The candidate may have run out of addresses since
+		// failoverHosts counted them; the next may not have.
+		if !isNoAddresses(err2) {
+			err = err2
+			break
+		}
+	}
+	// No other host of the zone took the endpoints, which stay on theirs.
+	for _, endpoint := range endpoints {
+		endpoint.HostId = hostID
+	}
+	return host, err
+}
+
+// allocateOn allocates addresses to the endpoints on the host,
+// which the store refuses if the host has none left.
+func (ipam *IPAM) allocateOn(ctx context.Context, client *common.RestClient, hostID string, endpoints []*Endpoint) (common.Host, error) {
+	first := endpoints[0]
+	upToEndpointIpInt, dc, host, err := ipam.segmentNetwork(ctx, client, hostID, first.TenantID, first.SegmentID, len(endpoints))
+	if err != nil {
+		return host, err
+	}
+	for _, endpoint := range endpoints {
+		endpoint.HostId = hostID
+	}
+	err = ipam.endpoints.AddEndpoints(ctx, endpoints, upToEndpointIpInt, dc.EndpointSpaceBits, segmentSlots(dc))
+	if httpErr, ok := err.(common.HttpError); ok {
+		if details, ok := httpErr.Details.(NoAddresses); ok {
+			details.HostName = host.Name
+			httpErr.Details = details
+			err = httpErr
+			log.Printf("IPAM refused to allocate %d addresses on host %s, which has %d left for segment %s", len(endpoints), host.Name, details.Available, first.SegmentID)
+		}
+	}
+	return host, err
+}
+
+// failoverHosts returns healthy hosts of the zone of the host, other
+// than it, that have addresses left for count more endpoints of the
+// segment, the ones with the most addresses left first.
+func (ipam *IPAM) failoverHosts(ctx context.Context, client *common.RestClient, hostID string, tenantID string, segmentID string, count int) ([]common.Host, error) {
+	hosts, index, err := ipam.topologyHosts(client, "")
+	if err != nil {
+		return nil, err
+	}
+	zone := ""
+	found := false
+	for _, host := range hosts {
+		if fmt.Sprintf("%d", host.ID) == hostID {
+			zone = hostZone(host, ipam.dc)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, common.NewError404("host", hostID)
+	}
+	usage, err := ipam.endpoints.CountEndpoints(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var candidates []failoverHost
+	for _, host := range hosts {
+		if fmt.Sprintf("%d", host.ID) == hostID || hostZone(host, ipam.dc) != zone {
+			continue
+		}
+		if host.Draining || host.Status == common.HostUnreachable || host.Status == common.HostDown {
+			continue
+		}
+		dc, err := ipam.hostDatacenter(client, index, host)
+		if err != nil {
+			return nil, err
+		}
+		left := segmentAvailable(dc, usage, fmt.Sprintf("%d", host.ID), tenantID, segmentID)
+		if left < uint64(count) {
+			continue
+		}
+		candidates = append(candidates, failoverHost{host: host, available: left})
+	}
+	sort.Stable(hostsByAvailable(candidates))
+	retval := make([]common.Host, len(candidates))
+	for i, candidate := range candidates {
+		retval[i] = candidate.host
+	}
+	return retval, nil
+}
+
+// failoverHost is a host to fail over to, with
+// how many addresses it has left for the segment.
+type failoverHost struct {
+	host      common.Host
+	available uint64
+}
+
+// hostsByAvailable sorts hosts with the most addresses left first.
+type hostsByAvailable []failoverHost
+
+func (h hostsByAvailable) Len() int           { return len(h) }
+func (h hostsByAvailable) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hostsByAvailable) Less(i, j int) bool { return h[i].available > h[j].available }
+
+// hostZone returns the name of the zone of the host,
+// empty for the datacenter itself.
+func hostZone(host common.Host, dc common.Datacenter) string {
+	if host.Zone == dc.Name {
+		return ""
+	}
+	return host.Zone
+}
@@ -16,18 +16,27 @@
 package ipam
 
 import (
+	"context"
 	"fmt"
 	"github.com/romana/core/common"
+	"github.com/romana/core/common/netutil"
 	"github.com/romana/core/tenant"
 	"log"
-	"net"
 )
 
 // IPAM provides ipam service.
 type IPAM struct {
 	config common.ServiceConfig
-	store  ipamStore
-	dc     common.Datacenter
+	// backend is configured and connected; handlers only keep
+	// endpoints and Neutron subnets in endpoints and subnets.
+	backend   Backend
+	endpoints EndpointRepository
+	subnets   SubnetRepository
+	dc        common.Datacenter
+	// Bus to publish endpoint events on, or nil.
+	bus common.EventBus
+	// limiter limits allocations of each tenant, or is nil.
+	limiter *common.RateLimiter
 }
 
 const (
@@ -43,6 +52,14 @@ func (ipam *IPAM) Routes() common.Routes {
 			Handler:         ipam.addEndpoint,
 			MakeMessage:     func() interface{} { return &Endpoint{} },
 			UseRequestToken: true,
+			Idempotent:      true,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         "/endpoints/bulk",
+			Handler:         ipam.addEndpoints,
+			MakeMessage:     func() interface{} { return &BulkAllocation{} },
+			UseRequestToken: false,
 		},
 		common.Route{
 			Method:          "DELETE",
@@ -51,14 +68,44 @@ func (ipam *IPAM) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/hosts/{hostId}/endpoints",
+			Handler:         ipam.listHostEndpoints,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/tenants/{tenantId}/endpoints",
+			Handler:         ipam.listTenantEndpoints,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/capacity",
+			Handler:         ipam.listCapacity,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         "/hosts/{hostId}/capacity",
+			Handler:         ipam.getHostCapacity,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         "/allocateIP",
 			Handler:         ipam.allocateIP,
 			MakeMessage:     nil,
 			UseRequestToken: false,
+			Idempotent:      true,
 		},
 	}
+	routes = append(routes, ipam.neutronRoutes()...)
 	return routes
 }
 
@@ -147,91 +194,219 @@ func (ipam *IPAM) allocateIP(input interface{}, ctx common.RestContext) (interfa
 // allocate an IP address.
 func (ipam *IPAM) addEndpoint(input interface{}, ctx common.RestContext) (interface{}, error) {
 	endpoint := input.(*Endpoint)
+	err := ipam.limiter.Check("tenant " + endpoint.TenantID)
+	if err != nil {
+		log.Printf("IPAM refused to allocate an address: %v", err)
+		return nil, err
+	}
 	client, err := common.NewRestClient(common.GetRestClientConfig(ipam.config))
 	if err != nil {
 		log.Printf("IPAM encountered an error getting a REST client instance: %v", err)
 		return nil, err
 	}
+	// Stop calling other services once the request has timed out.
+	client = client.WithContext(ctx.Context)
+	failover := ctx.QueryVariables.Get("failover") == "true"
+	requestedHostID := endpoint.HostId
+	host, err := ipam.allocate(ctx.Context, client, []*Endpoint{endpoint}, failover)
+	if err != nil {
+		log.Printf("IPAM encountered an error adding endpoint to db: %v", err)
+		return nil, err
+	}
+	common.PublishEvent(ipam.bus, common.BusTopicEndpoints, common.EndpointAllocated, endpoint)
+	if failover {
+		return Allocation{Endpoint: endpoint, Host: host, FailedOver: endpoint.HostId != requestedHostID, RequestedHostID: requestedHostID}, nil
+	}
+	return endpoint, nil
+
+}
+
+// BulkAllocation asks for addresses for several
+// endpoints of a segment on a host at once.
+type BulkAllocation struct {
+	TenantID  string   `json:"tenant_id"`
+	SegmentID string   `json:"segment_id"`
+	HostId    string   `json:"host_id"`
+	Names     []string `json:"names"`
+}
+
+// addEndpoints handles request to add endpoints named in
+// BulkAllocation, allocating addresses to all of them or,
+// on error, none.
+func (ipam *IPAM) addEndpoints(input interface{}, ctx common.RestContext) (interface{}, error) {
+	bulk := input.(*BulkAllocation)
+	if len(bulk.Names) == 0 {
+		return nil, common.NewError400("Names of endpoints are required")
+	}
+	err := ipam.limiter.Check("tenant " + bulk.TenantID)
+	if err != nil {
+		log.Printf("IPAM refused to allocate %d addresses: %v", len(bulk.Names), err)
+		return nil, err
+	}
+	client, err := common.NewRestClient(common.GetRestClientConfig(ipam.config))
+	if err != nil {
+		log.Printf("IPAM encountered an error getting a REST client instance: %v", err)
+		return nil, err
+	}
+	client = client.WithContext(ctx.Context)
+	failover := ctx.QueryVariables.Get("failover") == "true"
+	endpoints := make([]*Endpoint, len(bulk.Names))
+	for i, name := range bulk.Names {
+		endpoints[i] = &Endpoint{Name: name, TenantID: bulk.TenantID, SegmentID: bulk.SegmentID, HostId: bulk.HostId}
+	}
+	host, err := ipam.allocate(ctx.Context, client, endpoints, failover)
+	if err != nil {
+		log.Printf("IPAM encountered an error adding %d endpoints to db: %v", len(endpoints), err)
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		common.PublishEvent(ipam.bus, common.BusTopicEndpoints, common.EndpointAllocated, endpoint)
+	}
+	if failover {
+		return Allocation{Endpoints: endpoints, Host: host, FailedOver: endpoints[0].HostId != bulk.HostId, RequestedHostID: bulk.HostId}, nil
+	}
+	return endpoints, nil
+}
+
+// segmentNetwork checks that count more endpoints of the segment
+// may be allocated on the host, and returns the address they share
+// up to bits of the endpoint, along with the datacenter or zone of
+// the host, which gives the stride of their network IDs (see
+// GetEffectiveNetworkID) and the slots of the segment, and the host.
+func (ipam *IPAM) segmentNetwork(ctx context.Context, client *common.RestClient, hostID string, tenantID string, segmentID string, count int) (uint64, common.Datacenter, common.Host, error) {
 	// Get host info from topology service
 	topoUrl, err := client.GetServiceUrl("topology")
 	if err != nil {
 		log.Printf("IPAM encountered an error getting a topology service URL %v", err)
-		return nil, err
+		return 0, common.Datacenter{}, common.Host{}, err
 	}
 
 	index := common.IndexResponse{}
 	err = client.Get(topoUrl, &index)
 	if err != nil {
 		log.Printf("IPAM encountered an error querying topology: %v", err)
-		return nil, err
+		return 0, common.Datacenter{}, common.Host{}, err
 	}
 
 	hostsURL := index.Links.FindByRel("host-list")
 	host := common.Host{}
 
-	hostInfoURL := fmt.Sprintf("%s/%s", hostsURL, endpoint.HostId)
+	hostInfoURL := fmt.Sprintf("%s/%s", hostsURL, hostID)
 	err = client.Get(hostInfoURL, &host)
 
 	if err != nil {
 		log.Printf("IPAM encountered an error querying topology for hosts: %v", err)
-		return nil, err
+		return 0, common.Datacenter{}, host, err
+	}
+	if host.Draining {
+		log.Printf("IPAM refused to allocate an address on draining host %s", host.Name)
+		return 0, common.Datacenter{}, host, common.NewErrorConflict(fmt.Sprintf("Host %s is draining", host.Name))
+	}
+	if host.Status == common.HostDown {
+		log.Printf("IPAM refused to allocate an address on host %s, which is down", host.Name)
+		return 0, common.Datacenter{}, host, common.NewErrorConflict(fmt.Sprintf("Host %s is down", host.Name))
+	}
+	dc, err := ipam.hostDatacenter(client, index, host)
+	if err != nil {
+		return 0, dc, host, err
 	}
 
 	tenantUrl, err := client.GetServiceUrl("tenant")
 	if err != nil {
 		log.Printf("IPAM encountered an error getting tenant srevice URL: %v", err)
-		return nil, err
+		return 0, dc, host, err
 	}
 
 	// TODO follow links once tenant service supports it. For now...
 
 	t := &tenant.Tenant{}
-	tenantsUrl := fmt.Sprintf("%s/tenants/%s", tenantUrl, endpoint.TenantID)
+	tenantsUrl := fmt.Sprintf("%s/tenants/%s", tenantUrl, tenantID)
 	log.Printf("IPAM calling %s\n", tenantsUrl)
 	err = client.Get(tenantsUrl, t)
 	if err != nil {
-		log.Printf("IPAM encountered an error querying tenant service for tenant %s: %v", endpoint.TenantID, err)
-		return nil, err
+		log.Printf("IPAM encountered an error querying tenant service for tenant %s: %v", tenantID, err)
+		return 0, dc, host, err
 	}
 	log.Printf("IPAM: received tenant %s ID %d, network ID %d\n", t.Name, t.ID, t.NetworkID)
+	used, err := ipam.endpoints.ListTenantEndpoints(ctx, fmt.Sprintf("%d", t.ID))
+	if err != nil {
+		return 0, dc, host, err
+	}
+	err = tenant.CheckQuota(client, t.ID, tenant.QuotaEndpoints, len(used)+count-1)
+	if err != nil {
+		log.Printf("IPAM refused to allocate an address for tenant %s: %v", t.Name, err)
+		return 0, dc, host, err
+	}
 
-	segmentUrl := fmt.Sprintf("/tenants/%s/segments/%s", endpoint.TenantID, endpoint.SegmentID)
+	segmentUrl := fmt.Sprintf("/tenants/%s/segments/%s", tenantID, segmentID)
 	log.Printf("IPAM: calling %s\n", segmentUrl)
 	segment := &tenant.Segment{}
 	err = client.Get(segmentUrl, segment)
 	if err != nil {
-		log.Printf("IPAM encountered an error querying tenant service for tenant %s and segment %s: %v", endpoint.TenantID, endpoint.SegmentID, err)
-		return nil, err
+		log.Printf("IPAM encountered an error querying tenant service for tenant %s and segment %s: %v", tenantID, segmentID, err)
+		return 0, dc, host, err
 	}
 
 	log.Printf("Constructing IP from Host IP %s, Tenant %d, Segment %d", host.RomanaIp, t.NetworkID, segment.NetworkID)
 
-	endpointBits := 32 - ipam.dc.PrefixBits - ipam.dc.PortBits - ipam.dc.TenantBits - ipam.dc.SegmentBits - ipam.dc.EndpointSpaceBits
+	endpointBits := 32 - dc.PrefixBits - dc.PortBits - dc.TenantBits - dc.SegmentBits - dc.EndpointSpaceBits
 	segmentBitShift := endpointBits
 	//	prefixBitShift := 32 - ipam.dc.PrefixBits
-	tenantBitShift := segmentBitShift + ipam.dc.SegmentBits
+	tenantBitShift := segmentBitShift + dc.SegmentBits
 	log.Printf("Parsing Romana IP address of host %s: %s\n", host.Name, host.RomanaIp)
-	_, network, err := net.ParseCIDR(host.RomanaIp)
+	network, err := netutil.ParseCIDR(host.RomanaIp)
 	if err != nil {
 		log.Printf("IPAM encountered an error parsing %s: %v", host.RomanaIp, err)
-		return nil, err
+		return 0, dc, host, err
 	}
-	hostIpInt := common.IPv4ToInt(network.IP)
+	hostIpInt := netutil.IPv4ToInt(network.IP)
 	upToEndpointIpInt := hostIpInt | (t.NetworkID << tenantBitShift) | (segment.NetworkID << segmentBitShift)
-	log.Printf("IPAM: before calling addEndpoint:  %v | (%v << %v) | (%v << %v): %v ", network.IP.String(), t.NetworkID, tenantBitShift, segment.NetworkID, segmentBitShift, common.IntToIPv4(upToEndpointIpInt))
-	err = ipam.store.addEndpoint(endpoint, upToEndpointIpInt, ipam.dc.EndpointSpaceBits)
+	log.Printf("IPAM: before calling addEndpoint:  %v | (%v << %v) | (%v << %v): %v ", network.IP.String(), t.NetworkID, tenantBitShift, segment.NetworkID, segmentBitShift, netutil.IntToIPv4(upToEndpointIpInt))
+	return upToEndpointIpInt, dc, host, nil
+}
+
+// hostDatacenter returns the datacenter parameters for the host:
+// hosts in zones other than the datacenter itself use bit
+// allocation of their zone.
+func (ipam *IPAM) hostDatacenter(client *common.RestClient, topologyIndex common.IndexResponse, host common.Host) (common.Datacenter, error) {
+	dc := ipam.dc
+	if host.Zone == "" || host.Zone == dc.Name {
+		return dc, nil
+	}
+	zoneURL := fmt.Sprintf("%s/%s", topologyIndex.Links.FindByRel("zone-list"), host.Zone)
+	err := client.Get(zoneURL, &dc)
 	if err != nil {
-		log.Printf("IPAM encountered an error adding endpoint to db: %v", err)
-		return nil, err
+		log.Printf("IPAM encountered an error querying topology for zone %s: %v", host.Zone, err)
+		return dc, err
 	}
-	return endpoint, nil
-
+	return dc, nil
 }
 
 // deleteEndpoint releases the IP(s) owned by the endpoint into assignable
 // pool.
 func (ipam *IPAM) deleteEndpoint(input interface{}, ctx common.RestContext) (interface{}, error) {
-	return ipam.store.deleteEndpoint(ctx.PathVariables["ip"])
+	return ipam.releaseEndpoint(ctx.Context, ctx.PathVariables["ip"])
+}
+
+// releaseEndpoint releases the endpoint with the IP and
+// publishes its release.
+func (ipam *IPAM) releaseEndpoint(ctx context.Context, ip string) (Endpoint, error) {
+	endpoint, err := ipam.endpoints.DeleteEndpoint(ctx, ip)
+	if err != nil {
+		return endpoint, err
+	}
+	common.PublishEvent(ipam.bus, common.BusTopicEndpoints, common.EndpointReleased, endpoint)
+	return endpoint, nil
+}
+
+// listHostEndpoints lists endpoints allocated on the host.
+func (ipam *IPAM) listHostEndpoints(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.endpoints.ListHostEndpoints(ctx.Context, ctx.PathVariables["hostId"])
+}
+
+// listTenantEndpoints lists endpoints allocated to the tenant.
+func (ipam *IPAM) listTenantEndpoints(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.endpoints.ListTenantEndpoints(ctx.Context, ctx.PathVariables["tenantId"])
 }
 
 // Name provides name of this service.
@@ -239,6 +414,29 @@ func (ipam *IPAM) Name() string {
 	return "ipam"
 }
 
+// CheckHealth implements common.HealthChecker by checking the database.
+func (ipam *IPAM) CheckHealth() error {
+	return ipam.backend.Ping()
+}
+
+// Snapshot implements common.Snapshotter by taking a
+// snapshot of the database, for backups.
+func (ipam *IPAM) Snapshot(ctx context.Context) (common.StoreSnapshot, error) {
+	return common.SnapshotStore(ctx, ipam.backend)
+}
+
+// Restore implements common.Snapshotter by restoring
+// the snapshot into the database.
+func (ipam *IPAM) Restore(ctx context.Context, snapshot common.StoreSnapshot) error {
+	return common.RestoreStore(ctx, ipam.backend, snapshot)
+}
+
+// MaintenanceJobs implements common.Maintainer, analyzing
+// the endpoint tables if configured to.
+func (ipam *IPAM) MaintenanceJobs() map[string]common.MaintenanceJob {
+	return common.StoreMaintenanceJobs(ipam.backend)
+}
+
 // SetConfig implements SetConfig function of the Service interface.
 // Returns an error if cannot connect to the data store
 func (ipam *IPAM) SetConfig(config common.ServiceConfig) error {
@@ -246,14 +444,29 @@ func (ipam *IPAM) SetConfig(config common.ServiceConfig) error {
 	ipam.config = config
 	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
 	log.Printf("IPAM port: %d", config.Common.Api.Port)
-	ipam.store = ipamStore{}
-	ipam.store.ServiceStore = &ipam.store
-	return ipam.store.SetConfig(storeConfig)
+	limiter, err := common.ParseRateLimit(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	ipam.limiter = limiter
+	if ipam.backend == nil {
+		ipam.SetStore(newAllocatorStore())
+	}
+	return ipam.backend.SetConfig(storeConfig)
+
+}
 
+// SetStore makes IPAM keep endpoints in the store, such as
+// one of package ipamtest, rather than in the database
+// configured. It must be called before SetConfig.
+func (ipam *IPAM) SetStore(store Store) {
+	ipam.backend = store
+	ipam.endpoints = store
+	ipam.subnets = store
 }
 
 func (ipam *IPAM) createSchema(overwrite bool) error {
-	return ipam.store.CreateSchema(overwrite)
+	return ipam.backend.CreateSchema(overwrite)
 }
 
 // Run mainly runs IPAM service.
@@ -276,7 +489,7 @@ func Run(rootServiceUrl string, cred *common.Credential) (*common.RestServiceInf
 // Initialize implements Initialize method of Service interface
 func (ipam *IPAM) Initialize() error {
 	log.Println("Entering ipam.Initialize()")
-	err := ipam.store.Connect()
+	err := ipam.backend.Connect()
 	if err != nil {
 		return err
 	}
@@ -305,7 +518,8 @@ func (ipam *IPAM) Initialize() error {
 	}
 	// TODO should this always be queried?
 	ipam.dc = dc
-	return nil
+	ipam.bus, err = common.NewEventBus(ipam.Name(), ipam.config.ServiceSpecific)
+	return err
 }
 
 // CreateSchema creates schema for IPAM service.
@@ -326,5 +540,5 @@ func CreateSchema(rootServiceUrl string, overwrite bool) error {
 	if err != nil {
 		return err
 	}
-	return ipam.store.CreateSchema(overwrite)
+	return ipam.backend.CreateSchema(overwrite)
 }
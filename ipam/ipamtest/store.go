@@ -0,0 +1,315 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package ipamtest provides an in-memory ipam.Store, so that IPAM
+// can be tested without a database (see ipam.IPAM.SetStore).
+package ipamtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+)
+
+// Store keeps endpoints and Neutron subnets in memory, allocating
+// addresses the way the database-backed store does.
+type Store struct {
+	mu        sync.Mutex
+	nextID    uint64
+	endpoints []ipam.Endpoint
+	subnets   []ipam.NeutronSubnet
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// SetConfig implements ipam.Store; the configuration is ignored.
+func (s *Store) SetConfig(config map[string]interface{}) error {
+	return nil
+}
+
+// Connect implements ipam.Store.
+func (s *Store) Connect() error {
+	return nil
+}
+
+// CreateSchema implements ipam.Store, emptying the store if force is set.
+func (s *Store) CreateSchema(force bool) error {
+	if force {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.endpoints = nil
+		s.subnets = nil
+	}
+	return nil
+}
+
+// Ping implements ipam.Store.
+func (s *Store) Ping() error {
+	return nil
+}
+
+// AddEndpoint implements ipam.Store. An address released in the
+// host's tenant segment is reused before a new one is allocated.
+func (s *Store) AddEndpoint(ctx context.Context, endpoint *ipam.Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error {
+	return s.AddEndpoints(ctx, []*ipam.Endpoint{endpoint}, upToEndpointIpInt, stride, slots)
+}
+
+// AddEndpoints implements ipam.Store.
+func (s *Store) AddEndpoints(ctx context.Context, endpoints []*ipam.Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := endpoints[0]
+	var used uint64
+	for _, e := range s.endpoints {
+		if e.InUse && e.HostId == first.HostId && e.TenantID == first.TenantID && e.SegmentID == first.SegmentID {
+			used++
+		}
+	}
+	if used+uint64(len(endpoints)) > slots {
+		available := uint64(0)
+		if used < slots {
+			available = slots - used
+		}
+		return common.NewErrorConflict(ipam.NoAddresses{HostID: first.HostId, TenantID: first.TenantID, SegmentID: first.SegmentID, Available: available})
+	}
+	saved := make([]ipam.Endpoint, len(s.endpoints))
+	copy(saved, s.endpoints)
+	savedID := s.nextID
+	for _, endpoint := range endpoints {
+		if err := s.addEndpoint(endpoint, upToEndpointIpInt, stride); err != nil {
+			s.endpoints, s.nextID = saved, savedID
+			return err
+		}
+	}
+	return nil
+}
+
+// addEndpoint allocates an address to the endpoint.
+// Must be called with s.mu locked.
+func (s *Store) addEndpoint(endpoint *ipam.Endpoint, upToEndpointIpInt uint64, stride uint) error {
+	if endpoint.RequestToken.Valid {
+		for _, e := range s.endpoints {
+			if e.RequestToken == endpoint.RequestToken {
+				return errors.New("UNIQUE constraint failed: endpoints.request_token")
+			}
+		}
+	}
+	now := time.Now()
+	endpoint.InUse = true
+	endpoint.CreatedAt = &now
+	endpoint.UpdatedAt = &now
+	released := -1
+	var maxNetworkID int64 = -1
+	for i, e := range s.endpoints {
+		if e.HostId != endpoint.HostId || e.TenantID != endpoint.TenantID || e.SegmentID != endpoint.SegmentID {
+			continue
+		}
+		if !e.InUse && (released < 0 || e.NetworkID < s.endpoints[released].NetworkID) {
+			released = i
+		}
+		if e.InUse && int64(e.NetworkID) > maxNetworkID {
+			maxNetworkID = int64(e.NetworkID)
+		}
+	}
+	if released >= 0 {
+		endpoint.Ip = s.endpoints[released].Ip
+		s.endpoints[released].InUse = true
+		s.endpoints[released].RequestToken = endpoint.RequestToken
+		s.endpoints[released].CreatedAt = &now
+		s.endpoints[released].UpdatedAt = &now
+		return nil
+	}
+	endpoint.NetworkID = uint64(maxNetworkID + 1)
+	endpoint.EffectiveNetworkID = ipam.GetEffectiveNetworkID(endpoint.NetworkID, stride)
+	endpoint.Ip = common.IntToIPv4(upToEndpointIpInt | endpoint.EffectiveNetworkID).String()
+	for _, e := range s.endpoints {
+		if e.HostId == endpoint.HostId && e.TenantID == endpoint.TenantID && e.SegmentID == endpoint.SegmentID && e.NetworkID == endpoint.NetworkID {
+			return errors.New("UNIQUE constraint failed: endpoints.tenant_id, endpoints.segment_id, endpoints.host_id, endpoints.network_id")
+		}
+	}
+	s.nextID++
+	endpoint.Id = s.nextID
+	s.endpoints = append(s.endpoints, *endpoint)
+	return nil
+}
+
+// DeleteEndpoint implements ipam.Store.
+func (s *Store) DeleteEndpoint(ctx context.Context, ip string) (ipam.Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return ipam.Endpoint{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.endpoints {
+		if e.Ip == ip {
+			s.endpoints[i].InUse = false
+			s.endpoints[i].RequestToken = sql.NullString{}
+			now := time.Now()
+			s.endpoints[i].UpdatedAt = &now
+			e.UpdatedAt = &now
+			return e, nil
+		}
+	}
+	return ipam.Endpoint{}, common.NewError404("endpoint", ip)
+}
+
+// inUse returns endpoints in use for which match returns true.
+func (s *Store) inUse(match func(e ipam.Endpoint) bool) []ipam.Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoints := make([]ipam.Endpoint, 0)
+	for _, e := range s.endpoints {
+		if e.InUse && match(e) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// ListHostEndpoints implements ipam.Store.
+func (s *Store) ListHostEndpoints(ctx context.Context, hostId string) ([]ipam.Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	return s.inUse(func(e ipam.Endpoint) bool { return e.HostId == hostId }), nil
+}
+
+// ListTenantEndpoints implements ipam.Store.
+func (s *Store) ListTenantEndpoints(ctx context.Context, tenantId string) ([]ipam.Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	return s.inUse(func(e ipam.Endpoint) bool { return e.TenantID == tenantId }), nil
+}
+
+// FindEndpointByRequestToken implements ipam.Store.
+func (s *Store) FindEndpointByRequestToken(ctx context.Context, token string) (ipam.Endpoint, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return ipam.Endpoint{}, err
+	}
+	endpoints := s.inUse(func(e ipam.Endpoint) bool { return e.RequestToken.Valid && e.RequestToken.String == token })
+	if len(endpoints) == 0 {
+		return ipam.Endpoint{}, common.NewError404("endpoint", token)
+	}
+	return endpoints[0], nil
+}
+
+// usageList sorts usage by host, tenant and segment,
+// as the database groups it.
+type usageList []ipam.SegmentUsage
+
+func (l usageList) Len() int      { return len(l) }
+func (l usageList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l usageList) Less(i, j int) bool {
+	if l[i].HostId != l[j].HostId {
+		return l[i].HostId < l[j].HostId
+	}
+	if l[i].TenantID != l[j].TenantID {
+		return l[i].TenantID < l[j].TenantID
+	}
+	return l[i].SegmentID < l[j].SegmentID
+}
+
+// CountEndpoints implements ipam.Store.
+func (s *Store) CountEndpoints(ctx context.Context, hostId string) ([]ipam.SegmentUsage, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	endpoints := s.inUse(func(e ipam.Endpoint) bool { return hostId == "" || e.HostId == hostId })
+	var retval usageList
+	counted := make(map[ipam.SegmentUsage]int)
+	for _, e := range endpoints {
+		key := ipam.SegmentUsage{HostId: e.HostId, TenantID: e.TenantID, SegmentID: e.SegmentID}
+		i, ok := counted[key]
+		if !ok {
+			i = len(retval)
+			counted[key] = i
+			retval = append(retval, key)
+		}
+		retval[i].Used++
+	}
+	sort.Sort(retval)
+	return retval, nil
+}
+
+// PutNeutronSubnet implements ipam.Store.
+func (s *Store) PutNeutronSubnet(ctx context.Context, subnet *ipam.NeutronSubnet) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteSubnets(func(n ipam.NeutronSubnet) bool { return n.SubnetID == subnet.SubnetID })
+	s.nextID++
+	subnet.Id = s.nextID
+	s.subnets = append(s.subnets, *subnet)
+	return nil
+}
+
+// GetNeutronSubnet implements ipam.Store.
+func (s *Store) GetNeutronSubnet(ctx context.Context, subnetID string) (ipam.NeutronSubnet, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return ipam.NeutronSubnet{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, subnet := range s.subnets {
+		if subnet.SubnetID == subnetID {
+			return subnet, nil
+		}
+	}
+	return ipam.NeutronSubnet{}, common.NewError404("subnet", subnetID)
+}
+
+// DeleteNeutronSubnets implements ipam.Store.
+func (s *Store) DeleteNeutronSubnets(ctx context.Context, subnetID string, networkID string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if subnetID != "" {
+		s.deleteSubnets(func(n ipam.NeutronSubnet) bool { return n.SubnetID == subnetID })
+	} else {
+		s.deleteSubnets(func(n ipam.NeutronSubnet) bool { return n.NetworkID == networkID })
+	}
+	return nil
+}
+
+// deleteSubnets deletes subnets for which match returns true.
+func (s *Store) deleteSubnets(match func(n ipam.NeutronSubnet) bool) {
+	kept := s.subnets[:0]
+	for _, subnet := range s.subnets {
+		if !match(subnet) {
+			kept = append(kept, subnet)
+		}
+	}
+	s.subnets = kept
+}
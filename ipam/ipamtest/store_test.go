@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipamtest
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+)
+
+var _ ipam.Store = &Store{}
+
+// TestEndpoints tests allocation and release of addresses.
+func TestEndpoints(t *testing.T) {
+	store := NewStore()
+	// 10.1.0.0 with 2 endpoint space bits.
+	prefix := uint64(10<<24 | 1<<16)
+	slots := uint64(64)
+	var ips []string
+	for i := 0; i < 3; i++ {
+		endpoint := &ipam.Endpoint{HostId: "1", TenantID: "t1", SegmentID: "s1"}
+		if err := store.AddEndpoint(nil, endpoint, prefix, 2, slots); err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, endpoint.Ip)
+	}
+	if ips[0] != "10.1.0.3" || ips[1] != "10.1.0.7" || ips[2] != "10.1.0.11" {
+		t.Errorf("Unexpected addresses %v", ips)
+	}
+
+	released, err := store.DeleteEndpoint(nil, "10.1.0.7")
+	if err != nil || released.Ip != "10.1.0.7" {
+		t.Fatalf("Expected 10.1.0.7 to be released, got %v, %v", released, err)
+	}
+	if _, err := store.DeleteEndpoint(nil, "10.1.0.99"); err == nil {
+		t.Error("Expected error releasing unknown address")
+	}
+	endpoint := &ipam.Endpoint{HostId: "1", TenantID: "t1", SegmentID: "s1", RequestToken: sql.NullString{String: "port1", Valid: true}}
+	if err := store.AddEndpoint(nil, endpoint, prefix, 2, slots); err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Ip != "10.1.0.7" {
+		t.Errorf("Expected released address to be reused, got %s", endpoint.Ip)
+	}
+	duplicate := &ipam.Endpoint{HostId: "2", TenantID: "t1", SegmentID: "s1", RequestToken: endpoint.RequestToken}
+	if err := store.AddEndpoint(nil, duplicate, prefix, 2, slots); err == nil {
+		t.Error("Expected error for duplicate request token")
+	}
+	found, err := store.FindEndpointByRequestToken(nil, "port1")
+	if err != nil || found.Ip != "10.1.0.7" {
+		t.Errorf("Expected endpoint for port1, got %v, %v", found, err)
+	}
+	// A reused address is a new allocation.
+	if found.CreatedAt == nil || found.CreatedAt.Before(*released.UpdatedAt) {
+		t.Errorf("Expected endpoint for port1 created after release at %v, got %v", released.UpdatedAt, found.CreatedAt)
+	}
+
+	other := &ipam.Endpoint{HostId: "2", TenantID: "t1", SegmentID: "s2"}
+	if err := store.AddEndpoint(nil, other, prefix, 2, slots); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.CountEndpoints(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0].HostId != "1" || usage[0].Used != 3 || usage[1].HostId != "2" || usage[1].Used != 1 {
+		t.Errorf("Unexpected usage %v", usage)
+	}
+	endpoints, _ := store.ListTenantEndpoints(nil, "t1")
+	if len(endpoints) != 4 {
+		t.Errorf("Expected 4 endpoints of t1, got %v", endpoints)
+	}
+	endpoints, _ = store.ListHostEndpoints(nil, "2")
+	if len(endpoints) != 1 || endpoints[0].Ip != other.Ip {
+		t.Errorf("Expected %s on host 2, got %v", other.Ip, endpoints)
+	}
+
+	// Bulk allocation reuses released addresses first.
+	store.DeleteEndpoint(nil, "10.1.0.3")
+	bulk := []*ipam.Endpoint{
+		{HostId: "1", TenantID: "t1", SegmentID: "s1"},
+		{HostId: "1", TenantID: "t1", SegmentID: "s1"},
+	}
+	if err := store.AddEndpoints(nil, bulk, prefix, 2, slots); err != nil {
+		t.Fatal(err)
+	}
+	if bulk[0].Ip != "10.1.0.3" || bulk[1].Ip != "10.1.0.15" {
+		t.Errorf("Unexpected addresses %s, %s", bulk[0].Ip, bulk[1].Ip)
+	}
+	// None is allocated if one cannot be.
+	bulk = []*ipam.Endpoint{
+		{HostId: "1", TenantID: "t1", SegmentID: "s1"},
+		{HostId: "1", TenantID: "t1", SegmentID: "s1", RequestToken: endpoint.RequestToken},
+	}
+	if err := store.AddEndpoints(nil, bulk, prefix, 2, slots); err == nil {
+		t.Error("Expected error for duplicate request token")
+	}
+	endpoints, _ = store.ListHostEndpoints(nil, "1")
+	if len(endpoints) != 4 {
+		t.Errorf("Expected 4 endpoints on host 1, got %v", endpoints)
+	}
+
+	// Nor if the segment has too few slots left.
+	bulk = []*ipam.Endpoint{
+		{HostId: "1", TenantID: "t1", SegmentID: "s1"},
+		{HostId: "1", TenantID: "t1", SegmentID: "s1"},
+	}
+	err = store.AddEndpoints(nil, bulk, prefix, 2, 5)
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.Details != (ipam.NoAddresses{HostID: "1", TenantID: "t1", SegmentID: "s1", Available: 1}) {
+		t.Errorf("Expected no addresses left, got %v", err)
+	}
+	if err := store.AddEndpoints(nil, bulk[:1], prefix, 2, 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNeutronSubnets tests mappings of Neutron subnets.
+func TestNeutronSubnets(t *testing.T) {
+	store := NewStore()
+	for _, subnet := range []ipam.NeutronSubnet{
+		{SubnetID: "a", NetworkID: "n1", TenantID: "t1"},
+		{SubnetID: "b", NetworkID: "n1", TenantID: "t1"},
+		{SubnetID: "a", NetworkID: "n1", TenantID: "t2"},
+	} {
+		if err := store.PutNeutronSubnet(nil, &subnet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subnet, err := store.GetNeutronSubnet(nil, "a")
+	if err != nil || subnet.TenantID != "t2" {
+		t.Errorf("Expected subnet a to be replaced, got %v, %v", subnet, err)
+	}
+	if err := store.DeleteNeutronSubnets(nil, "", "n1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetNeutronSubnet(nil, "b"); err == nil {
+		t.Error("Expected subnets of n1 to be deleted")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Operations of journal entries.
+const (
+	journalAllocate = "allocate"
+	journalRelease  = "release"
+)
+
+// journalRetryInterval is how long the journal waits to write
+// changes again after the database failed to take them.
+const journalRetryInterval = time.Second
+
+// journalEntry is a change to an endpoint record.
+type journalEntry struct {
+	Op       string   `json:"op"`
+	Endpoint Endpoint `json:"endpoint"`
+	// Not serialized as part of Endpoint. The ID is that
+	// of the record to create, allocated in memory.
+	ID                 uint64 `json:"id"`
+	NetworkID          uint64 `json:"network_id"`
+	EffectiveNetworkID uint64 `json:"effective_network_id"`
+}
+
+// apply writes the change to the database. The record of an allocated
+// endpoint is looked up by network ID and updated or, if there is
+// none, created, so that applying an entry twice has no further effect.
+func (entry *journalEntry) apply(tx *gorm.DB) error {
+	endpoint := &entry.Endpoint
+	if entry.Op == journalRelease {
+		return tx.Model(Endpoint{}).Where("ip = ?", endpoint.Ip).Updates(map[string]interface{}{"in_use": false, "request_token": sql.NullString{}}).Error
+	}
+	where := "host_id = ? AND tenant_id = ? AND segment_id = ? AND network_id = ?"
+	var count int
+	err := tx.Model(Endpoint{}).Where(where, endpoint.HostId, endpoint.TenantID, endpoint.SegmentID, entry.NetworkID).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		// Saved rather than updated, for the request
+		// token to be encrypted if it is configured.
+		record := Endpoint{}
+		err = tx.Where(where, endpoint.HostId, endpoint.TenantID, endpoint.SegmentID, entry.NetworkID).First(&record).Error
+		if err != nil {
+			return err
+		}
+		record.InUse = true
+		record.RequestToken = endpoint.RequestToken
+		// The reused record is a new allocation.
+		record.CreatedAt = endpoint.CreatedAt
+		return tx.Save(&record).Error
+	}
+	endpoint.InUse = true
+	endpoint.Id = entry.ID
+	endpoint.NetworkID = entry.NetworkID
+	endpoint.EffectiveNetworkID = entry.EffectiveNetworkID
+	return tx.Create(endpoint).Error
+}
+
+// journal is a file of changes to endpoint records, one JSON
+// entry per line. Changes are synced to the file before they
+// are acknowledged, and written to the database behind.
+type journal struct {
+	path  string
+	apply func(entries []journalEntry) error
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []journalEntry
+	wake    chan struct{}
+
+	// Held while changes are written to the database,
+	// so that flush does not race writeBehind.
+	writing sync.Mutex
+}
+
+// openJournal applies the changes left in the journal at the path, if
+// any, and starts writing changes appended to it with apply.
+func openJournal(path string, apply func(entries []journalEntry) error) (*journal, error) {
+	entries, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		log.Printf("IpamStore: Applying %d changes from journal %s", len(entries), path)
+		if err = apply(entries); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	j := &journal{path: path, apply: apply, file: file, wake: make(chan struct{}, 1)}
+	go j.writeBehind()
+	return j, nil
+}
+
+// readJournal returns the entries in the journal at the path. A last
+// line that is incomplete is ignored: it was never acknowledged.
+func readJournal(path string) ([]journalEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []journalEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				log.Printf("IpamStore: Ignoring incomplete entry at the end of journal %s", path)
+			}
+			break
+		}
+		entry := journalEntry{}
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// append syncs the entries to the journal, to be
+// written to the database behind.
+func (j *journal) append(entries []journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = writeEntries(j.file, entries); err != nil {
+		// Do not leave entries that were not acknowledged.
+		j.file.Truncate(info.Size())
+		return err
+	}
+	j.pending = append(j.pending, entries...)
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeEntries writes the entries to the file and syncs it.
+func writeEntries(file *os.File, entries []journalEntry) error {
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeBehind writes pending changes to the database, retrying until
+// the database takes them, and removes them from the journal.
+func (j *journal) writeBehind() {
+	for range j.wake {
+		for {
+			j.writing.Lock()
+			j.mu.Lock()
+			batch := make([]journalEntry, len(j.pending))
+			copy(batch, j.pending)
+			j.mu.Unlock()
+			if len(batch) == 0 {
+				j.writing.Unlock()
+				break
+			}
+			if err := j.apply(batch); err != nil {
+				j.writing.Unlock()
+				log.Printf("IpamStore: Cannot write %d changes from journal %s: %v", len(batch), j.path, err)
+				time.Sleep(journalRetryInterval)
+				continue
+			}
+			j.mu.Lock()
+			j.pending = j.pending[len(batch):]
+			err := j.rewrite()
+			j.mu.Unlock()
+			j.writing.Unlock()
+			if err != nil {
+				log.Printf("IpamStore: Cannot remove changes written from journal %s: %v", j.path, err)
+			}
+		}
+	}
+}
+
+// flush writes pending changes to the database now, so that the
+// database can be read or replaced. Changes must not be appended
+// meanwhile.
+func (j *journal) flush() error {
+	j.writing.Lock()
+	defer j.writing.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.pending) == 0 {
+		return nil
+	}
+	if err := j.apply(j.pending); err != nil {
+		return err
+	}
+	j.pending = nil
+	return j.rewrite()
+}
+
+// rewrite replaces the journal with one of the pending entries.
+// Entries written to the database may stay in the journal if this
+// fails, since applying them again has no effect.
+func (j *journal) rewrite() error {
+	if len(j.pending) == 0 {
+		if err := j.file.Truncate(0); err != nil {
+			return err
+		}
+		return j.file.Sync()
+	}
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeEntries(file, j.pending)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	return nil
+}
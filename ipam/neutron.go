@@ -0,0 +1,426 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipam
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/netutil"
+	"github.com/romana/core/tenant"
+	"log"
+	"net/http"
+)
+
+// Routes used by the Neutron ML2 mechanism driver.
+const (
+	neutronNetworksPath = "/neutron/networks"
+	neutronSubnetsPath  = "/neutron/subnets"
+	neutronPortsPath    = "/neutron/ports"
+)
+
+// NeutronNetwork maps a Neutron network to a Romana segment of the
+// tenant whose external ID is the network's project.
+type NeutronNetwork struct {
+	ID        string `json:"id,omitempty"`
+	ProjectID string `json:"project_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// Romana tenant and segment the network is mapped to.
+	TenantID  string `json:"tenant_id,omitempty"`
+	SegmentID string `json:"segment_id,omitempty"`
+}
+
+// NeutronSubnet maps a Neutron subnet to the segment of its network,
+// for allocation requests that only carry the subnet.
+type NeutronSubnet struct {
+	SubnetID  string `json:"id,omitempty" sql:"unique"`
+	NetworkID string `json:"network_id,omitempty"`
+	CIDR      string `json:"cidr,omitempty"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	SegmentID string `json:"segment_id,omitempty"`
+	Id        uint64 `sql:"AUTO_INCREMENT" json:"-"`
+}
+
+// NeutronPort is a Neutron port to allocate an address for. Its UUID
+// is the request token of the endpoint, so that repeated requests for
+// the same port get the same address.
+type NeutronPort struct {
+	ID        string `json:"id,omitempty"`
+	NetworkID string `json:"network_id,omitempty"`
+	SubnetID  string `json:"subnet_id,omitempty"`
+	// HostID is the binding:host_id of the port, the name of the host.
+	HostID string `json:"host_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// neutronRoutes returns the routes for the Neutron ML2 mechanism driver.
+func (ipam *IPAM) neutronRoutes() common.Routes {
+	return common.Routes{
+		common.Route{
+			Method:          "PUT",
+			Pattern:         neutronNetworksPath + "/{networkId}",
+			Handler:         ipam.putNeutronNetwork,
+			MakeMessage:     func() interface{} { return &NeutronNetwork{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         neutronNetworksPath + "/{networkId}",
+			Handler:         ipam.deleteNeutronNetwork,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         neutronSubnetsPath + "/{subnetId}",
+			Handler:         ipam.putNeutronSubnet,
+			MakeMessage:     func() interface{} { return &NeutronSubnet{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         neutronSubnetsPath + "/{subnetId}",
+			Handler:         ipam.deleteNeutronSubnet,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         neutronPortsPath,
+			Handler:         ipam.addNeutronPort,
+			MakeMessage:     func() interface{} { return &NeutronPort{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         neutronPortsPath + "/{portId}",
+			Handler:         ipam.getNeutronPort,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         neutronPortsPath + "/{portId}/binding",
+			Handler:         ipam.bindNeutronPort,
+			MakeMessage:     func() interface{} { return &NeutronPort{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         neutronPortsPath + "/{portId}",
+			Handler:         ipam.deleteNeutronPort,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+	}
+}
+
+// isNotFound returns true if err is a 404 from a service or the store.
+func isNotFound(err error) bool {
+	httpErr, ok := err.(common.HttpError)
+	return ok && httpErr.StatusCode == http.StatusNotFound
+}
+
+// tenantClient returns a REST client bound to the request context
+// and the URL of the tenant service.
+func (ipam *IPAM) tenantClient(ctx common.RestContext) (*common.RestClient, string, error) {
+	client, err := common.NewRestClient(common.GetRestClientConfig(ipam.config))
+	if err != nil {
+		return nil, "", err
+	}
+	client = client.WithContext(ctx.Context)
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		log.Printf("IPAM encountered an error getting tenant service URL: %v", err)
+		return nil, "", err
+	}
+	return client, tenantURL, nil
+}
+
+// putNeutronNetwork maps a Neutron network to a segment of the tenant
+// of its project, creating the segment or renaming it as needed.
+// The tenant must already exist, e.g. through the Keystone sync.
+func (ipam *IPAM) putNeutronNetwork(input interface{}, ctx common.RestContext) (interface{}, error) {
+	network := input.(*NeutronNetwork)
+	network.ID = ctx.PathVariables["networkId"]
+	if network.ProjectID == "" {
+		return nil, common.NewError400("Missing or empty project_id")
+	}
+	name := network.Name
+	if name == "" {
+		name = network.ID
+	}
+	client, tenantURL, err := ipam.tenantClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t := tenant.Tenant{}
+	err = client.Get(fmt.Sprintf("%s/external/tenants/%s", tenantURL, network.ProjectID), &t)
+	if err != nil {
+		log.Printf("IPAM encountered an error finding tenant of project %s: %v", network.ProjectID, err)
+		return nil, err
+	}
+	segmentsURL := fmt.Sprintf("%s/tenants/%d/segments", tenantURL, t.ID)
+	seg := tenant.Segment{}
+	err = client.Get(fmt.Sprintf("%s/external/segments/%s", tenantURL, network.ID), &seg)
+	switch {
+	case isNotFound(err):
+		seg = tenant.Segment{Name: name, ExternalID: network.ID}
+		err = client.Post(segmentsURL, seg, &seg)
+		if err != nil {
+			log.Printf("IPAM encountered an error adding segment for network %s: %v", network.ID, err)
+			return nil, err
+		}
+		log.Printf("IPAM mapped network %s to new segment %d of tenant %s", network.ID, seg.ID, t.Name)
+	case err != nil:
+		return nil, err
+	case seg.TenantID != t.ID:
+		return nil, common.NewErrorConflict(fmt.Sprintf("Network %s is mapped to segment %d of tenant %d, not of tenant %s", network.ID, seg.ID, seg.TenantID, t.Name))
+	case seg.Name != name:
+		seg.Name = name
+		err = client.Put(fmt.Sprintf("%s/%d", segmentsURL, seg.ID), seg, &seg)
+		if err != nil {
+			log.Printf("IPAM encountered an error renaming segment %d: %v", seg.ID, err)
+			return nil, err
+		}
+	}
+	network.TenantID = fmt.Sprintf("%d", t.ID)
+	network.SegmentID = fmt.Sprintf("%d", seg.ID)
+	return network, nil
+}
+
+// deleteNeutronNetwork deletes the segment a Neutron network is
+// mapped to, along with the mappings of its subnets.
+func (ipam *IPAM) deleteNeutronNetwork(input interface{}, ctx common.RestContext) (interface{}, error) {
+	networkID := ctx.PathVariables["networkId"]
+	client, tenantURL, err := ipam.tenantClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seg := tenant.Segment{}
+	err = client.Get(fmt.Sprintf("%s/external/segments/%s", tenantURL, networkID), &seg)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Delete(fmt.Sprintf("%s/tenants/%d/segments/%d", tenantURL, seg.TenantID, seg.ID), nil, nil)
+	if err != nil {
+		log.Printf("IPAM encountered an error deleting segment %d of network %s: %v", seg.ID, networkID, err)
+		return nil, err
+	}
+	err = ipam.subnets.DeleteNeutronSubnets(ctx.Context, "", networkID)
+	if err != nil {
+		return nil, err
+	}
+	return NeutronNetwork{ID: networkID, Name: seg.Name, TenantID: fmt.Sprintf("%d", seg.TenantID), SegmentID: fmt.Sprintf("%d", seg.ID)}, nil
+}
+
+// putNeutronSubnet maps a Neutron subnet to the segment of its network,
+// which must have been mapped first.
+func (ipam *IPAM) putNeutronSubnet(input interface{}, ctx common.RestContext) (interface{}, error) {
+	subnet := input.(*NeutronSubnet)
+	subnet.SubnetID = ctx.PathVariables["subnetId"]
+	if subnet.NetworkID == "" {
+		return nil, common.NewError400("Missing or empty network_id")
+	}
+	if subnet.CIDR != "" {
+		subnetNet, err := netutil.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+		// Addresses of the subnet are allocated from the datacenter.
+		if dcNet, err := netutil.ParseCIDR(ipam.dc.Cidr); err == nil && !netutil.Contains(dcNet, subnetNet) {
+			return nil, common.NewError400(fmt.Sprintf("CIDR %s is not within datacenter %s", subnet.CIDR, ipam.dc.Cidr))
+		}
+	}
+	client, tenantURL, err := ipam.tenantClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seg := tenant.Segment{}
+	err = client.Get(fmt.Sprintf("%s/external/segments/%s", tenantURL, subnet.NetworkID), &seg)
+	if err != nil {
+		log.Printf("IPAM encountered an error finding segment of network %s: %v", subnet.NetworkID, err)
+		return nil, err
+	}
+	subnet.TenantID = fmt.Sprintf("%d", seg.TenantID)
+	subnet.SegmentID = fmt.Sprintf("%d", seg.ID)
+	err = ipam.subnets.PutNeutronSubnet(ctx.Context, subnet)
+	if err != nil {
+		return nil, err
+	}
+	return subnet, nil
+}
+
+// deleteNeutronSubnet removes the mapping of a Neutron subnet.
+func (ipam *IPAM) deleteNeutronSubnet(input interface{}, ctx common.RestContext) (interface{}, error) {
+	subnet, err := ipam.subnets.GetNeutronSubnet(ctx.Context, ctx.PathVariables["subnetId"])
+	if err != nil {
+		return nil, err
+	}
+	err = ipam.subnets.DeleteNeutronSubnets(ctx.Context, subnet.SubnetID, "")
+	if err != nil {
+		return nil, err
+	}
+	return subnet, nil
+}
+
+// portEndpoint builds the endpoint to allocate for a Neutron port,
+// finding its segment through the subnet or the network.
+func (ipam *IPAM) portEndpoint(port *NeutronPort, ctx common.RestContext) (*Endpoint, error) {
+	if port.ID == "" {
+		return nil, common.NewError400("Missing or empty port id")
+	}
+	endpoint := &Endpoint{
+		Name:         port.Name,
+		RequestToken: sql.NullString{String: port.ID, Valid: true},
+	}
+	client, tenantURL, err := ipam.tenantClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case port.SubnetID != "":
+		subnet, err := ipam.subnets.GetNeutronSubnet(ctx.Context, port.SubnetID)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.TenantID = subnet.TenantID
+		endpoint.SegmentID = subnet.SegmentID
+	case port.NetworkID != "":
+		seg := tenant.Segment{}
+		err = client.Get(fmt.Sprintf("%s/external/segments/%s", tenantURL, port.NetworkID), &seg)
+		if err != nil {
+			log.Printf("IPAM encountered an error finding segment of network %s: %v", port.NetworkID, err)
+			return nil, err
+		}
+		endpoint.TenantID = fmt.Sprintf("%d", seg.TenantID)
+		endpoint.SegmentID = fmt.Sprintf("%d", seg.ID)
+	default:
+		return nil, common.NewError400("Either subnet_id or network_id must be specified.")
+	}
+	endpoint.HostId, err = findHostID(client, port.HostID)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// findHostID returns the ID of the host with the name, which is what
+// Neutron knows hosts by.
+func findHostID(client *common.RestClient, name string) (string, error) {
+	if name == "" {
+		return "", common.NewError400("Missing or empty host_id")
+	}
+	host := &common.Host{Name: name}
+	err := client.Find(host, common.FindExactlyOne)
+	if err != nil {
+		log.Printf("IPAM encountered an error finding host for name %s %v", name, err)
+		return "", err
+	}
+	return fmt.Sprintf("%d", host.ID), nil
+}
+
+// addNeutronPort allocates an address for a Neutron port. If the port
+// already has one on the same host, that is returned instead.
+func (ipam *IPAM) addNeutronPort(input interface{}, ctx common.RestContext) (interface{}, error) {
+	port := input.(*NeutronPort)
+	endpoint, err := ipam.portEndpoint(port, ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ipam.endpoints.FindEndpointByRequestToken(ctx.Context, port.ID)
+	if err == nil {
+		if existing.HostId != endpoint.HostId {
+			return nil, common.NewErrorConflict(fmt.Sprintf("Port %s already has address %s on host %s", port.ID, existing.Ip, existing.HostId))
+		}
+		return existing, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+	return ipam.addEndpoint(endpoint, ctx)
+}
+
+// getNeutronPort returns the endpoint allocated for a Neutron port.
+func (ipam *IPAM) getNeutronPort(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return ipam.endpoints.FindEndpointByRequestToken(ctx.Context, ctx.PathVariables["portId"])
+}
+
+// bindNeutronPort handles the port-binding callback of the mechanism
+// driver. Neutron may create a port before it is bound to a host, and
+// may bind it to another host later (e.g. on migration); as addresses
+// are allocated from the host's range, the address is allocated on
+// binding or moved to the new host.
+func (ipam *IPAM) bindNeutronPort(input interface{}, ctx common.RestContext) (interface{}, error) {
+	port := input.(*NeutronPort)
+	port.ID = ctx.PathVariables["portId"]
+	existing, err := ipam.endpoints.FindEndpointByRequestToken(ctx.Context, port.ID)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	found := err == nil
+	if found && port.SubnetID == "" && port.NetworkID == "" {
+		// Keep the port in the segment it has an address in.
+		endpoint := &Endpoint{
+			Name:         existing.Name,
+			TenantID:     existing.TenantID,
+			SegmentID:    existing.SegmentID,
+			RequestToken: existing.RequestToken,
+		}
+		client, _, err := ipam.tenantClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.HostId, err = findHostID(client, port.HostID)
+		if err != nil {
+			return nil, err
+		}
+		return ipam.moveEndpoint(existing, endpoint, ctx)
+	}
+	endpoint, err := ipam.portEndpoint(port, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return ipam.addEndpoint(endpoint, ctx)
+	}
+	return ipam.moveEndpoint(existing, endpoint, ctx)
+}
+
+// moveEndpoint allocates endpoint in place of existing, unless
+// both are on the same host and segment.
+func (ipam *IPAM) moveEndpoint(existing Endpoint, endpoint *Endpoint, ctx common.RestContext) (interface{}, error) {
+	if existing.HostId == endpoint.HostId && existing.SegmentID == endpoint.SegmentID {
+		return existing, nil
+	}
+	// The request token is unique, so the old address has to be
+	// released before the new one is allocated.
+	log.Printf("IPAM moving endpoint %s from host %s to host %s", existing.Ip, existing.HostId, endpoint.HostId)
+	_, err := ipam.releaseEndpoint(ctx.Context, existing.Ip)
+	if err != nil {
+		return nil, err
+	}
+	return ipam.addEndpoint(endpoint, ctx)
+}
+
+// deleteNeutronPort releases the address of a Neutron port.
+func (ipam *IPAM) deleteNeutronPort(input interface{}, ctx common.RestContext) (interface{}, error) {
+	endpoint, err := ipam.endpoints.FindEndpointByRequestToken(ctx.Context, ctx.PathVariables["portId"])
+	if err != nil {
+		return nil, err
+	}
+	return ipam.releaseEndpoint(ctx.Context, endpoint.Ip)
+}
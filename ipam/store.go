@@ -16,12 +16,11 @@
 package ipam
 
 import (
+	"context"
 	"database/sql"
-	"errors"
-	"fmt"
 	"github.com/romana/core/common"
 	"log"
-	"strings"
+	"time"
 )
 
 // Endpoint represents an endpoint (a VM, a Kubernetes Pod, etc.)
@@ -32,7 +31,7 @@ type Endpoint struct {
 	SegmentID    string         `json:"segment_id,omitempty"`
 	HostId       string         `json:"host_id,omitempty"`
 	Name         string         `json:"name,omitempty"`
-	RequestToken sql.NullString `json:"request_token" sql:"unique"`
+	RequestToken sql.NullString `json:"request_token" sql:"unique" romana:"encrypted"`
 	// Ordinal number of this Endpoint in the host/tenant combination
 	NetworkID uint64 `json:"-"`
 	// Calculated effective network ID of this Endpoint --
@@ -42,103 +41,137 @@ type Endpoint struct {
 	// Whether it is in use (for purposes of reclaiming)
 	InUse bool   `json:"-"`
 	Id    uint64 `sql:"AUTO_INCREMENT",json:"-"`
+	// CreatedAt is when the endpoint was allocated its address,
+	// UpdatedAt when it was last allocated or released.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
+
+// Store keeps endpoints IPAM allocates and mappings of Neutron
+// subnets. allocatorStore keeps them in the database configured
+// (see allocator.go); package ipamtest provides one keeping them
+// in memory.
+type Store interface {
+	Backend
+	EndpointRepository
+	SubnetRepository
+}
+
+// Backend is what IPAM needs of a store besides its endpoints and
+// subnets: configuring and connecting it and creating its schema.
+// The database and schema stay behind it.
+type Backend interface {
+	SetConfig(config map[string]interface{}) error
+	Connect() error
+	CreateSchema(force bool) error
+	Ping() error
+}
+
+// SubnetRepository keeps mappings of Neutron subnets to the segments
+// of their networks, for the Neutron handlers (see neutron.go).
+type SubnetRepository interface {
+	PutNeutronSubnet(ctx context.Context, subnet *NeutronSubnet) error
+	GetNeutronSubnet(ctx context.Context, subnetID string) (NeutronSubnet, error)
+	DeleteNeutronSubnets(ctx context.Context, subnetID string, networkID string) error
+}
+
+// EndpointRepository allocates and keeps endpoints. It is the part
+// of Store that IPAM handlers use, and does not depend on how (or
+// whether) endpoints are kept in a database.
+type EndpointRepository interface {
+	// AddEndpoint allocates an address to the endpoint, provided its
+	// host has fewer than slots endpoints of its tenant segment, and
+	// returns 409 with NoAddresses as details otherwise.
+	AddEndpoint(ctx context.Context, endpoint *Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error
+	// AddEndpoints is like AddEndpoint for endpoints of the same host,
+	// tenant and segment, allocating addresses to all of them or none.
+	AddEndpoints(ctx context.Context, endpoints []*Endpoint, upToEndpointIpInt uint64, stride uint, slots uint64) error
+	DeleteEndpoint(ctx context.Context, ip string) (Endpoint, error)
+	ListHostEndpoints(ctx context.Context, hostId string) ([]Endpoint, error)
+	ListTenantEndpoints(ctx context.Context, tenantId string) ([]Endpoint, error)
+	FindEndpointByRequestToken(ctx context.Context, token string) (Endpoint, error)
+	CountEndpoints(ctx context.Context, hostId string) ([]SegmentUsage, error)
+}
+
+// ipamStore keeps endpoints and mappings of Neutron subnets in a
+// database; allocatorStore allocates endpoints on top of it.
 type ipamStore struct {
 	common.DbStore
 }
 
-// deleteEndpoint releases the IP(s) owned by the endpoint into assignable
-// pool.
-func (ipamStore *ipamStore) deleteEndpoint(ip string) (Endpoint, error) {
+// SegmentUsage is the number of endpoints in use
+// in a tenant segment on a host.
+type SegmentUsage struct {
+	HostId    string
+	TenantID  string
+	SegmentID string
+	Used      uint64
+}
+
+// PutNeutronSubnet records the mapping of a Neutron subnet,
+// replacing an earlier one for the same subnet.
+func (ipamStore *ipamStore) PutNeutronSubnet(ctx context.Context, subnet *NeutronSubnet) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 	tx := ipamStore.DbStore.Db.Begin()
-	results := make([]Endpoint, 0)
-	tx.Where(&Endpoint{Ip: ip}).Find(&results)
-	if len(results) == 0 {
+	tx = tx.Where("subnet_id = ?", subnet.SubnetID).Delete(NeutronSubnet{})
+	err := common.GetDbErrors(tx)
+	if err != nil {
 		tx.Rollback()
-		return Endpoint{}, common.NewError404("endpoint", ip)
+		return err
 	}
-	if len(results) > 1 {
-		// This cannot happen by constraints...
+	subnet.Id = 0
+	tx = tx.Create(subnet)
+	err = common.GetDbErrors(tx)
+	if err != nil {
 		tx.Rollback()
-		errMsg := fmt.Sprintf("Expected one result for ip %s, got %v", ip, results)
-		log.Printf(errMsg)
-		return Endpoint{}, common.NewError500(errors.New(errMsg))
+		return err
 	}
-	tx = tx.Model(Endpoint{}).Where("ip = ?", ip).Update("in_use", false)
-	err := common.MakeMultiError(tx.GetErrors())
-	if err != nil {
+	if err = common.CheckContext(ctx); err != nil {
 		tx.Rollback()
-		return Endpoint{}, err
+		return err
 	}
 	tx.Commit()
-	return results[0], nil
+	return nil
 }
 
-// addEndpoint allocates an IP address and stores it in the
-// database.
-func (ipamStore *ipamStore) addEndpoint(endpoint *Endpoint, upToEndpointIpInt uint64, stride uint) error {
-	var err error
-	tx := ipamStore.DbStore.Db.Begin()
-
-	hostId := endpoint.HostId
-	endpoint.InUse = true
-	tenantId := endpoint.TenantID
-	segId := endpoint.SegmentID
-	filter := "host_id = ? AND tenant_id = ? AND segment_id = ? "
-	// First, see if there is a formerly allocated IP already that has been released
-	// (marked "in_use")
-	where := filter + "AND in_use = 0"
-	sel := "min(network_id), ip"
-	log.Printf("IpamStore: Calling SELECT %s FROM endpoints WHERE %s;", sel, fmt.Sprintf(strings.Replace(where, "?", "%s", 3), hostId, tenantId, segId))
-	row := tx.Model(Endpoint{}).Where(where, hostId, tenantId, segId).Select(sel).Row()
-	netID := sql.NullInt64{}
-	var ip string
-	row.Scan(&netID, &ip)
-	if netID.Valid {
-		endpoint.Ip = ip
-		tx = tx.Model(Endpoint{}).Where("ip = ?", ip).Update("in_use", true)
-		err = common.MakeMultiError(tx.GetErrors())
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-		tx.Commit()
-		return nil
+// GetNeutronSubnet returns the mapping of a Neutron subnet.
+func (ipamStore *ipamStore) GetNeutronSubnet(ctx context.Context, subnetID string) (NeutronSubnet, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return NeutronSubnet{}, err
 	}
-	// Otherwise, find the MAX network ID available for this host/segment combination.
-	// TODO can this be done in a single query?
-	where = filter + "AND in_use = 1"
-	sel = "ifnull(max(network_id),-1)+1"
-	log.Printf("IpamStore: Calling SELECT %s FROM endpoints WHERE %s;", sel, fmt.Sprintf(strings.Replace(where, "?", "%s", 3), hostId, tenantId, segId))
-	row = tx.Model(Endpoint{}).Where(where, hostId, tenantId, segId).Select(sel).Row()
-	netID = sql.NullInt64{}
-	row.Scan(&netID)
-	log.Printf("IpamStore: max net ID: %v", netID)
-
-	endpoint.NetworkID = uint64(netID.Int64)
-
-	log.Printf("IpamStore: New network ID is %d\n", endpoint.NetworkID)
-
-	endpoint.EffectiveNetworkID = getEffectiveNetworkID(endpoint.NetworkID, stride)
-	log.Printf("IpamStore: Effective network ID for network ID %d (stride %d): %d\n", endpoint.NetworkID, stride, endpoint.EffectiveNetworkID)
-	ipInt := upToEndpointIpInt | endpoint.EffectiveNetworkID
-	log.Printf("IpamStore: %d | %d = %d", upToEndpointIpInt, endpoint.EffectiveNetworkID, ipInt)
-	endpoint.Ip = common.IntToIPv4(ipInt).String()
-	tx = tx.Create(endpoint)
-	log.Printf("IpamStore: Creating %v", endpoint)
-	err = common.MakeMultiError(tx.GetErrors())
+	subnets := make([]NeutronSubnet, 0)
+	db := ipamStore.DbStore.Db.Where("subnet_id = ?", subnetID).Find(&subnets)
+	err := common.GetDbErrors(db)
 	if err != nil {
-		log.Printf("Errors: %v", err)
-		tx.Rollback()
+		return NeutronSubnet{}, err
+	}
+	if len(subnets) == 0 {
+		return NeutronSubnet{}, common.NewError404("subnet", subnetID)
+	}
+	return subnets[0], nil
+}
+
+// DeleteNeutronSubnets removes the mapping of a Neutron subnet or,
+// if subnetID is empty, of all subnets of the Neutron network.
+func (ipamStore *ipamStore) DeleteNeutronSubnets(ctx context.Context, subnetID string, networkID string) error {
+	if err := common.CheckContext(ctx); err != nil {
 		return err
 	}
-	tx.Commit()
-	return nil
+	db := ipamStore.DbStore.Db
+	if subnetID != "" {
+		db = db.Where("subnet_id = ?", subnetID)
+	} else {
+		db = db.Where("network_id = ?", networkID)
+	}
+	db = db.Delete(NeutronSubnet{})
+	return common.GetDbErrors(db)
 }
 
-// getEffectiveNetworkID gets effective number of an Endpoint
+// GetEffectiveNetworkID gets effective number of an Endpoint
 // on a given host (see endpoint.EffectiveNetworkID).
-func getEffectiveNetworkID(EndpointNetworkID uint64, stride uint) uint64 {
+func GetEffectiveNetworkID(EndpointNetworkID uint64, stride uint) uint64 {
 	var effectiveEndpointNetworkID uint64
 	// We start with 3 because we reserve 1 for gateway
 	// and 2 for DHCP.
@@ -148,8 +181,9 @@ func getEffectiveNetworkID(EndpointNetworkID uint64, stride uint) uint64 {
 
 // Entities implements Entities method of Service interface.
 func (ipamStore *ipamStore) Entities() []interface{} {
-	retval := make([]interface{}, 1)
+	retval := make([]interface{}, 2)
 	retval[0] = &Endpoint{}
+	retval[1] = &NeutronSubnet{}
 	return retval
 }
 
@@ -159,6 +193,11 @@ func (ipamStore *ipamStore) CreateSchemaPostProcess() error {
 	db := ipamStore.Db
 	log.Printf("ipamStore.CreateSchemaPostProcess(), DB is %v", db)
 	db.Model(&Endpoint{}).AddUniqueIndex("idx_tenant_segment_host_network_id", "tenant_id", "segment_id", "host_id", "network_id")
+	// Endpoints are looked up by address when released, and listed
+	// by host or tenant.
+	db.Model(&Endpoint{}).AddIndex("idx_endpoint_ip", "ip")
+	db.Model(&Endpoint{}).AddIndex("idx_endpoint_host_in_use", "host_id", "in_use")
+	db.Model(&Endpoint{}).AddIndex("idx_endpoint_tenant_in_use", "tenant_id", "in_use")
 	err := common.MakeMultiError(db.GetErrors())
 	if err != nil {
 		return err
@@ -0,0 +1,251 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCommunity(t *testing.T) {
+	for s, expect := range map[string]uint32{
+		"65000:100": 65000<<16 | 100,
+		"0:0":       0,
+		"no-export": CommunityNoExport,
+	} {
+		community, err := ParseCommunity(s)
+		if err != nil || community != expect {
+			t.Errorf("Expected %x for %s, got %x, %v", expect, s, community, err)
+		}
+	}
+	for _, invalid := range []string{"65000", "65536:1", "a:b", "1:2:3"} {
+		if _, err := ParseCommunity(invalid); err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	open := openMessage{asn: 4200000001, holdTime: 90, routerID: net.ParseIP("192.168.0.11"), fourOctetASN: true}
+	decoded, err := decodeOpen(open.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.asn != open.asn || decoded.holdTime != 90 || !decoded.routerID.Equal(open.routerID) || !decoded.fourOctetASN {
+		t.Errorf("Expected %+v, got %+v", open, decoded)
+	}
+	// Without the capability, the 2-octet AS is used.
+	body := open.encode()
+	body[9] = 0
+	decoded, err = decodeOpen(body[0:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.asn != asTrans || decoded.fourOctetASN {
+		t.Errorf("Expected AS_TRANS without 4-octet AS capability, got %+v", decoded)
+	}
+}
+
+func TestPathAttributes(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.65.0.0/16")
+	route := Route{Prefix: prefix, NextHop: net.ParseIP("192.168.0.11"), Communities: []uint32{65000<<16 | 100}}
+	u, err := decodeUpdate(encodeUpdate(nil, pathAttributes(65001, 65000, false, route), []*net.IPNet{prefix}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.nlri) != 1 || u.nlri[0].String() != "10.65.0.0/16" {
+		t.Errorf("Expected NLRI 10.65.0.0/16, got %v", u.nlri)
+	}
+	expect := map[byte][]byte{
+		attrOrigin:      {originIGP},
+		attrASPath:      {asSequence, 1, 0xfd, 0xe9},
+		attrNextHop:     {192, 168, 0, 11},
+		attrCommunities: {0xfd, 0xe8, 0, 100},
+	}
+	if !reflect.DeepEqual(u.attrs, expect) {
+		t.Errorf("Expected attributes %v, got %v", expect, u.attrs)
+	}
+
+	// Internal peers get an empty AS path and local preference.
+	u, _ = decodeUpdate(encodeUpdate(nil, pathAttributes(65000, 65000, true, route), []*net.IPNet{prefix}))
+	if len(u.attrs[attrASPath]) != 0 || binary.BigEndian.Uint32(u.attrs[attrLocalPref]) != defaultLocalPref {
+		t.Errorf("Expected iBGP attributes, got %v", u.attrs)
+	}
+
+	// 4-octet AS towards a peer that does not support it.
+	u, _ = decodeUpdate(encodeUpdate(nil, pathAttributes(4200000001, 65000, false, route), []*net.IPNet{prefix}))
+	if !reflect.DeepEqual(u.attrs[attrASPath], asPath(asTrans, false)) || !reflect.DeepEqual(u.attrs[attrAS4Path], asPath(4200000001, true)) {
+		t.Errorf("Expected AS_TRANS and AS4_PATH, got %v", u.attrs)
+	}
+}
+
+// fakePeer plays the peer's side of a session over conn.
+type fakePeer struct {
+	conn    net.Conn
+	updates chan updateMessage
+	errors  chan error
+}
+
+func (p *fakePeer) run(asn uint32) {
+	msgType, body, err := readMessage(p.conn)
+	if err == nil && msgType != msgOpen {
+		err = fmt.Errorf("Expected OPEN, got %d", msgType)
+	}
+	if err == nil {
+		_, err = decodeOpen(body)
+	}
+	if err == nil {
+		// Unlike TCP, the pipe does not buffer writes.
+		go func() {
+			open := openMessage{asn: asn, holdTime: 30, routerID: net.ParseIP("192.168.0.1"), fourOctetASN: true}
+			writeMessage(p.conn, msgOpen, open.encode())
+			writeMessage(p.conn, msgKeepalive, nil)
+		}()
+	}
+	for err == nil {
+		msgType, body, err = readMessage(p.conn)
+		if err == nil && msgType == msgUpdate {
+			var u updateMessage
+			u, err = decodeUpdate(body)
+			p.updates <- u
+		}
+	}
+	p.errors <- err
+}
+
+func (p *fakePeer) nextUpdate(t *testing.T) updateMessage {
+	select {
+	case u := <-p.updates:
+		return u
+	case err := <-p.errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for UPDATE")
+	}
+	return updateMessage{}
+}
+
+func TestSpeaker(t *testing.T) {
+	if _, err := NewSpeaker(65001, net.ParseIP("192.168.0.11"), time.Second); err == nil {
+		t.Error("Expected error for hold time of 1s")
+	}
+	s, err := NewSpeaker(65001, net.ParseIP("192.168.0.11"), DefaultHoldTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &fakePeer{updates: make(chan updateMessage, 10), errors: make(chan error, 1)}
+	var dialed string
+	s.dial = func(address string) (net.Conn, error) {
+		dialed = address
+		local, remote := net.Pipe()
+		peer.conn = remote
+		go peer.run(65000)
+		return local, nil
+	}
+	_, prefix, _ := net.ParseCIDR("10.65.0.0/16")
+	s.Announce(Route{Prefix: prefix, NextHop: net.ParseIP("192.168.0.11")})
+	if err := s.AddPeer(Peer{Address: "192.168.0.1", ASN: 65000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Routes are announced once the session is established...
+	u := peer.nextUpdate(t)
+	if dialed != "192.168.0.1:179" {
+		t.Errorf("Expected to connect to 192.168.0.1:179, got %s", dialed)
+	}
+	if len(u.nlri) != 1 || u.nlri[0].String() != "10.65.0.0/16" {
+		t.Errorf("Expected announcement of 10.65.0.0/16, got %+v", u)
+	}
+	if established := s.Established(); !reflect.DeepEqual(established, []string{"192.168.0.1"}) {
+		t.Errorf("Expected session with 192.168.0.1, got %v", established)
+	}
+
+	// ...and withdrawn as they are removed.
+	s.Withdraw(prefix)
+	u = peer.nextUpdate(t)
+	if len(u.withdrawn) != 1 || u.withdrawn[0].String() != "10.65.0.0/16" || len(u.nlri) != 0 {
+		t.Errorf("Expected withdrawal of 10.65.0.0/16, got %+v", u)
+	}
+	if len(s.Routes()) != 0 {
+		t.Errorf("Expected no routes, got %v", s.Routes())
+	}
+	s.Stop()
+}
+
+// decodePrefixes decodes prefixes encoded with encodePrefix.
+func decodePrefixes(data []byte) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for len(data) > 0 {
+		ones := int(data[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(data) < 1+n {
+			return nil, fmt.Errorf("Invalid prefix in BGP UPDATE")
+		}
+		ip := make(net.IP, 4)
+		copy(ip, data[1:1+n])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)})
+		data = data[1+n:]
+	}
+	return prefixes, nil
+}
+
+// updateMessage is a decoded UPDATE message.
+type updateMessage struct {
+	withdrawn []*net.IPNet
+	// Path attributes by type.
+	attrs map[byte][]byte
+	nlri  []*net.IPNet
+}
+
+func decodeUpdate(body []byte) (updateMessage, error) {
+	u := updateMessage{attrs: make(map[byte][]byte)}
+	if len(body) < 4 {
+		return u, fmt.Errorf("BGP UPDATE message too short")
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 4+withdrawnLen {
+		return u, fmt.Errorf("Invalid BGP UPDATE message")
+	}
+	var err error
+	u.withdrawn, err = decodePrefixes(body[2 : 2+withdrawnLen])
+	if err != nil {
+		return u, err
+	}
+	body = body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 2+attrsLen {
+		return u, fmt.Errorf("Invalid BGP UPDATE message")
+	}
+	attrs := body[2 : 2+attrsLen]
+	for len(attrs) >= 3 {
+		flags, attrType := attrs[0], attrs[1]
+		valueStart, valueLen := 3, int(attrs[2])
+		if flags&0x10 != 0 && len(attrs) >= 4 {
+			valueStart, valueLen = 4, int(binary.BigEndian.Uint16(attrs[2:4]))
+		}
+		if len(attrs) < valueStart+valueLen {
+			return u, fmt.Errorf("Invalid BGP path attribute")
+		}
+		u.attrs[attrType] = attrs[valueStart : valueStart+valueLen]
+		attrs = attrs[valueStart+valueLen:]
+	}
+	u.nlri, err = decodePrefixes(body[2+attrsLen:])
+	return u, err
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Port is the TCP port BGP speakers listen on.
+	Port = 179
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	bgpVersion = 4
+
+	// Optional parameter with capabilities (RFC 5492), and
+	// the capability of 4-octet AS numbers (RFC 6793).
+	paramCapabilities = 2
+	capFourOctetASN   = 65
+	// AS number used in place of 4-octet ones towards
+	// peers that do not support them.
+	asTrans = 23456
+
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrLocalPref   = 5
+	attrCommunities = 8
+	attrAS4Path     = 17
+
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+
+	originIGP  = 0
+	asSequence = 2
+
+	defaultLocalPref = 100
+
+	// Error codes and subcodes of NOTIFICATION messages.
+	errOpen           = 2
+	errOpenBadPeerAS  = 2
+	errHoldTimer      = 4
+	errCease          = 6
+	errCeaseAdminDown = 2
+)
+
+// Well-known communities (RFC 1997).
+const (
+	CommunityNoExport    = 0xFFFFFF01
+	CommunityNoAdvertise = 0xFFFFFF02
+)
+
+// ParseCommunity parses a community given as ASN:value
+// or as the name of a well-known community.
+func ParseCommunity(s string) (uint32, error) {
+	switch s {
+	case "no-export":
+		return CommunityNoExport, nil
+	case "no-advertise":
+		return CommunityNoAdvertise, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid community %s, expected ASN:value", s)
+	}
+	high, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid community %s: %s", s, err)
+	}
+	low, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid community %s: %s", s, err)
+	}
+	return uint32(high<<16 | low), nil
+}
+
+// writeMessage writes a message of the given type and body.
+func writeMessage(w io.Writer, msgType byte, body []byte) error {
+	length := headerLen + len(body)
+	if length > maxMessageLen {
+		return fmt.Errorf("BGP message of %d bytes is too long", length)
+	}
+	msg := make([]byte, length)
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:18], uint16(length))
+	msg[18] = msgType
+	copy(msg[headerLen:], body)
+	_, err := w.Write(msg)
+	return err
+}
+
+// readMessage reads a message and returns its type and body.
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for i := 0; i < 16; i++ {
+		if header[i] != 0xff {
+			return 0, nil, fmt.Errorf("Invalid BGP message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, fmt.Errorf("Invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// openMessage is the OPEN message.
+type openMessage struct {
+	asn      uint32
+	holdTime uint16
+	routerID net.IP
+	// Whether 4-octet AS numbers are supported.
+	fourOctetASN bool
+}
+
+func (o openMessage) encode() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(bgpVersion)
+	myAS := uint16(asTrans)
+	if o.asn <= 0xffff {
+		myAS = uint16(o.asn)
+	}
+	binary.Write(buf, binary.BigEndian, myAS)
+	binary.Write(buf, binary.BigEndian, o.holdTime)
+	buf.Write(o.routerID.To4())
+	// One capabilities parameter with the 4-octet AS capability.
+	buf.Write([]byte{8, paramCapabilities, 6, capFourOctetASN, 4})
+	binary.Write(buf, binary.BigEndian, o.asn)
+	return buf.Bytes()
+}
+
+func decodeOpen(body []byte) (openMessage, error) {
+	o := openMessage{}
+	if len(body) < 10 {
+		return o, fmt.Errorf("BGP OPEN message too short")
+	}
+	if body[0] != bgpVersion {
+		return o, fmt.Errorf("Unsupported BGP version %d", body[0])
+	}
+	o.asn = uint32(binary.BigEndian.Uint16(body[1:3]))
+	o.holdTime = binary.BigEndian.Uint16(body[3:5])
+	o.routerID = net.IP(body[5:9])
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return o, fmt.Errorf("Invalid length of BGP OPEN parameters")
+	}
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return o, fmt.Errorf("Invalid BGP OPEN parameter")
+		}
+		if paramType == paramCapabilities {
+			caps := params[2 : 2+paramLen]
+			for len(caps) >= 2 {
+				capCode, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return o, fmt.Errorf("Invalid BGP capability")
+				}
+				if capCode == capFourOctetASN && capLen == 4 {
+					o.fourOctetASN = true
+					o.asn = binary.BigEndian.Uint32(caps[2:6])
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+		params = params[2+paramLen:]
+	}
+	return o, nil
+}
+
+// encodePrefix encodes a prefix as in NLRI and withdrawn routes.
+func encodePrefix(prefix *net.IPNet) []byte {
+	ones, _ := prefix.Mask.Size()
+	return append([]byte{byte(ones)}, prefix.IP.To4()[0:(ones+7)/8]...)
+}
+
+// appendAttribute appends a path attribute.
+func appendAttribute(buf *bytes.Buffer, flags byte, attrType byte, value []byte) {
+	buf.Write([]byte{flags, attrType, byte(len(value))})
+	buf.Write(value)
+}
+
+// asPath encodes an AS_PATH (or AS4_PATH) with the single AS.
+func asPath(asn uint32, fourOctet bool) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{asSequence, 1})
+	if fourOctet {
+		binary.Write(buf, binary.BigEndian, asn)
+	} else {
+		binary.Write(buf, binary.BigEndian, uint16(asn))
+	}
+	return buf.Bytes()
+}
+
+// pathAttributes encodes attributes of a route announced to a peer.
+// Towards external peers the local AS is prepended to the path;
+// internal peers get the local preference instead.
+func pathAttributes(localASN uint32, peerASN uint32, fourOctet bool, route Route) []byte {
+	buf := &bytes.Buffer{}
+	appendAttribute(buf, flagTransitive, attrOrigin, []byte{originIGP})
+	switch {
+	case localASN == peerASN:
+		appendAttribute(buf, flagTransitive, attrASPath, nil)
+	case fourOctet:
+		appendAttribute(buf, flagTransitive, attrASPath, asPath(localASN, true))
+	case localASN > 0xffff:
+		appendAttribute(buf, flagTransitive, attrASPath, asPath(asTrans, false))
+		appendAttribute(buf, flagOptional|flagTransitive, attrAS4Path, asPath(localASN, true))
+	default:
+		appendAttribute(buf, flagTransitive, attrASPath, asPath(localASN, false))
+	}
+	appendAttribute(buf, flagTransitive, attrNextHop, route.NextHop.To4())
+	if localASN == peerASN {
+		localPref := make([]byte, 4)
+		binary.BigEndian.PutUint32(localPref, defaultLocalPref)
+		appendAttribute(buf, flagTransitive, attrLocalPref, localPref)
+	}
+	if len(route.Communities) > 0 {
+		communities := make([]byte, 4*len(route.Communities))
+		for i, community := range route.Communities {
+			binary.BigEndian.PutUint32(communities[4*i:], community)
+		}
+		appendAttribute(buf, flagOptional|flagTransitive, attrCommunities, communities)
+	}
+	return buf.Bytes()
+}
+
+// encodeUpdate encodes an UPDATE message.
+func encodeUpdate(withdrawn []*net.IPNet, attrs []byte, nlri []*net.IPNet) []byte {
+	var withdrawnBytes, nlriBytes []byte
+	for _, prefix := range withdrawn {
+		withdrawnBytes = append(withdrawnBytes, encodePrefix(prefix)...)
+	}
+	for _, prefix := range nlri {
+		nlriBytes = append(nlriBytes, encodePrefix(prefix)...)
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint16(len(withdrawnBytes)))
+	buf.Write(withdrawnBytes)
+	binary.Write(buf, binary.BigEndian, uint16(len(attrs)))
+	buf.Write(attrs)
+	buf.Write(nlriBytes)
+	return buf.Bytes()
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultHoldTime is the hold time proposed to peers.
+	DefaultHoldTime = 90 * time.Second
+	// How long to wait before connecting to a peer again.
+	retryInterval = 10 * time.Second
+	// How long to wait for the peer to connect and open the session.
+	connectTimeout = 30 * time.Second
+)
+
+// Route is a route announced to peers.
+type Route struct {
+	Prefix  *net.IPNet
+	NextHop net.IP
+	// Communities, see ParseCommunity.
+	Communities []uint32
+}
+
+// Peer is a BGP peer.
+type Peer struct {
+	// Address is the IP address, optionally with a port (179 by default).
+	Address string
+	ASN     uint32
+}
+
+// Speaker announces routes to its peers. It keeps a session
+// with every peer, reconnecting when the session is lost, and
+// announces all routes whenever a session is established.
+type Speaker struct {
+	asn      uint32
+	routerID net.IP
+	holdTime time.Duration
+
+	// dial connects to a peer; a field so that tests can replace it.
+	dial func(address string) (net.Conn, error)
+
+	mu       sync.Mutex
+	routes   map[string]Route
+	sessions []*session
+	done     chan struct{}
+}
+
+// NewSpeaker creates a speaker in the AS with the router ID
+// (an IPv4 address), proposing the hold time to peers.
+func NewSpeaker(asn uint32, routerID net.IP, holdTime time.Duration) (*Speaker, error) {
+	if asn == 0 {
+		return nil, fmt.Errorf("Invalid AS number 0")
+	}
+	if routerID.To4() == nil {
+		return nil, fmt.Errorf("Invalid router ID %v, expected an IPv4 address", routerID)
+	}
+	if holdTime != 0 && (holdTime < 3*time.Second || holdTime > 0xffff*time.Second) {
+		return nil, fmt.Errorf("Invalid hold time %v, expected 0 or 3 to 65535 seconds", holdTime)
+	}
+	return &Speaker{
+		asn:      asn,
+		routerID: routerID.To4(),
+		holdTime: holdTime,
+		dial: func(address string) (net.Conn, error) {
+			return net.DialTimeout("tcp", address, connectTimeout)
+		},
+		routes: make(map[string]Route),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// AddPeer starts a session with the peer.
+func (s *Speaker) AddPeer(peer Peer) error {
+	address := peer.Address
+	if net.ParseIP(address) != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(Port))
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("Invalid BGP peer address %s", peer.Address)
+	}
+	ss := &session{speaker: s, peer: peer, address: address}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, ss)
+	s.mu.Unlock()
+	go ss.run()
+	return nil
+}
+
+// Announce announces the route to peers, replacing
+// the route to the same prefix, if any.
+func (s *Speaker) Announce(route Route) {
+	s.mu.Lock()
+	s.routes[route.Prefix.String()] = route
+	sessions := s.sessions
+	s.mu.Unlock()
+	for _, ss := range sessions {
+		ss.sendRoutes([]Route{route}, nil)
+	}
+}
+
+// Withdraw withdraws the route to the prefix from peers.
+func (s *Speaker) Withdraw(prefix *net.IPNet) {
+	s.mu.Lock()
+	_, ok := s.routes[prefix.String()]
+	delete(s.routes, prefix.String())
+	sessions := s.sessions
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, ss := range sessions {
+		ss.sendRoutes(nil, []*net.IPNet{prefix})
+	}
+}
+
+// Routes returns the routes announced.
+func (s *Speaker) Routes() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retval := make([]Route, 0, len(s.routes))
+	for _, route := range s.routes {
+		retval = append(retval, route)
+	}
+	return retval
+}
+
+// Established returns addresses of peers with established sessions.
+func (s *Speaker) Established() []string {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.mu.Unlock()
+	var retval []string
+	for _, ss := range sessions {
+		ss.mu.Lock()
+		if ss.conn != nil {
+			retval = append(retval, ss.peer.Address)
+		}
+		ss.mu.Unlock()
+	}
+	return retval
+}
+
+// Stop closes all sessions, telling peers the speaker is shutting down.
+func (s *Speaker) Stop() {
+	s.mu.Lock()
+	close(s.done)
+	sessions := s.sessions
+	s.mu.Unlock()
+	for _, ss := range sessions {
+		ss.close(errCease, errCeaseAdminDown)
+	}
+}
+
+// session is a session with a peer.
+type session struct {
+	speaker *Speaker
+	peer    Peer
+	address string
+
+	// mu protects writes to conn, which is
+	// set while the session is established.
+	mu        sync.Mutex
+	conn      net.Conn
+	fourOctet bool
+}
+
+// run keeps the session established until the speaker is stopped.
+func (ss *session) run() {
+	for {
+		err := ss.connect()
+		select {
+		case <-ss.speaker.done:
+			return
+		default:
+		}
+		glog.Warningf("BGP session with %s failed, retrying in %v: %s", ss.peer.Address, retryInterval, err)
+		select {
+		case <-ss.speaker.done:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// connect establishes the session, announces all routes
+// and then keeps the session alive until it fails.
+func (ss *session) connect() error {
+	s := ss.speaker
+	conn, err := s.dial(ss.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	open := openMessage{asn: s.asn, holdTime: uint16(s.holdTime / time.Second), routerID: s.routerID, fourOctetASN: true}
+	if err := writeMessage(conn, msgOpen, open.encode()); err != nil {
+		return err
+	}
+	msgType, body, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msgType != msgOpen {
+		return unexpectedMessage(msgType, body)
+	}
+	peerOpen, err := decodeOpen(body)
+	if err != nil {
+		return err
+	}
+	if peerOpen.asn != ss.peer.ASN {
+		writeMessage(conn, msgNotification, []byte{errOpen, errOpenBadPeerAS})
+		return fmt.Errorf("Peer is in AS %d, expected %d", peerOpen.asn, ss.peer.ASN)
+	}
+	holdTime := s.holdTime
+	if peerHoldTime := time.Duration(peerOpen.holdTime) * time.Second; peerHoldTime < holdTime {
+		holdTime = peerHoldTime
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		return err
+	}
+	msgType, body, err = readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msgType != msgKeepalive {
+		return unexpectedMessage(msgType, body)
+	}
+	conn.SetDeadline(time.Time{})
+	glog.Infof("BGP session with %s (AS %d) established, hold time %v", ss.peer.Address, peerOpen.asn, holdTime)
+
+	ss.mu.Lock()
+	ss.conn = conn
+	ss.fourOctet = peerOpen.fourOctetASN
+	ss.mu.Unlock()
+	defer func() {
+		ss.mu.Lock()
+		ss.conn = nil
+		ss.mu.Unlock()
+	}()
+	ss.sendRoutes(s.Routes(), nil)
+
+	stopKeepalives := make(chan struct{})
+	defer close(stopKeepalives)
+	if holdTime > 0 {
+		go ss.keepalive(holdTime/3, stopKeepalives)
+	}
+	for {
+		if holdTime > 0 {
+			conn.SetReadDeadline(time.Now().Add(holdTime))
+		}
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				ss.close(errHoldTimer, 0)
+				return fmt.Errorf("Hold timer expired")
+			}
+			return err
+		}
+		switch msgType {
+		case msgKeepalive, msgUpdate:
+			// Routes from peers are not used.
+		default:
+			return unexpectedMessage(msgType, body)
+		}
+	}
+}
+
+// keepalive sends KEEPALIVE messages every interval until stop is closed.
+func (ss *session) keepalive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ss.send(msgKeepalive, nil)
+		}
+	}
+}
+
+// sendRoutes announces and withdraws routes if the session is established.
+func (ss *session) sendRoutes(announced []Route, withdrawn []*net.IPNet) {
+	ss.mu.Lock()
+	fourOctet := ss.fourOctet
+	ss.mu.Unlock()
+	if len(withdrawn) > 0 {
+		ss.send(msgUpdate, encodeUpdate(withdrawn, nil, nil))
+	}
+	for _, route := range announced {
+		attrs := pathAttributes(ss.speaker.asn, ss.peer.ASN, fourOctet, route)
+		ss.send(msgUpdate, encodeUpdate(nil, attrs, []*net.IPNet{route.Prefix}))
+	}
+}
+
+// send writes the message if the session is established. Errors
+// are not returned: the session fails and is established again,
+// announcing all routes.
+func (ss *session) send(msgType byte, body []byte) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.conn == nil {
+		return
+	}
+	if err := writeMessage(ss.conn, msgType, body); err != nil {
+		glog.Warningf("Error sending BGP message to %s: %s", ss.peer.Address, err)
+		ss.conn.Close()
+	}
+}
+
+// close sends a NOTIFICATION with the error and closes the session.
+func (ss *session) close(code byte, subcode byte) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.conn == nil {
+		return
+	}
+	writeMessage(ss.conn, msgNotification, []byte{code, subcode})
+	ss.conn.Close()
+}
+
+// unexpectedMessage returns an error describing a message
+// received when another one was expected.
+func unexpectedMessage(msgType byte, body []byte) error {
+	if msgType == msgNotification && len(body) >= 2 {
+		return fmt.Errorf("Peer sent NOTIFICATION with error %d/%d", body[0], body[1])
+	}
+	return fmt.Errorf("Unexpected BGP message of type %d", msgType)
+}
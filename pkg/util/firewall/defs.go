@@ -18,6 +18,7 @@
 package firewall
 
 import (
+	"context"
 	utilexec "github.com/romana/core/pkg/util/exec"
 	"net"
 )
@@ -56,6 +57,11 @@ type Firewall interface {
 	// Cleanup deletes DB records and uninstall rules associated with given endpoint.
 	// Does not require Init.
 	Cleanup(netif FirewallEndpoint) error
+
+	// ProvisionAntiSpoofing applies rules dropping traffic from given endpoint
+	// with source address other than endpoint's own. Rules are removed by Cleanup.
+	// Does not require Init.
+	ProvisionAntiSpoofing(netif FirewallEndpoint) error
 }
 
 // NetConfig is for agent.NetworkConfig.
@@ -69,17 +75,21 @@ type NetConfig interface {
 }
 
 // NewFirewall returns fully initialized firewall struct, with rules and chains
-// configured for given endpoint.
-func NewFirewall(executor utilexec.Executable, store FirewallStore, nc NetConfig) (Firewall, error) {
+// configured for given endpoint, keeping the rules it manages in the
+// repository, such as one of NewDbRuleRepository or package firewalltest.
+func NewFirewall(executor utilexec.Executable, rules RuleRepository, nc NetConfig) (Firewall, error) {
+	return NewFirewallWithContext(context.Background(), executor, rules, nc)
+}
 
-	fwstore := firewallStore{}
-	fwstore.DbStore = store.GetDb()
-	fwstore.mu = store.GetMutex()
+// NewFirewallWithContext is like NewFirewall, but operations of the
+// returned firewall on the repository are abandoned once ctx is done.
+func NewFirewallWithContext(ctx context.Context, executor utilexec.Executable, rules RuleRepository, nc NetConfig) (Firewall, error) {
 
 	fw := new(IPtables)
-	fw.Store = fwstore
+	fw.Store = rules
 	fw.os = executor
 	fw.networkConfig = nc
+	fw.ctx = ctx
 
 	return fw, nil
 }
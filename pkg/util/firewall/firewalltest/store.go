@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package firewalltest provides an in-memory firewall store, so that
+// code using the firewall can be tested without a database.
+package firewalltest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+// Store keeps iptables rules in memory. It implements
+// firewall.RuleRepository, so a firewall created with it
+// keeps rules in it rather than in a database.
+type Store struct {
+	mu     sync.Mutex
+	nextID uint64
+	rules  []firewall.IPtablesRule
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// AddIPtablesRule implements firewall.RuleRepository.
+func (s *Store) AddIPtablesRule(ctx context.Context, rule *firewall.IPtablesRule) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(rule)
+	return nil
+}
+
+// add stores the rule as a new one, the way the database does.
+// Must be called with s.mu locked.
+func (s *Store) add(rule *firewall.IPtablesRule) {
+	now := time.Now()
+	s.nextID++
+	rule.ID = s.nextID
+	rule.CreatedAt = &now
+	rule.UpdatedAt = &now
+	s.rules = append(s.rules, *rule)
+}
+
+// AddIPtablesRules implements firewall.RuleRepository.
+func (s *Store) AddIPtablesRules(ctx context.Context, rules []*firewall.IPtablesRule) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range rules {
+		s.add(rule)
+	}
+	return nil
+}
+
+// ListIPtablesRules implements firewall.RuleRepository.
+func (s *Store) ListIPtablesRules(ctx context.Context) ([]firewall.IPtablesRule, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := make([]firewall.IPtablesRule, len(s.rules))
+	copy(rules, s.rules)
+	return rules, nil
+}
+
+// FindIPtablesRules implements firewall.RuleRepository.
+func (s *Store) FindIPtablesRules(ctx context.Context, subString string) (*[]firewall.IPtablesRule, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rules []firewall.IPtablesRule
+	for _, rule := range s.rules {
+		if strings.Contains(rule.Body, subString) {
+			rules = append(rules, rule)
+		}
+	}
+	return &rules, nil
+}
+
+// FindInterfaceRules implements firewall.RuleRepository.
+func (s *Store) FindInterfaceRules(ctx context.Context, iface string) ([]firewall.IPtablesRule, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rules []firewall.IPtablesRule
+	for _, rule := range s.rules {
+		if firewall.RuleInterface(rule.Body) == iface {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// SaveIPtablesRule implements firewall.RuleRepository.
+func (s *Store) SaveIPtablesRule(ctx context.Context, rule *firewall.IPtablesRule) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		if s.rules[i].ID == rule.ID {
+			now := time.Now()
+			rule.UpdatedAt = &now
+			s.rules[i] = *rule
+			return nil
+		}
+	}
+	// Like the database, store rules not stored before.
+	s.add(rule)
+	return nil
+}
+
+// DeleteIPtablesRule implements firewall.RuleRepository.
+func (s *Store) DeleteIPtablesRule(ctx context.Context, rule *firewall.IPtablesRule) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		if s.rules[i].ID == rule.ID {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package firewalltest
+
+import (
+	"net"
+	"testing"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+	"github.com/romana/core/pkg/util/firewall"
+)
+
+var _ firewall.RuleRepository = &Store{}
+
+type endpoint struct{}
+
+func (endpoint) GetName() string { return "eth1" }
+func (endpoint) GetMac() string  { return "" }
+func (endpoint) GetIP() net.IP   { return net.ParseIP("10.0.0.5") }
+
+// TestStore tests that the firewall keeps rules in the store.
+func TestStore(t *testing.T) {
+	store := NewStore()
+	fw, err := firewall.NewFirewall(&utilexec.FakeExecutor{}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.ProvisionAntiSpoofing(endpoint{}); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := fw.ListRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %v", rules)
+	}
+	for _, rule := range rules {
+		if rule.ID == 0 || rule.State != "active" {
+			t.Errorf("Expected rule to be stored and active, got %+v", rule)
+		}
+	}
+
+	if err := fw.Cleanup(endpoint{}); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = store.ListIPtablesRules(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 0 {
+		t.Errorf("Expected rules to be deleted, got %v", rules)
+	}
+}
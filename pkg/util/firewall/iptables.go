@@ -18,6 +18,7 @@
 package firewall
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	utilexec "github.com/romana/core/pkg/util/exec"
@@ -44,12 +45,15 @@ type IPtables struct {
 	u32filter     string
 	chainPrefix   string
 	interfaceName string
-	Store         firewallStore
+	Store         RuleRepository
 	os            utilexec.Executable
 	initialized   bool
 
 	// Discovered run-time configuration.
 	networkConfig NetConfig
+
+	// Context for store operations, see NewFirewallWithContext.
+	ctx context.Context
 }
 
 // Init implements Firewall interface
@@ -296,7 +300,7 @@ func (fw *IPtables) DivertTrafficToRomanaIPtablesChain(chain IPtablesChain, opTy
 		}
 
 		// Finally, set 'active' flag in database record.
-		if err2 := fw.Store.switchIPtablesRule(rule, setRuleActive); err2 != nil {
+		if err2 := switchIPtablesRule(fw.ctx, fw.Store, rule, setRuleActive); err2 != nil {
 			glog.Error("In DivertTrafficToRomanaIPtablesChain() iptables rule created but activation failed ", rule.Body)
 			return err2
 		}
@@ -308,7 +312,7 @@ func (fw *IPtables) DivertTrafficToRomanaIPtablesChain(chain IPtablesChain, opTy
 
 // addIPtablesRule creates new iptable rule in database.
 func (fw *IPtables) addIPtablesRule(rule *IPtablesRule) error {
-	if err := fw.Store.addIPtablesRule(rule); err != nil {
+	if err := fw.Store.AddIPtablesRule(fw.ctx, rule); err != nil {
 		glog.Error("In addIPtablesRule failed to add ", rule.Body)
 		return err
 	}
@@ -320,14 +324,12 @@ func (fw *IPtables) addIPtablesRule(rule *IPtablesRule) error {
 // to allow a traffic to flow between the Host and Endpoint.
 func (fw *IPtables) CreateRules(chain int) error {
 	glog.Info("In CreateRules() for chain", chain)
+	// First create records of all the rules in database.
+	if err0 := fw.Store.AddIPtablesRules(fw.ctx, fw.chains[chain].Rules); err0 != nil {
+		glog.Error("In CreateRules() failed to create db records for iptables rules of chain ", chain)
+		return err0
+	}
 	for _, rule := range fw.chains[chain].Rules {
-		// First create rule record in database.
-		err0 := fw.addIPtablesRule(rule)
-		if err0 != nil {
-			glog.Error("In CreateRules() create db record for iptables rule ", rule.Body)
-			return err0
-		}
-
 		err1 := fw.EnsureRule(rule, ensureFirst)
 		if err1 != nil {
 			glog.Error("In CreateRules() failed to create install firewall rule ", rule.Body)
@@ -335,7 +337,7 @@ func (fw *IPtables) CreateRules(chain int) error {
 		}
 
 		// Finally, set 'active' flag in database record.
-		if err2 := fw.Store.switchIPtablesRule(rule, setRuleActive); err2 != nil {
+		if err2 := switchIPtablesRule(fw.ctx, fw.Store, rule, setRuleActive); err2 != nil {
 			glog.Error("In CreateRules() iptables rule created but activation failed ", rule.Body)
 			return err2
 		}
@@ -391,7 +393,7 @@ func (fw *IPtables) CreateDefaultRule(chain int, target string) error {
 	}
 
 	// Finally, set 'active' flag in database record.
-	if err2 := fw.Store.switchIPtablesRule(rule, setRuleActive); err2 != nil {
+	if err2 := switchIPtablesRule(fw.ctx, fw.Store, rule, setRuleActive); err2 != nil {
 		glog.Error("In CreateDefaultRule() iptables rule created but activation failed ", rule.Body)
 		return err2
 	}
@@ -552,7 +554,7 @@ func (fw IPtables) ProvisionEndpoint() error {
 
 // Cleanup implements Firewall interface.
 func (fw IPtables) Cleanup(netif FirewallEndpoint) error {
-	if err := fw.deleteIPtablesRulesBySubstring(netif.GetName()); err != nil {
+	if err := fw.deleteInterfaceRules(netif.GetName()); err != nil {
 		glog.Errorf("In Cleanup() failed to clean firewall for %s", netif.GetName())
 		return err
 	}
@@ -560,15 +562,69 @@ func (fw IPtables) Cleanup(netif FirewallEndpoint) error {
 	return nil
 }
 
-// deleteIPtablesRulesBySubstring uninstalls iptables Rules matching given
-// substring and deletes them from database. Has no effect on 'inactive' Rules.
-func (fw *IPtables) deleteIPtablesRulesBySubstring(substring string) error {
-	rules, err := fw.Store.findIPtablesRules(substring)
+// ProvisionAntiSpoofing implements Firewall interface.
+// Rules go first into the base chains, so that spoofed packets are dropped
+// before they are diverted into Romana chains.
+func (fw IPtables) ProvisionAntiSpoofing(netif FirewallEndpoint) error {
+	iface := netif.GetName()
+	ip := netif.GetIP()
+	if iface == "" || ip == nil {
+		return fmt.Errorf("Anti-spoofing requires interface name and IP address, got %s and %v", iface, ip)
+	}
+
+	// Every rule is inserted at the top of its chain,
+	// so the last rule here is evaluated first.
+	var bodies []string
+	for _, baseChain := range []string{"INPUT", "FORWARD"} {
+		bodies = append(bodies, fmt.Sprintf("%s -i %s ! -s %s/32 -j DROP", baseChain, iface, ip))
+	}
+	// DHCP requests come from 0.0.0.0, before endpoint knows its address.
+	bodies = append(bodies, fmt.Sprintf("INPUT -i %s -s 0.0.0.0/32 -d 255.255.255.255/32 -p udp -m udp --sport 68 --dport 67 -j ACCEPT", iface))
+	if mac := netif.GetMac(); mac != "" {
+		for _, baseChain := range []string{"INPUT", "FORWARD"} {
+			bodies = append(bodies, fmt.Sprintf("%s -i %s -m mac ! --mac-source %s -j DROP", baseChain, iface, mac))
+		}
+	}
+
+	rules := make([]*IPtablesRule, len(bodies))
+	for i, body := range bodies {
+		rules[i] = &IPtablesRule{
+			Body:  body,
+			State: setRuleInactive.String(),
+		}
+	}
+	// First create records of all the rules in database.
+	if err0 := fw.Store.AddIPtablesRules(fw.ctx, rules); err0 != nil {
+		glog.Error("In ProvisionAntiSpoofing() failed to create db records for iptables rules of ", iface)
+		return err0
+	}
+
+	for _, rule := range rules {
+		if err1 := fw.EnsureRule(rule, ensureFirst); err1 != nil {
+			glog.Error("In ProvisionAntiSpoofing() failed to install firewall rule ", rule.Body)
+			return err1
+		}
+
+		// Finally, set 'active' flag in database record.
+		if err2 := switchIPtablesRule(fw.ctx, fw.Store, rule, setRuleActive); err2 != nil {
+			glog.Error("In ProvisionAntiSpoofing() iptables rule created but activation failed ", rule.Body)
+			return err2
+		}
+	}
+	glog.V(1).Infof("Anti-spoofing rules for %s provisioned", iface)
+	return nil
+}
+
+// deleteInterfaceRules uninstalls iptables Rules matching packets of
+// the given interface and deletes them from database. Has no effect
+// on 'inactive' Rules.
+func (fw *IPtables) deleteInterfaceRules(iface string) error {
+	rules, err := fw.Store.FindInterfaceRules(fw.ctx, iface)
 	if err != nil {
 		return err
 	}
 
-	for _, rule := range *rules {
+	for _, rule := range rules {
 		if rule.State == setRuleInactive.String() {
 			continue
 		}
@@ -584,7 +640,7 @@ func (fw *IPtables) deleteIPtablesRulesBySubstring(substring string) error {
 
 // deleteIPtablesRule attempts to uninstall and delete the given rule.
 func (fw *IPtables) deleteIPtablesRule(rule *IPtablesRule) error {
-	if err := fw.Store.switchIPtablesRule(rule, setRuleInactive); err != nil {
+	if err := switchIPtablesRule(fw.ctx, fw.Store, rule, setRuleInactive); err != nil {
 		glog.Error("In deleteIPtablesRule() failed to deactivate the rule", rule.Body)
 		return err
 	}
@@ -594,7 +650,7 @@ func (fw *IPtables) deleteIPtablesRule(rule *IPtablesRule) error {
 		return err1
 	}
 
-	if err2 := fw.Store.deleteIPtablesRule(rule); err2 != nil {
+	if err2 := fw.Store.DeleteIPtablesRule(fw.ctx, rule); err2 != nil {
 		glog.Errorf("In deleteIPtablesRule() rule %s set inactive and uninstalled but failed to delete DB record", rule.Body)
 		return err2
 	}
@@ -635,5 +691,5 @@ func (fw IPtables) EnsureRule(rule *IPtablesRule, opType RuleState) error {
 
 // ListRules implements Firewall interface
 func (fw IPtables) ListRules() ([]IPtablesRule, error) {
-	return fw.Store.listIPtablesRules()
+	return fw.Store.ListIPtablesRules(fw.ctx)
 }
@@ -24,6 +24,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	utilexec "github.com/romana/core/pkg/util/exec"
 )
@@ -213,3 +214,214 @@ func TestCreateU32Rules(t *testing.T) {
 		t.Errorf("Unexpected input from TestCreateU32Rules, expect\n%s, got\n%s", expect, *mockExec.Commands)
 	}
 }
+
+// missingRulesExecutor records commands like FakeExecutor, failing
+// only checks for existing rules.
+type missingRulesExecutor struct {
+	utilexec.FakeExecutor
+}
+
+func (x *missingRulesExecutor) Exec(cmd string, args []string) ([]byte, error) {
+	x.FakeExecutor.Exec(cmd, args)
+	if len(args) > 0 && args[0] == "-C" {
+		return nil, errors.New("Rule not found")
+	}
+	return nil, nil
+}
+
+// TestProvisionAntiSpoofing is checking that ProvisionAntiSpoofing installs
+// rules restricting endpoint's source address and Cleanup removes them.
+func TestProvisionAntiSpoofing(t *testing.T) {
+	// Rules do not exist yet, so all of them get inserted.
+	mockExec := &missingRulesExecutor{}
+
+	// Initialize database.
+	mockStore := makeMockStore()
+
+	fw := IPtables{
+		os:            mockExec,
+		Store:         mockStore,
+		networkConfig: mockNetworkConfig{},
+	}
+	err := fw.ProvisionAntiSpoofing(mockFirewallEndpoint{"tap1", "", nil})
+	if err == nil {
+		t.Error("Expected error for endpoint without IP address")
+	}
+
+	endpoint := mockFirewallEndpoint{"tap1", "02:00:0a:00:00:05", net.ParseIP("10.0.0.5")}
+	if err := fw.ProvisionAntiSpoofing(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := strings.Join([]string{
+		"/sbin/iptables -C INPUT -i tap1 ! -s 10.0.0.5/32 -j DROP",
+		"/sbin/iptables -I INPUT -i tap1 ! -s 10.0.0.5/32 -j DROP",
+		"/sbin/iptables -C FORWARD -i tap1 ! -s 10.0.0.5/32 -j DROP",
+		"/sbin/iptables -I FORWARD -i tap1 ! -s 10.0.0.5/32 -j DROP",
+		"/sbin/iptables -C INPUT -i tap1 -s 0.0.0.0/32 -d 255.255.255.255/32 -p udp -m udp --sport 68 --dport 67 -j ACCEPT",
+		"/sbin/iptables -I INPUT -i tap1 -s 0.0.0.0/32 -d 255.255.255.255/32 -p udp -m udp --sport 68 --dport 67 -j ACCEPT",
+		"/sbin/iptables -C INPUT -i tap1 -m mac ! --mac-source 02:00:0a:00:00:05 -j DROP",
+		"/sbin/iptables -I INPUT -i tap1 -m mac ! --mac-source 02:00:0a:00:00:05 -j DROP",
+		"/sbin/iptables -C FORWARD -i tap1 -m mac ! --mac-source 02:00:0a:00:00:05 -j DROP",
+		"/sbin/iptables -I FORWARD -i tap1 -m mac ! --mac-source 02:00:0a:00:00:05 -j DROP",
+	}, "\n")
+	if *mockExec.Commands != expect {
+		t.Errorf("Unexpected input from TestProvisionAntiSpoofing, expect\n%s, got\n%s", expect, *mockExec.Commands)
+	}
+
+	rules, err := fw.ListRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 5 {
+		t.Errorf("Expected 5 rules recorded, got %v", rules)
+	}
+
+	// Rules exist now, so Cleanup deletes them, but not
+	// those of another interface with a similar name.
+	other := mockFirewallEndpoint{"tap10", "", net.ParseIP("10.0.0.6")}
+	if err := fw.ProvisionAntiSpoofing(other); err != nil {
+		t.Fatal(err)
+	}
+	fw.os = &utilexec.FakeExecutor{}
+	if err := fw.Cleanup(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = fw.ListRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("Expected 3 rules of tap10 after Cleanup, got %v", rules)
+	}
+	for _, rule := range rules {
+		if rule.Interface != "tap10" {
+			t.Errorf("Expected rule of tap10, got %v", rule)
+		}
+	}
+}
+
+// TestRecorder tests that firewalls executed by Recorder
+// keep chains and rules in it instead of the host.
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	endpoint := mockFirewallEndpoint{"tap1", "", net.ParseIP("10.0.0.5")}
+	provision := func() {
+		fw, err := NewFirewall(recorder, makeMockStore(), mockNetworkConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Init(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		rule := NewFirewallRule()
+		rule.SetBody("ROMANA-T0S0-INPUT -p icmp --icmp-type 0 -j ACCEPT")
+		if err := fw.SetDefaultRules([]FirewallRule{rule}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.ProvisionEndpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provision()
+
+	expect := []string{
+		"-N ROMANA-T0S0-INPUT",
+		"-N ROMANA-T0S0-OUTPUT",
+		"-N ROMANA-T0S0-FORWARD",
+		"-N ROMANA-T0",
+		"-I ROMANA-T0S0-INPUT -p icmp --icmp-type 0 -j ACCEPT",
+		"-A ROMANA-T0 -j DROP",
+		"-A INPUT -i tap1 -j ROMANA-T0S0-INPUT",
+		"-A OUTPUT -o tap1 -j ROMANA-T0S0-OUTPUT",
+		"-A FORWARD -i tap1 -j ROMANA-T0S0-FORWARD",
+		"-A FORWARD -o tap1 -j ROMANA-T0",
+	}
+	ops := recorder.Operations()
+	if len(ops) != len(expect) {
+		t.Fatalf("Expected %d operations, got %v", len(expect), ops)
+	}
+	for i, op := range ops {
+		if op.String() != expect[i] {
+			t.Errorf("Expected operation %s, got %s", expect[i], op)
+		}
+	}
+
+	// Rules in place are not applied again.
+	provision()
+	if n := len(recorder.Operations()); n != len(expect) {
+		t.Errorf("Expected no more operations, got %v", recorder.Operations()[len(expect):])
+	}
+	if rules := recorder.Rules("FORWARD"); len(rules) != 2 {
+		t.Errorf("Expected 2 rules in FORWARD, got %v", rules)
+	}
+	if _, err := recorder.Exec(iptablesCmd, []string{"-D", "FORWARD", "-i", "tap9"}); err == nil {
+		t.Error("Expected error deleting missing rule")
+	}
+	if _, err := recorder.Exec("/sbin/ip", []string{"route"}); err == nil {
+		t.Error("Expected error executing other commands")
+	}
+
+	recorder.Reset()
+	if dump := recorder.Dump(); dump != "" {
+		t.Errorf("Expected nothing recorded after Reset, got\n%s", dump)
+	}
+}
+
+// lockedExecutor fails iptables commands as if another process held
+// the xtables lock until it has been asked to run them busy times.
+type lockedExecutor struct {
+	busy     int
+	commands []string
+}
+
+func (x *lockedExecutor) Exec(cmd string, args []string) ([]byte, error) {
+	x.commands = append(x.commands, cmd+" "+strings.Join(args, " "))
+	if len(x.commands) <= x.busy {
+		return []byte("Another app is currently holding the xtables lock. Perhaps you want to use the -w option?"), errors.New("exit status 4")
+	}
+	return nil, nil
+}
+
+// TestIPtablesQueue tests that iptables commands wait for the xtables
+// lock and are run again while it is held by another process.
+func TestIPtablesQueue(t *testing.T) {
+	executor := &lockedExecutor{busy: 2}
+	queue := NewIPtablesQueue(executor, 1500*time.Millisecond, 3)
+	var delays []time.Duration
+	queue.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	if _, err := queue.Exec(iptablesCmd, []string{"-N", "ROMANA-T0"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(executor.commands) != 3 || executor.commands[2] != "/sbin/iptables -w 2 -N ROMANA-T0" {
+		t.Errorf("Unexpected commands %v", executor.commands)
+	}
+	if len(delays) != 2 || delays[1] != 2*firstLockRetryDelay {
+		t.Errorf("Unexpected delays between retries %v", delays)
+	}
+
+	// Give up after the retries.
+	executor = &lockedExecutor{busy: 10}
+	queue = NewIPtablesQueue(executor, 0, 3)
+	queue.sleep = func(time.Duration) {}
+	if _, err := queue.Exec(iptablesCmd, []string{"-N", "ROMANA-T0"}); err == nil {
+		t.Error("Expected error while the lock is held")
+	}
+	if len(executor.commands) != 4 || executor.commands[0] != "/sbin/iptables -N ROMANA-T0" {
+		t.Errorf("Unexpected commands %v", executor.commands)
+	}
+
+	// Other failures and commands are not retried.
+	fake := &utilexec.FakeExecutor{Error: errors.New("exit status 1")}
+	queue = NewIPtablesQueue(NewIPtablesQueue(fake, time.Second, 3), time.Second, 3)
+	if _, err := queue.Exec(iptablesCmd, []string{"-C", "INPUT", "-j", "DROP"}); err == nil {
+		t.Error("Expected error of the executor")
+	}
+	if _, err := queue.Exec("/sbin/ipset", []string{"list"}); err == nil {
+		t.Error("Expected error of the executor")
+	}
+	if *fake.Commands != "/sbin/iptables -w 1 -C INPUT -j DROP\n/sbin/ipset list" {
+		t.Errorf("Unexpected commands\n%s", *fake.Commands)
+	}
+}
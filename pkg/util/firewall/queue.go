@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package firewall
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	utilexec "github.com/romana/core/pkg/util/exec"
+)
+
+// firstLockRetryDelay is how long IPtablesQueue waits before running
+// a command again the first time it failed to get the xtables lock;
+// the delay doubles with every retry.
+const firstLockRetryDelay = 100 * time.Millisecond
+
+// lockContentionMessages are what iptables reports when
+// another process is holding the xtables lock.
+var lockContentionMessages = []string{
+	"xtables lock",
+	"Resource temporarily unavailable",
+}
+
+// IPtablesQueue stands in front of the executor of iptables commands,
+// running them one at a time so that rules applied concurrently by the
+// agent do not contend for the xtables lock with each other. Commands
+// wait for the lock held by other programs of the host (kubelet, for
+// one) with iptables -w, and are run again if they still fail to get
+// it. Other commands are passed to the executor as they are.
+type IPtablesQueue struct {
+	// Executor runs the commands.
+	Executor utilexec.Executable
+	// wait is how long iptables waits for the lock, 0 for not at all.
+	wait time.Duration
+	// retries is how many times a command failing to get the lock
+	// is run again.
+	retries int
+
+	mu sync.Mutex
+	// sleep is time.Sleep, replaced by tests.
+	sleep func(time.Duration)
+}
+
+// NewIPtablesQueue returns an IPtablesQueue running iptables commands
+// with the executor. If the executor is an IPtablesQueue already, the
+// new queue runs commands with its executor instead.
+func NewIPtablesQueue(executor utilexec.Executable, wait time.Duration, retries int) *IPtablesQueue {
+	if queue, ok := executor.(*IPtablesQueue); ok {
+		executor = queue.Executor
+	}
+	return &IPtablesQueue{
+		Executor: executor,
+		wait:     wait,
+		retries:  retries,
+		sleep:    time.Sleep,
+	}
+}
+
+// Exec implements utilexec.Executable.
+func (q *IPtablesQueue) Exec(cmd string, args []string) ([]byte, error) {
+	if cmd != iptablesCmd {
+		return q.Executor.Exec(cmd, args)
+	}
+	if q.wait > 0 {
+		// iptables only takes whole seconds.
+		seconds := int((q.wait + time.Second - 1) / time.Second)
+		args = append([]string{"-w", strconv.Itoa(seconds)}, args...)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delay := firstLockRetryDelay
+	for retry := 0; ; retry++ {
+		out, err := q.Executor.Exec(cmd, args)
+		if err == nil || retry >= q.retries || !isLockContention(out, err) {
+			return out, err
+		}
+		glog.Infof("IPtablesQueue: xtables lock is busy, running iptables %s again in %s", strings.Join(args, " "), delay)
+		q.sleep(delay)
+		delay *= 2
+	}
+}
+
+// isLockContention reports whether iptables failed
+// because another process is holding the xtables lock.
+func isLockContention(out []byte, err error) bool {
+	for _, message := range lockContentionMessages {
+		if strings.Contains(string(out), message) || strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
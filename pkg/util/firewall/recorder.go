@@ -0,0 +1,192 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//
+// Firewall provider that records rules instead of applying them.
+
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// baseChains are the iptables chains that always exist.
+var baseChains = []string{"INPUT", "OUTPUT", "FORWARD"}
+
+// Errors Recorder returns, as iptables reports them.
+var (
+	errNoChain = errors.New("iptables: No chain/target/match by that name.")
+	errNoRule  = errors.New("iptables: Bad rule (does a matching rule exist in that chain?).")
+)
+
+// RuleOperation is a change to iptables chains recorded by Recorder.
+type RuleOperation struct {
+	// Op is the iptables option making the change:
+	// -N (new chain), -A (append), -I (insert) or -D (delete).
+	Op string `json:"op"`
+	// Rule is the chain followed by the rule specification,
+	// or just the chain for -N.
+	Rule string `json:"rule"`
+}
+
+func (o RuleOperation) String() string {
+	return o.Op + " " + o.Rule
+}
+
+// Recorder stands in for the iptables binary as the executor of
+// firewalls, so that they can be used without root privileges or
+// iptables installed. It applies nothing to the host, but keeps
+// chains and rules in memory the way iptables would, and records
+// every change to them. The same Recorder should be used for all
+// firewalls of a host, as they share its chains.
+type Recorder struct {
+	mu sync.Mutex
+	// Rules of chains, in order, without the chain name.
+	chains map[string][]string
+	ops    []RuleOperation
+}
+
+// NewRecorder returns a Recorder with empty base chains.
+func NewRecorder() *Recorder {
+	r := &Recorder{}
+	r.Reset()
+	return r
+}
+
+// Reset forgets chains, rules and operations recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chains = make(map[string][]string)
+	for _, chain := range baseChains {
+		r.chains[chain] = nil
+	}
+	r.ops = nil
+}
+
+// Exec implements utilexec.Executable for iptables commands
+// used by firewalls: -L, -N, -C, -A, -I and -D.
+func (r *Recorder) Exec(cmd string, args []string) ([]byte, error) {
+	if cmd != iptablesCmd {
+		return nil, fmt.Errorf("Recorder cannot execute %s", cmd)
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Recorder cannot execute iptables %s", strings.Join(args, " "))
+	}
+	op, chain, rule := args[0], args[1], strings.Join(args[2:], " ")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rules, exists := r.chains[chain]
+	if op == "-N" {
+		if exists {
+			return nil, fmt.Errorf("iptables: Chain %s already exists.", chain)
+		}
+		r.chains[chain] = nil
+		r.ops = append(r.ops, RuleOperation{Op: op, Rule: chain})
+		return nil, nil
+	}
+	if !exists {
+		return nil, errNoChain
+	}
+	i := indexOf(rules, rule)
+	switch op {
+	case "-L":
+		return r.list(chain), nil
+	case "-C":
+		if i < 0 {
+			return nil, errNoRule
+		}
+		return nil, nil
+	case "-A":
+		r.chains[chain] = append(rules, rule)
+	case "-I":
+		r.chains[chain] = append([]string{rule}, rules...)
+	case "-D":
+		if i < 0 {
+			return nil, errNoRule
+		}
+		r.chains[chain] = append(rules[:i], rules[i+1:]...)
+	default:
+		return nil, fmt.Errorf("Recorder cannot execute iptables %s", strings.Join(args, " "))
+	}
+	r.ops = append(r.ops, RuleOperation{Op: op, Rule: chain + " " + rule})
+	return nil, nil
+}
+
+// list returns rules of the chain as iptables -S would.
+func (r *Recorder) list(chain string) []byte {
+	var buf bytes.Buffer
+	if indexOf(baseChains, chain) < 0 {
+		fmt.Fprintf(&buf, "-N %s\n", chain)
+	}
+	for _, rule := range r.chains[chain] {
+		fmt.Fprintf(&buf, "-A %s %s\n", chain, rule)
+	}
+	return buf.Bytes()
+}
+
+func indexOf(rules []string, rule string) int {
+	for i, r := range rules {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+// Operations returns changes recorded so far, oldest first.
+func (r *Recorder) Operations() []RuleOperation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RuleOperation{}, r.ops...)
+}
+
+// Rules returns rules of the chain, in order.
+func (r *Recorder) Rules(chain string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.chains[chain]...)
+}
+
+// Dump returns chains and rules in the format of iptables-save:
+// user-defined chains first, then rules of all chains, ordered
+// by chain name.
+func (r *Recorder) Dump() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var chains []string
+	for chain := range r.chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+	var buf bytes.Buffer
+	for _, chain := range chains {
+		if indexOf(baseChains, chain) < 0 {
+			fmt.Fprintf(&buf, "-N %s\n", chain)
+		}
+	}
+	for _, chain := range chains {
+		for _, rule := range r.chains[chain] {
+			fmt.Fprintf(&buf, "-A %s %s\n", chain, rule)
+		}
+	}
+	return buf.String()
+}
@@ -18,12 +18,16 @@
 package firewall
 
 import (
+	"context"
 	"github.com/golang/glog"
+	"github.com/jinzhu/gorm"
 	"github.com/romana/core/common"
+	"strings"
 	"sync"
+	"time"
 )
 
-// FirewallStore defines how database should be passed into firewall instance.
+// FirewallStore defines how a database is passed to NewDbRuleRepository.
 type FirewallStore interface {
 	// GetDb Returns fully initialized DbStore object
 	GetDb() common.DbStore
@@ -32,12 +36,38 @@ type FirewallStore interface {
 	GetMutex() *sync.Mutex
 }
 
-// firewallStore implement FirewallStore
+// RuleRepository keeps the iptables rules a firewall manages; IPtables
+// uses nothing else of its store, and does not depend on how (or
+// whether) rules are kept in a database. NewDbRuleRepository returns
+// one keeping them in a database, package firewalltest one keeping
+// them in memory.
+type RuleRepository interface {
+	AddIPtablesRule(ctx context.Context, rule *IPtablesRule) error
+	// AddIPtablesRules adds a set of rules at once,
+	// either all of them or, on error, none.
+	AddIPtablesRules(ctx context.Context, rules []*IPtablesRule) error
+	ListIPtablesRules(ctx context.Context) ([]IPtablesRule, error)
+	FindIPtablesRules(ctx context.Context, subString string) (*[]IPtablesRule, error)
+	// FindInterfaceRules returns the rules matching packets
+	// of the interface (see IPtablesRule.Interface).
+	FindInterfaceRules(ctx context.Context, iface string) ([]IPtablesRule, error)
+	// SaveIPtablesRule updates the stored rule, such as its state.
+	SaveIPtablesRule(ctx context.Context, rule *IPtablesRule) error
+	DeleteIPtablesRule(ctx context.Context, rule *IPtablesRule) error
+}
+
+// firewallStore implements RuleRepository in the database of a FirewallStore.
 type firewallStore struct {
 	common.DbStore
 	mu *sync.Mutex
 }
 
+// NewDbRuleRepository returns a RuleRepository keeping rules in the
+// database of the store, guarded by its mutex.
+func NewDbRuleRepository(store FirewallStore) RuleRepository {
+	return firewallStore{DbStore: store.GetDb(), mu: store.GetMutex()}
+}
+
 // Entities implements Entities method of
 // Service interface.
 func (firewallStore *firewallStore) Entities() []interface{} {
@@ -48,7 +78,14 @@ func (firewallStore *firewallStore) Entities() []interface{} {
 
 // CreateSchemaPostProcess implements  common.ServiceStore.CreateSchemaPostProcess()
 func (fs firewallStore) CreateSchemaPostProcess() error {
-	return nil
+	return AddRuleIndexes(fs.Db)
+}
+
+// AddRuleIndexes adds indexes to the table of IPtablesRule
+// in the database of a store keeping the rules.
+func AddRuleIndexes(db *gorm.DB) error {
+	db.Model(&IPtablesRule{}).AddIndex("idx_iptables_rule_interface", "interface")
+	return common.MakeMultiError(db.GetErrors())
 }
 
 // GetDb implements firewall.FirewallStore
@@ -66,6 +103,12 @@ type IPtablesRule struct {
 	ID    uint64 `sql:"AUTO_INCREMENT"`
 	Body  string
 	State string
+	// Interface is the interface whose packets the rule matches
+	// (with -i or -o), if any. Stores set it from Body.
+	Interface string
+	// CreatedAt and UpdatedAt are maintained by the store.
+	CreatedAt *time.Time
+	UpdatedAt *time.Time
 }
 
 // GetBody implements FirewallRule interface.
@@ -83,28 +126,48 @@ func (r *IPtablesRule) SetBody(body string) {
 	r.Body = body
 }
 
-func (firewallStore *firewallStore) addIPtablesRule(rule *IPtablesRule) error {
-	glog.Info("Acquiring store mutex for addIPtablesRule")
+// RuleInterface returns the interface the rule with the given body
+// matches packets of, or an empty string if it matches none.
+func RuleInterface(body string) string {
+	args := strings.Fields(body)
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-i" || args[i] == "-o" {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// AddIPtablesRule implements RuleRepository.
+func (firewallStore firewallStore) AddIPtablesRule(ctx context.Context, rule *IPtablesRule) error {
+	glog.Info("Acquiring store mutex for AddIPtablesRule")
 	if rule == nil {
-		panic("In addIPtablesRule(), received nil rule")
+		panic("In AddIPtablesRule(), received nil rule")
 	}
 
 	firewallStore.mu.Lock()
 	defer func() {
-		glog.Info("Releasing store mutex for addIPtablesRule")
+		glog.Info("Releasing store mutex for AddIPtablesRule")
 		firewallStore.mu.Unlock()
 	}()
-	glog.Info("Acquired store mutex for addIPtablesRule")
+	glog.Info("Acquired store mutex for AddIPtablesRule")
+
+	// The mutex may have been held for a while; give up if the caller
+	// is no longer interested.
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 
 	db := firewallStore.DbStore.Db
 	// db := firewallStore.GetDb()
-	glog.Info("In addIPtablesRule() after GetDb")
+	glog.Info("In AddIPtablesRule() after GetDb")
 	if db == nil {
-		panic("In addIPtablesRule(), db is nil")
+		panic("In AddIPtablesRule(), db is nil")
 	}
 
+	rule.Interface = RuleInterface(rule.Body)
 	firewallStore.DbStore.Db.Create(rule)
-	glog.Info("In addIPtablesRule() after Db.Create")
+	glog.Info("In AddIPtablesRule() after Db.Create")
 	if db.Error != nil {
 		return db.Error
 	}
@@ -119,14 +182,35 @@ func (firewallStore *firewallStore) addIPtablesRule(rule *IPtablesRule) error {
 	return nil
 }
 
-func (firewallStore *firewallStore) listIPtablesRules() ([]IPtablesRule, error) {
-	glog.Info("Acquiring store mutex for listIPtablesRules")
+// AddIPtablesRules implements RuleRepository.
+func (firewallStore firewallStore) AddIPtablesRules(ctx context.Context, rules []*IPtablesRule) error {
+	glog.Info("Acquiring store mutex for AddIPtablesRules")
+	firewallStore.mu.Lock()
+	defer func() {
+		glog.Info("Releasing store mutex for AddIPtablesRules")
+		firewallStore.mu.Unlock()
+	}()
+	glog.Info("Acquired store mutex for AddIPtablesRules")
+
+	for _, rule := range rules {
+		rule.Interface = RuleInterface(rule.Body)
+	}
+	return firewallStore.DbStore.CreateAll(ctx, rules)
+}
+
+// ListIPtablesRules implements RuleRepository.
+func (firewallStore firewallStore) ListIPtablesRules(ctx context.Context) ([]IPtablesRule, error) {
+	glog.Info("Acquiring store mutex for ListIPtablesRules")
 	firewallStore.mu.Lock()
 	defer func() {
-		glog.Info("Releasing store mutex for listIPtablesRules")
+		glog.Info("Releasing store mutex for ListIPtablesRules")
 		firewallStore.mu.Unlock()
 	}()
-	glog.Info("Acquired store mutex for listIPtablesRules")
+	glog.Info("Acquired store mutex for ListIPtablesRules")
+
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 
 	var iPtablesRule []IPtablesRule
 	firewallStore.DbStore.Db.Find(&iPtablesRule)
@@ -137,14 +221,19 @@ func (firewallStore *firewallStore) listIPtablesRules() ([]IPtablesRule, error)
 	return iPtablesRule, nil
 }
 
-func (firewallStore *firewallStore) deleteIPtablesRule(rule *IPtablesRule) error {
-	glog.Info("Acquiring store mutex for deleteIPtablesRule")
+// DeleteIPtablesRule implements RuleRepository.
+func (firewallStore firewallStore) DeleteIPtablesRule(ctx context.Context, rule *IPtablesRule) error {
+	glog.Info("Acquiring store mutex for DeleteIPtablesRule")
 	firewallStore.mu.Lock()
 	defer func() {
-		glog.Info("Releasing store mutex for deleteIPtablesRule")
+		glog.Info("Releasing store mutex for DeleteIPtablesRule")
 		firewallStore.mu.Unlock()
 	}()
-	glog.Info("Acquired store mutex for deleteIPtablesRule")
+	glog.Info("Acquired store mutex for DeleteIPtablesRule")
+
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 
 	db := firewallStore.DbStore.Db
 	firewallStore.DbStore.Db.Delete(rule)
@@ -159,7 +248,8 @@ func (firewallStore *firewallStore) deleteIPtablesRule(rule *IPtablesRule) error
 	return nil
 }
 
-func (firewallStore *firewallStore) findIPtablesRules(subString string) (*[]IPtablesRule, error) {
+// FindIPtablesRules implements RuleRepository.
+func (firewallStore firewallStore) FindIPtablesRules(ctx context.Context, subString string) (*[]IPtablesRule, error) {
 	glog.Info("Acquiring store mutex for findIPtablesRule")
 	firewallStore.mu.Lock()
 	defer func() {
@@ -168,6 +258,10 @@ func (firewallStore *firewallStore) findIPtablesRules(subString string) (*[]IPta
 	}()
 	glog.Info("Acquired store mutex for findIPtablesRule")
 
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+
 	var rules []IPtablesRule
 	db := firewallStore.DbStore.Db
 	searchString := "%" + subString + "%"
@@ -182,6 +276,28 @@ func (firewallStore *firewallStore) findIPtablesRules(subString string) (*[]IPta
 	return &rules, nil
 }
 
+// FindInterfaceRules implements RuleRepository.
+func (firewallStore firewallStore) FindInterfaceRules(ctx context.Context, iface string) ([]IPtablesRule, error) {
+	glog.Info("Acquiring store mutex for FindInterfaceRules")
+	firewallStore.mu.Lock()
+	defer func() {
+		glog.Info("Releasing store mutex for FindInterfaceRules")
+		firewallStore.mu.Unlock()
+	}()
+	glog.Info("Acquired store mutex for FindInterfaceRules")
+
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+
+	var rules []IPtablesRule
+	db := firewallStore.DbStore.Db.Where("interface = ?", iface).Find(&rules)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	return rules, nil
+}
+
 // opSwitchIPtables represents action to be taken in switchIPtablesRule
 type opSwitchIPtables int
 
@@ -207,7 +323,7 @@ func (op opSwitchIPtables) String() string {
 }
 
 // switchIPtablesRule changes IPtablesRule state.
-func (firewallStore *firewallStore) switchIPtablesRule(rule *IPtablesRule, op opSwitchIPtables) error {
+func switchIPtablesRule(ctx context.Context, store RuleRepository, rule *IPtablesRule, op opSwitchIPtables) error {
 
 	// Fast track return if nothing to be done
 	if rule.State == op.String() {
@@ -215,14 +331,6 @@ func (firewallStore *firewallStore) switchIPtablesRule(rule *IPtablesRule, op op
 		return nil
 	}
 
-	glog.Info("Acquiring store mutex for switchIPtablesRule")
-	firewallStore.mu.Lock()
-	defer func() {
-		glog.Info("Releasing store mutex for switchIPtablesRule")
-		firewallStore.mu.Unlock()
-	}()
-	glog.Info("Acquired store mutex for switchIPtablesRule")
-
 	// if toggle requested then reverse current state
 	if op == toggleRule {
 		if rule.State == setRuleInactive.String() {
@@ -235,7 +343,25 @@ func (firewallStore *firewallStore) switchIPtablesRule(rule *IPtablesRule, op op
 		rule.State = op.String()
 	}
 
+	return store.SaveIPtablesRule(ctx, rule)
+}
+
+// SaveIPtablesRule implements RuleRepository.
+func (firewallStore firewallStore) SaveIPtablesRule(ctx context.Context, rule *IPtablesRule) error {
+	glog.Info("Acquiring store mutex for SaveIPtablesRule")
+	firewallStore.mu.Lock()
+	defer func() {
+		glog.Info("Releasing store mutex for SaveIPtablesRule")
+		firewallStore.mu.Unlock()
+	}()
+	glog.Info("Acquired store mutex for SaveIPtablesRule")
+
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+
 	db := firewallStore.DbStore.Db
+	rule.Interface = RuleInterface(rule.Body)
 	firewallStore.DbStore.Db.Save(rule)
 	err := common.MakeMultiError(db.GetErrors())
 	if err != nil {
@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipset
+
+import (
+	"strings"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+)
+
+const (
+	ipsetCmd = "/sbin/ipset"
+
+	// HashNet is a type of set holding addresses and networks.
+	HashNet = "hash:net"
+)
+
+// Ipset manages ipsets by running ipset utility.
+type Ipset struct {
+	os utilexec.Executable
+}
+
+// NewIpset returns Ipset running commands with given executor.
+func NewIpset(executor utilexec.Executable) Ipset {
+	return Ipset{os: executor}
+}
+
+// Create creates set of given type unless it exists already.
+func (s Ipset) Create(name string, setType string) error {
+	return s.exec("create", "-exist", name, setType)
+}
+
+// Destroy deletes the set, which must not be used by iptables rules.
+func (s Ipset) Destroy(name string) error {
+	return s.exec("destroy", name)
+}
+
+// Add adds entry to the set, unless it's there already. The entry
+// may be followed by options, e.g. "10.1.0.0/16 nomatch", as Members
+// returns them.
+func (s Ipset) Add(name string, entry string) error {
+	return s.exec(append([]string{"add", "-exist", name}, strings.Fields(entry)...)...)
+}
+
+// Del deletes entry from the set, if it's there. Options following
+// the entry are ignored.
+func (s Ipset) Del(name string, entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return s.exec("del", "-exist", name, entry)
+	}
+	return s.exec("del", "-exist", name, fields[0])
+}
+
+// Members returns entries of the set.
+func (s Ipset) Members(name string) ([]string, error) {
+	args := []string{"list", name}
+	out, err := s.os.Exec(ipsetCmd, args)
+	if err != nil {
+		return nil, execError(err, args, out)
+	}
+	var members []string
+	inMembers := false
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if inMembers {
+			members = append(members, line)
+		} else if line == "Members:" {
+			inMembers = true
+		}
+	}
+	return members, nil
+}
+
+func (s Ipset) exec(args ...string) error {
+	out, err := s.os.Exec(ipsetCmd, args)
+	if err != nil {
+		return execError(err, args, out)
+	}
+	return nil
+}
+
+// ipsetError is returned when ipset utility fails.
+type ipsetError struct {
+	err    error
+	args   []string
+	output string
+}
+
+func (e ipsetError) Error() string {
+	return ipsetCmd + " " + strings.Join(e.args, " ") + " failed: " + e.err.Error() + ": " + e.output
+}
+
+func execError(err error, args []string, out []byte) error {
+	return ipsetError{err: err, args: args, output: strings.TrimSpace(string(out))}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package ipset
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+)
+
+// TestIpset is checking that Ipset generates correct commands
+// and parses members of the set.
+func TestIpset(t *testing.T) {
+	mockExec := &utilexec.FakeExecutor{}
+	s := NewIpset(mockExec)
+	s.Create("romana-t1s2", HashNet)
+	s.Add("romana-t1s2", "10.0.18.5")
+	s.Del("romana-t1s2", "10.65.18.0/24")
+	s.Add("romana-t1s2", "10.0.18.0/28 nomatch")
+	s.Del("romana-t1s2", "10.0.18.0/28 nomatch")
+	s.Destroy("romana-t1s2")
+
+	expect := strings.Join([]string{
+		"/sbin/ipset create -exist romana-t1s2 hash:net",
+		"/sbin/ipset add -exist romana-t1s2 10.0.18.5",
+		"/sbin/ipset del -exist romana-t1s2 10.65.18.0/24",
+		"/sbin/ipset add -exist romana-t1s2 10.0.18.0/28 nomatch",
+		"/sbin/ipset del -exist romana-t1s2 10.0.18.0/28",
+		"/sbin/ipset destroy romana-t1s2",
+	}, "\n")
+	if *mockExec.Commands != expect {
+		t.Errorf("Unexpected commands, expect\n%s, got\n%s", expect, *mockExec.Commands)
+	}
+
+	mockExec = &utilexec.FakeExecutor{Output: []byte(`Name: romana-t1s2
+Type: hash:net
+Revision: 6
+Header: family inet hashsize 1024 maxelem 65536
+Size in memory: 576
+References: 1
+Number of entries: 2
+Members:
+10.0.18.5
+10.65.18.0/24
+`)}
+	members, err := NewIpset(mockExec).Members("romana-t1s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(members, " ") != "10.0.18.5 10.65.18.0/24" {
+		t.Errorf("Unexpected members %v", members)
+	}
+
+	mockExec = &utilexec.FakeExecutor{Output: []byte("ipset v6.29: The set with the given name does not exist\n"), Error: errors.New("exit status 1")}
+	_, err = NewIpset(mockExec).Members("romana-t9")
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected error with ipset output, got %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// FakeNetlink implements Netlink by keeping routes and
+// interfaces in memory, for testing.
+type FakeNetlink struct {
+	Routes []Route
+	Links  map[string]Link
+	Addrs  []Addr
+	// Operations that changed something, in the
+	// order performed, as in "route replace 10.0.0.0/8 via 1.1.1.1".
+	Commands []string
+	// If set, returned by all operations.
+	Error error
+	// Destinations of default forwarding entries by interface.
+	Fdb map[string][]net.IP
+	// Channels passed to LinkSubscribe.
+	subscribers []chan<- LinkUpdate
+	// Other network namespaces by path, and
+	// the one operations apply to, if any.
+	Netns map[string]*FakeNetns
+	netns string
+}
+
+// FakeNetns is a network namespace of FakeNetlink.
+type FakeNetns struct {
+	Routes []Route
+	Links  map[string]Link
+	Addrs  []Addr
+}
+
+func (f *FakeNetlink) record(op string, target string) {
+	if f.netns != "" {
+		op = "netns " + f.netns + " " + op
+	}
+	f.Commands = append(f.Commands, op+" "+target)
+}
+
+func (f *FakeNetlink) findRoute(dst *net.IPNet) int {
+	for i, route := range f.Routes {
+		if route.Dst.String() == dst.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FakeNetlink) RouteList(dst *net.IPNet) ([]Route, error) {
+	if f.Error != nil {
+		return nil, f.Error
+	}
+	var routes []Route
+	if dst == nil {
+		routes = append(routes, f.Routes...)
+	} else if i := f.findRoute(dst); i >= 0 {
+		routes = append(routes, f.Routes[i])
+	}
+	return routes, nil
+}
+
+func (f *FakeNetlink) RouteAdd(route Route) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	if f.findRoute(route.Dst) >= 0 {
+		return Error{Op: "route add", Target: route.String(), Errno: syscall.EEXIST}
+	}
+	f.record("route add", route.String())
+	f.Routes = append(f.Routes, route)
+	return nil
+}
+
+func (f *FakeNetlink) RouteReplace(route Route) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	f.record("route replace", route.String())
+	if i := f.findRoute(route.Dst); i >= 0 {
+		f.Routes[i] = route
+	} else {
+		f.Routes = append(f.Routes, route)
+	}
+	return nil
+}
+
+func (f *FakeNetlink) RouteDel(route Route) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	i := f.findRoute(route.Dst)
+	if i < 0 {
+		return Error{Op: "route del", Target: route.String(), Errno: syscall.ESRCH}
+	}
+	f.record("route del", route.String())
+	f.Routes = append(f.Routes[:i], f.Routes[i+1:]...)
+	return nil
+}
+
+func (f *FakeNetlink) AddrList() ([]Addr, error) {
+	if f.Error != nil {
+		return nil, f.Error
+	}
+	return f.Addrs, nil
+}
+
+func (f *FakeNetlink) LinkByName(name string) (Link, error) {
+	if f.Error != nil {
+		return Link{}, f.Error
+	}
+	link, ok := f.Links[name]
+	if !ok {
+		return Link{}, Error{Op: "link show", Target: name, Errno: syscall.ENODEV}
+	}
+	return link, nil
+}
+
+func (f *FakeNetlink) LinkSetUp(name string) error {
+	link, err := f.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	f.record("link set up", name)
+	link.Up = true
+	f.Links[name] = link
+	return nil
+}
+
+func (f *FakeNetlink) LinkDel(name string) error {
+	if _, err := f.LinkByName(name); err != nil {
+		return err
+	}
+	f.record("link del", name)
+	delete(f.Links, name)
+	return nil
+}
+
+func (f *FakeNetlink) VethAdd(name string, peer string) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	if f.Links == nil {
+		f.Links = make(map[string]Link)
+	}
+	for _, n := range []string{name, peer} {
+		if _, ok := f.Links[n]; ok {
+			return Error{Op: "link add veth", Target: name + " peer " + peer, Errno: syscall.EEXIST}
+		}
+	}
+	f.record("link add veth", name+" peer "+peer)
+	f.Links[name] = Link{Name: name, Index: len(f.Links) + 1}
+	f.Links[peer] = Link{Name: peer, Index: len(f.Links) + 1}
+	return nil
+}
+
+func (f *FakeNetlink) VxlanAdd(vxlan Vxlan) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	if f.Links == nil {
+		f.Links = make(map[string]Link)
+	}
+	if _, ok := f.Links[vxlan.Name]; ok {
+		return Error{Op: "link add vxlan", Target: vxlan.Name, Errno: syscall.EEXIST}
+	}
+	f.record("link add vxlan", fmt.Sprintf("%s id %d dstport %d local %s", vxlan.Name, vxlan.VNI, vxlan.Port, vxlan.Local))
+	f.Links[vxlan.Name] = Link{Name: vxlan.Name, Index: len(f.Links) + 1}
+	return nil
+}
+
+func (f *FakeNetlink) FdbList(linkName string) ([]net.IP, error) {
+	if _, err := f.LinkByName(linkName); err != nil {
+		return nil, err
+	}
+	return f.Fdb[linkName], nil
+}
+
+func (f *FakeNetlink) FdbAppend(linkName string, dst net.IP) error {
+	dsts, err := f.FdbList(linkName)
+	if err != nil {
+		return err
+	}
+	if containsIP(dsts, dst) {
+		return Error{Op: "fdb append", Target: dst.String() + " dev " + linkName, Errno: syscall.EEXIST}
+	}
+	f.record("fdb append", dst.String()+" dev "+linkName)
+	if f.Fdb == nil {
+		f.Fdb = make(map[string][]net.IP)
+	}
+	f.Fdb[linkName] = append(dsts, dst)
+	return nil
+}
+
+func (f *FakeNetlink) FdbDel(linkName string, dst net.IP) error {
+	dsts, err := f.FdbList(linkName)
+	if err != nil {
+		return err
+	}
+	for i, d := range dsts {
+		if d.Equal(dst) {
+			f.record("fdb del", dst.String()+" dev "+linkName)
+			f.Fdb[linkName] = append(dsts[:i:i], dsts[i+1:]...)
+			return nil
+		}
+	}
+	return Error{Op: "fdb del", Target: dst.String() + " dev " + linkName, Errno: syscall.ENOENT}
+}
+
+func (f *FakeNetlink) LinkSubscribe(updates chan<- LinkUpdate, done <-chan struct{}) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	f.subscribers = append(f.subscribers, updates)
+	return nil
+}
+
+// Notify applies the update to Links and sends it to subscribers.
+func (f *FakeNetlink) Notify(update LinkUpdate) {
+	if f.Links == nil {
+		f.Links = make(map[string]Link)
+	}
+	if update.Deleted {
+		delete(f.Links, update.Name)
+	} else {
+		f.Links[update.Name] = update.Link
+	}
+	for _, updates := range f.subscribers {
+		updates <- update
+	}
+}
+
+func (f *FakeNetlink) LinkSetName(name string, newName string) error {
+	link, err := f.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Links[newName]; ok {
+		return Error{Op: "link set name", Target: name + " " + newName, Errno: syscall.EEXIST}
+	}
+	f.record("link set name", name+" "+newName)
+	delete(f.Links, name)
+	link.Name = newName
+	f.Links[newName] = link
+	return nil
+}
+
+func (f *FakeNetlink) LinkSetNs(name string, netns string) error {
+	link, err := f.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	ns, ok := f.Netns[netns]
+	if !ok {
+		return Error{Op: "link set netns", Target: name + " " + netns, Errno: syscall.ENOENT}
+	}
+	f.record("link set netns", name+" "+netns)
+	delete(f.Links, name)
+	if ns.Links == nil {
+		ns.Links = make(map[string]Link)
+	}
+	ns.Links[name] = link
+	return nil
+}
+
+func (f *FakeNetlink) AddrAdd(linkName string, addr *net.IPNet) error {
+	if _, err := f.LinkByName(linkName); err != nil {
+		return err
+	}
+	for _, existing := range f.Addrs {
+		if existing.LinkName == linkName && existing.IPNet.String() == addr.String() {
+			return Error{Op: "addr add", Target: addr.String() + " dev " + linkName, Errno: syscall.EEXIST}
+		}
+	}
+	f.record("addr add", addr.String()+" dev "+linkName)
+	f.Addrs = append(f.Addrs, Addr{IPNet: addr, LinkName: linkName, Label: linkName})
+	return nil
+}
+
+// InNetns swaps in routes, interfaces and addresses
+// of the namespace for the duration of f.
+func (f *FakeNetlink) InNetns(netns string, fn func() error) error {
+	if f.Error != nil {
+		return f.Error
+	}
+	ns, ok := f.Netns[netns]
+	if !ok {
+		return Error{Op: "netns enter", Target: netns, Errno: syscall.ENOENT}
+	}
+	if ns.Links == nil {
+		ns.Links = make(map[string]Link)
+	}
+	saved := FakeNetns{Routes: f.Routes, Links: f.Links, Addrs: f.Addrs}
+	f.Routes, f.Links, f.Addrs, f.netns = ns.Routes, ns.Links, ns.Addrs, netns
+	err := fn()
+	*ns = FakeNetns{Routes: f.Routes, Links: f.Links, Addrs: f.Addrs}
+	f.Routes, f.Links, f.Addrs, f.netns = saved.Routes, saved.Links, saved.Addrs, ""
+	return err
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Netlink is a facade to the kernel's routing netlink interface.
+// Only IPv4 routes in the main routing table are managed.
+type Netlink interface {
+	// RouteList returns routes to exactly the destination,
+	// or all routes if it is nil.
+	RouteList(dst *net.IPNet) ([]Route, error)
+	// RouteAdd adds the route; it is an error if one to the
+	// same destination exists (see IsExist).
+	RouteAdd(route Route) error
+	// RouteReplace adds the route, replacing any existing
+	// one to the same destination.
+	RouteReplace(route Route) error
+	// RouteDel deletes the route to the destination of route.
+	RouteDel(route Route) error
+	// AddrList returns IPv4 addresses of all interfaces.
+	AddrList() ([]Addr, error)
+	// LinkByName returns the interface with the name
+	// (see IsNotExist if there is none).
+	LinkByName(name string) (Link, error)
+	// LinkSetUp brings the interface up.
+	LinkSetUp(name string) error
+	// LinkDel deletes the interface.
+	LinkDel(name string) error
+	// VethAdd creates a veth pair.
+	VethAdd(name string, peer string) error
+	// LinkSetName renames the interface.
+	LinkSetName(name string, newName string) error
+	// LinkSetNs moves the interface into the network namespace
+	// bound at the path (such as /proc/<pid>/ns/net).
+	LinkSetNs(name string, netns string) error
+	// AddrAdd adds the address to the interface.
+	AddrAdd(linkName string, addr *net.IPNet) error
+	// InNetns calls f in the network namespace bound at the path:
+	// calls of this interface made by f (in the same goroutine)
+	// apply to that namespace.
+	InNetns(netns string, f func() error) error
+	// VxlanAdd creates a VXLAN interface.
+	VxlanAdd(vxlan Vxlan) error
+	// FdbList returns destinations of default (all-zero MAC)
+	// forwarding entries of the VXLAN interface.
+	FdbList(linkName string) ([]net.IP, error)
+	// FdbAppend adds a default forwarding entry to the
+	// destination to the VXLAN interface.
+	FdbAppend(linkName string, dst net.IP) error
+	// FdbDel deletes the default forwarding entry
+	// to the destination.
+	FdbDel(linkName string, dst net.IP) error
+	// LinkSubscribe sends changes of interfaces to updates until
+	// done is closed, after which updates is closed.
+	LinkSubscribe(updates chan<- LinkUpdate, done <-chan struct{}) error
+}
+
+// Route is an IPv4 route.
+type Route struct {
+	Dst *net.IPNet
+	// Gateway, if the route is via one.
+	Gw net.IP
+	// Name of the outgoing interface, if the route is through one.
+	LinkName string
+	// Preferred source address, if any.
+	Src net.IP
+	// Whether the gateway is assumed to be directly reachable
+	// through the interface, even if no subnet on it says so.
+	OnLink bool
+}
+
+// String returns the route the way `ip route` shows it.
+func (r Route) String() string {
+	s := r.Dst.String()
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	if r.LinkName != "" {
+		s += " dev " + r.LinkName
+	}
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	if r.OnLink {
+		s += " onlink"
+	}
+	return s
+}
+
+// Equal returns true if the routes are the same.
+func (r Route) Equal(other Route) bool {
+	return r.Dst.String() == other.Dst.String() &&
+		r.Gw.Equal(other.Gw) &&
+		r.LinkName == other.LinkName &&
+		r.Src.Equal(other.Src) &&
+		r.OnLink == other.OnLink
+}
+
+// Link is a network interface.
+type Link struct {
+	Name  string
+	Index int
+	Up    bool
+}
+
+// Addr is an address of an interface.
+type Addr struct {
+	*net.IPNet
+	LinkName string
+	// Label of the address, which is the name of the
+	// interface unless given another one.
+	Label string
+}
+
+// Vxlan is a VXLAN interface.
+type Vxlan struct {
+	Name string
+	// VXLAN network identifier.
+	VNI int
+	// UDP port of the tunnel.
+	Port int
+	// Address to send tunneled packets from.
+	Local net.IP
+}
+
+// LinkUpdate is a change of an interface: it was created,
+// its state changed, or it was deleted.
+type LinkUpdate struct {
+	Link
+	Deleted bool
+}
+
+// Error is returned by Netlink operations that the kernel refused.
+type Error struct {
+	// Operation, such as "route add".
+	Op string
+	// Route or interface the operation was on.
+	Target string
+	Errno  syscall.Errno
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("netlink %s %s: %s", e.Op, e.Target, e.Errno)
+}
+
+// IsExist returns true if err is caused by what
+// was to be created already existing.
+func IsExist(err error) bool {
+	nlErr, ok := err.(Error)
+	return ok && nlErr.Errno == syscall.EEXIST
+}
+
+// IsNotExist returns true if err is caused by the
+// route or interface not existing.
+func IsNotExist(err error) bool {
+	nlErr, ok := err.(Error)
+	return ok && (nlErr.Errno == syscall.ENOENT || nlErr.Errno == syscall.ESRCH || nlErr.Errno == syscall.ENODEV)
+}
+
+// EnsureRoute makes sure the route exists, replacing any
+// different route to the same destination.
+func EnsureRoute(nl Netlink, route Route) error {
+	routes, err := nl.RouteList(route.Dst)
+	if err != nil {
+		return err
+	}
+	for _, existing := range routes {
+		if existing.Equal(route) {
+			return nil
+		}
+	}
+	return nl.RouteReplace(route)
+}
+
+// EnsureVxlan makes sure the VXLAN interface exists and is up.
+// An existing interface with the name is assumed to be it.
+func EnsureVxlan(nl Netlink, vxlan Vxlan) error {
+	_, err := nl.LinkByName(vxlan.Name)
+	if IsNotExist(err) {
+		err = nl.VxlanAdd(vxlan)
+	}
+	if err != nil {
+		return err
+	}
+	return nl.LinkSetUp(vxlan.Name)
+}
+
+// EnsureFdb makes sure the VXLAN interface has default
+// forwarding entries to exactly the destinations.
+func EnsureFdb(nl Netlink, linkName string, dsts []net.IP) error {
+	existing, err := nl.FdbList(linkName)
+	if err != nil {
+		return err
+	}
+	for _, dst := range dsts {
+		if !containsIP(existing, dst) {
+			if err := nl.FdbAppend(linkName, dst); err != nil && !IsExist(err) {
+				return err
+			}
+		}
+	}
+	for _, dst := range existing {
+		if !containsIP(dsts, dst) {
+			if err := nl.FdbDel(linkName, dst); err != nil && !IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureLinkDeleted makes sure the interface does not exist.
+func EnsureLinkDeleted(nl Netlink, name string) error {
+	err := nl.LinkDel(name)
+	if IsNotExist(err) {
+		return nil
+	}
+	return err
+}
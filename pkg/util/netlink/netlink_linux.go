@@ -0,0 +1,741 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Attributes of link info not defined in syscall.
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
+
+	// Multicast group of link notifications.
+	rtmgrpLink = 1
+
+	// Attributes of VXLAN link info data.
+	iflaVxlanID       = 1
+	iflaVxlanLocal    = 4
+	iflaVxlanLearning = 7
+	iflaVxlanPort     = 15
+
+	// Neighbor message and its attributes.
+	sizeofNdMsg  = 12
+	ndaDst       = 1
+	ndaLladdr    = 2
+	ntfSelf      = 0x02
+	nudPermanent = 0x80
+
+	rtnhFOnlink = 4
+
+	iflaNetNsFd = 28
+)
+
+// DefaultNetlink implements Netlink using netlink sockets.
+type DefaultNetlink struct{}
+
+// Sequence number of the last request sent.
+var lastSeq uint32
+
+// nativeEndian is the byte order of netlink messages,
+// which is that of the host.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// request is a netlink request being built.
+type request struct {
+	data []byte
+	seq  uint32
+}
+
+func newRequest(msgType uint16, flags uint16) *request {
+	r := &request{data: make([]byte, syscall.SizeofNlMsghdr), seq: atomic.AddUint32(&lastSeq, 1)}
+	nativeEndian.PutUint16(r.data[4:6], msgType)
+	nativeEndian.PutUint16(r.data[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(r.data[8:12], r.seq)
+	return r
+}
+
+// addRtMsg adds the route message header.
+func (r *request) addRtMsg(dstLen int, protocol uint8, scope uint8, routeType uint8, flags uint32) {
+	r.data = append(r.data, syscall.AF_INET, uint8(dstLen), 0, 0, syscall.RT_TABLE_MAIN, protocol, scope, routeType)
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, flags)
+	r.data = append(r.data, b...)
+}
+
+// addNdMsg adds the neighbor message header
+// of a permanent forwarding entry.
+func (r *request) addNdMsg(index int) {
+	b := make([]byte, sizeofNdMsg)
+	b[0] = syscall.AF_BRIDGE
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	nativeEndian.PutUint16(b[8:10], nudPermanent)
+	b[10] = ntfSelf
+	r.data = append(r.data, b...)
+}
+
+// addIfInfoMsg adds the link message header.
+func (r *request) addIfInfoMsg(index int, flags uint32, change uint32) {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	nativeEndian.PutUint32(b[8:12], flags)
+	nativeEndian.PutUint32(b[12:16], change)
+	r.data = append(r.data, b...)
+}
+
+// addAttr adds an attribute, padded to alignment.
+func (r *request) addAttr(attrType uint16, value []byte) {
+	b := make([]byte, syscall.SizeofRtAttr)
+	nativeEndian.PutUint16(b[0:2], uint16(syscall.SizeofRtAttr+len(value)))
+	nativeEndian.PutUint16(b[2:4], attrType)
+	r.data = append(r.data, b...)
+	r.data = append(r.data, value...)
+	for len(r.data)%syscall.NLMSG_ALIGNTO != 0 {
+		r.data = append(r.data, 0)
+	}
+}
+
+// startNested starts an attribute containing other attributes,
+// returning its offset for endNested.
+func (r *request) startNested(attrType uint16) int {
+	start := len(r.data)
+	r.addAttr(attrType, nil)
+	return start
+}
+
+func (r *request) endNested(start int) {
+	nativeEndian.PutUint16(r.data[start:start+2], uint16(len(r.data)-start))
+}
+
+func (r *request) addUint32Attr(attrType uint16, value uint32) {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, value)
+	r.addAttr(attrType, b)
+}
+
+func (r *request) addStringAttr(attrType uint16, value string) {
+	r.addAttr(attrType, append([]byte(value), 0))
+}
+
+// execute sends the request and waits for the acknowledgement.
+func (r *request) execute(op string, target string) error {
+	_, err := r.send(op, target)
+	return err
+}
+
+// send sends the request and returns messages received in
+// response until the acknowledgement, or the end of a dump.
+func (r *request) send(op string, target string) ([]syscall.NetlinkMessage, error) {
+	nativeEndian.PutUint32(r.data[0:4], uint32(len(r.data)))
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Sendto(fd, r.data, 0, kernel)
+	if err != nil {
+		return nil, err
+	}
+	var received []syscall.NetlinkMessage
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		// Messages refer to the buffer, which is reused.
+		msgs, err := syscall.ParseNetlinkMessage(append([]byte{}, buf[:n]...))
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != r.seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return received, nil
+			case syscall.NLMSG_ERROR:
+				errno := int32(nativeEndian.Uint32(msg.Data[0:4]))
+				if errno == 0 {
+					return received, nil
+				}
+				return nil, Error{Op: op, Target: target, Errno: syscall.Errno(-errno)}
+			default:
+				received = append(received, msg)
+			}
+		}
+	}
+}
+
+// routeRequest builds a request to add, replace or delete the route.
+func routeRequest(msgType uint16, flags uint16, route Route) (*request, error) {
+	r := newRequest(msgType, flags)
+	dstLen, _ := route.Dst.Mask.Size()
+	if msgType == syscall.RTM_DELROUTE {
+		r.addRtMsg(dstLen, 0, syscall.RT_SCOPE_NOWHERE, 0, 0)
+	} else {
+		scope := uint8(syscall.RT_SCOPE_UNIVERSE)
+		if route.Gw == nil {
+			scope = syscall.RT_SCOPE_LINK
+		}
+		var flags uint32
+		if route.OnLink {
+			flags = rtnhFOnlink
+		}
+		r.addRtMsg(dstLen, syscall.RTPROT_BOOT, scope, syscall.RTN_UNICAST, flags)
+	}
+	r.addAttr(syscall.RTA_DST, route.Dst.IP.To4())
+	if route.Gw != nil {
+		r.addAttr(syscall.RTA_GATEWAY, route.Gw.To4())
+	}
+	if route.LinkName != "" {
+		index, err := linkIndex(route.LinkName)
+		if err != nil {
+			return nil, err
+		}
+		r.addUint32Attr(syscall.RTA_OIF, uint32(index))
+	}
+	if route.Src != nil {
+		r.addAttr(syscall.RTA_PREFSRC, route.Src.To4())
+	}
+	return r, nil
+}
+
+// RouteList implements Netlink.RouteList.
+func (DefaultNetlink) RouteList(dst *net.IPNet) ([]Route, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	var routes []Route
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rtmsg := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		if rtmsg.Table != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		if dst != nil {
+			if dstLen, _ := dst.Mask.Size(); int(rtmsg.Dst_len) != dstLen {
+				continue
+			}
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, err
+		}
+		route := Route{
+			Dst:    &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(int(rtmsg.Dst_len), 32)},
+			OnLink: rtmsg.Flags&rtnhFOnlink != 0,
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				route.Dst.IP = net.IP(attr.Value)
+			case syscall.RTA_GATEWAY:
+				route.Gw = net.IP(attr.Value)
+			case syscall.RTA_PREFSRC:
+				route.Src = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				iface, err := net.InterfaceByIndex(int(nativeEndian.Uint32(attr.Value)))
+				if err == nil {
+					route.LinkName = iface.Name
+				}
+			}
+		}
+		if dst == nil || route.Dst.IP.Equal(dst.IP) {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// RouteAdd implements Netlink.RouteAdd.
+func (DefaultNetlink) RouteAdd(route Route) error {
+	r, err := routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, route)
+	if err != nil {
+		return err
+	}
+	return r.execute("route add", route.String())
+}
+
+// RouteReplace implements Netlink.RouteReplace.
+func (DefaultNetlink) RouteReplace(route Route) error {
+	r, err := routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, route)
+	if err != nil {
+		return err
+	}
+	return r.execute("route replace", route.String())
+}
+
+// RouteDel implements Netlink.RouteDel.
+func (DefaultNetlink) RouteDel(route Route) error {
+	r, err := routeRequest(syscall.RTM_DELROUTE, 0, Route{Dst: route.Dst})
+	if err != nil {
+		return err
+	}
+	return r.execute("route del", route.String())
+}
+
+// AddrList implements Netlink.AddrList.
+func (DefaultNetlink) AddrList() ([]Addr, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []Addr
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifaddr := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		addr := Addr{}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				if ip == nil {
+					ip = net.IP(attr.Value)
+				}
+			case syscall.IFA_LOCAL:
+				// Differs from IFA_ADDRESS on point-to-point
+				// interfaces, where that is the peer's.
+				ip = net.IP(attr.Value)
+			case syscall.IFA_LABEL:
+				addr.Label = strings.TrimRight(string(attr.Value), "\x00")
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		addr.IPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(int(ifaddr.Prefixlen), 8*net.IPv4len)}
+		if iface, err := net.InterfaceByIndex(int(ifaddr.Index)); err == nil {
+			addr.LinkName = iface.Name
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// linkIndex returns the index of the interface.
+func linkIndex(name string) (int, error) {
+	link, err := DefaultNetlink{}.LinkByName(name)
+	return link.Index, err
+}
+
+// LinkByName implements Netlink.LinkByName.
+func (DefaultNetlink) LinkByName(name string) (Link, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such network interface") {
+			return Link{}, Error{Op: "link show", Target: name, Errno: syscall.ENODEV}
+		}
+		return Link{}, err
+	}
+	return Link{Name: iface.Name, Index: iface.Index, Up: iface.Flags&net.FlagUp != 0}, nil
+}
+
+// LinkSetUp implements Netlink.LinkSetUp.
+func (DefaultNetlink) LinkSetUp(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	r := newRequest(syscall.RTM_NEWLINK, 0)
+	r.addIfInfoMsg(index, syscall.IFF_UP, syscall.IFF_UP)
+	return r.execute("link set up", name)
+}
+
+// LinkDel implements Netlink.LinkDel.
+func (DefaultNetlink) LinkDel(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	r := newRequest(syscall.RTM_DELLINK, 0)
+	r.addIfInfoMsg(index, 0, 0)
+	return r.execute("link del", name)
+}
+
+// VxlanAdd implements Netlink.VxlanAdd.
+func (DefaultNetlink) VxlanAdd(vxlan Vxlan) error {
+	r := newRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	r.addIfInfoMsg(0, 0, 0)
+	r.addStringAttr(syscall.IFLA_IFNAME, vxlan.Name)
+	linkInfo := r.startNested(syscall.IFLA_LINKINFO)
+	r.addAttr(iflaInfoKind, []byte("vxlan"))
+	infoData := r.startNested(iflaInfoData)
+	r.addUint32Attr(iflaVxlanID, uint32(vxlan.VNI))
+	if vxlan.Local != nil {
+		r.addAttr(iflaVxlanLocal, vxlan.Local.To4())
+	}
+	r.addAttr(iflaVxlanLearning, []byte{1})
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(vxlan.Port))
+	r.addAttr(iflaVxlanPort, port)
+	r.endNested(infoData)
+	r.endNested(linkInfo)
+	return r.execute("link add vxlan", vxlan.Name)
+}
+
+// FdbList implements Netlink.FdbList.
+func (DefaultNetlink) FdbList(linkName string) ([]net.IP, error) {
+	index, err := linkIndex(linkName)
+	if err != nil {
+		return nil, err
+	}
+	r := newRequest(syscall.RTM_GETNEIGH, syscall.NLM_F_DUMP)
+	r.addNdMsg(0)
+	msgs, err := r.send("fdb show", linkName)
+	if err != nil {
+		return nil, err
+	}
+	var dsts []net.IP
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdMsg {
+			continue
+		}
+		if int(nativeEndian.Uint32(msg.Data[4:8])) != index {
+			continue
+		}
+		var lladdr, dst []byte
+		for _, attr := range parseAttrs(msg.Data[sizeofNdMsg:]) {
+			switch attr.Attr.Type {
+			case ndaLladdr:
+				lladdr = attr.Value
+			case ndaDst:
+				dst = attr.Value
+			}
+		}
+		if len(dst) == net.IPv4len && isZero(lladdr) {
+			dsts = append(dsts, net.IP(dst))
+		}
+	}
+	return dsts, nil
+}
+
+// parseAttrs parses attributes of messages which
+// syscall.ParseNetlinkRouteAttr does not know.
+func parseAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var attrs []syscall.NetlinkRouteAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		attrLen := int(nativeEndian.Uint16(b[0:2]))
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(b) {
+			break
+		}
+		attr := syscall.NetlinkRouteAttr{Value: b[syscall.SizeofRtAttr:attrLen]}
+		attr.Attr.Len = uint16(attrLen)
+		attr.Attr.Type = nativeEndian.Uint16(b[2:4])
+		attrs = append(attrs, attr)
+		alignedLen := (attrLen + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+		if alignedLen > len(b) {
+			break
+		}
+		b = b[alignedLen:]
+	}
+	return attrs
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// fdbRequest builds a request to add or delete
+// the default forwarding entry to dst.
+func fdbRequest(msgType uint16, flags uint16, linkName string, dst net.IP) (*request, error) {
+	index, err := linkIndex(linkName)
+	if err != nil {
+		return nil, err
+	}
+	r := newRequest(msgType, flags)
+	r.addNdMsg(index)
+	r.addAttr(ndaLladdr, make([]byte, 6))
+	r.addAttr(ndaDst, dst.To4())
+	return r, nil
+}
+
+// FdbAppend implements Netlink.FdbAppend.
+func (DefaultNetlink) FdbAppend(linkName string, dst net.IP) error {
+	r, err := fdbRequest(syscall.RTM_NEWNEIGH, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND, linkName, dst)
+	if err != nil {
+		return err
+	}
+	return r.execute("fdb append", dst.String()+" dev "+linkName)
+}
+
+// FdbDel implements Netlink.FdbDel.
+func (DefaultNetlink) FdbDel(linkName string, dst net.IP) error {
+	r, err := fdbRequest(syscall.RTM_DELNEIGH, 0, linkName, dst)
+	if err != nil {
+		return err
+	}
+	return r.execute("fdb del", dst.String()+" dev "+linkName)
+}
+
+// LinkSubscribe implements Netlink.LinkSubscribe.
+func (DefaultNetlink) LinkSubscribe(updates chan<- LinkUpdate, done <-chan struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink})
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	// Receiving cannot be interrupted, so time out
+	// periodically to notice that we are done.
+	timeout := syscall.Timeval{Sec: 1}
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go func() {
+		defer close(updates)
+		defer syscall.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, msg := range msgs {
+				update, ok := parseLinkUpdate(msg)
+				if !ok {
+					continue
+				}
+				select {
+				case updates <- update:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// parseLinkUpdate parses a link message, returning
+// false if it is not one.
+func parseLinkUpdate(msg syscall.NetlinkMessage) (LinkUpdate, bool) {
+	if msg.Header.Type != syscall.RTM_NEWLINK && msg.Header.Type != syscall.RTM_DELLINK {
+		return LinkUpdate{}, false
+	}
+	if len(msg.Data) < syscall.SizeofIfInfomsg {
+		return LinkUpdate{}, false
+	}
+	ifinfo := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+	update := LinkUpdate{
+		Link: Link{
+			Index: int(ifinfo.Index),
+			Up:    ifinfo.Flags&syscall.IFF_UP != 0,
+		},
+		Deleted: msg.Header.Type == syscall.RTM_DELLINK,
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+	if err != nil {
+		return LinkUpdate{}, false
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFLA_IFNAME {
+			update.Name = strings.TrimRight(string(attr.Value), "\x00")
+		}
+	}
+	return update, true
+}
+
+// VethAdd implements Netlink.VethAdd.
+func (DefaultNetlink) VethAdd(name string, peer string) error {
+	r := newRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	r.addIfInfoMsg(0, 0, 0)
+	r.addStringAttr(syscall.IFLA_IFNAME, name)
+	linkInfo := r.startNested(syscall.IFLA_LINKINFO)
+	r.addAttr(iflaInfoKind, []byte("veth"))
+	infoData := r.startNested(iflaInfoData)
+	peerInfo := r.startNested(vethInfoPeer)
+	r.addIfInfoMsg(0, 0, 0)
+	r.addStringAttr(syscall.IFLA_IFNAME, peer)
+	r.endNested(peerInfo)
+	r.endNested(infoData)
+	r.endNested(linkInfo)
+	return r.execute("link add veth", name+" peer "+peer)
+}
+
+// LinkSetName implements Netlink.LinkSetName.
+func (DefaultNetlink) LinkSetName(name string, newName string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	r := newRequest(syscall.RTM_NEWLINK, 0)
+	r.addIfInfoMsg(index, 0, 0)
+	r.addStringAttr(syscall.IFLA_IFNAME, newName)
+	return r.execute("link set name", name+" "+newName)
+}
+
+// LinkSetNs implements Netlink.LinkSetNs.
+func (DefaultNetlink) LinkSetNs(name string, netns string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	ns, err := os.Open(netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	r := newRequest(syscall.RTM_NEWLINK, 0)
+	r.addIfInfoMsg(index, 0, 0)
+	r.addUint32Attr(iflaNetNsFd, uint32(ns.Fd()))
+	return r.execute("link set netns", name+" "+netns)
+}
+
+// AddrAdd implements Netlink.AddrAdd.
+func (DefaultNetlink) AddrAdd(linkName string, addr *net.IPNet) error {
+	index, err := linkIndex(linkName)
+	if err != nil {
+		return err
+	}
+	r := newRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	prefixLen, _ := addr.Mask.Size()
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = syscall.AF_INET
+	b[1] = uint8(prefixLen)
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	r.data = append(r.data, b...)
+	r.addAttr(syscall.IFA_LOCAL, addr.IP.To4())
+	r.addAttr(syscall.IFA_ADDRESS, addr.IP.To4())
+	return r.execute("addr add", addr.String()+" dev "+linkName)
+}
+
+// InNetns implements Netlink.InNetns. Network namespace is a
+// property of an OS thread, so f runs with the goroutine locked
+// to a thread that is switched to the namespace for the duration.
+func (DefaultNetlink) InNetns(netns string, f func() error) error {
+	ns, err := os.Open(netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	runtime.LockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := setns(ns.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return Error{Op: "netns enter", Target: netns, Errno: err.(syscall.Errno)}
+	}
+	err = f()
+	if err := setns(origin.Fd()); err != nil {
+		// Leave the thread locked: it is stuck in the namespace,
+		// and the runtime terminates it when the goroutine exits.
+		return Error{Op: "netns exit", Target: netns, Errno: err.(syscall.Errno)}
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// setnsTrap returns the number of the setns system call,
+// which syscall does not define on all architectures.
+func setnsTrap() uintptr {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 308
+	case "arm64", "riscv64", "loong64":
+		return 268
+	case "386":
+		return 346
+	case "arm":
+		return 375
+	case "ppc64", "ppc64le":
+		return 350
+	case "s390x":
+		return 339
+	case "mips", "mipsle":
+		return 4344
+	case "mips64", "mips64le":
+		return 5303
+	}
+	return 0
+}
+
+func setns(fd uintptr) error {
+	trap := setnsTrap()
+	if trap == 0 {
+		return syscall.ENOSYS
+	}
+	_, _, errno := syscall.RawSyscall(trap, fd, syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build !linux
+// +build !linux
+
+package netlink
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultNetlink implements Netlink; netlink is only
+// available on Linux, so everything fails elsewhere.
+type DefaultNetlink struct{}
+
+var errNotSupported = errors.New("netlink is only supported on Linux")
+
+func (DefaultNetlink) RouteList(dst *net.IPNet) ([]Route, error) { return nil, errNotSupported }
+func (DefaultNetlink) RouteAdd(route Route) error                { return errNotSupported }
+func (DefaultNetlink) RouteReplace(route Route) error            { return errNotSupported }
+func (DefaultNetlink) RouteDel(route Route) error                { return errNotSupported }
+func (DefaultNetlink) AddrList() ([]Addr, error)                 { return nil, errNotSupported }
+func (DefaultNetlink) LinkByName(name string) (Link, error)      { return Link{}, errNotSupported }
+func (DefaultNetlink) LinkSetUp(name string) error               { return errNotSupported }
+func (DefaultNetlink) LinkDel(name string) error                 { return errNotSupported }
+func (DefaultNetlink) VethAdd(name string, peer string) error    { return errNotSupported }
+func (DefaultNetlink) LinkSetName(name string, newName string) error {
+	return errNotSupported
+}
+func (DefaultNetlink) LinkSetNs(name string, netns string) error      { return errNotSupported }
+func (DefaultNetlink) AddrAdd(linkName string, addr *net.IPNet) error { return errNotSupported }
+func (DefaultNetlink) InNetns(netns string, f func() error) error     { return errNotSupported }
+func (DefaultNetlink) LinkSubscribe(updates chan<- LinkUpdate, done <-chan struct{}) error {
+	return errNotSupported
+}
+func (DefaultNetlink) VxlanAdd(vxlan Vxlan) error                  { return errNotSupported }
+func (DefaultNetlink) FdbList(linkName string) ([]net.IP, error)   { return nil, errNotSupported }
+func (DefaultNetlink) FdbAppend(linkName string, dst net.IP) error { return errNotSupported }
+func (DefaultNetlink) FdbDel(linkName string, dst net.IP) error    { return errNotSupported }
@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package netlink
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEnsureRoute(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	nl := &FakeNetlink{}
+	route := Route{Dst: dst, Gw: net.ParseIP("192.168.0.1")}
+	for i := 0; i < 2; i++ {
+		if err := EnsureRoute(nl, route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	route.Gw = net.ParseIP("192.168.0.2")
+	if err := EnsureRoute(nl, route); err != nil {
+		t.Fatal(err)
+	}
+	expect := "route replace 10.1.0.0/16 via 192.168.0.1\nroute replace 10.1.0.0/16 via 192.168.0.2"
+	if got := strings.Join(nl.Commands, "\n"); got != expect {
+		t.Errorf("Expected\n%s\ngot\n%s", expect, got)
+	}
+	if err := nl.RouteAdd(route); !IsExist(err) {
+		t.Errorf("Expected route to exist, got %v", err)
+	}
+}
+
+func TestEnsureLinkDeleted(t *testing.T) {
+	nl := &FakeNetlink{}
+	if err := nl.VethAdd("veth0", "veth1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := EnsureLinkDeleted(nl, "veth0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := nl.LinkByName("veth0"); !IsNotExist(err) {
+		t.Errorf("Expected veth0 not to exist, got %v", err)
+	}
+	nl.Error = Error{Op: "link del", Target: "veth1", Errno: syscall.EPERM}
+	if err := EnsureLinkDeleted(nl, "veth1"); err == nil || IsNotExist(err) {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"syscall"
 )
 
 // FakeFile implements OSFile.
@@ -43,6 +44,8 @@ func (f *FakeFile) Write(p []byte) (ret int, err error) {
 type FakeOS struct {
 	FakeData string
 	FakeFile *FakeFile
+	// Signals sent, in order.
+	Signals []syscall.Signal
 }
 
 // open returns a FakeFile stuffed with fake data
@@ -63,3 +66,9 @@ func (o *FakeOS) AppendFile(name string) (OSFile, error) {
 func (o *FakeOS) CreateIfMissing(name string) error {
 	return nil
 }
+
+// Signal records the signal.
+func (o *FakeOS) Signal(pid int, sig syscall.Signal) error {
+	o.Signals = append(o.Signals, sig)
+	return nil
+}
@@ -18,6 +18,7 @@ package os
 import (
 	"io"
 	"os"
+	"syscall"
 )
 
 // OS interface is a facade to standard lib os.
@@ -25,6 +26,9 @@ type OS interface {
 	Open(name string) (OSFile, error)
 	AppendFile(name string) (OSFile, error)
 	CreateIfMissing(name string) error
+	// Signal sends the signal to the process;
+	// signal 0 only checks that the process exists.
+	Signal(pid int, sig syscall.Signal) error
 }
 
 // OSFile interface is a facade to os.File
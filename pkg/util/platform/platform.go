@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package platform
+
+import (
+	"errors"
+
+	utilexec "github.com/romana/core/pkg/util/exec"
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	utilos "github.com/romana/core/pkg/util/os"
+)
+
+// ErrNotSupported is returned by the stub platform for
+// everything that can only be done on Linux.
+var ErrNotSupported = errors.New("programming the dataplane is only supported on Linux")
+
+// Platform groups interfaces to the operating system used to
+// program the dataplane: running commands (iptables, ipset,
+// sysctl, dnsmasq), files and signals, and routing netlink.
+type Platform struct {
+	Executor utilexec.Executable
+	OS       utilos.OS
+	Netlink  utilnetlink.Netlink
+}
+
+// Fake returns a platform of fakes, which record what is done
+// with them instead of doing it, for testing.
+func Fake() Platform {
+	return Platform{
+		Executor: &utilexec.FakeExecutor{},
+		OS:       &utilos.FakeOS{},
+		Netlink:  &utilnetlink.FakeNetlink{},
+	}
+}
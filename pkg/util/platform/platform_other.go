@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build !linux
+// +build !linux
+
+package platform
+
+import (
+	utilnetlink "github.com/romana/core/pkg/util/netlink"
+	utilos "github.com/romana/core/pkg/util/os"
+)
+
+// Supported is true if the dataplane can be programmed
+// on the platform the program is built for.
+const Supported = false
+
+// Default returns the stub platform, on which commands
+// programming the dataplane, netlink and signals all fail
+// with ErrNotSupported.
+func Default() Platform {
+	return Platform{
+		Executor: unsupportedExecutor{},
+		OS:       new(utilos.DefaultOS),
+		Netlink:  new(utilnetlink.DefaultNetlink),
+	}
+}
+
+// unsupportedExecutor implements utilexec.Executable
+// by failing to execute anything.
+type unsupportedExecutor struct{}
+
+func (unsupportedExecutor) Exec(cmd string, args []string) ([]byte, error) {
+	return nil, ErrNotSupported
+}
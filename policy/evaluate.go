@@ -0,0 +1,213 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// evaluateFlow handles POST to /policies/evaluate. It evaluates
+// the stored policies against the flow the way agents enforce them,
+// without touching any host, and returns the verdict.
+func (policy *PolicySvc) evaluateFlow(input interface{}, ctx common.RestContext) (interface{}, error) {
+	flow := input.(*common.PolicyFlow)
+	flow.Protocol = strings.ToLower(strings.TrimSpace(flow.Protocol))
+	switch flow.Protocol {
+	case "tcp", "udp", "icmp":
+	default:
+		return nil, common.NewError400(fmt.Sprintf("Invalid protocol '%s', expected tcp, udp or icmp.", flow.Protocol))
+	}
+	for _, ip := range []string{flow.SrcIP, flow.DstIP} {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return nil, common.NewError400(fmt.Sprintf("Invalid address %s.", ip))
+		}
+	}
+	for _, endpoint := range []*common.Endpoint{&flow.Source, &flow.Destination} {
+		if !hasTenant(*endpoint) {
+			continue
+		}
+		if err := policy.augmentEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+	}
+	policies, err := policy.store.ListPolicies(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	evaluation := evaluatePolicies(policies, *flow)
+	log.Printf("evaluateFlow(): %s: %s", evaluation.Verdict, evaluation.Reason)
+	return evaluation, nil
+}
+
+// hasTenant returns true if the endpoint names a tenant.
+func hasTenant(endpoint common.Endpoint) bool {
+	return endpoint.TenantNetworkID != nil || endpoint.TenantID != 0 ||
+		endpoint.TenantName != "" || endpoint.TenantExternalID != ""
+}
+
+// evaluatePolicies returns the verdict of the (augmented) policies on
+// the flow. Egress policies applied to the source are checked first:
+// the first one matching the flow drops it or lets it through, and
+// with no match the flow is dropped. Then ingress policies applied
+// to the destination are checked, the first one matching deciding.
+// With none matching, the default isolation of tenants and segments
+// applies.
+func evaluatePolicies(policies []common.Policy, flow common.PolicyFlow) common.PolicyEvaluation {
+	srcIP, dstIP := net.ParseIP(flow.SrcIP), net.ParseIP(flow.DstIP)
+	var egress, ingress []common.Policy
+	for _, p := range policies {
+		if p.Direction == common.PolicyDirectionEgress {
+			if appliesTo(p, flow.Source) {
+				egress = append(egress, p)
+			}
+		} else if appliesTo(p, flow.Destination) {
+			ingress = append(ingress, p)
+		}
+	}
+	sort.Sort(common.PoliciesByPrecedence(egress))
+	sort.Sort(common.PoliciesByPrecedence(ingress))
+
+	evaluation := common.PolicyEvaluation{}
+	if len(egress) > 0 {
+		p, ok := firstMatching(egress, flow, flow.Destination, dstIP)
+		if !ok {
+			evaluation.Verdict = common.PolicyActionDeny
+			evaluation.Reason = "Egress policies are applied to the source, none of them allows the flow."
+			return evaluation
+		}
+		evaluation.Policies = append(evaluation.Policies, p)
+		if p.IsDeny() {
+			evaluation.Verdict = common.PolicyActionDeny
+			evaluation.Reason = fmt.Sprintf("Egress policy %d (%s) denies the flow.", p.ID, p.Name)
+			return evaluation
+		}
+	}
+	p, ok := firstMatching(ingress, flow, flow.Source, srcIP)
+	if !ok {
+		evaluation.Verdict = common.PolicyVerdictNone
+		evaluation.Reason = "No ingress policy of the destination matches the flow, the default isolation of tenants and segments applies."
+		return evaluation
+	}
+	evaluation.Policies = append(evaluation.Policies, p)
+	evaluation.Verdict = common.PolicyActionAllow
+	if p.IsDeny() {
+		evaluation.Verdict = common.PolicyActionDeny
+	}
+	evaluation.Reason = fmt.Sprintf("Ingress policy %d (%s) %ss the flow.", p.ID, p.Name, evaluation.Verdict)
+	return evaluation
+}
+
+// firstMatching returns the first of the policies with a peer
+// matching the other end of the flow and a rule matching the flow.
+func firstMatching(policies []common.Policy, flow common.PolicyFlow, peer common.Endpoint, peerIP net.IP) (common.Policy, bool) {
+	for _, p := range policies {
+		peerMatches := false
+		for _, endpoint := range p.Peers {
+			if endpointMatches(endpoint, peer, peerIP) {
+				peerMatches = true
+				break
+			}
+		}
+		if !peerMatches {
+			continue
+		}
+		for _, rule := range p.Rules {
+			if ruleMatches(rule, flow) {
+				return p, true
+			}
+		}
+	}
+	return common.Policy{}, false
+}
+
+// appliesTo returns true if the policy is applied to the endpoint.
+func appliesTo(p common.Policy, endpoint common.Endpoint) bool {
+	for _, target := range p.AppliedTo {
+		if endpointMatches(target, endpoint, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointMatches returns true if the policy endpoint matches
+// the endpoint with the address (if known).
+func endpointMatches(policyEndpoint common.Endpoint, endpoint common.Endpoint, ip net.IP) bool {
+	switch {
+	case policyEndpoint.Peer == common.Wildcard:
+		return true
+	case policyEndpoint.Cidr != "":
+		_, cidr, err := net.ParseCIDR(policyEndpoint.Cidr)
+		if err != nil || ip == nil || !cidr.Contains(ip) {
+			return false
+		}
+		for _, except := range policyEndpoint.Except {
+			if _, exceptNet, err := net.ParseCIDR(except); err == nil && exceptNet.Contains(ip) {
+				return false
+			}
+		}
+		return true
+	case policyEndpoint.TenantNetworkID != nil:
+		if endpoint.TenantNetworkID == nil || *endpoint.TenantNetworkID != *policyEndpoint.TenantNetworkID {
+			return false
+		}
+		if policyEndpoint.SegmentNetworkID == nil {
+			return true
+		}
+		return endpoint.SegmentNetworkID != nil && *endpoint.SegmentNetworkID == *policyEndpoint.SegmentNetworkID
+	}
+	return false
+}
+
+// ruleMatches returns true if the rule matches protocol
+// and destination port or ICMP type and code of the flow.
+func ruleMatches(rule common.Rule, flow common.PolicyFlow) bool {
+	proto := strings.ToLower(rule.Protocol)
+	if proto == common.Wildcard {
+		return true
+	}
+	if proto != flow.Protocol {
+		return false
+	}
+	if proto == "icmp" {
+		if rule.IcmpTypeName != "" {
+			_, icmpType, icmpCode, ok := common.IcmpTypeByName(rule.IcmpTypeName)
+			return ok && icmpType == flow.IcmpType &&
+				(icmpCode == common.IcmpAnyCode || uint(icmpCode) == flow.IcmpCode)
+		}
+		return (rule.IcmpType == 0 || rule.IcmpType == flow.IcmpType) &&
+			(rule.IcmpCode == 0 || rule.IcmpCode == flow.IcmpCode)
+	}
+	if len(rule.Ports) == 0 && len(rule.PortRanges) == 0 {
+		return true
+	}
+	for _, port := range rule.Ports {
+		if port == flow.DstPort {
+			return true
+		}
+	}
+	for _, portRange := range rule.PortRanges {
+		if flow.DstPort >= portRange[0] && flow.DstPort <= portRange[1] {
+			return true
+		}
+	}
+	return false
+}
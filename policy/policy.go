@@ -16,6 +16,7 @@
 package policy
 
 import (
+	"context"
 	"fmt"
 	"github.com/romana/core/common"
 	"github.com/romana/core/tenant"
@@ -28,16 +29,26 @@ import (
 type PolicySvc struct {
 	client *common.RestClient
 	config common.ServiceConfig
-	store  policyStore
+	store  Store
+	// Bus to publish policy events on, or nil.
+	bus common.EventBus
+	// limiter limits policies added by each tenant, or is nil.
+	limiter *common.RateLimiter
 }
 
 const (
 	infoListPath       = "/info"
 	findPath           = "/find"
 	policiesPath       = "/policies"
+	portListsPath      = "/portlists"
+	templatesPath      = "/templates"
 	policyNameQueryVar = "policyName"
 )
 
+// DefaultKeepRevisions is how many revisions of each policy the
+// compact_history maintenance job keeps unless configured otherwise.
+const DefaultKeepRevisions = 100
+
 func (policy *PolicySvc) Routes() common.Routes {
 	routes := common.Routes{
 		common.Route{
@@ -46,6 +57,21 @@ func (policy *PolicySvc) Routes() common.Routes {
 			Handler:         policy.addPolicy,
 			MakeMessage:     func() interface{} { return &common.Policy{} },
 			UseRequestToken: false,
+			Idempotent:      true,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         policiesPath + "/validate",
+			Handler:         policy.validatePolicy,
+			MakeMessage:     func() interface{} { return &common.Policy{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         policiesPath + "/evaluate",
+			Handler:         policy.evaluateFlow,
+			MakeMessage:     func() interface{} { return &common.PolicyFlow{} },
+			UseRequestToken: false,
 		},
 		common.Route{
 			Method:          "DELETE",
@@ -68,6 +94,62 @@ func (policy *PolicySvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         policiesPath + "/status",
+			Handler:         policy.reportStatus,
+			MakeMessage:     func() interface{} { return &common.HostPolicyStatus{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         policiesPath + "/status",
+			Handler:         policy.listRollouts,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         policiesPath + "/{policyID}/status",
+			Handler:         policy.getRollout,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         policiesPath + "/{policyID}",
+			Handler:         policy.updatePolicy,
+			MakeMessage:     func() interface{} { return &common.Policy{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         policiesPath + "/{policyID}/restore",
+			Handler:         policy.restorePolicy,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         policiesPath + "/{policyID}/revisions",
+			Handler:         policy.listRevisions,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         policiesPath + "/{policyID}/diff",
+			Handler:         policy.diffRevisions,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         policiesPath + "/{policyID}/rollback",
+			Handler:         policy.rollbackPolicy,
+			MakeMessage:     func() interface{} { return &common.PolicyRollback{} },
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         policiesPath + "/{policyID}",
@@ -80,6 +162,69 @@ func (policy *PolicySvc) Routes() common.Routes {
 			Pattern: findPath + policiesPath + "/{policyName}",
 			Handler: policy.findPolicyByName,
 		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         portListsPath,
+			Handler:         policy.addPortList,
+			MakeMessage:     func() interface{} { return &common.PortList{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         portListsPath,
+			Handler:         policy.listPortLists,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         portListsPath + "/{portListName}",
+			Handler:         policy.getPortList,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         portListsPath + "/{portListName}",
+			Handler:         policy.deletePortList,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         templatesPath,
+			Handler:         policy.addTemplate,
+			MakeMessage:     func() interface{} { return &common.PolicyTemplate{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         templatesPath,
+			Handler:         policy.listTemplates,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         templatesPath + "/{templateName}",
+			Handler:         policy.getTemplate,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         templatesPath + "/{templateName}",
+			Handler:         policy.deleteTemplate,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         templatesPath + "/{templateName}/instantiate",
+			Handler:         policy.instantiateTemplate,
+			MakeMessage:     func() interface{} { return &common.PolicyTemplateInstance{} },
+			UseRequestToken: false,
+		},
 	}
 	return routes
 }
@@ -91,8 +236,8 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 	if err != nil {
 		return err
 	}
-	if endpoint.Peer == common.Wildcard {
-		// If a wildcard is specfied, there is nothing to augment
+	if endpoint.Peer == common.Wildcard || endpoint.Cidr != "" {
+		// If a wildcard or a CIDR is specfied, there is nothing to augment
 		return nil
 	}
 	log.Printf("Policy: Augmenting  %#v", endpoint)
@@ -157,8 +302,8 @@ func (policy *PolicySvc) augmentEndpoint(endpoint *common.Endpoint) error {
 }
 
 // augmentPolicy augments the provided policy with information gotten from
-// various services.
-func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy) error {
+// various services and with ports of the port lists its rules refer to.
+func (policy *PolicySvc) augmentPolicy(ctx context.Context, policyDoc *common.Policy) error {
 	// Get info from topology service
 	log.Printf("Augmenting policy %s", policyDoc.Name)
 	topoUrl, err := policy.client.GetServiceUrl("topology")
@@ -187,6 +332,10 @@ func (policy *PolicySvc) augmentPolicy(policyDoc *common.Policy) error {
 		rule := &policyDoc.Rules[i]
 		rule.Protocol = strings.ToUpper(rule.Protocol)
 	}
+	err = policy.resolvePortLists(ctx, policyDoc)
+	if err != nil {
+		return err
+	}
 
 	for i, _ := range policyDoc.AppliedTo {
 		endpoint := &policyDoc.AppliedTo[i]
@@ -237,7 +386,7 @@ func (policy *PolicySvc) getPolicy(input interface{}, ctx common.RestContext) (i
 	if err != nil {
 		return nil, common.NewError404("policy", idStr)
 	}
-	policyDoc, err := policy.store.getPolicy(id, false)
+	policyDoc, err := policy.store.GetPolicy(ctx.Context, id, false)
 	log.Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
 	return policyDoc, err
 }
@@ -253,12 +402,12 @@ func (policy *PolicySvc) deletePolicyHandler(input interface{}, ctx common.RestC
 		if err != nil {
 			return nil, err
 		}
-		id, err := policy.store.lookupPolicy(policyDoc.ExternalID)
+		id, err := policy.store.LookupPolicy(ctx.Context, policyDoc.ExternalID)
 		log.Printf("Found %d / %v (%T) from external ID %s", id, err, err, policyDoc.ExternalID)
 		if err != nil {
 			return nil, err
 		}
-		return policy.deletePolicy(id)
+		return policy.deletePolicy(ctx.Context, id)
 	} else {
 		if input != nil {
 			common.NewError400("Request must either be to /policies/{policyID} or have a body.")
@@ -267,19 +416,20 @@ func (policy *PolicySvc) deletePolicyHandler(input interface{}, ctx common.RestC
 		if err != nil {
 			return nil, common.NewError404("policy", idStr)
 		}
-		return policy.deletePolicy(id)
+		return policy.deletePolicy(ctx.Context, id)
 	}
 }
 
-// deletePolicy deletes policy based the following algorithm:
-//1. Mark the policy as "deleted" in the backend store.
-func (policy *PolicySvc) deletePolicy(id uint64) (interface{}, error) {
+// deletePolicy marks the policy deleted in the store and deletes
+// it from all agents. It stays marked deleted, and can be restored,
+// for the deletion grace period of the store (see restorePolicy).
+func (policy *PolicySvc) deletePolicy(ctx context.Context, id uint64) (interface{}, error) {
 	// TODO do we need this to be transactional or not ... case can be made for either.
-	err := policy.store.inactivatePolicy(id)
+	err := policy.store.InactivatePolicy(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	policyDoc, err := policy.store.getPolicy(id, true)
+	policyDoc, err := policy.store.GetPolicy(ctx, id, true)
 	log.Printf("Found policy for ID %d: %s (%v)", id, policyDoc, err)
 	if err != nil {
 		return nil, err
@@ -302,17 +452,49 @@ func (policy *PolicySvc) deletePolicy(id uint64) (interface{}, error) {
 	if len(errStr) > 0 {
 		return nil, common.NewError500(errStr)
 	}
-	err = policy.store.deletePolicy(id)
+	policyDoc.Datacenter = nil
+	common.PublishEvent(policy.bus, common.BusTopicPolicies, common.PolicyDeleted, policyDoc)
+	return policyDoc, nil
+}
+
+// restorePolicy handles POST to /policies/{policyID}/restore,
+// restoring a deleted policy that has not been purged yet and
+// distributing it to agents again.
+func (policy *PolicySvc) restorePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := policy.store.GetPolicy(ctx.Context, id, false); err == nil {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Policy %d is not deleted", id))
+	}
+	policyDoc, err := policy.store.GetPolicy(ctx.Context, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if policyDoc.ExternalID != "" {
+		if other, err := policy.store.LookupPolicy(ctx.Context, policyDoc.ExternalID); err == nil {
+			return nil, common.NewErrorConflict(fmt.Sprintf("Policy %d has external ID %s of policy %d", other, policyDoc.ExternalID, id))
+		}
+	}
+	err = policy.store.RestorePolicy(ctx.Context, id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("restorePolicy(): Restored policy %d (%s)", id, policyDoc.Name)
+	err = policy.distributePolicy(&policyDoc)
 	if err != nil {
+		log.Printf("restorePolicy(): Error distributing: %v", err)
 		return nil, err
 	}
 	policyDoc.Datacenter = nil
+	common.PublishEvent(policy.bus, common.BusTopicPolicies, common.PolicyAdded, policyDoc)
 	return policyDoc, nil
 }
 
 // deletePolicy deletes policy...
 func (policy *PolicySvc) listPolicies(input interface{}, ctx common.RestContext) (interface{}, error) {
-	policies, err := policy.store.listPolicies()
+	policies, err := policy.store.ListPolicies(ctx.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -331,7 +513,7 @@ func (policy *PolicySvc) findPolicyByName(input interface{}, ctx common.RestCont
 	if nameStr == "" {
 		return nil, common.NewError500(fmt.Sprintf("Expected policy name, got %s", nameStr))
 	}
-	policyDoc, err := policy.store.findPolicyByName(nameStr)
+	policyDoc, err := policy.store.FindPolicyByName(ctx.Context, nameStr)
 	if err != nil {
 		return nil, err
 	}
@@ -349,13 +531,24 @@ func (policy *PolicySvc) addPolicy(input interface{}, ctx common.RestContext) (i
 		return nil, err
 	}
 
-	err = policy.augmentPolicy(policyDoc)
+	err = policy.augmentPolicy(ctx.Context, policyDoc)
 	if err != nil {
 		log.Printf("addPolicy(): Error augmenting: %v", err)
 		return nil, err
 	}
+	err = policy.checkRateLimit(policyDoc)
+	if err != nil {
+		log.Printf("addPolicy(): Rate limited: %v", err)
+		return nil, err
+	}
+	err = policy.checkQuotas(ctx.Context, policyDoc)
+	if err != nil {
+		log.Printf("addPolicy(): Quota exceeded: %v", err)
+		return nil, err
+	}
+	policyDoc.Revision = 1
 	// Save it
-	err = policy.store.addPolicy(policyDoc)
+	err = policy.store.AddPolicy(ctx.Context, policyDoc)
 	if err != nil {
 		log.Printf("addPolicy(): Error storing: %v", err)
 		return nil, err
@@ -367,14 +560,124 @@ func (policy *PolicySvc) addPolicy(input interface{}, ctx common.RestContext) (i
 		return nil, err
 	}
 	policyDoc.Datacenter = nil
+	common.PublishEvent(policy.bus, common.BusTopicPolicies, common.PolicyAdded, policyDoc)
 	return policyDoc, nil
 }
 
+// checkRateLimit takes a request of each tenant the (augmented)
+// policy applies to from the rate limiter, returning its error if
+// any of the tenants made too many requests, in which case none of
+// them is charged. Tenants are known by network ID here, as in
+// checkQuotas.
+func (policy *PolicySvc) checkRateLimit(policyDoc *common.Policy) error {
+	networkIDs := make(map[uint64]bool)
+	var keys []string
+	for _, endpoint := range policyDoc.AppliedTo {
+		if endpoint.TenantNetworkID == nil || networkIDs[*endpoint.TenantNetworkID] {
+			continue
+		}
+		networkIDs[*endpoint.TenantNetworkID] = true
+		keys = append(keys, fmt.Sprintf("tenant with network ID %d", *endpoint.TenantNetworkID))
+	}
+	return policy.limiter.CheckAll(keys)
+}
+
+// checkQuotas asks the tenant service whether tenants the (augmented)
+// policy is applied to may have one more policy.
+func (policy *PolicySvc) checkQuotas(ctx context.Context, policyDoc *common.Policy) error {
+	networkIDs := make(map[uint64]bool)
+	for _, endpoint := range policyDoc.AppliedTo {
+		if endpoint.TenantNetworkID != nil {
+			networkIDs[*endpoint.TenantNetworkID] = true
+		}
+	}
+	if len(networkIDs) == 0 {
+		return nil
+	}
+	policies, err := policy.store.ListPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	used := make(map[uint64]int)
+	for _, p := range policies {
+		for networkID := range networkIDs {
+			for _, endpoint := range p.AppliedTo {
+				if endpoint.TenantNetworkID != nil && *endpoint.TenantNetworkID == networkID {
+					used[networkID]++
+					break
+				}
+			}
+		}
+	}
+
+	client := policy.client.WithContext(ctx)
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+	var tenants []tenant.Tenant
+	err = client.Get(tenantURL+"/tenants", &tenants)
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		if networkIDs[t.NetworkID] {
+			err = tenant.CheckQuota(client, t.ID, tenant.QuotaPolicies, used[t.NetworkID])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Name provides name of this service.
 func (policy *PolicySvc) Name() string {
 	return "policy"
 }
 
+// CheckHealth implements common.HealthChecker by checking the database.
+func (policy *PolicySvc) CheckHealth() error {
+	return policy.store.Ping()
+}
+
+// Snapshot implements common.Snapshotter by taking a
+// snapshot of the database, for backups.
+func (policy *PolicySvc) Snapshot(ctx context.Context) (common.StoreSnapshot, error) {
+	return common.SnapshotStore(ctx, policy.store)
+}
+
+// Restore implements common.Snapshotter by restoring
+// the snapshot into the database.
+func (policy *PolicySvc) Restore(ctx context.Context, snapshot common.StoreSnapshot) error {
+	return common.RestoreStore(ctx, policy.store, snapshot)
+}
+
+// MaintenanceJobs implements common.Maintainer. Besides the jobs
+// of the store, compact_history removes old revisions of policies,
+// keeping the last keep_revisions (DefaultKeepRevisions) of each.
+func (policy *PolicySvc) MaintenanceJobs() map[string]common.MaintenanceJob {
+	jobs := common.StoreMaintenanceJobs(policy.store)
+	jobs["compact_history"] = common.MaintenanceJob{
+		Run: func(ctx context.Context, config map[string]interface{}) (string, error) {
+			keep := DefaultKeepRevisions
+			if value, ok := config["keep_revisions"]; ok {
+				n, ok := value.(float64)
+				if !ok || n < 1 {
+					return "", common.NewError("Invalid keep_revisions %v", value)
+				}
+				keep = int(n)
+			}
+			removed, err := policy.store.CompactRevisions(ctx, keep)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Removed %d revisions older than the last %d of each policy", removed, keep), nil
+		},
+	}
+	return jobs
+}
+
 // SetConfig implements SetConfig function of the Service interface.
 // Returns an error if cannot connect to the data store
 func (policy *PolicySvc) SetConfig(config common.ServiceConfig) error {
@@ -382,12 +685,27 @@ func (policy *PolicySvc) SetConfig(config common.ServiceConfig) error {
 	policy.config = config
 	//	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
 	log.Printf("Policy port: %d", config.Common.Api.Port)
-	policy.store = policyStore{}
+	limiter, err := common.ParseRateLimit(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	policy.limiter = limiter
+	if policy.store == nil {
+		store := &policyStore{}
+		store.ServiceStore = store
+		policy.store = store
+	}
 	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
-	policy.store.ServiceStore = &policy.store
 	return policy.store.SetConfig(storeConfig)
 }
 
+// SetStore makes the policy service keep policies in the store,
+// such as one of package policytest, rather than in the database
+// configured. It must be called before SetConfig.
+func (policy *PolicySvc) SetStore(store Store) {
+	policy.store = store
+}
+
 func (policy *PolicySvc) createSchema(overwrite bool) error {
 	return nil
 }
@@ -416,6 +734,10 @@ func (policy *PolicySvc) Initialize() error {
 	if err != nil {
 		return err
 	}
+	policy.bus, err = common.NewEventBus(policy.Name(), policy.config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -26,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) {
@@ -54,6 +55,8 @@ type mockSvc struct {
 	segmentCounter uint64
 	segments       map[uint64]string
 	segmentsStr    map[string]uint64
+	// Quota of policies of tenant 1; 0 for no limit.
+	maxPolicies int
 }
 
 func (s *mockSvc) SetConfig(config common.ServiceConfig) error {
@@ -78,6 +81,27 @@ func (s *mockSvc) Routes() common.Routes {
 		},
 	}
 
+	tenantListRoute := common.Route{
+		Method:  "GET",
+		Pattern: "/tenants",
+		Handler: func(input interface{}, ctx common.RestContext) (interface{}, error) {
+			return []tenant.Tenant{{ID: 1, Name: "default", ExternalID: "default", NetworkID: 1}}, nil
+		},
+	}
+
+	quotaCheckRoute := common.Route{
+		Method:  "POST",
+		Pattern: "/tenants/1/quota/check",
+		Handler: func(input interface{}, ctx common.RestContext) (interface{}, error) {
+			check := input.(*tenant.QuotaCheck)
+			if check.Resource == tenant.QuotaPolicies && s.maxPolicies > 0 && check.Used >= s.maxPolicies {
+				return nil, common.NewErrorConflict("Quota reached")
+			}
+			return check, nil
+		},
+		MakeMessage: func() interface{} { return &tenant.QuotaCheck{} },
+	}
+
 	segmentGetRoute := common.Route{
 		Method:  "GET",
 		Pattern: "/tenants/1/segments/{id}",
@@ -216,6 +240,8 @@ func (s *mockSvc) Routes() common.Routes {
 	routes := common.Routes{
 		rootRoute,
 		tenantGetRoute,
+		tenantListRoute,
+		quotaCheckRoute,
 		segmentGetRoute,
 		registerPortRoute,
 		policyConfigRoute,
@@ -326,6 +352,205 @@ func (s *MySuite) TestPolicy(c *check.C) {
 	c.Assert(policyOut.Name, check.Equals, "default")
 	c.Assert(policyOut.ID, check.Equals, uint64(3))
 
+	log.Println("3a. Add policy over quota")
+	svc.maxPolicies = 3
+	overQuota := defPol
+	overQuota.Name = "overquota"
+	err = client.Post(polURL, overQuota, &policyOut)
+	c.Assert(err, check.NotNil)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusConflict)
+	svc.maxPolicies = 0
+
+	log.Println("3b. Validate policies")
+	validation := common.PolicyValidationResponse{}
+	err = client.Post(polURL+"/validate", policyIn, &validation)
+	c.Assert(err, check.IsNil)
+	c.Assert(validation.Valid, check.Equals, true)
+	two := uint64(2)
+	invalid := common.Policy{
+		Direction: "sideways",
+		Name:      "invalid",
+		AppliedTo: []common.Endpoint{{TenantID: two}},
+		Peers:     []common.Endpoint{{Cidr: "10.0.0.0/8"}, {Cidr: "10.1.0.0/16"}, {Cidr: "192.168.0.0/16"}},
+		Rules:     []common.Rule{{Protocol: "tcp", Ports: []uint{80}, IsStateful: true}, {Protocol: "sctp"}},
+	}
+	err = client.Post(polURL+"/validate", invalid, &validation)
+	c.Assert(err, check.IsNil)
+	c.Assert(validation.Valid, check.Equals, false)
+	c.Assert(validation.Errors, check.DeepEquals, []string{
+		"Unknown direction 'sideways', allowed 'egress' or 'ingress'.",
+		"Rule #2: Invalid protocol: sctp.",
+		"applied_to entry #1: Unknown tenant or segment.",
+		"peers entry #1 and peers entry #2: CIDRs 10.0.0.0/8 and 10.1.0.0/16 overlap.",
+		"Rule #1: Stateful rules are not supported.",
+	})
+
+	log.Println("3c. Evaluate flows")
+	evaluation := common.PolicyEvaluation{}
+	flow := common.PolicyFlow{
+		Protocol:    "TCP",
+		DstPort:     80,
+		Source:      common.Endpoint{TenantID: 1, SegmentID: 2},
+		Destination: common.Endpoint{TenantID: 1, SegmentID: 1},
+	}
+	err = client.Post(polURL+"/evaluate", flow, &evaluation)
+	c.Assert(err, check.IsNil)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyActionAllow)
+	c.Assert(len(evaluation.Policies), check.Equals, 1)
+	c.Assert(evaluation.Policies[0].Name, check.Equals, "pol1")
+	flow.Protocol, flow.DstPort = "udp", 53
+	err = client.Post(polURL+"/evaluate", flow, &evaluation)
+	c.Assert(err, check.IsNil)
+	c.Assert(evaluation.Policies[0].Name, check.Equals, "default")
+	flow.Destination, flow.DstIP = common.Endpoint{}, "8.8.8.8"
+	err = client.Post(polURL+"/evaluate", flow, &evaluation)
+	c.Assert(err, check.IsNil)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyVerdictNone)
+	flow.Protocol = "sctp"
+	err = client.Post(polURL+"/evaluate", flow, &evaluation)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusBadRequest)
+
+	log.Println("3d. Report and list policy status")
+	status := common.HostPolicyStatus{Host: "127.0.0.1", Policies: []common.AppliedPolicy{
+		{ID: 1, Revision: 1},
+		{ID: 2, Revision: 1, Error: "iptables failed"},
+	}}
+	err = client.Post(polURL+"/status", status, &status)
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Timestamp, check.Not(check.Equals), int64(0))
+	var rollouts []common.PolicyRollout
+	err = client.Get(polURL+"/status", &rollouts)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(rollouts), check.Equals, 3)
+	c.Assert(rollouts[0].Revision, check.Equals, uint64(1))
+	c.Assert(rollouts[0].Complete, check.Equals, true)
+	c.Assert(rollouts[0].Applied, check.DeepEquals, []string{"127.0.0.1"})
+	c.Assert(rollouts[1].Complete, check.Equals, false)
+	c.Assert(rollouts[1].Failed, check.DeepEquals, map[string]string{"127.0.0.1": "iptables failed"})
+	rollout := common.PolicyRollout{}
+	err = client.Get(polURL+"/3/status", &rollout)
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Name, check.Equals, "default")
+	c.Assert(rollout.Pending, check.DeepEquals, []string{"127.0.0.1"})
+
+	log.Println("3e. Update, diff and roll back default policy")
+	update := defPol
+	update.Priority = 5
+	update.Rules = []common.Rule{{Protocol: "TCP", Ports: []uint{22}}}
+	err = client.Put(polURL+"/3", update, &policyOut)
+	c.Assert(err, check.NotNil)
+	c.Assert(client.GetStatusCode(), check.Equals, common.StatusPreconditionRequired)
+	update.Revision = 1
+	err = client.Put(polURL+"/3", update, &policyOut)
+	c.Assert(err, check.IsNil)
+	c.Assert(policyOut.ID, check.Equals, uint64(3))
+	c.Assert(policyOut.Revision, check.Equals, uint64(2))
+	c.Assert(policyOut.UpdatedAt, check.NotNil)
+	stored := common.Policy{}
+	err = client.Get(polURL+"/3", &stored)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.CreatedAt, check.NotNil)
+	c.Assert(stored.UpdatedAt.Unix(), check.Equals, policyOut.UpdatedAt.Unix())
+	c.Assert(stored.UpdatedAt.Before(*stored.CreatedAt), check.Equals, false)
+	// Another update of revision 1 would overwrite this one.
+	err = client.Put(polURL+"/3", update, &policyOut)
+	c.Assert(err, check.NotNil)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusConflict)
+	var revisions []common.PolicyRevision
+	err = client.Get(polURL+"/3/revisions", &revisions)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(revisions), check.Equals, 2)
+	c.Assert(revisions[0].Policy.Priority, check.Equals, 0)
+	c.Assert(revisions[1].Policy.Priority, check.Equals, 5)
+	diff := common.PolicyDiff{}
+	err = client.Get(polURL+"/3/diff", &diff)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.From, check.Equals, uint64(1))
+	c.Assert(diff.To, check.Equals, uint64(2))
+	c.Assert(len(diff.Changes), check.Equals, 2)
+	c.Assert(diff.Changes[0].Field, check.Equals, "priority")
+	c.Assert(diff.Changes[1].Field, check.Equals, "rules")
+	policyOut = common.Policy{}
+	err = client.Post(polURL+"/3/rollback", common.PolicyRollback{Revision: 1}, &policyOut)
+	c.Assert(err, check.IsNil)
+	c.Assert(policyOut.Revision, check.Equals, uint64(3))
+	c.Assert(policyOut.Priority, check.Equals, 0)
+	err = client.Get(polURL+"/3/diff?from=1&to=3", &diff)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(diff.Changes), check.Equals, 0)
+	err = client.Post(polURL+"/3/rollback", common.PolicyRollback{Revision: 9}, &policyOut)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusNotFound)
+
+	log.Println("3f. Refer to port lists in rules")
+	portListURL := "http://" + svcInfo.Address + "/portlists"
+	webPorts := struct {
+		Name       string   `json:"name"`
+		Ports      []uint   `json:"ports"`
+		PortRanges []string `json:"port_ranges"`
+	}{"web", []uint{80, 443}, []string{"8000-8080"}}
+	portList := common.PortList{}
+	err = client.Post(portListURL, webPorts, &portList)
+	c.Assert(err, check.IsNil)
+	c.Assert(portList.PortRanges, check.DeepEquals, []common.PortRange{{8000, 8080}})
+	err = client.Post(portListURL, webPorts, &portList)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusConflict)
+	err = client.Post(portListURL, common.PortList{Name: "none"}, &portList)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusUnprocessableEntity)
+	var portLists []common.PortList
+	err = client.Get(portListURL, &portLists)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(portLists), check.Equals, 1)
+	update.Rules = []common.Rule{{Protocol: "TCP", Ports: []uint{22}, PortLists: []string{"web"}}}
+	update.Revision = 3
+	policyOut = common.Policy{}
+	err = client.Put(polURL+"/3", update, &policyOut)
+	c.Assert(err, check.IsNil)
+	c.Assert(policyOut.Rules[0].Ports, check.DeepEquals, []uint{22, 80, 443})
+	c.Assert(policyOut.Rules[0].PortRanges, check.DeepEquals, []common.PortRange{{8000, 8080}})
+	err = client.Delete(portListURL+"/web", nil, &portList)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusConflict)
+	update.Rules[0].PortLists = []string{"nope"}
+	err = client.Post(polURL+"/validate", update, &validation)
+	c.Assert(err, check.IsNil)
+	c.Assert(validation.Errors, check.DeepEquals, []string{"Rule #1: Unknown port list nope."})
+
+	log.Println("3g. Create a policy from a template")
+	templateURL := "http://" + svcInfo.Address + "/templates"
+	template := common.PolicyTemplate{
+		Name:       "web-tier",
+		Parameters: []string{"app", "ports"},
+		Policy: common.Policy{
+			Direction:   common.PolicyDirectionIngress,
+			Name:        "${app}-web",
+			Description: "Web tier of ${app}",
+			AppliedTo:   []common.Endpoint{{TenantID: 1, SegmentID: 2}},
+			Peers:       []common.Endpoint{{Peer: common.Wildcard}},
+			Rules:       []common.Rule{{Protocol: "tcp", PortLists: []string{"${ports}"}}},
+		},
+	}
+	err = client.Post(templateURL, template, &template)
+	c.Assert(err, check.IsNil)
+	c.Assert(template.ID, check.Equals, uint64(1))
+	badTemplate := template
+	badTemplate.Name, badTemplate.Parameters = "bad", []string{"app", "tier"}
+	err = client.Post(templateURL, badTemplate, &template)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusUnprocessableEntity)
+	policyOut = common.Policy{}
+	err = client.Post(templateURL+"/web-tier/instantiate", common.PolicyTemplateInstance{Parameters: map[string]string{"app": "shop"}}, &policyOut)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusUnprocessableEntity)
+	err = client.Post(templateURL+"/web-tier/instantiate", common.PolicyTemplateInstance{Parameters: map[string]string{"app": "shop", "ports": "web"}}, &policyOut)
+	c.Assert(err, check.IsNil)
+	c.Assert(policyOut.ID, check.Equals, uint64(4))
+	c.Assert(policyOut.Name, check.Equals, "shop-web")
+	c.Assert(policyOut.Description, check.Equals, "Web tier of shop")
+	c.Assert(policyOut.Rules[0].Ports, check.DeepEquals, []uint{80, 443})
+	err = client.Delete(polURL+"/4", nil, &policyOut)
+	c.Assert(err, check.IsNil)
+	err = client.Delete(templateURL+"/web-tier", nil, &template)
+	c.Assert(err, check.IsNil)
+	err = client.Get(templateURL+"/web-tier", &template)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusNotFound)
+
 	log.Println("4. Test list policies - should have 3.")
 	var policies []common.Policy
 	err = client.Get(polURL, &policies)
@@ -442,6 +667,148 @@ func (s *MySuite) TestPolicy(c *check.C) {
 	c.Assert(httpErr.ResourceID, check.Equals, "default")
 	log.Printf("%v", err)
 
+	log.Println("15. Test restore default policy - should be applied again")
+	policyOut = common.Policy{}
+	err = client.Post(polURL+"/3/restore", nil, &policyOut)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(policyOut.Name, check.Equals, defPol.Name)
+	err = client.Get(polURL, &policies)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(len(policies), check.Equals, 1)
+
+	log.Println("16. Test restore default policy again - should be Conflict")
+	err = client.Post(polURL+"/3/restore", nil, &policyOut)
+	c.Assert(err, check.NotNil)
+	c.Assert(client.GetStatusCode(), check.Equals, http.StatusConflict)
+}
+
+// TestCheckRateLimit tests that a policy counts against the
+// rate limit of every tenant it is applied to.
+func (s *MySuite) TestCheckRateLimit(c *check.C) {
+	one, two := uint64(1), uint64(2)
+	policy := &PolicySvc{}
+	both := &common.Policy{AppliedTo: []common.Endpoint{{TenantNetworkID: &one}, {TenantNetworkID: &two}, {TenantNetworkID: &two}}}
+	// No limit is configured.
+	c.Assert(policy.checkRateLimit(both), check.IsNil)
+
+	var err error
+	policy.limiter, err = common.ParseRateLimit(map[string]interface{}{"rate_limit": map[string]interface{}{"requests_per_second": 0.001, "burst": 1.0}})
+	c.Assert(err, check.IsNil)
+	c.Assert(policy.checkRateLimit(both), check.IsNil)
+	err = policy.checkRateLimit(&common.Policy{AppliedTo: []common.Endpoint{{TenantNetworkID: &two}}})
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, common.StatusTooManyRequests)
+
+	// A policy refused for one tenant is not charged to the others.
+	policy.limiter, err = common.ParseRateLimit(map[string]interface{}{"rate_limit": map[string]interface{}{"requests_per_second": 0.001, "burst": 1.0}})
+	c.Assert(err, check.IsNil)
+	c.Assert(policy.checkRateLimit(&common.Policy{AppliedTo: []common.Endpoint{{TenantNetworkID: &two}}}), check.IsNil)
+	err = policy.checkRateLimit(both)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, common.StatusTooManyRequests)
+	c.Assert(policy.checkRateLimit(&common.Policy{AppliedTo: []common.Endpoint{{TenantNetworkID: &one}}}), check.IsNil)
+}
+
+// TestEvaluatePolicies tests the order in which egress and ingress
+// policies decide the fate of flows.
+func (s *MySuite) TestEvaluatePolicies(c *check.C) {
+	one, two := uint64(1), uint64(2)
+	web := common.Endpoint{TenantNetworkID: &one}
+	db := common.Endpoint{TenantNetworkID: &two}
+	policies := []common.Policy{
+		{ID: 1, Name: "db-from-web", AppliedTo: []common.Endpoint{db}, Peers: []common.Endpoint{web},
+			Rules: []common.Rule{{Protocol: "tcp", PortRanges: []common.PortRange{{5432, 5433}}}}},
+		{ID: 2, Name: "db-no-web", Action: common.PolicyActionDeny, Priority: 10, AppliedTo: []common.Endpoint{db},
+			Peers: []common.Endpoint{{Peer: common.Wildcard}}, Rules: []common.Rule{{Protocol: common.Wildcard}}},
+		{ID: 3, Name: "web-out", Direction: common.PolicyDirectionEgress, AppliedTo: []common.Endpoint{web},
+			Peers: []common.Endpoint{db, {Cidr: "172.16.0.0/12", Except: []string{"172.16.5.0/24"}}},
+			Rules: []common.Rule{{Protocol: "TCP"}}},
+	}
+	flow := common.PolicyFlow{Protocol: "tcp", DstPort: 5432, Source: web, Destination: db}
+	evaluation := evaluatePolicies(policies, flow)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyActionAllow)
+	c.Assert(len(evaluation.Policies), check.Equals, 2)
+	c.Assert(evaluation.Policies[0].ID, check.Equals, uint64(3))
+	c.Assert(evaluation.Policies[1].ID, check.Equals, uint64(1))
+
+	// Lower priority allow wins over the deny.
+	flow.DstPort = 22
+	evaluation = evaluatePolicies(policies, flow)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyActionDeny)
+	c.Assert(evaluation.Policies[1].ID, check.Equals, uint64(2))
+
+	// Egress policies drop what they do not allow.
+	flow.Protocol = "udp"
+	evaluation = evaluatePolicies(policies, flow)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyActionDeny)
+	c.Assert(len(evaluation.Policies), check.Equals, 0)
+
+	flow = common.PolicyFlow{Protocol: "tcp", DstIP: "172.16.1.1", Source: web}
+	c.Assert(evaluatePolicies(policies, flow).Verdict, check.Equals, common.PolicyVerdictNone)
+	flow.DstIP = "172.16.5.1"
+	c.Assert(evaluatePolicies(policies, flow).Verdict, check.Equals, common.PolicyActionDeny)
+
+	// ICMP type names match their type and code.
+	policies = append(policies, common.Policy{ID: 4, Name: "db-pmtu", Priority: 5, AppliedTo: []common.Endpoint{db},
+		Peers: []common.Endpoint{{Peer: common.Wildcard}}, Rules: []common.Rule{{Protocol: "icmp", IcmpTypeName: "fragmentation-needed"}}})
+	flow = common.PolicyFlow{Protocol: "icmp", IcmpType: 3, IcmpCode: 4, Destination: db}
+	evaluation = evaluatePolicies(policies, flow)
+	c.Assert(evaluation.Verdict, check.Equals, common.PolicyActionAllow)
+	c.Assert(evaluation.Policies[0].ID, check.Equals, uint64(4))
+	flow.IcmpCode = 3
+	c.Assert(evaluatePolicies(policies, flow).Verdict, check.Equals, common.PolicyActionDeny)
+}
+
+// TestCompactHistory tests removal of old revisions of policies
+// by the compact_history maintenance job.
+func (s *MySuite) TestCompactHistory(c *check.C) {
+	store := &policyStore{}
+	store.ServiceStore = store
+	err := store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/policyCompact.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+	policy := &PolicySvc{store: store}
+
+	var ids []uint64
+	for i, name := range []string{"p1", "p2"} {
+		policyDoc := &common.Policy{Name: name, ExternalID: name, Revision: 1}
+		err = store.AddPolicy(nil, policyDoc)
+		c.Assert(err, check.IsNil)
+		ids = append(ids, policyDoc.ID)
+		// p1 gets 4 revisions, p2 only 1.
+		for revision := uint64(2); i == 0 && revision <= 4; revision++ {
+			policyDoc.Revision = revision
+			err = store.UpdatePolicy(nil, policyDoc)
+			c.Assert(err, check.IsNil)
+		}
+	}
+
+	jobs := policy.MaintenanceJobs()
+	c.Assert(jobs[common.MaintenancePurgeDeleted].Interval > 0, check.Equals, true)
+	compact := jobs["compact_history"]
+	c.Assert(compact.Interval, check.Equals, time.Duration(0))
+	_, err = compact.Run(nil, map[string]interface{}{"keep_revisions": 0.0})
+	c.Assert(err, check.NotNil)
+	result, err := compact.Run(nil, map[string]interface{}{"keep_revisions": 2.0})
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(result, "Removed 2 revisions"), check.Equals, true)
+	revisions, err := store.ListRevisions(nil, ids[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(len(revisions), check.Equals, 2)
+	c.Assert(revisions[0].Revision, check.Equals, uint64(3))
+	revisions, err = store.ListRevisions(nil, ids[1])
+	c.Assert(err, check.IsNil)
+	c.Assert(len(revisions), check.Equals, 1)
+	removed, err := store.CompactRevisions(nil, 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.Equals, int64(0))
 }
 
 const (
@@ -0,0 +1,602 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package policytest provides an in-memory policy.Store, so that the
+// policy service can be tested without a database
+// (see policy.PolicySvc.SetStore).
+package policytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// document is a policy, port list or template kept as JSON,
+// the way the database-backed store keeps it.
+type document struct {
+	id uint64
+	// External ID of a policy, name of a port list or template.
+	key     string
+	doc     []byte
+	deleted bool
+	// When the policy was marked deleted.
+	deletedAt time.Time
+	// Revision of a policy.
+	revision uint64
+	// When a policy was added and last updated.
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+// setStored sets the fields of the policy document
+// kept outside of it, as the database-backed store does.
+func (d document) setStored(policyDoc *common.Policy) {
+	createdAt, updatedAt := d.createdAt, d.updatedAt
+	policyDoc.ID = d.id
+	policyDoc.CreatedAt = &createdAt
+	policyDoc.UpdatedAt = &updatedAt
+}
+
+// byKey sorts documents by their key.
+type byKey []document
+
+func (d byKey) Len() int           { return len(d) }
+func (d byKey) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byKey) Less(i, j int) bool { return d[i].key < d[j].key }
+
+type revision struct {
+	policyID  uint64
+	revision  uint64
+	doc       []byte
+	timestamp int64
+}
+
+// Store keeps policies, their revisions, host statuses, port lists
+// and templates in memory.
+type Store struct {
+	mu        sync.Mutex
+	nextID    uint64
+	policies  []document
+	revisions []revision
+	statuses  map[string][]byte
+	portLists []document
+	templates []document
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{statuses: make(map[string][]byte)}
+}
+
+// SetConfig implements policy.Store; the configuration is ignored.
+func (s *Store) SetConfig(config map[string]interface{}) error {
+	return nil
+}
+
+// Connect implements policy.Store.
+func (s *Store) Connect() error {
+	return nil
+}
+
+// CreateSchema implements policy.Store, emptying the store if force is set.
+func (s *Store) CreateSchema(force bool) error {
+	if force {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.policies = nil
+		s.revisions = nil
+		s.statuses = make(map[string][]byte)
+		s.portLists = nil
+		s.templates = nil
+	}
+	return nil
+}
+
+// Ping implements policy.Store.
+func (s *Store) Ping() error {
+	return nil
+}
+
+// AddPolicy implements policy.Store.
+func (s *Store) AddPolicy(ctx context.Context, policyDoc *common.Policy) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(policyDoc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.nextID++
+	now := time.Now()
+	stored := document{id: s.nextID, key: policyDoc.ExternalID, doc: doc, revision: policyDoc.Revision, createdAt: now, updatedAt: now}
+	stored.setStored(policyDoc)
+	s.policies = append(s.policies, stored)
+	s.mu.Unlock()
+	return s.AddRevision(policyDoc)
+}
+
+// UpdatePolicy implements policy.Store.
+func (s *Store) UpdatePolicy(ctx context.Context, policyDoc *common.Policy) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(policyDoc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	i := s.findPolicy(policyDoc.ID, false)
+	if i < 0 {
+		s.mu.Unlock()
+		return common.NewError404("policy", strconv.FormatUint(policyDoc.ID, 10))
+	}
+	if s.policies[i].revision >= policyDoc.Revision {
+		s.mu.Unlock()
+		return common.NewErrorConflict(fmt.Sprintf("Policy %d changed concurrently, reload it and retry", policyDoc.ID))
+	}
+	s.policies[i].key = policyDoc.ExternalID
+	s.policies[i].doc = doc
+	s.policies[i].revision = policyDoc.Revision
+	s.policies[i].updatedAt = time.Now()
+	s.policies[i].setStored(policyDoc)
+	s.mu.Unlock()
+	return s.AddRevision(policyDoc)
+}
+
+// findPolicy returns the index of the policy with the ID, or -1.
+// Policies marked deleted are only found if markedDeleted is set.
+func (s *Store) findPolicy(id uint64, markedDeleted bool) int {
+	for i, p := range s.policies {
+		if p.id == id && (markedDeleted || !p.deleted) {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddRevision implements policy.Store.
+func (s *Store) AddRevision(policyDoc *common.Policy) error {
+	doc, err := json.Marshal(policyDoc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revisions = append(s.revisions, revision{
+		policyID:  policyDoc.ID,
+		revision:  policyDoc.Revision,
+		doc:       doc,
+		timestamp: time.Now().Unix(),
+	})
+	return nil
+}
+
+// ListRevisions implements policy.Store.
+func (s *Store) ListRevisions(ctx context.Context, id uint64) ([]common.PolicyRevision, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revisions := []common.PolicyRevision{}
+	for _, r := range s.revisions {
+		if r.policyID != id {
+			continue
+		}
+		revision := common.PolicyRevision{Revision: r.revision, Timestamp: r.timestamp}
+		if err := json.Unmarshal(r.doc, &revision.Policy); err != nil {
+			return nil, err
+		}
+		revision.Policy.ID = id
+		revisions = append(revisions, revision)
+	}
+	sort.Sort(byRevision(revisions))
+	return revisions, nil
+}
+
+type byRevision []common.PolicyRevision
+
+func (r byRevision) Len() int           { return len(r) }
+func (r byRevision) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRevision) Less(i, j int) bool { return r[i].Revision < r[j].Revision }
+
+// GetRevision implements policy.Store.
+func (s *Store) GetRevision(ctx context.Context, id uint64, revision uint64) (common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Policy{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.revisions {
+		if r.policyID == id && r.revision == revision {
+			policyDoc := common.Policy{}
+			if err := json.Unmarshal(r.doc, &policyDoc); err != nil {
+				return policyDoc, err
+			}
+			policyDoc.ID = id
+			return policyDoc, nil
+		}
+	}
+	return common.Policy{}, common.NewError404("policy revision", fmt.Sprintf("%d/%d", id, revision))
+}
+
+// ListPolicies implements policy.Store.
+func (s *Store) ListPolicies(ctx context.Context) ([]common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies := []common.Policy{}
+	for _, p := range s.policies {
+		if p.deleted {
+			continue
+		}
+		policyDoc := common.Policy{}
+		if err := json.Unmarshal(p.doc, &policyDoc); err != nil {
+			return nil, err
+		}
+		p.setStored(&policyDoc)
+		policies = append(policies, policyDoc)
+	}
+	return policies, nil
+}
+
+// LookupPolicy implements policy.Store.
+func (s *Store) LookupPolicy(ctx context.Context, externalID string) (uint64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.policies {
+		if !p.deleted && p.key == externalID {
+			return p.id, nil
+		}
+	}
+	return 0, common.NewError404("policy", externalID)
+}
+
+// GetPolicy implements policy.Store.
+func (s *Store) GetPolicy(ctx context.Context, id uint64, markedDeleted bool) (common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Policy{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policyDoc := common.Policy{}
+	i := s.findPolicy(id, markedDeleted)
+	if i < 0 {
+		return policyDoc, common.NewError404("policy", strconv.FormatUint(id, 10))
+	}
+	if err := json.Unmarshal(s.policies[i].doc, &policyDoc); err != nil {
+		return policyDoc, err
+	}
+	s.policies[i].setStored(&policyDoc)
+	return policyDoc, nil
+}
+
+// InactivatePolicy implements policy.Store.
+func (s *Store) InactivatePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.findPolicy(id, false); i >= 0 {
+		s.policies[i].deleted = true
+		s.policies[i].deletedAt = time.Now()
+	}
+	return nil
+}
+
+// FindPolicyByName implements policy.Store.
+func (s *Store) FindPolicyByName(ctx context.Context, name string) (common.Policy, error) {
+	policies, err := s.ListPolicies(ctx)
+	if err != nil {
+		return common.Policy{}, err
+	}
+	for _, p := range policies {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return common.Policy{}, common.NewError404("policy", name)
+}
+
+// DeletePolicy implements policy.Store, deleting the policy
+// even if it is marked deleted, and its revisions.
+func (s *Store) DeletePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removePolicy(id)
+	return nil
+}
+
+// removePolicy removes the policy with its
+// revisions. The caller holds mu.
+func (s *Store) removePolicy(id uint64) {
+	if i := s.findPolicy(id, true); i >= 0 {
+		s.policies = append(s.policies[:i], s.policies[i+1:]...)
+	}
+	revisions := s.revisions[:0]
+	for _, r := range s.revisions {
+		if r.policyID != id {
+			revisions = append(revisions, r)
+		}
+	}
+	s.revisions = revisions
+}
+
+// RestorePolicy implements policy.Store.
+func (s *Store) RestorePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.findPolicy(id, true)
+	if i < 0 || !s.policies[i].deleted {
+		return common.NewError404("deleted policy", strconv.FormatUint(id, 10))
+	}
+	s.policies[i].deleted = false
+	return nil
+}
+
+// DeletionGrace implements common.Purger.
+func (s *Store) DeletionGrace() time.Duration {
+	return common.DefaultDeletionGrace
+}
+
+// PurgeDeleted implements common.Purger, removing policies
+// marked deleted before the time with their revisions.
+func (s *Store) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []uint64
+	for _, p := range s.policies {
+		if p.deleted && p.deletedAt.Before(before) {
+			ids = append(ids, p.id)
+		}
+	}
+	for _, id := range ids {
+		s.removePolicy(id)
+	}
+	return int64(len(ids)), nil
+}
+
+// CompactRevisions implements policy.Store.
+func (s *Store) CompactRevisions(ctx context.Context, keep int) (int64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var revisions []revision
+	for _, r := range s.revisions {
+		newer := 0
+		for _, other := range s.revisions {
+			if other.policyID == r.policyID && other.revision > r.revision {
+				newer++
+			}
+		}
+		if newer < keep {
+			revisions = append(revisions, r)
+		}
+	}
+	removed := int64(len(s.revisions) - len(revisions))
+	s.revisions = revisions
+	return removed, nil
+}
+
+// SaveHostStatus implements policy.Store.
+func (s *Store) SaveHostStatus(ctx context.Context, status common.HostPolicyStatus) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.Host] = doc
+	return nil
+}
+
+// ListHostStatus implements policy.Store.
+func (s *Store) ListHostStatus(ctx context.Context) ([]common.HostPolicyStatus, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]string, 0, len(s.statuses))
+	for host := range s.statuses {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	statuses := make([]common.HostPolicyStatus, len(hosts))
+	for i, host := range hosts {
+		if err := json.Unmarshal(s.statuses[host], &statuses[i]); err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// addNamed adds the document v named name to docs, assigning
+// it an ID, unless the name is taken.
+func (s *Store) addNamed(docs *[]document, kind string, name string, v interface{}) (uint64, error) {
+	for _, d := range *docs {
+		if d.key == name {
+			return 0, common.NewErrorConflict(fmt.Sprintf("%s %s already exists.", kind, name))
+		}
+	}
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	s.nextID++
+	*docs = append(*docs, document{id: s.nextID, key: name, doc: doc})
+	sort.Sort(byKey(*docs))
+	return s.nextID, nil
+}
+
+// getNamed unmarshals the document named name of docs into v,
+// returning its ID.
+func getNamed(docs []document, kind string, name string, v interface{}) (uint64, error) {
+	for _, d := range docs {
+		if d.key == name {
+			return d.id, json.Unmarshal(d.doc, v)
+		}
+	}
+	return 0, common.NewError404(kind, name)
+}
+
+// deleteNamed deletes the document named name from docs.
+func deleteNamed(docs *[]document, kind string, name string) error {
+	for i, d := range *docs {
+		if d.key == name {
+			*docs = append((*docs)[:i], (*docs)[i+1:]...)
+			return nil
+		}
+	}
+	return common.NewError404(kind, name)
+}
+
+// AddPortList implements policy.Store.
+func (s *Store) AddPortList(ctx context.Context, portList *common.PortList) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.addNamed(&s.portLists, "Port list", portList.Name, portList)
+	if err != nil {
+		return err
+	}
+	portList.ID = id
+	return nil
+}
+
+// ListPortLists implements policy.Store.
+func (s *Store) ListPortLists(ctx context.Context) ([]common.PortList, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	portLists := make([]common.PortList, len(s.portLists))
+	for i, d := range s.portLists {
+		if err := json.Unmarshal(d.doc, &portLists[i]); err != nil {
+			return nil, err
+		}
+		portLists[i].ID = d.id
+	}
+	return portLists, nil
+}
+
+// GetPortList implements policy.Store.
+func (s *Store) GetPortList(ctx context.Context, name string) (common.PortList, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.PortList{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	portList := common.PortList{}
+	id, err := getNamed(s.portLists, "port list", name, &portList)
+	portList.ID = id
+	return portList, err
+}
+
+// DeletePortList implements policy.Store.
+func (s *Store) DeletePortList(ctx context.Context, name string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return deleteNamed(&s.portLists, "port list", name)
+}
+
+// AddTemplate implements policy.Store.
+func (s *Store) AddTemplate(ctx context.Context, template *common.PolicyTemplate) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.addNamed(&s.templates, "Template", template.Name, template)
+	if err != nil {
+		return err
+	}
+	template.ID = id
+	return nil
+}
+
+// ListTemplates implements policy.Store.
+func (s *Store) ListTemplates(ctx context.Context) ([]common.PolicyTemplate, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	templates := make([]common.PolicyTemplate, len(s.templates))
+	for i, d := range s.templates {
+		if err := json.Unmarshal(d.doc, &templates[i]); err != nil {
+			return nil, err
+		}
+		templates[i].ID = d.id
+	}
+	return templates, nil
+}
+
+// GetTemplate implements policy.Store.
+func (s *Store) GetTemplate(ctx context.Context, name string) (common.PolicyTemplate, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.PolicyTemplate{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	template := common.PolicyTemplate{}
+	id, err := getNamed(s.templates, "template", name, &template)
+	template.ID = id
+	return template, err
+}
+
+// DeleteTemplate implements policy.Store.
+func (s *Store) DeleteTemplate(ctx context.Context, name string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return deleteNamed(&s.templates, "template", name)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policytest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/commontest"
+	"github.com/romana/core/policy"
+)
+
+var _ policy.Store = &Store{}
+
+// TestPortLists tests port lists of the policy service kept in the store.
+func TestPortLists(t *testing.T) {
+	store := NewStore()
+	svc := &policy.PolicySvc{}
+	svc.SetStore(store)
+	routes := svc.Routes()
+	config := common.ServiceConfig{
+		Common: common.CommonConfig{Api: &common.Api{}},
+		ServiceSpecific: map[string]interface{}{
+			"store": map[string]interface{}{"type": "memory"},
+		},
+	}
+	if err := svc.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := common.RestContext{Context: context.Background()}
+	for _, name := range []string{"web", "db"} {
+		portList := &common.PortList{Name: name, Ports: []uint{80}}
+		if _, err := commontest.Handler(t, routes, "POST", "/portlists")(portList, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := commontest.Handler(t, routes, "POST", "/portlists")(&common.PortList{Name: "web", Ports: []uint{8080}}, ctx)
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict adding port list web again, got %v", err)
+	}
+	lists, err := commontest.Handler(t, routes, "GET", "/portlists")(nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := lists.([]common.PortList); len(l) != 2 || l[0].Name != "db" || l[1].Name != "web" || l[1].ID != 1 {
+		t.Errorf("Expected port lists db and web, got %+v", l)
+	}
+
+	policyDoc := &common.Policy{Name: "p1", ExternalID: "e1", Rules: common.Rules{{Protocol: "tcp", PortLists: []string{"web"}}}}
+	if err := store.AddPolicy(nil, policyDoc); err != nil {
+		t.Fatal(err)
+	}
+	ctx.PathVariables = map[string]string{"portListName": "web"}
+	_, err = commontest.Handler(t, routes, "DELETE", "/portlists/{portListName}")(nil, ctx)
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict deleting port list in use, got %v", err)
+	}
+	ctx.PathVariables = map[string]string{"portListName": "db"}
+	if _, err := commontest.Handler(t, routes, "DELETE", "/portlists/{portListName}")(nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPortList(nil, "db"); err == nil {
+		t.Error("Expected port list db to be deleted")
+	}
+}
+
+// TestPolicies tests policies and their revisions.
+func TestPolicies(t *testing.T) {
+	store := NewStore()
+	policyDoc := &common.Policy{Name: "p1", ExternalID: "e1"}
+	if err := store.AddPolicy(nil, policyDoc); err != nil {
+		t.Fatal(err)
+	}
+	policyDoc.Revision = 1
+	policyDoc.Description = "updated"
+	if err := store.UpdatePolicy(nil, policyDoc); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdatePolicy(nil, &common.Policy{ID: 42}); err == nil {
+		t.Error("Expected error updating unknown policy")
+	}
+	id, err := store.LookupPolicy(nil, "e1")
+	if err != nil || id != policyDoc.ID {
+		t.Errorf("Expected policy %d, got %d, %v", policyDoc.ID, id, err)
+	}
+	found, err := store.FindPolicyByName(nil, "p1")
+	if err != nil || found.Description != "updated" {
+		t.Errorf("Expected updated policy, got %+v, %v", found, err)
+	}
+	revisions, err := store.ListRevisions(nil, id)
+	if err != nil || len(revisions) != 2 || revisions[0].Policy.Description != "" {
+		t.Errorf("Expected 2 revisions, got %+v, %v", revisions, err)
+	}
+	if removed, err := store.CompactRevisions(nil, 1); err != nil || removed != 1 {
+		t.Errorf("Expected 1 revision removed, got %d, %v", removed, err)
+	}
+	revisions, _ = store.ListRevisions(nil, id)
+	if len(revisions) != 1 || revisions[0].Policy.Description != "updated" {
+		t.Errorf("Expected last revision to be kept, got %+v", revisions)
+	}
+
+	if err := store.InactivatePolicy(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPolicy(nil, id, false); err == nil {
+		t.Error("Expected inactive policy not to be found")
+	}
+	if _, err := store.GetPolicy(nil, id, true); err != nil {
+		t.Errorf("Expected inactive policy to be found, got %v", err)
+	}
+	if policies, _ := store.ListPolicies(nil); len(policies) != 0 {
+		t.Errorf("Expected no active policies, got %+v", policies)
+	}
+	if err := store.RestorePolicy(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPolicy(nil, id, false); err != nil {
+		t.Errorf("Expected restored policy to be found, got %v", err)
+	}
+	if err := store.RestorePolicy(nil, id); err == nil {
+		t.Error("Expected error restoring active policy")
+	}
+	store.InactivatePolicy(nil, id)
+	if purged, _ := store.PurgeDeleted(nil, time.Now().Add(-time.Hour)); purged != 0 {
+		t.Errorf("Expected policy deleted within grace period to be kept, purged %d", purged)
+	}
+	if err := store.DeletePolicy(nil, id); err != nil {
+		t.Fatal(err)
+	}
+	if revisions, _ := store.ListRevisions(nil, id); len(revisions) != 0 {
+		t.Errorf("Expected revisions to be deleted, got %+v", revisions)
+	}
+
+	for _, host := range []string{"host2", "host1", "host2"} {
+		if err := store.SaveHostStatus(nil, common.HostPolicyStatus{Host: host}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses, err := store.ListHostStatus(nil)
+	if err != nil || len(statuses) != 2 || statuses[0].Host != "host1" {
+		t.Errorf("Expected statuses of host1 and host2, got %+v, %v", statuses, err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// addPortList handles POST to /portlists.
+func (policy *PolicySvc) addPortList(input interface{}, ctx common.RestContext) (interface{}, error) {
+	portList := input.(*common.PortList)
+	portList.Name = strings.TrimSpace(portList.Name)
+	if err := portList.Validate(); err != nil {
+		return nil, err
+	}
+	if err := policy.store.AddPortList(ctx.Context, portList); err != nil {
+		return nil, err
+	}
+	return portList, nil
+}
+
+// listPortLists handles GET to /portlists.
+func (policy *PolicySvc) listPortLists(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return policy.store.ListPortLists(ctx.Context)
+}
+
+// getPortList handles GET to /portlists/{portListName}.
+func (policy *PolicySvc) getPortList(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return policy.store.GetPortList(ctx.Context, ctx.PathVariables["portListName"])
+}
+
+// deletePortList handles DELETE to /portlists/{portListName}.
+// Port lists rules of stored policies refer to cannot be deleted.
+func (policy *PolicySvc) deletePortList(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["portListName"]
+	portList, err := policy.store.GetPortList(ctx.Context, name)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := policy.store.ListPolicies(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		for _, rule := range p.Rules {
+			for _, listName := range rule.PortLists {
+				if listName == name {
+					return nil, common.NewErrorConflict(fmt.Sprintf("Port list %s is used by policy %d (%s).", name, p.ID, p.Name))
+				}
+			}
+		}
+	}
+	if err := policy.store.DeletePortList(ctx.Context, name); err != nil {
+		return nil, err
+	}
+	log.Printf("deletePortList(): Deleted port list %s", name)
+	return portList, nil
+}
+
+// resolvePortLists adds ports of the port lists rules of
+// the policy refer to to the ports of the rules.
+func (policy *PolicySvc) resolvePortLists(ctx context.Context, policyDoc *common.Policy) error {
+	for i := range policyDoc.Rules {
+		rule := &policyDoc.Rules[i]
+		for _, name := range rule.PortLists {
+			portList, err := policy.store.GetPortList(ctx, name)
+			if err != nil {
+				return err
+			}
+			rule.Ports = append(rule.Ports, portList.Ports...)
+			rule.PortRanges = append(rule.PortRanges, portList.PortRanges...)
+		}
+	}
+	return nil
+}
+
+// lookupPortLists reports port lists rules of
+// the policy refer to which do not exist.
+func (policy *PolicySvc) lookupPortLists(ctx context.Context, policyDoc *common.Policy) []string {
+	var errs []string
+	for i, rule := range policyDoc.Rules {
+		for _, name := range rule.PortLists {
+			_, err := policy.store.GetPortList(ctx, name)
+			if err == nil {
+				continue
+			}
+			if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+				errs = append(errs, fmt.Sprintf("Rule #%d: Unknown port list %s.", i+1, name))
+			} else {
+				errs = append(errs, fmt.Sprintf("Rule #%d: %s", i+1, err))
+			}
+		}
+	}
+	return errs
+}
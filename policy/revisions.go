@@ -0,0 +1,243 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"reflect"
+	"strconv"
+)
+
+// policyID returns the policy ID from the path.
+func policyID(ctx common.RestContext) (uint64, error) {
+	idStr := ctx.PathVariables["policyID"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return 0, common.NewError404("policy", idStr)
+	}
+	return id, nil
+}
+
+// updatePolicy handles PUT to /policies/{policyID}. It stores the
+// policy as the next revision of the one with the ID and sends
+// it to all agents, which replace the previous revision. The
+// revision being replaced must be given, in the If-Match header
+// or as the revision of the policy.
+func (policy *PolicySvc) updatePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policyDoc := input.(*common.Policy)
+	current, err := policy.store.GetPolicy(ctx.Context, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := common.CheckVersion(ctx, "policy", current.Revision, policyDoc.Revision); err != nil {
+		return nil, err
+	}
+	if err := policyDoc.Validate(); err != nil {
+		return nil, err
+	}
+	if err := policy.augmentPolicy(ctx.Context, policyDoc); err != nil {
+		return nil, err
+	}
+	return policy.storeRevision(ctx, id, policyDoc)
+}
+
+// storeRevision stores the policy as the next revision of the one
+// with the ID and distributes it.
+func (policy *PolicySvc) storeRevision(ctx common.RestContext, id uint64, policyDoc *common.Policy) (interface{}, error) {
+	current, err := policy.store.GetPolicy(ctx.Context, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if current.Revision == 0 {
+		// Stored before revisions were kept.
+		current.Revision = 1
+		if err := policy.store.AddRevision(&current); err != nil {
+			return nil, err
+		}
+	}
+	policyDoc.ID = id
+	policyDoc.Revision = current.Revision + 1
+	if err := policy.store.UpdatePolicy(ctx.Context, policyDoc); err != nil {
+		return nil, err
+	}
+	log.Printf("storeRevision(): Policy %d is at revision %d", id, policyDoc.Revision)
+	if err := policy.distributePolicy(policyDoc); err != nil {
+		return nil, err
+	}
+	policyDoc.Datacenter = nil
+	common.PublishEvent(policy.bus, common.BusTopicPolicies, common.PolicyUpdated, policyDoc)
+	return policyDoc, nil
+}
+
+// listRevisions handles GET to /policies/{policyID}/revisions.
+func (policy *PolicySvc) listRevisions(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := policy.store.GetPolicy(ctx.Context, id, false); err != nil {
+		return nil, err
+	}
+	revisions, err := policy.store.ListRevisions(ctx.Context, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		revisions[i].Policy.Datacenter = nil
+	}
+	return revisions, nil
+}
+
+// diffRevisions handles GET to /policies/{policyID}/diff, comparing
+// revisions given by from and to query variables. To defaults to the
+// current revision and from to the one before to.
+func (policy *PolicySvc) diffRevisions(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := policy.store.GetPolicy(ctx.Context, id, false)
+	if err != nil {
+		return nil, err
+	}
+	diff := common.PolicyDiff{ID: id, To: current.Revision}
+	for _, v := range []struct {
+		name  string
+		value *uint64
+	}{{"from", &diff.From}, {"to", &diff.To}} {
+		if s := ctx.QueryVariables.Get(v.name); s != "" {
+			if *v.value, err = strconv.ParseUint(s, 10, 64); err != nil {
+				return nil, common.NewError400(fmt.Sprintf("Invalid %s: %s", v.name, s))
+			}
+		}
+	}
+	if ctx.QueryVariables.Get("from") == "" {
+		if diff.To < 2 {
+			return nil, common.NewError400("No revision before revision 1, from is required")
+		}
+		diff.From = diff.To - 1
+	}
+	from, err := policy.store.GetRevision(ctx.Context, id, diff.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := policy.store.GetRevision(ctx.Context, id, diff.To)
+	if err != nil {
+		return nil, err
+	}
+	diff.Changes = policyChanges(from, to)
+	return diff, nil
+}
+
+// rollbackPolicy handles POST to /policies/{policyID}/rollback. It
+// stores the requested revision of the policy as its next revision
+// and sends that to all agents.
+func (policy *PolicySvc) rollbackPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rollback := input.(*common.PolicyRollback)
+	policyDoc, err := policy.store.GetRevision(ctx.Context, id, rollback.Revision)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("rollbackPolicy(): Rolling policy %d back to revision %d", id, rollback.Revision)
+	return policy.storeRevision(ctx, id, &policyDoc)
+}
+
+// policyChanges returns changes of fields users set from
+// one revision of a policy to another.
+func policyChanges(from common.Policy, to common.Policy) []common.PolicyChange {
+	changes := []common.PolicyChange{}
+	for _, field := range []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"name", from.Name, to.Name},
+		{"description", from.Description, to.Description},
+		{"external_id", from.ExternalID, to.ExternalID},
+		{"direction", from.Direction, to.Direction},
+		{"action", from.Action, to.Action},
+		{"priority", from.Priority, to.Priority},
+	} {
+		if field.from != field.to {
+			changes = append(changes, common.PolicyChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	for _, field := range []struct {
+		name     string
+		from, to []interface{}
+	}{
+		{"applied_to", endpointEntries(from.AppliedTo), endpointEntries(to.AppliedTo)},
+		{"peers", endpointEntries(from.Peers), endpointEntries(to.Peers)},
+		{"rules", ruleEntries(from.Rules), ruleEntries(to.Rules)},
+	} {
+		removed, added := listChanges(field.from, field.to)
+		if len(removed) > 0 || len(added) > 0 {
+			changes = append(changes, common.PolicyChange{Field: field.name, From: removed, To: added})
+		}
+	}
+	return changes
+}
+
+func endpointEntries(endpoints []common.Endpoint) []interface{} {
+	entries := make([]interface{}, len(endpoints))
+	for i, endpoint := range endpoints {
+		entries[i] = endpoint
+	}
+	return entries
+}
+
+func ruleEntries(rules []common.Rule) []interface{} {
+	entries := make([]interface{}, len(rules))
+	for i, rule := range rules {
+		entries[i] = rule
+	}
+	return entries
+}
+
+// listChanges returns entries of from missing in to (removed)
+// and entries of to missing in from (added).
+func listChanges(from []interface{}, to []interface{}) ([]interface{}, []interface{}) {
+	var removed, added []interface{}
+	for _, entry := range from {
+		if !containsEntry(to, entry) {
+			removed = append(removed, entry)
+		}
+	}
+	for _, entry := range to {
+		if !containsEntry(from, entry) {
+			added = append(added, entry)
+		}
+	}
+	return removed, added
+}
+
+func containsEntry(list []interface{}, entry interface{}) bool {
+	for _, e := range list {
+		if reflect.DeepEqual(e, entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"github.com/romana/core/common"
+	"log"
+	"time"
+)
+
+// reportStatus handles POST to /policies/status, by which agents
+// report the policies they have applied.
+func (policy *PolicySvc) reportStatus(input interface{}, ctx common.RestContext) (interface{}, error) {
+	status := input.(*common.HostPolicyStatus)
+	if status.Host == "" {
+		return nil, common.NewError400("Host is required.")
+	}
+	status.Timestamp = time.Now().Unix()
+	if err := policy.store.SaveHostStatus(ctx.Context, *status); err != nil {
+		return nil, err
+	}
+	log.Printf("reportStatus(): Host %s applied %d policies", status.Host, len(status.Policies))
+	return status, nil
+}
+
+// listRollouts handles GET to /policies/status.
+func (policy *PolicySvc) listRollouts(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policies, err := policy.store.ListPolicies(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	return policy.rollouts(ctx, policies)
+}
+
+// getRollout handles GET to /policies/{policyID}/status.
+func (policy *PolicySvc) getRollout(input interface{}, ctx common.RestContext) (interface{}, error) {
+	id, err := policyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policyDoc, err := policy.store.GetPolicy(ctx.Context, id, false)
+	if err != nil {
+		return nil, err
+	}
+	rollouts, err := policy.rollouts(ctx, []common.Policy{policyDoc})
+	if err != nil {
+		return nil, err
+	}
+	return rollouts[0], nil
+}
+
+// rollouts compares the policies to what the hosts known to the
+// topology service report applying.
+func (policy *PolicySvc) rollouts(ctx common.RestContext, policies []common.Policy) ([]common.PolicyRollout, error) {
+	hosts, err := policy.client.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := policy.store.ListHostStatus(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	return policyRollouts(policies, hosts, statuses), nil
+}
+
+// policyRollouts returns, for every policy, the hosts which have
+// applied its revision, failed to, or not reported it yet. Hosts
+// report under their names, or addresses if they have none.
+func policyRollouts(policies []common.Policy, hosts []common.Host, statuses []common.HostPolicyStatus) []common.PolicyRollout {
+	byHost := make(map[string]common.HostPolicyStatus)
+	for _, status := range statuses {
+		byHost[status.Host] = status
+	}
+	rollouts := make([]common.PolicyRollout, len(policies))
+	for i, p := range policies {
+		rollout := common.PolicyRollout{ID: p.ID, Name: p.Name, Revision: p.Revision, Applied: []string{}}
+		for _, host := range hosts {
+			name := host.Name
+			if name == "" {
+				name = host.Ip
+			}
+			status, ok := byHost[name]
+			if !ok {
+				rollout.Pending = append(rollout.Pending, name)
+				continue
+			}
+			applied := false
+			for _, a := range status.Policies {
+				if a.ID != p.ID || a.Revision < p.Revision {
+					continue
+				}
+				if a.Error != "" {
+					if rollout.Failed == nil {
+						rollout.Failed = make(map[string]string)
+					}
+					rollout.Failed[name] = a.Error
+				} else {
+					applied = true
+				}
+				break
+			}
+			switch {
+			case applied:
+				rollout.Applied = append(rollout.Applied, name)
+			case rollout.Failed[name] == "":
+				rollout.Pending = append(rollout.Pending, name)
+			}
+		}
+		rollout.Complete = len(rollout.Pending) == 0 && len(rollout.Failed) == 0
+		rollouts[i] = rollout
+	}
+	return rollouts
+}
@@ -15,8 +15,11 @@
 package policy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/romana/core/common"
@@ -24,11 +27,58 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// Store keeps policies with their revisions, statuses hosts report,
+// port lists and policy templates. policyStore keeps them in the
+// database configured; package policytest provides one keeping
+// them in memory.
+type Store interface {
+	SetConfig(config map[string]interface{}) error
+	Connect() error
+	CreateSchema(force bool) error
+	Ping() error
+
+	AddPolicy(ctx context.Context, policyDoc *common.Policy) error
+	UpdatePolicy(ctx context.Context, policyDoc *common.Policy) error
+	AddRevision(policyDoc *common.Policy) error
+	ListRevisions(ctx context.Context, id uint64) ([]common.PolicyRevision, error)
+	GetRevision(ctx context.Context, id uint64, revision uint64) (common.Policy, error)
+	// CompactRevisions removes all but the last keep revisions
+	// of each policy, returning how many were removed.
+	CompactRevisions(ctx context.Context, keep int) (int64, error)
+	ListPolicies(ctx context.Context) ([]common.Policy, error)
+	LookupPolicy(ctx context.Context, externalID string) (uint64, error)
+	GetPolicy(ctx context.Context, id uint64, markedDeleted bool) (common.Policy, error)
+	InactivatePolicy(ctx context.Context, id uint64) error
+	FindPolicyByName(ctx context.Context, name string) (common.Policy, error)
+	DeletePolicy(ctx context.Context, id uint64) error
+	// Inactive policies are kept for the deletion grace period,
+	// during which they can be restored (see common.Purger).
+	common.Purger
+	RestorePolicy(ctx context.Context, id uint64) error
+
+	SaveHostStatus(ctx context.Context, status common.HostPolicyStatus) error
+	ListHostStatus(ctx context.Context) ([]common.HostPolicyStatus, error)
+
+	AddPortList(ctx context.Context, portList *common.PortList) error
+	ListPortLists(ctx context.Context) ([]common.PortList, error)
+	GetPortList(ctx context.Context, name string) (common.PortList, error)
+	DeletePortList(ctx context.Context, name string) error
+
+	AddTemplate(ctx context.Context, template *common.PolicyTemplate) error
+	ListTemplates(ctx context.Context) ([]common.PolicyTemplate, error)
+	GetTemplate(ctx context.Context, name string) (common.PolicyTemplate, error)
+	DeleteTemplate(ctx context.Context, name string) error
+}
+
+// policyStore implements Store in a database.
 type policyStore struct {
 	common.DbStore
 }
 
-func (policyStore *policyStore) addPolicy(policyDoc *common.Policy) error {
+func (policyStore *policyStore) AddPolicy(ctx context.Context, policyDoc *common.Policy) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 	// TODO ensure uniqueness of datacenter/external ID combination.
 	// TODO assume that external ID is taken from name if not specified.
 	// At least one must be specified.
@@ -36,6 +86,7 @@ func (policyStore *policyStore) addPolicy(policyDoc *common.Policy) error {
 	policyDb := &PolicyDb{}
 	policyDb.Policy = string(json)
 	policyDb.ExternalID = policyDoc.ExternalID
+	policyDb.Revision = policyDoc.Revision
 	db := policyStore.DbStore.Db
 	db.Create(policyDb)
 	err = common.GetDbErrors(db)
@@ -48,11 +99,113 @@ func (policyStore *policyStore) addPolicy(policyDoc *common.Policy) error {
 		return err
 	}
 	policyDoc.ID = policyDb.ID
-	log.Printf("addPolicy(): Stored %s with ID %d", policyDoc.Name, policyDb.ID)
-	return nil
+	policyDoc.CreatedAt = policyDb.CreatedAt
+	policyDoc.UpdatedAt = policyDb.UpdatedAt
+	log.Printf("AddPolicy(): Stored %s with ID %d", policyDoc.Name, policyDb.ID)
+	return policyStore.AddRevision(policyDoc)
+}
+
+// UpdatePolicy replaces the stored policy with the new revision of it,
+// keeping the old one among its revisions. It returns 409 if the policy
+// is already at that revision or a later one, that is, another update
+// was stored since the one this follows was read.
+func (policyStore *policyStore) UpdatePolicy(ctx context.Context, policyDoc *common.Policy) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	json, err := json.Marshal(policyDoc)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	db := policyStore.DbStore.Db
+	db = db.Model(&PolicyDb{}).Where("id = ? AND revision < ?", policyDoc.ID, policyDoc.Revision).Updates(map[string]interface{}{
+		"policy":      string(json),
+		"external_id": policyDoc.ExternalID,
+		"revision":    policyDoc.Revision,
+		"updated_at":  now,
+	})
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		var count int
+		db = policyStore.DbStore.Db.Model(&PolicyDb{}).Where("id = ?", policyDoc.ID).Count(&count)
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+		if count == 0 {
+			return common.NewError404("policy", strconv.FormatUint(policyDoc.ID, 10))
+		}
+		return common.NewErrorConflict(fmt.Sprintf("Policy %d changed concurrently, reload it and retry", policyDoc.ID))
+	}
+	policyDoc.UpdatedAt = &now
+	log.Printf("UpdatePolicy(): Stored revision %d of policy %d", policyDoc.Revision, policyDoc.ID)
+	return policyStore.AddRevision(policyDoc)
+}
+
+// AddRevision keeps the revision of the policy.
+func (policyStore *policyStore) AddRevision(policyDoc *common.Policy) error {
+	json, err := json.Marshal(policyDoc)
+	if err != nil {
+		return err
+	}
+	revisionDb := &PolicyRevisionDb{
+		PolicyID:  policyDoc.ID,
+		Revision:  policyDoc.Revision,
+		Policy:    string(json),
+		Timestamp: time.Now().Unix(),
+	}
+	db := policyStore.DbStore.Db.Create(revisionDb)
+	return common.GetDbErrors(db)
+}
+
+// ListRevisions returns revisions of the policy, oldest first.
+func (policyStore *policyStore) ListRevisions(ctx context.Context, id uint64) ([]common.PolicyRevision, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var revisionDb []PolicyRevisionDb
+	db := policyStore.DbStore.Db.Where("policy_id = ?", id).Order("revision").Find(&revisionDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return nil, err
+	}
+	revisions := make([]common.PolicyRevision, len(revisionDb))
+	for i, r := range revisionDb {
+		revisions[i] = common.PolicyRevision{Revision: r.Revision, Timestamp: r.Timestamp}
+		if err := json.Unmarshal([]byte(r.Policy), &revisions[i].Policy); err != nil {
+			return nil, err
+		}
+		revisions[i].Policy.ID = id
+	}
+	return revisions, nil
+}
+
+// GetRevision returns the revision of the policy.
+func (policyStore *policyStore) GetRevision(ctx context.Context, id uint64, revision uint64) (common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Policy{}, err
+	}
+	revisionDb := PolicyRevisionDb{}
+	db := policyStore.DbStore.Db.Where("policy_id = ? AND revision = ?", id, revision).First(&revisionDb)
+	if db.RecordNotFound() {
+		return common.Policy{}, common.NewError404("policy revision", fmt.Sprintf("%d/%d", id, revision))
+	}
+	if err := common.GetDbErrors(db); err != nil {
+		return common.Policy{}, err
+	}
+	policyDoc := common.Policy{}
+	if err := json.Unmarshal([]byte(revisionDb.Policy), &policyDoc); err != nil {
+		return policyDoc, err
+	}
+	policyDoc.ID = id
+	return policyDoc, nil
 }
 
-func (policyStore *policyStore) listPolicies() ([]common.Policy, error) {
+func (policyStore *policyStore) ListPolicies(ctx context.Context) ([]common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 	var policyDb []PolicyDb
 	var policies []common.Policy
 	db := policyStore.DbStore.Db.Find(&policyDb)
@@ -63,12 +216,15 @@ func (policyStore *policyStore) listPolicies() ([]common.Policy, error) {
 	policies = make([]common.Policy, len(policyDb))
 	for i, p := range policyDb {
 		json.Unmarshal([]byte(p.Policy), &policies[i])
-		policies[i].ID = p.ID
+		p.setStored(&policies[i])
 	}
 	return policies, err
 }
 
-func (policyStore *policyStore) lookupPolicy(externalID string) (uint64, error) {
+func (policyStore *policyStore) LookupPolicy(ctx context.Context, externalID string) (uint64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
 	policyDbEntry := PolicyDb{}
 	log.Printf("Looking up policy with id = %s ", externalID)
 	db := policyStore.DbStore.Db.First(&policyDbEntry, "external_id = ?", externalID)
@@ -83,7 +239,10 @@ func (policyStore *policyStore) lookupPolicy(externalID string) (uint64, error)
 	return policyDbEntry.ID, nil
 }
 
-func (policyStore *policyStore) getPolicy(id uint64, markedDeleted bool) (common.Policy, error) {
+func (policyStore *policyStore) GetPolicy(ctx context.Context, id uint64, markedDeleted bool) (common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Policy{}, err
+	}
 	policyDbEntry := PolicyDb{}
 	policyDoc := common.Policy{}
 	log.Printf("Looking up policy with id = %v (deleted: %v)", id, markedDeleted)
@@ -110,14 +269,17 @@ func (policyStore *policyStore) getPolicy(id uint64, markedDeleted bool) (common
 	if err != nil {
 		return policyDoc, err
 	}
-	policyDoc.ID = policyDbEntry.ID
+	policyDbEntry.setStored(&policyDoc)
 	return policyDoc, err
 }
 
-// inactivatePolicy marks policy as inactive. This is done
+// InactivatePolicy marks policy as inactive. This is done
 // upon receiving a DELETE request but before distributing
 // this request to agents.
-func (policyStore *policyStore) inactivatePolicy(id uint64) error {
+func (policyStore *policyStore) InactivatePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 	policyDb := &PolicyDb{}
 	db := policyStore.DbStore.Db
 	db = db.Where("id = ?", id).Delete(policyDb)
@@ -131,10 +293,13 @@ func (policyStore *policyStore) inactivatePolicy(id uint64) error {
 	return nil
 }
 
-// findPolicyByName returns first found policy corresponding to policy
+// FindPolicyByName returns first found policy corresponding to policy
 // name provided. Policy names are not unique, thus the return
 // value is the first policy found in the list of policies present.
-func (policyStore *policyStore) findPolicyByName(name string) (common.Policy, error) {
+func (policyStore *policyStore) FindPolicyByName(ctx context.Context, name string) (common.Policy, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Policy{}, err
+	}
 	var policyDb []PolicyDb
 	var policies []common.Policy
 	log.Println("In findPoliciesByName()")
@@ -150,14 +315,17 @@ func (policyStore *policyStore) findPolicyByName(name string) (common.Policy, er
 			return common.Policy{}, err
 		}
 		if policies[i].Name == name {
-			policies[i].ID = p.ID
+			p.setStored(&policies[i])
 			return policies[i], nil
 		}
 	}
 	return common.Policy{}, common.NewError404("policy", name)
 }
 
-func (policyStore *policyStore) deletePolicy(id uint64) error {
+func (policyStore *policyStore) DeletePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 	policyDb := &PolicyDb{}
 	db := policyStore.DbStore.Db
 	db = db.Unscoped().Where("id = ?", id).Delete(policyDb)
@@ -168,6 +336,279 @@ func (policyStore *policyStore) deletePolicy(id uint64) error {
 	if err != nil {
 		return err
 	}
+	db = policyStore.DbStore.Db.Where("policy_id = ?", id).Delete(&PolicyRevisionDb{})
+	return common.GetDbErrors(db)
+}
+
+// RestorePolicy makes the inactive policy active again.
+func (policyStore *policyStore) RestorePolicy(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	n, err := common.Undelete(policyStore.DbStore.Db, &PolicyDb{}, "id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.NewError404("deleted policy", strconv.FormatUint(id, 10))
+	}
+	return nil
+}
+
+// PurgeDeleted implements common.Purger, also removing
+// revisions of the policies purged.
+func (policyStore *policyStore) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	purged, err := policyStore.DbStore.PurgeDeleted(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	db := policyStore.DbStore.Db.Where("policy_id NOT IN (SELECT id FROM policies)").Delete(&PolicyRevisionDb{})
+	return purged, common.GetDbErrors(db)
+}
+
+// CompactRevisions implements Store.
+func (policyStore *policyStore) CompactRevisions(ctx context.Context, keep int) (int64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	var revisions []PolicyRevisionDb
+	db := policyStore.DbStore.Db.Select("policy_id, revision").Order("policy_id, revision DESC").Find(&revisions)
+	if err := common.GetDbErrors(db); err != nil {
+		return 0, err
+	}
+	// Oldest revision kept of policies with more revisions.
+	oldest := make(map[uint64]uint64)
+	count := make(map[uint64]int)
+	for _, r := range revisions {
+		count[r.PolicyID]++
+		if count[r.PolicyID] == keep {
+			oldest[r.PolicyID] = r.Revision
+		}
+	}
+	var removed int64
+	tx := policyStore.DbStore.Db.Begin()
+	for id, revision := range oldest {
+		if count[id] == keep {
+			continue
+		}
+		db = tx.Where("policy_id = ? AND revision < ?", id, revision).Delete(PolicyRevisionDb{})
+		if err := common.GetDbErrors(db); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		removed += db.RowsAffected
+	}
+	if err := common.GetDbErrors(tx.Commit()); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// SaveHostStatus stores the status reported by the host,
+// replacing the one it reported before.
+func (policyStore *policyStore) SaveHostStatus(ctx context.Context, status common.HostPolicyStatus) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	statusDb := &HostStatusDb{}
+	db := policyStore.DbStore.Db.Where("host = ?", status.Host).First(statusDb)
+	if !db.RecordNotFound() {
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+	}
+	statusDb.Host = status.Host
+	statusDb.Status = string(doc)
+	db = policyStore.DbStore.Db.Save(statusDb)
+	return common.GetDbErrors(db)
+}
+
+// ListHostStatus returns statuses reported by hosts.
+func (policyStore *policyStore) ListHostStatus(ctx context.Context) ([]common.HostPolicyStatus, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var statusDb []HostStatusDb
+	db := policyStore.DbStore.Db.Order("host").Find(&statusDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return nil, err
+	}
+	statuses := make([]common.HostPolicyStatus, len(statusDb))
+	for i, s := range statusDb {
+		if err := json.Unmarshal([]byte(s.Status), &statuses[i]); err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// AddPortList stores the port list, whose name must not be taken.
+func (policyStore *policyStore) AddPortList(ctx context.Context, portList *common.PortList) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	portListDb := &PortListDb{}
+	db := policyStore.DbStore.Db.Where("name = ?", portList.Name).First(portListDb)
+	if !db.RecordNotFound() {
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+		return common.NewErrorConflict(fmt.Sprintf("Port list %s already exists.", portList.Name))
+	}
+	doc, err := json.Marshal(portList)
+	if err != nil {
+		return err
+	}
+	portListDb = &PortListDb{Name: portList.Name, PortList: string(doc)}
+	db = policyStore.DbStore.Db.Create(portListDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	portList.ID = portListDb.ID
+	log.Printf("AddPortList(): Stored %s with ID %d", portList.Name, portList.ID)
+	return nil
+}
+
+// ListPortLists returns port lists ordered by name.
+func (policyStore *policyStore) ListPortLists(ctx context.Context) ([]common.PortList, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var portListDb []PortListDb
+	db := policyStore.DbStore.Db.Order("name").Find(&portListDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return nil, err
+	}
+	portLists := make([]common.PortList, len(portListDb))
+	for i, l := range portListDb {
+		if err := json.Unmarshal([]byte(l.PortList), &portLists[i]); err != nil {
+			return nil, err
+		}
+		portLists[i].ID = l.ID
+	}
+	return portLists, nil
+}
+
+// GetPortList returns the port list with the name.
+func (policyStore *policyStore) GetPortList(ctx context.Context, name string) (common.PortList, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.PortList{}, err
+	}
+	portListDb := PortListDb{}
+	db := policyStore.DbStore.Db.Where("name = ?", name).First(&portListDb)
+	if db.RecordNotFound() {
+		return common.PortList{}, common.NewError404("port list", name)
+	}
+	if err := common.GetDbErrors(db); err != nil {
+		return common.PortList{}, err
+	}
+	portList := common.PortList{}
+	if err := json.Unmarshal([]byte(portListDb.PortList), &portList); err != nil {
+		return portList, err
+	}
+	portList.ID = portListDb.ID
+	return portList, nil
+}
+
+// DeletePortList deletes the port list with the name.
+func (policyStore *policyStore) DeletePortList(ctx context.Context, name string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	db := policyStore.DbStore.Db.Where("name = ?", name).Delete(&PortListDb{})
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return common.NewError404("port list", name)
+	}
+	return nil
+}
+
+// AddTemplate stores the policy template, whose name must not be taken.
+func (policyStore *policyStore) AddTemplate(ctx context.Context, template *common.PolicyTemplate) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	templateDb := &PolicyTemplateDb{}
+	db := policyStore.DbStore.Db.Where("name = ?", template.Name).First(templateDb)
+	if !db.RecordNotFound() {
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+		return common.NewErrorConflict(fmt.Sprintf("Template %s already exists.", template.Name))
+	}
+	doc, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	templateDb = &PolicyTemplateDb{Name: template.Name, Template: string(doc)}
+	db = policyStore.DbStore.Db.Create(templateDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	template.ID = templateDb.ID
+	log.Printf("AddTemplate(): Stored %s with ID %d", template.Name, template.ID)
+	return nil
+}
+
+// ListTemplates returns policy templates ordered by name.
+func (policyStore *policyStore) ListTemplates(ctx context.Context) ([]common.PolicyTemplate, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var templateDb []PolicyTemplateDb
+	db := policyStore.DbStore.Db.Order("name").Find(&templateDb)
+	if err := common.GetDbErrors(db); err != nil {
+		return nil, err
+	}
+	templates := make([]common.PolicyTemplate, len(templateDb))
+	for i, t := range templateDb {
+		if err := json.Unmarshal([]byte(t.Template), &templates[i]); err != nil {
+			return nil, err
+		}
+		templates[i].ID = t.ID
+	}
+	return templates, nil
+}
+
+// GetTemplate returns the policy template with the name.
+func (policyStore *policyStore) GetTemplate(ctx context.Context, name string) (common.PolicyTemplate, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.PolicyTemplate{}, err
+	}
+	templateDb := PolicyTemplateDb{}
+	db := policyStore.DbStore.Db.Where("name = ?", name).First(&templateDb)
+	if db.RecordNotFound() {
+		return common.PolicyTemplate{}, common.NewError404("template", name)
+	}
+	if err := common.GetDbErrors(db); err != nil {
+		return common.PolicyTemplate{}, err
+	}
+	template := common.PolicyTemplate{}
+	if err := json.Unmarshal([]byte(templateDb.Template), &template); err != nil {
+		return template, err
+	}
+	template.ID = templateDb.ID
+	return template, nil
+}
+
+// DeleteTemplate deletes the policy template with the name.
+func (policyStore *policyStore) DeleteTemplate(ctx context.Context, name string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	db := policyStore.DbStore.Db.Where("name = ?", name).Delete(&PolicyTemplateDb{})
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return common.NewError404("template", name)
+	}
 	return nil
 }
 
@@ -186,9 +627,14 @@ type PolicyDb struct {
 	Policy       string `sql:"type:TEXT"`
 	ExternalID   string
 	DatacenterID string
+	// Revision of the policy document, for updates
+	// to check they follow the last one.
+	Revision uint64 `sql:"not null;default:0"`
 	// DeletedAt is for using soft delete functionality
 	// from http://jinzhu.me/gorm/curd.html#delete
 	DeletedAt *time.Time
+	CreatedAt *time.Time
+	UpdatedAt *time.Time
 	//	Comment string `gorm:"type:varchar(8192)"`
 }
 
@@ -197,10 +643,73 @@ func (PolicyDb) TableName() string {
 	return "policies"
 }
 
+// setStored sets the fields of the policy document that the
+// store keeps in columns rather than in the document itself.
+func (p PolicyDb) setStored(policyDoc *common.Policy) {
+	policyDoc.ID = p.ID
+	policyDoc.CreatedAt = p.CreatedAt
+	policyDoc.UpdatedAt = p.UpdatedAt
+}
+
+// PolicyRevisionDb keeps a revision of a policy, as JSON.
+type PolicyRevisionDb struct {
+	ID        uint64 `sql:"AUTO_INCREMENT"`
+	PolicyID  uint64
+	Revision  uint64
+	Policy    string `sql:"type:TEXT"`
+	Timestamp int64
+}
+
+// TableName specifies a nicer-looking table name.
+func (PolicyRevisionDb) TableName() string {
+	return "policy_revisions"
+}
+
+// HostStatusDb keeps the latest common.HostPolicyStatus
+// reported by a host, as JSON.
+type HostStatusDb struct {
+	ID     uint64 `sql:"AUTO_INCREMENT"`
+	Host   string `sql:"unique"`
+	Status string `sql:"type:TEXT"`
+}
+
+// TableName specifies a nicer-looking table name.
+func (HostStatusDb) TableName() string {
+	return "host_policy_status"
+}
+
+// PortListDb keeps a common.PortList as JSON.
+type PortListDb struct {
+	ID       uint64 `sql:"AUTO_INCREMENT"`
+	Name     string `sql:"unique"`
+	PortList string `sql:"type:TEXT"`
+}
+
+// TableName specifies a nicer-looking table name.
+func (PortListDb) TableName() string {
+	return "port_lists"
+}
+
+// PolicyTemplateDb keeps a common.PolicyTemplate as JSON.
+type PolicyTemplateDb struct {
+	ID       uint64 `sql:"AUTO_INCREMENT"`
+	Name     string `sql:"unique"`
+	Template string `sql:"type:TEXT"`
+}
+
+// TableName specifies a nicer-looking table name.
+func (PolicyTemplateDb) TableName() string {
+	return "policy_templates"
+}
+
 // Entities implements Entities method of
 // Service interface.
 func (policyStore *policyStore) Entities() []interface{} {
-	retval := make([]interface{}, 1)
+	retval := make([]interface{}, 5)
 	retval[0] = &PolicyDb{}
+	retval[1] = &HostStatusDb{}
+	retval[2] = &PolicyRevisionDb{}
+	retval[3] = &PortListDb{}
+	retval[4] = &PolicyTemplateDb{}
 	return retval
 }
@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"github.com/romana/core/common"
+	"log"
+	"strings"
+)
+
+// addTemplate handles POST to /templates.
+func (policy *PolicySvc) addTemplate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	template := input.(*common.PolicyTemplate)
+	template.Name = strings.TrimSpace(template.Name)
+	if err := template.Validate(); err != nil {
+		return nil, err
+	}
+	if err := policy.store.AddTemplate(ctx.Context, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// listTemplates handles GET to /templates.
+func (policy *PolicySvc) listTemplates(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return policy.store.ListTemplates(ctx.Context)
+}
+
+// getTemplate handles GET to /templates/{templateName}.
+func (policy *PolicySvc) getTemplate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return policy.store.GetTemplate(ctx.Context, ctx.PathVariables["templateName"])
+}
+
+// deleteTemplate handles DELETE to /templates/{templateName}. Policies
+// created from the template are kept.
+func (policy *PolicySvc) deleteTemplate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["templateName"]
+	template, err := policy.store.GetTemplate(ctx.Context, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.store.DeleteTemplate(ctx.Context, name); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// instantiateTemplate handles POST to /templates/{templateName}/instantiate.
+// It creates a policy from the template with the parameters given and
+// adds it as a POST to /policies would.
+func (policy *PolicySvc) instantiateTemplate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	instance := input.(*common.PolicyTemplateInstance)
+	template, err := policy.store.GetTemplate(ctx.Context, ctx.PathVariables["templateName"])
+	if err != nil {
+		return nil, err
+	}
+	policyDoc, err := template.Instantiate(instance.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("instantiateTemplate(): Creating policy %s from template %s", policyDoc.Name, template.Name)
+	return policy.addPolicy(&policyDoc, ctx)
+}
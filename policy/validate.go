@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package policy
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/netutil"
+	"net"
+	"net/http"
+)
+
+// validatePolicy handles POST to /policies/validate. It checks the
+// policy as addPolicy would, without storing or distributing it,
+// and reports all problems found.
+func (policy *PolicySvc) validatePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policyDoc := input.(*common.Policy)
+	retval := common.PolicyValidationResponse{}
+	err := policyDoc.Validate()
+	if err != nil {
+		if httpErr, ok := err.(common.HttpError); ok {
+			if msgs, ok := httpErr.Details.([]string); ok {
+				retval.Errors = append(retval.Errors, msgs...)
+			} else {
+				retval.Errors = append(retval.Errors, err.Error())
+			}
+		} else {
+			retval.Errors = append(retval.Errors, err.Error())
+		}
+	}
+	retval.Errors = append(retval.Errors, policy.lookupEndpoints("applied_to", policyDoc.AppliedTo)...)
+	retval.Errors = append(retval.Errors, policy.lookupEndpoints("peers", policyDoc.Peers)...)
+	retval.Errors = append(retval.Errors, overlappingCidrs(policyDoc)...)
+	retval.Errors = append(retval.Errors, policy.lookupPortLists(ctx.Context, policyDoc)...)
+	for i, rule := range policyDoc.Rules {
+		if rule.IsStateful {
+			retval.Errors = append(retval.Errors, fmt.Sprintf("Rule #%d: Stateful rules are not supported.", i+1))
+		}
+	}
+	retval.Valid = len(retval.Errors) == 0
+	return retval, nil
+}
+
+// lookupEndpoints looks up tenants and segments of endpoints
+// (in the policy's section named by field) in the tenant service.
+func (policy *PolicySvc) lookupEndpoints(field string, endpoints []common.Endpoint) []string {
+	var errs []string
+	for i, endpoint := range endpoints {
+		if endpoint.Peer != "" || endpoint.Cidr != "" {
+			continue
+		}
+		// augmentEndpoint fills in network IDs; keep the policy as it is.
+		err := policy.augmentEndpoint(&endpoint)
+		if err == nil {
+			continue
+		}
+		if httpErr, ok := err.(common.HttpError); ok && httpErr.StatusCode == http.StatusNotFound {
+			errs = append(errs, fmt.Sprintf("%s entry #%d: Unknown tenant or segment.", field, i+1))
+		} else {
+			errs = append(errs, fmt.Sprintf("%s entry #%d: %s", field, i+1, err))
+		}
+	}
+	return errs
+}
+
+// overlappingCidrs reports invalid CIDRs of the policy's
+// endpoints and pairs of them that overlap. Blocks excepted from
+// a peer's CIDR are not taken into account.
+func overlappingCidrs(policyDoc *common.Policy) []string {
+	type cidrEntry struct {
+		name  string
+		ipNet *net.IPNet
+	}
+	var errs []string
+	var cidrs []cidrEntry
+	sections := []struct {
+		field     string
+		endpoints []common.Endpoint
+	}{{"applied_to", policyDoc.AppliedTo}, {"peers", policyDoc.Peers}}
+	for _, section := range sections {
+		for i, endpoint := range section.endpoints {
+			if endpoint.Cidr == "" {
+				continue
+			}
+			name := fmt.Sprintf("%s entry #%d", section.field, i+1)
+			ipNet, err := netutil.ParseCIDR(endpoint.Cidr)
+			if err != nil {
+				// Validate reports invalid CIDRs of peers.
+				if section.field != "peers" {
+					errs = append(errs, fmt.Sprintf("%s: Invalid CIDR %s.", name, endpoint.Cidr))
+				}
+				continue
+			}
+			cidrs = append(cidrs, cidrEntry{name, ipNet})
+		}
+	}
+	for i := range cidrs {
+		for j := i + 1; j < len(cidrs); j++ {
+			a, b := cidrs[i].ipNet, cidrs[j].ipNet
+			if netutil.Overlaps(a, b) {
+				errs = append(errs, fmt.Sprintf("%s and %s: CIDRs %s and %s overlap.", cidrs[i].name, cidrs[j].name, a, b))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,613 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/adaptor"
+	"github.com/romana/core/romana/util"
+	"github.com/romana/core/tenant"
+
+	"github.com/go-yaml/yaml"
+	cli "github.com/spf13/cobra"
+)
+
+var (
+	applyFile   string
+	applyDryRun bool
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cli.Command{
+	Use:   "apply [file]",
+	Short: "Create or update hosts, tenants, segments and policies from a file.",
+	Long: `Create or update hosts, tenants, segments and policies from a file.
+
+The file (or STDIN if it is "-") is a YAML or JSON document with the
+lists "hosts", "tenants" (each with its "segments") and "policies",
+using the field names of the REST APIs, or a CSV file with rows:
+
+    host,NAME,IP,ROMANA_CIDR[,AGENT_PORT]
+    tenant,NAME[,EXTERNAL_ID]
+    segment,TENANT,NAME[,EXTERNAL_ID]
+
+Resources are matched to existing ones by name: missing ones are
+created, those that differ are updated and the rest are left alone,
+so applying a file again changes nothing. A summary is printed
+with created (+), updated (~) and unchanged resources.
+
+For more information, please check http://romana.io
+`,
+	RunE:         apply,
+	SilenceUsage: true,
+}
+
+func init() {
+	applyCmd.Flags().StringVarP(&applyFile, "filename", "", "", "File to apply, same as the file argument")
+	applyCmd.Flags().BoolVarP(&applyDryRun, "dry-run", "", false, "Print what would change without changing it")
+}
+
+// applyDocument is what apply reads.
+type applyDocument struct {
+	Hosts    []common.Host   `json:"hosts,omitempty"`
+	Tenants  []tenant.Tenant `json:"tenants,omitempty"`
+	Policies []common.Policy `json:"policies,omitempty"`
+}
+
+// Actions taken by apply on resources.
+const (
+	applyCreated   = "created"
+	applyUpdated   = "updated"
+	applyUnchanged = "unchanged"
+)
+
+// applyChange describes what apply did with a resource.
+type applyChange struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	ID     uint64 `json:"id,omitempty"`
+	// Changes lists the differences which were updated.
+	Changes []string `json:"changes,omitempty"`
+}
+
+func (c applyChange) String() string {
+	mark := " "
+	switch c.Action {
+	case applyCreated:
+		mark = "+"
+	case applyUpdated:
+		mark = "~"
+	}
+	s := fmt.Sprintf("%s %s %s", mark, c.Kind, c.Name)
+	if len(c.Changes) > 0 {
+		s += " (" + strings.Join(c.Changes, ", ") + ")"
+	}
+	return s
+}
+
+// applier creates and updates resources,
+// keeping track of what it changed.
+type applier struct {
+	client  *common.RestClient
+	dryRun  bool
+	changes []applyChange
+}
+
+func apply(cmd *cli.Command, args []string) error {
+	file := applyFile
+	if len(args) == 1 && file == "" {
+		file = args[0]
+	} else if len(args) > 0 || file == "" {
+		return util.UsageError(cmd, "FILE (or - for STDIN) should be provided, as an argument or with --filename.")
+	}
+
+	doc, err := readApplyDocument(file)
+	if err != nil {
+		return err
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return err
+	}
+
+	a := &applier{client: client, dryRun: applyDryRun}
+	err = a.applyHosts(doc.Hosts)
+	if err == nil {
+		err = a.applyTenants(doc.Tenants)
+	}
+	if err == nil {
+		err = a.applyPolicies(doc.Policies)
+	}
+
+	// What was changed before an error is printed as well.
+	var ids []string
+	for _, c := range a.changes {
+		if c.Action != applyUnchanged && c.ID != 0 {
+			ids = append(ids, strconv.FormatUint(c.ID, 10))
+		}
+	}
+	printErr := printResult(a.changes, ids, func() {
+		counts := make(map[string]int)
+		for _, c := range a.changes {
+			fmt.Println(c)
+			counts[c.Action]++
+		}
+		summary := fmt.Sprintf("%d created, %d updated, %d unchanged.",
+			counts[applyCreated], counts[applyUpdated], counts[applyUnchanged])
+		if a.dryRun {
+			summary += " (dry run)"
+		}
+		fmt.Println(summary)
+	})
+	if err != nil {
+		return err
+	}
+	return printErr
+}
+
+// readApplyDocument reads the file, or STDIN if it is "-",
+// as CSV if its name ends with .csv and as YAML otherwise.
+func readApplyDocument(file string) (*applyDocument, error) {
+	var buf []byte
+	var err error
+	if file == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("File error: %s", err)
+	}
+
+	if strings.ToLower(filepath.Ext(file)) == ".csv" {
+		return parseApplyCSV(strings.NewReader(string(buf)))
+	}
+
+	// YAML is read through JSON, so that documents use the field
+	// names of the REST APIs whichever of the two they are written in.
+	var raw interface{}
+	err = yaml.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(jsonValue(raw))
+	if err != nil {
+		return nil, err
+	}
+	doc := &applyDocument{}
+	err = json.Unmarshal(body, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// jsonValue converts a value decoded from YAML, which has maps
+// with keys of any type, into one encoding/json can marshal.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// parseApplyCSV reads rows of hosts, tenants and segments.
+// Segments of tenants which have no row of their own are added
+// to existing tenants.
+func parseApplyCSV(r io.Reader) (*applyDocument, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &applyDocument{}
+	tenants := make(map[string]int)
+	tenantIndex := func(name string) int {
+		i, ok := tenants[name]
+		if !ok {
+			i = len(doc.Tenants)
+			tenants[name] = i
+			doc.Tenants = append(doc.Tenants, tenant.Tenant{Name: name})
+		}
+		return i
+	}
+	for n, record := range records {
+		field := func(i int) string {
+			if i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		switch strings.ToLower(record[0]) {
+		case "host":
+			if len(record) < 4 || len(record) > 5 {
+				return nil, fmt.Errorf("Line %d: expected host,NAME,IP,ROMANA_CIDR[,AGENT_PORT]", n+1)
+			}
+			host := common.Host{Name: record[1], Ip: record[2], RomanaIp: record[3]}
+			if port := field(4); port != "" {
+				host.AgentPort, err = strconv.ParseUint(port, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Line %d: invalid agent port %s", n+1, port)
+				}
+			}
+			doc.Hosts = append(doc.Hosts, host)
+		case "tenant":
+			if len(record) < 2 || len(record) > 3 {
+				return nil, fmt.Errorf("Line %d: expected tenant,NAME[,EXTERNAL_ID]", n+1)
+			}
+			doc.Tenants[tenantIndex(record[1])].ExternalID = field(2)
+		case "segment":
+			if len(record) < 3 || len(record) > 4 {
+				return nil, fmt.Errorf("Line %d: expected segment,TENANT,NAME[,EXTERNAL_ID]", n+1)
+			}
+			i := tenantIndex(record[1])
+			doc.Tenants[i].Segments = append(doc.Tenants[i].Segments,
+				tenant.Segment{Name: record[2], ExternalID: field(3)})
+		default:
+			return nil, fmt.Errorf("Line %d: unknown kind %s, expected host, tenant or segment", n+1, record[0])
+		}
+	}
+	return doc, nil
+}
+
+// record adds the change of a resource, which
+// is unchanged if there are no differences.
+func (a *applier) record(kind string, name string, id uint64, changes []string) {
+	action := applyUnchanged
+	if len(changes) > 0 {
+		action = applyUpdated
+	}
+	a.changes = append(a.changes, applyChange{
+		Action:  action,
+		Kind:    kind,
+		Name:    name,
+		ID:      id,
+		Changes: changes,
+	})
+}
+
+func (a *applier) applyHosts(hosts []common.Host) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	topologyURL, err := a.client.GetServiceUrl("topology")
+	if err != nil {
+		return err
+	}
+	hostURL := topologyURL + "/hosts"
+
+	existing := []common.Host{}
+	err = a.client.Get(hostURL, &existing)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]common.Host)
+	for _, host := range existing {
+		byName[host.Name] = host
+	}
+
+	for _, host := range hosts {
+		if host.Name == "" {
+			return fmt.Errorf("Host %s has no name.", host.Ip)
+		}
+		current, ok := byName[host.Name]
+		if !ok {
+			result := common.Host{}
+			if !a.dryRun {
+				err = a.client.Post(hostURL, host, &result)
+				if err != nil {
+					return fmt.Errorf("Error adding host %s: %s", host.Name, err)
+				}
+			}
+			a.changes = append(a.changes, applyChange{Action: applyCreated, Kind: "host", Name: host.Name, ID: result.ID})
+			continue
+		}
+
+		// Only attributes given in the document are compared,
+		// and the service refuses to change immutable ones.
+		var changes []string
+		update := current
+		if host.Ip != "" && host.Ip != current.Ip {
+			changes = append(changes, fmt.Sprintf("ip: %s -> %s", current.Ip, host.Ip))
+			update.Ip = host.Ip
+		}
+		if host.RomanaIp != "" && host.RomanaIp != current.RomanaIp {
+			changes = append(changes, fmt.Sprintf("romana_ip: %s -> %s", current.RomanaIp, host.RomanaIp))
+			update.RomanaIp = host.RomanaIp
+		}
+		if host.AgentPort != 0 && host.AgentPort != current.AgentPort {
+			changes = append(changes, fmt.Sprintf("agent_port: %d -> %d", current.AgentPort, host.AgentPort))
+			update.AgentPort = host.AgentPort
+		}
+		if host.Zone != "" && host.Zone != current.Zone {
+			changes = append(changes, fmt.Sprintf("zone: %s -> %s", current.Zone, host.Zone))
+			update.Zone = host.Zone
+		}
+		if host.Labels != nil && !reflect.DeepEqual(host.Labels, current.Labels) {
+			changes = append(changes, "labels")
+			update.Labels = host.Labels
+		}
+		if len(changes) > 0 && !a.dryRun {
+			result := common.Host{}
+			err = a.client.Put(hostURL+"/"+strconv.FormatUint(current.ID, 10), update, &result)
+			if err != nil {
+				return fmt.Errorf("Error updating host %s: %s", host.Name, err)
+			}
+		}
+		a.record("host", host.Name, current.ID, changes)
+	}
+	return nil
+}
+
+func (a *applier) applyTenants(tenants []tenant.Tenant) error {
+	if len(tenants) == 0 {
+		return nil
+	}
+	tenantURL, err := a.client.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+
+	existing := []tenant.Tenant{}
+	err = a.client.Get(tenantURL+"/tenants", &existing)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]tenant.Tenant)
+	for _, t := range existing {
+		byName[t.Name] = t
+	}
+
+	for _, t := range tenants {
+		if t.Name == "" {
+			return fmt.Errorf("Tenant %s has no name.", t.ExternalID)
+		}
+		current, ok := byName[t.Name]
+		if ok {
+			if t.ExternalID != "" && t.ExternalID != current.ExternalID {
+				return fmt.Errorf("External ID of tenant %s cannot be changed (%s -> %s).",
+					t.Name, current.ExternalID, t.ExternalID)
+			}
+			a.record("tenant", t.Name, current.ID, nil)
+		} else {
+			if t.ExternalID == "" {
+				t.ExternalID, err = adaptor.GetTenantUUID(t.Name)
+				if err == util.ErrUnimplementedFeature {
+					return fmt.Errorf("Tenant %s should have an external_id.", t.Name)
+				} else if err != nil {
+					return err
+				}
+			}
+			current = tenant.Tenant{Name: t.Name, ExternalID: t.ExternalID}
+			if !a.dryRun {
+				err = a.client.Post(tenantURL+"/tenants", current, &current)
+				if err != nil {
+					return fmt.Errorf("Error adding tenant %s: %s", t.Name, err)
+				}
+			}
+			a.changes = append(a.changes, applyChange{Action: applyCreated, Kind: "tenant", Name: t.Name, ID: current.ID})
+		}
+
+		err = a.applySegments(tenantURL, current, t.Segments)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySegments applies segments of the tenant, which
+// has no ID yet if it was not created in a dry run.
+func (a *applier) applySegments(tenantURL string, t tenant.Tenant, segments []tenant.Segment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+	segmentURL := tenantURL + "/tenants/" + strconv.FormatUint(t.ID, 10) + "/segments"
+
+	byName := make(map[string]tenant.Segment)
+	if t.ID != 0 {
+		existing := []tenant.Segment{}
+		err := a.client.Get(segmentURL, &existing)
+		if err != nil {
+			return err
+		}
+		for _, seg := range existing {
+			byName[seg.Name] = seg
+		}
+	}
+
+	for _, seg := range segments {
+		if seg.Name == "" {
+			return fmt.Errorf("Segment %s of tenant %s has no name.", seg.ExternalID, t.Name)
+		}
+		name := t.Name + "/" + seg.Name
+		current, ok := byName[seg.Name]
+		if !ok {
+			result := tenant.Segment{}
+			if !a.dryRun {
+				err := a.client.Post(segmentURL, tenant.Segment{Name: seg.Name, ExternalID: seg.ExternalID}, &result)
+				if err != nil {
+					return fmt.Errorf("Error adding segment %s: %s", name, err)
+				}
+			}
+			a.changes = append(a.changes, applyChange{Action: applyCreated, Kind: "segment", Name: name, ID: result.ID})
+			continue
+		}
+
+		var changes []string
+		if seg.ExternalID != "" && seg.ExternalID != current.ExternalID {
+			changes = append(changes, fmt.Sprintf("external_id: %s -> %s", current.ExternalID, seg.ExternalID))
+			if !a.dryRun {
+				update := tenant.Segment{Name: current.Name, ExternalID: seg.ExternalID, Version: current.Version}
+				err := a.client.Put(segmentURL+"/"+strconv.FormatUint(current.ID, 10), update, &current)
+				if err != nil {
+					return fmt.Errorf("Error updating segment %s: %s", name, err)
+				}
+			}
+		}
+		a.record("segment", name, current.ID, changes)
+	}
+	return nil
+}
+
+func (a *applier) applyPolicies(policies []common.Policy) error {
+	if len(policies) == 0 {
+		return nil
+	}
+	policyURL, err := a.client.GetServiceUrl("policy")
+	if err != nil {
+		return err
+	}
+
+	existing := []common.Policy{}
+	err = a.client.Get(policyURL+"/policies", &existing)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]common.Policy)
+	for _, p := range existing {
+		byName[p.Name] = p
+	}
+
+	for _, p := range policies {
+		if p.Name == "" {
+			return fmt.Errorf("Policy %s has no name.", p.ExternalID)
+		}
+		current, ok := byName[p.Name]
+		if !ok {
+			result := common.Policy{}
+			if !a.dryRun {
+				err = a.client.Post(policyURL+"/policies", p, &result)
+				if err != nil {
+					return fmt.Errorf("Error adding policy %s: %s", p.Name, err)
+				}
+			}
+			a.changes = append(a.changes, applyChange{Action: applyCreated, Kind: "policy", Name: p.Name, ID: result.ID})
+			continue
+		}
+
+		changes, err := policyChanges(current, p)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 && !a.dryRun {
+			result := common.Policy{}
+			// Replace the revision compared, not one stored since.
+			p.Revision = current.Revision
+			err = a.client.Put(policyURL+"/policies/"+strconv.FormatUint(current.ID, 10), p, &result)
+			if err != nil {
+				return fmt.Errorf("Error updating policy %s: %s", p.Name, err)
+			}
+		}
+		a.record("policy", p.Name, current.ID, changes)
+	}
+	return nil
+}
+
+// policyChanges returns the names of fields of the policy which
+// differ from the stored one. The policy service fills in fields
+// (tenant IDs of endpoints, ports of port lists...) and upper-cases
+// protocols, so fields are compared as given in the document:
+// objects may have more fields in the stored policy, and strings
+// are compared ignoring case.
+func policyChanges(current common.Policy, p common.Policy) ([]string, error) {
+	var got, want map[string]interface{}
+	for _, v := range []struct {
+		policy common.Policy
+		m      *map[string]interface{}
+	}{{current, &got}, {p, &want}} {
+		body, err := json.Marshal(v.policy)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(body, v.m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	delete(want, "id")
+	delete(want, "revision")
+
+	var changes []string
+	for field, value := range want {
+		if !jsonCovers(got[field], value) {
+			changes = append(changes, field)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// jsonCovers returns true if got, decoded from JSON, has
+// everything want has (see policyChanges).
+func jsonCovers(got interface{}, want interface{}) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range want {
+			if !jsonCovers(got[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok || len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !jsonCovers(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	case string:
+		got, ok := got.(string)
+		return ok && strings.EqualFold(got, want)
+	}
+	return reflect.DeepEqual(got, want)
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+var backupDryRun bool
+
+// backupCmd represents the backup commands
+var backupCmd = &cli.Command{
+	Use:   "backup [create|restore]",
+	Short: "Back up and restore stores of services.",
+	Long: `Back up and restore stores of services.
+
+A backup is a single gzipped archive of snapshots of the stores of
+tenant, topology, ipam and policy services. Before it is restored,
+references between records of the services (such as endpoints to
+their hosts and segments) are checked, and nothing is restored if
+any of them is dangling.
+
+Restoring replaces what services store. It does not change what
+agents enforce or endpoints running on hosts. Services are restored
+one after another, so a failure leaves those before it restored;
+restoring again completes it.
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	backupCmd.AddCommand(backupCreateCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+	backupRestoreCmd.Flags().BoolVarP(&backupDryRun, "dry-run", "", false, "Only check that the backup can be restored")
+}
+
+var backupCreateCmd = &cli.Command{
+	Use:          "create [file]",
+	Short:        "Back up stores of services into the file.",
+	Long:         `Back up stores of services into the file.`,
+	RunE:         backupCreate,
+	SilenceUsage: true,
+}
+
+var backupRestoreCmd = &cli.Command{
+	Use:          "restore [file]",
+	Short:        "Restore stores of services from the backup in the file.",
+	Long:         `Restore stores of services from the backup in the file.`,
+	RunE:         backupRestore,
+	SilenceUsage: true,
+}
+
+// backupRestored is the number of rows restored
+// into a table of the store of a service.
+type backupRestored struct {
+	Service string `json:"service"`
+	Table   string `json:"table"`
+	Rows    int    `json:"rows"`
+}
+
+// snapshotURL returns the URL of snapshots of the service.
+func snapshotURL(client *common.RestClient, service string) (string, error) {
+	url, err := client.GetServiceUrl(service)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(url, "/") + common.SnapshotPath, nil
+}
+
+func backupCreate(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "expected the file to back up into")
+	}
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(config.GetString("RootURL")))
+	if err != nil {
+		return err
+	}
+	backup := common.Backup{
+		Version: common.BackupVersion,
+		Created: time.Now().Unix(),
+		Build:   common.BuildInfo(),
+	}
+	for _, service := range common.BackupServices {
+		url, err := snapshotURL(client, service)
+		if err != nil {
+			return err
+		}
+		snapshot := common.StoreSnapshot{}
+		if err := client.Get(url, &snapshot); err != nil {
+			return fmt.Errorf("Cannot back up %s: %s", service, err)
+		}
+		backup.Snapshots = append(backup.Snapshots, snapshot)
+	}
+	// Services are backed up one after another.
+	if err := backup.Validate(); err != nil {
+		return fmt.Errorf("Services changed while being backed up, back them up again: %s", err)
+	}
+	if err := writeBackup(args[0], backup); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s into %s.\n", strings.Join(common.BackupServices, ", "), args[0])
+	return nil
+}
+
+// writeBackup writes the backup into the file, replacing
+// it only once the backup is written in full.
+func writeBackup(path string, backup common.Backup) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(backup)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readBackup reads the backup in the file.
+func readBackup(path string) (common.Backup, error) {
+	backup := common.Backup{}
+	f, err := os.Open(path)
+	if err != nil {
+		return backup, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return backup, fmt.Errorf("%s is not a backup: %s", path, err)
+	}
+	if err := json.NewDecoder(zr).Decode(&backup); err != nil {
+		return backup, fmt.Errorf("%s is not a backup: %s", path, err)
+	}
+	return backup, nil
+}
+
+func backupRestore(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "expected the file to restore from")
+	}
+	backup, err := readBackup(args[0])
+	if err != nil {
+		return err
+	}
+	if err := backup.Validate(); err != nil {
+		return fmt.Errorf("Cannot restore %s: %s", args[0], err)
+	}
+	if backupDryRun {
+		fmt.Printf("Backup taken at %s can be restored.\n", time.Unix(backup.Created, 0).Format(time.RFC3339))
+		return nil
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(config.GetString("RootURL")))
+	if err != nil {
+		return err
+	}
+	var restored []backupRestored
+	for _, service := range common.BackupServices {
+		url, err := snapshotURL(client, service)
+		if err != nil {
+			return err
+		}
+		rows := make(map[string]int)
+		if err := client.Put(url, backup.Snapshot(service), &rows); err != nil {
+			return fmt.Errorf("Cannot restore %s: %s", service, err)
+		}
+		for _, table := range backup.Snapshot(service).Tables {
+			restored = append(restored, backupRestored{Service: service, Table: table.Name, Rows: rows[table.Name]})
+		}
+	}
+	return printResult(restored, nil, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Fprintln(w, "Service\t",
+			"Table\t",
+			"Rows Restored\t")
+		for _, r := range restored {
+			fmt.Fprintln(w, r.Service, "\t",
+				r.Table, "\t",
+				r.Rows, "\t")
+		}
+		w.Flush()
+	})
+}
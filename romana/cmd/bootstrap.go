@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/romana/core/romana/util"
+	"github.com/romana/core/root"
+
+	cli "github.com/spf13/cobra"
+)
+
+var (
+	bootstrapConfig   string
+	bootstrapUsername string
+	bootstrapReset    bool
+)
+
+// rootServiceCmd represents the commands about the root service.
+var rootServiceCmd = &cli.Command{
+	Use:   "root [bootstrap]",
+	Short: "Set up the root service.",
+	Long: `Set up the root service.
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	rootServiceCmd.AddCommand(rootBootstrapCmd)
+	rootBootstrapCmd.Flags().StringVarP(&bootstrapConfig, "root-config", "", "",
+		"Configuration file of root, or etcd key as etcd://host:port/key")
+	rootBootstrapCmd.Flags().StringVarP(&bootstrapUsername, "username", "", "admin",
+		"Name of the admin to create")
+	rootBootstrapCmd.Flags().BoolVarP(&bootstrapReset, "reset", "", false,
+		"Generate a new password if the admin exists already")
+}
+
+var rootBootstrapCmd = &cli.Command{
+	Use:   "bootstrap",
+	Short: "Create the initial admin of a secured deployment.",
+	Long: `Create the initial admin of a secured deployment.
+
+bootstrap connects to the store root keeps users and roles in, as
+configured in --root-config, creating its schema if needed and
+default roles. It creates the admin with a generated password and
+the admin role, and prints the credentials along with a token
+signed with the private key of root, if it is configured.
+
+The password is printed only once: it is not kept in clear, so
+keep it safe. Run bootstrap on a host that can reach the store,
+before services with auth on are started.
+
+For more information, please check http://romana.io
+`,
+	RunE:         rootBootstrap,
+	SilenceUsage: true,
+}
+
+func rootBootstrap(cmd *cli.Command, args []string) error {
+	if bootstrapConfig == "" {
+		return util.UsageError(cmd, "expected --root-config")
+	}
+	result, err := root.Bootstrap(bootstrapConfig, root.BootstrapOptions{
+		Username: bootstrapUsername,
+		Reset:    bootstrapReset,
+	})
+	if err != nil {
+		return err
+	}
+	// Not printResult: the password is printed even with --quiet.
+	if structuredOutput() {
+		return printStructured(result)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(w, "Username:\t%s\n", result.Username)
+	fmt.Fprintf(w, "Password:\t%s\n", result.Password)
+	fmt.Fprintf(w, "Roles:\t%s\n", strings.Join(result.Roles, ", "))
+	if result.Token != "" {
+		fmt.Fprintf(w, "Token:\t%s\n", result.Token)
+	}
+	w.Flush()
+	fmt.Println("\nThe password is not shown again, keep it safe.")
+	return nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/romana"
+	"github.com/romana/core/romana/util"
+	"github.com/romana/core/tenant"
+
+	cli "github.com/spf13/cobra"
+)
+
+// completionCmd represents the completion command
+var completionCmd = &cli.Command{
+	Use:   "completion [bash|zsh]",
+	Short: "Generate shell completion scripts.",
+	Long: `Generate shell completion scripts.
+
+Commands, and names of tenants, segments and hosts fetched from
+romana services, are completed. To enable completion, e.g. in bash:
+
+    source <(romana completion bash)
+
+For more information, please check http://romana.io
+`,
+	ValidArgs:    []string{"bash", "zsh"},
+	RunE:         completion,
+	SilenceUsage: true,
+}
+
+// completeCmd prints completions of the arguments
+// following those given; completion scripts call it.
+var completeCmd = &cli.Command{
+	Use:    "__complete [args]...",
+	Hidden: true,
+	Run:    complete,
+}
+
+// completionFunc returns names to complete an argument
+// with, given the arguments before it.
+type completionFunc func(args []string) ([]string, error)
+
+// argCompletions lists how arguments of commands are completed, by
+// position. The last one applies to any further arguments as well.
+var argCompletions map[*cli.Command][]completionFunc
+
+func init() {
+	argCompletions = map[*cli.Command][]completionFunc{
+		hostShowCmd:      {hostNames},
+		hostRemoveCmd:    {hostNames, nil},
+		tenantShowCmd:    {tenantNames},
+		tenantDeleteCmd:  {tenantNames},
+		segmentAddCmd:    {tenantNames, nil},
+		segmentRemoveCmd: {tenantNames, segmentNames, nil},
+		segmentListCmd:   {tenantNames},
+		endpointListCmd:  {tenantNames},
+		vmAllocateCmd:    {tenantNames, segmentNames, hostNames, nil},
+	}
+}
+
+const bashCompletion = `# bash completion for romana
+_romana() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    COMPREPLY=( $(compgen -W "$(romana __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" 2>/dev/null)" -- "$cur") )
+}
+complete -F _romana romana
+`
+
+const zshCompletion = `#compdef romana
+# zsh completion for romana
+_romana() {
+    local -a candidates
+    candidates=(${(f)"$(romana __complete ${words[2,CURRENT-1]} 2>/dev/null)"})
+    compadd -a candidates
+}
+compdef _romana romana
+`
+
+func completion(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "SHELL (bash or zsh) should be provided.")
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	default:
+		return util.UsageError(cmd, "Unsupported shell %s, expected bash or zsh.", args[0])
+	}
+	return nil
+}
+
+// complete prints completions, one per line. Services which
+// cannot be reached just leave names uncompleted.
+func complete(cmd *cli.Command, args []string) {
+	for _, candidate := range completions(args) {
+		fmt.Println(candidate)
+	}
+}
+
+// completions returns candidates for the argument following args.
+func completions(args []string) []string {
+	cmd, rest, _ := RootCmd.Find(args)
+	if cmd == nil {
+		return nil
+	}
+	positional := positionalArgs(cmd, rest)
+	if cmd.HasAvailableSubCommands() {
+		if len(positional) > 0 {
+			return nil
+		}
+		var names []string
+		for _, sub := range cmd.Commands() {
+			if sub.IsAvailableCommand() {
+				names = append(names, sub.Name())
+			}
+		}
+		return names
+	}
+	if len(cmd.ValidArgs) > 0 {
+		return cmd.ValidArgs
+	}
+	funcs := argCompletions[cmd]
+	if len(funcs) == 0 {
+		return nil
+	}
+	f := funcs[len(funcs)-1]
+	if len(positional) < len(funcs) {
+		f = funcs[len(positional)]
+	}
+	if f == nil {
+		return nil
+	}
+	names, err := f(positional)
+	if err != nil {
+		return nil
+	}
+	return names
+}
+
+// positionalArgs returns args without flags and their values.
+func positionalArgs(cmd *cli.Command, args []string) []string {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		if strings.Contains(arg, "=") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		flag := cmd.LocalFlags().Lookup(name)
+		if flag == nil {
+			flag = cmd.InheritedFlags().Lookup(name)
+		}
+		if flag == nil && len(name) == 1 {
+			flag = cmd.LocalFlags().ShorthandLookup(name)
+			if flag == nil {
+				flag = cmd.InheritedFlags().ShorthandLookup(name)
+			}
+		}
+		// Skip the value of the flag.
+		if flag != nil && flag.Value.Type() != "bool" {
+			i++
+		}
+	}
+	return positional
+}
+
+// tenantNames returns names of tenants.
+func tenantNames(args []string) ([]string, error) {
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return nil, err
+	}
+
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := []tenant.Tenant{}
+	err = client.Get(tenantURL+"/tenants", &tenants)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(tenants))
+	for i, t := range tenants {
+		names[i] = t.Name
+	}
+	return names, nil
+}
+
+// segmentNames returns names of segments of
+// the tenant named by the first argument.
+func segmentNames(args []string) ([]string, error) {
+	tenantID, err := romana.GetTenantID(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return nil, err
+	}
+
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []tenant.Segment{}
+	err = client.Get(tenantURL+"/tenants/"+strconv.FormatUint(tenantID, 10)+"/segments", &segments)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(segments))
+	for i, s := range segments {
+		names[i] = s.Name
+	}
+	return names, nil
+}
+
+// hostNames returns names of hosts.
+func hostNames(args []string) ([]string, error) {
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return nil, err
+	}
+
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return nil, err
+	}
+
+	index := common.IndexResponse{}
+	err = client.Get(topologyURL, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []common.Host{}
+	err = client.Get(index.Links.FindByRel("host-list"), &hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(hosts))
+	for i, host := range hosts {
+		names[i] = host.Name
+	}
+	return names, nil
+}
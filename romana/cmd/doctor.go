@@ -0,0 +1,289 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+)
+
+var doctorHost string
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cli.Command{
+	Use:   "doctor",
+	Short: "Diagnose problems with romana services and agents.",
+	Long: `Diagnose problems with romana services and agents.
+
+doctor checks that root and every service can be reached, and that
+their databases are usable. With --host, it also compares policies
+and routes to other hosts of the agent on the host with those the
+services store. Problems found are listed most severe first, and the
+command fails if any of them is critical or an error.
+
+For more information, please check http://romana.io
+`,
+	RunE:         doctor,
+	SilenceUsage: true,
+}
+
+func init() {
+	doctorCmd.Flags().StringVarP(&doctorHost, "host", "", "", "Name or IP of a host whose agent to check as well")
+}
+
+// Severities of problems, most severe first.
+const (
+	severityCritical = "critical"
+	severityError    = "error"
+	severityWarning  = "warning"
+)
+
+var severityRank = map[string]int{
+	severityCritical: 0,
+	severityError:    1,
+	severityWarning:  2,
+}
+
+// problem is a problem found by doctor.
+type problem struct {
+	Severity string `json:"severity"`
+	// Component is the service or host with the problem.
+	Component string `json:"component"`
+	Problem   string `json:"problem"`
+}
+
+type problemsBySeverity []problem
+
+func (p problemsBySeverity) Len() int      { return len(p) }
+func (p problemsBySeverity) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p problemsBySeverity) Less(i, j int) bool {
+	return severityRank[p[i].Severity] < severityRank[p[j].Severity]
+}
+
+// agentRule is a firewall rule as reported by an agent.
+type agentRule struct {
+	Body  string
+	State string
+}
+
+// agentRoute is a route to another host as reported by
+// an agent (see agent.RouteStatus).
+type agentRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+	Expected    bool   `json:"expected"`
+	Present     bool   `json:"present"`
+}
+
+// doctorChecks runs checks, each of which adds the problems it finds.
+type doctorChecks struct {
+	client   *common.RestClient
+	problems []problem
+}
+
+func (d *doctorChecks) add(severity string, component string, format string, args ...interface{}) {
+	d.problems = append(d.problems, problem{
+		Severity:  severity,
+		Component: component,
+		Problem:   fmt.Sprintf(format, args...),
+	})
+}
+
+func doctor(cmd *cli.Command, args []string) error {
+	if len(args) != 0 {
+		return util.UsageError(cmd, "doctor takes no arguments, use --host to check a host.")
+	}
+
+	d := &doctorChecks{}
+	var err error
+	d.client, err = common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		d.add(severityCritical, "root", "Cannot reach root at %s: %s", rootURL, err)
+	} else if d.checkServices() && doctorHost != "" {
+		d.checkHost(doctorHost)
+	}
+
+	sort.Stable(problemsBySeverity(d.problems))
+	err = printResult(d.problems, nil, func() {
+		if len(d.problems) == 0 {
+			fmt.Println("No problems found.")
+			return
+		}
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Fprintln(w, "Severity\t",
+			"Component\t",
+			"Problem\t")
+		for _, p := range d.problems {
+			fmt.Fprintln(w, p.Severity, "\t",
+				p.Component, "\t",
+				p.Problem, "\t")
+		}
+		w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range d.problems {
+		if p.Severity != severityWarning {
+			return fmt.Errorf("%d problems found", len(d.problems))
+		}
+	}
+	return nil
+}
+
+// checkServices checks root, and every service both as seen by
+// root and from here. It returns false if root cannot be reached,
+// as nothing else can be checked then.
+func (d *doctorChecks) checkServices() bool {
+	status, err := d.client.GetClusterStatus()
+	if err != nil {
+		d.add(severityCritical, "root", "Cannot get status of services from root at %s: %s", rootURL, err)
+		return false
+	}
+	if len(status.Services) == 0 {
+		d.add(severityCritical, "root", "No services are registered with root.")
+	}
+
+	for _, svc := range status.Services {
+		switch {
+		case svc.Error != "":
+			d.add(severityCritical, svc.Service, "Root cannot reach the service at %s: %s", svc.Url, svc.Error)
+			continue
+		case svc.Database != "" && svc.Database != common.HealthOK:
+			d.add(severityCritical, svc.Service, "Database is not usable: %s", svc.Database)
+		case !svc.Healthy:
+			d.add(severityError, svc.Service, "Service is not healthy.")
+		}
+		if svc.LastError != "" {
+			d.add(severityWarning, svc.Service, "Last error returned: %s", svc.LastError)
+		}
+		if svc.Supervisor != nil && svc.Supervisor.Restarts > 0 {
+			d.add(severityWarning, svc.Service, "Root restarted the service %d times, it last %s.", svc.Supervisor.Restarts, svc.Supervisor.LastExit)
+		}
+
+		// Root may reach services which cannot be reached from here.
+		health := common.ServiceHealth{}
+		if err := d.client.Get(strings.TrimRight(svc.Url, "/")+common.HealthPath, &health); err != nil {
+			d.add(severityError, svc.Service, "Cannot reach the service at %s from here: %s", svc.Url, err)
+		}
+	}
+	return true
+}
+
+// checkHost compares the state of the agent on the host
+// with policies and hosts stored by the services.
+func (d *doctorChecks) checkHost(nameOrIP string) {
+	host, err := getHost(d.client, nameOrIP)
+	if err != nil {
+		d.add(severityError, nameOrIP, "Cannot find the host in topology: %s", err)
+		return
+	}
+	component := "agent on " + host.Name
+	if host.Draining {
+		d.add(severityWarning, component, "Host is draining.")
+	}
+	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
+
+	rules := []agentRule{}
+	err = d.client.Get(agentURL+"/", &rules)
+	if err != nil {
+		d.add(severityCritical, component, "Cannot reach the agent at %s: %s", agentURL, err)
+		return
+	}
+	var inactive int
+	for _, rule := range rules {
+		if rule.State != "active" {
+			inactive++
+		}
+	}
+	if inactive > 0 {
+		d.add(severityWarning, component, "%d of %d firewall rules are not active.", inactive, len(rules))
+	}
+
+	d.checkPolicies(component, agentURL)
+
+	routes := []agentRoute{}
+	err = d.client.Get(agentURL+"/routes", &routes)
+	if err != nil {
+		d.add(severityError, component, "Cannot get routes from the agent: %s", err)
+		return
+	}
+	for _, route := range routes {
+		switch {
+		case route.Expected && !route.Present:
+			d.add(severityError, component, "Route to %s via %s is missing.", route.Destination, route.Gateway)
+		case !route.Expected:
+			d.add(severityWarning, component, "Route to %s via %s is stale.", route.Destination, route.Gateway)
+		}
+	}
+}
+
+// checkPolicies compares policies applied by the
+// agent with those stored by the policy service.
+func (d *doctorChecks) checkPolicies(component string, agentURL string) {
+	policyURL, err := d.client.GetServiceUrl("policy")
+	if err != nil {
+		d.add(severityError, "policy", "Cannot find the policy service: %s", err)
+		return
+	}
+	stored := []common.Policy{}
+	err = d.client.Get(policyURL+"/policies", &stored)
+	if err != nil {
+		d.add(severityError, "policy", "Cannot list policies: %s", err)
+		return
+	}
+	applied := []common.Policy{}
+	err = d.client.Get(agentURL+"/policies", &applied)
+	if err != nil {
+		d.add(severityError, component, "Cannot list policies applied by the agent: %s", err)
+		return
+	}
+
+	appliedByID := make(map[uint64]common.Policy)
+	for _, p := range applied {
+		appliedByID[p.ID] = p
+	}
+	var missing []string
+	for _, p := range stored {
+		a, ok := appliedByID[p.ID]
+		delete(appliedByID, p.ID)
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s (%d)", p.Name, p.ID))
+			continue
+		}
+		if a.Revision != p.Revision {
+			d.add(severityWarning, component, "Policy %s (%d) is applied at revision %d instead of %d.",
+				p.Name, p.ID, a.Revision, p.Revision)
+		}
+	}
+	if len(missing) > 0 {
+		d.add(severityError, component, "Policies not applied: %s.", strings.Join(missing, ", "))
+	}
+	for _, p := range applied {
+		if _, ok := appliedByID[p.ID]; ok {
+			d.add(severityError, component, "Policy %s (%d) is applied but no longer stored.", p.Name, p.ID)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/romana/romana"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+)
+
+var endpointHost string
+
+// endpointCmd represents the endpoint commands
+var endpointCmd = &cli.Command{
+	Use:   "endpoint [list]",
+	Short: "List endpoints allocated by IPAM.",
+	Long: `List endpoints allocated by IPAM.
+
+endpoint requires a subcommand, e.g. ` + "`romana endpoint list`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	endpointCmd.AddCommand(endpointListCmd)
+	endpointListCmd.Flags().StringVarP(&endpointHost, "host", "", "", "List endpoints of the host instead")
+	addWatchFlag(endpointListCmd)
+}
+
+var endpointListCmd = &cli.Command{
+	Use:          "list [tenantName][tenantName]...",
+	Short:        "List endpoints of tenants or of a host.",
+	Long:         `List endpoints of tenants or, with --host, of a host.`,
+	RunE:         endpointList,
+	SilenceUsage: true,
+}
+
+func endpointList(cmd *cli.Command, args []string) error {
+	if (len(args) == 0) == (endpointHost == "") {
+		return util.UsageError(cmd, "TENANT names or --host should be provided.")
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return err
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+
+	var urls []string
+	if endpointHost != "" {
+		host, err := getHost(client, endpointHost)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, fmt.Sprintf("%s/hosts/%d/endpoints", ipamURL, host.ID))
+	}
+	for _, tnt := range args {
+		tenantID, err := romana.GetTenantID(tnt)
+		if err != nil {
+			return fmt.Errorf("Romana Tenant doesn't exists: %s", tnt)
+		}
+		urls = append(urls, ipamURL+"/tenants/"+strconv.FormatUint(tenantID, 10)+"/endpoints")
+	}
+
+	endpoints := []ipam.Endpoint{}
+	for _, url := range urls {
+		data := []ipam.Endpoint{}
+		err = client.Get(url, &data)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, data...)
+	}
+
+	// Endpoints are identified by their addresses.
+	ips := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		ips[i] = endpoint.Ip
+	}
+	err = printResult(endpoints, ips, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+		fmt.Println("Endpoint List")
+		fmt.Fprintln(w, endpointHeader...)
+		for _, endpoint := range endpoints {
+			fmt.Fprintln(w, endpointRow(endpoint)...)
+		}
+		w.Flush()
+	})
+	if err != nil || !watch {
+		return err
+	}
+
+	// IPAM has no feed of changes to endpoints, so they are polled.
+	list := func() (map[string]interface{}, error) {
+		current := make(map[string]interface{})
+		for _, url := range urls {
+			data := []ipam.Endpoint{}
+			err := client.Get(url, &data)
+			if err != nil {
+				return nil, err
+			}
+			for _, endpoint := range data {
+				current[endpoint.Ip] = endpoint
+			}
+		}
+		return current, nil
+	}
+	known := make(map[string]interface{})
+	for _, endpoint := range endpoints {
+		known[endpoint.Ip] = endpoint
+	}
+	printer := newWatchPrinter(endpointHeader, func(resource interface{}) []interface{} {
+		return endpointRow(resource.(ipam.Endpoint))
+	})
+	return pollResources(printer, known, list)
+}
+
+var endpointHeader = []interface{}{"IP\t",
+	"Name\t",
+	"Tenant ID\t",
+	"Segment ID\t",
+	"Host ID\t"}
+
+// endpointRow returns the row of the endpoint in endpoint tables.
+func endpointRow(endpoint ipam.Endpoint) []interface{} {
+	return []interface{}{endpoint.Ip, "\t",
+		endpoint.Name, "\t",
+		endpoint.TenantID, "\t",
+		endpoint.SegmentID, "\t",
+		endpoint.HostId, "\t"}
+}
+
+// getHost returns the host with the name or IP.
+func getHost(client *common.RestClient, nameOrIP string) (common.Host, error) {
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return common.Host{}, err
+	}
+
+	index := common.IndexResponse{}
+	err = client.Get(topologyURL, &index)
+	if err != nil {
+		return common.Host{}, err
+	}
+
+	hosts := []common.Host{}
+	err = client.Get(index.Links.FindByRel("host-list"), &hosts)
+	if err != nil {
+		return common.Host{}, err
+	}
+
+	for _, host := range hosts {
+		if host.Name == nameOrIP || host.Ip == nameOrIP {
+			return host, nil
+		}
+	}
+	return common.Host{}, fmt.Errorf("Host not found: %s", nameOrIP)
+}
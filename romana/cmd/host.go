@@ -16,7 +16,6 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
@@ -26,7 +25,6 @@ import (
 	"github.com/romana/core/romana/util"
 
 	cli "github.com/spf13/cobra"
-	config "github.com/spf13/viper"
 )
 
 // hostCmd represents the host commands
@@ -46,6 +44,7 @@ func init() {
 	hostCmd.AddCommand(hostShowCmd)
 	hostCmd.AddCommand(hostListCmd)
 	hostCmd.AddCommand(hostRemoveCmd)
+	addWatchFlag(hostListCmd)
 }
 
 var hostAddCmd = &cli.Command{
@@ -125,8 +124,6 @@ func hostAdd(cmd *cli.Command, args []string) error {
 		RomanaIp:  romanacidr,
 		AgentPort: agentport,
 	}
-	fmt.Printf("Host (%v) added successfully.\n", host)
-
 	data := common.Host{}
 	err = client.Post(topologyURL+"/hosts", host, &data)
 	if err != nil {
@@ -134,8 +131,9 @@ func hostAdd(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	fmt.Printf("Host (%s) added successfully.\n", hostname)
-	return nil
+	return printResult(data, []string{strconv.FormatUint(data.ID, 10)}, func() {
+		fmt.Printf("Host (%s) added successfully.\n", hostname)
+	})
 }
 
 func hostShow(cmd *cli.Command, args []string) error {
@@ -176,32 +174,7 @@ func hostShow(cmd *cli.Command, args []string) error {
 		}
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(hosts, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
-		w := new(tabwriter.Writer)
-		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-		fmt.Println("Host List")
-		fmt.Fprintln(w, "Id\t",
-			"Host Name\t",
-			"Host IP\t",
-			"Romana CIDR\t",
-			"Agent Port\t")
-		for _, host := range hosts {
-			fmt.Fprintln(w, host.ID, "\t",
-				host.Name, "\t",
-				host.Ip, "\t",
-				host.RomanaIp, "\t",
-				host.AgentPort, "\t")
-		}
-		w.Flush()
-	}
-
-	return nil
+	return printHosts(hosts)
 }
 
 func hostList(cmd *cli.Command, args []string) error {
@@ -228,35 +201,75 @@ func hostList(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(hosts, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	err = printHosts(hosts)
+	if err != nil || !watch {
+		return err
+	}
+	return watchHosts(client, index, hosts)
+}
+
+func hostRemove(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected 1 argument, saw %d: %s", len(args), args))
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return err
+	}
+
+	removed, err := getHost(client, args[0])
+	if err != nil {
+		return err
+	}
+
+	topologyURL, err := client.GetServiceUrl("topology")
+	if err != nil {
+		return err
+	}
+
+	host := common.Host{}
+	err = client.Delete(fmt.Sprintf("%s/hosts/%d", topologyURL, removed.ID), nil, &host)
+	if err != nil {
+		fmt.Printf("Error removing host (%s).\n", args[0])
+		return err
+	}
+
+	return printResult(host, []string{strconv.FormatUint(removed.ID, 10)}, func() {
+		fmt.Printf("Host (%s) removed successfully.\n", args[0])
+	})
+}
+
+// printHosts prints the hosts in the output format.
+func printHosts(hosts []common.Host) error {
+	ids := make([]string, len(hosts))
+	for i, host := range hosts {
+		ids[i] = strconv.FormatUint(host.ID, 10)
+	}
+	return printResult(hosts, ids, func() {
 		w := new(tabwriter.Writer)
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 		fmt.Println("Host List")
-		fmt.Fprintln(w, "Id\t",
-			"Host Name\t",
-			"Host IP\t",
-			"Romana CIDR\t",
-			"Agent Port\t")
+		fmt.Fprintln(w, hostHeader...)
 		for _, host := range hosts {
-			fmt.Fprintln(w, host.ID, "\t",
-				host.Name, "\t",
-				host.Ip, "\t",
-				host.RomanaIp, "\t",
-				host.AgentPort, "\t")
+			fmt.Fprintln(w, hostRow(host)...)
 		}
 		w.Flush()
-	}
-
-	return nil
+	})
 }
 
-func hostRemove(cmd *cli.Command, args []string) error {
-	fmt.Println("Unimplemented: Remove a host.")
-	return nil
+var hostHeader = []interface{}{"Id\t",
+	"Host Name\t",
+	"Host IP\t",
+	"Romana CIDR\t",
+	"Agent Port\t"}
+
+// hostRow returns the row of the host in host tables.
+func hostRow(host common.Host) []interface{} {
+	return []interface{}{host.ID, "\t",
+		host.Name, "\t",
+		host.Ip, "\t",
+		host.RomanaIp, "\t",
+		host.AgentPort, "\t"}
 }
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-yaml/yaml"
+	config "github.com/spf13/viper"
+)
+
+// Output formats, selected with -o (or -f).
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+// structuredOutput returns true if output is to be
+// JSON or YAML rather than a table.
+func structuredOutput() bool {
+	format := config.GetString("Format")
+	return format == formatJSON || format == formatYAML
+}
+
+// printStructured prints data as JSON or YAML. YAML uses the
+// field names of JSON, so both formats are read the same way.
+func printStructured(data interface{}) error {
+	body, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+	if config.GetString("Format") == formatYAML {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return err
+		}
+		if body, err = yaml.Marshal(doc); err != nil {
+			return err
+		}
+		fmt.Print(string(body))
+		return nil
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+// printResult prints the result of a command: only the IDs,
+// one per line, with --quiet, data as JSON or YAML if asked
+// for, and otherwise the table printed by table.
+func printResult(data interface{}, ids []string, table func()) error {
+	if quiet {
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+	if structuredOutput() {
+		return printStructured(data)
+	}
+	table()
+	return nil
+}
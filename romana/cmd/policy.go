@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"text/tabwriter"
 
 	"github.com/romana/core/common"
@@ -43,7 +44,7 @@ var policyID uint64
 
 // policyCmd represents the policy commands
 var policyCmd = &cli.Command{
-	Use:   "policy [add|remove|list]",
+	Use:   "policy [add|apply|remove|list]",
 	Short: "Add, Remove or List a policy.",
 	Long: `Add, Remove or List a policy.
 
@@ -56,10 +57,12 @@ func init() {
 	policyCmd.AddCommand(policyRemoveCmd)
 	policyCmd.AddCommand(policyListCmd)
 	policyRemoveCmd.Flags().Uint64VarP(&policyID, "policyid", "i", 0, "Policy ID")
+	addWatchFlag(policyListCmd)
 }
 
 var policyAddCmd = &cli.Command{
 	Use:          "add [policyFile]",
+	Aliases:      []string{"apply"},
 	Short:        "Add a new policy.",
 	Long:         `Add a new policy.`,
 	RunE:         policyAdd,
@@ -98,7 +101,6 @@ func policyAdd(cmd *cli.Command, args []string) error {
 	var policyFile string
 	var err error
 	isFile := true
-	isJSON := config.GetString("Format") == "json"
 
 	if len(args) == 0 {
 		isFile = false
@@ -166,7 +168,13 @@ func policyAdd(cmd *cli.Command, args []string) error {
 		reqPolicies.AppliedSuccessfully[i] = true
 	}
 
-	if isJSON {
+	if quiet {
+		for i := range reqPolicies.SecurityPolicies {
+			if id, ok := result[i]["id"].(float64); ok {
+				fmt.Println(uint64(id))
+			}
+		}
+	} else if structuredOutput() {
 		for i := range reqPolicies.SecurityPolicies {
 			// check if any of policy markers are present in the map.
 			_, exOk := result[i]["external_id"]
@@ -183,11 +191,7 @@ func policyAdd(cmd *cli.Command, args []string) error {
 				if err != nil {
 					continue
 				}
-				body, err := json.MarshalIndent(p, "", "\t")
-				if err != nil {
-					continue
-				}
-				fmt.Println(string(body))
+				printStructured(p)
 			} else {
 				var h common.HttpError
 				dc := &ms.DecoderConfig{TagName: "json", Result: &h}
@@ -199,8 +203,7 @@ func policyAdd(cmd *cli.Command, args []string) error {
 				if err != nil {
 					continue
 				}
-				status, _ := json.MarshalIndent(h, "", "\t")
-				fmt.Println(string(status))
+				printStructured(h)
 			}
 		}
 	} else {
@@ -313,21 +316,13 @@ func policyRemove(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(policyResp, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	return printResult(policyResp, []string{strconv.FormatUint(policyID, 10)}, func() {
 		if policyIDPresent {
 			fmt.Printf("Policy (ID: %d) deleted successfully.\n", policyID)
 		} else {
 			fmt.Printf("Policy (%s) deleted successfully.\n", policyName)
 		}
-	}
-
-	return nil
+	})
 }
 
 // policyList lists policies in tabular or json format.
@@ -350,42 +345,72 @@ func policyList(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(policies, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	ids := make([]string, len(policies))
+	for i, p := range policies {
+		ids[i] = strconv.FormatUint(p.ID, 10)
+	}
+	err = printResult(policies, ids, func() {
 		w := new(tabwriter.Writer)
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 		fmt.Println("Policy List")
-		fmt.Fprintln(w, "Id\t",
-			"Policy\t",
-			"Direction\t",
-			"Tenant ID\t",
-			"Segment ID\t",
-			"ExternalID\t",
-			"Description\t",
-		)
+		fmt.Fprintln(w, policyHeader...)
 		for _, p := range policies {
-			var tID uint64
-			var sID uint64
-			if len(p.AppliedTo) > 0 {
-				tID = p.AppliedTo[0].TenantID
-				sID = p.AppliedTo[0].SegmentID
-			}
-			fmt.Fprintln(w, p.ID, "\t",
-				p.Name, "\t",
-				p.Direction, "\t",
-				tID, "\t",
-				sID, "\t",
-				p.ExternalID, "\t",
-				p.Description, "\t",
-			)
+			fmt.Fprintln(w, policyRow(p)...)
 		}
 		w.Flush()
+	})
+	if err != nil || !watch {
+		return err
 	}
 
-	return nil
+	// The policy service has no feed of changes
+	// to policies, so they are polled.
+	list := func() (map[string]interface{}, error) {
+		policies := []common.Policy{}
+		err := client.Get(policyURL+"/policies", &policies)
+		if err != nil {
+			return nil, err
+		}
+		return policiesByID(policies), nil
+	}
+	printer := newWatchPrinter(policyHeader, func(resource interface{}) []interface{} {
+		return policyRow(resource.(common.Policy))
+	})
+	return pollResources(printer, policiesByID(policies), list)
+}
+
+var policyHeader = []interface{}{"Id\t",
+	"Policy\t",
+	"Direction\t",
+	"Tenant ID\t",
+	"Segment ID\t",
+	"ExternalID\t",
+	"Description\t",
+}
+
+// policyRow returns the row of the policy in policy tables.
+func policyRow(p common.Policy) []interface{} {
+	var tID uint64
+	var sID uint64
+	if len(p.AppliedTo) > 0 {
+		tID = p.AppliedTo[0].TenantID
+		sID = p.AppliedTo[0].SegmentID
+	}
+	return []interface{}{p.ID, "\t",
+		p.Name, "\t",
+		p.Direction, "\t",
+		tID, "\t",
+		sID, "\t",
+		p.ExternalID, "\t",
+		p.Description, "\t",
+	}
+}
+
+// policiesByID returns the policies by their IDs.
+func policiesByID(policies []common.Policy) map[string]interface{} {
+	byID := make(map[string]interface{}, len(policies))
+	for _, p := range policies {
+		byID[strconv.FormatUint(p.ID, 10)] = p
+	}
+	return byID
 }
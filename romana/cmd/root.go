@@ -38,6 +38,8 @@ var (
 	version  bool
 	verbose  bool
 	format   string
+	output   string
+	quiet    bool
 	platform string
 )
 
@@ -70,6 +72,14 @@ func init() {
 	RootCmd.AddCommand(tenantCmd)
 	RootCmd.AddCommand(segmentCmd)
 	RootCmd.AddCommand(policyCmd)
+	RootCmd.AddCommand(endpointCmd)
+	RootCmd.AddCommand(vmCmd)
+	RootCmd.AddCommand(applyCmd)
+	RootCmd.AddCommand(doctorCmd)
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(rootServiceCmd)
+	RootCmd.AddCommand(completionCmd)
+	RootCmd.AddCommand(completeCmd)
 
 	RootCmd.Flags().BoolVarP(&version, "version", "",
 		false, "Build and Versioning Information.")
@@ -81,18 +91,23 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&rootPort, "rootPort",
 		"p", "", "root service port, e.g. 9600")
 	RootCmd.PersistentFlags().StringVarP(&format, "format",
-		"f", "", "enable formatting options like [json|table], etc.")
+		"f", "", "enable formatting options like [json|yaml|table], etc.")
+	RootCmd.PersistentFlags().StringVarP(&output, "output",
+		"o", "", "output format [json|yaml|table], same as --format.")
+	RootCmd.PersistentFlags().BoolVarP(&quiet, "quiet",
+		"q", false, "print only IDs of the resources.")
 	RootCmd.PersistentFlags().StringVarP(&platform, "platform",
 		"P", "", "Use platforms like [openstack|kubernetes], etc.")
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose",
 		"v", false, "Verbose output.")
 
-	RootCmd.PersistentPreRun = preConfig
+	RootCmd.PersistentPreRunE = preConfig
 	RootCmd.Run = versionInfo
 }
 
-// preConfig sanitizes URLs and sets up config with URLs.
-func preConfig(cmd *cli.Command, args []string) {
+// preConfig sanitizes URLs and sets up config with URLs
+// and the output format.
+func preConfig(cmd *cli.Command, args []string) error {
 	var baseURL string
 
 	// Add port details to rootURL else try localhost
@@ -128,12 +143,19 @@ func preConfig(cmd *cli.Command, args []string) {
 
 	// Give command line options higher priority then
 	// the corresponding config options.
+	if output != "" {
+		format = output
+	}
 	if format == "" {
 		format = config.GetString("Format")
 	}
 	// if format is still not found just default to tabular format.
 	if format == "" {
-		format = "table"
+		format = formatTable
+	}
+	format = strings.ToLower(format)
+	if format != formatTable && format != formatJSON && format != formatYAML {
+		return fmt.Errorf("Unknown output format %s, expected json, yaml or table", format)
 	}
 	config.Set("Format", format)
 
@@ -144,7 +166,7 @@ func preConfig(cmd *cli.Command, args []string) {
 		platform = "openstack"
 	}
 	config.Set("Platform", platform)
-
+	return nil
 }
 
 // versionInfo displays the build and versioning information.
@@ -16,7 +16,6 @@
 package cmd
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -28,12 +27,11 @@ import (
 
 	ms "github.com/mitchellh/mapstructure"
 	cli "github.com/spf13/cobra"
-	config "github.com/spf13/viper"
 )
 
 // segmentCmd represents the segment commands
 var segmentCmd = &cli.Command{
-	Use:   "segment [add|remove|list]",
+	Use:   "segment [add|create|remove|list]",
 	Short: "Add or Remove a segment.",
 	Long: `Add or Remove a segment.
 
@@ -50,6 +48,7 @@ func init() {
 
 var segmentAddCmd = &cli.Command{
 	Use:          "add [tenantName][segmentName]",
+	Aliases:      []string{"create"},
 	Short:        "Add a new segment.",
 	Long:         `Add a new segment.`,
 	RunE:         segmentAdd,
@@ -115,34 +114,26 @@ func segmentAdd(cmd *cli.Command, args []string) error {
 		if err != nil {
 			return err
 		}
-		if config.GetString("Format") == "json" {
-			status, _ := json.MarshalIndent(h, "", "\t")
-			fmt.Println(string(status))
+		if structuredOutput() {
+			printStructured(h)
 			return fmt.Errorf("HTTP Error")
 		}
 		return fmt.Errorf(h.Error())
 	}
 
-	if config.GetString("Format") == "json" {
-		segment := tenant.Segment{}
-		dc := &ms.DecoderConfig{TagName: "json", Result: &segment}
-		decoder, err := ms.NewDecoder(dc)
-		if err != nil {
-			return err
-		}
-		err = decoder.Decode(result)
-		if err != nil {
-			return err
-		}
-		body, err := json.MarshalIndent(segment, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
-		fmt.Printf("Tenant Segment (%s) added successfully.\n", seg)
+	segment := tenant.Segment{}
+	dc := &ms.DecoderConfig{TagName: "json", Result: &segment}
+	decoder, err := ms.NewDecoder(dc)
+	if err != nil {
+		return err
 	}
-	return nil
+	err = decoder.Decode(result)
+	if err != nil {
+		return err
+	}
+	return printResult(segment, []string{strconv.FormatUint(segment.ID, 10)}, func() {
+		fmt.Printf("Tenant Segment (%s) added successfully.\n", seg)
+	})
 }
 
 func segmentRemove(cmd *cli.Command, args []string) error {
@@ -16,9 +16,9 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"text/tabwriter"
 
 	"github.com/romana/core/common"
@@ -181,22 +181,19 @@ func tenantCreate(cmd *cli.Command, args []string) error {
 			if err != nil {
 				return err
 			}
-			if config.GetString("Format") == "json" {
-				status, _ := json.MarshalIndent(h, "", "\t")
-				fmt.Println(string(status))
+			if structuredOutput() {
+				printStructured(h)
 				return fmt.Errorf("HTTP Error")
 			}
 			return fmt.Errorf(h.Error())
 		}
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(tenants, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	ids := make([]string, len(tenants))
+	for i, t := range tenants {
+		ids[i] = strconv.FormatUint(t.ID, 10)
+	}
+	return printResult(tenants, ids, func() {
 		w := new(tabwriter.Writer)
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 		fmt.Println("New Tenant(s) Added:")
@@ -210,9 +207,7 @@ func tenantCreate(cmd *cli.Command, args []string) error {
 			fmt.Fprintf(w, "\n")
 		}
 		w.Flush()
-	}
-
-	return nil
+	})
 }
 
 // tenantShow displays tenant details using tenant name
@@ -255,13 +250,11 @@ func tenantShow(cmd *cli.Command, args []string) error {
 		}
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(tenants, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	ids := make([]string, len(tenants))
+	for i, t := range tenants {
+		ids[i] = strconv.FormatUint(t.Tenant.ID, 10)
+	}
+	return printResult(tenants, ids, func() {
 		w := new(tabwriter.Writer)
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 		fmt.Fprintln(w, "ID\t",
@@ -278,9 +271,7 @@ func tenantShow(cmd *cli.Command, args []string) error {
 			fmt.Fprintf(w, "\n")
 		}
 		w.Flush()
-	}
-
-	return nil
+	})
 }
 
 // tenantList displays tenant list in either json or
@@ -305,13 +296,11 @@ func tenantList(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	if config.GetString("Format") == "json" {
-		body, err := json.MarshalIndent(tenants, "", "\t")
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(body))
-	} else {
+	ids := make([]string, len(tenants))
+	for i, t := range tenants {
+		ids[i] = strconv.FormatUint(t.ID, 10)
+	}
+	return printResult(tenants, ids, func() {
 		w := new(tabwriter.Writer)
 		w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 		fmt.Println("Tenant List")
@@ -326,9 +315,7 @@ func tenantList(cmd *cli.Command, args []string) error {
 			)
 		}
 		w.Flush()
-	}
-
-	return nil
+	})
 }
 
 // tenantDelete takes tenant name as input for deleting a specific
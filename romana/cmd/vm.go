@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/romana/util"
+
+	cli "github.com/spf13/cobra"
+)
+
+// vmCmd represents the vm commands
+var vmCmd = &cli.Command{
+	Use:   "vm [allocate|release]",
+	Short: "Allocate or Release IP addresses of VMs.",
+	Long: `Allocate or Release IP addresses of VMs.
+
+vm requires a subcommand, e.g. ` + "`romana vm allocate`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	vmCmd.AddCommand(vmAllocateCmd)
+	vmCmd.AddCommand(vmReleaseCmd)
+}
+
+var vmAllocateCmd = &cli.Command{
+	Use:          "allocate [tenantName][segmentName][hostName][(optional)vmName]",
+	Short:        "Allocate an IP address for a VM.",
+	Long:         `Allocate an IP address for a VM in the segment of the tenant on the host.`,
+	RunE:         vmAllocate,
+	SilenceUsage: true,
+}
+
+var vmReleaseCmd = &cli.Command{
+	Use:          "release [ip]",
+	Short:        "Release the IP address of a VM.",
+	Long:         `Release the IP address of a VM.`,
+	RunE:         vmRelease,
+	SilenceUsage: true,
+}
+
+func vmAllocate(cmd *cli.Command, args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return util.UsageError(cmd,
+			fmt.Sprintf("expected 3 or 4 arguments, saw %d: %s", len(args), args))
+	}
+
+	query := url.Values{}
+	query.Set("tenantName", args[0])
+	query.Set("segmentName", args[1])
+	query.Set("hostName", args[2])
+	if len(args) == 4 {
+		query.Set("instanceName", args[3])
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return err
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+
+	endpoint := ipam.Endpoint{}
+	err = client.Get(ipamURL+"/allocateIP?"+query.Encode(), &endpoint)
+	if err != nil {
+		return err
+	}
+
+	return printResult(endpoint, []string{endpoint.Ip}, func() {
+		fmt.Printf("IP (%s) allocated successfully.\n", endpoint.Ip)
+	})
+}
+
+func vmRelease(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "IP address should be provided.")
+	}
+
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return err
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+
+	endpoint := ipam.Endpoint{}
+	err = client.Delete(ipamURL+"/endpoints/"+args[0], nil, &endpoint)
+	if err != nil {
+		return err
+	}
+
+	return printResult(endpoint, []string{args[0]}, func() {
+		fmt.Printf("IP (%s) released successfully.\n", args[0])
+	})
+}
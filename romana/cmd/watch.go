@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+// Watch mode of list commands. After listing resources, commands
+// given --watch keep printing changes to them, one per line, until
+// interrupted: rows of the table prefixed with the type of change,
+// the ID (IP for endpoints) with --quiet, or the change and the
+// resource with -o json or yaml. Hosts are followed through the host
+// events of the topology service; services without such a feed are
+// polled every watchInterval.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/romana/core/common"
+
+	cli "github.com/spf13/cobra"
+)
+
+const watchInterval = 2 * time.Second
+
+var watch bool
+
+// addWatchFlag adds --watch to the list command.
+func addWatchFlag(cmd *cli.Command) {
+	cmd.Flags().BoolVarP(&watch, "watch", "w", false, "After listing, watch for changes and print them")
+}
+
+// watchEvent is a change printed with -o json or yaml. Type
+// is one of common.HostAdded, HostUpdated or HostRemoved,
+// which are used for changes to other resources as well.
+type watchEvent struct {
+	Type     string      `json:"type"`
+	Resource interface{} `json:"resource"`
+}
+
+// watchPrinter prints changes to resources.
+type watchPrinter struct {
+	row func(resource interface{}) []interface{}
+	w   *tabwriter.Writer
+}
+
+// newWatchPrinter returns a printer of rows of a table
+// with the header, returned for resources by row.
+func newWatchPrinter(header []interface{}, row func(resource interface{}) []interface{}) *watchPrinter {
+	p := &watchPrinter{row: row}
+	if !quiet && !structuredOutput() {
+		// Rows are flushed one by one, so columns
+		// are padded to a width rather than aligned.
+		p.w = new(tabwriter.Writer)
+		p.w.Init(os.Stdout, 14, 8, 1, ' ', 0)
+		fmt.Fprintln(p.w, append([]interface{}{"Event\t"}, header...)...)
+		p.w.Flush()
+	}
+	return p
+}
+
+func (p *watchPrinter) print(eventType string, id string, resource interface{}) error {
+	if quiet {
+		fmt.Println(id)
+		return nil
+	}
+	if structuredOutput() {
+		return printStructured(watchEvent{Type: eventType, Resource: resource})
+	}
+	fmt.Fprintln(p.w, append([]interface{}{eventType, "\t"}, p.row(resource)...)...)
+	return p.w.Flush()
+}
+
+// diffResources prints changes from known to current
+// resources, both by ID, and returns current.
+func diffResources(p *watchPrinter, known map[string]interface{}, current map[string]interface{}) (map[string]interface{}, error) {
+	var ids []string
+	for id := range known {
+		ids = append(ids, id)
+	}
+	for id := range current {
+		if _, ok := known[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var err error
+		before, wasKnown := known[id]
+		after, isCurrent := current[id]
+		switch {
+		case !isCurrent:
+			err = p.print(common.HostRemoved, id, before)
+		case !wasKnown:
+			err = p.print(common.HostAdded, id, after)
+		case !reflect.DeepEqual(before, after):
+			err = p.print(common.HostUpdated, id, after)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+// pollResources prints changes to the resources, listing
+// them by ID with list every watchInterval.
+func pollResources(p *watchPrinter, known map[string]interface{}, list func() (map[string]interface{}, error)) error {
+	for {
+		time.Sleep(watchInterval)
+		current, err := list()
+		if err != nil {
+			return err
+		}
+		known, err = diffResources(p, known, current)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hostsByID returns the hosts by their IDs.
+func hostsByID(hosts []common.Host) map[string]interface{} {
+	byID := make(map[string]interface{}, len(hosts))
+	for _, host := range hosts {
+		byID[strconv.FormatUint(host.ID, 10)] = host
+	}
+	return byID
+}
+
+// watchHosts prints changes to the hosts as the topology service
+// reports them, listing the hosts again when told to reset.
+func watchHosts(client *common.RestClient, index common.IndexResponse, hosts []common.Host) error {
+	eventsURL := index.Links.FindByRel("host-events")
+	if eventsURL == "" {
+		return errors.New("Topology service does not provide host events")
+	}
+	printer := newWatchPrinter(hostHeader, func(resource interface{}) []interface{} {
+		return hostRow(resource.(common.Host))
+	})
+
+	list := common.HostEventList{}
+	err := client.Get(eventsURL, &list)
+	if err != nil {
+		return err
+	}
+	seq := list.Seq
+	// Hosts may have changed since they were listed; resetting
+	// prints those changes without waiting for further events.
+	reset := true
+	known := hostsByID(hosts)
+	for {
+		if reset {
+			hosts := []common.Host{}
+			err = client.Get(index.Links.FindByRel("host-list"), &hosts)
+			if err != nil {
+				return err
+			}
+			known, err = diffResources(printer, known, hostsByID(hosts))
+			if err != nil {
+				return err
+			}
+		}
+
+		list = common.HostEventList{}
+		err = client.Get(fmt.Sprintf("%s?watch=true&since=%d", eventsURL, seq), &list)
+		if err != nil {
+			return err
+		}
+		reset = list.Reset
+		if !reset {
+			for _, event := range list.Events {
+				id := strconv.FormatUint(event.Host.ID, 10)
+				if event.Type == common.HostRemoved {
+					delete(known, id)
+				} else {
+					known[id] = event.Host
+				}
+				err = printer.print(event.Type, id, event.Host)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		seq = list.Seq
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cni
+
+// Romana services the plugin talks to.
+
+import (
+	"fmt"
+	"github.com/romana/core/agent"
+	"github.com/romana/core/common"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// romanaAPI is the part of Romana API that the plugin uses.
+type romanaAPI interface {
+	// host returns the host with the provided name from topology.
+	host(name string) (common.Host, error)
+	// agentURL returns URL of the agent running on the host.
+	agentURL(host common.Host) (string, error)
+	// allocateIP allocates an address for the instance.
+	allocateIP(tenant string, segment string, hostName string, instance string) (net.IP, error)
+	// releaseIP returns the address to ipam.
+	releaseIP(ip string) error
+	// podUp and podDown ask the agent to set up and tear
+	// down routes and firewall for the interface.
+	podUp(agentURL string, req agent.NetworkRequest) error
+	podDown(agentURL string, req agent.NetworkRequest) error
+}
+
+// restAPI implements romanaAPI using REST API of the services.
+type restAPI struct {
+	client *common.RestClient
+}
+
+func newRestAPI(rootURL string) (*restAPI, error) {
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		return nil, err
+	}
+	return &restAPI{client: client}, nil
+}
+
+func (r *restAPI) host(name string) (common.Host, error) {
+	host := common.Host{Name: name}
+	err := r.client.Find(&host, common.FindExactlyOne)
+	if err != nil {
+		return host, common.NewError("Cannot find host %s in topology: %s", name, err)
+	}
+	return host, nil
+}
+
+func (r *restAPI) agentURL(host common.Host) (string, error) {
+	port := host.AgentPort
+	if port == 0 {
+		agentConfig, err := r.client.GetServiceConfig("agent")
+		if err != nil {
+			return "", err
+		}
+		port = agentConfig.Common.Api.Port
+	}
+	return fmt.Sprintf("http://%s:%d", host.Ip, port), nil
+}
+
+func (r *restAPI) allocateIP(tenant string, segment string, hostName string, instance string) (net.IP, error) {
+	ipamURL, err := r.client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("tenantName", tenant)
+	query.Set("segmentName", segment)
+	query.Set("hostName", hostName)
+	query.Set("instanceName", instance)
+	endpoint := struct {
+		Ip string `json:"ip"`
+	}{}
+	err = r.client.Get(strings.TrimRight(ipamURL, "/")+"/allocateIP?"+query.Encode(), &endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(endpoint.Ip)
+	if ip == nil {
+		return nil, common.NewError("ipam returned invalid address '%s'", endpoint.Ip)
+	}
+	return ip, nil
+}
+
+func (r *restAPI) releaseIP(ip string) error {
+	ipamURL, err := r.client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+	return r.client.Delete(strings.TrimRight(ipamURL, "/")+"/endpoints/"+ip, nil, nil)
+}
+
+func (r *restAPI) podUp(agentURL string, req agent.NetworkRequest) error {
+	result := ""
+	return r.client.Post(strings.TrimRight(agentURL, "/")+"/pod", req, &result)
+}
+
+func (r *restAPI) podDown(agentURL string, req agent.NetworkRequest) error {
+	result := ""
+	return r.client.Delete(strings.TrimRight(agentURL, "/")+"/pod", req, &result)
+}
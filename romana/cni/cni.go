@@ -0,0 +1,482 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package cni implements a CNI plugin (see
+// https://github.com/containernetworking/cni/blob/master/SPEC.md)
+// that connects containers to Romana: on ADD it allocates an address
+// from the ipam service, creates a veth pair into the container's
+// network namespace and asks the agent to set up routes and firewall
+// rules for it; on DEL it undoes all of that.
+package cni
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/romana/core/agent"
+	"github.com/romana/core/common"
+	"github.com/romana/core/pkg/util/exec"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Version of the CNI spec results are reported in,
+	// unless the network configuration asks for an older one.
+	cniVersion = "0.3.1"
+
+	// Where allocations are recorded unless configured otherwise.
+	defaultDataDir = "/var/lib/cni/romana"
+
+	// Segment containers are placed in unless configured otherwise.
+	defaultSegment = "default"
+
+	// Host side of the veth pair is named with this prefix and
+	// a hash of the container ID, to fit in IFNAMSIZ.
+	hostIfacePrefix = "romana"
+
+	// CNI error codes (see the spec).
+	errCodeIncompatibleVersion = 1
+	errCodeInvalidConfig       = 7
+	errCodeInternal            = 100
+)
+
+// Versions of the CNI spec this plugin supports.
+var supportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1"}
+
+// NetConf is the network configuration passed to the plugin on stdin.
+type NetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// URL of the Romana root service.
+	RootURL string `json:"root_url"`
+	// Tenant to allocate addresses for. Defaults to the
+	// Kubernetes namespace of the pod.
+	Tenant string `json:"tenant,omitempty"`
+	// Segment of the tenant to allocate addresses in.
+	Segment string `json:"segment,omitempty"`
+	// Name of this host in Romana topology. Defaults to hostname.
+	HostName string `json:"host_name,omitempty"`
+	// Directory where allocations are recorded on ADD,
+	// so that they can be released on DEL.
+	DataDir string `json:"data_dir,omitempty"`
+}
+
+// Args are the parameters passed to the plugin in the environment.
+type Args struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	// Extra arguments passed in CNI_ARGS, such as
+	// K8S_POD_NAMESPACE and K8S_POD_NAME.
+	Extra map[string]string
+}
+
+// argsFromEnv reads the parameters from the environment.
+func argsFromEnv(getenv func(string) string) (Args, error) {
+	args := Args{
+		Command:     getenv("CNI_COMMAND"),
+		ContainerID: getenv("CNI_CONTAINERID"),
+		Netns:       getenv("CNI_NETNS"),
+		IfName:      getenv("CNI_IFNAME"),
+		Extra:       make(map[string]string),
+	}
+	if args.Command == "" {
+		return args, common.NewError("CNI_COMMAND is not set")
+	}
+	for _, kv := range strings.Split(getenv("CNI_ARGS"), ";") {
+		if kv == "" {
+			continue
+		}
+		idx := strings.Index(kv, "=")
+		if idx < 0 {
+			return args, common.NewError("Invalid CNI_ARGS element %s", kv)
+		}
+		args.Extra[kv[0:idx]] = kv[idx+1:]
+	}
+	if args.Command == "VERSION" {
+		return args, nil
+	}
+	if args.ContainerID == "" || args.IfName == "" {
+		return args, common.NewError("CNI_CONTAINERID and CNI_IFNAME must be set")
+	}
+	if args.Command == "ADD" && args.Netns == "" {
+		return args, common.NewError("CNI_NETNS must be set")
+	}
+	return args, nil
+}
+
+// Error is reported to the runtime when the plugin fails.
+type Error struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("CNI error %d: %s", e.Code, e.Msg)
+}
+
+// Result is the result of ADD in version 0.3 of the spec.
+type Result struct {
+	CNIVersion string      `json:"cniVersion"`
+	Interfaces []Interface `json:"interfaces,omitempty"`
+	IPs        []IPConfig  `json:"ips,omitempty"`
+	Routes     []Route     `json:"routes,omitempty"`
+}
+
+type Interface struct {
+	Name    string `json:"name"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type IPConfig struct {
+	Version string `json:"version"`
+	Address string `json:"address"`
+	Gateway string `json:"gateway,omitempty"`
+	// Index of the interface in Result.Interfaces.
+	Interface int `json:"interface"`
+}
+
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// legacyResult is the result of ADD in versions 0.1 and 0.2 of the spec.
+type legacyResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	IP4        legacyIPConfig `json:"ip4"`
+}
+
+type legacyIPConfig struct {
+	IP      string  `json:"ip"`
+	Gateway string  `json:"gateway,omitempty"`
+	Routes  []Route `json:"routes,omitempty"`
+}
+
+// allocation is what ADD did, recorded for DEL to undo.
+type allocation struct {
+	IP        string `json:"ip"`
+	HostIface string `json:"host_iface"`
+	AgentURL  string `json:"agent_url"`
+}
+
+// plugin executes one CNI command.
+type plugin struct {
+	conf     NetConf
+	args     Args
+	api      romanaAPI
+	executor exec.Executable
+	// Addresses of this host's interfaces, to find the Romana gateway.
+	interfaceAddrs func() ([]net.Addr, error)
+}
+
+// Main runs the plugin with the configuration read from stdin and
+// parameters from the environment (see getenv), writing the result
+// or error to stdout as the spec requires. It returns the exit code.
+func Main(stdin io.Reader, stdout io.Writer, getenv func(string) string) int {
+	result, err := run(stdin, getenv)
+	if err != nil {
+		cniErr, ok := err.(Error)
+		if !ok {
+			cniErr = Error{Code: errCodeInternal, Msg: err.Error()}
+		}
+		cniErr.CNIVersion = cniVersion
+		log.Printf("CNI plugin: %s", cniErr)
+		json.NewEncoder(stdout).Encode(cniErr)
+		return 1
+	}
+	if result != nil {
+		json.NewEncoder(stdout).Encode(result)
+	}
+	return 0
+}
+
+// run parses the input and executes the command.
+func run(stdin io.Reader, getenv func(string) string) (interface{}, error) {
+	args, err := argsFromEnv(getenv)
+	if err != nil {
+		return nil, Error{Code: errCodeInvalidConfig, Msg: err.Error()}
+	}
+	if args.Command == "VERSION" {
+		return struct {
+			CNIVersion        string   `json:"cniVersion"`
+			SupportedVersions []string `json:"supportedVersions"`
+		}{cniVersion, supportedVersions}, nil
+	}
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := parseNetConf(data)
+	if err != nil {
+		return nil, err
+	}
+	api, err := newRestAPI(conf.RootURL)
+	if err != nil {
+		return nil, err
+	}
+	p := &plugin{conf: conf, args: args, api: api, executor: exec.DefaultExecutor{}, interfaceAddrs: net.InterfaceAddrs}
+	switch args.Command {
+	case "ADD":
+		return p.add()
+	case "DEL":
+		return nil, p.del()
+	default:
+		return nil, Error{Code: errCodeInvalidConfig, Msg: fmt.Sprintf("Unknown CNI_COMMAND %s", args.Command)}
+	}
+}
+
+// parseNetConf parses the network configuration, applying defaults.
+func parseNetConf(data []byte) (NetConf, error) {
+	conf := NetConf{}
+	err := json.Unmarshal(data, &conf)
+	if err != nil {
+		return conf, Error{Code: errCodeInvalidConfig, Msg: fmt.Sprintf("Cannot parse network configuration: %s", err)}
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = "0.1.0"
+	}
+	supported := false
+	for _, v := range supportedVersions {
+		supported = supported || v == conf.CNIVersion
+	}
+	if !supported {
+		return conf, Error{Code: errCodeIncompatibleVersion, Msg: fmt.Sprintf("Unsupported CNI version %s, supported are %s", conf.CNIVersion, strings.Join(supportedVersions, ", "))}
+	}
+	if conf.RootURL == "" {
+		return conf, Error{Code: errCodeInvalidConfig, Msg: "root_url is required"}
+	}
+	if conf.Segment == "" {
+		conf.Segment = defaultSegment
+	}
+	if conf.DataDir == "" {
+		conf.DataDir = defaultDataDir
+	}
+	if conf.HostName == "" {
+		conf.HostName, err = os.Hostname()
+		if err != nil {
+			return conf, err
+		}
+	}
+	return conf, nil
+}
+
+// add connects the container: allocates an address, creates the
+// interfaces and has the agent set up routes and firewall. If any
+// step fails, whatever was done is undone.
+func (p *plugin) add() (interface{}, error) {
+	tenant := p.conf.Tenant
+	if tenant == "" {
+		tenant = p.args.Extra["K8S_POD_NAMESPACE"]
+	}
+	if tenant == "" {
+		return nil, Error{Code: errCodeInvalidConfig, Msg: "No tenant configured and K8S_POD_NAMESPACE not provided"}
+	}
+	instance := p.args.ContainerID
+	if pod := p.args.Extra["K8S_POD_NAME"]; pod != "" {
+		instance = p.args.Extra["K8S_POD_NAMESPACE"] + "." + pod
+	}
+
+	host, err := p.api.host(p.conf.HostName)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := p.gateway(host)
+	if err != nil {
+		return nil, err
+	}
+	agentURL, err := p.api.agentURL(host)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := p.api.allocateIP(tenant, p.conf.Segment, p.conf.HostName, instance)
+	if err != nil {
+		return nil, err
+	}
+	alloc := allocation{IP: ip.String(), HostIface: hostIfaceName(p.args.ContainerID), AgentURL: agentURL}
+	log.Printf("CNI plugin: allocated %s for %s (tenant %s, segment %s)", ip, instance, tenant, p.conf.Segment)
+
+	err = p.saveAllocation(alloc)
+	if err == nil {
+		err = p.createInterfaces(alloc.HostIface, ip, gateway)
+	}
+	if err == nil {
+		err = p.api.podUp(agentURL, agent.NetworkRequest{NetIf: agent.NetIf{Name: alloc.HostIface, IP: ip}})
+	}
+	if err != nil {
+		log.Printf("CNI plugin: failed to connect %s: %s", instance, err)
+		if delErr := p.release(alloc); delErr != nil {
+			log.Printf("CNI plugin: failed to clean up after %s: %s", instance, delErr)
+		}
+		return nil, err
+	}
+	return p.result(ip, gateway), nil
+}
+
+// result builds the result of ADD in the requested version of the spec.
+func (p *plugin) result(ip net.IP, gateway net.IP) interface{} {
+	defaultRoute := Route{Dst: "0.0.0.0/0", GW: gateway.String()}
+	address := ip.String() + "/32"
+	if strings.HasPrefix(p.conf.CNIVersion, "0.1") || strings.HasPrefix(p.conf.CNIVersion, "0.2") {
+		return legacyResult{
+			CNIVersion: p.conf.CNIVersion,
+			IP4:        legacyIPConfig{IP: address, Gateway: gateway.String(), Routes: []Route{defaultRoute}},
+		}
+	}
+	return Result{
+		CNIVersion: p.conf.CNIVersion,
+		Interfaces: []Interface{{Name: p.args.IfName, Sandbox: p.args.Netns}},
+		IPs:        []IPConfig{{Version: "4", Address: address, Gateway: gateway.String(), Interface: 0}},
+		Routes:     []Route{defaultRoute},
+	}
+}
+
+// del disconnects the container. It is not an error if the container
+// was never connected (or has already been disconnected), as the spec
+// requires DEL to be idempotent.
+func (p *plugin) del() error {
+	alloc, err := p.loadAllocation()
+	if os.IsNotExist(err) {
+		log.Printf("CNI plugin: nothing to release for %s", p.args.ContainerID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return p.release(alloc)
+}
+
+// release undoes what add did for the allocation. All steps are
+// attempted even if some fail, and the first error is returned.
+func (p *plugin) release(alloc allocation) error {
+	var errs []error
+	ip := net.ParseIP(alloc.IP)
+	err := p.api.podDown(alloc.AgentURL, agent.NetworkRequest{NetIf: agent.NetIf{Name: alloc.HostIface, IP: ip}})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	// Deleting one end of the veth pair deletes the other, along
+	// with routes through it. It may be gone with the namespace.
+	out, err := p.executor.Exec("ip", []string{"link", "del", alloc.HostIface})
+	if err != nil && !strings.Contains(string(out), "Cannot find device") {
+		errs = append(errs, common.NewError("Cannot delete %s: %s (%s)", alloc.HostIface, err, strings.TrimSpace(string(out))))
+	}
+	err = p.api.releaseIP(alloc.IP)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		// Keep the allocation for DEL to be retried.
+		return errs[0]
+	}
+	err = os.Remove(p.allocationFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("CNI plugin: released %s of %s", alloc.IP, p.args.ContainerID)
+	return nil
+}
+
+// createInterfaces creates the veth pair, moves one end into the
+// container namespace and configures the address and routes there.
+// The route on the host side is set up by the agent.
+func (p *plugin) createInterfaces(hostIface string, ip net.IP, gateway net.IP) error {
+	peer := hostIface + "p"
+	nsenter := []string{"--net=" + p.args.Netns, "ip"}
+	cmds := []struct {
+		cmd  string
+		args []string
+	}{
+		{"ip", []string{"link", "add", hostIface, "type", "veth", "peer", "name", peer}},
+		{"ip", []string{"link", "set", peer, "netns", p.args.Netns}},
+		{"ip", []string{"link", "set", hostIface, "up"}},
+		{"nsenter", append(nsenter, "link", "set", peer, "name", p.args.IfName)},
+		{"nsenter", append(nsenter, "addr", "add", ip.String()+"/32", "dev", p.args.IfName)},
+		{"nsenter", append(nsenter, "link", "set", p.args.IfName, "up")},
+		{"nsenter", append(nsenter, "route", "add", gateway.String(), "dev", p.args.IfName, "scope", "link")},
+		{"nsenter", append(nsenter, "route", "add", "default", "via", gateway.String(), "dev", p.args.IfName)},
+	}
+	for _, c := range cmds {
+		out, err := p.executor.Exec(c.cmd, c.args)
+		if err != nil {
+			return common.NewError("%s %s failed: %s (%s)", c.cmd, strings.Join(c.args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// gateway returns the address of this host in its Romana CIDR, which
+// containers on it use as their gateway (see also the agent's
+// identifyCurrentHost).
+func (p *plugin) gateway(host common.Host) (net.IP, error) {
+	_, romanaCIDR, err := net.ParseCIDR(host.RomanaIp)
+	if err != nil {
+		return nil, common.NewError("Cannot parse Romana CIDR '%s' of host %s: %s", host.RomanaIp, host.Name, err)
+	}
+	addrs, err := p.interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && romanaCIDR.Contains(ipnet.IP) {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, common.NewError("No interface on this host has an address in %s", host.RomanaIp)
+}
+
+// hostIfaceName returns the name of host side of the veth pair for
+// the container. The peer is created with a suffix added before it is
+// renamed in the container, so the name leaves room for it.
+func hostIfaceName(containerID string) string {
+	sum := sha1.Sum([]byte(containerID))
+	return hostIfacePrefix + hex.EncodeToString(sum[:])[0:8]
+}
+
+func (p *plugin) allocationFile() string {
+	return filepath.Join(p.conf.DataDir, p.args.ContainerID+"-"+p.args.IfName)
+}
+
+func (p *plugin) saveAllocation(alloc allocation) error {
+	err := os.MkdirAll(p.conf.DataDir, 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(alloc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.allocationFile(), data, 0600)
+}
+
+func (p *plugin) loadAllocation() (allocation, error) {
+	alloc := allocation{}
+	data, err := ioutil.ReadFile(p.allocationFile())
+	if err != nil {
+		return alloc, err
+	}
+	err = json.Unmarshal(data, &alloc)
+	return alloc, err
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/romana/core/agent"
+	"github.com/romana/core/common"
+	"github.com/romana/core/pkg/util/exec"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeAPI records calls to Romana services.
+type fakeAPI struct {
+	calls     []string
+	podUpErr  error
+	allocated net.IP
+}
+
+func (f *fakeAPI) host(name string) (common.Host, error) {
+	f.calls = append(f.calls, "host "+name)
+	return common.Host{Name: name, Ip: "192.168.0.10", RomanaIp: "10.1.0.0/16", AgentPort: 9604}, nil
+}
+
+func (f *fakeAPI) agentURL(host common.Host) (string, error) {
+	return "http://192.168.0.10:9604", nil
+}
+
+func (f *fakeAPI) allocateIP(tenant string, segment string, hostName string, instance string) (net.IP, error) {
+	f.calls = append(f.calls, strings.Join([]string{"allocate", tenant, segment, hostName, instance}, " "))
+	return f.allocated, nil
+}
+
+func (f *fakeAPI) releaseIP(ip string) error {
+	f.calls = append(f.calls, "release "+ip)
+	return nil
+}
+
+func (f *fakeAPI) podUp(agentURL string, req agent.NetworkRequest) error {
+	f.calls = append(f.calls, "podUp "+agentURL+" "+req.NetIf.Name+" "+req.NetIf.IP.String())
+	return f.podUpErr
+}
+
+func (f *fakeAPI) podDown(agentURL string, req agent.NetworkRequest) error {
+	f.calls = append(f.calls, "podDown "+agentURL+" "+req.NetIf.Name+" "+req.NetIf.IP.String())
+	return nil
+}
+
+func newTestPlugin(t *testing.T, command string, version string) (*plugin, *fakeAPI, *exec.FakeExecutor) {
+	dir, err := ioutil.TempDir("", "romana-cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CNI_COMMAND":     command,
+		"CNI_CONTAINERID": "abcdef",
+		"CNI_NETNS":       "/proc/1234/ns/net",
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "IgnoreUnknown=1;K8S_POD_NAMESPACE=tenant1;K8S_POD_NAME=pod1",
+	}
+	args, err := argsFromEnv(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := parseNetConf([]byte(`{"cniVersion": "` + version + `", "name": "romana", "type": "romana-cni", "root_url": "http://localhost:9600", "host_name": "host1", "data_dir": "` + dir + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeAPI{allocated: net.ParseIP("10.1.2.3")}
+	executor := &exec.FakeExecutor{}
+	p := &plugin{conf: conf, args: args, api: api, executor: executor,
+		interfaceAddrs: func() ([]net.Addr, error) {
+			return []net.Addr{
+				&net.IPNet{IP: net.ParseIP("192.168.0.10"), Mask: net.CIDRMask(24, 32)},
+				&net.IPNet{IP: net.ParseIP("10.1.0.1"), Mask: net.CIDRMask(16, 32)},
+			}, nil
+		},
+	}
+	return p, api, executor
+}
+
+func TestAddDel(t *testing.T) {
+	p, api, executor := newTestPlugin(t, "ADD", "0.3.1")
+	defer os.RemoveAll(p.conf.DataDir)
+	out, err := p.add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(Result)
+	if len(result.IPs) != 1 || result.IPs[0].Address != "10.1.2.3/32" || result.IPs[0].Gateway != "10.1.0.1" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if len(result.Interfaces) != 1 || result.Interfaces[0].Name != "eth0" || result.Interfaces[0].Sandbox != "/proc/1234/ns/net" {
+		t.Errorf("Unexpected interfaces %+v", result.Interfaces)
+	}
+	hostIface := hostIfaceName("abcdef")
+	if len(hostIface) > 14 {
+		t.Errorf("Host interface name %s leaves no room for the peer suffix", hostIface)
+	}
+	expectedCalls := []string{
+		"host host1",
+		"allocate tenant1 default host1 tenant1.pod1",
+		"podUp http://192.168.0.10:9604 " + hostIface + " 10.1.2.3",
+	}
+	if strings.Join(api.calls, "\n") != strings.Join(expectedCalls, "\n") {
+		t.Errorf("Expected calls\n%s\ngot\n%s", strings.Join(expectedCalls, "\n"), strings.Join(api.calls, "\n"))
+	}
+	for _, cmd := range []string{
+		"ip link add " + hostIface + " type veth peer name " + hostIface + "p",
+		"nsenter --net=/proc/1234/ns/net ip addr add 10.1.2.3/32 dev eth0",
+		"nsenter --net=/proc/1234/ns/net ip route add default via 10.1.0.1 dev eth0",
+	} {
+		if !strings.Contains(*executor.Commands, cmd) {
+			t.Errorf("Expected command %s, got\n%s", cmd, *executor.Commands)
+		}
+	}
+
+	p.args.Command = "DEL"
+	api.calls = nil
+	err = p.del()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCalls = []string{
+		"podDown http://192.168.0.10:9604 " + hostIface + " 10.1.2.3",
+		"release 10.1.2.3",
+	}
+	if strings.Join(api.calls, "\n") != strings.Join(expectedCalls, "\n") {
+		t.Errorf("Expected calls\n%s\ngot\n%s", strings.Join(expectedCalls, "\n"), strings.Join(api.calls, "\n"))
+	}
+	if !strings.HasSuffix(*executor.Commands, "ip link del "+hostIface) {
+		t.Errorf("Expected host interface to be deleted, got\n%s", *executor.Commands)
+	}
+
+	// DEL is idempotent.
+	api.calls = nil
+	err = p.del()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.calls) != 0 {
+		t.Errorf("Expected no calls on repeated DEL, got %v", api.calls)
+	}
+}
+
+func TestAddFailure(t *testing.T) {
+	p, api, _ := newTestPlugin(t, "ADD", "0.2.0")
+	defer os.RemoveAll(p.conf.DataDir)
+	api.podUpErr = errors.New("agent is down")
+	_, err := p.add()
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if api.calls[len(api.calls)-1] != "release 10.1.2.3" {
+		t.Errorf("Expected address to be released, got %v", api.calls)
+	}
+
+	api.podUpErr = nil
+	out, err := p.add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(legacyResult)
+	if result.IP4.IP != "10.1.2.3/32" || result.IP4.Gateway != "10.1.0.1" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestMainOutput(t *testing.T) {
+	env := map[string]string{"CNI_COMMAND": "VERSION"}
+	stdout := &bytes.Buffer{}
+	code := Main(strings.NewReader(""), stdout, func(k string) string { return env[k] })
+	if code != 0 || !strings.Contains(stdout.String(), "0.3.1") {
+		t.Errorf("Unexpected VERSION output (%d): %s", code, stdout.String())
+	}
+
+	env = map[string]string{"CNI_COMMAND": "ADD", "CNI_CONTAINERID": "abcdef", "CNI_NETNS": "/proc/1/ns/net", "CNI_IFNAME": "eth0"}
+	stdout.Reset()
+	code = Main(strings.NewReader(`{"cniVersion": "0.4.0", "root_url": "http://localhost"}`), stdout, func(k string) string { return env[k] })
+	cniErr := Error{}
+	json.Unmarshal(stdout.Bytes(), &cniErr)
+	if code == 0 || cniErr.Code != errCodeIncompatibleVersion {
+		t.Errorf("Expected incompatible version error, got (%d): %s", code, stdout.String())
+	}
+}
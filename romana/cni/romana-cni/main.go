@@ -0,0 +1,39 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Romana CNI plugin. Install it in the CNI plugin directory and
+// refer to it as type "romana-cni" in the network configuration.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/romana/core/common"
+	"github.com/romana/core/romana/cni"
+	"log"
+	"os"
+)
+
+func main() {
+	version := flag.Bool("version", false, "Build Information.")
+	flag.Parse()
+	if *version {
+		fmt.Println(common.BuildInfo())
+		return
+	}
+	// stdout is reserved for the result.
+	log.SetOutput(os.Stderr)
+	os.Exit(cni.Main(os.Stdin, os.Stdout, os.Getenv))
+}
@@ -19,19 +19,25 @@ import (
 	"log"
 )
 
-// manageResources manages map of termination channels and fires up new
-// per-namespace gorotines when needed.
-func (l *kubeListener) manageResources(ns Event, terminators map[string]chan Done, out chan Event) {
+// manageResources starts an informer of network policies (see
+// KubeObject.produce) of every namespace added, and stops it when
+// the namespace is deleted. terminators has a termination channel
+// for the informer of every namespace, by UID.
+func (l *kubeListener) manageResources(ns Event, terminators map[string]chan Done, queue *workQueue) {
 	uid := ns.Object.Metadata.Uid
-	if ns.Type == KubeEventAdded {
+	if ns.Type == KubeEventAdded || ns.Type == InternalEventKnown {
 		if _, ok := terminators[uid]; ok {
 			log.Println("Received ADDED event for uid that is already known, ignoring ", uid)
 			return
 		}
 
 		done := make(chan Done)
+		err := ns.Object.produce(queue, done, l)
+		if err != nil {
+			log.Printf("Cannot watch policies of namespace %s: %s", ns.Object.Metadata.Name, err)
+			return
+		}
 		terminators[uid] = done
-		ns.Object.produce(out, terminators[uid], l)
 	} else if ns.Type == KubeEventDeleted {
 		if _, ok := terminators[uid]; !ok {
 			log.Println("Received DELETED event for uid that is not known, ignoring ", uid)
@@ -40,40 +46,5 @@ func (l *kubeListener) manageResources(ns Event, terminators map[string]chan Don
 
 		close(terminators[uid])
 		delete(terminators, uid)
-	} else if ns.Type == InternalEventDeleteAll {
-		for uid, c := range terminators {
-			close(c)
-			delete(terminators, uid)
-		}
 	}
 }
-
-// conductor manages a set of goroutines one per namespace.
-func (l *kubeListener) conductor(in <-chan Event, done <-chan Done) <-chan Event {
-	// done in arguments is a channel that can be used to stop Conductor itsefl
-	// while map of Done's below is for terminating managed gorotines.
-
-	// Idea of this map is to keep termination channels organized
-	// so when DELETED event occurs on a namespace it would be possible
-	// to terminater related goroutine.
-	terminators := map[string]chan Done{}
-
-	ns := Event{}
-	out := make(chan Event)
-
-	go func() {
-		for {
-			select {
-			case ns = <-in:
-				l.manageResources(ns, terminators, out)
-
-				// ADDED, DELETED events for namespace handled here
-				ns.handle(l)
-			case <-done:
-				return
-			}
-		}
-	}()
-
-	return out
-}
@@ -0,0 +1,377 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubernetes
+
+// Informers keep a cache of the Kubernetes objects of a kind (all
+// namespaces, or network policies of a namespace) in sync with the API
+// server. An informer lists the objects, then watches for changes
+// since the resourceVersion of the list, and queues an event for every
+// change (see workQueue). When a watch ends, such as when the API
+// server restarts, the informer watches again from the last version it
+// saw, so that no change is missed or delivered twice. If that version
+// is too old (the watch returns an ERROR event, 410 Gone), and every
+// resync_period seconds (300 by default), it lists the objects again
+// and queues events only for the differences with its cache. The
+// first list queues all objects as added, so that Romana catches up
+// with changes made while the listener was not running.
+//
+// When a replica takes over as the leader (see leader.go), the
+// informers start from the versions up to which the previous leader
+// handled changes: objects not changed since are queued as known
+// rather than added, and the informers watch from those versions, so
+// that changes made while no replica was leading, including
+// deletions, are not missed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResyncPeriod = 300 * time.Second
+
+	// Delays before listing or watching again after an error,
+	// doubled on every further error.
+	minInformerBackoff = 1 * time.Second
+	maxInformerBackoff = 60 * time.Second
+
+	// KubeEventError is the type of events sent on a watch that can
+	// not continue, such as when the requested version is too old.
+	KubeEventError = "ERROR"
+)
+
+// KubeObjectList is a list of objects returned by the Kubernetes API.
+type KubeObjectList struct {
+	Kind     string       `json:"kind"`
+	Metadata ListMetadata `json:"metadata"`
+	Items    []KubeObject `json:"items"`
+}
+
+// ListMetadata is the metadata of a list of objects.
+type ListMetadata struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// informer follows objects of a kind. See the top of the file.
+type informer struct {
+	// Kind of the objects, which items of lists may lack.
+	kind string
+	// URL to list the objects, without the watch parameter.
+	listURL      string
+	resyncPeriod time.Duration
+	queue        *workQueue
+
+	objects map[string]KubeObject
+	// Version handed off by the previous leader, until listed.
+	since string
+	// Version up to which changes have been queued.
+	resourceVersion string
+}
+
+// newInformer returns an informer of objects of the kind at the URL,
+// which may have the watch parameter (it is added when watching).
+func newInformer(kind string, rawURL string, resyncPeriod time.Duration, queue *workQueue) (*informer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Del("watch")
+	u.RawQuery = query.Encode()
+	return &informer{
+		kind:         kind,
+		listURL:      u.String(),
+		resyncPeriod: resyncPeriod,
+		queue:        queue,
+		objects:      make(map[string]KubeObject),
+	}, nil
+}
+
+// advance records that changes up to the version have been queued,
+// which the cursor of the informer in the queue moves to once they
+// are processed (see workQueue.checkpoint).
+func (inf *informer) advance(resourceVersion string) {
+	inf.resourceVersion = resourceVersion
+	inf.queue.checkpoint(inf.listURL, resourceVersion)
+}
+
+// newerVersion returns true if resource version a is newer than b.
+// Versions are opaque, but are integers in practice; if they are
+// not, a is assumed to be newer unless equal to b.
+func newerVersion(a string, b string) bool {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return a != b
+	}
+	return na > nb
+}
+
+// run follows the objects until done is closed.
+func (inf *informer) run(done <-chan Done) {
+	backoff := minInformerBackoff
+	relist := true
+	var resyncAt time.Time
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		var err error
+		if relist || !time.Now().Before(resyncAt) {
+			err = inf.list()
+			if err == nil {
+				relist = false
+				resyncAt = time.Now().Add(inf.resyncPeriod)
+			}
+		}
+		if err == nil {
+			relist, err = inf.watch(resyncAt, done)
+		}
+		if err == nil {
+			backoff = minInformerBackoff
+			continue
+		}
+
+		log.Printf("Informer for %s at %s: %s, retrying in %v", inf.kind, inf.listURL, err, backoff)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxInformerBackoff {
+			backoff = maxInformerBackoff
+		}
+	}
+}
+
+// list lists the objects and queues events
+// for the differences with the cache.
+func (inf *informer) list() error {
+	resp, err := http.Get(inf.listURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing returned %s", resp.Status)
+	}
+	list := KubeObjectList{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, object := range list.Items {
+		if object.Kind == "" {
+			object.Kind = inf.kind
+		}
+		key := object.makeId()
+		current[key] = true
+		cached, ok := inf.objects[key]
+		inf.objects[key] = object
+		switch {
+		case !ok && inf.since != "" && !newerVersion(object.Metadata.ResourceVersion, inf.since):
+			inf.queue.add(inf.listURL, Event{Type: InternalEventKnown, Object: object})
+		case !ok:
+			inf.queue.add(inf.listURL, Event{Type: KubeEventAdded, Object: object})
+		case cached.Metadata.Uid != object.Metadata.Uid:
+			// Deleted and created again while not watched.
+			inf.queue.add(inf.listURL, Event{Type: KubeEventDeleted, Object: cached})
+			inf.queue.add(inf.listURL, Event{Type: KubeEventAdded, Object: object})
+		case cached.Metadata.ResourceVersion != object.Metadata.ResourceVersion:
+			inf.queue.add(inf.listURL, Event{Type: KubeEventModified, Object: object})
+		}
+	}
+	for key, cached := range inf.objects {
+		if !current[key] {
+			delete(inf.objects, key)
+			inf.queue.add(inf.listURL, Event{Type: KubeEventDeleted, Object: cached})
+		}
+	}
+	log.Printf("Informer for %s: listed %d objects at version %s", inf.kind, len(list.Items), list.Metadata.ResourceVersion)
+	if inf.since != "" {
+		// Replay changes made since the previous leader stopped.
+		log.Printf("Informer for %s: resuming from version %s", inf.kind, inf.since)
+		inf.advance(inf.since)
+		inf.since = ""
+		return nil
+	}
+	inf.advance(list.Metadata.ResourceVersion)
+	return nil
+}
+
+// replayed returns true if the event, replayed when watching from a
+// version older than that of the last list, is already reflected in
+// the cache: the object is cached at the same or a newer version, or,
+// for a deletion, was created again since.
+func (inf *informer) replayed(key string, e Event) bool {
+	cached, ok := inf.objects[key]
+	if !ok {
+		return false
+	}
+	if e.Type == KubeEventDeleted {
+		return cached.Metadata.Uid != e.Object.Metadata.Uid
+	}
+	return !newerVersion(e.Object.Metadata.ResourceVersion, cached.Metadata.ResourceVersion)
+}
+
+// watch queues events for changes until the API server ends the
+// watch (which it is asked to do by until) or done is closed. It
+// returns true if the objects have to be listed again.
+func (inf *informer) watch(until time.Time, done <-chan Done) (bool, error) {
+	u, err := url.Parse(inf.listURL)
+	if err != nil {
+		return false, err
+	}
+	query := u.Query()
+	query.Set("watch", "true")
+	query.Set("resourceVersion", inf.resourceVersion)
+	timeout := int(until.Sub(time.Now()).Seconds())
+	if timeout < 1 {
+		timeout = 1
+	}
+	query.Set("timeoutSeconds", fmt.Sprint(timeout))
+	u.RawQuery = query.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("watching returned %s", resp.Status)
+	}
+
+	// Stop reading when done is closed.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			resp.Body.Close()
+		case <-stop:
+		}
+	}()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		e := Event{}
+		err := dec.Decode(&e)
+		if err != nil {
+			// The watch ended; watch again from the
+			// last version seen.
+			return false, nil
+		}
+		if e.Type == KubeEventError {
+			log.Printf("Informer for %s: watch from version %s failed, listing again", inf.kind, inf.resourceVersion)
+			return true, nil
+		}
+		if e.Object.Kind == "" {
+			e.Object.Kind = inf.kind
+		}
+		key := e.Object.makeId()
+		if inf.replayed(key, e) {
+			inf.advance(e.Object.Metadata.ResourceVersion)
+			continue
+		}
+		if e.Type == KubeEventDeleted {
+			delete(inf.objects, key)
+		} else {
+			inf.objects[key] = e.Object
+		}
+		inf.queue.add(inf.listURL, e)
+		inf.advance(e.Object.Metadata.ResourceVersion)
+	}
+}
+
+// informerSet keeps track of running informers, by the URL they list
+// objects at, so that their positions can be checkpointed and handed
+// off to the next leader.
+type informerSet struct {
+	mu        sync.Mutex
+	informers map[string]*informer
+	// Positions handed off by the previous leader.
+	handoff map[string]string
+	// Closed when the listener stops, as opposed to when
+	// an informer is stopped as its namespace is deleted.
+	term <-chan Done
+}
+
+func newInformerSet(handoff map[string]string, term <-chan Done) *informerSet {
+	return &informerSet{informers: make(map[string]*informer), handoff: handoff, term: term}
+}
+
+// start starts an informer of objects of the kind at the URL
+// (see newInformer), which runs until done is closed.
+func (s *informerSet) start(kind string, rawURL string, resyncPeriod time.Duration, queue *workQueue, done <-chan Done) error {
+	inf, err := newInformer(kind, rawURL, resyncPeriod, queue)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	inf.since = s.handoff[inf.listURL]
+	s.informers[inf.listURL] = inf
+	s.mu.Unlock()
+	go func() {
+		inf.run(done)
+		select {
+		case <-s.term:
+			// Keep the position to hand off.
+			return
+		default:
+		}
+		s.mu.Lock()
+		if s.informers[inf.listURL] == inf {
+			delete(s.informers, inf.listURL)
+			queue.forget(inf.listURL)
+		}
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// positions returns, by URL, the version up to which events of every
+// informer have been processed, or the version handed off to it if
+// it has not checkpointed yet.
+func (s *informerSet) positions() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	positions := make(map[string]string)
+	for listURL, inf := range s.informers {
+		position := inf.queue.position(listURL)
+		if position == "" {
+			position = s.handoff[listURL]
+		}
+		if position != "" {
+			positions[listURL] = position
+		}
+	}
+	return positions
+}
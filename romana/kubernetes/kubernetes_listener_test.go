@@ -21,9 +21,13 @@ import (
 	"github.com/go-check/check"
 	"github.com/romana/core/common"
 	"github.com/romana/core/tenant"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -51,31 +55,36 @@ func (ks kubeSimulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	flusher, _ := w.(http.Flusher)
 
 	reqURI, _ := url.Parse(r.RequestURI)
-	path := fmt.Sprintf("%s?%s", reqURI.Path, reqURI.RawQuery)
-	log.Printf("Request to %s", path)
-	if path == "/api/v1/namespaces/?watch=true" {
-		log.Printf("Sending %s", addNamespace1)
-		fmt.Fprintf(w, addNamespace1)
-		flusher.Flush() // Trigger "chunked" encoding and send a chunk...
-		time.Sleep(10 * time.Millisecond)
-		return
-	}
-	if strings.HasPrefix(path, "/apis/romana.io/demo/v1/namespaces/") && strings.HasSuffix(path, "/networkpolicys/?watch=true") {
+	path := reqURI.Path
+	watch := reqURI.Query().Get("watch") == "true"
+	log.Printf("Request to %s (watch: %t)", path, watch)
+	var object string
+	if path == "/api/v1/namespaces/" {
+		object = addNamespace1
+	} else if strings.HasPrefix(path, "/apis/romana.io/demo/v1/namespaces/") && strings.HasSuffix(path, "/networkpolicys/") {
 		uriArr := strings.Split(path, "/")
 		if len(uriArr) != 9 {
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte(fmt.Sprintf("Not found: %s", path)))
 			return
 		}
-		log.Printf("Sending %s", addPolicy1)
-		fmt.Fprintf(w, addPolicy1)
+		object = addPolicy1
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Not found: %s", path)))
+		return
+	}
+	if watch {
+		// Nothing changes until the watch times out.
 		flusher.Flush() // Trigger "chunked" encoding and send a chunk...
-		time.Sleep(10 * time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte(fmt.Sprintf("Not found: %s", path)))
-	return
+	e := Event{}
+	json.Unmarshal([]byte(object), &e)
+	list := KubeObjectList{Metadata: ListMetadata{ResourceVersion: e.Object.Metadata.ResourceVersion}, Items: []KubeObject{e.Object}}
+	log.Printf("Sending %+v", list)
+	json.NewEncoder(w).Encode(list)
 }
 
 // mockSvc is a Romana Service used in tests.
@@ -364,6 +373,16 @@ func (s *MySuite) TestListener(c *check.C) {
 
 }
 
+// TestNamespaceSegments tests segments created for namespaces.
+func (s *MySuite) TestNamespaceSegments(c *check.C) {
+	ns := KubeObject{Kind: "Namespace", Metadata: Metadata{Name: "ns1"}}
+	c.Assert(ns.namespaceSegments(), check.DeepEquals, []string{"default"})
+	ns.Metadata.Annotations = map[string]string{"romana.io/segments": "frontend, backend,"}
+	c.Assert(ns.namespaceSegments(), check.DeepEquals, []string{"frontend", "backend"})
+	ns.Metadata.Annotations = map[string]string{"romana.io/segments": ""}
+	c.Assert(len(ns.namespaceSegments()), check.Equals, 0)
+}
+
 const (
 	addPolicy1 = `{
 		"type":"ADDED",
@@ -420,3 +439,193 @@ const (
 	 						},
 	 				"spec":{"finalizers":["kubernetes"]},"status":{"phase":"Active"}}}`
 )
+
+// TestSourceNamespaces tests namespaces selected by
+// sources of traffic of policies.
+func (s *MySuite) TestSourceNamespaces(c *check.C) {
+	l := &kubeListener{segmentLabelName: "tier"}
+	for _, ns := range []KubeObject{
+		{Kind: "Namespace", Metadata: Metadata{Name: "prod-web", Labels: map[string]string{"env": "prod", "team": "web"}}},
+		{Kind: "Namespace", Metadata: Metadata{Name: "prod-db", Labels: map[string]string{"env": "prod"}}},
+		{Kind: "Namespace", Metadata: Metadata{Name: "dev"}},
+	} {
+		l.namespaces.set(ns.Metadata.Name, ns.Metadata.Labels)
+	}
+
+	var entry FromEntry
+	err := json.Unmarshal([]byte(`{"podSelector": {"matchLabels": {"tier": "frontend"}}}`), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(l.sourceNamespaces("dev", entry), check.DeepEquals, []string{"dev"})
+
+	err = json.Unmarshal([]byte(`{"namespaceSelector": {"matchLabels": {"env": "prod"}},
+		"podSelector": {"matchLabels": {"tier": "frontend"}}}`), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(l.sourceNamespaces("dev", entry), check.DeepEquals, []string{"prod-db", "prod-web"})
+
+	entry = FromEntry{Namespaces: &PodSelector{}}
+	c.Assert(l.sourceNamespaces("dev", entry), check.DeepEquals, []string{"dev", "prod-db", "prod-web"})
+
+	entry = FromEntry{Namespaces: &PodSelector{MatchLabels: map[string]string{"env": "prod", "team": "db"}}}
+	c.Assert(len(l.sourceNamespaces("dev", entry)), check.Equals, 0)
+
+	l.namespaces.remove("prod-db")
+	entry = FromEntry{Namespaces: &PodSelector{MatchLabels: map[string]string{"env": "prod"}}}
+	c.Assert(l.sourceNamespaces("dev", entry), check.DeepEquals, []string{"prod-web"})
+
+	// Pods can only be selected by segment.
+	_, err = l.translateFromEntry("dev", &tenant.Tenant{}, FromEntry{Pods: PodSelector{MatchLabels: map[string]string{"app": "x"}}})
+	c.Assert(err, check.NotNil)
+
+	entry = FromEntry{}
+	err = json.Unmarshal([]byte(`{"ipBlock": {"cidr": "172.16.0.0/12", "except": ["172.16.5.0/24"]}}`), &entry)
+	c.Assert(err, check.IsNil)
+	peers, err := l.translateFromEntry("dev", &tenant.Tenant{}, entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(peers, check.DeepEquals, []common.Endpoint{{Cidr: "172.16.0.0/12", Except: []string{"172.16.5.0/24"}}})
+}
+
+// TestInformer tests that informers queue events for changes seen
+// when watching and for differences found when listing again.
+func (s *MySuite) TestInformer(c *check.C) {
+	namespace := func(name string, version string) KubeObject {
+		return KubeObject{Metadata: Metadata{Name: name, Uid: name, ResourceVersion: version}}
+	}
+	lists := []KubeObjectList{
+		{Metadata: ListMetadata{ResourceVersion: "10"}, Items: []KubeObject{namespace("a", "1"), namespace("b", "2")}},
+		{Metadata: ListMetadata{ResourceVersion: "14"}, Items: []KubeObject{namespace("a", "11"), namespace("c", "13"), namespace("d", "14")}},
+	}
+	watches := [][]Event{
+		{{Type: KubeEventModified, Object: namespace("a", "11")}, {Type: KubeEventAdded, Object: namespace("c", "12")}},
+		{{Type: KubeEventError}},
+	}
+	var versions []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		if r.URL.Query().Get("watch") != "true" {
+			enc.Encode(lists[0])
+			lists = lists[1:]
+			return
+		}
+		versions = append(versions, r.URL.Query().Get("resourceVersion"))
+		for _, e := range watches[0] {
+			enc.Encode(e)
+		}
+		watches = watches[1:]
+	}))
+	defer svr.Close()
+
+	queue := newWorkQueue()
+	inf, err := newInformer("Namespace", svr.URL+"/api/v1/namespaces/?watch=true", time.Minute, queue)
+	c.Assert(err, check.IsNil)
+	done := make(chan Done)
+	defer close(done)
+
+	c.Assert(inf.list(), check.IsNil)
+	relist, err := inf.watch(time.Now().Add(time.Minute), done)
+	c.Assert(err, check.IsNil)
+	c.Assert(relist, check.Equals, false)
+	relist, err = inf.watch(time.Now().Add(time.Minute), done)
+	c.Assert(err, check.IsNil)
+	c.Assert(relist, check.Equals, true)
+	c.Assert(inf.list(), check.IsNil)
+	c.Assert(versions, check.DeepEquals, []string{"10", "12"})
+
+	// Modifications of objects already queued are merged.
+	var got []string
+	for queue.len() > 0 {
+		e := queue.get(done).event
+		c.Assert(e.Object.Kind, check.Equals, "Namespace")
+		got = append(got, fmt.Sprintf("%s %s %s", e.Type, e.Object.Metadata.Name, e.Object.Metadata.ResourceVersion))
+	}
+	c.Assert(got, check.DeepEquals, []string{
+		"ADDED a 11",
+		"ADDED b 2",
+		"ADDED c 13",
+		"ADDED d 14",
+		"DELETED b 2",
+	})
+	c.Assert(len(inf.objects), check.Equals, 3)
+	c.Assert(inf.resourceVersion, check.Equals, "14")
+}
+
+// TestInformerHandoff tests that an informer started from the position
+// handed off by a previous leader queues objects not changed since as
+// known, and replays changes made since, skipping those listed.
+func (s *MySuite) TestInformerHandoff(c *check.C) {
+	namespace := func(name string, version string) KubeObject {
+		return KubeObject{Metadata: Metadata{Name: name, Uid: name, ResourceVersion: version}}
+	}
+	list := KubeObjectList{Metadata: ListMetadata{ResourceVersion: "12"}, Items: []KubeObject{namespace("a", "5"), namespace("b", "8"), namespace("c", "12")}}
+	watch := []Event{
+		{Type: KubeEventDeleted, Object: namespace("x", "11")},
+		{Type: KubeEventAdded, Object: namespace("c", "12")},
+		{Type: KubeEventModified, Object: namespace("b", "13")},
+	}
+	var versions []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		if r.URL.Query().Get("watch") != "true" {
+			enc.Encode(list)
+			return
+		}
+		versions = append(versions, r.URL.Query().Get("resourceVersion"))
+		for _, e := range watch {
+			enc.Encode(e)
+		}
+	}))
+	defer svr.Close()
+
+	queue := newWorkQueue()
+	done := make(chan Done)
+	defer close(done)
+	inf, err := newInformer("Namespace", svr.URL+"/api/v1/namespaces/", time.Minute, queue)
+	c.Assert(err, check.IsNil)
+	informers := newInformerSet(map[string]string{inf.listURL: "10"}, done)
+	informers.informers[inf.listURL] = inf
+	inf.since = informers.handoff[inf.listURL]
+	c.Assert(informers.positions(), check.DeepEquals, map[string]string{inf.listURL: "10"})
+
+	c.Assert(inf.list(), check.IsNil)
+	_, err = inf.watch(time.Now().Add(time.Minute), done)
+	c.Assert(err, check.IsNil)
+	c.Assert(versions, check.DeepEquals, []string{"10"})
+	c.Assert(inf.resourceVersion, check.Equals, "13")
+
+	// The position moves as events are processed.
+	var got, positions []string
+	for queue.len() > 0 {
+		qe := queue.get(done)
+		queue.finish(qe)
+		e := qe.event
+		got = append(got, fmt.Sprintf("%s %s %s", e.Type, e.Object.Metadata.Name, e.Object.Metadata.ResourceVersion))
+		positions = append(positions, informers.positions()[inf.listURL])
+	}
+	c.Assert(got, check.DeepEquals, []string{
+		"KNOWN a 5",
+		"KNOWN b 8",
+		"ADDED c 12",
+		"DELETED x 11",
+		"MODIFIED b 13",
+	})
+	c.Assert(positions, check.DeepEquals, []string{"10", "10", "10", "12", "13"})
+}
+
+// TestCheckpoint tests saving and loading positions of informers.
+func (s *MySuite) TestCheckpoint(c *check.C) {
+	dir, err := ioutil.TempDir("", "listener")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	positions, err := loadCheckpoint(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(positions, check.IsNil)
+	c.Assert(saveCheckpoint(path, map[string]string{"http://localhost/api/v1/namespaces": "10"}), check.IsNil)
+	positions, err = loadCheckpoint(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(positions, check.DeepEquals, map[string]string{"http://localhost/api/v1/namespaces": "10"})
+
+	c.Assert(ioutil.WriteFile(path, []byte("{"), 0644), check.IsNil)
+	_, err = loadCheckpoint(path)
+	c.Assert(err, check.NotNil)
+}
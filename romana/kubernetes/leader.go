@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubernetes
+
+// The listener records, for every informer, the resource version up
+// to which it has processed events (see workQueue.checkpoint), so that
+// it resumes from there instead of processing all objects again, or
+// missing changes made while it was not running (see informer.go).
+//
+// With checkpoint_file set, positions are saved to that file, and
+// read from it when the listener starts. With leader_election set,
+// several replicas of the listener can run at once: they campaign for
+// a lease on root (see common.LeaderElection), only the leader runs
+// informers and processes events, and positions are recorded in the
+// lease, for the next leader to resume from.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/romana/core/common"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"time"
+)
+
+const (
+	defaultLeaderLeaseTTL = 15 * time.Second
+	// How often positions of informers are recorded.
+	positionRecordInterval = 5 * time.Second
+)
+
+// listenerCheckpoint is the content of the checkpoint file.
+type listenerCheckpoint struct {
+	// Positions of informers by the URL they list objects at.
+	Positions map[string]string `json:"positions"`
+}
+
+// loadCheckpoint returns positions saved in the checkpoint
+// file, or none if there is no file.
+func loadCheckpoint(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := listenerCheckpoint{}
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint file %s: %s", path, err)
+	}
+	return checkpoint.Positions, nil
+}
+
+// saveCheckpoint saves positions to the checkpoint file, replacing
+// it only once written so that a crash does not leave it truncated.
+func saveCheckpoint(path string, positions map[string]string) error {
+	data, err := json.Marshal(listenerCheckpoint{Positions: positions})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// replicaID identifies this replica of the listener.
+func replicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// start runs the listener, when this replica is the leader if
+// leader_election is set, until the process is shut down.
+func (l *kubeListener) start() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	// Stop processing and record final positions on
+	// shutdown, releasing the lease if leading.
+	common.AddShutdownHook(func() {
+		close(done)
+		<-stopped
+	})
+	if !l.leaderElection {
+		go func() {
+			defer close(stopped)
+			l.lead(nil, done)
+		}()
+		return
+	}
+	l.election = common.NewLeaderElection(l.restClient, l.Name(), replicaID(), l.leaderLeaseTTL)
+	log.Printf("%s: replica %s campaigning for leadership", l.Name(), l.election.ID())
+	go func() {
+		defer close(stopped)
+		l.election.Run(done, l.lead)
+	}()
+}
+
+// lead runs the listener from the positions handed off by the previous
+// leader, or else from those in the checkpoint file, until stop is
+// closed.
+func (l *kubeListener) lead(handoff map[string]string, stop <-chan struct{}) {
+	if len(handoff) == 0 && l.checkpointFile != "" {
+		var err error
+		handoff, err = loadCheckpoint(l.checkpointFile)
+		if err != nil {
+			log.Printf("%s: cannot load checkpoint, processing all objects: %s", l.Name(), err)
+		}
+	}
+	log.Printf("%s: starting, resuming %d informers", l.Name(), len(handoff))
+	done := make(chan Done)
+	queue := newWorkQueue()
+	stopped, err := l.run(handoff, queue, done)
+	if err != nil {
+		log.Printf("%s: cannot start: %s", l.Name(), err)
+		return
+	}
+	ticker := time.NewTicker(positionRecordInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-stop:
+			running = false
+		case <-ticker.C:
+			l.recordPositions()
+		}
+	}
+	close(done)
+	<-stopped
+	l.recordPositions()
+	log.Printf("%s: stopped", l.Name())
+}
+
+// recordPositions records positions of informers in the lease and
+// the checkpoint file.
+func (l *kubeListener) recordPositions() {
+	positions := l.informers.positions()
+	if l.election != nil {
+		l.election.SetData(positions)
+	}
+	if l.checkpointFile == "" || reflect.DeepEqual(positions, l.checkpointed) {
+		return
+	}
+	err := saveCheckpoint(l.checkpointFile, positions)
+	if err != nil {
+		log.Printf("%s: cannot save checkpoint: %s", l.Name(), err)
+		return
+	}
+	l.checkpointed = positions
+}
@@ -27,6 +27,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // readChunk reads the next chunk from the provided reader.
@@ -56,8 +57,8 @@ const (
 )
 
 // kubeListener is a Service that listens to updates
-// from Kubernetes by connecting to the endpoints specified
-// and consuming chunked JSON documents. The endpoints are
+// from Kubernetes by listing and watching objects at the
+// endpoints specified (see informer.go). The endpoints are
 // constructed from kubeURL and the following paths:
 // 1. namespaceNotificationPath for namespace additions/deletions
 // 2. policyNotificationPathPrefix + <namespace name> + policyNotificationPathPostfix
@@ -70,6 +71,20 @@ type kubeListener struct {
 	policyNotificationPathPrefix  string
 	policyNotificationPathPostfix string
 	segmentLabelName              string
+	// How often informers list objects again (see informer.go).
+	resyncPeriod time.Duration
+	namespaces   namespaceLabels
+	// Informers started by the current leader (see leader.go).
+	informers *informerSet
+	// File to save positions of informers to, and
+	// positions last saved to it.
+	checkpointFile string
+	checkpointed   map[string]string
+
+	// Whether replicas elect a leader, and the TTL of its lease.
+	leaderElection bool
+	leaderLeaseTTL time.Duration
+	election       *common.LeaderElection
 }
 
 // Routes returns various routes used in the service.
@@ -111,6 +126,37 @@ func (l *kubeListener) SetConfig(config common.ServiceConfig) error {
 	}
 	l.segmentLabelName = m["segment_label_name"].(string)
 
+	l.resyncPeriod = defaultResyncPeriod
+	if value, ok := m["resync_period"]; ok {
+		seconds, ok := value.(float64)
+		if !ok || seconds <= 0 {
+			return fmt.Errorf("Invalid resync_period %v, expected a number of seconds", value)
+		}
+		l.resyncPeriod = time.Duration(seconds * float64(time.Second))
+	}
+
+	if value, ok := m["checkpoint_file"]; ok {
+		l.checkpointFile, ok = value.(string)
+		if !ok {
+			return fmt.Errorf("Invalid checkpoint_file %v, expected a file name", value)
+		}
+	}
+
+	if value, ok := m["leader_election"]; ok {
+		l.leaderElection, ok = value.(bool)
+		if !ok {
+			return fmt.Errorf("Invalid leader_election %v, expected true or false", value)
+		}
+	}
+	l.leaderLeaseTTL = defaultLeaderLeaseTTL
+	if value, ok := m["leader_lease_ttl"]; ok {
+		seconds, ok := value.(float64)
+		if !ok || seconds < 3 {
+			return fmt.Errorf("Invalid leader_lease_ttl %v, expected a number of seconds, at least 3", value)
+		}
+		l.leaderLeaseTTL = time.Duration(seconds) * time.Second
+	}
+
 	return nil
 }
 
@@ -210,6 +256,8 @@ func (l *kubeListener) resolveTenantByName(tenantName string) (*tenant.Tenant, e
 // 1. Kubernetes Namespace corresponds to Romana Tenant
 // 2. If Romana Tenant does not exist it is an error (a tenant should
 //    automatically have been created when the namespace was added)
+// 3. Sources of traffic (see FromEntry) in namespaces other than the
+//    policy's become peers in their tenants
 func (l *kubeListener) translateNetworkPolicy(kubePolicy *KubeObject) (common.Policy, error) {
 	policyName := kubePolicy.Metadata.Name
 	romanaPolicy := &common.Policy{Direction: common.PolicyDirectionIngress, Name: policyName, ExternalID: policyName}
@@ -221,7 +269,6 @@ func (l *kubeListener) translateNetworkPolicy(kubePolicy *KubeObject) (common.Po
 		return *romanaPolicy, err
 	}
 	tenantID := t.ID
-	tenantExternalID := t.ExternalID
 
 	kubeSegmentID := kubePolicy.Spec.PodSelector.MatchLabels[l.segmentLabelName]
 	if kubeSegmentID == "" {
@@ -244,17 +291,11 @@ func (l *kubeListener) translateNetworkPolicy(kubePolicy *KubeObject) (common.Po
 	// Right now it is a work in progress.
 	for _, ingress := range kubePolicy.Spec.Ingress {
 		for _, entry := range ingress.From {
-			pods := entry.Pods
-			fromKubeSegmentID := pods.MatchLabels[l.segmentLabelName]
-			if fromKubeSegmentID == "" {
-				return *romanaPolicy, common.NewError("Expected segment to be specified in podSelector part as '%s'", l.segmentLabelName)
-			}
-			fromSegment, err := l.getOrAddSegment(ns, fromKubeSegmentID)
+			peers, err := l.translateFromEntry(ns, t, entry)
 			if err != nil {
 				return *romanaPolicy, err
 			}
-			peer := common.Endpoint{TenantID: tenantID, TenantExternalID: tenantExternalID, SegmentID: fromSegment.ID, SegmentExternalID: fromSegment.ExternalID}
-			romanaPolicy.Peers = append(romanaPolicy.Peers, peer)
+			romanaPolicy.Peers = append(romanaPolicy.Peers, peers...)
 		}
 		// TODO range
 		// toPorts := kubePolicy.Spec.Ingress[0].ToPorts
@@ -272,17 +313,67 @@ func (l *kubeListener) translateNetworkPolicy(kubePolicy *KubeObject) (common.Po
 	return *romanaPolicy, nil
 }
 
+// translateFromEntry translates a source of ingress traffic of a
+// policy of namespace ns (of tenant t) into peers: a CIDR peer for
+// ipBlock or, for every namespace the entry selects (see
+// sourceNamespaces), its tenant if all pods are selected, or the
+// segment given by the segment label of podSelector.
+func (l *kubeListener) translateFromEntry(ns string, t *tenant.Tenant, entry FromEntry) ([]common.Endpoint, error) {
+	if entry.IPBlock != nil {
+		return []common.Endpoint{{Cidr: entry.IPBlock.Cidr, Except: entry.IPBlock.Except}}, nil
+	}
+	fromKubeSegmentID := entry.Pods.MatchLabels[l.segmentLabelName]
+	if fromKubeSegmentID == "" && len(entry.Pods.MatchLabels) > 0 {
+		return nil, common.NewError("Expected segment to be specified in podSelector part as '%s'", l.segmentLabelName)
+	}
+	namespaces := l.sourceNamespaces(ns, entry)
+	if len(namespaces) == 0 {
+		log.Printf("translateFromEntry(): No namespaces match %v", entry.Namespaces.MatchLabels)
+	}
+	var peers []common.Endpoint
+	for _, fromNs := range namespaces {
+		fromTenant := t
+		if fromNs != ns {
+			var err error
+			fromTenant, err = l.resolveTenantByName(fromNs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		peer := common.Endpoint{TenantID: fromTenant.ID, TenantExternalID: fromTenant.ExternalID}
+		if fromKubeSegmentID != "" {
+			fromSegment, err := l.getOrAddSegment(fromNs, fromKubeSegmentID)
+			if err != nil {
+				return nil, err
+			}
+			peer.SegmentID = fromSegment.ID
+			peer.SegmentExternalID = fromSegment.ExternalID
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
 func (l *kubeListener) applyNetworkPolicy(action networkPolicyAction, romanaNetworkPolicy common.Policy) error {
-	policyURL, err := l.restClient.GetServiceUrl("policy")
+	serviceURL, err := l.restClient.GetServiceUrl("policy")
 	if err != nil {
 		return err
 	}
-	policyURL = fmt.Sprintf("%s/policies", policyURL)
+	policyURL := fmt.Sprintf("%s/policies", serviceURL)
 	policyStr, _ := json.Marshal(romanaNetworkPolicy)
 	switch action {
 	case networkPolicyActionAdd:
+		// Policies are added again when objects are listed
+		// after a restart, so existing ones are left alone.
+		err := l.restClient.Get(fmt.Sprintf("%s/find/policies/%s", serviceURL, romanaNetworkPolicy.Name), &common.Policy{})
+		if err == nil {
+			log.Printf("Policy %s already exists", romanaNetworkPolicy.Name)
+			return nil
+		} else if !isHttpStatus(err, http.StatusNotFound) {
+			return err
+		}
 		log.Printf("Applying policy %s", policyStr)
-		err := l.restClient.Post(policyURL, romanaNetworkPolicy, &romanaNetworkPolicy)
+		err = l.restClient.Post(policyURL, romanaNetworkPolicy, &romanaNetworkPolicy)
 		if err != nil {
 			return err
 		}
@@ -300,21 +391,32 @@ func (l *kubeListener) applyNetworkPolicy(action networkPolicyAction, romanaNetw
 
 func (l *kubeListener) Initialize() error {
 	log.Printf("%s: Starting server", l.Name())
-	nsURL, err := common.CleanURL(fmt.Sprintf("%s%s", l.kubeURL, l.namespaceNotificationPath))
+	_, err := common.CleanURL(fmt.Sprintf("%s%s", l.kubeURL, l.namespaceNotificationPath))
 	if err != nil {
 		return err
 	}
+	l.start()
+	return nil
+}
+
+// run starts the informer of namespaces, from the positions handed
+// off by the previous leader if any, and the processing of events,
+// until done is closed. It returns a channel closed once processing
+// has stopped.
+func (l *kubeListener) run(handoff map[string]string, queue *workQueue, done chan Done) (<-chan struct{}, error) {
+	nsURL, err := common.CleanURL(fmt.Sprintf("%s%s", l.kubeURL, l.namespaceNotificationPath))
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("Starting to listen on %s", nsURL)
-	done := make(chan Done)
-	nsEvents, err := l.nsWatch(done, nsURL)
+	l.informers = newInformerSet(handoff, done)
+	err = l.informers.start("Namespace", nsURL, l.resyncPeriod, queue, done)
 	if err != nil {
-		log.Fatal("Namespace watcher failed to start", err)
+		return nil, err
 	}
-
-	events := l.conductor(nsEvents, done)
-	l.process(events, done)
+	stopped := l.process(queue, done)
 	log.Println("All routines started")
-	return nil
+	return stopped, nil
 }
 
 // CreateSchema is placeholder for now.
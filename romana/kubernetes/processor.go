@@ -15,28 +15,38 @@
 
 package kubernetes
 
-import ()
-
-// Process is a goroutine that consumes resource update events and:
-// 1. On receiving an added or deleted event:
-//    a. If the Object Kind is NetworkPolicy, translates the body (Object of the event)
-//       to romana policy (common.Policy) using translateNetworkPolicy, and then
-//       calls applyNetworkPolicy with the appropriate action (add or delete)
-//    b. If the Object Kind is Namespace, attempts to add a new Tenant to Romana with that name.
-//       Logs an error if not possible.
-// 2. On receiving a done event, exit the goroutine
-func (l *kubeListener) process(in <-chan Event, done chan Done) {
+// process starts a goroutine that consumes events from the queue
+// and handles them (see Event.handle), starting and stopping informers
+// of policies of namespaces as they are added and deleted (see
+// manageResources). Events that fail to be handled are retried later.
+// When done is closed, the goroutine stops informers it started and
+// exits, closing the returned channel.
+func (l *kubeListener) process(queue *workQueue, done <-chan Done) <-chan struct{} {
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
+		// Termination channels of the informer
+		// of every namespace, by namespace UID.
+		terminators := map[string]chan Done{}
+		defer func() {
+			for _, terminator := range terminators {
+				close(terminator)
+			}
+		}()
 		for {
-			select {
-			case e := <-in:
-
-				// All events for policies and MODIFIED for namespaces
-				e.handle(l)
-			case <-done:
+			qe := queue.get(done)
+			if qe == nil {
 				return
 			}
+			if qe.event.Object.Kind == "Namespace" {
+				l.manageResources(qe.event, terminators, queue)
+			}
+			if err := qe.event.handle(l); err != nil {
+				queue.retry(qe, err)
+			} else {
+				queue.finish(qe)
+			}
 		}
 	}()
-	return
+	return stopped
 }
@@ -26,7 +26,7 @@ import (
 func TestResourceProcessor(t *testing.T) {
 
 	done := make(chan Done)
-	events := make(chan Event)
+	queue := newWorkQueue()
 
 	l := kubeListener{}
 	cfg := common.ServiceConfig{}
@@ -41,7 +41,12 @@ func TestResourceProcessor(t *testing.T) {
 	if err != nil {
 		t.Error(err.Error())
 	}
-	l.process(events, done)
+	// Romana services cannot be reached, so the event is retried.
+	l.restClient, err = common.NewRestClient(common.GetDefaultRestClientConfig("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.process(queue, done)
 	time.Sleep(time.Duration(1 * time.Second))
 
 	var e Event
@@ -49,6 +54,12 @@ func TestResourceProcessor(t *testing.T) {
 	dec := json.NewDecoder(policyReader)
 	dec.Decode(&e)
 
-	events <- e
-
+	queue.add("", e)
+	for i := 0; queue.len() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queue.len() > 0 {
+		t.Error("Expected the event to be processed")
+	}
+	close(done)
 }
@@ -0,0 +1,223 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubernetes
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How many times to retry an event that failed to be processed.
+	maxEventRetries = 5
+	// Delay before the first retry, doubled for every further one.
+	eventRetryDelay = 1 * time.Second
+)
+
+// queuedEvent is an event waiting to be processed.
+type queuedEvent struct {
+	event   Event
+	retries int
+	// Cursor of the source of the event, and entry of the event in it.
+	cursor *cursor
+	entry  *cursorEntry
+}
+
+// cursor tracks, for a source of events (an informer), the resource
+// version up to which all events it queued have been processed, so
+// that the listener can resume from there (see kubeListener.lead).
+// Sources add checkpoints with the resource version reached after
+// queuing events; the cursor moves to a checkpoint once all events
+// queued before it have been processed.
+type cursor struct {
+	entries  []*cursorEntry
+	position string
+}
+
+// cursorEntry is an event, or a checkpoint if resourceVersion is set.
+type cursorEntry struct {
+	resourceVersion string
+	done            bool
+}
+
+// advance moves the cursor past entries that are done.
+func (c *cursor) advance() {
+	for len(c.entries) > 0 && c.entries[0].done {
+		if c.entries[0].resourceVersion != "" {
+			c.position = c.entries[0].resourceVersion
+		}
+		c.entries = c.entries[1:]
+	}
+}
+
+// workQueue holds events from informers until they are processed.
+// A modification of an object whose last queued event has not been
+// processed yet replaces the object in that event instead of being
+// queued, so that a burst of changes, such as when watching again,
+// is processed as one.
+type workQueue struct {
+	mu     sync.Mutex
+	events []*queuedEvent
+	// Last queued event of every object, by object ID.
+	last map[string]*queuedEvent
+	// Cursor of every source, by source.
+	cursors map[string]*cursor
+	// Signalled when an event is queued.
+	ready chan struct{}
+}
+
+func newWorkQueue() *workQueue {
+	return &workQueue{
+		last:    make(map[string]*queuedEvent),
+		cursors: make(map[string]*cursor),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (q *workQueue) cursor(source string) *cursor {
+	c, ok := q.cursors[source]
+	if !ok {
+		c = &cursor{}
+		q.cursors[source] = c
+	}
+	return c
+}
+
+// add queues the event from the source.
+func (q *workQueue) add(source string, e Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qe := &queuedEvent{event: e}
+	if q.push(qe) {
+		qe.cursor = q.cursor(source)
+		qe.entry = &cursorEntry{}
+		qe.cursor.entries = append(qe.cursor.entries, qe.entry)
+	}
+}
+
+// push queues the event, returning false if it was merged
+// into a queued event instead. q.mu must be held.
+func (q *workQueue) push(qe *queuedEvent) bool {
+	key := qe.event.Object.Kind + "/" + qe.event.Object.makeId()
+	if last, ok := q.last[key]; ok && qe.event.Type == KubeEventModified && (last.event.Type == KubeEventAdded || last.event.Type == KubeEventModified) {
+		last.event.Object = qe.event.Object
+		return false
+	}
+	q.events = append(q.events, qe)
+	q.last[key] = qe
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// checkpoint records that the source reached the resource version
+// once all events it queued so far are processed.
+func (q *workQueue) checkpoint(source string, resourceVersion string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := q.cursor(source)
+	c.entries = append(c.entries, &cursorEntry{resourceVersion: resourceVersion, done: true})
+	c.advance()
+}
+
+// position returns the resource version up to which all events from
+// the source have been processed, empty if not known yet.
+func (q *workQueue) position(source string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if c, ok := q.cursors[source]; ok {
+		return c.position
+	}
+	return ""
+}
+
+// forget drops the cursor of a source that stopped.
+func (q *workQueue) forget(source string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.cursors, source)
+}
+
+// get returns the next event, waiting for one if there is
+// none, which has to be passed to finish or retry once processed.
+// It returns nil once done is closed.
+func (q *workQueue) get(done <-chan Done) *queuedEvent {
+	for {
+		q.mu.Lock()
+		if len(q.events) > 0 {
+			qe := q.events[0]
+			q.events = q.events[1:]
+			key := qe.event.Object.Kind + "/" + qe.event.Object.makeId()
+			if q.last[key] == qe {
+				delete(q.last, key)
+			}
+			q.mu.Unlock()
+			return qe
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// retry queues the event again after a delay growing with the
+// number of retries, unless it has been retried too many times.
+func (q *workQueue) retry(qe *queuedEvent, err error) {
+	if qe.retries >= maxEventRetries {
+		log.Printf("Giving up on %s event for %s after %d retries: %s", qe.event.Type, qe.event.Object.makeId(), qe.retries, err)
+		q.finish(qe)
+		return
+	}
+	delay := eventRetryDelay << uint(qe.retries)
+	qe.retries++
+	log.Printf("Retrying %s event for %s in %v: %s", qe.event.Type, qe.event.Object.makeId(), delay, err)
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if !q.push(qe) {
+			// Merged into a later event of the object.
+			q.finishLocked(qe)
+		}
+	})
+}
+
+// finish marks an event returned by get as processed.
+func (q *workQueue) finish(qe *queuedEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finishLocked(qe)
+}
+
+func (q *workQueue) finishLocked(qe *queuedEvent) {
+	if qe.entry == nil {
+		return
+	}
+	qe.entry.done = true
+	qe.cursor.advance()
+}
+
+// len returns the number of queued events.
+func (q *workQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
@@ -27,6 +27,13 @@ import (
 
 const (
 	selector = "podSelector"
+
+	// Annotation of a namespace listing (comma-separated) segments
+	// to create in its tenant; defaultNamespaceSegment if absent.
+	namespaceSegmentsAnnotation = "romana.io/segments"
+	defaultNamespaceSegment     = "default"
+	// Value of tenant.Tenant.Source for tenants of namespaces.
+	namespaceTenantSource = "kubernetes"
 )
 
 // Done is an alias for empty struct, used to make broadcast channels
@@ -40,10 +47,14 @@ type Event struct {
 }
 
 const (
-	KubeEventAdded         = "ADDED"
-	KubeEventDeleted       = "DELETED"
-	KubeEventModified      = "MODIFIED"
-	InternalEventDeleteAll = "_DELETE_ALL"
+	KubeEventAdded    = "ADDED"
+	KubeEventDeleted  = "DELETED"
+	KubeEventModified = "MODIFIED"
+
+	// InternalEventKnown is queued instead of KubeEventAdded for
+	// objects that the previous leader already handled (see
+	// informer.since), so that only informers are started for them.
+	InternalEventKnown = "KNOWN"
 )
 
 // KubeObject is a representation of object in kubernetes.
@@ -65,8 +76,22 @@ type PodSelector struct {
 	MatchLabels map[string]string `json:"matchLabels"`
 }
 
+// FromEntry selects sources of ingress traffic: pods of the policy's
+// namespace or, with Namespaces, pods of the namespaces it selects.
+// Empty selectors select all pods or all namespaces. With IPBlock,
+// the sources are addresses of the block, such as of an external
+// network, and the selectors are ignored.
 type FromEntry struct {
-	Pods PodSelector `json:"podSelector"`
+	Pods       PodSelector  `json:"podSelector"`
+	Namespaces *PodSelector `json:"namespaceSelector,omitempty"`
+	IPBlock    *IPBlock     `json:"ipBlock,omitempty"`
+}
+
+// IPBlock is a block of addresses, less the blocks within it
+// listed in Except.
+type IPBlock struct {
+	Cidr   string   `json:"cidr"`
+	Except []string `json:"except,omitempty"`
 }
 
 type Ingress struct {
@@ -97,21 +122,25 @@ type Metadata struct {
 	Annotations       map[string]string `json:"annotations,omitempty"`
 }
 
-// handle kubernetes events according to their type.
-func (e Event) handle(l *kubeListener) {
+// handle kubernetes events according to their type. It returns
+// an error if handling the event failed and is worth retrying.
+func (e Event) handle(l *kubeListener) error {
 	log.Printf("Processing %s request for %s", e.Type, e.Object.Metadata.Name)
 
+	if e.Type == InternalEventKnown {
+		return nil
+	}
 	if e.Object.Kind == "NetworkPolicy" && e.Type != KubeEventModified {
-		e.handleNetworkPolicyEvent(l)
+		return e.handleNetworkPolicyEvent(l)
 	} else if e.Object.Kind == "Namespace" {
-		e.handleNamespaceEvent(l)
-	} else {
-		log.Printf("Received unindentified request %s for %s", e.Type, e.Object.Metadata.Name)
+		return e.handleNamespaceEvent(l)
 	}
+	log.Printf("Received unindentified request %s for %s", e.Type, e.Object.Metadata.Name)
+	return nil
 }
 
 // handleNetworkPolicyEvent by creating or deleting romana policies.
-func (e Event) handleNetworkPolicyEvent(l *kubeListener) {
+func (e Event) handleNetworkPolicyEvent(l *kubeListener) error {
 	var action networkPolicyAction
 	if e.Type == KubeEventAdded {
 		action = networkPolicyActionAdd
@@ -119,37 +148,59 @@ func (e Event) handleNetworkPolicyEvent(l *kubeListener) {
 		action = networkPolicyActionDelete
 	}
 	policy, err := l.translateNetworkPolicy(&e.Object)
-	if err == nil {
-		j1, _ := json.Marshal(e)
-		j2, _ := json.Marshal(policy)
-		log.Printf("handleNetworkPolicyEvent(): translated\n\t%s\n\tto\n\t%s", j1, j2)
-		l.applyNetworkPolicy(action, policy)
-	} else {
-		log.Println(err)
+	if err != nil {
+		return err
+	}
+	j1, _ := json.Marshal(e)
+	j2, _ := json.Marshal(policy)
+	log.Printf("handleNetworkPolicyEvent(): translated\n\t%s\n\tto\n\t%s", j1, j2)
+	err = l.applyNetworkPolicy(action, policy)
+	if action == networkPolicyActionDelete && isHttpStatus(err, http.StatusNotFound) {
+		log.Printf("handleNetworkPolicyEvent(): Policy %s is already deleted", policy.Name)
+		return nil
 	}
+	return err
 }
 
 // handleNamespaceEvent by creating or deleting romana tenants.
-func (e Event) handleNamespaceEvent(l *kubeListener) {
+func (e Event) handleNamespaceEvent(l *kubeListener) error {
 	log.Printf("KubeEvent: Processing namespace event == %v and phase %v", e.Type, e.Object.Status)
 
+	if e.Type == KubeEventDeleted {
+		l.namespaces.remove(e.Object.Metadata.Name)
+	} else {
+		l.namespaces.set(e.Object.Metadata.Name, e.Object.Metadata.Labels)
+	}
+
 	if e.Type == KubeEventAdded {
-		tenantReq := tenant.Tenant{Name: e.Object.Metadata.Name, ExternalID: e.Object.Metadata.Uid}
+		tenantReq := tenant.Tenant{Name: e.Object.Metadata.Name, ExternalID: e.Object.Metadata.Uid, Source: namespaceTenantSource}
 		tenantResp := tenant.Tenant{}
 		log.Printf("KubeEventAdded: Posting to /tenants: %+v", tenantReq)
 		tenantUrl, err := l.restClient.GetServiceUrl("tenant")
 		if err != nil {
-			log.Printf("KubeEventAdded:Error adding tenant %s: %+v", tenantReq.Name, err)
+			return err
+		}
+		err = l.restClient.Post(fmt.Sprintf("%s/tenants", tenantUrl), tenantReq, &tenantResp)
+		if isHttpStatus(err, http.StatusConflict) {
+			// Namespaces are added again when listed after a restart.
+			log.Printf("KubeEventAdded: Tenant %s already exists", tenantReq.Name)
+		} else if err != nil {
+			return err
 		} else {
-			err := l.restClient.Post(fmt.Sprintf("%s/tenants", tenantUrl), tenantReq, &tenantResp)
-			if err != nil {
-				log.Printf("KubeEventAdded: Error adding tenant %s: %+v", tenantReq.Name, err)
-			} else {
-				log.Printf("KubeEventAdded: Added tenant: %+v", tenantResp)
-			}
+			log.Printf("KubeEventAdded: Added tenant: %+v", tenantResp)
 		}
 	} else if e.Type == KubeEventDeleted {
-		// TODO
+		err := l.deleteNamespaceTenant(e.Object)
+		if isHttpStatus(err, http.StatusNotFound) {
+			log.Printf("KubeEventDeleted: Tenant %s is already deleted", e.Object.Metadata.Name)
+			return nil
+		}
+		return err
+	}
+	if e.Object.Status["phase"] != "Terminating" {
+		if err := l.addNamespaceSegments(e.Object); err != nil {
+			return err
+		}
 	}
 
 	// Ignore repeated events during namespace termination
@@ -160,7 +211,64 @@ func (e Event) handleNamespaceEvent(l *kubeListener) {
 	} else {
 		e.Object.handleAnnotations(l)
 	}
+	return nil
+}
+
+// isHttpStatus returns true if err is an HTTP error with the status code.
+func isHttpStatus(err error, statusCode int) bool {
+	httpErr, ok := err.(common.HttpError)
+	return ok && httpErr.StatusCode == statusCode
+}
 
+// namespaceSegments returns names of segments to create
+// in the tenant of the namespace.
+func (o KubeObject) namespaceSegments() []string {
+	annotation, ok := o.Metadata.Annotations[namespaceSegmentsAnnotation]
+	if !ok {
+		return []string{defaultNamespaceSegment}
+	}
+	var segments []string
+	for _, name := range strings.Split(annotation, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			segments = append(segments, name)
+		}
+	}
+	return segments
+}
+
+// addNamespaceSegments creates segments of the namespace
+// (see namespaceSegments) that do not exist yet.
+func (l *kubeListener) addNamespaceSegments(o KubeObject) error {
+	for _, name := range o.namespaceSegments() {
+		_, err := l.getOrAddSegment(o.Metadata.Name, name)
+		if err != nil {
+			log.Printf("Error adding segment %s to tenant %s: %+v", name, o.Metadata.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteNamespaceTenant deletes the tenant of the namespace
+// along with its segments and default policy.
+func (l *kubeListener) deleteNamespaceTenant(o KubeObject) error {
+	tenantURL, err := l.restClient.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+	ten := &tenant.Tenant{}
+	err = l.restClient.Get(fmt.Sprintf("%s/external/tenants/%s", tenantURL, o.Metadata.Uid), ten)
+	if err != nil {
+		return err
+	}
+	// There is no default policy if the namespace was isolated.
+	err = l.applyNetworkPolicy(networkPolicyActionDelete, *defaultPolicy(ten))
+	if err != nil {
+		log.Printf("Error deleting default policy of namespace %s: %+v", o.Metadata.Name, err)
+	}
+	log.Printf("Deleting tenant %d of namespace %s", ten.ID, o.Metadata.Name)
+	return l.restClient.Delete(fmt.Sprintf("%s/tenants/%d", tenantURL, ten.ID), nil, &tenant.Tenant{})
 }
 
 // handleAnnotations on a namespace by implementing extra features requested through the annotation
@@ -175,6 +283,18 @@ func (o KubeObject) handleAnnotations(l *kubeListener) {
 	CreateDefaultPolicy(o, l)
 }
 
+// defaultPolicy returns the policy allowing traffic to the tenant
+// of a namespace that is not isolated.
+func defaultPolicy(ten *tenant.Tenant) *common.Policy {
+	return &common.Policy{
+		Direction: common.PolicyDirectionIngress,
+		Name:      fmt.Sprintf("ns%d", ten.NetworkID),
+		AppliedTo: []common.Endpoint{{TenantNetworkID: &ten.NetworkID}},
+		Peers:     []common.Endpoint{{Peer: common.Wildcard}},
+		Rules:     []common.Rule{{Protocol: common.Wildcard}},
+	}
+}
+
 func CreateDefaultPolicy(o KubeObject, l *kubeListener) {
 	log.Printf("In CreateDefaultPolicy for %v\n", o)
 	tenant, err := l.resolveTenantByName(o.Metadata.Name)
@@ -183,15 +303,7 @@ func CreateDefaultPolicy(o KubeObject, l *kubeListener) {
 		return
 	}
 
-	policyName := fmt.Sprintf("ns%d", tenant.NetworkID)
-
-	romanaPolicy := &common.Policy{
-		Direction: common.PolicyDirectionIngress,
-		Name:      policyName,
-		AppliedTo: []common.Endpoint{{TenantNetworkID: &tenant.NetworkID}},
-		Peers:     []common.Endpoint{{Peer: common.Wildcard}},
-		Rules:     []common.Rule{{Protocol: common.Wildcard}},
-	}
+	romanaPolicy := defaultPolicy(tenant)
 
 	log.Printf("In CreateDefaultPolicy with policy %v\n", romanaPolicy)
 
@@ -227,74 +339,13 @@ func CreateDefaultPolicy(o KubeObject, l *kubeListener) {
 	}
 }
 
-// watchEvents maintains goroutine fired by NsWatch, restarts it in case HTTP GET times out.
-func (l *kubeListener) watchEvents(done <-chan Done, url string, resp *http.Response, out chan Event) {
-	log.Println("Received namespace related event from kubernetes", resp.Body)
-
-	dec := json.NewDecoder(resp.Body)
-	var e Event
-
-	for {
-		select {
-		case <-done:
-			return
-		default:
-			// Flush e to ensure nothing gets carried over
-			e = Event{}
-
-			// Attempting to read event from HTTP connection
-			err := dec.Decode(&e)
-			if err != nil {
-				// If fail
-				log.Printf("Failed to decode message from connection %s due to %s\n. Attempting to re-establish", url, err)
-				// Then stop all goroutines
-				out <- Event{Type: InternalEventDeleteAll}
-
-				// And try to re-establish HTTP connection
-				resp, err2 := http.Get(url)
-				if err2 != nil {
-					log.Printf("Failed establish connection %s due to %s\n.", url, err)
-				} else if err2 == nil {
-					dec = json.NewDecoder(resp.Body)
-				}
-			} else {
-				// Else submit event
-				out <- e
-			}
-		}
-
-	}
-}
-
-// NsWatch is a generator that watches namespace related events in
-// kubernetes API and publishes this events to a channel.
-func (l *kubeListener) nsWatch(done <-chan Done, url string) (<-chan Event, error) {
-	out := make(chan Event)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return out, err
-	}
-
-	go l.watchEvents(done, url, resp, out)
-
-	return out, nil
-}
-
-// Produce method listens for resource updates happening within given namespace
-// and publishes these updates in a channel.
-func (ns KubeObject) produce(out chan Event, done <-chan Done, kubeListener *kubeListener) error {
+// produce starts an informer of network policies in the namespace,
+// which queues their events until done is closed.
+func (ns KubeObject) produce(queue *workQueue, done <-chan Done, kubeListener *kubeListener) error {
 	url, err := common.CleanURL(fmt.Sprintf("%s/%s/%s%s", kubeListener.kubeURL, kubeListener.policyNotificationPathPrefix, ns.Metadata.Name, kubeListener.policyNotificationPathPostfix))
 	if err != nil {
 		return err
 	}
-	log.Printf("Launching producer to listen for policy notifications on namespace %s at URL %s ", ns.Metadata.Name, url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-
-	go kubeListener.watchEvents(done, url, resp, out)
-
-	return nil
+	log.Printf("Launching informer of policies in namespace %s at URL %s ", ns.Metadata.Name, url)
+	return kubeListener.informers.start("NetworkPolicy", url, kubeListener.resyncPeriod, queue, done)
 }
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubernetes
+
+import (
+	"sort"
+	"sync"
+)
+
+// namespaceLabels keeps labels of namespaces seen in namespace
+// events, so that namespaceSelector of policies can be resolved
+// without asking Kubernetes.
+type namespaceLabels struct {
+	sync.Mutex
+	labels map[string]map[string]string
+}
+
+// set records labels of the namespace.
+func (n *namespaceLabels) set(namespace string, labels map[string]string) {
+	n.Lock()
+	defer n.Unlock()
+	if n.labels == nil {
+		n.labels = make(map[string]map[string]string)
+	}
+	n.labels[namespace] = labels
+}
+
+// remove forgets the namespace.
+func (n *namespaceLabels) remove(namespace string) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.labels, namespace)
+}
+
+// matching returns sorted names of namespaces having all labels of
+// the selector; all known namespaces for an empty selector.
+func (n *namespaceLabels) matching(selector PodSelector) []string {
+	n.Lock()
+	defer n.Unlock()
+	var names []string
+	for name, labels := range n.labels {
+		if selector.matches(labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matches returns true if labels include all labels of the selector.
+func (s PodSelector) matches(labels map[string]string) bool {
+	for key, value := range s.MatchLabels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceNamespaces returns namespaces whose pods are selected by
+// the entry of a policy of namespace ns: ns itself unless the entry
+// has a namespaceSelector.
+func (l *kubeListener) sourceNamespaces(ns string, entry FromEntry) []string {
+	if entry.Namespaces == nil {
+		return []string{ns}
+	}
+	return l.namespaces.matching(*entry.Namespaces)
+}
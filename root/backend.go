@@ -0,0 +1,343 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Backends for the global configuration served by root.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/romana/core/common"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of the configuration location (see Run()) that
+	// denotes configuration stored in etcd, as in
+	// etcd://127.0.0.1:2379/romana/config
+	etcdScheme = "etcd://"
+
+	// Timeout for etcd requests other than watches.
+	etcdTimeout = 10 * time.Second
+
+	// etcd v2 error codes we care about.
+	etcdErrorKeyNotFound  = 100
+	etcdErrorTestFailed   = 101
+	etcdErrorNodeExist    = 105
+	etcdErrorIndexCleared = 401
+)
+
+// configBackend is where the global configuration lives.
+type configBackend interface {
+	// load returns the configuration and its index in the backend.
+	load() (common.Config, uint64, error)
+	// save stores the configuration and returns its new index.
+	save(config common.Config) (uint64, error)
+	// String describes the backend for logging.
+	String() string
+}
+
+// watchingBackend is a configBackend that may be modified by
+// someone other than this root instance and can notify of changes.
+type watchingBackend interface {
+	configBackend
+	// watch blocks until configuration is modified after the
+	// provided index.
+	watch(index uint64) error
+}
+
+// electingBackend is a configBackend shared by several root
+// instances, which elects one of them as the leader.
+type electingBackend interface {
+	configBackend
+	// campaign attempts to become (or, if already, remain) the leader
+	// for the ttl, and returns the ID of the current leader.
+	campaign(id string, ttl time.Duration) (string, error)
+	// announce advertises the instance as a member for the ttl.
+	announce(id string, ttl time.Duration) error
+	// members returns IDs of all currently advertised instances.
+	members() ([]string, error)
+}
+
+// newConfigBackend creates the backend for the provided location,
+// which is either a file name or an etcd URL.
+func newConfigBackend(location string) (configBackend, error) {
+	if !strings.HasPrefix(location, etcdScheme) {
+		return &fileBackend{fileName: location}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return nil, common.NewError("Expected %shost:port/key, got %s", etcdScheme, location)
+	}
+	return newEtcdBackend("http://"+u.Host, u.Path), nil
+}
+
+// fileBackend keeps configuration in a YAML file.
+type fileBackend struct {
+	fileName string
+}
+
+func (f *fileBackend) load() (common.Config, uint64, error) {
+	config, err := common.ReadConfig(f.fileName)
+	return config, 0, err
+}
+
+func (f *fileBackend) save(config common.Config) (uint64, error) {
+	return 0, common.WriteConfig(config, f.fileName)
+}
+
+func (f *fileBackend) String() string {
+	return f.fileName
+}
+
+// etcdBackend keeps configuration, in the same YAML format as
+// the configuration file, as the value of a single etcd key.
+// It uses etcd v2 keys API.
+type etcdBackend struct {
+	endpoint string
+	key      string
+	client   *http.Client
+	// Watches have no timeout.
+	watchClient *http.Client
+}
+
+// etcdNode and etcdResponse are the parts of etcd v2 keys API
+// responses that we use.
+type etcdNode struct {
+	Key           string     `json:"key"`
+	Value         string     `json:"value"`
+	ModifiedIndex uint64     `json:"modifiedIndex"`
+	Nodes         []etcdNode `json:"nodes"`
+}
+
+type etcdResponse struct {
+	Action    string   `json:"action"`
+	Node      etcdNode `json:"node"`
+	ErrorCode int      `json:"errorCode"`
+	Message   string   `json:"message"`
+	// Set in the X-Etcd-Index header.
+	etcdIndex uint64
+}
+
+// etcdError is returned when etcd responds with an error.
+type etcdError struct {
+	Code    int
+	Message string
+}
+
+func (e etcdError) Error() string {
+	return fmt.Sprintf("etcd error %d: %s", e.Code, e.Message)
+}
+
+func newEtcdBackend(endpoint string, key string) *etcdBackend {
+	return &etcdBackend{endpoint: endpoint,
+		key:         "/" + strings.Trim(key, "/"),
+		client:      &http.Client{Timeout: etcdTimeout},
+		watchClient: &http.Client{},
+	}
+}
+
+func (e *etcdBackend) String() string {
+	return etcdScheme + strings.TrimPrefix(e.endpoint, "http://") + e.key
+}
+
+func (e *etcdBackend) keyUrl(key string, query url.Values) string {
+	u := e.endpoint + "/v2/keys" + key
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// Keys of the leader and of the directory of members are
+// siblings of the configuration key.
+func (e *etcdBackend) leaderKey() string {
+	return e.key + "-leader"
+}
+
+func (e *etcdBackend) membersKey() string {
+	return e.key + "-members"
+}
+
+func (e *etcdBackend) get(key string) (*etcdResponse, error) {
+	req, err := http.NewRequest("GET", e.keyUrl(key, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return e.do(e.client, req)
+}
+
+func (e *etcdBackend) put(key string, query url.Values, value string) (*etcdResponse, error) {
+	form := url.Values{}
+	form.Set("value", value)
+	req, err := http.NewRequest("PUT", e.keyUrl(key, query), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return e.do(e.client, req)
+}
+
+// do executes the request and parses etcd response.
+func (e *etcdBackend) do(client *http.Client, req *http.Request) (*etcdResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	etcdResp := &etcdResponse{}
+	err = json.Unmarshal(body, etcdResp)
+	if err != nil {
+		return nil, common.NewError("Cannot parse response from etcd (%d): %s", resp.StatusCode, string(body))
+	}
+	if etcdResp.ErrorCode != 0 {
+		return nil, etcdError{Code: etcdResp.ErrorCode, Message: etcdResp.Message}
+	}
+	etcdResp.etcdIndex, _ = strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+	return etcdResp, nil
+}
+
+func (e *etcdBackend) load() (common.Config, uint64, error) {
+	resp, err := e.get(e.key)
+	if err != nil {
+		return common.Config{}, 0, err
+	}
+	config, err := common.ParseConfig([]byte(resp.Node.Value))
+	return config, resp.Node.ModifiedIndex, err
+}
+
+func (e *etcdBackend) save(config common.Config) (uint64, error) {
+	data, err := common.MarshalConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := e.put(e.key, nil, string(data))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (e *etcdBackend) watch(index uint64) error {
+	query := url.Values{}
+	query.Set("wait", "true")
+	query.Set("waitIndex", strconv.FormatUint(index+1, 10))
+	req, err := http.NewRequest("GET", e.keyUrl(e.key, query), nil)
+	if err != nil {
+		return err
+	}
+	_, err = e.do(e.watchClient, req)
+	if err, ok := err.(etcdError); ok && err.Code == etcdErrorIndexCleared {
+		// Too many changes happened since index for etcd to
+		// remember them; the caller will reload anyway.
+		log.Printf("Root service: %s: %s", e, err)
+		return nil
+	}
+	return err
+}
+
+func (e *etcdBackend) campaign(id string, ttl time.Duration) (string, error) {
+	ttlStr := strconv.Itoa(int(ttl.Seconds()))
+	// Try to become the leader...
+	_, err := e.put(e.leaderKey(), url.Values{"prevExist": {"false"}, "ttl": {ttlStr}}, id)
+	if err == nil {
+		return id, nil
+	}
+	if etcdErr, ok := err.(etcdError); !ok || etcdErr.Code != etcdErrorNodeExist {
+		return "", err
+	}
+	// ...or extend the term if already the leader.
+	_, err = e.put(e.leaderKey(), url.Values{"prevValue": {id}, "ttl": {ttlStr}}, id)
+	if err == nil {
+		return id, nil
+	}
+	if etcdErr, ok := err.(etcdError); !ok || etcdErr.Code != etcdErrorTestFailed {
+		return "", err
+	}
+	resp, err := e.get(e.leaderKey())
+	if err != nil {
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+func (e *etcdBackend) announce(id string, ttl time.Duration) error {
+	key := e.membersKey() + "/" + url.QueryEscape(id)
+	_, err := e.put(key, url.Values{"ttl": {strconv.Itoa(int(ttl.Seconds()))}}, id)
+	return err
+}
+
+func (e *etcdBackend) members() ([]string, error) {
+	resp, err := e.get(e.membersKey())
+	if isKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var retval []string
+	for _, node := range resp.Node.Nodes {
+		retval = append(retval, node.Value)
+	}
+	return retval, nil
+}
+
+// isKeyNotFound returns true if err is etcd's "key not found" error.
+func isKeyNotFound(err error) bool {
+	etcdErr, ok := err.(etcdError)
+	return ok && etcdErr.Code == etcdErrorKeyNotFound
+}
+
+// SeedConfig stores configuration read from the file in the provided
+// location (see Run()) unless configuration already exists there.
+// It is used to initialize configuration in etcd.
+func SeedConfig(location string, fileName string) error {
+	backend, err := newConfigBackend(location)
+	if err != nil {
+		return err
+	}
+	_, _, err = backend.load()
+	if err == nil {
+		log.Printf("Root service: configuration already exists in %s", backend)
+		return nil
+	}
+	if !isKeyNotFound(err) {
+		return err
+	}
+	config, err := common.ReadConfig(fileName)
+	if err != nil {
+		return err
+	}
+	_, err = backend.save(config)
+	if err != nil {
+		return err
+	}
+	log.Printf("Root service: seeded %s from %s", backend, fileName)
+	return nil
+}
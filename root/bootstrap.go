@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Bootstrapping of the auth store of root: creating the initial
+// admin with generated credentials, for deployments with auth on.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// generatedPasswordBytes is how many random bytes
+// a generated password is made of.
+const generatedPasswordBytes = 18
+
+// BootstrapOptions tell Bootstrap what to create.
+type BootstrapOptions struct {
+	// Username of the admin, "admin" if empty.
+	Username string
+	// Reset generates a new password for the admin if it exists
+	// already (as it does with the default password when the
+	// schema was created by the root service), rather than failing.
+	Reset bool
+}
+
+// BootstrapResult is what Bootstrap created. The password is not
+// kept anywhere in clear, so it cannot be shown again.
+type BootstrapResult struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	// Token granting the roles of the admin, if root
+	// is configured with the key to sign it.
+	Token string `json:"token,omitempty"`
+}
+
+// Bootstrap creates the admin in the auth store of root, configured
+// at configLocation (see Run()), with a generated password and the
+// admin role. The store is seeded with DefaultRoles, and its schema
+// created first if it does not exist.
+func Bootstrap(configLocation string, options BootstrapOptions) (*BootstrapResult, error) {
+	backend, err := newConfigBackend(configLocation)
+	if err != nil {
+		return nil, err
+	}
+	fullConfig, _, err := backend.load()
+	if err != nil {
+		return nil, err
+	}
+	rootConfig := fullConfig.Services["root"].ServiceSpecific
+	storeConfig, ok := rootConfig["store"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("No store configured for root to keep users and roles in")
+	}
+	username := options.Username
+	if username == "" {
+		username = "admin"
+	}
+
+	store := &rootStore{bootstrapping: true}
+	store.ServiceStore = store
+	if err := store.SetConfig(storeConfig); err != nil {
+		return nil, err
+	}
+	if err := store.Connect(); err != nil {
+		return nil, err
+	}
+	if !store.Db.HasTable(&User{}) {
+		log.Printf("Bootstrap: creating schema of %s", store.Config)
+		if err := store.CreateSchema(false); err != nil {
+			return nil, err
+		}
+	} else if err := store.seedRoles(); err != nil {
+		return nil, err
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+	user, err := store.findUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		user, err = store.createUser(username, password)
+	} else if options.Reset {
+		log.Printf("Bootstrap: resetting password of %s", username)
+		err = store.setPassword(user, password)
+	} else {
+		err = errors.New(fmt.Sprintf("User %s exists already, reset its password to bootstrap it again", username))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := store.grantRole(user, "admin"); err != nil {
+		return nil, err
+	}
+
+	result := &BootstrapResult{Username: username, Password: password, Roles: []string{"admin"}}
+	if privateKeyLocation, ok := rootConfig["authPrivate"].(string); ok && privateKeyLocation != "" {
+		privateKey, err := ioutil.ReadFile(privateKeyLocation)
+		if err != nil {
+			return nil, err
+		}
+		result.Token, err = signToken(privateKey, result.Roles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// generatePassword returns a random password.
+func generatePassword() (string, error) {
+	buf := make([]byte, generatedPasswordBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Active/standby mode of several root instances sharing
+// configuration in etcd. One instance is elected the leader and
+// handles all writes; followers serve reads from the shared
+// configuration and forward writes to the leader.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// How long leadership and membership last unless renewed.
+	haTTL = 10 * time.Second
+	// How often leadership and membership are renewed.
+	haRefreshInterval = 3 * time.Second
+)
+
+// runHA keeps this instance advertised as a member and
+// campaigning for leadership.
+func (root *Root) runHA(backend electingBackend) {
+	for {
+		root.refreshHA(backend)
+		time.Sleep(haRefreshInterval)
+	}
+}
+
+// refreshHA renews membership and leadership once.
+func (root *Root) refreshHA(backend electingBackend) {
+	err := backend.announce(root.instanceUrl, haTTL)
+	if err != nil {
+		log.Printf("Root service: cannot announce %s in %s: %s", root.instanceUrl, backend, err)
+	}
+	leader, err := backend.campaign(root.instanceUrl, haTTL)
+	if err != nil {
+		// Cannot be sure we are still the leader, so
+		// stop accepting writes until we know.
+		log.Printf("Root service: cannot determine leader in %s: %s", backend, err)
+		leader = ""
+	}
+	members, err := backend.members()
+	if err != nil {
+		log.Printf("Root service: cannot list members in %s: %s", backend, err)
+	}
+
+	root.haMu.Lock()
+	if leader != root.leader {
+		log.Printf("Root service: leader changed from '%s' to '%s' (this instance is %s)", root.leader, leader, root.instanceUrl)
+	}
+	root.leader = leader
+	if err == nil {
+		root.members = members
+	}
+	root.haMu.Unlock()
+
+	if leader != "" && leader != root.instanceUrl {
+		root.syncRegistry(leader)
+	}
+}
+
+// syncRegistry replaces the local registry of services with
+// that of the leader, with which services register.
+func (root *Root) syncRegistry(leader string) {
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(leader))
+	if err != nil {
+		log.Printf("Root service: %s", err)
+		return
+	}
+	var regs []common.ServiceRegistration
+	err = client.Get(strings.TrimRight(leader, "/")+common.ServicesPath, &regs)
+	if err != nil {
+		log.Printf("Root service: cannot get services from leader %s: %s", leader, err)
+		return
+	}
+	if root.registry.replace(regs) {
+		root.configUpdated(fmt.Sprintf("Services synchronized from leader %s", leader))
+	}
+}
+
+// haState returns this instance's view of the current
+// leader and of all root instances.
+func (root *Root) haState() (string, []string) {
+	root.haMu.RLock()
+	defer root.haMu.RUnlock()
+	return root.leader, root.members
+}
+
+// forwardToLeader forwards a write request, or a read of state only
+// the leader has, to the leader if this instance is a follower,
+// returning true and the leader's response.
+// If this instance is the leader (or not running in HA mode), it
+// returns false, and the request should be handled locally.
+func (root *Root) forwardToLeader(ctx common.RestContext, method string, path string, input interface{}) (bool, interface{}, error) {
+	if _, ok := root.backend.(electingBackend); !ok {
+		return false, nil, nil
+	}
+	leader, _ := root.haState()
+	if leader == root.instanceUrl {
+		return false, nil, nil
+	}
+	if leader == "" {
+		return true, nil, common.NewHttpError(http.StatusServiceUnavailable, "No root service leader elected")
+	}
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(leader))
+	if err != nil {
+		return true, nil, err
+	}
+	url := strings.TrimRight(leader, "/") + path
+	log.Printf("Root service: forwarding %s %s to leader %s", method, path, leader)
+	result := make(map[string]interface{})
+	client = client.WithContext(ctx.Context)
+	switch method {
+	case "GET":
+		err = client.Get(url, &result)
+	case "POST":
+		err = client.Post(url, input, &result)
+	case "DELETE":
+		err = client.Delete(url, input, &result)
+	default:
+		return true, nil, common.NewError("Cannot forward %s %s", method, path)
+	}
+	if err != nil {
+		return true, nil, err
+	}
+	return true, result, nil
+}
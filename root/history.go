@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// History of configuration versions and rollback to them.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"strconv"
+	"time"
+)
+
+// How many versions of the configuration to keep.
+const maxConfigHistory = 100
+
+// copyConfig returns a copy of the configuration which can be
+// modified without affecting the original.
+func copyConfig(config common.Config) common.Config {
+	retval := common.Config{Services: make(map[string]common.ServiceConfig)}
+	for name, svcConfig := range config.Services {
+		if svcConfig.Common.Api != nil {
+			api := *svcConfig.Common.Api
+			svcConfig.Common.Api = &api
+		}
+		retval.Services[name] = svcConfig
+	}
+	return retval
+}
+
+// recordHistory adds current version of the configuration to
+// history, dropping the oldest one if there are too many. Must
+// be called with configMu held.
+func (root *Root) recordHistory(reason string) {
+	entry := common.ConfigHistoryEntry{
+		Version:   root.configVersion,
+		Timestamp: time.Now().Unix(),
+		Reason:    reason,
+		Config:    copyConfig(*root.config.full),
+	}
+	root.history = append(root.history, entry)
+	if len(root.history) > maxConfigHistory {
+		root.history = root.history[len(root.history)-maxConfigHistory:]
+	}
+}
+
+// handleConfigHistory handles GET to /config/history.
+// Versions are listed from oldest to newest.
+func (root *Root) handleConfigHistory(input interface{}, ctx common.RestContext) (interface{}, error) {
+	root.configMu.RLock()
+	defer root.configMu.RUnlock()
+	retval := make([]common.ConfigHistoryEntry, len(root.history))
+	copy(retval, root.history)
+	return retval, nil
+}
+
+// handleConfigRollback handles POST to /config/rollback/{version}.
+// Configuration of the provided version becomes current, as a new
+// version. Runtime registrations of services are not affected.
+func (root *Root) handleConfigRollback(input interface{}, ctx common.RestContext) (interface{}, error) {
+	versionStr := ctx.PathVariables["version"]
+	if forwarded, result, err := root.forwardToLeader(ctx, "POST", common.ConfigPath+"/rollback/"+versionStr, nil); forwarded {
+		return result, err
+	}
+	version, err := strconv.ParseUint(versionStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError400(fmt.Sprintf("Invalid version: %s", versionStr))
+	}
+	root.configMu.Lock()
+	found := false
+	for _, entry := range root.history {
+		if entry.Version == version {
+			newConfig := copyConfig(entry.Config)
+			root.config.full = &newConfig
+			found = true
+			break
+		}
+	}
+	root.configMu.Unlock()
+	if !found {
+		return nil, common.NewError404("configuration version", versionStr)
+	}
+	log.Printf("Root service: rolling back configuration to version %d", version)
+	err = root.persistConfig()
+	if err != nil {
+		return nil, err
+	}
+	root.configUpdated(fmt.Sprintf("Rolled back to version %d", version))
+	_, newVersion := root.versionedConfig()
+	return common.ConfigVersionResponse{Version: newVersion}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Leases that replicas of services use to elect a leader (see
+// common.LeaderElection). Leases are kept in memory by the root
+// instance that handles writes; in HA mode, followers forward
+// requests to the leader, so when the root leader changes, leases
+// and their data are lost and have to be acquired again.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"sync"
+	"time"
+)
+
+// leaseTable holds leases by name.
+type leaseTable struct {
+	sync.Mutex
+	leases map[string]common.Lease
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{leases: make(map[string]common.Lease)}
+}
+
+// current returns the named lease as of now,
+// without a holder if it has expired.
+func (t *leaseTable) current(name string, now time.Time) (common.Lease, bool) {
+	lease, ok := t.leases[name]
+	if ok && lease.Holder != "" && now.Unix() >= lease.ExpiresAt {
+		lease.Holder = ""
+		lease.ExpiresAt = 0
+	}
+	return lease, ok
+}
+
+// acquire acquires or renews the lease for its holder.
+func (t *leaseTable) acquire(req common.Lease, now time.Time) (common.Lease, error) {
+	if req.Holder == "" {
+		return common.Lease{}, common.NewError400("Lease holder is required.")
+	}
+	if req.TTL <= 0 {
+		return common.Lease{}, common.NewError400(fmt.Sprintf("Invalid lease TTL %d.", req.TTL))
+	}
+	t.Lock()
+	defer t.Unlock()
+	lease, _ := t.current(req.Name, now)
+	if lease.Holder != "" && lease.Holder != req.Holder {
+		// As with other conflicts, the details are the
+		// conflicting object, here the lease as held.
+		return common.Lease{}, common.NewErrorConflict(lease)
+	}
+	if lease.Holder == "" {
+		log.Printf("Root service: lease %s acquired by %s", req.Name, req.Holder)
+	}
+	lease.Name = req.Name
+	lease.Holder = req.Holder
+	lease.TTL = req.TTL
+	lease.ExpiresAt = now.Add(time.Duration(req.TTL) * time.Second).Unix()
+	if req.Data != nil {
+		lease.Data = req.Data
+	}
+	t.leases[req.Name] = lease
+	return lease, nil
+}
+
+// release releases the lease held by the holder of req.
+func (t *leaseTable) release(req common.Lease, now time.Time) (common.Lease, error) {
+	t.Lock()
+	defer t.Unlock()
+	lease, ok := t.current(req.Name, now)
+	if !ok {
+		return common.Lease{}, common.NewError404("lease", req.Name)
+	}
+	if lease.Holder != req.Holder {
+		return common.Lease{}, common.NewErrorConflict(lease)
+	}
+	log.Printf("Root service: lease %s released by %s", req.Name, req.Holder)
+	lease.Holder = ""
+	lease.ExpiresAt = 0
+	if req.Data != nil {
+		lease.Data = req.Data
+	}
+	t.leases[req.Name] = lease
+	return lease, nil
+}
+
+// get returns the named lease.
+func (t *leaseTable) get(name string, now time.Time) (common.Lease, error) {
+	t.Lock()
+	defer t.Unlock()
+	lease, ok := t.current(name, now)
+	if !ok {
+		return common.Lease{}, common.NewError404("lease", name)
+	}
+	return lease, nil
+}
+
+// handleAcquireLease handles POST to /leases/{leaseName}.
+func (root *Root) handleAcquireLease(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["leaseName"]
+	if forwarded, result, err := root.forwardToLeader(ctx, "POST", common.LeasesPath+"/"+name, input); forwarded {
+		return result, err
+	}
+	req := input.(*common.Lease)
+	req.Name = name
+	return root.leases.acquire(*req, time.Now())
+}
+
+// handleReleaseLease handles DELETE to /leases/{leaseName}.
+func (root *Root) handleReleaseLease(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["leaseName"]
+	if forwarded, result, err := root.forwardToLeader(ctx, "DELETE", common.LeasesPath+"/"+name, input); forwarded {
+		return result, err
+	}
+	req := input.(*common.Lease)
+	req.Name = name
+	return root.leases.release(*req, time.Now())
+}
+
+// handleGetLease handles GET to /leases/{leaseName}.
+func (root *Root) handleGetLease(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["leaseName"]
+	if forwarded, result, err := root.forwardToLeader(ctx, "GET", common.LeasesPath+"/"+name, nil); forwarded {
+		return result, err
+	}
+	return root.leases.get(name, time.Now())
+}
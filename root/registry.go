@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Live registry of services that registered themselves with root.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registry keeps track of services that registered with root
+// at runtime, keyed by service name.
+type registry struct {
+	sync.RWMutex
+	services map[string]common.ServiceRegistration
+}
+
+func newRegistry() *registry {
+	return &registry{services: make(map[string]common.ServiceRegistration)}
+}
+
+// add adds or replaces the registration.
+func (r *registry) add(reg common.ServiceRegistration) {
+	r.Lock()
+	defer r.Unlock()
+	r.services[reg.Name] = reg
+}
+
+// remove removes the registration of the named service,
+// returning false if there was none.
+func (r *registry) remove(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.services[name]; !ok {
+		return false
+	}
+	delete(r.services, name)
+	return true
+}
+
+// replace replaces all registrations with the provided ones,
+// returning true if anything changed.
+func (r *registry) replace(regs []common.ServiceRegistration) bool {
+	services := make(map[string]common.ServiceRegistration)
+	for _, reg := range regs {
+		services[reg.Name] = reg
+	}
+	r.Lock()
+	defer r.Unlock()
+	if reflect.DeepEqual(services, r.services) {
+		return false
+	}
+	r.services = services
+	return true
+}
+
+// get returns registration of the named service, if any.
+func (r *registry) get(name string) (common.ServiceRegistration, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	reg, ok := r.services[name]
+	return reg, ok
+}
+
+// list returns all registrations sorted by name.
+func (r *registry) list() []common.ServiceRegistration {
+	r.RLock()
+	defer r.RUnlock()
+	retval := make([]common.ServiceRegistration, 0, len(r.services))
+	for _, reg := range r.services {
+		retval = append(retval, reg)
+	}
+	sort.Sort(registrationsByName(retval))
+	return retval
+}
+
+type registrationsByName []common.ServiceRegistration
+
+func (r registrationsByName) Len() int           { return len(r) }
+func (r registrationsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r registrationsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+// handleRegisterService handles POST to /services.
+func (root *Root) handleRegisterService(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if forwarded, result, err := root.forwardToLeader(ctx, "POST", common.ServicesPath, input); forwarded {
+		return result, err
+	}
+	reg := input.(*common.ServiceRegistration)
+	reg.Name = strings.TrimSpace(reg.Name)
+	if reg.Name == "" {
+		return nil, common.NewError400("Service name is required.")
+	}
+	if reg.Name == common.ServiceRoot {
+		return nil, common.NewError400(fmt.Sprintf("Service name %s is reserved.", common.ServiceRoot))
+	}
+	u, err := url.Parse(reg.Url)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, common.NewError400(fmt.Sprintf("Invalid service URL '%s'.", reg.Url))
+	}
+	reg.RegisteredAt = time.Now().Unix()
+	root.registry.add(*reg)
+	root.configUpdated(fmt.Sprintf("Service %s registered at %s", reg.Name, reg.Url))
+	log.Printf("Root service: registered service %s at %s (version %s, capabilities %v)", reg.Name, reg.Url, reg.Version, reg.Capabilities)
+	return reg, nil
+}
+
+// handleDeregisterService handles DELETE to /services/{serviceName}.
+func (root *Root) handleDeregisterService(input interface{}, ctx common.RestContext) (interface{}, error) {
+	serviceName := ctx.PathVariables["serviceName"]
+	if forwarded, result, err := root.forwardToLeader(ctx, "DELETE", common.ServicesPath+"/"+serviceName, nil); forwarded {
+		return result, err
+	}
+	if !root.registry.remove(serviceName) {
+		return nil, common.NewError404("service", serviceName)
+	}
+	root.configUpdated(fmt.Sprintf("Service %s deregistered", serviceName))
+	log.Printf("Root service: deregistered service %s", serviceName)
+	return nil, nil
+}
+
+// handleListServices handles GET to /services.
+func (root *Root) handleListServices(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return root.registry.list(), nil
+}
+
+// liveServiceConfig returns the configuration of the named service,
+// with the API host and port replaced by those the service
+// registered with, if it did.
+func (root *Root) liveServiceConfig(serviceName string) common.ServiceConfig {
+	fullConfig, version := root.versionedConfig()
+	serviceConfig := root.applyRegistration(serviceName, fullConfig.Services[serviceName])
+	serviceConfig.Version = version
+	return serviceConfig
+}
+
+// applyRegistration replaces the API host and port in the provided
+// configuration of the named service with those the service
+// registered with, if it did.
+func (root *Root) applyRegistration(serviceName string, serviceConfig common.ServiceConfig) common.ServiceConfig {
+	reg, ok := root.registry.get(serviceName)
+	if !ok {
+		return serviceConfig
+	}
+	u, err := url.Parse(reg.Url)
+	if err != nil {
+		return serviceConfig
+	}
+	// Copy Api so as not to modify the static configuration.
+	api := common.Api{}
+	if serviceConfig.Common.Api != nil {
+		api = *serviceConfig.Common.Api
+	}
+	host := u.Host
+	if idx := strings.LastIndex(host, ":"); idx >= 0 {
+		port, err := strconv.ParseUint(host[idx+1:], 10, 64)
+		if err == nil {
+			api.Port = port
+		}
+		host = host[0:idx]
+	}
+	api.Host = host
+	serviceConfig.Common.Api = &api
+	return serviceConfig
+}
@@ -23,8 +23,10 @@ import (
 	"github.com/romana/core/common"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -45,8 +47,57 @@ type Root struct {
 	//	routes     common.Routes
 	privateKey []byte
 	store      rootStore
+	// Services registered at runtime.
+	registry *registry
+	// Leases for leader election of services (see lease.go).
+	leases *leaseTable
+
+	// Where the full configuration is stored.
+	backend configBackend
+	// Index of the configuration in the backend.
+	backendIndex uint64
+
+	// configMu guards config.full, configVersion, configChanged,
+	// history and backendIndex.
+	configMu sync.RWMutex
+	// configVersion is incremented on every change to
+	// configuration served by root.
+	configVersion uint64
+	// configChanged is closed (and replaced) on every change.
+	configChanged chan struct{}
+	// Most recent versions of the configuration (see history.go).
+	history []common.ConfigHistoryEntry
+	// Configuration of each service as last served, and
+	// version at which it last changed (see trackServiceVersions).
+	serviceConfigs  map[string]common.ServiceConfig
+	serviceVersions map[string]uint64
+
+	// URL this instance is reachable at, used to
+	// identify it in HA mode (see ha.go).
+	instanceUrl string
+	// haMu guards leader and members.
+	haMu sync.RWMutex
+	// URL of the current leader, empty if unknown.
+	leader string
+	// URLs of all root instances.
+	members []string
+
+	// supervisorMu guards supervisor.
+	supervisorMu sync.RWMutex
+	// Supervisor of the rest of the services, if root
+	// started them (see supervisor.go).
+	supervisor *supervisor
 }
 
+const (
+	// How long to wait before retrying a failed watch of the backend.
+	backendRetryInterval = 5 * time.Second
+
+	// How long to hold a watch request on /config if the
+	// request has no deadline.
+	defaultConfigWatchTimeout = 30 * time.Second
+)
+
 const fullConfigKey = "fullConfig"
 
 // SetConfig implements SetConfig function of the Service interface
@@ -56,6 +107,15 @@ func (root *Root) SetConfig(config common.ServiceConfig) error {
 	root.config.common = &config.Common
 	f := config.ServiceSpecific[fullConfigKey].(common.Config)
 	root.config.full = &f
+	root.registry = newRegistry()
+	root.leases = newLeaseTable()
+	root.configVersion = 1
+	root.configChanged = make(chan struct{})
+	root.history = nil
+	root.recordHistory("Initial configuration")
+	root.serviceConfigs = make(map[string]common.ServiceConfig)
+	root.serviceVersions = make(map[string]uint64)
+	root.trackServiceVersions()
 	var err error
 	root.store = rootStore{}
 	root.store.ServiceStore = &root.store
@@ -85,6 +145,113 @@ func (root *Root) SetConfig(config common.ServiceConfig) error {
 }
 
 func (root *Root) Initialize() error {
+	if backend, ok := root.backend.(watchingBackend); ok {
+		go root.watchBackend(backend)
+	}
+	return nil
+}
+
+// watchBackend reloads configuration whenever it is changed
+// in the backend.
+func (root *Root) watchBackend(backend watchingBackend) {
+	for {
+		root.configMu.RLock()
+		index := root.backendIndex
+		root.configMu.RUnlock()
+		err := backend.watch(index)
+		if err == nil {
+			var config common.Config
+			var index uint64
+			config, index, err = backend.load()
+			if err == nil {
+				root.configMu.Lock()
+				if index == root.backendIndex {
+					// Our own change.
+					root.configMu.Unlock()
+					continue
+				}
+				log.Printf("Root service: configuration in %s changed (index %d)", backend, index)
+				root.backendIndex = index
+				root.config.full = &config
+				root.configMu.Unlock()
+				root.configUpdated(fmt.Sprintf("Reloaded from %s", backend))
+				continue
+			}
+		}
+		log.Printf("Root service: error watching %s: %s", backend, err)
+		time.Sleep(backendRetryInterval)
+	}
+}
+
+// configUpdated bumps configuration version, records it
+// in history and wakes up watchers.
+func (root *Root) configUpdated(reason string) {
+	root.configMu.Lock()
+	defer root.configMu.Unlock()
+	root.configVersion++
+	root.recordHistory(reason)
+	root.trackServiceVersions()
+	close(root.configChanged)
+	root.configChanged = make(chan struct{})
+}
+
+// fullConfig returns current full configuration.
+func (root *Root) fullConfig() *common.Config {
+	root.configMu.RLock()
+	defer root.configMu.RUnlock()
+	return root.config.full
+}
+
+// trackServiceVersions notes the current version as the one at
+// which configuration of a service changed, for every service whose
+// configuration differs from that last seen. Must be called with
+// configMu held.
+func (root *Root) trackServiceVersions() {
+	current := make(map[string]common.ServiceConfig)
+	for name, serviceConfig := range root.config.full.Services {
+		current[name] = serviceConfig
+	}
+	for _, reg := range root.registry.list() {
+		current[reg.Name] = root.config.full.Services[reg.Name]
+	}
+	for name, serviceConfig := range current {
+		serviceConfig = root.applyRegistration(name, serviceConfig)
+		if prev, ok := root.serviceConfigs[name]; !ok || !reflect.DeepEqual(prev, serviceConfig) {
+			root.serviceConfigs[name] = serviceConfig
+			root.serviceVersions[name] = root.configVersion
+		}
+	}
+	for name := range root.serviceConfigs {
+		if _, ok := current[name]; !ok {
+			delete(root.serviceConfigs, name)
+			root.serviceVersions[name] = root.configVersion
+		}
+	}
+}
+
+// versionedConfig returns current full configuration and its version.
+func (root *Root) versionedConfig() (*common.Config, uint64) {
+	root.configMu.RLock()
+	defer root.configMu.RUnlock()
+	return root.config.full, root.configVersion
+}
+
+// persistConfig saves current configuration if it is stored in a
+// backend shared with other root instances, so that they see
+// the change too.
+func (root *Root) persistConfig() error {
+	backend, ok := root.backend.(watchingBackend)
+	if !ok {
+		return nil
+	}
+	root.configMu.Lock()
+	defer root.configMu.Unlock()
+	index, err := backend.save(*root.config.full)
+	if err != nil {
+		return err
+	}
+	root.backendIndex = index
+	log.Printf("Root service: saved configuration to %s (index %d)", backend, index)
 	return nil
 }
 
@@ -94,10 +261,24 @@ func (root *Root) handlePortUpdate(input interface{}, ctx common.RestContext) (i
 	portUpdateMsg := input.(*common.PortUpdateMessage)
 	pathVars := ctx.PathVariables
 	serviceName := pathVars["serviceName"]
-	serviceConfig := root.config.full.Services[serviceName]
+	if forwarded, result, err := root.forwardToLeader(ctx, "POST", "/config/"+serviceName+"/port", input); forwarded {
+		return result, err
+	}
+	root.configMu.Lock()
+	// Configuration is copied rather than modified
+	// as previous versions are kept in history.
+	newConfig := copyConfig(*root.config.full)
+	serviceConfig := newConfig.Services[serviceName]
 	oldPort := serviceConfig.Common.Api.Port
 	serviceConfig.Common.Api.Port = portUpdateMsg.Port
+	root.config.full = &newConfig
+	root.configMu.Unlock()
 	log.Printf("Root service: registering port %d for service %s (was %d)\n", serviceConfig.Common.Api.Port, serviceName, oldPort)
+	err := root.persistConfig()
+	if err != nil {
+		return nil, err
+	}
+	root.configUpdated(fmt.Sprintf("Port of %s set to %d", serviceName, portUpdateMsg.Port))
 	return nil, nil
 }
 
@@ -105,22 +286,28 @@ func (root *Root) handlePortUpdate(input interface{}, ctx common.RestContext) (i
 func (root *Root) handleAuth(input interface{}, ctx common.RestContext) (interface{}, error) {
 	cred := input.(*common.Credential)
 	// We assume just username/password for now
-	roles, err := root.store.Authenticate(*cred)
+	roles, err := root.store.Authenticate(ctx.Context, *cred)
 	if err != nil {
 		return nil, err
 	}
-	token := jwt.New(jwt.SigningMethodHS256)
 	rolesStr := make([]string, len(roles))
 	for i := range roles {
 		rolesStr[i] = roles[i].Name()
 	}
-	token.Claims["roles"] = rolesStr
+	jwtString, err := signToken(root.privateKey, rolesStr)
+	return common.TokenMessage{Token: jwtString}, err
+}
+
+// signToken returns a token granting the roles, signed with the key.
+func signToken(privateKey []byte, roles []string) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["roles"] = roles
 	token.Claims["iat"] = time.Now().Unix()
 	// TODO make this configurable?
 	token.Claims["exp"] = time.Now().Add(time.Second * 3600 * 24).Unix()
-	jwtString, err := token.SignedString(root.privateKey)
+	jwtString, err := token.SignedString(privateKey)
 	log.Printf("Signed token %v as %s", token, jwtString)
-	return common.TokenMessage{Token: jwtString}, err
+	return jwtString, err
 }
 
 // Handler for the / URL
@@ -131,17 +318,39 @@ func (root *Root) handleIndex(input interface{}, ctx common.RestContext) (interf
 	retval.ServiceName = "root"
 	myUrl := strings.Join([]string{"http://", root.config.common.Api.Host, ":", strconv.FormatUint(root.config.common.Api.Port, 10)}, "")
 
-	// Links has links to config URLs for now, but also self - hence plus one
-	retval.Links = make([]common.LinkResponse, len(root.config.full.Services)+2)
+	// Services from the config file, as well as those that
+	// registered at runtime but are not in the config file.
+	// Registered URL takes precedence over the configured one.
+	// Services configured with port 0 have no URL until they
+	// start and report the port they got.
+	hrefs := make(map[string]string)
+	var names []string
+	config := root.fullConfig()
+	for key, value := range config.Services {
+		names = append(names, key)
+		if value.Common.Api.Port != 0 {
+			hrefs[key] = "http://" + value.Common.Api.GetHostPort()
+		}
+	}
+	for _, reg := range root.registry.list() {
+		if _, ok := config.Services[reg.Name]; !ok {
+			names = append(names, reg.Name)
+		}
+		hrefs[reg.Name] = reg.Url
+	}
+
+	// Links has links to config URLs for now, but also self, auth and services
+	// as well as to other root instances in HA mode.
+	leader, members := root.haState()
+	retval.Links = make([]common.LinkResponse, len(names)+3, len(names)+4+len(members))
 
-	retval.Services = make([]common.ServiceResponse, len(root.config.full.Services))
+	retval.Services = make([]common.ServiceResponse, 0, len(hrefs))
 	i := 0
-	for key, value := range root.config.full.Services {
-		retval.Services[i] = common.ServiceResponse{}
-		retval.Services[i].Name = key
-		href := "http://" + value.Common.Api.GetHostPort()
-		link := common.LinkResponse{Rel: "service", Href: href}
-		retval.Services[i].Links = []common.LinkResponse{link}
+	for _, key := range names {
+		if href, ok := hrefs[key]; ok {
+			link := common.LinkResponse{Rel: "service", Href: href}
+			retval.Services = append(retval.Services, common.ServiceResponse{Name: key, Links: []common.LinkResponse{link}})
+		}
 		configLink := common.LinkResponse{Href: "/config/" + key, Rel: key + "-config"}
 		retval.Links[i] = configLink
 		i++
@@ -149,6 +358,14 @@ func (root *Root) handleIndex(input interface{}, ctx common.RestContext) (interf
 	retval.Links[i] = common.LinkResponse{Href: myUrl, Rel: "self"}
 	i++
 	retval.Links[i] = common.LinkResponse{Href: "/auth", Rel: "auth"}
+	i++
+	retval.Links[i] = common.LinkResponse{Href: common.ServicesPath, Rel: "services"}
+	for _, member := range members {
+		retval.Links = append(retval.Links, common.LinkResponse{Href: member, Rel: common.RootLinkRel})
+	}
+	if leader != "" {
+		retval.Links = append(retval.Links, common.LinkResponse{Href: leader, Rel: common.RootLeaderLinkRel})
+	}
 	return retval, nil
 }
 
@@ -156,15 +373,111 @@ func (root *Root) Name() string {
 	return common.ServiceRoot
 }
 
-// Handler for the /config
+// Handler for the /config/{serviceName}. If watch=true and since=N
+// query parameters are given, it waits until configuration of the
+// service changes after version N (or the request is about to time out).
 func (root *Root) handleConfig(input interface{}, ctx common.RestContext) (interface{}, error) {
 	pathVars := ctx.PathVariables
 	serviceName := pathVars["serviceName"]
 	log.Printf("Received request for config of %s", serviceName)
-	retval := root.config.full.Services[serviceName]
+	if ctx.QueryVariables.Get("watch") == "true" {
+		since, err := parseSince(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = root.waitForChange(ctx, func() bool {
+			return root.serviceVersions[serviceName] > since
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	retval := root.liveServiceConfig(serviceName)
 	return retval, nil
 }
 
+// handleConfigValidate handles POST to /config/validate. It parses and
+// validates the provided configuration without applying it, and
+// reports all problems found.
+func (root *Root) handleConfigValidate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*common.ConfigValidationRequest)
+	retval := common.ConfigValidationResponse{}
+	config, err := common.ParseConfig([]byte(req.Config))
+	if err != nil {
+		retval.Errors = append(retval.Errors, err.Error())
+		return retval, nil
+	}
+	for _, err := range common.ValidateConfig(config) {
+		retval.Errors = append(retval.Errors, err.Error())
+	}
+	_, err = dependencyOrder(config)
+	if err != nil {
+		retval.Errors = append(retval.Errors, err.Error())
+	}
+	retval.Valid = len(retval.Errors) == 0
+	return retval, nil
+}
+
+// parseSince parses the since query parameter of watch requests.
+func parseSince(ctx common.RestContext) (uint64, error) {
+	since, err := strconv.ParseUint(ctx.QueryVariables.Get("since"), 10, 64)
+	if err != nil {
+		return 0, common.NewError400(fmt.Sprintf("Invalid value of since: %s", ctx.QueryVariables.Get("since")))
+	}
+	return since, nil
+}
+
+// waitForChange waits until changed returns true, checking it on
+// every configuration change, or until the request is about to time
+// out, whichever comes first. changed is called with configMu held
+// for reading.
+func (root *Root) waitForChange(ctx common.RestContext, changed func() bool) error {
+	timeout := defaultConfigWatchTimeout
+	if deadline, ok := ctx.Context.Deadline(); ok {
+		// Leave some time to write the response.
+		timeout = deadline.Sub(time.Now()) * 9 / 10
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		root.configMu.RLock()
+		done := changed()
+		configChanged := root.configChanged
+		root.configMu.RUnlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-configChanged:
+		case <-timer.C:
+			return nil
+		case <-ctx.Context.Done():
+			return ctx.Context.Err()
+		}
+	}
+}
+
+// handleConfigVersion handles GET to /config. It returns current
+// version of the configuration. If watch=true and since=N query
+// parameters are given, it waits until the version is greater
+// than N (or the request is about to time out).
+func (root *Root) handleConfigVersion(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if ctx.QueryVariables.Get("watch") == "true" {
+		since, err := parseSince(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = root.waitForChange(ctx, func() bool {
+			return root.configVersion > since
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, version := root.versionedConfig()
+	return common.ConfigVersionResponse{Version: version}, nil
+}
+
 // Routes provided by root service.
 func (root *Root) Routes() common.Routes {
 	routes := common.Routes{
@@ -182,6 +495,34 @@ func (root *Root) Routes() common.Routes {
 			MakeMessage:     func() interface{} { return &common.Credential{} },
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         common.ConfigPath,
+			Handler:         root.handleConfigVersion,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         common.ConfigPath + "/history",
+			Handler:         root.handleConfigHistory,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         common.ConfigPath + "/validate",
+			Handler:         root.handleConfigValidate,
+			MakeMessage:     func() interface{} { return &common.ConfigValidationRequest{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         common.ConfigPath + "/rollback/{version}",
+			Handler:         root.handleConfigRollback,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         "/config/{serviceName}",
@@ -196,24 +537,115 @@ func (root *Root) Routes() common.Routes {
 			MakeMessage:     func() interface{} { return &common.PortUpdateMessage{} },
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         common.StatusPath,
+			Handler:         root.handleStatus,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         common.ServicesPath,
+			Handler:         root.handleListServices,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         common.ServicesPath,
+			Handler:         root.handleRegisterService,
+			MakeMessage:     func() interface{} { return &common.ServiceRegistration{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         common.ServicesPath + "/{serviceName}",
+			Handler:         root.handleDeregisterService,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         common.LeasesPath + "/{leaseName}",
+			Handler:         root.handleGetLease,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         common.LeasesPath + "/{leaseName}",
+			Handler:         root.handleAcquireLease,
+			MakeMessage:     func() interface{} { return &common.Lease{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         common.LeasesPath + "/{leaseName}",
+			Handler:         root.handleReleaseLease,
+			MakeMessage:     func() interface{} { return &common.Lease{} },
+			UseRequestToken: false,
+		},
 	}
 	return routes
 }
 
-// Run configures and starts root service.
-func Run(configFileName string) (*common.RestServiceInfo, error) {
+// Run configures and starts root service. The configuration
+// location is either a file name or a URL of an etcd key,
+// in the form etcd://host:port/key (see SeedConfig()).
+func Run(configLocation string) (*common.RestServiceInfo, error) {
+	return RunInstance(configLocation, "")
+}
+
+// RunInstance is like Run, but allows to specify the URL at which
+// this instance is reachable. This matters when several instances
+// of root share configuration stored in etcd: one of them is
+// elected the leader, and they advertise their URLs to clients.
+// If advertiseUrl is empty, the address root listens on is used.
+func RunInstance(configLocation string, advertiseUrl string) (*common.RestServiceInfo, error) {
+	_, svcInfo, err := runInstance(configLocation, advertiseUrl)
+	return svcInfo, err
+}
+
+// runInstance is RunInstance also returning the root service.
+func runInstance(configLocation string, advertiseUrl string) (*Root, *common.RestServiceInfo, error) {
 	log.Printf("Entering root.Run()")
-	fullConfig, err := common.ReadConfig(configFileName)
+	backend, err := newConfigBackend(configLocation)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	fullConfig, index, err := backend.load()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	rootService := &Root{}
+	rootService := &Root{backend: backend, backendIndex: index}
 	log.Printf("Initializing root config")
 	rootServiceConfig := common.ServiceConfig{
 		Common:          fullConfig.Services["root"].Common,
 		ServiceSpecific: make(map[string]interface{}),
 	}
 	rootServiceConfig.ServiceSpecific[fullConfigKey] = fullConfig
-	return common.InitializeService(rootService, rootServiceConfig)
+	portAssigned := rootServiceConfig.Common.Api.Port == 0
+	svcInfo, err := common.InitializeService(rootService, rootServiceConfig)
+	if err != nil {
+		return rootService, svcInfo, err
+	}
+	if portAssigned {
+		// InitializeService has set the port it got in the
+		// configuration before it could be served to anyone, so
+		// the initial version in history is amended to match.
+		rootService.configMu.Lock()
+		rootService.history = nil
+		rootService.recordHistory("Initial configuration")
+		rootService.configMu.Unlock()
+	}
+	if backend, ok := backend.(electingBackend); ok {
+		rootService.instanceUrl = advertiseUrl
+		if rootService.instanceUrl == "" {
+			rootService.instanceUrl = "http://" + svcInfo.Address
+		}
+		go rootService.runHA(backend)
+	}
+	return rootService, svcInfo, nil
 }
@@ -22,19 +22,39 @@ import (
 	"github.com/romana/core/common"
 	"github.com/romana/core/root"
 	"log"
+	"os"
 )
 
 // Main entry point for the root microservice
 func main() {
-	configFileName := flag.String("c", "", "Configuration file")
+	configFileName := flag.String("c", "", "Configuration file, or etcd key as etcd://host:port/key")
+	seedFileName := flag.String("seed", "", "Configuration file to initialize etcd key with if it does not exist")
+	advertiseUrl := flag.String("advertise", "", "URL of this instance advertised to clients when configuration is in etcd")
+	supervise := flag.Bool("supervise", false, "Start other services in the order of their dependencies, and restart them when they exit")
 	version := flag.Bool("version", false, "Build Information.")
 	flag.Parse()
 	if *version {
 		fmt.Println(common.BuildInfo())
 		return
 	}
-	svcInfo, err := root.Run(*configFileName)
+	if *seedFileName != "" {
+		err := root.SeedConfig(*configFileName, *seedFileName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	var svcInfo *common.RestServiceInfo
+	var err error
+	if *supervise {
+		svcInfo, err = root.RunSupervised(*configFileName, *advertiseUrl)
+	} else {
+		svcInfo, err = root.RunInstance(*configFileName, *advertiseUrl)
+	}
 	if err != nil {
+		if *supervise {
+			log.Println(err)
+			os.Exit(1)
+		}
 		panic(err)
 	}
 	for {
@@ -16,12 +16,20 @@
 package root
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/romana/core/common"
+	"io/ioutil"
 	//	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Test hooks
@@ -187,3 +195,951 @@ func TestServiceList(t *testing.T) {
 		t.Errorf("Expected serviceName to be root, got %s", svcName)
 	}
 }
+
+// TestServiceRegistration tests registering and deregistering
+// services at runtime.
+func TestServiceRegistration(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-svcInfo.Channel
+	fmt.Println("Root service said:", msg)
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bad registration
+	err = client.RegisterService(common.ServiceRegistration{Name: "foo", Url: "not a url"})
+	if err == nil {
+		t.Error("Expected error for invalid URL")
+	}
+
+	reg := common.ServiceRegistration{Name: "foo", Url: "http://10.1.1.1:1234", Version: "1.0", Capabilities: []string{"bar"}}
+	err = client.RegisterService(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := client.GetServiceUrl("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != reg.Url {
+		t.Errorf("Expected %s, received %s", reg.Url, url)
+	}
+
+	// Registration overrides static config.
+	err = client.RegisterService(common.ServiceRegistration{Name: "ipam", Url: "http://10.1.1.2:9601"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipamConfig, err := client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipamConfig.Common.Api.Host != "10.1.1.2" || ipamConfig.Common.Api.Port != 9601 {
+		t.Errorf("Expected 10.1.1.2:9601, received %s", ipamConfig.Common.Api.GetHostPort())
+	}
+
+	var regs []common.ServiceRegistration
+	err = client.Get(rootURL+common.ServicesPath, &regs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 2 || regs[0].Name != "foo" || regs[0].Capabilities[0] != "bar" {
+		t.Errorf("Unexpected registrations %+v", regs)
+	}
+
+	err = client.DeregisterService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetServiceUrl("foo")
+	if err == nil {
+		t.Error("Expected error for deregistered service")
+	}
+	err = client.DeregisterService("foo")
+	if err == nil {
+		t.Error("Expected error deregistering unknown service")
+	}
+}
+
+// fakeEtcd implements just enough of etcd v2 keys API
+// for root service.
+type fakeEtcd struct {
+	sync.Mutex
+	values  map[string]string
+	indexes map[string]uint64
+	index   uint64
+	changed chan struct{}
+	// Closed to release pending watches.
+	done chan struct{}
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{values: make(map[string]string), indexes: make(map[string]uint64), changed: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (f *fakeEtcd) close() {
+	close(f.done)
+}
+
+func (f *fakeEtcd) set(key string, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.setLocked(key, value)
+}
+
+func (f *fakeEtcd) setLocked(key string, value string) {
+	f.index++
+	f.values[key] = value
+	f.indexes[key] = f.index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcd) get(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.values[key]
+}
+
+func (f *fakeEtcd) writeError(w http.ResponseWriter, code int, errorCode int) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errorCode": errorCode, "message": "error"})
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	f.Lock()
+	defer f.Unlock()
+	value, exists := f.values[key]
+	if r.Method == "PUT" {
+		if r.Form.Get("prevExist") == "false" && exists {
+			f.writeError(w, http.StatusPreconditionFailed, etcdErrorNodeExist)
+			return
+		}
+		if prevValue := r.Form.Get("prevValue"); prevValue != "" && prevValue != value {
+			f.writeError(w, http.StatusPreconditionFailed, etcdErrorTestFailed)
+			return
+		}
+		f.setLocked(key, r.Form.Get("value"))
+		value, exists = f.values[key], true
+	}
+	if r.Form.Get("wait") == "true" {
+		waitIndex, _ := strconv.ParseUint(r.Form.Get("waitIndex"), 10, 64)
+		for f.indexes[key] < waitIndex {
+			changed := f.changed
+			f.Unlock()
+			select {
+			case <-changed:
+			case <-f.done:
+				f.Lock()
+				f.writeError(w, http.StatusServiceUnavailable, 300)
+				return
+			}
+			f.Lock()
+		}
+		value, exists = f.values[key], true
+	}
+	node := map[string]interface{}{"key": key, "value": value, "modifiedIndex": f.indexes[key]}
+	if !exists {
+		// Maybe a directory
+		var nodes []map[string]interface{}
+		for k, v := range f.values {
+			if strings.HasPrefix(k, key+"/") {
+				nodes = append(nodes, map[string]interface{}{"key": k, "value": v})
+			}
+		}
+		if nodes == nil {
+			f.writeError(w, http.StatusNotFound, etcdErrorKeyNotFound)
+			return
+		}
+		node = map[string]interface{}{"key": key, "dir": true, "nodes": nodes}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"action": "get", "node": node})
+}
+
+// TestEtcdConfig tests keeping configuration in etcd
+// and watching it for changes.
+func TestEtcdConfig(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcdServer := httptest.NewServer(etcd)
+	defer etcdServer.Close()
+	defer etcd.close()
+	location := etcdScheme + strings.TrimPrefix(etcdServer.URL, "http://") + "/romana/config"
+
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	err := SeedConfig(location, "/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := etcd.get("/romana/config")
+	if seeded == "" {
+		t.Fatal("Expected configuration to be seeded")
+	}
+	// Seeding again should not overwrite.
+	err = SeedConfig(location, "/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etcd.index != 1 {
+		t.Fatalf("Expected configuration not to be overwritten")
+	}
+
+	svcInfo, err := Run(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-svcInfo.Channel
+	fmt.Println("Root service said:", msg)
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionResp := common.ConfigVersionResponse{}
+	err = client.Get(rootURL+common.ConfigPath, &versionResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := versionResp.Version
+
+	// Change configuration in etcd behind root's back.
+	config, err := common.ReadConfig("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Services["ipam"].Common.Api.Port = 12345
+	data, err := common.MarshalConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcd.set("/romana/config", string(data))
+
+	newVersion := version
+	for i := 0; i < 10 && newVersion <= version; i++ {
+		newVersion, err = client.WatchConfig(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if newVersion <= version {
+		t.Fatalf("Expected version to change from %d", version)
+	}
+	ipamConfig, err := client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipamConfig.Common.Api.Port != 12345 {
+		t.Errorf("Expected port 12345, received %d", ipamConfig.Common.Api.Port)
+	}
+
+	// Port update goes to etcd.
+	err = client.Post(rootURL+"/config/ipam/port", common.PortUpdateMessage{Port: 23456}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := common.ParseConfig([]byte(etcd.get("/romana/config")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Services["ipam"].Common.Api.Port != 23456 {
+		t.Errorf("Expected port 23456 in etcd, found %d", saved.Services["ipam"].Common.Api.Port)
+	}
+}
+
+// TestHA tests two root instances sharing configuration in etcd.
+func TestHA(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcdServer := httptest.NewServer(etcd)
+	defer etcdServer.Close()
+	defer etcd.close()
+	location := etcdScheme + strings.TrimPrefix(etcdServer.URL, "http://") + "/romana/config"
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	err := SeedConfig(location, "/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever starts first becomes the leader.
+	svcInfo1, err := Run(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo1.Channel
+	root1 := "http://" + svcInfo1.Address
+	for i := 0; i < 50 && etcd.get("/romana/config-leader") == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if leader := etcd.get("/romana/config-leader"); leader != root1 {
+		t.Fatalf("Expected %s to be the leader, found '%s'", root1, leader)
+	}
+	svcInfo2, err := Run(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo2.Channel
+	root2 := "http://" + svcInfo2.Address
+
+	// Wait for the follower to learn of the leader.
+	var index common.RootIndexResponse
+	client2, err := common.NewRestClient(common.GetDefaultRestClientConfig(root2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		index = common.RootIndexResponse{}
+		err = client2.Get(root2, &index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.Links.FindByRel(common.RootLeaderLinkRel) != "" && len(index.Links.FindAllByRel(common.RootLinkRel)) == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if leader := index.Links.FindByRel(common.RootLeaderLinkRel); leader != root1 {
+		t.Fatalf("Expected follower to advertise %s as the leader, got '%s'", root1, leader)
+	}
+	if roots := index.Links.FindAllByRel(common.RootLinkRel); len(roots) != 2 {
+		t.Fatalf("Expected 2 root instances, got %v", roots)
+	}
+
+	// Write to the follower is handled by the leader.
+	err = client2.RegisterService(common.ServiceRegistration{Name: "foo", Url: "http://10.1.1.1:1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client1, err := common.NewRestClient(common.GetDefaultRestClientConfig(root1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := client1.GetServiceUrl("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://10.1.1.1:1234" {
+		t.Errorf("Expected foo at leader, got %s", url)
+	}
+
+	// Client fails over from an unreachable root instance.
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig("http://127.0.0.1:1," + root2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSupervisor tests starting services in the order
+// of their dependencies.
+func TestSupervisor(t *testing.T) {
+	config, err := common.ReadConfig("../common/testdata/romana.sample.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := dependencyOrder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := make(map[string]int)
+	for i, name := range order {
+		position[name] = i
+	}
+	for _, name := range order {
+		for _, dep := range config.Services[name].Common.DependsOn {
+			if position[dep] > position[name] {
+				t.Errorf("Expected %s to start before %s, got %v", dep, name, order)
+			}
+		}
+	}
+	if _, ok := position[common.ServiceRoot]; ok {
+		t.Errorf("Expected root not to be started, got %v", order)
+	}
+
+	var started []string
+	s := newSupervisor(config)
+	s.readyTimeout = time.Second
+	s.start = func(name string) (*instance, error) {
+		if name == "tenant" {
+			return nil, errors.New("no such file")
+		}
+		started = append(started, name)
+		return &instance{exited: make(chan error, 1), kill: func() {}}, nil
+	}
+	s.ready = func(name string) (bool, error) { return true, nil }
+	err = s.run()
+	if err == nil {
+		t.Fatal("Expected startup to fail")
+	}
+	startupErr := err.(StartupError)
+	for _, name := range started {
+		if name == "ipam" || name == "agent" {
+			t.Errorf("Expected %s not to be started", name)
+		}
+	}
+	expect := "was not started because it depends on ipam, which was not started because it depends on tenant, which failed: no such file"
+	if startupErr.Reasons["agent"] != expect {
+		t.Errorf("Expected '%s', got '%s'", expect, startupErr.Reasons["agent"])
+	}
+
+	// Services are restarted when they exit, with growing delays.
+	s = newSupervisor(config)
+	instances := make(chan *instance, 10)
+	s.start = func(name string) (*instance, error) {
+		inst := &instance{exited: make(chan error, 1), kill: func() {}}
+		if name == "ipam" {
+			instances <- inst
+		}
+		return inst, nil
+	}
+	s.ready = func(name string) (bool, error) { return true, nil }
+	delays := make(chan time.Duration, 10)
+	s.after = func(d time.Duration) <-chan time.Time {
+		delays <- d
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+	err = s.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.watch("ipam")
+	for i := 0; i < 2; i++ {
+		(<-instances).exited <- errors.New("exit status 2")
+	}
+	if d1, d2 := <-delays, <-delays; d1 != minRestartDelay || d2 != 2*minRestartDelay {
+		t.Errorf("Unexpected delays before restarts %v, %v", d1, d2)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.status()["ipam"].Restarts < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.stop()
+	status := s.status()["ipam"]
+	if !status.Running || status.Restarts != 2 || status.LastExit != "exited: exit status 2" || status.LastExitAt == 0 {
+		t.Errorf("Unexpected status of ipam %+v", status)
+	}
+	if status := s.status()["tenant"]; status.Restarts != 0 || status.LastExit != "" {
+		t.Errorf("Unexpected status of tenant %+v", status)
+	}
+
+	// Circular dependencies
+	config.Services["tenant"] = common.ServiceConfig{Common: common.CommonConfig{DependsOn: []string{"agent"}}}
+	_, err = dependencyOrder(config)
+	if err == nil || !strings.Contains(err.Error(), "Circular dependency") {
+		t.Errorf("Expected circular dependency error, got %v", err)
+	}
+}
+
+// TestConfigHistory tests configuration versions and rollback.
+func TestConfigHistory(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipamConfig, err := client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := ipamConfig.Version
+	oldPort := ipamConfig.Common.Api.Port
+
+	err = client.Post(rootURL+"/config/ipam/port", common.PortUpdateMessage{Port: 34567}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipamConfig, err = client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipamConfig.Version != version+1 || ipamConfig.Common.Api.Port != 34567 {
+		t.Fatalf("Expected version %d with port 34567, got version %d with port %d", version+1, ipamConfig.Version, ipamConfig.Common.Api.Port)
+	}
+
+	var history []common.ConfigHistoryEntry
+	err = client.Get(rootURL+common.ConfigPath+"/history", &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Version != version || history[1].Version != version+1 {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+	if history[0].Config.Services["ipam"].Common.Api.Port != oldPort {
+		t.Errorf("Expected port %d in version %d, got %d", oldPort, version, history[0].Config.Services["ipam"].Common.Api.Port)
+	}
+
+	versionResp := common.ConfigVersionResponse{}
+	err = client.Post(fmt.Sprintf("%s%s/rollback/%d", rootURL, common.ConfigPath, version), nil, &versionResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versionResp.Version != version+2 {
+		t.Errorf("Expected rollback to create version %d, got %d", version+2, versionResp.Version)
+	}
+	ipamConfig, err = client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipamConfig.Common.Api.Port != oldPort {
+		t.Errorf("Expected port %d after rollback, got %d", oldPort, ipamConfig.Common.Api.Port)
+	}
+
+	err = client.Post(rootURL+common.ConfigPath+"/rollback/1000", nil, &versionResp)
+	if err == nil {
+		t.Error("Expected error rolling back to unknown version")
+	}
+}
+
+// TestWatchServiceConfig tests waiting for configuration
+// of a service to change.
+func TestWatchServiceConfig(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipamConfig, err := client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := ipamConfig.Version
+
+	// Change to another service does not wake up the watch.
+	err = client.Post(rootURL+"/config/tenant/port", common.PortUpdateMessage{Port: 45678}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchConfig, err := client.WatchServiceConfig("ipam", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watchConfig.Common.Api.Port != ipamConfig.Common.Api.Port {
+		t.Errorf("Expected ipam port to stay %d, got %d", ipamConfig.Common.Api.Port, watchConfig.Common.Api.Port)
+	}
+
+	done := make(chan *common.ServiceConfig)
+	go func() {
+		watchClient, _ := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+		since := watchConfig.Version
+		for i := 0; i < 10; i++ {
+			config, err := watchClient.WatchServiceConfig("ipam", since)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			if config.Common.Api.Port != ipamConfig.Common.Api.Port {
+				done <- config
+				return
+			}
+			since = config.Version
+		}
+		done <- nil
+	}()
+	time.Sleep(100 * time.Millisecond)
+	err = client.Post(rootURL+"/config/ipam/port", common.PortUpdateMessage{Port: 45679}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := <-done
+	if changed == nil || changed.Common.Api.Port != 45679 {
+		t.Fatalf("Expected watch to return port 45679, got %+v", changed)
+	}
+	if changed.Version <= watchConfig.Version {
+		t.Errorf("Expected version greater than %d, got %d", watchConfig.Version, changed.Version)
+	}
+}
+
+// TestConfigValidate tests validating configuration without applying it.
+func TestConfigValidate(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("../common/testdata/romana.sample.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := common.ConfigValidationResponse{}
+	err = client.Post(rootURL+common.ConfigPath+"/validate", common.ConfigValidationRequest{Config: string(data)}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Valid {
+		t.Errorf("Expected sample configuration to be valid, got %v", resp.Errors)
+	}
+
+	bad := `services:
+  - service: ipam
+    depends_on: [tenant]
+    api:
+      host: localhost
+      port: 9601
+    config:
+      store:
+        type: oracle
+        database: ipam
+        password: "secret:nowhere:x"
+  - service: tenant
+    api:
+      host: localhost
+      port: 9601
+`
+	resp = common.ConfigValidationResponse{}
+	err = client.Post(rootURL+common.ConfigPath+"/validate", common.ConfigValidationRequest{Config: bad}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Valid {
+		t.Fatal("Expected configuration to be invalid")
+	}
+	// No root, port conflict, bad store type, bad secret
+	if len(resp.Errors) != 4 {
+		t.Errorf("Expected 4 errors, got %v", resp.Errors)
+	}
+
+	// Nothing was applied.
+	ipamConfig, err := client.GetServiceConfig("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipamConfig.Common.Api.Port != 0 {
+		t.Errorf("Expected ipam port to stay 0, got %d", ipamConfig.Common.Api.Port)
+	}
+}
+
+// TestStatus tests aggregation of health of registered services.
+func TestStatus(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthServer := func(health common.ServiceHealth) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != common.HealthPath {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(health)
+		}))
+	}
+	tenant := healthServer(common.ServiceHealth{Service: "tenant", Version: "1.1", Uptime: 10, Database: common.HealthOK})
+	defer tenant.Close()
+	ipam := healthServer(common.ServiceHealth{Service: "ipam", Uptime: 20, Database: "connection refused", LastError: "boom"})
+	defer ipam.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for name, url := range map[string]string{"tenant": tenant.URL, "ipam": ipam.URL, "topology": gone.URL} {
+		err = client.RegisterService(common.ServiceRegistration{Name: name, Url: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := client.GetClusterStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Healthy {
+		t.Error("Expected cluster to be unhealthy")
+	}
+	var names []string
+	for _, s := range status.Services {
+		names = append(names, s.Service)
+	}
+	if strings.Join(names, ",") != "root,ipam,tenant,topology" {
+		t.Fatalf("Unexpected services in status: %v", names)
+	}
+	if !status.Services[0].Healthy {
+		t.Errorf("Expected root to be healthy: %+v", status.Services[0])
+	}
+	ipamStatus := status.Services[1]
+	if ipamStatus.Healthy || ipamStatus.LastError != "boom" || ipamStatus.Uptime != 20 {
+		t.Errorf("Unexpected ipam status: %+v", ipamStatus)
+	}
+	tenantStatus := status.Services[2]
+	if !tenantStatus.Healthy || tenantStatus.Version != "1.1" || tenantStatus.Url != tenant.URL {
+		t.Errorf("Unexpected tenant status: %+v", tenantStatus)
+	}
+	topologyStatus := status.Services[3]
+	if topologyStatus.Healthy || topologyStatus.Error == "" {
+		t.Errorf("Expected topology to be unreachable: %+v", topologyStatus)
+	}
+}
+
+// TestSupervisedStatus tests reporting how services
+// started by root have been running in their status.
+func TestSupervisedStatus(t *testing.T) {
+	root := &Root{}
+	statuses := []common.ServiceStatus{{Url: "http://ipam"}}
+	statuses[0].Service = "ipam"
+	if len(root.addSupervisedStatus(statuses)) != 1 || statuses[0].Supervisor != nil {
+		t.Errorf("Expected no supervisor status, got %+v", statuses)
+	}
+
+	s := newSupervisor(common.Config{})
+	s.services["ipam"] = &supervisedService{running: true, restarts: 3}
+	s.services["tenant"] = &supervisedService{lastExit: "exited: signal: killed", lastExitAt: time.Now()}
+	root.setSupervisor(s)
+	statuses = root.addSupervisedStatus(statuses)
+	if len(statuses) != 2 || statuses[0].Supervisor == nil || statuses[0].Supervisor.Restarts != 3 {
+		t.Fatalf("Unexpected statuses %+v", statuses)
+	}
+	tenant := statuses[1]
+	if tenant.Service != "tenant" || tenant.Healthy || tenant.Error == "" || tenant.Supervisor.Running || tenant.Supervisor.LastExitAt == 0 {
+		t.Errorf("Unexpected tenant status %+v", tenant)
+	}
+}
+
+// TestBootstrap tests creating the admin in the auth store.
+func TestBootstrap(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.auth.yaml")
+	os.Remove("/tmp/auth.sqlite3")
+
+	result, err := Bootstrap("/tmp/romana.yaml", BootstrapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Username != "admin" || len(result.Password) < 20 || len(result.Roles) != 1 || result.Roles[0] != "admin" {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	// Bootstrapping again does not replace the admin, unless asked.
+	if _, err := Bootstrap("/tmp/romana.yaml", BootstrapOptions{}); err == nil {
+		t.Error("Expected error bootstrapping again")
+	}
+	reset, err := Bootstrap("/tmp/romana.yaml", BootstrapOptions{Reset: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.Password == result.Password {
+		t.Error("Expected a new password")
+	}
+
+	store := &rootStore{}
+	store.ServiceStore = store
+	store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/tmp/auth.sqlite3"})
+	if err := store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	var roles []Role
+	store.Db.Find(&roles)
+	if len(roles) != len(DefaultRoles) {
+		t.Errorf("Expected roles %v, got %+v", DefaultRoles, roles)
+	}
+	var count int
+	store.Db.Table("user_roles").Count(&count)
+	if count != 1 {
+		t.Errorf("Expected admin to be granted its role once, got %d grants", count)
+	}
+}
+
+// TestPortAssignment tests serving addresses of services
+// configured with port 0.
+func TestPortAssignment(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-svcInfo.Channel
+	rootURL := fmt.Sprintf("http://%s", svcInfo.Address)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(rootURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootConfig, err := client.GetServiceConfig(common.ServiceRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(svcInfo.Address, fmt.Sprintf(":%d", rootConfig.Common.Api.Port)) {
+		t.Errorf("Expected root port from %s, got %d", svcInfo.Address, rootConfig.Common.Api.Port)
+	}
+
+	_, err = client.GetServiceUrl("ipam")
+	if err == nil {
+		t.Error("Expected no URL for ipam before its port is known")
+	}
+	err = client.Post(rootURL+"/config/ipam/port", common.PortUpdateMessage{Port: 34567}, &map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(url, ":34567") {
+		t.Errorf("Expected ipam URL with port 34567, got %s", url)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-svcInfo.Channel
+	fmt.Println("Root service said:", msg)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(fmt.Sprintf("http://%s", svcInfo.Address)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetLease("listener")
+	if err == nil {
+		t.Error("Expected error for unknown lease")
+	}
+	lease, err := client.AcquireLease(common.Lease{Name: "listener", Holder: "a", TTL: 10, Data: map[string]string{"x": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "a" || lease.ExpiresAt == 0 {
+		t.Errorf("Unexpected lease %+v", lease)
+	}
+	_, err = client.AcquireLease(common.Lease{Name: "listener", Holder: "b", TTL: 10})
+	if httpErr, ok := err.(common.HttpError); !ok || httpErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict acquiring lease held by another, received %v", err)
+	}
+	// Renewal without data keeps the data.
+	lease, err = client.AcquireLease(common.Lease{Name: "listener", Holder: "a", TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Data["x"] != "1" {
+		t.Errorf("Expected data to be kept, received %+v", lease)
+	}
+	err = client.ReleaseLease(common.Lease{Name: "listener", Holder: "b"})
+	if err == nil {
+		t.Error("Expected error releasing lease held by another")
+	}
+	err = client.ReleaseLease(common.Lease{Name: "listener", Holder: "a", Data: map[string]string{"x": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err = client.GetLease("listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "" || lease.Data["x"] != "2" {
+		t.Errorf("Expected released lease with data handed off, received %+v", lease)
+	}
+	lease, err = client.AcquireLease(common.Lease{Name: "listener", Holder: "b", TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "b" || lease.Data["x"] != "2" {
+		t.Errorf("Unexpected lease %+v", lease)
+	}
+
+	// Expired leases can be acquired by another.
+	leases := newLeaseTable()
+	now := time.Now()
+	_, err = leases.acquire(common.Lease{Name: "l", Holder: "a", TTL: 5}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = leases.acquire(common.Lease{Name: "l", Holder: "b", TTL: 5}, now.Add(4*time.Second))
+	if err == nil {
+		t.Error("Expected error acquiring lease before it expires")
+	}
+	_, err = leases.acquire(common.Lease{Name: "l", Holder: "b", TTL: 5}, now.Add(6*time.Second))
+	if err != nil {
+		t.Errorf("Expected expired lease to be acquired, received %v", err)
+	}
+}
+
+// TestLeaderElection tests that a replica takes over when the leader
+// stops, receiving the data the leader recorded.
+func TestLeaderElection(t *testing.T) {
+	common.MockPortsInConfig("../common/testdata/romana.sample.yaml")
+	svcInfo, err := Run("/tmp/romana.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-svcInfo.Channel
+	fmt.Println("Root service said:", msg)
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(fmt.Sprintf("http://%s", svcInfo.Address)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaders := make(chan string, 2)
+	handoffs := make(chan map[string]string, 2)
+	elect := func(id string, done chan struct{}) (*common.LeaderElection, chan struct{}) {
+		le := common.NewLeaderElection(client, "election", id, 3*time.Second)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			le.Run(done, func(data map[string]string, stop <-chan struct{}) {
+				leaders <- id
+				handoffs <- data
+				le.SetData(map[string]string{"leader": id})
+				<-stop
+			})
+		}()
+		return le, stopped
+	}
+	doneA := make(chan struct{})
+	_, stoppedA := elect("a", doneA)
+	if leader := <-leaders; leader != "a" {
+		t.Fatalf("Expected a to lead, received %s", leader)
+	}
+	<-handoffs
+	doneB := make(chan struct{})
+	defer close(doneB)
+	elect("b", doneB)
+
+	close(doneA)
+	<-stoppedA
+	select {
+	case leader := <-leaders:
+		if leader != "b" {
+			t.Errorf("Expected b to lead, received %s", leader)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected b to take over")
+	}
+	if data := <-handoffs; data["leader"] != "a" {
+		t.Errorf("Expected data recorded by a, received %v", data)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Status of the whole cluster, aggregated from health
+// reported by every registered service.
+
+import (
+	"github.com/romana/core/common"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handleStatus handles GET to /status. Health of all registered
+// services is requested in parallel, and they are listed by name
+// after root itself; services that cannot be
+// reached are reported as unhealthy along with the error.
+func (root *Root) handleStatus(input interface{}, ctx common.RestContext) (interface{}, error) {
+	regs := root.registry.list()
+	statuses := make([]common.ServiceStatus, len(regs))
+	var wg sync.WaitGroup
+	for i, reg := range regs {
+		wg.Add(1)
+		go func(i int, reg common.ServiceRegistration) {
+			defer wg.Done()
+			statuses[i] = root.serviceStatus(ctx, reg)
+		}(i, reg)
+	}
+	wg.Wait()
+	statuses = root.addSupervisedStatus(statuses)
+
+	own, _ := common.GetServiceHealth(root)
+	rootStatus := common.ServiceStatus{ServiceHealth: own, Url: root.instanceUrl, Healthy: true}
+	if rootStatus.Url == "" {
+		rootStatus.Url = "http://" + root.config.common.Api.GetHostPort()
+	}
+	retval := common.ClusterStatus{
+		Healthy:   true,
+		Timestamp: time.Now().Unix(),
+		Services:  append([]common.ServiceStatus{rootStatus}, statuses...),
+	}
+	for _, status := range statuses {
+		retval.Healthy = retval.Healthy && status.Healthy
+	}
+	return retval, nil
+}
+
+// serviceStatus requests health of a registered service.
+func (root *Root) serviceStatus(ctx common.RestContext, reg common.ServiceRegistration) common.ServiceStatus {
+	retval := common.ServiceStatus{Url: reg.Url}
+	retval.Service = reg.Name
+	retval.Version = reg.Version
+	clientConfig := common.GetDefaultRestClientConfig(reg.Url)
+	// Whatever is slow to answer is reported as such,
+	// rather than slowing down the status.
+	clientConfig.Retries = 1
+	client, err := common.NewRestClient(clientConfig)
+	if err == nil {
+		err = client.WithContext(ctx.Context).Get(strings.TrimRight(reg.Url, "/")+common.HealthPath, &retval.ServiceHealth)
+	}
+	if err != nil {
+		retval.Error = err.Error()
+		return retval
+	}
+	retval.Healthy = retval.Database == "" || retval.Database == common.HealthOK
+	return retval
+}
+
+// setSupervisor sets the supervisor of the rest of the services.
+func (root *Root) setSupervisor(s *supervisor) {
+	root.supervisorMu.Lock()
+	defer root.supervisorMu.Unlock()
+	root.supervisor = s
+}
+
+// addSupervisedStatus adds how services have been running to their
+// statuses, if root started them. Services root started which are not
+// registered are added as unhealthy.
+func (root *Root) addSupervisedStatus(statuses []common.ServiceStatus) []common.ServiceStatus {
+	root.supervisorMu.RLock()
+	s := root.supervisor
+	root.supervisorMu.RUnlock()
+	if s == nil {
+		return statuses
+	}
+	supervised := s.status()
+	var names []string
+	for name := range supervised {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := supervised[name]
+		registered := false
+		for i := range statuses {
+			if statuses[i].Service == name {
+				statuses[i].Supervisor = &status
+				registered = true
+			}
+		}
+		if !registered {
+			retval := common.ServiceStatus{Supervisor: &status, Error: "Service is not registered"}
+			retval.Service = name
+			statuses = append(statuses, retval)
+		}
+	}
+	return statuses
+}
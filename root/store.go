@@ -15,6 +15,8 @@
 package root
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -25,20 +27,108 @@ import (
 type rootStore struct {
 	common.DbStore
 	isAuthEnabled bool
+	// bootstrapping is set by Bootstrap, which creates the admin
+	// itself rather than with the default password.
+	bootstrapping bool
+}
+
+// DefaultRoles are roles the auth store is seeded with.
+var DefaultRoles = []string{
+	// Administrators of Romana.
+	"admin",
+	// Romana services and agents.
+	"service",
+	// Users managing networks of their tenants.
+	"tenant",
 }
 
 // CreateSchemaPostProcess implements CreateSchemaPostProcess method of
 // Service interface.
 func (rootStore *rootStore) CreateSchemaPostProcess() error {
-	passwd, err := rootStore.GetPasswordFunction()
+	if err := rootStore.seedRoles(); err != nil {
+		return err
+	}
+	if rootStore.bootstrapping {
+		return nil
+	}
+	user, err := rootStore.createUser("admin", "password")
 	if err != nil {
 		return err
 	}
+	return rootStore.grantRole(user, "admin")
+}
+
+// seedRoles creates those of DefaultRoles that do not exist yet.
+func (rootStore *rootStore) seedRoles() error {
+	db := rootStore.DbStore.Db
+	for _, name := range DefaultRoles {
+		var roles []Role
+		if err := db.Where("name = ?", name).Find(&roles).Error; err != nil {
+			return err
+		}
+		if len(roles) > 0 {
+			continue
+		}
+		if err := db.Create(&Role{Name: name}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findUser returns the user with the username,
+// or nil if there is none.
+func (rootStore *rootStore) findUser(username string) (*User, error) {
+	var users []User
+	if err := rootStore.DbStore.Db.Where("username = ?", username).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// createUser creates the user with the password, hashed
+// as Authenticate expects it.
+func (rootStore *rootStore) createUser(username string, password string) (*User, error) {
+	passwd, err := rootStore.GetPasswordFunction()
+	if err != nil {
+		return nil, err
+	}
 	sql := fmt.Sprintf("INSERT INTO users (username, password) VALUES (?, %s)", passwd)
-	rootStore.DbStore.Db.Exec(sql, "admin", "password")
-	rootStore.DbStore.Db.Exec("INSERT INTO roles (name) VALUES (admin)")
-	//	rootStore.DbStore.Db.Exec("INSERT INTO roles (name) VALUES (admin)")
-	return common.MakeMultiError(rootStore.DbStore.Db.GetErrors())
+	if err := rootStore.DbStore.Db.Exec(sql, username, password).Error; err != nil {
+		return nil, err
+	}
+	return rootStore.findUser(username)
+}
+
+// setPassword replaces the password of the user.
+func (rootStore *rootStore) setPassword(user *User, password string) error {
+	passwd, err := rootStore.GetPasswordFunction()
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("UPDATE users SET password = %s WHERE id = ?", passwd)
+	return rootStore.DbStore.Db.Exec(sql, password, user.Id).Error
+}
+
+// grantRole grants the user the role, unless it has it already.
+func (rootStore *rootStore) grantRole(user *User, name string) error {
+	db := rootStore.DbStore.Db
+	var roles []Role
+	if err := db.Where("name = ?", name).Find(&roles).Error; err != nil {
+		return err
+	}
+	if len(roles) == 0 {
+		return errors.New(fmt.Sprintf("No role %s", name))
+	}
+	var count int
+	err := db.Table("user_roles").Where("user_id = ? AND role_id = ?", user.Id, roles[0].Id).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	return db.Exec("INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)", user.Id, roles[0].Id).Error
 }
 
 // Entities implements Entities method of
@@ -54,6 +144,8 @@ type User struct {
 	Id       uint64 `sql:"AUTO_INCREMENT" json:"id"`
 	Username string `json:"username"`
 	Roles    []Role `gorm:"many2many:user_roles;"`
+	// Hashed by the database, never encrypted: passwords
+	// are compared, not read back.
 	Password string `json:"password"`
 }
 
@@ -64,13 +156,16 @@ type Role struct {
 
 // Authenticate returns a list of roles this credential
 // has or an error if cannot authenticate.
-func (rootStore *rootStore) Authenticate(cred common.Credential) ([]common.Role, error) {
+func (rootStore *rootStore) Authenticate(ctx context.Context, cred common.Credential) ([]common.Role, error) {
 
 	if !rootStore.isAuthEnabled {
 		log.Println("Authentication is disabled")
 		return nil, nil
 	} else {
 		log.Println("Authentication is enabled")
+		if err := common.CheckContext(ctx); err != nil {
+			return nil, err
+		}
 		gormDb := rootStore.DbStore.Db
 		pwdFunc, err := rootStore.DbStore.GetPasswordFunction()
 		if err != nil {
@@ -0,0 +1,489 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+// Supervisor mode, in which root starts the rest of the services
+// in the order of their dependencies (see depends_on in the
+// configuration) and restarts them when they exit.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long to wait for a started service to become ready.
+	defaultReadyTimeout = 30 * time.Second
+	// How often to check whether a started service is ready.
+	readyCheckInterval = 500 * time.Millisecond
+
+	// Bounds of the delay before restarting a service that exited.
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+
+	// How long a service has to exit after SIGTERM before it is killed.
+	stopGracePeriod = 10 * time.Second
+	// How long a service has to run before it exits for
+	// its restart not to be delayed more than minRestartDelay.
+	stableRunTime = 10 * time.Minute
+)
+
+// dependencyOrder returns names of the services in the configuration
+// (other than root) in the order in which they can be started: every
+// service comes after all services it depends on. Ties are broken
+// alphabetically. It is an error for a service to depend on a service
+// not in the configuration, or for dependencies to form a cycle.
+func dependencyOrder(config common.Config) ([]string, error) {
+	var names []string
+	for name, svcConfig := range config.Services {
+		if name == common.ServiceRoot {
+			continue
+		}
+		names = append(names, name)
+		for _, dep := range svcConfig.Common.DependsOn {
+			if _, ok := config.Services[dep]; !ok {
+				return nil, common.NewError("Service %s depends on %s, which is not configured", name, dep)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var order []string
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return common.NewError("Circular dependency: %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		deps := append([]string{}, config.Services[name].Common.DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if dep == common.ServiceRoot {
+				continue
+			}
+			err := visit(dep, append(path, name))
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		err := visit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// StartupError is returned by Supervise when some services
+// could not be started.
+type StartupError struct {
+	// Services that failed, in the order they were attempted.
+	Failed []string
+	// Reason for each failed service.
+	Reasons map[string]string
+}
+
+func (e StartupError) Error() string {
+	lines := make([]string, len(e.Failed))
+	for i, name := range e.Failed {
+		lines[i] = fmt.Sprintf("%s: %s", name, e.Reasons[name])
+	}
+	return "Failed to start services:\n" + strings.Join(lines, "\n")
+}
+
+// instance is a started process (or other instance) of a service.
+type instance struct {
+	// exited receives the error the instance exits with.
+	exited chan error
+	// kill stops the instance, returning once it is gone.
+	kill func()
+}
+
+// supervisedService is the instance of a service the
+// supervisor started last, and how it has been running.
+type supervisedService struct {
+	instance  *instance
+	startedAt time.Time
+	running   bool
+	restarts  int
+	lastExit  string
+	// Zero if the service has not exited.
+	lastExitAt time.Time
+}
+
+// supervisor starts services and waits for them to be ready,
+// then restarts them when they exit. start, ready and after
+// are fields so that tests can replace them.
+type supervisor struct {
+	config common.Config
+	// start starts the named service.
+	start func(name string) (*instance, error)
+	// ready returns true once the named service is ready to
+	// serve requests, or an error if it never will be.
+	ready        func(name string) (bool, error)
+	readyTimeout time.Duration
+	// after is time.After.
+	after func(time.Duration) <-chan time.Time
+
+	mu       sync.Mutex
+	services map[string]*supervisedService
+	// done is closed by stop.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newSupervisor returns a supervisor of services in the configuration.
+func newSupervisor(config common.Config) *supervisor {
+	return &supervisor{
+		config:       config,
+		readyTimeout: defaultReadyTimeout,
+		after:        time.After,
+		services:     make(map[string]*supervisedService),
+		done:         make(chan struct{}),
+	}
+}
+
+// run starts all services in dependency order. A service whose
+// dependency failed is not started, and the reason reported for it
+// names the whole chain of failed dependencies.
+func (s *supervisor) run() error {
+	order, err := dependencyOrder(s.config)
+	if err != nil {
+		return err
+	}
+	startupErr := StartupError{Reasons: make(map[string]string)}
+	for _, name := range order {
+		var failedDep string
+		for _, dep := range s.config.Services[name].Common.DependsOn {
+			if _, failed := startupErr.Reasons[dep]; failed {
+				failedDep = dep
+				break
+			}
+		}
+		var reason string
+		if failedDep != "" {
+			reason = fmt.Sprintf("was not started because it depends on %s, which %s", failedDep, startupErr.Reasons[failedDep])
+		} else {
+			log.Printf("Supervisor: starting %s", name)
+			err = s.startService(name)
+			if err == nil {
+				err = s.waitReady(name)
+			}
+			if err == nil {
+				log.Printf("Supervisor: %s is ready", name)
+				continue
+			}
+			reason = fmt.Sprintf("failed: %s", err)
+		}
+		log.Printf("Supervisor: %s %s", name, reason)
+		startupErr.Failed = append(startupErr.Failed, name)
+		startupErr.Reasons[name] = reason
+	}
+	if len(startupErr.Failed) > 0 {
+		return startupErr
+	}
+	return nil
+}
+
+// startService starts an instance of the service, counting
+// it as a restart if the service was started before.
+func (s *supervisor) startService(name string) error {
+	inst, err := s.start(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[name]
+	if !ok {
+		svc = &supervisedService{}
+		s.services[name] = svc
+	}
+	if err != nil {
+		svc.lastExit = fmt.Sprintf("failed to start: %s", err)
+		svc.lastExitAt = time.Now()
+		return err
+	}
+	if svc.instance != nil {
+		svc.restarts++
+	}
+	svc.instance = inst
+	svc.startedAt = time.Now()
+	svc.running = true
+	return nil
+}
+
+// waitReady waits for the service to become ready.
+func (s *supervisor) waitReady(name string) error {
+	s.mu.Lock()
+	exited := s.services[name].instance.exited
+	s.mu.Unlock()
+	deadline := time.Now().Add(s.readyTimeout)
+	for {
+		select {
+		case err := <-exited:
+			s.exitedService(name, err)
+			return common.NewError("exited: %v", err)
+		default:
+		}
+		ready, err := s.ready(name)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return common.NewError("not ready after %v", s.readyTimeout)
+		}
+		time.Sleep(readyCheckInterval)
+	}
+}
+
+// exitedService records that the service exited with the error.
+func (s *supervisor) exitedService(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc := s.services[name]
+	svc.running = false
+	svc.lastExit = fmt.Sprintf("exited: %v", err)
+	svc.lastExitAt = time.Now()
+}
+
+// watch restarts the service every time it exits, until the
+// supervisor is stopped. Restarts are delayed by minRestartDelay,
+// doubled for every restart up to maxRestartDelay, unless the
+// service ran for at least stableRunTime before exiting.
+func (s *supervisor) watch(name string) {
+	delay := minRestartDelay
+	for {
+		s.mu.Lock()
+		svc := s.services[name]
+		exited, startedAt := svc.instance.exited, svc.startedAt
+		s.mu.Unlock()
+		select {
+		case err := <-exited:
+			log.Printf("Supervisor: %s exited: %v", name, err)
+			s.exitedService(name, err)
+		case <-s.done:
+			return
+		}
+		if time.Since(startedAt) >= stableRunTime {
+			delay = minRestartDelay
+		}
+		for {
+			log.Printf("Supervisor: restarting %s in %v", name, delay)
+			select {
+			case <-s.after(delay):
+			case <-s.done:
+				return
+			}
+			delay *= 2
+			if delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+			err := s.startService(name)
+			if err == nil {
+				break
+			}
+			log.Printf("Supervisor: %s failed to start: %v", name, err)
+		}
+	}
+}
+
+// status returns how each started service has been running.
+func (s *supervisor) status() map[string]common.SupervisedStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retval := make(map[string]common.SupervisedStatus)
+	for name, svc := range s.services {
+		status := common.SupervisedStatus{Running: svc.running, Restarts: svc.restarts, LastExit: svc.lastExit}
+		if !svc.lastExitAt.IsZero() {
+			status.LastExitAt = svc.lastExitAt.Unix()
+		}
+		retval[name] = status
+	}
+	return retval
+}
+
+// stop stops restarting services and stops all started instances,
+// waiting for them to exit. Only the first call has any effect.
+func (s *supervisor) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		var instances []*instance
+		for _, svc := range s.services {
+			if svc.instance != nil {
+				instances = append(instances, svc.instance)
+			}
+		}
+		s.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, inst := range instances {
+			wg.Add(1)
+			go func(inst *instance) {
+				defer wg.Done()
+				inst.kill()
+			}(inst)
+		}
+		wg.Wait()
+	})
+}
+
+// startProcess starts the executable of the service as a process
+// pointed to the root service at rootUrl.
+func startProcess(config common.Config, name string, rootUrl string) (*instance, error) {
+	executable := config.Services[name].Common.Executable
+	if executable == "" {
+		executable = name
+	}
+	cmd := exec.Command(executable, "-rootURL", rootUrl)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	setParentDeathSignal(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	gone := make(chan struct{})
+	inst := &instance{
+		exited: make(chan error, 1),
+		kill: func() {
+			stopProcess(cmd.Process, gone, stopGracePeriod)
+		},
+	}
+	go func() {
+		err := cmd.Wait()
+		close(gone)
+		inst.exited <- err
+	}()
+	return inst, nil
+}
+
+// stopProcess sends SIGTERM to the process, so that it can deregister
+// and exit in an orderly way, and kills it if it is not gone (closed)
+// once the grace period is over.
+func stopProcess(process *os.Process, gone <-chan struct{}, grace time.Duration) {
+	err := process.Signal(syscall.SIGTERM)
+	if err != nil {
+		// Either the process is already gone, or it cannot be
+		// signalled on this platform.
+		process.Kill()
+		return
+	}
+	select {
+	case <-gone:
+	case <-time.After(grace):
+		log.Printf("Supervisor: process %d did not exit within %v of SIGTERM, killing it", process.Pid, grace)
+		process.Kill()
+	}
+}
+
+// Supervise starts all services configured in the provided location
+// (see Run()) other than root, in the order of their dependencies,
+// pointing them to the root service at rootUrl. Each service is
+// started only after the services it depends on are ready. If some
+// services could not be started, all started services are stopped
+// and a StartupError explaining why is returned. Otherwise, services
+// are restarted whenever they exit.
+func Supervise(configLocation string, rootUrl string) error {
+	_, err := supervise(configLocation, rootUrl)
+	return err
+}
+
+// supervise is Supervise returning the supervisor of the services.
+func supervise(configLocation string, rootUrl string) (*supervisor, error) {
+	backend, err := newConfigBackend(configLocation)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := backend.load()
+	if err != nil {
+		return nil, err
+	}
+	// Readiness is checked repeatedly anyway.
+	clientConfig := common.GetDefaultRestClientConfig(rootUrl)
+	clientConfig.Retries = 1
+	client, err := common.NewRestClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := newSupervisor(config)
+	s.start = func(name string) (*instance, error) {
+		return startProcess(config, name, rootUrl)
+	}
+	s.ready = func(name string) (bool, error) {
+		url, err := client.GetServiceUrl(name)
+		if err != nil {
+			return false, nil
+		}
+		err = client.Get(url, &common.IndexResponse{})
+		return err == nil, nil
+	}
+	err = s.run()
+	if err != nil {
+		s.stop()
+		return nil, err
+	}
+	for name := range s.services {
+		go s.watch(name)
+	}
+	return s, nil
+}
+
+// RunSupervised is like RunInstance, but once root is serving it also
+// starts the rest of the services (see Supervise), and reports how
+// they have been running in the status of the cluster.
+func RunSupervised(configLocation string, advertiseUrl string) (*common.RestServiceInfo, error) {
+	rootService, svcInfo, err := runInstance(configLocation, advertiseUrl)
+	if err != nil {
+		return svcInfo, err
+	}
+	// Wait for root to start serving.
+	log.Println(<-svcInfo.Channel)
+	rootUrl := advertiseUrl
+	if rootUrl == "" {
+		rootUrl = "http://" + svcInfo.Address
+	}
+	s, err := supervise(configLocation, rootUrl)
+	if err != nil {
+		return svcInfo, err
+	}
+	rootService.setSupervisor(s)
+	// Services are not left running when root is stopped.
+	common.AddShutdownHook(s.stop)
+	return svcInfo, nil
+}
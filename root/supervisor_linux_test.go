@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package root
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStopProcess tests that a process exiting on SIGTERM is left to
+// exit, and that a process ignoring it is killed after the grace period.
+func TestStopProcess(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		signal syscall.Signal
+	}{
+		{"exec sleep 10", syscall.SIGTERM},
+		{"trap '' TERM; sleep 10", syscall.SIGKILL},
+	} {
+		cmd := exec.Command("sh", "-c", test.script)
+		err := cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gone := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(gone)
+		}()
+		// Let the shell set up the trap.
+		time.Sleep(100 * time.Millisecond)
+		stopProcess(cmd.Process, gone, 200*time.Millisecond)
+		<-gone
+		status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		if !status.Signaled() || status.Signal() != test.signal {
+			t.Errorf("Expected '%s' to exit on %v, got %v", test.script, test.signal, cmd.ProcessState)
+		}
+	}
+}
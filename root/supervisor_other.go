@@ -0,0 +1,29 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build !linux
+// +build !linux
+
+package root
+
+import (
+	"os/exec"
+)
+
+// setParentDeathSignal does nothing: only Linux can signal a process
+// when its parent dies, elsewhere services may outlive a root that
+// died without stopping them.
+func setParentDeathSignal(cmd *exec.Cmd) {
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenant
+
+// Cascading deletion of tenants. Deleting a tenant with cascade=true
+// starts a job that releases the tenant's endpoints in ipam, removes
+// the tenant from policies applied to it, and then deletes the tenant
+// with its segments. Policies applied to the tenant only are deleted
+// (which removes their rules from hosts); those also applied to other
+// tenants are updated so that they no longer apply to this one.
+// Progress of the job is reported at /jobs/{jobId} until jobRetention
+// after the job finished.
+//
+// DELETE /jobs/{jobId} cancels a running job. The job stops before
+// releasing the next endpoint or deleting the next policy, and
+// requests in flight are abandoned. Endpoints released and policies
+// deleted until then, as counted in the job, stay so, but the tenant
+// and its segments are not deleted; deleting the tenant again picks
+// up what is left. An endpoint or policy whose request was abandoned
+// is not counted, though it may have been released or deleted. A job
+// cancelled after it started deleting the tenant may still be done.
+
+import (
+	"context"
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of a DeletionJob.
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+	// JobCancelling is the state of a job asked to be cancelled,
+	// until it stops.
+	JobCancelling = "cancelling"
+	JobCancelled  = "cancelled"
+)
+
+// jobRetention is how long a job is kept once it finished.
+const jobRetention = time.Hour
+
+// Steps of a DeletionJob.
+const (
+	stepEndpoints = "releasing endpoints"
+	stepPolicies  = "deleting policies"
+	stepTenant    = "deleting tenant"
+)
+
+// DeletionJob is a cascading deletion of a tenant.
+type DeletionJob struct {
+	ID       uint64 `json:"id"`
+	TenantID uint64 `json:"tenant_id"`
+	State    string `json:"state"`
+	// Step is what the job is doing while it is running,
+	// or what it failed to do or was stopped doing.
+	Step              string `json:"step,omitempty"`
+	Endpoints         int    `json:"endpoints"`
+	EndpointsReleased int    `json:"endpoints_released"`
+	Policies          int    `json:"policies"`
+	// PoliciesDeleted counts policies the tenant was removed from,
+	// whether they were deleted or updated.
+	PoliciesDeleted int    `json:"policies_deleted"`
+	Error           string `json:"error,omitempty"`
+
+	// cancel cancels the context the job runs with.
+	cancel context.CancelFunc
+	// finished is when the job stopped, zero while it runs.
+	finished time.Time
+}
+
+// deletionJobs keeps deletion jobs of the service.
+type deletionJobs struct {
+	mu     sync.Mutex
+	lastID uint64
+	jobs   map[uint64]*DeletionJob
+}
+
+// add adds a job for the tenant, along with the context to run it
+// with, unless one is already running for it, in which case that
+// one is returned.
+func (d *deletionJobs) add(tenantID uint64) (*DeletionJob, context.Context, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.jobs == nil {
+		d.jobs = make(map[uint64]*DeletionJob)
+	}
+	d.prune()
+	for _, job := range d.jobs {
+		if job.TenantID == tenantID && (job.State == JobRunning || job.State == JobCancelling) {
+			return job, nil, false
+		}
+	}
+	d.lastID++
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &DeletionJob{ID: d.lastID, TenantID: tenantID, State: JobRunning, cancel: cancel}
+	d.jobs[job.ID] = job
+	return job, ctx, true
+}
+
+// update changes the job while holding the lock.
+func (d *deletionJobs) update(job *DeletionJob, f func(job *DeletionJob)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(job)
+}
+
+// finish ends the job in the state, with the error if it failed.
+func (d *deletionJobs) finish(job *DeletionJob, state string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.State = state
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.finished = time.Now()
+}
+
+// prune forgets jobs that finished more than jobRetention ago.
+// Must be called with the lock held.
+func (d *deletionJobs) prune() {
+	for id, job := range d.jobs {
+		if !job.finished.IsZero() && time.Since(job.finished) > jobRetention {
+			delete(d.jobs, id)
+		}
+	}
+}
+
+// get returns a copy of the job with the given ID.
+func (d *deletionJobs) get(id uint64) (DeletionJob, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	job, ok := d.jobs[id]
+	if !ok {
+		return DeletionJob{}, false
+	}
+	return *job, true
+}
+
+// cancel asks the job with the given ID to stop, returning a copy
+// of it. Jobs that are not running cannot be cancelled.
+func (d *deletionJobs) cancel(id uint64) (DeletionJob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[id]
+	if !ok {
+		return DeletionJob{}, common.NewError404("job", strconv.FormatUint(id, 10))
+	}
+	switch job.State {
+	case JobRunning:
+		job.State = JobCancelling
+		job.cancel()
+	case JobCancelling:
+	default:
+		return DeletionJob{}, common.NewErrorConflict(fmt.Sprintf("Job %d is %s", id, job.State))
+	}
+	return *job, nil
+}
+
+// startDeletion starts a cascading deletion of the tenant.
+func (tsvc *TenantSvc) startDeletion(ten Tenant) DeletionJob {
+	job, ctx, started := tsvc.jobs.add(ten.ID)
+	if started {
+		log.Printf("Starting deletion job %d of tenant %d (%s)", job.ID, ten.ID, ten.Name)
+		go tsvc.runDeletion(ctx, job, ten)
+	}
+	retval, _ := tsvc.jobs.get(job.ID)
+	return retval
+}
+
+// runDeletion runs the job to completion,
+// or until the context is cancelled.
+func (tsvc *TenantSvc) runDeletion(ctx context.Context, job *DeletionJob, ten Tenant) {
+	defer job.cancel()
+	// stop ends the job, as cancelled if it was, as failed otherwise.
+	stop := func(err error) {
+		if ctx.Err() != nil {
+			log.Printf("Deletion job %d of tenant %d cancelled", job.ID, ten.ID)
+			tsvc.jobs.finish(job, JobCancelled, nil)
+			return
+		}
+		log.Printf("Deletion job %d of tenant %d failed: %s", job.ID, ten.ID, err)
+		tsvc.jobs.finish(job, JobFailed, err)
+	}
+
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Step = stepEndpoints })
+	ips, err := tsvc.tenantEndpoints(ctx, ten)
+	if err != nil {
+		stop(err)
+		return
+	}
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Endpoints = len(ips) })
+	for _, ip := range ips {
+		if ctx.Err() != nil {
+			stop(ctx.Err())
+			return
+		}
+		err = tsvc.releaseEndpoint(ctx, ip)
+		if err != nil {
+			stop(err)
+			return
+		}
+		tsvc.jobs.update(job, func(job *DeletionJob) { job.EndpointsReleased++ })
+	}
+
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Step = stepPolicies })
+	policies, err := tsvc.tenantPolicies(ctx, ten)
+	if err != nil {
+		stop(err)
+		return
+	}
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Policies = len(policies) })
+	for _, policy := range policies {
+		if ctx.Err() != nil {
+			stop(ctx.Err())
+			return
+		}
+		err = tsvc.detachPolicy(ctx, ten, policy)
+		if err != nil {
+			stop(err)
+			return
+		}
+		tsvc.jobs.update(job, func(job *DeletionJob) { job.PoliciesDeleted++ })
+	}
+
+	if ctx.Err() != nil {
+		stop(ctx.Err())
+		return
+	}
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Step = stepTenant })
+	// Not cancelled any more, so that the tenant is deleted
+	// with all of its segments or not at all.
+	err = tsvc.store.DeleteTenant(context.Background(), ten.ID)
+	if err != nil {
+		stop(err)
+		return
+	}
+	log.Printf("Deletion job %d deleted tenant %d (%s)", job.ID, ten.ID, ten.Name)
+	tsvc.jobs.update(job, func(job *DeletionJob) { job.Step = "" })
+	tsvc.jobs.finish(job, JobDone, nil)
+}
+
+// cancelJob cancels a deletion job, returning it.
+func (tsvc *TenantSvc) cancelJob(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["jobId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("job", idStr)
+	}
+	return tsvc.jobs.cancel(id)
+}
+
+// getJob reports progress of a deletion job.
+func (tsvc *TenantSvc) getJob(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["jobId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, common.NewError404("job", idStr)
+	}
+	job, ok := tsvc.jobs.get(id)
+	if !ok {
+		return nil, common.NewError404("job", idStr)
+	}
+	return job, nil
+}
+
+// ipamEndpoint is an endpoint as listed by ipam.
+type ipamEndpoint struct {
+	Ip        string `json:"ip"`
+	SegmentID string `json:"segment_id"`
+}
+
+// listIpamEndpoints lists endpoints of the tenant in ipam.
+func (tsvc *TenantSvc) listIpamEndpoints(ctx context.Context, tenantID uint64) ([]ipamEndpoint, error) {
+	client := tsvc.client.WithContext(ctx)
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []ipamEndpoint
+	err = client.Get(fmt.Sprintf("%s/tenants/%d/endpoints", ipamURL, tenantID), &endpoints)
+	return endpoints, err
+}
+
+// ipamEndpoints returns IPs of endpoints of the tenant in ipam.
+func (tsvc *TenantSvc) ipamEndpoints(ctx context.Context, ten Tenant) ([]string, error) {
+	endpoints, err := tsvc.listIpamEndpoints(ctx, ten.ID)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		ips[i] = endpoint.Ip
+	}
+	return ips, nil
+}
+
+// ipamRelease releases the endpoint in ipam.
+func (tsvc *TenantSvc) ipamRelease(ctx context.Context, ip string) error {
+	client := tsvc.client.WithContext(ctx)
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return err
+	}
+	result := make(map[string]interface{})
+	return client.Delete(fmt.Sprintf("%s/endpoints/%s", ipamURL, ip), nil, &result)
+}
+
+// appliedPolicies returns policies applied to the tenant.
+// Policies of other tenants that merely allow traffic from it
+// are left alone.
+func (tsvc *TenantSvc) appliedPolicies(ctx context.Context, ten Tenant) ([]common.Policy, error) {
+	policies, err := tsvc.listPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []common.Policy
+	for _, policy := range policies {
+		for _, endpoint := range policy.AppliedTo {
+			if ten.matches(endpoint) {
+				applied = append(applied, policy)
+				break
+			}
+		}
+	}
+	return applied, nil
+}
+
+// listPolicies lists policies in the policy service.
+func (tsvc *TenantSvc) listPolicies(ctx context.Context) ([]common.Policy, error) {
+	client := tsvc.client.WithContext(ctx)
+	policyURL, err := client.GetServiceUrl("policy")
+	if err != nil {
+		return nil, err
+	}
+	var policies []common.Policy
+	err = client.Get(policyURL+"/policies", &policies)
+	return policies, err
+}
+
+// matches returns true if the policy endpoint refers to the tenant.
+func (ten Tenant) matches(endpoint common.Endpoint) bool {
+	return endpoint.TenantID == ten.ID ||
+		(endpoint.TenantNetworkID != nil && *endpoint.TenantNetworkID == ten.NetworkID) ||
+		(ten.ExternalID != "" && endpoint.TenantExternalID == ten.ExternalID)
+}
+
+// removePolicy removes the tenant from the endpoints the policy is
+// applied to. If the policy is applied to nothing else, it is deleted,
+// which removes it from agents; otherwise it is updated, at the
+// revision listed, so that it keeps applying to other tenants.
+func (tsvc *TenantSvc) removePolicy(ctx context.Context, ten Tenant, policy common.Policy) error {
+	client := tsvc.client.WithContext(ctx)
+	policyURL, err := client.GetServiceUrl("policy")
+	if err != nil {
+		return err
+	}
+	var appliedTo []common.Endpoint
+	for _, endpoint := range policy.AppliedTo {
+		if !ten.matches(endpoint) {
+			appliedTo = append(appliedTo, endpoint)
+		}
+	}
+	url := fmt.Sprintf("%s/policies/%d", policyURL, policy.ID)
+	result := make(map[string]interface{})
+	if len(appliedTo) == 0 {
+		return client.Delete(url, nil, &result)
+	}
+	log.Printf("Removing tenant %d from policy %d, which applies to other tenants", ten.ID, policy.ID)
+	policy.AppliedTo = appliedTo
+	return client.Put(url, policy, &result)
+}
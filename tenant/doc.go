@@ -14,4 +14,40 @@
 // under the License.
 
 // Package tenant implements Tenant service.
+//
+// With a keystone section in the configuration (url of the Keystone v3
+// API, username, password, project and domain, which defaults to
+// Default), the service imports OpenStack projects as tenants every
+// sync_interval seconds (300 by default, 0 to disable) and on
+// POST /keystone/sync, renaming and deleting imported tenants along
+// with their projects.
+//
+// DELETE /tenants/{id}?cascade=true starts a job that releases the
+// tenant's endpoints in ipam and removes it from policies applied to
+// it, deleting those applied to nothing else, before deleting the
+// tenant; GET /jobs/{id} reports its progress, and
+// DELETE /jobs/{id} cancels it, leaving the tenant in place (see
+// cascade.go).
+// Segments can be renamed with PUT and deleted with DELETE on
+// /tenants/{id}/segments/{id}, unless ipam has endpoints in them
+// or policies refer to them.
+//
+// Deleted tenants and segments are kept for the deletion_grace_seconds
+// of the store (a day by default): GET /tenants/{id}?deleted=true finds
+// them, and POST /tenants/{id}/restore and
+// /tenants/{id}/segments/{id}/restore restore them (see restore.go).
+//
+// Lists of tenants and segments are paged with the limit and offset
+// query parameters and searched by the beginning of names with name,
+// e.g. GET /tenants?name=prod&limit=100&offset=200.
+//
+// Tenants and segments are looked up by external ID (such as the UUID
+// of a Keystone project or a Kubernetes namespace) with
+// GET /external/tenants/{externalId} and /external/segments/{externalId}.
+//
+// PUT /tenants/{id}/quota limits the number of segments, endpoints and
+// policies of a tenant (0 for no limit) and GET reports it with current
+// usage. The service refuses segments over the quota with 409 Conflict;
+// ipam and policy check endpoints and policies with
+// POST /tenants/{id}/quota/check before they create them.
 package tenant
@@ -0,0 +1,281 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenant
+
+// Synchronization of tenants with OpenStack Keystone: projects are
+// imported as tenants with the project ID as the external ID, tenants
+// follow renames of their projects and are deleted with them. Only
+// tenants imported from Keystone are renamed or deleted.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/romana/core/common"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Value of Tenant.Source for tenants imported from Keystone.
+	keystoneSource = "keystone"
+
+	defaultKeystoneSyncInterval = 300 * time.Second
+	defaultKeystoneDomain       = "Default"
+)
+
+// keystoneConfig is the keystone section of the configuration
+// of the tenant service.
+type keystoneConfig struct {
+	// URL of the Keystone v3 API, such as http://keystone:5000/v3.
+	url      string
+	username string
+	password string
+	// Project to scope the token to; it must be allowed to list projects.
+	project string
+	// Domain of the user and the project.
+	domain string
+	// How often to synchronize; 0 to synchronize only on request.
+	interval time.Duration
+}
+
+// parseKeystoneConfig parses the keystone section of the
+// configuration; it returns nil if there is none.
+func parseKeystoneConfig(serviceSpecific map[string]interface{}) (*keystoneConfig, error) {
+	keystoneMap, ok := serviceSpecific["keystone"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	config := &keystoneConfig{
+		domain:   defaultKeystoneDomain,
+		interval: defaultKeystoneSyncInterval,
+	}
+	config.url, _ = keystoneMap["url"].(string)
+	config.username, _ = keystoneMap["username"].(string)
+	config.password, _ = keystoneMap["password"].(string)
+	config.project, _ = keystoneMap["project"].(string)
+	if domain, ok := keystoneMap["domain"].(string); ok {
+		config.domain = domain
+	}
+	if seconds, ok := keystoneMap["sync_interval"].(float64); ok {
+		config.interval = time.Duration(seconds * float64(time.Second))
+	}
+	if config.url == "" || config.username == "" || config.project == "" {
+		return nil, common.NewError("Keystone url, username and project are required")
+	}
+	if config.interval < 0 {
+		return nil, common.NewError("Invalid keystone sync_interval %v", config.interval)
+	}
+	return config, nil
+}
+
+// keystoneProject is a project as returned by Keystone.
+type keystoneProject struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// keystoneSync synchronizes tenants with Keystone projects.
+type keystoneSync struct {
+	config keystoneConfig
+	store  Store
+	client *http.Client
+
+	// Only one synchronization runs at a time.
+	mu sync.Mutex
+}
+
+// KeystoneSyncResult reports changes made by a synchronization.
+type KeystoneSyncResult struct {
+	Added   []string `json:"added"`
+	Renamed []string `json:"renamed"`
+	Deleted []string `json:"deleted"`
+}
+
+// token obtains a token scoped to the configured project.
+func (k *keystoneSync) token(ctx context.Context) (string, error) {
+	domain := map[string]string{"name": k.config.domain}
+	body := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     k.config.username,
+						"password": k.config.password,
+						"domain":   domain,
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   k.config.project,
+					"domain": domain,
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", k.config.url+"/auth/tokens", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", common.NewError("Keystone authentication as %s failed: %s", k.config.username, resp.Status)
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", common.NewError("Keystone returned no token")
+	}
+	return token, nil
+}
+
+// projects lists all projects, following pages.
+func (k *keystoneSync) projects(ctx context.Context) ([]keystoneProject, error) {
+	token, err := k.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var projects []keystoneProject
+	url := k.config.url + "/projects"
+	for url != "" {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := k.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		page := struct {
+			Projects []keystoneProject `json:"projects"`
+			Links    struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, common.NewError("Listing Keystone projects failed: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, page.Projects...)
+		url = page.Links.Next
+	}
+	return projects, nil
+}
+
+// sync imports projects as tenants, renames tenants whose projects
+// were renamed and deletes tenants whose projects were deleted.
+func (k *keystoneSync) sync(ctx context.Context) (*KeystoneSyncResult, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	projects, err := k.projects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := k.store.ListTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byExternalID := make(map[string]Tenant)
+	for _, tenant := range tenants {
+		if tenant.ExternalID != "" {
+			byExternalID[tenant.ExternalID] = tenant
+		}
+	}
+
+	result := &KeystoneSyncResult{Added: []string{}, Renamed: []string{}, Deleted: []string{}}
+	found := make(map[string]bool)
+	for _, project := range projects {
+		found[project.ID] = true
+		tenant, ok := byExternalID[project.ID]
+		if !ok {
+			tenant = Tenant{ExternalID: project.ID, Name: project.Name, Source: keystoneSource}
+			err = k.store.AddTenant(ctx, &tenant)
+			if err != nil {
+				return result, err
+			}
+			log.Printf("Imported Keystone project %s (%s) as tenant %d", project.Name, project.ID, tenant.ID)
+			result.Added = append(result.Added, project.ID)
+			continue
+		}
+		if tenant.Source == keystoneSource && tenant.Name != project.Name {
+			oldName := tenant.Name
+			tenant.Name = project.Name
+			// A tenant changed since it was listed
+			// conflicts; the next sync renames it.
+			err = k.store.UpdateTenant(ctx, &tenant)
+			if err != nil {
+				return result, err
+			}
+			log.Printf("Renamed tenant %d from %s to %s after Keystone project %s", tenant.ID, oldName, project.Name, project.ID)
+			result.Renamed = append(result.Renamed, project.ID)
+		}
+	}
+	for _, tenant := range tenants {
+		if tenant.Source != keystoneSource || found[tenant.ExternalID] {
+			continue
+		}
+		err = k.store.DeleteTenant(ctx, tenant.ID)
+		if err != nil {
+			return result, err
+		}
+		log.Printf("Deleted tenant %d (%s) after Keystone project %s was deleted", tenant.ID, tenant.Name, tenant.ExternalID)
+		result.Deleted = append(result.Deleted, tenant.ExternalID)
+	}
+	return result, nil
+}
+
+// run synchronizes periodically.
+func (k *keystoneSync) run() {
+	for {
+		_, err := k.sync(context.Background())
+		if err != nil {
+			log.Printf("Error synchronizing tenants with Keystone: %s", err)
+		}
+		time.Sleep(k.config.interval)
+	}
+}
+
+// handleKeystoneSync synchronizes tenants with Keystone on request,
+// such as from a hook run on changes of projects.
+func (tsvc *TenantSvc) handleKeystoneSync(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if tsvc.keystone == nil {
+		return nil, common.NewError404("keystone", "configuration")
+	}
+	result, err := tsvc.keystone.sync(ctx.Context)
+	if err != nil {
+		return nil, common.NewError500(fmt.Sprintf("Synchronization with Keystone failed: %s", err))
+	}
+	return result, nil
+}
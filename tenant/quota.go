@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenant
+
+// Quotas of tenants. A quota limits the number of segments,
+// endpoints and policies of a tenant; 0 means no limit. The tenant
+// service enforces the segment limit itself; ipam and policy ask it
+// (see CheckQuota) before they create endpoints and policies.
+
+import (
+	"context"
+	"fmt"
+	"github.com/romana/core/common"
+	"strconv"
+)
+
+// Resources limited by quotas.
+const (
+	QuotaSegments  = "segments"
+	QuotaEndpoints = "endpoints"
+	QuotaPolicies  = "policies"
+)
+
+// Quota limits resources of a tenant.
+type Quota struct {
+	ID           uint64 `sql:"AUTO_INCREMENT" json:"-"`
+	TenantID     uint64 `gorm:"COLUMN:tenant_id" sql:"unique" json:"tenant_id"`
+	MaxSegments  int    `json:"max_segments"`
+	MaxEndpoints int    `json:"max_endpoints"`
+	MaxPolicies  int    `json:"max_policies"`
+}
+
+// limit returns the limit of the resource; 0 if there is none.
+func (q Quota) limit(resource string) (int, error) {
+	switch resource {
+	case QuotaSegments:
+		return q.MaxSegments, nil
+	case QuotaEndpoints:
+		return q.MaxEndpoints, nil
+	case QuotaPolicies:
+		return q.MaxPolicies, nil
+	}
+	return 0, common.NewError400(fmt.Sprintf("Unknown resource %s", resource))
+}
+
+// QuotaUsage reports the quota of a tenant and how much of it is used.
+type QuotaUsage struct {
+	Quota     Quota `json:"quota"`
+	Segments  int   `json:"segments"`
+	Endpoints int   `json:"endpoints"`
+	Policies  int   `json:"policies"`
+}
+
+// QuotaCheck asks whether the tenant, which has Used of
+// the resource, may have one more.
+type QuotaCheck struct {
+	Resource string `json:"resource"`
+	Used     int    `json:"used"`
+}
+
+// checkQuota returns a Conflict error if the tenant,
+// which has used of the resource, cannot have one more.
+func (tsvc *TenantSvc) checkQuota(ctx context.Context, tenantID uint64, resource string, used int) error {
+	quota, err := tsvc.store.GetQuota(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	limit, err := quota.limit(resource)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && used >= limit {
+		return common.NewErrorConflict(fmt.Sprintf("Tenant %d has reached its quota of %d %s", tenantID, limit, resource))
+	}
+	return nil
+}
+
+// getQuota reports the quota of a tenant with its usage.
+func (tsvc *TenantSvc) getQuota(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["tenantId"]
+	ten, err := tsvc.store.GetTenant(ctx.Context, idStr)
+	if err != nil {
+		return nil, err
+	}
+	usage := QuotaUsage{}
+	usage.Quota, err = tsvc.store.GetQuota(ctx.Context, ten.ID)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := tsvc.store.ListSegments(ctx.Context, idStr)
+	if err != nil {
+		return nil, err
+	}
+	usage.Segments = len(segments)
+	endpoints, err := tsvc.tenantEndpoints(ctx.Context, ten)
+	if err != nil {
+		return nil, err
+	}
+	usage.Endpoints = len(endpoints)
+	policies, err := tsvc.tenantPolicies(ctx.Context, ten)
+	if err != nil {
+		return nil, err
+	}
+	usage.Policies = len(policies)
+	return usage, nil
+}
+
+// putQuota sets the quota of a tenant.
+func (tsvc *TenantSvc) putQuota(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ten, err := tsvc.store.GetTenant(ctx.Context, ctx.PathVariables["tenantId"])
+	if err != nil {
+		return nil, err
+	}
+	quota := input.(*Quota)
+	if quota.MaxSegments < 0 || quota.MaxEndpoints < 0 || quota.MaxPolicies < 0 {
+		return nil, common.NewError400("Quota limits cannot be negative")
+	}
+	quota.TenantID = ten.ID
+	err = tsvc.store.SetQuota(ctx.Context, quota)
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// postQuotaCheck is called by other services before they create
+// resources of a tenant; it returns Conflict if the quota is reached.
+func (tsvc *TenantSvc) postQuotaCheck(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ten, err := tsvc.store.GetTenant(ctx.Context, ctx.PathVariables["tenantId"])
+	if err != nil {
+		return nil, err
+	}
+	check := input.(*QuotaCheck)
+	err = tsvc.checkQuota(ctx.Context, ten.ID, check.Resource, check.Used)
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// CheckQuota asks the tenant service whether the tenant, which has
+// used of the resource (QuotaEndpoints or QuotaPolicies), may have
+// one more. It returns a Conflict error if it may not.
+func CheckQuota(client *common.RestClient, tenantID uint64, resource string, used int) error {
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/tenants/%s/quota/check", tenantURL, strconv.FormatUint(tenantID, 10))
+	// No result, so that details of Conflict (a message rather
+	// than the conflicting object) are kept as they are.
+	return client.Post(url, QuotaCheck{Resource: resource, Used: used}, nil)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenant
+
+// Deleted tenants and segments are kept for the deletion grace period
+// of the store (see common.Purger), during which references to them
+// can be resolved with GET and deleted=true, and they can be restored:
+//
+//   POST /tenants/{tenantId}/restore
+//   POST /tenants/{tenantId}/segments/{segmentId}/restore
+//
+// Restoring a tenant restores the segments deleted along with it;
+// segments deleted before it are restored on their own, once their
+// tenant is there. Endpoints and policies deleted with a cascading
+// deletion (see cascade.go) are not restored.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/romana/core/common"
+)
+
+// isNotFound returns true if err is a 404 error.
+func isNotFound(err error) bool {
+	httpErr, ok := err.(common.HttpError)
+	return ok && httpErr.StatusCode == http.StatusNotFound
+}
+
+// restoreTenant handles POST to /tenants/{tenantId}/restore,
+// restoring the deleted tenant and returning it.
+func (tsvc *TenantSvc) restoreTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["tenantId"]
+	if _, err := tsvc.store.GetTenant(ctx.Context, idStr); err == nil {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Tenant %s is not deleted", idStr))
+	}
+	ten, err := tsvc.store.GetDeletedTenant(ctx.Context, idStr)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.RestoreTenant(ctx.Context, ten.ID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Restored tenant %d (%s)", ten.ID, ten.Name)
+	return tsvc.store.GetTenant(ctx.Context, idStr)
+}
+
+// restoreSegment handles POST to
+// /tenants/{tenantId}/segments/{segmentId}/restore, restoring the
+// deleted segment of a tenant that is not deleted, and returning it.
+func (tsvc *TenantSvc) restoreSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
+	tenantIdStr := ctx.PathVariables["tenantId"]
+	segmentIdStr := ctx.PathVariables["segmentId"]
+	if _, err := tsvc.store.GetTenant(ctx.Context, tenantIdStr); err != nil {
+		if isNotFound(err) {
+			return nil, common.NewErrorConflict(fmt.Sprintf("Tenant %s is deleted or unknown; restore it first", tenantIdStr))
+		}
+		return nil, err
+	}
+	if _, err := tsvc.store.GetSegment(ctx.Context, tenantIdStr, segmentIdStr); err == nil {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Segment %s is not deleted", segmentIdStr))
+	}
+	seg, err := tsvc.store.GetDeletedSegment(ctx.Context, tenantIdStr, segmentIdStr)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.RestoreSegment(ctx.Context, seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Restored segment %d (%s) of tenant %s", seg.ID, seg.Name, tenantIdStr)
+	return tsvc.store.GetSegment(ctx.Context, tenantIdStr, strconv.FormatUint(seg.ID, 10))
+}
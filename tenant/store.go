@@ -16,12 +16,53 @@
 package tenant
 
 import (
+	"context"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"github.com/romana/core/common"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Backing store
+// Store keeps tenants, their segments and quotas. tenantStore keeps
+// them in the database configured; package tenanttest provides one
+// keeping them in memory.
+type Store interface {
+	common.Store
+	Ping() error
+
+	ListTenants(ctx context.Context) ([]Tenant, error)
+	ListTenantsPage(ctx context.Context, page ListPage) ([]Tenant, error)
+	AddTenant(ctx context.Context, tenant *Tenant) error
+	UpdateTenant(ctx context.Context, tenant *Tenant) error
+	DeleteTenant(ctx context.Context, id uint64) error
+	GetTenant(ctx context.Context, id string) (Tenant, error)
+	FindTenantByExternalID(ctx context.Context, externalID string) (Tenant, error)
+
+	ListSegments(ctx context.Context, tenantId string) ([]Segment, error)
+	ListSegmentsPage(ctx context.Context, tenantId string, page ListPage) ([]Segment, error)
+	AddSegment(ctx context.Context, tenantId uint64, segment *Segment) error
+	UpdateSegment(ctx context.Context, segment *Segment) error
+	DeleteSegment(ctx context.Context, id uint64) error
+	GetSegment(ctx context.Context, tenantId string, segmentId string) (Segment, error)
+	FindSegmentByExternalID(ctx context.Context, externalID string) (Segment, error)
+
+	GetQuota(ctx context.Context, tenantID uint64) (Quota, error)
+	SetQuota(ctx context.Context, quota *Quota) error
+
+	// Deleted tenants and segments are kept for the deletion
+	// grace period, during which they can be found and restored
+	// (see common.Purger).
+	common.Purger
+	GetDeletedTenant(ctx context.Context, id string) (Tenant, error)
+	RestoreTenant(ctx context.Context, id uint64) error
+	GetDeletedSegment(ctx context.Context, tenantId string, segmentId string) (Segment, error)
+	RestoreSegment(ctx context.Context, id uint64) error
+}
+
+// tenantStore implements Store in a database.
 type tenantStore struct {
 	common.DbStore
 }
@@ -29,11 +70,13 @@ type tenantStore struct {
 // Entities implements Entities method of
 // Service interface.
 func (tenantStore *tenantStore) Entities() []interface{} {
-	retval := make([]interface{}, 2)
+	retval := make([]interface{}, 3)
 	t := Tenant{}
 	retval[0] = &t
 	s := Segment{}
 	retval[1] = &s
+	q := Quota{}
+	retval[2] = &q
 	return retval
 }
 
@@ -43,21 +86,70 @@ type Tenant struct {
 	Name       string    `json:"name,omitempty"`
 	Segments   []Segment `json:"segments,omitempty"`
 	NetworkID  uint64    `json:"network_id,omitempty"`
+	// Source is where the tenant was imported from, such as
+	// keystone; empty for tenants added through the API.
+	Source string `json:"source,omitempty"`
+	// DeletedAt is set when the tenant is deleted, making
+	// gorm delete it softly (see common.SoftDelete).
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version is incremented on each update of the tenant
+	// (see common.CheckVersion).
+	Version uint64 `sql:"not null;default:1" json:"version,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by the store.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
 
 type Segment struct {
-	ID         uint64 `sql:"AUTO_INCREMENT" json:"id,omitempty"`
-	ExternalID string `sql:"not null" json:"external_id,omitempty" gorm:"COLUMN:external_id"`
-	TenantID   uint64 `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
-	Name       string `json:"name,omitempty"`
-	NetworkID  uint64 `json:"network_id,omitempty"`
+	ID         uint64     `sql:"AUTO_INCREMENT" json:"id,omitempty"`
+	ExternalID string     `sql:"not null" json:"external_id,omitempty" gorm:"COLUMN:external_id"`
+	TenantID   uint64     `gorm:"COLUMN:tenant_id" json:"tenant_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	NetworkID  uint64     `json:"network_id,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	Version    uint64     `sql:"not null;default:1" json:"version,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// ListPage selects a page of tenants or segments, ordered by ID:
+// those whose names start with NamePrefix, skipping the first Offset
+// of them and returning at most Limit (0 for no limit).
+type ListPage struct {
+	NamePrefix string
+	Offset     int
+	Limit      int
+}
+
+// likeEscaper escapes wildcards of LIKE patterns, with ! as the
+// escape character since backslash is not portable between dialects.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// apply adds conditions selecting the page to a query of table.
+func (page ListPage) apply(db *gorm.DB, table string) *gorm.DB {
+	if page.NamePrefix != "" {
+		db = db.Where(table+".name LIKE ? ESCAPE '!'", likeEscaper.Replace(page.NamePrefix)+"%")
+	}
+	db = db.Order(table + ".id")
+	if page.Limit > 0 {
+		db = db.Limit(page.Limit).Offset(page.Offset)
+	}
+	return db
+}
+
+func (tenantStore *tenantStore) ListTenants(ctx context.Context) ([]Tenant, error) {
+	return tenantStore.ListTenantsPage(ctx, ListPage{})
 }
 
-func (tenantStore *tenantStore) listTenants() ([]Tenant, error) {
+// ListTenantsPage returns the page of tenants.
+func (tenantStore *tenantStore) ListTenantsPage(ctx context.Context, page ListPage) ([]Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 	var tenants []Tenant
 	log.Println("In listTenants()", &tenants)
-	tenantStore.DbStore.Db.Find(&tenants)
-	err := common.MakeMultiError(tenantStore.DbStore.Db.GetErrors())
+	db := page.apply(tenantStore.DbStore.Db, "tenants").Find(&tenants)
+	err := common.GetDbErrors(db)
 	if err != nil {
 		return nil, err
 	}
@@ -65,13 +157,21 @@ func (tenantStore *tenantStore) listTenants() ([]Tenant, error) {
 	return tenants, nil
 }
 
-// listSegments returns a list of segments for a specific tenant
+// ListSegments returns a list of segments for a specific tenant
 // whose tenantId is specified.
-func (tenantStore *tenantStore) listSegments(tenantId string) ([]Segment, error) {
+func (tenantStore *tenantStore) ListSegments(ctx context.Context, tenantId string) ([]Segment, error) {
+	return tenantStore.ListSegmentsPage(ctx, tenantId, ListPage{})
+}
+
+// ListSegmentsPage returns the page of segments of the tenant.
+func (tenantStore *tenantStore) ListSegmentsPage(ctx context.Context, tenantId string, page ListPage) ([]Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 	var segments []Segment
 	db := tenantStore.DbStore.Db.Joins("JOIN tenants ON segments.tenant_id = tenants.id").
-		Where("tenants.id = ? OR tenants.external_id = ?", tenantId, tenantId).
-		Find(&segments)
+		Where("tenants.id = ? OR tenants.external_id = ?", tenantId, tenantId)
+	db = page.apply(db, "segments").Find(&segments)
 	err := common.MakeMultiError(db.GetErrors())
 	log.Printf("In listSegments(): %v, %v", segments, err)
 	if err != nil {
@@ -83,19 +183,35 @@ func (tenantStore *tenantStore) listSegments(tenantId string) ([]Segment, error)
 	return segments, nil
 }
 
-func (tenantStore *tenantStore) addTenant(tenant *Tenant) error {
+func (tenantStore *tenantStore) AddTenant(ctx context.Context, tenant *Tenant) error {
 	log.Println("In tenantStore addTenant().")
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
 
 	var tenants []Tenant
 	tx := tenantStore.DbStore.Db.Begin()
 
-	tx = tx.Find(&tenants)
-	err := common.GetDbErrors(tx)
+	err := purgeDeletedTenants(tx, tenant.Name, tenant.ExternalID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	db := tx.Unscoped().Find(&tenants)
+	err = common.GetDbErrors(db)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	tenant.NetworkID = uint64(len(tenants))
+	// Network IDs of deleted tenants are not reused while the last
+	// one is there, nor while deleted ones can be restored.
+	tenant.NetworkID = 0
+	for _, t := range tenants {
+		if t.NetworkID >= tenant.NetworkID {
+			tenant.NetworkID = t.NetworkID + 1
+		}
+	}
+	tenant.Version = 1
 
 	tx = tx.Create(tenant)
 	err = common.GetDbErrors(tx)
@@ -103,66 +219,351 @@ func (tenantStore *tenantStore) addTenant(tenant *Tenant) error {
 		tx.Rollback()
 		return err
 	}
+	// Do not commit on behalf of a request that has gone away.
+	if err = common.CheckContext(ctx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// UpdateTenant saves the name of the tenant, provided it is still
+// at tenant.Version, and increments the version.
+func (tenantStore *tenantStore) UpdateTenant(ctx context.Context, tenant *Tenant) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	now := time.Now()
+	tx := tenantStore.DbStore.Db.Begin()
+	err := purgeDeletedTenants(tx, tenant.Name, tenant.ExternalID)
+	if err == nil {
+		columns := map[string]interface{}{"name": tenant.Name, "updated_at": now}
+		err = common.UpdateVersioned(tx, &Tenant{}, tenant.Version, columns, "id = ?", tenant.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	tx.Commit()
+	tenant.Version++
+	tenant.UpdatedAt = &now
+	return nil
+}
+
+// DeleteTenant deletes the tenant with its segments, softly, so that
+// they can be restored together (see RestoreTenant). The quota of the
+// tenant is kept until the tenant is purged.
+func (tenantStore *tenantStore) DeleteTenant(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	deletedAt := common.DeletionTime()
+	tx := tenantStore.DbStore.Db.Begin()
+	err := common.SoftDelete(tx, &Segment{}, deletedAt, "tenant_id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = common.SoftDelete(tx, &Tenant{}, deletedAt, "id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// purgeDeletedTenants removes deleted tenants of the name and external
+// ID, which cannot be restored once another tenant has them, with their
+// segments and quotas.
+func purgeDeletedTenants(tx *gorm.DB, name string, externalID string) error {
+	var tenants []Tenant
+	db := tx.Unscoped().Where("deleted_at IS NOT NULL AND name = ? AND external_id = ?", name, externalID).Find(&tenants)
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	for _, ten := range tenants {
+		for _, entity := range []interface{}{&Segment{}, &Quota{}} {
+			db = tx.Unscoped().Where("tenant_id = ?", ten.ID).Delete(entity)
+			if err := common.GetDbErrors(db); err != nil {
+				return err
+			}
+		}
+		db = tx.Unscoped().Where("id = ?", ten.ID).Delete(&Tenant{})
+		if err := common.GetDbErrors(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeDeletedSegments removes deleted segments of the tenant with
+// the name and external ID, which cannot be restored once another
+// segment has them.
+func purgeDeletedSegments(tx *gorm.DB, tenantID uint64, name string, externalID string) error {
+	db := tx.Unscoped().Where("deleted_at IS NOT NULL AND tenant_id = ? AND name = ? AND external_id = ?", tenantID, name, externalID).Delete(&Segment{})
+	return common.GetDbErrors(db)
+}
+
+// GetDeletedTenant returns the tenant if it is deleted
+// but not yet purged.
+func (tenantStore *tenantStore) GetDeletedTenant(ctx context.Context, id string) (Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Tenant{}, err
+	}
+	var tenants []Tenant
+	db := tenantStore.DbStore.Db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).Find(&tenants)
+	if err := common.GetDbErrors(db); err != nil {
+		return Tenant{}, err
+	}
+	if len(tenants) == 0 {
+		return Tenant{}, common.NewError404("deleted tenant", id)
+	}
+	return tenants[0], nil
+}
+
+// RestoreTenant restores the deleted tenant with the
+// segments that were deleted along with it.
+func (tenantStore *tenantStore) RestoreTenant(ctx context.Context, id uint64) error {
+	ten, err := tenantStore.GetDeletedTenant(ctx, strconv.FormatUint(id, 10))
+	if err != nil {
+		return err
+	}
+	tx := tenantStore.DbStore.Db.Begin()
+	// Segments deleted before the tenant stay deleted.
+	_, err = common.Undelete(tx, &Segment{}, "tenant_id = ? AND deleted_at >= ?", id, *ten.DeletedAt)
+	if err == nil {
+		_, err = common.Undelete(tx, &Tenant{}, "id = ?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// GetDeletedSegment returns the segment of the tenant
+// if it is deleted but not yet purged.
+func (tenantStore *tenantStore) GetDeletedSegment(ctx context.Context, tenantId string, segmentId string) (Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Segment{}, err
+	}
+	var segments []Segment
+	db := tenantStore.DbStore.Db.Unscoped().Where("tenant_id = ? AND id = ? AND deleted_at IS NOT NULL", tenantId, segmentId).Find(&segments)
+	if err := common.GetDbErrors(db); err != nil {
+		return Segment{}, err
+	}
+	if len(segments) == 0 {
+		return Segment{}, common.NewError404("deleted segment/tenant", fmt.Sprintf("%s/%s", tenantId, segmentId))
+	}
+	return segments[0], nil
+}
+
+// RestoreSegment restores the deleted segment.
+func (tenantStore *tenantStore) RestoreSegment(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	n, err := common.Undelete(tenantStore.DbStore.Db, &Segment{}, "id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.NewError404("deleted segment", strconv.FormatUint(id, 10))
+	}
 	return nil
 }
 
-func (tenantStore *tenantStore) addSegment(tenantId uint64, segment *Segment) error {
+// PurgeDeleted implements common.Purger, also removing
+// quotas of the tenants purged.
+func (tenantStore *tenantStore) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	purged, err := tenantStore.DbStore.PurgeDeleted(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	db := tenantStore.DbStore.Db.Where("tenant_id NOT IN (SELECT id FROM tenants)").Delete(&Quota{})
+	return purged, common.GetDbErrors(db)
+}
+
+func (tenantStore *tenantStore) AddSegment(ctx context.Context, tenantId uint64, segment *Segment) error {
 	var err error
+	if err = common.CheckContext(ctx); err != nil {
+		return err
+	}
 	tx := tenantStore.DbStore.Db.Begin()
 
+	err = purgeDeletedSegments(tx, tenantId, segment.Name, segment.ExternalID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Deleted segments that can be restored keep their network IDs.
 	var segments []Segment
-	tx = tx.Where("tenant_id = ?", tenantId).Find(&segments)
-	err = common.GetDbErrors(tx)
+	db := tx.Unscoped().Where("tenant_id = ?", tenantId).Find(&segments)
+	err = common.GetDbErrors(db)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	segment.NetworkID = uint64(len(segments))
+	segment.NetworkID = 0
+	for _, s := range segments {
+		if s.NetworkID >= segment.NetworkID {
+			segment.NetworkID = s.NetworkID + 1
+		}
+	}
 	segment.TenantID = tenantId
+	segment.Version = 1
 	tx = tx.Create(segment)
 	err = common.GetDbErrors(tx)
 
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Do not commit on behalf of a request that has gone away.
+	if err = common.CheckContext(ctx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// UpdateSegment saves the name and external ID of the segment.
+func (tenantStore *tenantStore) UpdateSegment(ctx context.Context, segment *Segment) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	now := time.Now()
+	tx := tenantStore.DbStore.Db.Begin()
+	err := purgeDeletedSegments(tx, segment.TenantID, segment.Name, segment.ExternalID)
+	if err == nil {
+		columns := map[string]interface{}{"name": segment.Name, "external_id": segment.ExternalID, "updated_at": now}
+		err = common.UpdateVersioned(tx, &Segment{}, segment.Version, columns, "id = ?", segment.ID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	tx.Commit()
+	segment.Version++
+	segment.UpdatedAt = &now
 	return nil
 }
 
-func (tenantStore *tenantStore) getTenant(id string) (Tenant, error) {
+// DeleteSegment deletes the segment, softly (see RestoreSegment).
+func (tenantStore *tenantStore) DeleteSegment(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	return common.SoftDelete(tenantStore.DbStore.Db, &Segment{}, common.DeletionTime(), "id = ?", id)
+}
+
+func (tenantStore *tenantStore) GetTenant(ctx context.Context, id string) (Tenant, error) {
 	ten := Tenant{}
-	var count int
+	if err := common.CheckContext(ctx); err != nil {
+		return ten, err
+	}
 	log.Println("In getTenant()")
-	db := tenantStore.DbStore.Db.Where("id = ?", id).First(&ten).Count(&count)
+	db := tenantStore.DbStore.Db.Where("id = ?", id).First(&ten)
+	if db.RecordNotFound() {
+		return ten, common.NewError404("tenant", id)
+	}
 	err := common.GetDbErrors(db)
 	if err != nil {
 		return ten, err
 	}
-	if count == 0 {
-		return ten, common.NewError404("tenant", id)
-	}
 	return ten, nil
 }
 
-func (tenantStore *tenantStore) getSegment(tenantId string, segmentId string) (Segment, error) {
+func (tenantStore *tenantStore) GetSegment(ctx context.Context, tenantId string, segmentId string) (Segment, error) {
 	seg := Segment{}
-	var count int
-	db := tenantStore.DbStore.Db.Where("tenant_id = ? AND id = ?", tenantId, segmentId).
-		First(&seg).Count(&count)
-
-	err := common.GetDbErrors(db)
-	if err != nil {
+	if err := common.CheckContext(ctx); err != nil {
 		return seg, err
 	}
-	if count == 0 {
+	db := tenantStore.DbStore.Db.Where("tenant_id = ? AND id = ?", tenantId, segmentId).First(&seg)
+	if db.RecordNotFound() {
 		return seg, common.NewError404("segment/tenant", fmt.Sprintf("%s/%s", tenantId, segmentId))
 	}
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return seg, err
+	}
 	return seg, nil
 }
 
+// GetQuota returns the quota of the tenant; a quota
+// with no limits if none was set.
+func (tenantStore *tenantStore) GetQuota(ctx context.Context, tenantID uint64) (Quota, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Quota{}, err
+	}
+	var quotas []Quota
+	db := tenantStore.DbStore.Db.Where("tenant_id = ?", tenantID).Find(&quotas)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return Quota{}, err
+	}
+	if len(quotas) == 0 {
+		return Quota{TenantID: tenantID}, nil
+	}
+	return quotas[0], nil
+}
+
+// SetQuota saves the quota of the tenant, replacing the existing one.
+func (tenantStore *tenantStore) SetQuota(ctx context.Context, quota *Quota) error {
+	existing, err := tenantStore.GetQuota(ctx, quota.TenantID)
+	if err != nil {
+		return err
+	}
+	quota.ID = existing.ID
+	db := tenantStore.DbStore.Db.Save(quota)
+	return common.GetDbErrors(db)
+}
+
+// FindTenantByExternalID finds the tenant with the external ID.
+func (tenantStore *tenantStore) FindTenantByExternalID(ctx context.Context, externalID string) (Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Tenant{}, err
+	}
+	var tenants []Tenant
+	db := tenantStore.DbStore.Db.Where("external_id = ?", externalID).Find(&tenants)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return Tenant{}, err
+	}
+	if len(tenants) == 0 {
+		return Tenant{}, common.NewError404("tenant", externalID)
+	}
+	if len(tenants) > 1 {
+		return Tenant{}, common.NewErrorConflict(fmt.Sprintf("%d tenants have external ID %s", len(tenants), externalID))
+	}
+	return tenants[0], nil
+}
+
+// FindSegmentByExternalID finds the segment with the external ID.
+func (tenantStore *tenantStore) FindSegmentByExternalID(ctx context.Context, externalID string) (Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return Segment{}, err
+	}
+	var segments []Segment
+	db := tenantStore.DbStore.Db.Where("external_id = ?", externalID).Find(&segments)
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return Segment{}, err
+	}
+	if len(segments) == 0 {
+		return Segment{}, common.NewError404("segment", externalID)
+	}
+	if len(segments) > 1 {
+		return Segment{}, common.NewErrorConflict(fmt.Sprintf("%d segments have external ID %s", len(segments), externalID))
+	}
+	return segments[0], nil
+}
+
 // CreateSchemaPostProcess implements CreateSchemaPostProcess method of
 // Service interface.
 func (tenantStore *tenantStore) CreateSchemaPostProcess() error {
@@ -170,6 +571,9 @@ func (tenantStore *tenantStore) CreateSchemaPostProcess() error {
 	log.Printf("tenantStore.CreateSchemaPostProcess(), DB is %v", db)
 	db.Model(&Tenant{}).AddUniqueIndex("idx_name_extid", "name", "external_id")
 	db.Model(&Segment{}).AddUniqueIndex("idx_tenant_name_extid", "tenant_id", "name", "external_id")
+	// For lookups by external ID alone (see findTenantByExternalID).
+	db.Model(&Tenant{}).AddIndex("idx_tenant_extid", "external_id")
+	db.Model(&Segment{}).AddIndex("idx_segment_extid", "external_id")
 	err := common.MakeMultiError(db.GetErrors())
 	if err != nil {
 		return err
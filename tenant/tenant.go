@@ -16,23 +16,51 @@
 package tenant
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/romana/core/common"
 )
 
 // TenantSvc provides tenant service.
 type TenantSvc struct {
-	store  tenantStore
+	store  Store
 	config common.ServiceConfig
 	dc     common.Datacenter
+
+	// Synchronization with Keystone, if configured.
+	keystone *keystoneSync
+
+	client *common.RestClient
+	// Cascading deletions of tenants (see cascade.go).
+	jobs deletionJobs
+	// Steps of cascading deletions, which query ipam (ipamEndpoints,
+	// ipamRelease) and policy (appliedPolicies, removePolicy). They
+	// are fields so that tests can replace them.
+	tenantEndpoints func(ctx context.Context, ten Tenant) ([]string, error)
+	releaseEndpoint func(ctx context.Context, ip string) error
+	tenantPolicies  func(ctx context.Context, ten Tenant) ([]common.Policy, error)
+	detachPolicy    func(ctx context.Context, ten Tenant, policy common.Policy) error
+	// Checks before deleting segments, which query ipam
+	// (ipamSegmentEndpoints) and policy (segmentPolicies).
+	segmentEndpoints  func(ctx context.Context, ten Tenant, seg Segment) (int, error)
+	referringPolicies func(ctx context.Context, ten Tenant, seg Segment) ([]uint64, error)
 }
 
 const (
 	tenantsPath        = "/tenants"
 	segmentsPath       = "/segments"
 	tenantNameQueryVar = "tenantName"
+	keystoneSyncPath   = "/keystone/sync"
+	jobsPath           = "/jobs"
+	externalPath       = "/external"
+	quotaPath          = "/quota"
+	restorePath        = "/restore"
 )
 
 // Routes provides route for tenant service.
@@ -49,6 +77,22 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			Pattern: tenantsPath + "/{tenantId}",
 			Handler: tsvc.getTenant,
 		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     tenantsPath + "/{tenantId}",
+			Handler:     tsvc.updateTenant,
+			MakeMessage: func() interface{} { return &Tenant{} },
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: tenantsPath + "/{tenantId}",
+			Handler: tsvc.deleteTenant,
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: tenantsPath + "/{tenantId}" + restorePath,
+			Handler: tsvc.restoreTenant,
+		},
 		common.Route{
 			Method:  "GET",
 			Pattern: tenantsPath,
@@ -67,6 +111,27 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath + "/{segmentId}",
+			Handler:         tsvc.updateSegment,
+			MakeMessage:     func() interface{} { return &Segment{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath + "/{segmentId}",
+			Handler:         tsvc.deleteSegment,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath + "/{segmentId}" + restorePath,
+			Handler:         tsvc.restoreSegment,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         tenantsPath + "/{tenantId}" + segmentsPath,
@@ -74,11 +139,67 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         tenantsPath + "/{tenantId}" + quotaPath,
+			Handler:         tsvc.getQuota,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         tenantsPath + "/{tenantId}" + quotaPath,
+			Handler:         tsvc.putQuota,
+			MakeMessage:     func() interface{} { return &Quota{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         tenantsPath + "/{tenantId}" + quotaPath + "/check",
+			Handler:         tsvc.postQuotaCheck,
+			MakeMessage:     func() interface{} { return &QuotaCheck{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         externalPath + tenantsPath + "/{externalId}",
+			Handler:         tsvc.getTenantByExternalID,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         externalPath + segmentsPath + "/{externalId}",
+			Handler:         tsvc.getSegmentByExternalID,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         jobsPath + "/{jobId}",
+			Handler:         tsvc.getJob,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         jobsPath + "/{jobId}",
+			Handler:         tsvc.cancelJob,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         keystoneSyncPath,
+			Handler:         tsvc.handleKeystoneSync,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 	}
 	var t = []Tenant{}
-	routes = append(routes, common.CreateFindRoutes(&t, &tsvc.store.DbStore)...)
+	routes = append(routes, common.CreateFindRoutes(&t, storeFinder{tsvc})...)
 	var s = []Segment{}
-	routes = append(routes, common.CreateFindRoutes(&s, &tsvc.store.DbStore)...)
+	routes = append(routes, common.CreateFindRoutes(&s, storeFinder{tsvc})...)
 	return routes
 }
 
@@ -88,16 +209,51 @@ func (tsvc *TenantSvc) Routes() common.Routes {
 func (tsvc *TenantSvc) addTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("TenantService: Entering addTenant()")
 	newTenant := input.(*Tenant)
-	err := tsvc.store.addTenant(newTenant)
+	err := tsvc.store.AddTenant(ctx.Context, newTenant)
 	log.Printf("TenantService: Attempting to add tenant %+v: %+v", newTenant, err)
 	if err != nil {
 		return nil, err
 	}
 	return newTenant, err
 }
+
+// parseCount parses an optional non-negative query parameter.
+func parseCount(ctx common.RestContext, name string) (int, error) {
+	str := ctx.QueryVariables.Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(str)
+	if err != nil || i < 0 {
+		return 0, common.NewError400(fmt.Sprintf("Invalid value of %s: %s", name, str))
+	}
+	return i, nil
+}
+
+// parseListPage parses the name (prefix of names), offset and limit
+// query parameters of lists.
+func parseListPage(ctx common.RestContext) (ListPage, error) {
+	var err error
+	page := ListPage{NamePrefix: ctx.QueryVariables.Get("name")}
+	if page.Offset, err = parseCount(ctx, "offset"); err != nil {
+		return page, err
+	}
+	if page.Limit, err = parseCount(ctx, "limit"); err != nil {
+		return page, err
+	}
+	if page.Offset > 0 && page.Limit == 0 {
+		return page, common.NewError400("offset requires limit")
+	}
+	return page, nil
+}
+
 func (tsvc *TenantSvc) listTenants(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("In listTenants()")
-	tenants, err := tsvc.store.listTenants()
+	page, err := parseListPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := tsvc.store.ListTenantsPage(ctx.Context, page)
 	if err != nil {
 		return nil, err
 	}
@@ -107,20 +263,85 @@ func (tsvc *TenantSvc) listTenants(input interface{}, ctx common.RestContext) (i
 func (tsvc *TenantSvc) listSegments(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("In listSegments()")
 	idStr := ctx.PathVariables["tenantId"]
-	segments, err := tsvc.store.listSegments(idStr)
+	page, err := parseListPage(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(segments) == 0 {
+	segments, err := tsvc.store.ListSegmentsPage(ctx.Context, idStr, page)
+	if err != nil {
+		return nil, err
+	}
+	// An empty page is not an error, a tenant without segments is.
+	if len(segments) == 0 && page == (ListPage{}) {
 		return nil, common.NewError404("segment", "ALL")
 	}
 	return segments, nil
 }
 
+// getTenant finds a tenant by its ID. With deleted=true, tenants
+// deleted but not yet purged are found too.
 func (tsvc *TenantSvc) getTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
 	idStr := ctx.PathVariables["tenantId"]
 	log.Printf("In findTenant(%s)\n", idStr)
-	return tsvc.store.getTenant(idStr)
+	ten, err := tsvc.store.GetTenant(ctx.Context, idStr)
+	if isNotFound(err) && ctx.QueryVariables.Get("deleted") == "true" {
+		return tsvc.store.GetDeletedTenant(ctx.Context, idStr)
+	}
+	return ten, err
+}
+
+// updateTenant changes the name of a tenant at the version the
+// client gives; its external ID and network ID stay.
+func (tsvc *TenantSvc) updateTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
+	ten, err := tsvc.store.GetTenant(ctx.Context, ctx.PathVariables["tenantId"])
+	if err != nil {
+		return nil, err
+	}
+	update := input.(*Tenant)
+	if update.Name == "" {
+		return nil, common.NewError400("Tenant must have a name")
+	}
+	err = common.CheckVersion(ctx, "tenant", ten.Version, update.Version)
+	if err != nil {
+		return nil, err
+	}
+	ten.Name = update.Name
+	err = tsvc.store.UpdateTenant(ctx.Context, &ten)
+	if err != nil {
+		return nil, err
+	}
+	return ten, nil
+}
+
+// getTenantByExternalID finds a tenant by its external ID, such
+// as the UUID of a Keystone project or of a Kubernetes namespace.
+func (tsvc *TenantSvc) getTenantByExternalID(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return tsvc.store.FindTenantByExternalID(ctx.Context, ctx.PathVariables["externalId"])
+}
+
+// getSegmentByExternalID finds a segment by its external ID.
+func (tsvc *TenantSvc) getSegmentByExternalID(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return tsvc.store.FindSegmentByExternalID(ctx.Context, ctx.PathVariables["externalId"])
+}
+
+// deleteTenant deletes a tenant with its segments. With cascade=true,
+// it starts a job that first releases the tenant's endpoints and
+// deletes its policies (see cascade.go), and returns the job.
+func (tsvc *TenantSvc) deleteTenant(input interface{}, ctx common.RestContext) (interface{}, error) {
+	idStr := ctx.PathVariables["tenantId"]
+	log.Printf("In deleteTenant(%s)\n", idStr)
+	ten, err := tsvc.store.GetTenant(ctx.Context, idStr)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.QueryVariables.Get("cascade") == "true" {
+		return tsvc.startDeletion(ten), nil
+	}
+	err = tsvc.store.DeleteTenant(ctx.Context, ten.ID)
+	if err != nil {
+		return nil, err
+	}
+	return ten, nil
 }
 
 func (tsvc *TenantSvc) addSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
@@ -131,7 +352,15 @@ func (tsvc *TenantSvc) addSegment(input interface{}, ctx common.RestContext) (in
 		return nil, err
 	}
 	newSegment := input.(*Segment)
-	err = tsvc.store.addSegment(tenantId, newSegment)
+	segments, err := tsvc.store.ListSegments(ctx.Context, tenantIdStr)
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.checkQuota(ctx.Context, tenantId, QuotaSegments, len(segments))
+	if err != nil {
+		return nil, err
+	}
+	err = tsvc.store.AddSegment(ctx.Context, tenantId, newSegment)
 	return newSegment, err
 }
 
@@ -139,12 +368,146 @@ func (tenant *TenantSvc) Name() string {
 	return "tenant"
 }
 
+// CheckHealth implements common.HealthChecker by checking the database.
+func (tenant *TenantSvc) CheckHealth() error {
+	return tenant.store.Ping()
+}
+
+// Snapshot implements common.Snapshotter by taking a
+// snapshot of the database, for backups.
+func (tenant *TenantSvc) Snapshot(ctx context.Context) (common.StoreSnapshot, error) {
+	return common.SnapshotStore(ctx, tenant.store)
+}
+
+// Restore implements common.Snapshotter by restoring
+// the snapshot into the database.
+func (tenant *TenantSvc) Restore(ctx context.Context, snapshot common.StoreSnapshot) error {
+	return common.RestoreStore(ctx, tenant.store, snapshot)
+}
+
+// MaintenanceJobs implements common.Maintainer, purging tenants
+// and segments deleted longer than the grace period ago.
+func (tenant *TenantSvc) MaintenanceJobs() map[string]common.MaintenanceJob {
+	return common.StoreMaintenanceJobs(tenant.store)
+}
+
+// getSegment finds a segment of a tenant by its ID. With deleted=true,
+// segments deleted but not yet purged are found too.
 func (tsvc *TenantSvc) getSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("In findSegment()")
 	tenantIdStr := ctx.PathVariables["tenantId"]
 	segmentIdStr := ctx.PathVariables["segmentId"]
 
-	return tsvc.store.getSegment(tenantIdStr, segmentIdStr)
+	seg, err := tsvc.store.GetSegment(ctx.Context, tenantIdStr, segmentIdStr)
+	if isNotFound(err) && ctx.QueryVariables.Get("deleted") == "true" {
+		return tsvc.store.GetDeletedSegment(ctx.Context, tenantIdStr, segmentIdStr)
+	}
+	return seg, err
+}
+
+// updateSegment changes the name and external ID of a segment at the
+// version the client gives; its network ID, from which addresses are
+// derived, stays.
+func (tsvc *TenantSvc) updateSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
+	tenantIdStr := ctx.PathVariables["tenantId"]
+	segmentIdStr := ctx.PathVariables["segmentId"]
+	seg, err := tsvc.store.GetSegment(ctx.Context, tenantIdStr, segmentIdStr)
+	if err != nil {
+		return nil, err
+	}
+	update := input.(*Segment)
+	if update.Name == "" && update.ExternalID == "" {
+		return nil, common.NewError400("Segment must have a name or an external ID")
+	}
+	err = common.CheckVersion(ctx, "segment", seg.Version, update.Version)
+	if err != nil {
+		return nil, err
+	}
+	seg.Name = update.Name
+	seg.ExternalID = update.ExternalID
+	err = tsvc.store.UpdateSegment(ctx.Context, &seg)
+	if err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// deleteSegment deletes a segment that has no endpoints
+// and is not referred to by policies.
+func (tsvc *TenantSvc) deleteSegment(input interface{}, ctx common.RestContext) (interface{}, error) {
+	tenantIdStr := ctx.PathVariables["tenantId"]
+	segmentIdStr := ctx.PathVariables["segmentId"]
+	ten, err := tsvc.store.GetTenant(ctx.Context, tenantIdStr)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := tsvc.store.GetSegment(ctx.Context, tenantIdStr, segmentIdStr)
+	if err != nil {
+		return nil, err
+	}
+	n, err := tsvc.segmentEndpoints(ctx.Context, ten, seg)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Segment %s still has %d endpoint(s)", seg.Name, n))
+	}
+	ids, err := tsvc.referringPolicies(ctx.Context, ten, seg)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Segment %s is referred to by policies %v", seg.Name, ids))
+	}
+	err = tsvc.store.DeleteSegment(ctx.Context, seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// ipamSegmentEndpoints returns the number of endpoints
+// of the segment in ipam.
+func (tsvc *TenantSvc) ipamSegmentEndpoints(ctx context.Context, ten Tenant, seg Segment) (int, error) {
+	endpoints, err := tsvc.listIpamEndpoints(ctx, ten.ID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, endpoint := range endpoints {
+		if endpoint.SegmentID == strconv.FormatUint(seg.ID, 10) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// segmentPolicies returns IDs of policies applied to
+// the segment or allowing traffic from it.
+func (tsvc *TenantSvc) segmentPolicies(ctx context.Context, ten Tenant, seg Segment) ([]uint64, error) {
+	policies, err := tsvc.listPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, policy := range policies {
+		endpoints := append(append([]common.Endpoint{}, policy.AppliedTo...), policy.Peers...)
+		for _, endpoint := range endpoints {
+			if seg.matches(ten, endpoint) {
+				ids = append(ids, policy.ID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// matches returns true if the policy endpoint refers to the segment
+// of the tenant; network IDs of segments are unique within tenants.
+func (seg Segment) matches(ten Tenant, endpoint common.Endpoint) bool {
+	return endpoint.SegmentID == seg.ID ||
+		(seg.ExternalID != "" && endpoint.SegmentExternalID == seg.ExternalID) ||
+		(endpoint.SegmentNetworkID != nil && *endpoint.SegmentNetworkID == seg.NetworkID && ten.matches(endpoint))
 }
 
 // SetConfig implements SetConfig function of the Service interface.
@@ -152,15 +515,48 @@ func (tsvc *TenantSvc) getSegment(input interface{}, ctx common.RestContext) (in
 func (tsvc *TenantSvc) SetConfig(config common.ServiceConfig) error {
 	tsvc.config = config
 	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
-	tsvc.store = tenantStore{}
-	// TODO
-	// From review:
-	// What's going on here? Why does ServicStore need a reference to the structure that contains it?
-	// Need a good way to document this (pattern or anti-pattern?)
-	tsvc.store.ServiceStore = &tsvc.store
+	if tsvc.store == nil {
+		store := &tenantStore{}
+		// TODO
+		// From review:
+		// What's going on here? Why does ServicStore need a reference to the structure that contains it?
+		// Need a good way to document this (pattern or anti-pattern?)
+		store.ServiceStore = store
+		tsvc.store = store
+	}
+
+	keystoneConfig, err := parseKeystoneConfig(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	tsvc.keystone = nil
+	if keystoneConfig != nil {
+		tsvc.keystone = &keystoneSync{
+			config: *keystoneConfig,
+			store:  tsvc.store,
+			client: &http.Client{Timeout: time.Duration(common.DefaultRestTimeout) * time.Millisecond},
+		}
+	}
 	return tsvc.store.SetConfig(storeConfig)
 }
 
+// SetStore makes the tenant service keep tenants in the store,
+// such as one of package tenanttest, rather than in the database
+// configured. It must be called before SetConfig.
+func (tsvc *TenantSvc) SetStore(store Store) {
+	tsvc.store = store
+}
+
+// storeFinder finds tenants and segments in the store of the
+// service, which is only set up after routes are created.
+type storeFinder struct {
+	tsvc *TenantSvc
+}
+
+func (f storeFinder) Find(ctx context.Context, query url.Values, entities interface{}, flag common.FindFlag) (interface{}, error) {
+	return f.tsvc.store.Find(ctx, query, entities, flag)
+}
+
 func (tsvc *TenantSvc) createSchema(overwrite bool) error {
 	return tsvc.store.CreateSchema(overwrite)
 }
@@ -174,6 +570,13 @@ func Run(rootServiceUrl string, cred *common.Credential) (*common.RestServiceInf
 	if err != nil {
 		return nil, err
 	}
+	tsvc.client = client
+	tsvc.tenantEndpoints = tsvc.ipamEndpoints
+	tsvc.releaseEndpoint = tsvc.ipamRelease
+	tsvc.tenantPolicies = tsvc.appliedPolicies
+	tsvc.detachPolicy = tsvc.removePolicy
+	tsvc.segmentEndpoints = tsvc.ipamSegmentEndpoints
+	tsvc.referringPolicies = tsvc.segmentPolicies
 	config, err := client.GetServiceConfig(tsvc.Name())
 	if err != nil {
 		return nil, err
@@ -212,6 +615,9 @@ func (tsvc *TenantSvc) Initialize() error {
 	}
 	// TODO should this always be queried?
 	tsvc.dc = dc
+	if tsvc.keystone != nil && tsvc.keystone.config.interval > 0 {
+		go tsvc.keystone.run()
+	}
 	return nil
 }
 
@@ -16,9 +16,18 @@
 package tenant
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/go-check/check"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/commontest"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -49,7 +58,7 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Should be OK
 	t = Tenant{Name: "name1"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.IsNil)
 
 	tenID1 := t.ID
@@ -57,13 +66,13 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Error: duplicate name
 	t = Tenant{Name: "name1"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK: external ID disambiguates.
 	t = Tenant{Name: "name1", ExternalID: "extid1"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.IsNil)
 
 	tenID2 := t.ID
@@ -71,68 +80,699 @@ func (s *MySuite) TestStore(c *check.C) {
 
 	// Error: duplicate
 	t = Tenant{Name: "name1", ExternalID: "extid1"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	t = Tenant{Name: "xxx", ExternalID: "extid1"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.IsNil)
 
 	// OK
 	t = Tenant{ExternalID: "extid2"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created tenant %+v", t)
 
 	// Duplicate
 	t = Tenant{ExternalID: "extid2"}
-	err = store.addTenant(&t)
+	err = store.AddTenant(context.Background(), &t)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
 	// Duplicate
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK
 	seg = Segment{Name: "seg1", ExternalID: "segextid1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
 	// Duplicate
 	seg = Segment{Name: "seg1", ExternalID: "segextid1"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
 	// OK - different tenant
 	seg = Segment{Name: "seg1"}
-	err = store.addSegment(tenID2, &seg)
+	err = store.AddSegment(context.Background(), tenID2, &seg)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
 	// OK
 	seg = Segment{ExternalID: "segextid2"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.IsNil)
 	log.Printf("Created segment %+v", seg)
 
 	// Duplicate
 	seg = Segment{ExternalID: "segextid2"}
-	err = store.addSegment(tenID1, &seg)
+	err = store.AddSegment(context.Background(), tenID1, &seg)
 	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
 	log.Printf("Expected error %T %+v", err, err)
 
+	// Cancelled context: nothing should be done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t = Tenant{Name: "name5", ExternalID: "extid5"}
+	err = store.AddTenant(ctx, &t)
+	c.Assert(err, check.NotNil, check.Commentf("Expected error"))
+	c.Assert(t.ID, check.Equals, uint64(0))
+
+	// Lookups by external ID
+	t, err = store.FindTenantByExternalID(context.Background(), "extid2")
+	c.Assert(err, check.IsNil)
+	c.Assert(t.ExternalID, check.Equals, "extid2")
+	_, err = store.FindTenantByExternalID(context.Background(), "extid1")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = store.FindTenantByExternalID(context.Background(), "extid9")
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+	seg, err = store.FindSegmentByExternalID(context.Background(), "segextid1")
+	c.Assert(err, check.IsNil)
+	c.Assert(seg.TenantID, check.Equals, tenID1)
+
 	c.Assert("", check.Equals, "")
 }
+
+// TestKeystoneSync tests synchronization of tenants with
+// Keystone projects served by a fake Keystone.
+func (s *MySuite) TestKeystoneSync(c *check.C) {
+	projects := []keystoneProject{
+		{ID: "p1", Name: "project1", Enabled: true},
+		{ID: "p2", Name: "project2", Enabled: true},
+	}
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/auth/tokens":
+			w.Header().Set("X-Subject-Token", "token1")
+			w.WriteHeader(http.StatusCreated)
+		case "/v3/projects":
+			if r.Header.Get("X-Auth-Token") != "token1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"projects": projects})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer keystone.Close()
+
+	store := tenantStore{}
+	store.ServiceStore = &store
+	err := store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantKeystone.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	// Tenants from elsewhere are left alone.
+	err = store.AddTenant(ctx, &Tenant{Name: "other", ExternalID: "other1"})
+	c.Assert(err, check.IsNil)
+
+	config, err := parseKeystoneConfig(map[string]interface{}{
+		"keystone": map[string]interface{}{
+			"url":      keystone.URL + "/v3",
+			"username": "admin",
+			"password": "secret",
+			"project":  "admin",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.interval, check.Equals, defaultKeystoneSyncInterval)
+	k := &keystoneSync{config: *config, store: &store, client: http.DefaultClient}
+
+	result, err := k.sync(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Added, check.DeepEquals, []string{"p1", "p2"})
+	tenants, err := store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 3)
+	c.Assert(tenants[1].Source, check.Equals, keystoneSource)
+
+	// Renames and deletions follow Keystone.
+	projects = []keystoneProject{{ID: "p2", Name: "project2a", Enabled: true}}
+	result, err = k.sync(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Added, check.DeepEquals, []string{})
+	c.Assert(result.Renamed, check.DeepEquals, []string{"p2"})
+	c.Assert(result.Deleted, check.DeepEquals, []string{"p1"})
+	tenants, err = store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 2)
+	c.Assert(tenants[0].Name, check.Equals, "other")
+	c.Assert(tenants[1].Name, check.Equals, "project2a")
+
+	// Network IDs are not reused after deletion.
+	t := Tenant{Name: "new"}
+	err = store.AddTenant(ctx, &t)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.NetworkID, check.Equals, uint64(3))
+
+	_, err = parseKeystoneConfig(map[string]interface{}{"keystone": map[string]interface{}{"url": keystone.URL}})
+	c.Assert(err, check.NotNil)
+}
+
+// TestCascadeDelete tests cascading deletion of a tenant.
+func (s *MySuite) TestCascadeDelete(c *check.C) {
+	store := &tenantStore{}
+	store.ServiceStore = store
+	tsvc := &TenantSvc{store: store}
+	err := tsvc.store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantCascade.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	ten := Tenant{Name: "t1"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.AddSegment(ctx, ten.ID, &Segment{Name: "s1"})
+	c.Assert(err, check.IsNil)
+
+	var released []string
+	var deleted []uint64
+	tsvc.tenantEndpoints = func(ctx context.Context, t Tenant) ([]string, error) {
+		c.Assert(t.ID, check.Equals, ten.ID)
+		return []string{"10.0.0.3", "10.0.0.4"}, nil
+	}
+	tsvc.releaseEndpoint = func(ctx context.Context, ip string) error {
+		released = append(released, ip)
+		return nil
+	}
+	tsvc.tenantPolicies = func(ctx context.Context, t Tenant) ([]common.Policy, error) {
+		return []common.Policy{{ID: 7}}, nil
+	}
+	tsvc.detachPolicy = func(ctx context.Context, t Tenant, policy common.Policy) error {
+		deleted = append(deleted, policy.ID)
+		return nil
+	}
+
+	restCtx := common.RestContext{
+		Context:        ctx,
+		PathVariables:  map[string]string{"tenantId": fmt.Sprintf("%d", ten.ID)},
+		QueryVariables: url.Values{"cascade": []string{"true"}},
+	}
+	result, err := tsvc.deleteTenant(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	job := result.(DeletionJob)
+	c.Assert(job.TenantID, check.Equals, ten.ID)
+
+	jobCtx := common.RestContext{Context: ctx, PathVariables: map[string]string{"jobId": fmt.Sprintf("%d", job.ID)}}
+	for i := 0; i < 100 && job.State == JobRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result, err = tsvc.getJob(nil, jobCtx)
+		c.Assert(err, check.IsNil)
+		job = result.(DeletionJob)
+	}
+	c.Assert(job.State, check.Equals, JobDone)
+	c.Assert(job.EndpointsReleased, check.Equals, 2)
+	c.Assert(job.PoliciesDeleted, check.Equals, 1)
+	c.Assert(released, check.DeepEquals, []string{"10.0.0.3", "10.0.0.4"})
+	c.Assert(deleted, check.DeepEquals, []uint64{7})
+	tenants, err := tsvc.store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 0)
+
+	// A failed step stops the job, leaving the tenant in place.
+	ten = Tenant{Name: "t2"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	tsvc.releaseEndpoint = func(ctx context.Context, ip string) error {
+		return common.NewError("ipam is down")
+	}
+	restCtx.PathVariables["tenantId"] = fmt.Sprintf("%d", ten.ID)
+	result, err = tsvc.deleteTenant(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	job = result.(DeletionJob)
+	jobCtx.PathVariables["jobId"] = fmt.Sprintf("%d", job.ID)
+	for i := 0; i < 100 && job.State == JobRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result, err = tsvc.getJob(nil, jobCtx)
+		c.Assert(err, check.IsNil)
+		job = result.(DeletionJob)
+	}
+	c.Assert(job.State, check.Equals, JobFailed)
+	c.Assert(job.Step, check.Equals, "releasing endpoints")
+	tenants, err = tsvc.store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 1)
+
+	// A cancelled job stops, keeping what it did so far
+	// and leaving the tenant in place.
+	ten = Tenant{Name: "t3"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	released = nil
+	releasing := make(chan struct{})
+	tsvc.tenantEndpoints = func(ctx context.Context, t Tenant) ([]string, error) {
+		return []string{"10.0.0.5", "10.0.0.6", "10.0.0.7"}, nil
+	}
+	tsvc.releaseEndpoint = func(ctx context.Context, ip string) error {
+		if ip == "10.0.0.6" {
+			close(releasing)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		released = append(released, ip)
+		return nil
+	}
+	restCtx.PathVariables["tenantId"] = fmt.Sprintf("%d", ten.ID)
+	result, err = tsvc.deleteTenant(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	job = result.(DeletionJob)
+	jobCtx.PathVariables["jobId"] = fmt.Sprintf("%d", job.ID)
+	<-releasing
+	result, err = tsvc.cancelJob(nil, jobCtx)
+	c.Assert(err, check.IsNil)
+	job = result.(DeletionJob)
+	for i := 0; i < 100 && job.State == JobCancelling; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result, err = tsvc.getJob(nil, jobCtx)
+		c.Assert(err, check.IsNil)
+		job = result.(DeletionJob)
+	}
+	c.Assert(job.State, check.Equals, JobCancelled)
+	c.Assert(job.Step, check.Equals, "releasing endpoints")
+	c.Assert(job.Endpoints, check.Equals, 3)
+	c.Assert(job.EndpointsReleased, check.Equals, 1)
+	c.Assert(released, check.DeepEquals, []string{"10.0.0.5"})
+	tenants, err = tsvc.store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 2)
+
+	// Jobs that are not running cannot be cancelled.
+	_, err = tsvc.cancelJob(nil, jobCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	jobCtx.PathVariables["jobId"] = "100"
+	_, err = tsvc.cancelJob(nil, jobCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	// Jobs are forgotten once they finished jobRetention ago.
+	_, ok := tsvc.jobs.get(job.ID)
+	c.Assert(ok, check.Equals, true)
+	tsvc.jobs.jobs[job.ID].finished = time.Now().Add(-2 * jobRetention)
+	_, ok = tsvc.jobs.get(job.ID)
+	c.Assert(ok, check.Equals, false)
+}
+
+// TestRemovePolicy tests that a cascading deletion deletes policies
+// applied to the tenant only, and updates those applied to other
+// tenants too so that they no longer apply to the tenant.
+func (s *MySuite) TestRemovePolicy(c *check.C) {
+	transport := commontest.NewTransport()
+	client, err := transport.Client()
+	c.Assert(err, check.IsNil)
+	err = transport.RespondServices("policy")
+	c.Assert(err, check.IsNil)
+	transport.Respond("DELETE", "http://policy/policies/7", http.StatusOK, map[string]interface{}{})
+	transport.Respond("PUT", "http://policy/policies/8", http.StatusOK, map[string]interface{}{})
+	tsvc := &TenantSvc{client: client}
+
+	ctx := context.Background()
+	ten := Tenant{ID: 1, NetworkID: 2}
+	other := uint64(3)
+	err = tsvc.removePolicy(ctx, ten, common.Policy{ID: 7, AppliedTo: []common.Endpoint{{TenantID: 1}}})
+	c.Assert(err, check.IsNil)
+	shared := common.Policy{ID: 8, Revision: 4, AppliedTo: []common.Endpoint{{TenantID: 1}, {TenantNetworkID: &other}}}
+	err = tsvc.removePolicy(ctx, ten, shared)
+	c.Assert(err, check.IsNil)
+
+	var changes []commontest.Request
+	for _, request := range transport.Requests() {
+		if request.Method != "GET" {
+			changes = append(changes, request)
+		}
+	}
+	c.Assert(len(changes), check.Equals, 2)
+	c.Assert(changes[0].Method+" "+changes[0].URL, check.Equals, "DELETE http://policy/policies/7")
+	c.Assert(changes[1].Method+" "+changes[1].URL, check.Equals, "PUT http://policy/policies/8")
+	updated := common.Policy{}
+	err = changes[1].Decode(&updated)
+	c.Assert(err, check.IsNil)
+	c.Assert(updated.Revision, check.Equals, uint64(4))
+	c.Assert(len(updated.AppliedTo), check.Equals, 1)
+	c.Assert(*updated.AppliedTo[0].TenantNetworkID, check.Equals, other)
+}
+
+// TestSegmentUpdateDelete tests renaming tenants and segments,
+// and deleting segments.
+func (s *MySuite) TestSegmentUpdateDelete(c *check.C) {
+	store := &tenantStore{}
+	store.ServiceStore = store
+	tsvc := &TenantSvc{store: store}
+	err := tsvc.store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantSegments.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	ten := Tenant{Name: "t1"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	segs := []Segment{{Name: "s1"}, {Name: "s2"}}
+	for i := range segs {
+		err = tsvc.store.AddSegment(ctx, ten.ID, &segs[i])
+		c.Assert(err, check.IsNil)
+	}
+
+	restCtx := common.RestContext{Context: ctx, PathVariables: map[string]string{
+		"tenantId":  fmt.Sprintf("%d", ten.ID),
+		"segmentId": fmt.Sprintf("%d", segs[0].ID),
+	}}
+	result, err := tsvc.updateSegment(&Segment{Name: "frontend", Version: segs[0].Version}, restCtx)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(Segment).Name, check.Equals, "frontend")
+	c.Assert(result.(Segment).NetworkID, check.Equals, segs[0].NetworkID)
+	c.Assert(result.(Segment).Version, check.Equals, segs[0].Version+1)
+	seg, err := tsvc.store.GetSegment(ctx, restCtx.PathVariables["tenantId"], restCtx.PathVariables["segmentId"])
+	c.Assert(err, check.IsNil)
+	c.Assert(seg.Name, check.Equals, "frontend")
+	c.Assert(seg.Version, check.Equals, segs[0].Version+1)
+	// The update keeps when the segment was created.
+	c.Assert(seg.CreatedAt.Unix(), check.Equals, segs[0].CreatedAt.Unix())
+	c.Assert(seg.UpdatedAt.Before(*segs[0].UpdatedAt), check.Equals, false)
+	c.Assert(result.(Segment).UpdatedAt.Unix(), check.Equals, seg.UpdatedAt.Unix())
+	_, err = tsvc.updateSegment(&Segment{}, restCtx)
+	c.Assert(err, check.NotNil)
+
+	// An update of the version read before the last one conflicts,
+	// one of no version is refused.
+	_, err = tsvc.updateSegment(&Segment{Name: "backend", Version: segs[0].Version}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = tsvc.updateSegment(&Segment{Name: "backend"}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, common.StatusPreconditionRequired)
+	restCtx.IfMatch = fmt.Sprintf("%d", seg.Version)
+	_, err = tsvc.updateSegment(&Segment{Name: "frontend"}, restCtx)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.UpdateSegment(ctx, &seg)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	// Tenants are renamed at the version the client read, too.
+	restCtx.IfMatch = ""
+	_, err = tsvc.updateTenant(&Tenant{Name: "t2"}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, common.StatusPreconditionRequired)
+	result, err = tsvc.updateTenant(&Tenant{Name: "t2", Version: ten.Version}, restCtx)
+	c.Assert(err, check.IsNil)
+	renamed, err := tsvc.store.GetTenant(ctx, fmt.Sprintf("%d", ten.ID))
+	c.Assert(err, check.IsNil)
+	c.Assert(renamed.Name, check.Equals, "t2")
+	c.Assert(renamed.Version, check.Equals, ten.Version+1)
+	c.Assert(result.(Tenant).Version, check.Equals, renamed.Version)
+	_, err = tsvc.updateTenant(&Tenant{Name: "t3", Version: ten.Version}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	err = tsvc.store.UpdateTenant(ctx, &ten)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	// Segments in use cannot be deleted.
+	endpoints := 1
+	var policies []uint64
+	tsvc.segmentEndpoints = func(ctx context.Context, t Tenant, seg Segment) (int, error) {
+		return endpoints, nil
+	}
+	tsvc.referringPolicies = func(ctx context.Context, t Tenant, seg Segment) ([]uint64, error) {
+		return policies, nil
+	}
+	_, err = tsvc.deleteSegment(nil, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	endpoints = 0
+	policies = []uint64{3}
+	_, err = tsvc.deleteSegment(nil, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	policies = nil
+	_, err = tsvc.deleteSegment(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	segments, err := tsvc.store.ListSegments(ctx, restCtx.PathVariables["tenantId"])
+	c.Assert(err, check.IsNil)
+	c.Assert(len(segments), check.Equals, 1)
+
+	// Network IDs of deleted segments are not reused.
+	seg = Segment{Name: "s3"}
+	err = tsvc.store.AddSegment(ctx, ten.ID, &seg)
+	c.Assert(err, check.IsNil)
+	c.Assert(seg.NetworkID, check.Equals, segs[1].NetworkID+1)
+
+	// Policies refer to segments by ID or by network ID within the tenant.
+	netID := segs[1].NetworkID
+	otherTenant := uint64(99)
+	c.Assert(segs[1].matches(ten, common.Endpoint{SegmentID: segs[1].ID}), check.Equals, true)
+	c.Assert(segs[1].matches(ten, common.Endpoint{TenantID: ten.ID, SegmentNetworkID: &netID}), check.Equals, true)
+	c.Assert(segs[1].matches(ten, common.Endpoint{TenantID: otherTenant, SegmentNetworkID: &netID}), check.Equals, false)
+}
+
+func (s *MySuite) TestQuota(c *check.C) {
+	store := &tenantStore{}
+	store.ServiceStore = store
+	tsvc := &TenantSvc{store: store}
+	err := tsvc.store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantQuota.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	ten := Tenant{Name: "t1"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	restCtx := common.RestContext{Context: ctx, PathVariables: map[string]string{
+		"tenantId": fmt.Sprintf("%d", ten.ID),
+	}}
+
+	// No quota means no limits.
+	_, err = tsvc.addSegment(&Segment{Name: "s1"}, restCtx)
+	c.Assert(err, check.IsNil)
+	c.Assert(tsvc.checkQuota(ctx, ten.ID, QuotaEndpoints, 1000), check.IsNil)
+
+	_, err = tsvc.putQuota(&Quota{MaxSegments: -1}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = tsvc.putQuota(&Quota{MaxSegments: 2, MaxEndpoints: 5}, restCtx)
+	c.Assert(err, check.IsNil)
+	// Setting it again replaces it.
+	_, err = tsvc.putQuota(&Quota{MaxSegments: 2, MaxEndpoints: 5, MaxPolicies: 1}, restCtx)
+	c.Assert(err, check.IsNil)
+
+	_, err = tsvc.addSegment(&Segment{Name: "s2"}, restCtx)
+	c.Assert(err, check.IsNil)
+	_, err = tsvc.addSegment(&Segment{Name: "s3"}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	_, err = tsvc.postQuotaCheck(&QuotaCheck{Resource: QuotaEndpoints, Used: 4}, restCtx)
+	c.Assert(err, check.IsNil)
+	_, err = tsvc.postQuotaCheck(&QuotaCheck{Resource: QuotaEndpoints, Used: 5}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = tsvc.postQuotaCheck(&QuotaCheck{Resource: "bogus"}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+
+	tsvc.tenantEndpoints = func(ctx context.Context, t Tenant) ([]string, error) {
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+	tsvc.tenantPolicies = func(ctx context.Context, t Tenant) ([]common.Policy, error) {
+		return []common.Policy{{ID: 7}}, nil
+	}
+	result, err := tsvc.getQuota(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	usage := result.(QuotaUsage)
+	c.Assert(usage.Quota.MaxPolicies, check.Equals, 1)
+	c.Assert(usage.Segments, check.Equals, 2)
+	c.Assert(usage.Endpoints, check.Equals, 2)
+	c.Assert(usage.Policies, check.Equals, 1)
+
+	// Quotas go with their tenants, once these are purged.
+	err = tsvc.store.DeleteTenant(ctx, ten.ID)
+	c.Assert(err, check.IsNil)
+	_, err = tsvc.store.PurgeDeleted(ctx, time.Now().Add(time.Second))
+	c.Assert(err, check.IsNil)
+	quota, err := tsvc.store.GetQuota(ctx, ten.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(quota.ID, check.Equals, uint64(0))
+}
+
+func (s *MySuite) TestListPage(c *check.C) {
+	store := &tenantStore{}
+	store.ServiceStore = store
+	tsvc := &TenantSvc{store: store}
+	err := tsvc.store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantPages.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	for _, name := range []string{"prod-a", "prod-b", "prod_c", "prodd", "test"} {
+		ten := Tenant{Name: name}
+		err = tsvc.store.AddTenant(ctx, &ten)
+		c.Assert(err, check.IsNil)
+	}
+	list := func(query string) ([]Tenant, error) {
+		values, err := url.ParseQuery(query)
+		c.Assert(err, check.IsNil)
+		result, err := tsvc.listTenants(nil, common.RestContext{Context: ctx, QueryVariables: values})
+		if err != nil {
+			return nil, err
+		}
+		return result.([]Tenant), nil
+	}
+	names := func(tenants []Tenant) []string {
+		var retval []string
+		for _, t := range tenants {
+			retval = append(retval, t.Name)
+		}
+		return retval
+	}
+
+	tenants, err := list("")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 5)
+	tenants, err = list("name=prod")
+	c.Assert(err, check.IsNil)
+	c.Assert(names(tenants), check.DeepEquals, []string{"prod-a", "prod-b", "prod_c", "prodd"})
+	// Wildcards in names are matched literally.
+	tenants, err = list("name=prod_")
+	c.Assert(err, check.IsNil)
+	c.Assert(names(tenants), check.DeepEquals, []string{"prod_c"})
+	tenants, err = list("name=prod&limit=2&offset=1")
+	c.Assert(err, check.IsNil)
+	c.Assert(names(tenants), check.DeepEquals, []string{"prod-b", "prod_c"})
+	tenants, err = list("limit=2&offset=10")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 0)
+
+	for _, query := range []string{"limit=x", "limit=-1", "offset=2"} {
+		_, err = list(query)
+		c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest, check.Commentf(query))
+	}
+
+	// Segments are paged the same way.
+	for _, name := range []string{"web", "web2", "db"} {
+		err = tsvc.store.AddSegment(ctx, 1, &Segment{Name: name})
+		c.Assert(err, check.IsNil)
+	}
+	values, _ := url.ParseQuery("name=web&limit=1&offset=1")
+	result, err := tsvc.listSegments(nil, common.RestContext{Context: ctx, QueryVariables: values, PathVariables: map[string]string{"tenantId": "1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(result.([]Segment)), check.Equals, 1)
+	c.Assert(result.([]Segment)[0].Name, check.Equals, "web2")
+	values, _ = url.ParseQuery("name=nothing")
+	result, err = tsvc.listSegments(nil, common.RestContext{Context: ctx, QueryVariables: values, PathVariables: map[string]string{"tenantId": "1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(result.([]Segment)), check.Equals, 0)
+}
+
+// TestDeleteRestore tests restoring deleted tenants and
+// segments, and purging them.
+func (s *MySuite) TestDeleteRestore(c *check.C) {
+	store := &tenantStore{}
+	store.ServiceStore = store
+	tsvc := &TenantSvc{store: store}
+	err := tsvc.store.SetConfig(map[string]interface{}{"type": "sqlite3", "database": "/var/tmp/tenantRestore.sqlite3"})
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = tsvc.store.Connect()
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	ten := Tenant{Name: "t1", ExternalID: "e1"}
+	err = tsvc.store.AddTenant(ctx, &ten)
+	c.Assert(err, check.IsNil)
+	segs := []Segment{{Name: "s1"}, {Name: "s2"}, {Name: "s3"}}
+	for i := range segs {
+		err = tsvc.store.AddSegment(ctx, ten.ID, &segs[i])
+		c.Assert(err, check.IsNil)
+	}
+	err = tsvc.store.SetQuota(ctx, &Quota{TenantID: ten.ID, MaxSegments: 5})
+	c.Assert(err, check.IsNil)
+	tenantID := fmt.Sprintf("%d", ten.ID)
+	restCtx := func(segmentID uint64, query url.Values) common.RestContext {
+		return common.RestContext{Context: ctx, QueryVariables: query, PathVariables: map[string]string{
+			"tenantId":  tenantID,
+			"segmentId": fmt.Sprintf("%d", segmentID),
+		}}
+	}
+
+	// A segment deleted before its tenant is not restored with it.
+	err = tsvc.store.DeleteSegment(ctx, segs[2].ID)
+	c.Assert(err, check.IsNil)
+	time.Sleep(time.Second)
+	_, err = tsvc.deleteTenant(nil, restCtx(0, url.Values{}))
+	c.Assert(err, check.IsNil)
+	_, err = tsvc.getTenant(nil, restCtx(0, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+	tenants, err := tsvc.store.ListTenants(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(tenants), check.Equals, 0)
+
+	// References are resolved until deleted entities are purged.
+	result, err := tsvc.getTenant(nil, restCtx(0, url.Values{"deleted": {"true"}}))
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(Tenant).NetworkID, check.Equals, ten.NetworkID)
+	c.Assert(result.(Tenant).DeletedAt, check.NotNil)
+	result, err = tsvc.getSegment(nil, restCtx(segs[1].ID, url.Values{"deleted": {"true"}}))
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(Segment).NetworkID, check.Equals, segs[1].NetworkID)
+
+	// Network IDs of deleted tenants are not reused while they can be restored.
+	other := Tenant{Name: "t2"}
+	err = tsvc.store.AddTenant(ctx, &other)
+	c.Assert(err, check.IsNil)
+	c.Assert(other.NetworkID, check.Equals, ten.NetworkID+1)
+
+	_, err = tsvc.restoreSegment(nil, restCtx(segs[0].ID, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	result, err = tsvc.restoreTenant(nil, restCtx(0, url.Values{}))
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(Tenant).Name, check.Equals, "t1")
+	c.Assert(result.(Tenant).DeletedAt, check.IsNil)
+	_, err = tsvc.restoreTenant(nil, restCtx(0, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	segments, err := tsvc.store.ListSegments(ctx, tenantID)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(segments), check.Equals, 2)
+	quota, err := tsvc.store.GetQuota(ctx, ten.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(quota.MaxSegments, check.Equals, 5)
+
+	result, err = tsvc.restoreSegment(nil, restCtx(segs[2].ID, url.Values{}))
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(Segment).NetworkID, check.Equals, segs[2].NetworkID)
+	_, err = tsvc.restoreSegment(nil, restCtx(segs[2].ID, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	// Adding a segment like a deleted one replaces it.
+	err = tsvc.store.DeleteSegment(ctx, segs[2].ID)
+	c.Assert(err, check.IsNil)
+	replacement := Segment{Name: "s3"}
+	err = tsvc.store.AddSegment(ctx, ten.ID, &replacement)
+	c.Assert(err, check.IsNil)
+	_, err = tsvc.restoreSegment(nil, restCtx(segs[2].ID, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+
+	// Purging removes deleted tenants with their segments and quotas.
+	err = tsvc.store.DeleteTenant(ctx, ten.ID)
+	c.Assert(err, check.IsNil)
+	purged, err := tsvc.store.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(purged, check.Equals, int64(0))
+	purged, err = tsvc.store.PurgeDeleted(ctx, time.Now().Add(time.Second))
+	c.Assert(err, check.IsNil)
+	c.Assert(purged, check.Equals, int64(4))
+	_, err = tsvc.restoreTenant(nil, restCtx(0, url.Values{}))
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusNotFound)
+	quota, err = tsvc.store.GetQuota(ctx, ten.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(quota.MaxSegments, check.Equals, 0)
+}
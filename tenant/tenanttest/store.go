@@ -0,0 +1,570 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package tenanttest provides an in-memory tenant.Store, so that the
+// tenant service can be tested without a database
+// (see tenant.TenantSvc.SetStore).
+package tenanttest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/tenant"
+)
+
+// Store keeps tenants, segments and quotas in memory, allocating
+// network IDs and keeping deleted tenants and segments the way
+// the database-backed store does.
+type Store struct {
+	mu       sync.Mutex
+	nextID   uint64
+	tenants  []tenant.Tenant
+	segments []tenant.Segment
+	quotas   map[uint64]tenant.Quota
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{quotas: make(map[uint64]tenant.Quota)}
+}
+
+// SetConfig implements tenant.Store; the configuration is ignored.
+func (s *Store) SetConfig(config map[string]interface{}) error {
+	return nil
+}
+
+// Connect implements tenant.Store.
+func (s *Store) Connect() error {
+	return nil
+}
+
+// CreateSchema implements tenant.Store, emptying the store if force is set.
+func (s *Store) CreateSchema(force bool) error {
+	if force {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.tenants = nil
+		s.segments = nil
+		s.quotas = make(map[uint64]tenant.Quota)
+	}
+	return nil
+}
+
+// Ping implements tenant.Store.
+func (s *Store) Ping() error {
+	return nil
+}
+
+// Find implements tenant.Store for tenants and segments.
+func (s *Store) Find(ctx context.Context, query url.Values, entities interface{}, flag common.FindFlag) (interface{}, error) {
+	switch entities.(type) {
+	case *[]tenant.Tenant:
+		tenants, err := s.ListTenants(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return common.FindIn(ctx, query, tenants, flag)
+	case *[]tenant.Segment:
+		if err := common.CheckContext(ctx); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		segments := []tenant.Segment{}
+		for _, seg := range s.segments {
+			if seg.DeletedAt == nil {
+				segments = append(segments, seg)
+			}
+		}
+		s.mu.Unlock()
+		return common.FindIn(ctx, query, segments, flag)
+	}
+	return nil, common.NewError500(fmt.Sprintf("Cannot find %T", entities))
+}
+
+// pageBounds returns the bounds of the page of n entities.
+// As in the database, the offset only applies with a limit.
+func pageBounds(n int, page tenant.ListPage) (int, int) {
+	if page.Limit <= 0 {
+		return 0, n
+	}
+	start := page.Offset
+	if start > n {
+		start = n
+	}
+	end := start + page.Limit
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// ListTenants implements tenant.Store.
+func (s *Store) ListTenants(ctx context.Context) ([]tenant.Tenant, error) {
+	return s.ListTenantsPage(ctx, tenant.ListPage{})
+}
+
+// ListTenantsPage implements tenant.Store.
+func (s *Store) ListTenantsPage(ctx context.Context, page tenant.ListPage) ([]tenant.Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenants := []tenant.Tenant{}
+	for _, t := range s.tenants {
+		if t.DeletedAt == nil && strings.HasPrefix(t.Name, page.NamePrefix) {
+			tenants = append(tenants, t)
+		}
+	}
+	start, end := pageBounds(len(tenants), page)
+	return tenants[start:end], nil
+}
+
+// AddTenant implements tenant.Store. Network IDs of deleted
+// tenants are not reused while the last one is there, nor
+// while deleted ones can be restored.
+func (s *Store) AddTenant(ctx context.Context, t *tenant.Tenant) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeTenants(func(deleted tenant.Tenant) bool {
+		return deleted.Name == t.Name && deleted.ExternalID == t.ExternalID
+	})
+	t.NetworkID = 0
+	for _, existing := range s.tenants {
+		if existing.NetworkID >= t.NetworkID {
+			t.NetworkID = existing.NetworkID + 1
+		}
+	}
+	s.nextID++
+	t.ID = s.nextID
+	t.Version = 1
+	now := time.Now()
+	t.CreatedAt = &now
+	t.UpdatedAt = &now
+	stored := *t
+	stored.Segments = nil
+	s.tenants = append(s.tenants, stored)
+	return nil
+}
+
+// UpdateTenant implements tenant.Store, saving the name
+// of the tenant if it is still at tenant.Version.
+func (s *Store) UpdateTenant(ctx context.Context, t *tenant.Tenant) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for ; i < len(s.tenants); i++ {
+		if s.tenants[i].ID == t.ID && s.tenants[i].DeletedAt == nil {
+			break
+		}
+	}
+	if i == len(s.tenants) || s.tenants[i].Version != t.Version {
+		return common.NewErrorConflict(fmt.Sprintf("Tenant %d changed concurrently, reload it and retry", t.ID))
+	}
+	s.purgeTenants(func(deleted tenant.Tenant) bool {
+		return deleted.Name == t.Name && deleted.ExternalID == t.ExternalID
+	})
+	now := time.Now()
+	for i := range s.tenants {
+		if s.tenants[i].ID == t.ID && s.tenants[i].DeletedAt == nil {
+			s.tenants[i].Name = t.Name
+			s.tenants[i].Version++
+			s.tenants[i].UpdatedAt = &now
+		}
+	}
+	t.Version++
+	t.UpdatedAt = &now
+	return nil
+}
+
+// DeleteTenant implements tenant.Store, deleting the tenant with
+// its segments; the quota is kept until the tenant is purged.
+func (s *Store) DeleteTenant(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deletedAt := common.DeletionTime()
+	for i := range s.segments {
+		if s.segments[i].TenantID == id && s.segments[i].DeletedAt == nil {
+			s.segments[i].DeletedAt = &deletedAt
+		}
+	}
+	for i := range s.tenants {
+		if s.tenants[i].ID == id && s.tenants[i].DeletedAt == nil {
+			s.tenants[i].DeletedAt = &deletedAt
+		}
+	}
+	return nil
+}
+
+// purgeTenants removes the deleted tenants matching,
+// with their segments and quotas. The caller holds mu.
+func (s *Store) purgeTenants(matches func(tenant.Tenant) bool) int64 {
+	var purged int64
+	ids := make(map[uint64]bool)
+	tenants := s.tenants[:0]
+	for _, t := range s.tenants {
+		if t.DeletedAt != nil && matches(t) {
+			ids[t.ID] = true
+			purged++
+			continue
+		}
+		tenants = append(tenants, t)
+	}
+	s.tenants = tenants
+	segments := s.segments[:0]
+	for _, seg := range s.segments {
+		if ids[seg.TenantID] {
+			purged++
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	s.segments = segments
+	for id := range ids {
+		delete(s.quotas, id)
+	}
+	return purged
+}
+
+// purgeSegments removes the deleted segments
+// matching. The caller holds mu.
+func (s *Store) purgeSegments(matches func(tenant.Segment) bool) int64 {
+	var purged int64
+	segments := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.DeletedAt != nil && matches(seg) {
+			purged++
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	s.segments = segments
+	return purged
+}
+
+// DeletionGrace implements common.Purger.
+func (s *Store) DeletionGrace() time.Duration {
+	return common.DefaultDeletionGrace
+}
+
+// PurgeDeleted implements common.Purger.
+func (s *Store) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := s.purgeTenants(func(t tenant.Tenant) bool {
+		return t.DeletedAt.Before(before)
+	})
+	purged += s.purgeSegments(func(seg tenant.Segment) bool {
+		return seg.DeletedAt.Before(before)
+	})
+	return purged, nil
+}
+
+// GetDeletedTenant implements tenant.Store.
+func (s *Store) GetDeletedTenant(ctx context.Context, id string) (tenant.Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Tenant{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tenants {
+		if t.DeletedAt != nil && strconv.FormatUint(t.ID, 10) == id {
+			return t, nil
+		}
+	}
+	return tenant.Tenant{}, common.NewError404("deleted tenant", id)
+}
+
+// RestoreTenant implements tenant.Store, restoring the tenant
+// with the segments deleted along with it.
+func (s *Store) RestoreTenant(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.tenants {
+		t := &s.tenants[i]
+		if t.ID != id || t.DeletedAt == nil {
+			continue
+		}
+		for j := range s.segments {
+			seg := &s.segments[j]
+			if seg.TenantID == id && seg.DeletedAt != nil && !seg.DeletedAt.Before(*t.DeletedAt) {
+				seg.DeletedAt = nil
+			}
+		}
+		t.DeletedAt = nil
+		return nil
+	}
+	return common.NewError404("deleted tenant", strconv.FormatUint(id, 10))
+}
+
+// GetDeletedSegment implements tenant.Store.
+func (s *Store) GetDeletedSegment(ctx context.Context, tenantId string, segmentId string) (tenant.Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Segment{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		if seg.DeletedAt != nil && strconv.FormatUint(seg.TenantID, 10) == tenantId && strconv.FormatUint(seg.ID, 10) == segmentId {
+			return seg, nil
+		}
+	}
+	return tenant.Segment{}, common.NewError404("deleted segment/tenant", fmt.Sprintf("%s/%s", tenantId, segmentId))
+}
+
+// RestoreSegment implements tenant.Store.
+func (s *Store) RestoreSegment(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.segments {
+		if s.segments[i].ID == id && s.segments[i].DeletedAt != nil {
+			s.segments[i].DeletedAt = nil
+			return nil
+		}
+	}
+	return common.NewError404("deleted segment", strconv.FormatUint(id, 10))
+}
+
+// GetTenant implements tenant.Store.
+func (s *Store) GetTenant(ctx context.Context, id string) (tenant.Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Tenant{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tenants {
+		if t.DeletedAt == nil && strconv.FormatUint(t.ID, 10) == id {
+			return t, nil
+		}
+	}
+	return tenant.Tenant{}, common.NewError404("tenant", id)
+}
+
+// FindTenantByExternalID implements tenant.Store.
+func (s *Store) FindTenantByExternalID(ctx context.Context, externalID string) (tenant.Tenant, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Tenant{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []tenant.Tenant
+	for _, t := range s.tenants {
+		if t.DeletedAt == nil && t.ExternalID == externalID {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return tenant.Tenant{}, common.NewError404("tenant", externalID)
+	}
+	if len(found) > 1 {
+		return tenant.Tenant{}, common.NewErrorConflict(fmt.Sprintf("%d tenants have external ID %s", len(found), externalID))
+	}
+	return found[0], nil
+}
+
+// ListSegments implements tenant.Store.
+func (s *Store) ListSegments(ctx context.Context, tenantId string) ([]tenant.Segment, error) {
+	return s.ListSegmentsPage(ctx, tenantId, tenant.ListPage{})
+}
+
+// ListSegmentsPage implements tenant.Store; the tenant is
+// identified by its ID or external ID.
+func (s *Store) ListSegmentsPage(ctx context.Context, tenantId string, page tenant.ListPage) ([]tenant.Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[uint64]bool)
+	for _, t := range s.tenants {
+		if t.DeletedAt == nil && (strconv.FormatUint(t.ID, 10) == tenantId || t.ExternalID == tenantId) {
+			ids[t.ID] = true
+		}
+	}
+	segments := []tenant.Segment{}
+	for _, seg := range s.segments {
+		if ids[seg.TenantID] && seg.DeletedAt == nil && strings.HasPrefix(seg.Name, page.NamePrefix) {
+			segments = append(segments, seg)
+		}
+	}
+	start, end := pageBounds(len(segments), page)
+	return segments[start:end], nil
+}
+
+// AddSegment implements tenant.Store.
+func (s *Store) AddSegment(ctx context.Context, tenantId uint64, segment *tenant.Segment) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeSegments(func(deleted tenant.Segment) bool {
+		return deleted.TenantID == tenantId && deleted.Name == segment.Name && deleted.ExternalID == segment.ExternalID
+	})
+	segment.NetworkID = 0
+	for _, seg := range s.segments {
+		if seg.TenantID == tenantId && seg.NetworkID >= segment.NetworkID {
+			segment.NetworkID = seg.NetworkID + 1
+		}
+	}
+	segment.TenantID = tenantId
+	s.nextID++
+	segment.ID = s.nextID
+	segment.Version = 1
+	now := time.Now()
+	segment.CreatedAt = &now
+	segment.UpdatedAt = &now
+	s.segments = append(s.segments, *segment)
+	return nil
+}
+
+// UpdateSegment implements tenant.Store, saving the name and
+// external ID of the segment if it is still at segment.Version.
+func (s *Store) UpdateSegment(ctx context.Context, segment *tenant.Segment) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for ; i < len(s.segments); i++ {
+		if s.segments[i].ID == segment.ID && s.segments[i].DeletedAt == nil {
+			break
+		}
+	}
+	if i == len(s.segments) || s.segments[i].Version != segment.Version {
+		return common.NewErrorConflict(fmt.Sprintf("Segment %d changed concurrently, reload it and retry", segment.ID))
+	}
+	s.segments[i].Name = segment.Name
+	s.segments[i].ExternalID = segment.ExternalID
+	s.segments[i].Version++
+	segment.Version++
+	now := time.Now()
+	s.segments[i].UpdatedAt = &now
+	segment.UpdatedAt = &now
+	s.purgeSegments(func(deleted tenant.Segment) bool {
+		return deleted.TenantID == segment.TenantID && deleted.Name == segment.Name && deleted.ExternalID == segment.ExternalID
+	})
+	return nil
+}
+
+// DeleteSegment implements tenant.Store.
+func (s *Store) DeleteSegment(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deletedAt := common.DeletionTime()
+	for i := range s.segments {
+		if s.segments[i].ID == id && s.segments[i].DeletedAt == nil {
+			s.segments[i].DeletedAt = &deletedAt
+		}
+	}
+	return nil
+}
+
+// GetSegment implements tenant.Store.
+func (s *Store) GetSegment(ctx context.Context, tenantId string, segmentId string) (tenant.Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Segment{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		if seg.DeletedAt == nil && strconv.FormatUint(seg.TenantID, 10) == tenantId && strconv.FormatUint(seg.ID, 10) == segmentId {
+			return seg, nil
+		}
+	}
+	return tenant.Segment{}, common.NewError404("segment/tenant", fmt.Sprintf("%s/%s", tenantId, segmentId))
+}
+
+// FindSegmentByExternalID implements tenant.Store.
+func (s *Store) FindSegmentByExternalID(ctx context.Context, externalID string) (tenant.Segment, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Segment{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []tenant.Segment
+	for _, seg := range s.segments {
+		if seg.DeletedAt == nil && seg.ExternalID == externalID {
+			found = append(found, seg)
+		}
+	}
+	if len(found) == 0 {
+		return tenant.Segment{}, common.NewError404("segment", externalID)
+	}
+	if len(found) > 1 {
+		return tenant.Segment{}, common.NewErrorConflict(fmt.Sprintf("%d segments have external ID %s", len(found), externalID))
+	}
+	return found[0], nil
+}
+
+// GetQuota implements tenant.Store; a quota with
+// no limits is returned if none was set.
+func (s *Store) GetQuota(ctx context.Context, tenantID uint64) (tenant.Quota, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return tenant.Quota{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if quota, ok := s.quotas[tenantID]; ok {
+		return quota, nil
+	}
+	return tenant.Quota{TenantID: tenantID}, nil
+}
+
+// SetQuota implements tenant.Store.
+func (s *Store) SetQuota(ctx context.Context, quota *tenant.Quota) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.quotas[quota.TenantID]; ok {
+		quota.ID = existing.ID
+	} else {
+		s.nextID++
+		quota.ID = s.nextID
+	}
+	s.quotas[quota.TenantID] = *quota
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package tenanttest
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/commontest"
+	"github.com/romana/core/tenant"
+)
+
+var _ tenant.Store = &Store{}
+
+// TestTenants tests the tenant service with tenants kept in the store.
+func TestTenants(t *testing.T) {
+	store := NewStore()
+	svc := &tenant.TenantSvc{}
+	svc.SetStore(store)
+	routes := svc.Routes()
+	config := common.ServiceConfig{ServiceSpecific: map[string]interface{}{
+		"store": map[string]interface{}{"type": "memory"},
+	}}
+	if err := svc.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := common.RestContext{Context: context.Background()}
+	for _, name := range []string{"dev", "prod"} {
+		ten := &tenant.Tenant{Name: name, ExternalID: name + "-ext"}
+		if _, err := commontest.Handler(t, routes, "POST", "/tenants")(ten, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetQuota(nil, &tenant.Quota{TenantID: 2, MaxSegments: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx.PathVariables = map[string]string{"tenantId": "2"}
+	segment, err := commontest.Handler(t, routes, "POST", "/tenants/{tenantId}/segments")(&tenant.Segment{Name: "web"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg := segment.(*tenant.Segment); seg.TenantID != 2 || seg.NetworkID != 0 {
+		t.Errorf("Unexpected segment %+v", seg)
+	}
+	if _, err := commontest.Handler(t, routes, "POST", "/tenants/{tenantId}/segments")(&tenant.Segment{Name: "db"}, ctx); err == nil {
+		t.Error("Expected segment over quota to be refused")
+	}
+
+	ctx.PathVariables = nil
+	ctx.QueryVariables = url.Values{"name": {"prod"}}
+	found, err := commontest.Handler(t, routes, "GET", "/"+common.FindExactlyOne+"/tenants")(nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ten := found.(tenant.Tenant); ten.ID != 2 || ten.NetworkID != 1 {
+		t.Errorf("Expected tenant prod, got %+v", ten)
+	}
+	ctx.QueryVariables = url.Values{"name": {"web"}}
+	found, err = commontest.Handler(t, routes, "GET", "/"+common.FindExactlyOne+"/segments")(nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg := found.(tenant.Segment); seg.TenantID != 2 {
+		t.Errorf("Expected segment web, got %+v", seg)
+	}
+
+	ctx.QueryVariables = url.Values{"limit": {"1"}, "offset": {"1"}}
+	tenants, err := commontest.Handler(t, routes, "GET", "/tenants")(nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := tenants.([]tenant.Tenant); len(l) != 1 || l[0].Name != "prod" {
+		t.Errorf("Expected second page to hold prod, got %+v", l)
+	}
+
+	ctx.QueryVariables = nil
+	ctx.PathVariables = map[string]string{"tenantId": "2"}
+	if _, err := commontest.Handler(t, routes, "DELETE", "/tenants/{tenantId}")(nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := store.ListSegments(nil, "prod-ext"); len(segments) != 0 {
+		t.Errorf("Expected segments of deleted tenant to be deleted, got %+v", segments)
+	}
+	if _, err := store.FindTenantByExternalID(nil, "prod-ext"); err == nil {
+		t.Error("Expected tenant prod to be deleted")
+	}
+
+	// Deleted tenants are restored with their segments and quotas.
+	if _, err := commontest.Handler(t, routes, "POST", "/tenants/{tenantId}/restore")(nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := store.ListSegments(nil, "prod-ext"); len(segments) != 1 {
+		t.Errorf("Expected segments of restored tenant to be restored, got %+v", segments)
+	}
+	if quota, _ := store.GetQuota(nil, 2); quota.MaxSegments == 0 {
+		t.Errorf("Expected quota of restored tenant to be kept, got %+v", quota)
+	}
+
+	// Purged tenants are gone with their quotas.
+	if err := store.DeleteTenant(nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := store.PurgeDeleted(nil, time.Now().Add(time.Second)); err != nil || purged != 2 {
+		t.Errorf("Expected tenant and segment purged, got %d, %v", purged, err)
+	}
+	if quota, _ := store.GetQuota(nil, 2); quota.MaxSegments != 0 {
+		t.Errorf("Expected quota of purged tenant to be deleted, got %+v", quota)
+	}
+	if _, err := commontest.Handler(t, routes, "POST", "/tenants/{tenantId}/restore")(nil, ctx); err == nil {
+		t.Error("Expected purged tenant not to be restored")
+	}
+}
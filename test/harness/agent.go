@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package harness
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/romana/core/agent"
+	"github.com/romana/core/common"
+)
+
+// Agent is a fake agent serving the policy API of the agent. It
+// keeps policies sent to it by the policy service instead of
+// enforcing them, and lists the rules the agent would enforce
+// them with.
+type Agent struct {
+	// Host the agent stands for, as added to topology.
+	Host common.Host
+
+	ip   string
+	port uint64
+
+	mu       sync.Mutex
+	policies map[uint64]common.Policy
+}
+
+// startAgent starts a fake agent listening on the loopback
+// interface, which registers its port with root.
+func startAgent(rootURL string) (*Agent, error) {
+	a := &Agent{policies: make(map[uint64]common.Policy)}
+	config := common.ServiceConfig{
+		Common: common.CommonConfig{
+			Api: &common.Api{Host: "127.0.0.1", RootServiceUrl: rootURL},
+		},
+	}
+	info, err := common.InitializeService(a, config)
+	if err != nil {
+		return nil, err
+	}
+	<-info.Channel
+	ip, port, err := net.SplitHostPort(info.Address)
+	if err != nil {
+		return nil, err
+	}
+	a.ip = ip
+	a.port, err = strconv.ParseUint(port, 10, 64)
+	return a, err
+}
+
+// Name implements Name function of Service interface.
+func (a *Agent) Name() string {
+	return "agent"
+}
+
+// SetConfig implements SetConfig function of Service interface.
+func (a *Agent) SetConfig(config common.ServiceConfig) error {
+	return nil
+}
+
+// Initialize implements Initialize function of Service interface.
+func (a *Agent) Initialize() error {
+	return nil
+}
+
+// Routes implements Routes function of Service interface.
+func (a *Agent) Routes() common.Routes {
+	return common.Routes{
+		common.Route{
+			Method:  "POST",
+			Pattern: "/policies",
+			Handler: a.addPolicy,
+			MakeMessage: func() interface{} {
+				return &common.Policy{}
+			},
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/policies",
+			Handler: a.deletePolicy,
+			MakeMessage: func() interface{} {
+				return &common.Policy{}
+			},
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/policies",
+			Handler: a.listPolicies,
+		},
+	}
+}
+
+// addPolicy keeps the policy, replacing the one with the same ID,
+// unless the agent would reject it.
+func (a *Agent) addPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policy := input.(*common.Policy)
+	if _, err := agent.PolicyRules([]common.Policy{*policy}); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policies[policy.ID] = *policy
+	return policy, nil
+}
+
+// deletePolicy forgets the policy with the ID of the provided one.
+func (a *Agent) deletePolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
+	policy := input.(*common.Policy)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.policies, policy.ID)
+	return policy, nil
+}
+
+func (a *Agent) listPolicies(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return a.Policies(), nil
+}
+
+// Policies returns policies kept by the agent, by ID.
+func (a *Agent) Policies() []common.Policy {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	policies := make([]common.Policy, 0, len(a.policies))
+	for _, policy := range a.policies {
+		policies = append(policies, policy)
+	}
+	sort.Sort(byID(policies))
+	return policies
+}
+
+// Rules returns the rules the agent would enforce
+// its policies with (see agent.PolicyRules).
+func (a *Agent) Rules() ([]string, error) {
+	return agent.PolicyRules(a.Policies())
+}
+
+// byID sorts policies by ID.
+type byID []common.Policy
+
+func (p byID) Len() int           { return len(p) }
+func (p byID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p byID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,355 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package harness boots root, topology, tenant, IPAM and policy
+// services in-process, backed by SQLite databases in a temporary
+// directory, along with fake agents standing for hosts. Scenario
+// tests drive the services through it end to end: allocate endpoints,
+// add policies and check the rules agents would enforce them with.
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/policy"
+	"github.com/romana/core/root"
+	"github.com/romana/core/tenant"
+	"github.com/romana/core/topology"
+)
+
+// configTemplate is the configuration of the mesh, with the
+// directory for databases as the argument. Services listen on
+// ports assigned by the system and register them with root.
+const configTemplate = `services:
+  - service: root
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/root.sqlite3
+  - service: ipam
+    depends_on: [tenant, topology]
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/ipam.sqlite3
+        journal: %[1]s/ipam.journal
+  - service: tenant
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/tenant.sqlite3
+  - service: topology
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/topology.sqlite3
+      datacenter:
+        ip_version: 4
+        cidr: 10.0.0.0/8
+        host_bits: 8
+        tenant_bits: 4
+        segment_bits: 4
+        endpoint_space_bits: 0
+        endpoint_bits: 8
+  - service: policy
+    depends_on: [tenant, topology]
+    api:
+      host: 127.0.0.1
+      port: 0
+    config:
+      store:
+        type: sqlite3
+        database: %[1]s/policy.sqlite3
+  - service: agent
+    api:
+      host: 127.0.0.1
+      port: 0
+`
+
+// Mesh is a set of running services.
+type Mesh struct {
+	// Dir holds the configuration and databases of the services.
+	Dir string
+	// URLs of the services.
+	RootURL     string
+	TopologyURL string
+	TenantURL   string
+	IpamURL     string
+	PolicyURL   string
+
+	mu     sync.Mutex
+	agents []*Agent
+}
+
+// Start writes configuration of the mesh into a new temporary
+// directory, creates schemas of the services and starts them.
+// Services keep running until the process exits; Close only
+// removes the directory.
+func Start() (*Mesh, error) {
+	dir, err := ioutil.TempDir("", "romana-harness")
+	if err != nil {
+		return nil, err
+	}
+	mesh := &Mesh{Dir: dir}
+	if err := mesh.start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return mesh, nil
+}
+
+func (m *Mesh) start() error {
+	configFile := filepath.Join(m.Dir, "romana.yaml")
+	config := fmt.Sprintf(configTemplate, m.Dir)
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		return err
+	}
+	rootInfo, err := root.Run(configFile)
+	if err != nil {
+		return err
+	}
+	<-rootInfo.Channel
+	m.RootURL = "http://" + rootInfo.Address
+
+	schemas := []func(string, bool) error{
+		topology.CreateSchema,
+		tenant.CreateSchema,
+		ipam.CreateSchema,
+		policy.CreateSchema,
+	}
+	for _, createSchema := range schemas {
+		if err := createSchema(m.RootURL, true); err != nil {
+			return err
+		}
+	}
+
+	// Dependencies come first.
+	services := []struct {
+		run func(string, *common.Credential) (*common.RestServiceInfo, error)
+		url *string
+	}{
+		{topology.Run, &m.TopologyURL},
+		{tenant.Run, &m.TenantURL},
+		{ipam.Run, &m.IpamURL},
+		{policy.Run, &m.PolicyURL},
+	}
+	for _, service := range services {
+		info, err := service.run(m.RootURL, nil)
+		if err != nil {
+			return err
+		}
+		<-info.Channel
+		*service.url = "http://" + info.Address
+	}
+	return nil
+}
+
+// Close removes the directory of the mesh.
+func (m *Mesh) Close() error {
+	return os.RemoveAll(m.Dir)
+}
+
+// Client returns a client of the services, which finds
+// them through root.
+func (m *Mesh) Client() (*common.RestClient, error) {
+	return common.NewRestClient(common.GetDefaultRestClientConfig(m.RootURL))
+}
+
+// post posts data to the path of the service at url.
+func (m *Mesh) post(url string, path string, data interface{}, result interface{}) error {
+	client, err := m.Client()
+	if err != nil {
+		return err
+	}
+	return client.Post(url+path, data, result)
+}
+
+// AddHost starts a fake agent and adds a host it stands for to
+// topology. The nth host added gets 10.<n>.0.0/16 as Romana CIDR.
+func (m *Mesh) AddHost(name string) (*Agent, error) {
+	agent, err := startAgent(m.RootURL)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	n := len(m.agents)
+	m.agents = append(m.agents, agent)
+	m.mu.Unlock()
+	host := common.Host{
+		Name:      name,
+		Ip:        agent.ip,
+		RomanaIp:  fmt.Sprintf("10.%d.0.0/16", n),
+		AgentPort: agent.port,
+	}
+	if err := m.post(m.TopologyURL, "/hosts", host, &agent.Host); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// Agents returns fake agents of the hosts added, in that order.
+func (m *Mesh) Agents() []*Agent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agents := make([]*Agent, len(m.agents))
+	copy(agents, m.agents)
+	return agents
+}
+
+// AddTenant adds a tenant with the name, which is also
+// used as its external ID.
+func (m *Mesh) AddTenant(name string) (tenant.Tenant, error) {
+	t := tenant.Tenant{}
+	err := m.post(m.TenantURL, "/tenants", tenant.Tenant{Name: name, ExternalID: name}, &t)
+	return t, err
+}
+
+// AddSegment adds a segment with the name, which is also
+// used as its external ID, to the tenant.
+func (m *Mesh) AddSegment(t tenant.Tenant, name string) (tenant.Segment, error) {
+	s := tenant.Segment{}
+	path := fmt.Sprintf("/tenants/%d/segments", t.ID)
+	err := m.post(m.TenantURL, path, tenant.Segment{Name: name, ExternalID: name, TenantID: t.ID}, &s)
+	return s, err
+}
+
+// Allocate allocates an address to the named endpoint
+// of the segment on the host of the agent.
+func (m *Mesh) Allocate(agent *Agent, s tenant.Segment, name string) (ipam.Endpoint, error) {
+	endpoint := ipam.Endpoint{
+		Name:      name,
+		TenantID:  strconv.FormatUint(s.TenantID, 10),
+		SegmentID: strconv.FormatUint(s.ID, 10),
+		HostId:    strconv.FormatUint(agent.Host.ID, 10),
+	}
+	allocated := ipam.Endpoint{}
+	err := m.post(m.IpamURL, "/endpoints", endpoint, &allocated)
+	return allocated, err
+}
+
+// AllocateAll allocates addresses to the named endpoints
+// of the segment on the host of the agent at once.
+func (m *Mesh) AllocateAll(agent *Agent, s tenant.Segment, names ...string) ([]ipam.Endpoint, error) {
+	bulk := ipam.BulkAllocation{
+		TenantID:  strconv.FormatUint(s.TenantID, 10),
+		SegmentID: strconv.FormatUint(s.ID, 10),
+		HostId:    strconv.FormatUint(agent.Host.ID, 10),
+		Names:     names,
+	}
+	var allocated []ipam.Endpoint
+	err := m.post(m.IpamURL, "/endpoints/bulk", bulk, &allocated)
+	return allocated, err
+}
+
+// Release releases the endpoint with the address.
+func (m *Mesh) Release(ip string) error {
+	client, err := m.Client()
+	if err != nil {
+		return err
+	}
+	released := ipam.Endpoint{}
+	return client.Delete(m.IpamURL+"/endpoints/"+ip, nil, &released)
+}
+
+// AddPolicy adds the policy, which the policy
+// service sends to agents of all hosts.
+func (m *Mesh) AddPolicy(p common.Policy) (common.Policy, error) {
+	added := common.Policy{}
+	err := m.post(m.PolicyURL, "/policies", p, &added)
+	return added, err
+}
+
+// DeletePolicy deletes the policy with the ID,
+// which the policy service removes from agents.
+func (m *Mesh) DeletePolicy(id uint64) error {
+	client, err := m.Client()
+	if err != nil {
+		return err
+	}
+	deleted := common.Policy{}
+	return client.Delete(fmt.Sprintf("%s/policies/%d", m.PolicyURL, id), nil, &deleted)
+}
+
+// serviceURLs returns URLs of BackupServices, in that order.
+func (m *Mesh) serviceURLs() []string {
+	urls := map[string]string{
+		"tenant":   m.TenantURL,
+		"topology": m.TopologyURL,
+		"ipam":     m.IpamURL,
+		"policy":   m.PolicyURL,
+	}
+	retval := make([]string, len(common.BackupServices))
+	for i, service := range common.BackupServices {
+		retval[i] = urls[service]
+	}
+	return retval
+}
+
+// Backup takes a backup of the stores of the
+// services, as romana backup create does.
+func (m *Mesh) Backup() (common.Backup, error) {
+	backup := common.Backup{Version: common.BackupVersion, Created: time.Now().Unix()}
+	client, err := m.Client()
+	if err != nil {
+		return backup, err
+	}
+	for _, url := range m.serviceURLs() {
+		snapshot := common.StoreSnapshot{}
+		if err := client.Get(url+common.SnapshotPath, &snapshot); err != nil {
+			return backup, err
+		}
+		backup.Snapshots = append(backup.Snapshots, snapshot)
+	}
+	return backup, nil
+}
+
+// Restore restores the stores of the services from
+// the backup, as romana backup restore does.
+func (m *Mesh) Restore(backup common.Backup) error {
+	if err := backup.Validate(); err != nil {
+		return err
+	}
+	client, err := m.Client()
+	if err != nil {
+		return err
+	}
+	for i, url := range m.serviceURLs() {
+		rows := make(map[string]int)
+		if err := client.Put(url+common.SnapshotPath, backup.Snapshot(common.BackupServices[i]), &rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package harness
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common"
+)
+
+// TestScenario is allocating an endpoint, adding a policy
+// and checking rules agents of all hosts get for it.
+func TestScenario(t *testing.T) {
+	mesh, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mesh.Close()
+
+	host1, err := mesh.AddHost("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mesh.AddHost("host2"); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := mesh.AddTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend, err := mesh.AddSegment(acme, "frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mesh.AddSegment(acme, "backend"); err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := mesh.Allocate(host1, frontend, "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Ip != "10.0.0.3" {
+		t.Errorf("Expected 10.0.0.3, got %s", endpoint.Ip)
+	}
+	endpoints, err := mesh.AllocateAll(host1, frontend, "web2", "web3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 || endpoints[0].Ip != "10.0.0.4" || endpoints[1].Ip != "10.0.0.5" {
+		t.Errorf("Expected 10.0.0.4 and 10.0.0.5, got %v", endpoints)
+	}
+	// The lowest address released is allocated next.
+	if err := mesh.Release("10.0.0.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mesh.Release("10.0.0.99"); err == nil {
+		t.Error("Expected error releasing unknown 10.0.0.99")
+	}
+	endpoint, err = mesh.Allocate(host1, frontend, "web4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Ip != "10.0.0.4" {
+		t.Errorf("Expected 10.0.0.4 to be reused, got %s", endpoint.Ip)
+	}
+
+	policy, err := mesh.AddPolicy(common.Policy{
+		Name:      "web",
+		Direction: common.PolicyDirectionIngress,
+		AppliedTo: []common.Endpoint{{TenantName: "acme", SegmentName: "frontend"}},
+		Peers:     []common.Endpoint{{TenantName: "acme", SegmentName: "backend"}},
+		Rules:     []common.Rule{{Protocol: "tcp", Ports: []uint{80}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"FORWARD -j ROMANA-INGRESS",
+		"ROMANA-INGRESS -m set --match-set romana-t0s0 dst -j ROMANA-P1",
+		"ROMANA-P1 -m set --match-set romana-t0s1 src -p tcp --dport 80 -j ACCEPT",
+	}
+	for _, agent := range mesh.Agents() {
+		rules, err := agent.Rules()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rules, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("Expected on %s\n%s\ngot\n%s", agent.Host.Name, strings.Join(expect, "\n"), strings.Join(rules, "\n"))
+		}
+	}
+
+	if err := mesh.DeletePolicy(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, agent := range mesh.Agents() {
+		if policies := agent.Policies(); len(policies) != 0 {
+			t.Errorf("Expected no policies on %s, got %v", agent.Host.Name, policies)
+		}
+	}
+}
+
+// TestBackupRestore is restoring services from a backup
+// after endpoints and policies changed.
+func TestBackupRestore(t *testing.T) {
+	mesh, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mesh.Close()
+
+	host1, err := mesh.AddHost("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := mesh.AddTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend, err := mesh.AddSegment(acme, "frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mesh.AllocateAll(host1, frontend, "web1", "web2"); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := mesh.AddPolicy(common.Policy{
+		Name:      "web",
+		Direction: common.PolicyDirectionIngress,
+		AppliedTo: []common.Endpoint{{TenantName: "acme", SegmentName: "frontend"}},
+		Peers:     []common.Endpoint{{Cidr: "192.168.0.0/16"}},
+		Rules:     []common.Rule{{Protocol: "tcp", Ports: []uint{80}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := mesh.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backup.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mesh.Allocate(host1, frontend, "web3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mesh.Release("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mesh.DeletePolicy(policy.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mesh.Restore(backup); err != nil {
+		t.Fatal(err)
+	}
+	// 10.0.0.3 released since is in use again, and
+	// 10.0.0.5 allocated since is free again.
+	endpoint, err := mesh.Allocate(host1, frontend, "web4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Ip != "10.0.0.5" {
+		t.Errorf("Expected 10.0.0.5, got %s", endpoint.Ip)
+	}
+	client, err := mesh.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policies []common.Policy
+	if err := client.Get(mesh.PolicyURL+"/policies", &policies); err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].ID != policy.ID {
+		t.Errorf("Expected policy %d restored, got %v", policy.ID, policies)
+	}
+
+	// Backups with dangling references are not restored.
+	backup.Snapshot("topology").Tables = nil
+	if err := mesh.Restore(backup); err == nil {
+		t.Error("Expected error restoring endpoints without their host")
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command for generating load on services booted by the test
+// harness. It allocates endpoints concurrently and adds policies,
+// which the policy service sends to the agents of all hosts, at
+// the scales asked for, and reports how long that took in the
+// format of Go benchmarks, so that results of runs can be
+// compared with benchstat:
+//
+//	load -hosts 1,4,16 -endpoints 2000 -count 5 > new.txt
+//	benchstat old.txt new.txt
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/ipam"
+	"github.com/romana/core/tenant"
+	"github.com/romana/core/test/harness"
+)
+
+// result is a line of the report. Time per operation is the time
+// all operations took divided by their number, so with concurrent
+// clients it is less than the latency of an operation.
+type result struct {
+	name    string
+	n       int
+	elapsed time.Duration
+	// Unit of the rate reported along with time per
+	// operation, if any.
+	unit string
+}
+
+func (r result) String() string {
+	line := fmt.Sprintf("Benchmark%s\t%8d\t%10d ns/op", r.name, r.n, r.elapsed.Nanoseconds()/int64(r.n))
+	if r.unit != "" {
+		line += fmt.Sprintf("\t%10.2f %s", float64(r.n)/r.elapsed.Seconds(), r.unit)
+	}
+	return line
+}
+
+// load is a mesh with hosts, and a segment to allocate
+// endpoints of on them.
+type load struct {
+	mesh    *harness.Mesh
+	agents  []*harness.Agent
+	segment tenant.Segment
+}
+
+func newLoad(hosts int) (*load, error) {
+	mesh, err := harness.Start()
+	if err != nil {
+		return nil, err
+	}
+	l := &load{mesh: mesh}
+	for i := 0; i < hosts; i++ {
+		agent, err := mesh.AddHost(fmt.Sprintf("host%d", i))
+		if err != nil {
+			return nil, err
+		}
+		l.agents = append(l.agents, agent)
+	}
+	t, err := mesh.AddTenant("load")
+	if err != nil {
+		return nil, err
+	}
+	l.segment, err = mesh.AddSegment(t, "load")
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// allocate allocates n endpoints spread over the hosts
+// by the number of concurrent clients.
+func (l *load) allocate(n int, concurrency int) ([]ipam.Endpoint, time.Duration, error) {
+	endpoints := make([]ipam.Endpoint, n)
+	errs := make(chan error, concurrency)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for c := 0; c < concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				endpoint, err := l.mesh.Allocate(l.agents[i%len(l.agents)], l.segment, fmt.Sprintf("load%d", i))
+				if err != nil {
+					errs <- err
+					return
+				}
+				endpoints[i] = endpoint
+			}
+		}()
+	}
+	err := feed(next, n, errs)
+	wg.Wait()
+	return endpoints, time.Since(start), err
+}
+
+// release releases the endpoints by the
+// number of concurrent clients.
+func (l *load) release(endpoints []ipam.Endpoint, concurrency int) (time.Duration, error) {
+	errs := make(chan error, concurrency)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for c := 0; c < concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := l.mesh.Release(endpoints[i].Ip); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	err := feed(next, len(endpoints), errs)
+	wg.Wait()
+	return time.Since(start), err
+}
+
+// feed sends indexes up to n to the clients and closes next,
+// stopping at the first error of a client.
+func feed(next chan<- int, n int, errs <-chan error) error {
+	defer close(next)
+	for i := 0; i < n; i++ {
+		select {
+		case next <- i:
+		case err := <-errs:
+			return err
+		}
+	}
+	return nil
+}
+
+// addPolicies adds n policies, one after another, since each
+// rewrites rules of the policies before it on the agents.
+func (l *load) addPolicies(n int) ([]uint64, time.Duration, error) {
+	var ids []uint64
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		policy, err := l.mesh.AddPolicy(common.Policy{
+			Name:      fmt.Sprintf("load%d", i),
+			Direction: common.PolicyDirectionIngress,
+			AppliedTo: []common.Endpoint{{TenantName: "load", SegmentName: "load"}},
+			Peers:     []common.Endpoint{{Cidr: "192.168.0.0/16"}},
+			Rules:     []common.Rule{{Protocol: "tcp", Ports: []uint{uint(1024 + i)}}},
+		})
+		if err != nil {
+			return ids, time.Since(start), err
+		}
+		ids = append(ids, policy.ID)
+	}
+	return ids, time.Since(start), nil
+}
+
+func (l *load) deletePolicies(ids []uint64) (time.Duration, error) {
+	start := time.Now()
+	for _, id := range ids {
+		if err := l.mesh.DeletePolicy(id); err != nil {
+			return time.Since(start), err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// run generates the load on a new mesh with the number of hosts.
+func run(hosts int, endpoints int, concurrency int, policies int) ([]result, error) {
+	l, err := newLoad(hosts)
+	if err != nil {
+		return nil, err
+	}
+	defer l.mesh.Close()
+	var results []result
+	scale := fmt.Sprintf("hosts=%d/concurrency=%d", hosts, concurrency)
+
+	allocated, elapsed, err := l.allocate(endpoints, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, result{name: "Allocate/" + scale, n: endpoints, elapsed: elapsed, unit: "endpoints/s"})
+
+	ids, elapsed, err := l.addPolicies(policies)
+	if err != nil {
+		return nil, err
+	}
+	scale = fmt.Sprintf("hosts=%d/policies=%d", hosts, policies)
+	results = append(results, result{name: "AddPolicy/" + scale, n: policies, elapsed: elapsed})
+	elapsed, err = l.deletePolicies(ids)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, result{name: "DeletePolicy/" + scale, n: policies, elapsed: elapsed})
+
+	elapsed, err = l.release(allocated, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	scale = fmt.Sprintf("hosts=%d/concurrency=%d", hosts, concurrency)
+	results = append(results, result{name: "Release/" + scale, n: endpoints, elapsed: elapsed, unit: "endpoints/s"})
+	return results, nil
+}
+
+// parseScales parses a comma-separated list of positive numbers.
+func parseScales(list string) ([]int, error) {
+	var scales []int
+	for _, s := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid scale %q", s))
+		}
+		scales = append(scales, n)
+	}
+	return scales, nil
+}
+
+func main() {
+	hostList := flag.String("hosts", "1,4,16", "Comma-separated numbers of hosts to run with")
+	endpoints := flag.Int("endpoints", 1000, "Number of endpoints to allocate")
+	concurrency := flag.Int("concurrency", 8, "Number of concurrent clients allocating endpoints")
+	policies := flag.Int("policies", 50, "Number of policies to add")
+	count := flag.Int("count", 1, "Run each scale this many times")
+	verbose := flag.Bool("verbose", false, "Log output of the services")
+	flag.Parse()
+
+	hosts, err := parseScales(*hostList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *endpoints <= 0 || *concurrency <= 0 || *policies <= 0 || *count <= 0 {
+		fmt.Fprintln(os.Stderr, "endpoints, concurrency, policies and count must be positive")
+		os.Exit(2)
+	}
+	// Services print to standard output too, so it
+	// is kept for the report only.
+	report := os.Stdout
+	os.Stdout = os.Stderr
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+		if os.Stdout, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(report, "goos: %s\ngoarch: %s\npkg: github.com/romana/core/test/load\n", runtime.GOOS, runtime.GOARCH)
+	for i := 0; i < *count; i++ {
+		for _, h := range hosts {
+			results, err := run(h, *endpoints, *concurrency, *policies)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Load with %d hosts failed: %v\n", h, err)
+				os.Exit(1)
+			}
+			for _, r := range results {
+				fmt.Fprintln(report, r)
+			}
+		}
+	}
+}
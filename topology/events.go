@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package topology
+
+// Feed of changes to hosts. Every host added, updated or removed is
+// recorded as an event with a sequence number; GET /events?since=N
+// returns events after N, and with watch=true waits for one if there
+// are none yet, so that agents can react to changes without polling
+// the host list. Only the latest maxHostEvents events are kept, in
+// memory; a client that falls further behind (or asks a restarted
+// service) is told to reset, that is, to fetch the full host list.
+// Events are also published on the event bus, if one is configured.
+
+import (
+	"fmt"
+	"github.com/romana/core/common"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How many host events to keep.
+	maxHostEvents = 1000
+	// How long to hold a watch request if the request
+	// itself has no deadline.
+	defaultEventWatchTimeout = 30 * time.Second
+)
+
+// hostEvents is the log of host events.
+type hostEvents struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []common.HostEvent
+	// Closed and replaced whenever an event is recorded.
+	changed chan struct{}
+	// Bus to publish events on, or nil.
+	bus common.EventBus
+}
+
+func newHostEvents() *hostEvents {
+	return &hostEvents{changed: make(chan struct{})}
+}
+
+// record adds an event of the given type for the host
+// and wakes up watchers.
+func (e *hostEvents) record(eventType string, host common.Host) {
+	e.mu.Lock()
+	e.seq++
+	host.Links = nil
+	e.events = append(e.events, common.HostEvent{Seq: e.seq, Type: eventType, Timestamp: time.Now().Unix(), Host: host})
+	if len(e.events) > maxHostEvents {
+		e.events = e.events[len(e.events)-maxHostEvents:]
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+	bus := e.bus
+	e.mu.Unlock()
+	common.PublishEvent(bus, common.BusTopicHosts, eventType, host)
+}
+
+// since returns events after the given sequence number, and a
+// channel closed on the next event.
+func (e *hostEvents) since(seq uint64) (common.HostEventList, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	retval := common.HostEventList{Seq: e.seq, Events: make([]common.HostEvent, 0)}
+	if seq > e.seq || (len(e.events) > 0 && seq+1 < e.events[0].Seq) {
+		retval.Reset = true
+		return retval, e.changed
+	}
+	for _, event := range e.events {
+		if event.Seq > seq {
+			retval.Events = append(retval.Events, event)
+		}
+	}
+	return retval, e.changed
+}
+
+// handleEvents handles GET to /events. See the top of the file.
+func (topology *TopologySvc) handleEvents(input interface{}, ctx common.RestContext) (interface{}, error) {
+	var since uint64
+	if sinceStr := ctx.QueryVariables.Get("since"); sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			return nil, common.NewError400(fmt.Sprintf("Invalid value of since: %s", sinceStr))
+		}
+	}
+	list, changed := topology.events.since(since)
+	if ctx.QueryVariables.Get("watch") != "true" || list.Reset || len(list.Events) > 0 {
+		return list, nil
+	}
+	timeout := defaultEventWatchTimeout
+	if deadline, ok := ctx.Context.Deadline(); ok {
+		// Leave some time to write the response.
+		timeout = deadline.Sub(time.Now()) * 9 / 10
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Context.Done():
+		return nil, ctx.Context.Err()
+	}
+	list, _ = topology.events.since(since)
+	return list, nil
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package topology
+
+// Export of the topology as a graph: the datacenter contains zones,
+// the datacenter and zones contain hosts, tenants own segments and
+// segments span the hosts they have endpoints on. The graph is
+// served as JSON or, with format=dot, as a Graphviz DOT document.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/romana/core/common"
+	"github.com/romana/core/tenant"
+	"sort"
+	"time"
+)
+
+// Kinds of nodes and edges of the exported graph.
+const (
+	exportDatacenter = "datacenter"
+	exportZone       = "zone"
+	exportHost       = "host"
+	exportTenant     = "tenant"
+	exportSegment    = "segment"
+
+	exportContains = "contains"
+	exportOwns     = "owns"
+	exportSpans    = "spans"
+)
+
+// TopologyExport is the exported graph.
+type TopologyExport struct {
+	Datacenter common.Datacenter   `json:"datacenter"`
+	Zones      []common.Datacenter `json:"zones"`
+	Hosts      []common.Host       `json:"hosts"`
+	Tenants    []tenant.Tenant     `json:"tenants"`
+	Nodes      []ExportNode        `json:"nodes"`
+	Edges      []ExportEdge        `json:"edges"`
+}
+
+// ExportNode is a node of the exported graph.
+type ExportNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+}
+
+// ExportEdge is a relationship between two nodes of the exported
+// graph. Endpoints is the number of endpoints of a segment on a
+// host for edges of kind spans.
+type ExportEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Kind      string `json:"kind"`
+	Endpoints uint64 `json:"endpoints,omitempty"`
+}
+
+// segmentHosts is the number of endpoints of a tenant segment
+// on a host, as reported by ipam.
+type segmentHosts struct {
+	HostID    string
+	TenantID  string
+	SegmentID string
+	Used      uint64
+}
+
+// segmentHostsByID sorts segmentHosts by segment and host.
+type segmentHostsByID []segmentHosts
+
+func (s segmentHostsByID) Len() int      { return len(s) }
+func (s segmentHostsByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s segmentHostsByID) Less(i, j int) bool {
+	if s[i].TenantID != s[j].TenantID {
+		return s[i].TenantID < s[j].TenantID
+	}
+	if s[i].SegmentID != s[j].SegmentID {
+		return s[i].SegmentID < s[j].SegmentID
+	}
+	return s[i].HostID < s[j].HostID
+}
+
+// tenantSegments returns tenants with their segments from the
+// tenant service and the hosts segments have endpoints on from
+// the capacity report of ipam.
+func (topology *TopologySvc) tenantSegments(ctx context.Context) ([]tenant.Tenant, []segmentHosts, error) {
+	client := topology.client.WithContext(ctx)
+	tenantURL, err := client.GetServiceUrl("tenant")
+	if err != nil {
+		return nil, nil, err
+	}
+	var tenants []tenant.Tenant
+	err = client.Get(tenantURL+"/tenants", &tenants)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range tenants {
+		var segments []tenant.Segment
+		err = client.Get(fmt.Sprintf("%s/tenants/%d/segments", tenantURL, tenants[i].ID), &segments)
+		if err != nil {
+			return nil, nil, err
+		}
+		tenants[i].Segments = segments
+	}
+
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return nil, nil, err
+	}
+	var capacity []struct {
+		HostID   string `json:"host_id"`
+		Segments []struct {
+			TenantID  string `json:"tenant_id"`
+			SegmentID string `json:"segment_id"`
+			Used      uint64 `json:"used"`
+		} `json:"segments"`
+	}
+	err = client.Get(ipamURL+"/capacity", &capacity)
+	if err != nil {
+		return nil, nil, err
+	}
+	var usage []segmentHosts
+	for _, host := range capacity {
+		for _, segment := range host.Segments {
+			usage = append(usage, segmentHosts{HostID: host.HostID, TenantID: segment.TenantID, SegmentID: segment.SegmentID, Used: segment.Used})
+		}
+	}
+	return tenants, usage, nil
+}
+
+// export builds the graph of the topology.
+func (topology *TopologySvc) export(ctx context.Context) (*TopologyExport, error) {
+	hosts, err := topology.hosts.ListHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenants, usage, err := topology.listSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zones, _ := topology.handleZoneListGet(nil, common.RestContext{Context: ctx})
+
+	export := &TopologyExport{
+		Datacenter: *topology.datacenter,
+		Zones:      zones.([]common.Datacenter)[1:],
+		Hosts:      hosts,
+		Tenants:    tenants,
+		Nodes:      make([]ExportNode, 0),
+		Edges:      make([]ExportEdge, 0),
+	}
+	dcID := exportDatacenter + ":" + export.Datacenter.Name
+	export.Nodes = append(export.Nodes, ExportNode{ID: dcID, Kind: exportDatacenter, Label: export.Datacenter.Name})
+	for _, zone := range export.Zones {
+		zoneID := exportZone + ":" + zone.Name
+		export.Nodes = append(export.Nodes, ExportNode{ID: zoneID, Kind: exportZone, Label: zone.Name})
+		export.Edges = append(export.Edges, ExportEdge{From: dcID, To: zoneID, Kind: exportContains})
+	}
+	for i := range hosts {
+		hosts[i].Status = topology.health.status(hosts[i], time.Now())
+		host := hosts[i]
+		hostID := fmt.Sprintf("%s:%d", exportHost, host.ID)
+		export.Nodes = append(export.Nodes, ExportNode{ID: hostID, Kind: exportHost, Label: host.Name})
+		parentID := dcID
+		if host.Zone != "" && host.Zone != export.Datacenter.Name {
+			parentID = exportZone + ":" + host.Zone
+		}
+		export.Edges = append(export.Edges, ExportEdge{From: parentID, To: hostID, Kind: exportContains})
+	}
+	for _, t := range tenants {
+		tenantID := fmt.Sprintf("%s:%d", exportTenant, t.ID)
+		export.Nodes = append(export.Nodes, ExportNode{ID: tenantID, Kind: exportTenant, Label: t.Name})
+		for _, segment := range t.Segments {
+			segmentID := fmt.Sprintf("%s:%d/%d", exportSegment, t.ID, segment.ID)
+			export.Nodes = append(export.Nodes, ExportNode{ID: segmentID, Kind: exportSegment, Label: t.Name + "/" + segment.Name})
+			export.Edges = append(export.Edges, ExportEdge{From: tenantID, To: segmentID, Kind: exportOwns})
+		}
+	}
+	sort.Sort(segmentHostsByID(usage))
+	for _, u := range usage {
+		export.Edges = append(export.Edges, ExportEdge{
+			From:      fmt.Sprintf("%s:%s/%s", exportSegment, u.TenantID, u.SegmentID),
+			To:        exportHost + ":" + u.HostID,
+			Kind:      exportSpans,
+			Endpoints: u.Used,
+		})
+	}
+	return export, nil
+}
+
+// dot renders the graph as a Graphviz DOT document.
+func (export *TopologyExport) dot() string {
+	var buf bytes.Buffer
+	buf.WriteString("digraph romana {\n")
+	shapes := map[string]string{
+		exportDatacenter: "box3d",
+		exportZone:       "box",
+		exportHost:       "component",
+		exportTenant:     "folder",
+		exportSegment:    "ellipse",
+	}
+	for _, node := range export.Nodes {
+		fmt.Fprintf(&buf, "  %q [label=%q, shape=%s];\n", node.ID, node.Label, shapes[node.Kind])
+	}
+	for _, edge := range export.Edges {
+		label := edge.Kind
+		if edge.Kind == exportSpans {
+			label = fmt.Sprintf("%d endpoints", edge.Endpoints)
+		}
+		fmt.Fprintf(&buf, "  %q -> %q [label=%q];\n", edge.From, edge.To, label)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// handleExport exports the topology as JSON or, with format=dot,
+// as a DOT document.
+func (topology *TopologySvc) handleExport(input interface{}, ctx common.RestContext) (interface{}, error) {
+	format := ctx.QueryVariables.Get("format")
+	if format != "" && format != "json" && format != "dot" {
+		return nil, common.NewError400(fmt.Sprintf("Unknown export format %s, expected json or dot", format))
+	}
+	export, err := topology.export(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	if format == "dot" {
+		return common.Raw{Body: export.dot()}, nil
+	}
+	return export, nil
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package topology
+
+// Health of self-registered hosts, derived from their heartbeats
+// (see common.Host.LastHeartbeat). A host is healthy until it misses
+// heartbeats for unreachable_after seconds (90 by default), then
+// unreachable, and down once it misses them for down_after seconds
+// (300 by default). ipam allocates no endpoints on hosts that are
+// down. Hosts added by hand send no heartbeats and have no status.
+// Changes of status are recorded as host events.
+
+import (
+	"context"
+	"github.com/romana/core/common"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUnreachableAfter = 90 * time.Second
+	defaultDownAfter        = 300 * time.Second
+	// How often to check for changes of status.
+	healthCheckInterval = 10 * time.Second
+)
+
+// hostHealth tracks status of hosts.
+type hostHealth struct {
+	unreachableAfter time.Duration
+	downAfter        time.Duration
+
+	mu sync.Mutex
+	// Status of hosts as of the last check, by ID.
+	statuses map[uint64]string
+}
+
+// parseHostHealth parses health thresholds from the configuration.
+func parseHostHealth(serviceSpecific map[string]interface{}) (*hostHealth, error) {
+	health := &hostHealth{
+		unreachableAfter: defaultUnreachableAfter,
+		downAfter:        defaultDownAfter,
+		statuses:         make(map[uint64]string),
+	}
+	if seconds, ok := serviceSpecific["unreachable_after"].(float64); ok {
+		health.unreachableAfter = time.Duration(seconds * float64(time.Second))
+	}
+	if seconds, ok := serviceSpecific["down_after"].(float64); ok {
+		health.downAfter = time.Duration(seconds * float64(time.Second))
+	}
+	if health.unreachableAfter <= 0 || health.downAfter < health.unreachableAfter {
+		return nil, common.NewError("Invalid unreachable_after %v and down_after %v", health.unreachableAfter, health.downAfter)
+	}
+	return health, nil
+}
+
+// status returns status of the host at the given time.
+func (health *hostHealth) status(host common.Host, now time.Time) string {
+	if host.LastHeartbeat == 0 {
+		return ""
+	}
+	missing := now.Sub(time.Unix(host.LastHeartbeat, 0))
+	switch {
+	case missing >= health.downAfter:
+		return common.HostDown
+	case missing >= health.unreachableAfter:
+		return common.HostUnreachable
+	default:
+		return common.HostHealthy
+	}
+}
+
+// setStatus sets status of the hosts as of now.
+func (health *hostHealth) setStatus(hosts []common.Host) {
+	now := time.Now()
+	for i := range hosts {
+		hosts[i].Status = health.status(hosts[i], now)
+	}
+}
+
+// checkHealth records changes of status of hosts since the last check.
+func (topology *TopologySvc) checkHealth(ctx context.Context, now time.Time) error {
+	hosts, err := topology.hosts.ListHosts(ctx)
+	if err != nil {
+		return err
+	}
+	health := topology.health
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	seen := make(map[uint64]bool)
+	for _, host := range hosts {
+		seen[host.ID] = true
+		host.Status = health.status(host, now)
+		prev, known := health.statuses[host.ID]
+		health.statuses[host.ID] = host.Status
+		if !known || prev == host.Status {
+			continue
+		}
+		log.Printf("Host %s (%d) is %s, was %s", host.Name, host.ID, host.Status, prev)
+		topology.events.record(common.HostUpdated, host)
+	}
+	for id := range health.statuses {
+		if !seen[id] {
+			delete(health.statuses, id)
+		}
+	}
+	return nil
+}
+
+// monitorHealth periodically checks health of hosts.
+func (topology *TopologySvc) monitorHealth() {
+	for {
+		err := topology.checkHealth(context.Background(), time.Now())
+		if err != nil {
+			log.Printf("Error checking health of hosts: %s", err)
+		}
+		time.Sleep(healthCheckInterval)
+	}
+}
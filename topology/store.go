@@ -17,13 +17,16 @@
 package topology
 
 import (
+	"context"
 	"log"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
 
 	"github.com/romana/core/common"
 
 	"strconv"
+	"time"
 )
 
 type Tor struct {
@@ -31,33 +34,85 @@ type Tor struct {
 	datacenter *common.Datacenter
 }
 
-// Backing store
+// hostLabel is a label of a host (see common.Host.Labels).
+type hostLabel struct {
+	ID     uint64 `sql:"AUTO_INCREMENT"`
+	HostID uint64
+	Key    string
+	Value  string
+}
+
+// HostRepository keeps hosts and their labels, which is all the
+// handlers of the service need of a store.
+type HostRepository interface {
+	AddHost(ctx context.Context, host *common.Host) (string, error)
+	FindHost(ctx context.Context, id uint64) (common.Host, error)
+	FindHostByName(ctx context.Context, name string) (*common.Host, error)
+	ListHosts(ctx context.Context) ([]common.Host, error)
+	UpdateHost(ctx context.Context, host *common.Host, labels map[string]string) error
+	HeartbeatHost(ctx context.Context, host *common.Host) error
+	DeleteHost(ctx context.Context, id uint64) error
+	DeleteStaleHosts(ctx context.Context, before int64) ([]common.Host, error)
+	SetLabels(ctx context.Context, hostID uint64, labels map[string]string) error
+}
+
+// Backend is what the service needs of a store besides its hosts:
+// configuring and connecting it, creating its schema and finding
+// entities for find routes. The database and schema stay behind it.
+type Backend interface {
+	common.Store
+	Ping() error
+}
+
+// Store is a backend keeping hosts and their labels. topoStore keeps
+// them in the database configured; package topologytest provides one
+// keeping them in memory.
+type Store interface {
+	Backend
+	HostRepository
+}
+
+// topoStore implements Store in a database.
 type topoStore struct {
 	common.DbStore
 }
 
 func (topoStore *topoStore) Entities() []interface{} {
-	retval := make([]interface{}, 2)
+	retval := make([]interface{}, 3)
 	retval[0] = &common.Host{}
 	retval[1] = &common.Datacenter{}
+	retval[2] = &hostLabel{}
 	return retval
 }
 
 func (topoStore *topoStore) CreateSchemaPostProcess() error {
-	return nil
+	db := topoStore.Db
+	db.Model(&common.Host{}).AddIndex("idx_host_name", "name")
+	db.Model(&hostLabel{}).AddIndex("idx_host_label_host_id", "host_id")
+	return common.MakeMultiError(db.GetErrors())
 }
 
-func (topoStore *topoStore) findHost(id uint64) (common.Host, error) {
+// FindHost returns the host with the given ID.
+func (topoStore *topoStore) FindHost(ctx context.Context, id uint64) (common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Host{}, err
+	}
 	host := common.Host{}
 	topoStore.DbStore.Db.Where("id = ?", id).First(&host)
 	err := common.MakeMultiError(topoStore.DbStore.Db.GetErrors())
 	if err != nil {
 		return host, err
 	}
-	return host, nil
+	hosts := []common.Host{host}
+	err = topoStore.loadLabels(hosts)
+	return hosts[0], err
 }
 
-func (topoStore *topoStore) listHosts() ([]common.Host, error) {
+// ListHosts returns all hosts.
+func (topoStore *topoStore) ListHosts(ctx context.Context) ([]common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
 	var hosts []common.Host
 	log.Println("In listHosts()")
 	topoStore.DbStore.Db.Find(&hosts)
@@ -65,11 +120,20 @@ func (topoStore *topoStore) listHosts() ([]common.Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = topoStore.loadLabels(hosts)
+	if err != nil {
+		return nil, err
+	}
 	log.Println("MySQL found hosts:", hosts)
 	return hosts, nil
 }
 
-func (topoStore *topoStore) addHost(host *common.Host) (string, error) {
+// AddHost adds the host, returning its ID.
+func (topoStore *topoStore) AddHost(ctx context.Context, host *common.Host) (string, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return "", err
+	}
+	host.Version = 1
 	topoStore.DbStore.Db.NewRecord(*host)
 	db := topoStore.DbStore.Db.Create(host)
 	if db.Error != nil {
@@ -79,5 +143,199 @@ func (topoStore *topoStore) addHost(host *common.Host) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if len(host.Labels) > 0 {
+		err = topoStore.SetLabels(ctx, host.ID, host.Labels)
+		if err != nil {
+			return "", err
+		}
+	}
 	return strconv.FormatUint(host.ID, 10), nil
 }
+
+// FindHostByName returns the host with the given name, or nil if there is none.
+func (topoStore *topoStore) FindHostByName(ctx context.Context, name string) (*common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var hosts []common.Host
+	topoStore.DbStore.Db.Where("name = ?", name).Find(&hosts)
+	err := common.MakeMultiError(topoStore.DbStore.Db.GetErrors())
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	err = topoStore.loadLabels(hosts[0:1])
+	if err != nil {
+		return nil, err
+	}
+	return &hosts[0], nil
+}
+
+// UpdateHost stores changes to an existing host, provided it is still
+// at host.Version, and increments the version. Labels of the host are
+// replaced by the provided ones in the same transaction unless they are
+// nil, in which case they are kept.
+func (topoStore *topoStore) UpdateHost(ctx context.Context, host *common.Host, labels map[string]string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	now := time.Now()
+	columns := map[string]interface{}{
+		"name":           host.Name,
+		"ip":             host.Ip,
+		"romana_ip":      host.RomanaIp,
+		"agent_port":     host.AgentPort,
+		"last_heartbeat": host.LastHeartbeat,
+		"draining":       host.Draining,
+		"zone":           host.Zone,
+		"updated_at":     now,
+	}
+	tx := topoStore.DbStore.Db.Begin()
+	err := common.UpdateVersioned(tx, &common.Host{}, host.Version, columns, "id = ?", host.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if labels != nil {
+		err = setLabels(tx, host.ID, labels)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	tx.Commit()
+	host.Version++
+	host.UpdatedAt = &now
+	if labels != nil {
+		host.Labels = labels
+	}
+	return nil
+}
+
+// HeartbeatHost stores what the agent of a registered host reports,
+// its addresses, agent port and zone along with its last heartbeat,
+// whatever the version of the host, which is left as it is: versions
+// guard changes of operators (see UpdateHost), not heartbeats.
+func (topoStore *topoStore) HeartbeatHost(ctx context.Context, host *common.Host) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	columns := map[string]interface{}{
+		"ip":             host.Ip,
+		"romana_ip":      host.RomanaIp,
+		"agent_port":     host.AgentPort,
+		"last_heartbeat": host.LastHeartbeat,
+		"zone":           host.Zone,
+	}
+	db := topoStore.DbStore.Db.Model(&common.Host{}).Where("id = ?", host.ID).UpdateColumns(columns)
+	if err := common.GetDbErrors(db); err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return common.NewError404("host", strconv.FormatUint(host.ID, 10))
+	}
+	return nil
+}
+
+// DeleteStaleHosts deletes self-registered hosts whose last
+// heartbeat was before the given time, and returns them.
+func (topoStore *topoStore) DeleteStaleHosts(ctx context.Context, before int64) ([]common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	var stale []common.Host
+	db := topoStore.DbStore.Db.Where("last_heartbeat > 0 AND last_heartbeat < ?", before).Find(&stale)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	for _, host := range stale {
+		err := topoStore.DeleteHost(ctx, host.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
+
+// DeleteHost deletes the host with the given ID.
+func (topoStore *topoStore) DeleteHost(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	db := topoStore.DbStore.Db.Where("host_id = ?", id).Delete(hostLabel{})
+	if db.Error != nil {
+		return db.Error
+	}
+	db = topoStore.DbStore.Db.Where("id = ?", id).Delete(common.Host{})
+	if db.Error != nil {
+		return db.Error
+	}
+	return common.MakeMultiError(topoStore.DbStore.Db.GetErrors())
+}
+
+// loadLabels fills in labels of the provided hosts. Labels of a single
+// host are looked up by its ID; for more hosts, as listed by ListHosts,
+// all labels are read instead of listing the IDs in the query.
+func (topoStore *topoStore) loadLabels(hosts []common.Host) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	index := make(map[uint64]int, len(hosts))
+	for i, host := range hosts {
+		index[host.ID] = i
+	}
+	var labels []hostLabel
+	db := topoStore.DbStore.Db
+	if len(hosts) == 1 {
+		db = db.Where("host_id = ?", hosts[0].ID)
+	}
+	db = db.Find(&labels)
+	if db.Error != nil {
+		return db.Error
+	}
+	for _, label := range labels {
+		i, ok := index[label.HostID]
+		if !ok {
+			continue
+		}
+		if hosts[i].Labels == nil {
+			hosts[i].Labels = make(map[string]string)
+		}
+		hosts[i].Labels[label.Key] = label.Value
+	}
+	return nil
+}
+
+// SetLabels replaces labels of the host with the provided ones.
+func (topoStore *topoStore) SetLabels(ctx context.Context, hostID uint64, labels map[string]string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	tx := topoStore.DbStore.Db.Begin()
+	err := setLabels(tx, hostID, labels)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// setLabels replaces labels of the host within the transaction.
+func setLabels(tx *gorm.DB, hostID uint64, labels map[string]string) error {
+	db := tx.Where("host_id = ?", hostID).Delete(hostLabel{})
+	err := common.GetDbErrors(db)
+	if err != nil {
+		return err
+	}
+	for key, value := range labels {
+		db = tx.Create(&hostLabel{HostID: hostID, Key: key, Value: value})
+		err = common.GetDbErrors(db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,13 +16,20 @@
 package topology
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
 	//	"github.com/mitchellh/mapstructure"
 	"github.com/romana/core/common"
+	"github.com/romana/core/tenant"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // TopologySvc service
@@ -30,17 +37,50 @@ type TopologySvc struct {
 	client     *common.RestClient
 	config     common.ServiceConfig
 	datacenter *common.Datacenter
-	store      topoStore
-	routes     common.Route
+	// backend is configured, connected and finds entities for
+	// find routes; handlers only keep hosts in hosts.
+	backend Backend
+	hosts   HostRepository
+	routes  common.Route
+
+	// Zones other than the datacenter itself, by name. Each
+	// has its own CIDR and bit allocation (see zones in
+	// the configuration).
+	zones map[string]*common.Datacenter
+	// Log of changes to hosts (see events.go).
+	events *hostEvents
+	// Health of hosts (see health.go).
+	health *hostHealth
+
+	// Token agents register their hosts with; if empty,
+	// hosts cannot register themselves.
+	bootstrapToken string
+	// How long a self-registered host is kept without
+	// heartbeats; 0 to keep it forever.
+	hostTTL time.Duration
+
+	// countEndpoints returns the number of endpoints on the host
+	// (ipamEndpoints), and notifyAgents tells agents of the other
+	// hosts that the host was removed (reconcileAgents). They are
+	// fields so that tests can replace them.
+	countEndpoints func(ctx context.Context, host common.Host) (int, error)
+	notifyAgents   func(ctx context.Context, removed common.Host)
+	// listSegments returns tenants with their segments and
+	// the hosts segments span (tenantSegments), for export.
+	listSegments func(ctx context.Context) ([]tenant.Tenant, []segmentHosts, error)
 }
 
 const (
 	infoListPath  = "/info"
 	agentListPath = "/agents"
 	hostListPath  = "/hosts"
+	hostRegPath   = "/hosts/register"
 	torListPath   = "/tors"
 	spineListPath = "/spines"
 	dcPath        = "/datacenter"
+	eventsPath    = "/events"
+	zoneListPath  = "/zones"
+	exportPath    = "/topology/export"
 )
 
 // Routes returns various routes used in the service.
@@ -68,6 +108,13 @@ func (topology *TopologySvc) Routes() common.Routes {
 			MakeMessage:     func() interface{} { return &common.Host{} },
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         hostRegPath,
+			Handler:         topology.handleHostRegister,
+			MakeMessage:     func() interface{} { return &common.HostRegistration{} },
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         hostListPath + "/{hostId}",
@@ -75,6 +122,41 @@ func (topology *TopologySvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         hostListPath + "/{hostId}",
+			Handler:         topology.handleHostPut,
+			MakeMessage:     func() interface{} { return &common.Host{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PATCH",
+			Pattern:         hostListPath + "/{hostId}",
+			Handler:         topology.handleHostPatch,
+			MakeMessage:     func() interface{} { return &hostPatch{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "PUT",
+			Pattern:         hostListPath + "/{hostId}/labels",
+			Handler:         topology.handleHostLabelsPut,
+			MakeMessage:     func() interface{} { return &map[string]string{} },
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "POST",
+			Pattern:         hostListPath + "/{hostId}/drain",
+			Handler:         topology.handleHostDrain,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "DELETE",
+			Pattern:         hostListPath + "/{hostId}",
+			Handler:         topology.handleHostDelete,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 		common.Route{
 			Method:          "GET",
 			Pattern:         dcPath,
@@ -82,9 +164,37 @@ func (topology *TopologySvc) Routes() common.Routes {
 			MakeMessage:     nil,
 			UseRequestToken: false,
 		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         eventsPath,
+			Handler:         topology.handleEvents,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         zoneListPath,
+			Handler:         topology.handleZoneListGet,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         zoneListPath + "/{zone}",
+			Handler:         topology.handleGetZone,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
+		common.Route{
+			Method:          "GET",
+			Pattern:         exportPath,
+			Handler:         topology.handleExport,
+			MakeMessage:     nil,
+			UseRequestToken: false,
+		},
 	}
 	var h = []common.Host{}
-	routes = append(routes, common.CreateFindRoutes(&h, &topology.store.DbStore)...)
+	routes = append(routes, common.CreateFindRoutes(&h, storeFinder{topology})...)
 	return routes
 }
 
@@ -94,11 +204,76 @@ func (topology *TopologySvc) handleDc(input interface{}, ctx common.RestContext)
 	return topology.datacenter, nil
 }
 
+// zone returns the zone with the given name; the datacenter
+// itself is the zone of hosts with no zone.
+func (topology *TopologySvc) zone(name string) *common.Datacenter {
+	if name == "" || name == topology.datacenter.Name {
+		return topology.datacenter
+	}
+	return topology.zones[name]
+}
+
+// handleZoneListGet lists zones, starting with the datacenter itself.
+func (topology *TopologySvc) handleZoneListGet(input interface{}, ctx common.RestContext) (interface{}, error) {
+	names := make([]string, 0, len(topology.zones))
+	for name := range topology.zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	retval := []common.Datacenter{*topology.datacenter}
+	for _, name := range names {
+		retval = append(retval, *topology.zones[name])
+	}
+	return retval, nil
+}
+
+// handleGetZone handles request for a specific zone.
+func (topology *TopologySvc) handleGetZone(input interface{}, ctx common.RestContext) (interface{}, error) {
+	name := ctx.PathVariables["zone"]
+	zone := topology.zone(name)
+	if zone == nil {
+		return nil, common.NewError404("zone", name)
+	}
+	return zone, nil
+}
+
+// checkZone returns an error if the host is assigned to
+// a zone that does not exist.
+func (topology *TopologySvc) checkZone(host common.Host) error {
+	if topology.zone(host.Zone) == nil {
+		return common.NewError400(fmt.Sprintf("Unknown zone %s of host %s", host.Zone, host.Name))
+	}
+	return nil
+}
+
 // Name implements method of Service interface.
 func (topology *TopologySvc) Name() string {
 	return "topology"
 }
 
+// CheckHealth implements common.HealthChecker by checking the database.
+func (topology *TopologySvc) CheckHealth() error {
+	return topology.backend.Ping()
+}
+
+// Snapshot implements common.Snapshotter by taking a
+// snapshot of the database, for backups.
+func (topology *TopologySvc) Snapshot(ctx context.Context) (common.StoreSnapshot, error) {
+	return common.SnapshotStore(ctx, topology.backend)
+}
+
+// Restore implements common.Snapshotter by restoring
+// the snapshot into the database.
+func (topology *TopologySvc) Restore(ctx context.Context, snapshot common.StoreSnapshot) error {
+	return common.RestoreStore(ctx, topology.backend, snapshot)
+}
+
+// MaintenanceJobs implements common.Maintainer. Hosts are
+// deleted for good, so their tables only need analyzing.
+func (topology *TopologySvc) MaintenanceJobs() map[string]common.MaintenanceJob {
+	return common.StoreMaintenanceJobs(topology.backend)
+}
+
 // handleGetHost handles request for a specific host's info
 func (topology *TopologySvc) handleGetHost(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("In handleHost()")
@@ -107,10 +282,11 @@ func (topology *TopologySvc) handleGetHost(input interface{}, ctx common.RestCon
 	if err != nil {
 		return nil, err
 	}
-	host, err := topology.store.findHost(id)
+	host, err := topology.hosts.FindHost(ctx.Context, id)
 	if err != nil {
 		return nil, err
 	}
+	host.Status = topology.health.status(host, time.Now())
 	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
 	agentLink := common.LinkResponse{Href: agentURL, Rel: "agent"}
 	hostLink := common.LinkResponse{Href: hostListPath + "/" + idStr, Rel: "self"}
@@ -121,11 +297,200 @@ func (topology *TopologySvc) handleGetHost(input interface{}, ctx common.RestCon
 
 func (topology *TopologySvc) handleHostListGet(input interface{}, ctx common.RestContext) (interface{}, error) {
 	log.Println("In handleHostListGet()")
-	hosts, err := topology.store.listHosts()
+	selector, err := parseLabelSelector(ctx.QueryVariables["label"])
+	if err != nil {
+		return nil, err
+	}
+	status := ctx.QueryVariables.Get("status")
+	hosts, err := topology.hosts.ListHosts(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	topology.health.setStatus(hosts)
+	if len(selector) == 0 && status == "" {
+		return hosts, nil
+	}
+	retval := make([]common.Host, 0)
+	for _, host := range hosts {
+		if selector.matches(host) && (status == "" || host.Status == status) {
+			retval = append(retval, host)
+		}
+	}
+	return retval, nil
+}
+
+// labelRequirement is a requirement for a host to have a label,
+// given as key=value in label query parameter of GET /hosts, or
+// just as key if any value will do.
+type labelRequirement struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// labelSelector selects hosts that meet all of its requirements.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses values of label query parameters.
+func parseLabelSelector(values []string) (labelSelector, error) {
+	var selector labelSelector
+	for _, value := range values {
+		req := labelRequirement{}
+		idx := strings.Index(value, "=")
+		if idx < 0 {
+			req.key = value
+			req.anyValue = true
+		} else {
+			req.key = value[0:idx]
+			req.value = value[idx+1:]
+		}
+		if req.key == "" {
+			return nil, common.NewError400(fmt.Sprintf("Invalid label selector %s", value))
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+func (selector labelSelector) matches(host common.Host) bool {
+	for _, req := range selector {
+		value, ok := host.Labels[req.key]
+		if !ok || (!req.anyValue && value != req.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleHostLabelsPut replaces labels of the host.
+func (topology *TopologySvc) handleHostLabelsPut(input interface{}, ctx common.RestContext) (interface{}, error) {
+	labels := *input.(*map[string]string)
+	err := checkLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	host, err := topology.hostFromPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = topology.hosts.SetLabels(ctx.Context, host.ID, labels)
+	if err != nil {
+		return nil, err
+	}
+	host.Labels = labels
+	topology.events.record(common.HostUpdated, host)
+	return host, nil
+}
+
+// checkLabels returns an error if a label key cannot
+// be used in a label selector.
+func checkLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" || strings.Contains(key, "=") {
+			return common.NewError400(fmt.Sprintf("Invalid label key '%s'", key))
+		}
+	}
+	return nil
+}
+
+// hostPatch is the body of a PATCH of a host: only the
+// attributes present are changed.
+type hostPatch struct {
+	Name      *string            `json:"name"`
+	Ip        *string            `json:"ip"`
+	RomanaIp  *string            `json:"romana_ip"`
+	AgentPort *uint64            `json:"agent_port"`
+	Zone      *string            `json:"zone"`
+	Labels    *map[string]string `json:"labels"`
+	// Version is the version of the host being changed,
+	// unless given in the If-Match header.
+	Version uint64 `json:"version"`
+}
+
+// handleHostPut replaces the mutable attributes of a host
+// (IP, agent port and labels) with those in the request.
+func (topology *TopologySvc) handleHostPut(input interface{}, ctx common.RestContext) (interface{}, error) {
+	update := input.(*common.Host)
+	labels := update.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	patch := &hostPatch{
+		Ip:        &update.Ip,
+		AgentPort: &update.AgentPort,
+		Labels:    &labels,
+		Version:   update.Version,
+	}
+	if update.Name != "" {
+		patch.Name = &update.Name
+	}
+	if update.RomanaIp != "" {
+		patch.RomanaIp = &update.RomanaIp
+	}
+	if update.Zone != "" {
+		patch.Zone = &update.Zone
+	}
+	return topology.updateHost(ctx, patch)
+}
+
+// handleHostPatch changes the mutable attributes
+// of a host present in the request.
+func (topology *TopologySvc) handleHostPatch(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return topology.updateHost(ctx, input.(*hostPatch))
+}
+
+// updateHost applies the patch to the host, which must be at the
+// version the client gives. The name, Romana CIDR and zone of a host
+// cannot be changed: endpoints and routes on other hosts are derived
+// from them, so the host must be drained and added again.
+func (topology *TopologySvc) updateHost(ctx common.RestContext, patch *hostPatch) (interface{}, error) {
+	host, err := topology.hostFromPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = common.CheckVersion(ctx, "host", host.Version, patch.Version)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Name != nil && *patch.Name != host.Name {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Name of host %s cannot be changed", host.Name))
+	}
+	if patch.RomanaIp != nil && *patch.RomanaIp != host.RomanaIp {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Romana CIDR %s of host %s cannot be changed, drain and add the host again to renumber it", host.RomanaIp, host.Name))
+	}
+	if patch.Zone != nil && *patch.Zone != host.Zone {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Zone of host %s cannot be changed, drain and add the host again to move it", host.Name))
+	}
+	if patch.Ip != nil {
+		if net.ParseIP(*patch.Ip) == nil {
+			return nil, common.NewError400(fmt.Sprintf("Invalid IP '%s'", *patch.Ip))
+		}
+		host.Ip = *patch.Ip
+	}
+	if patch.AgentPort != nil {
+		if *patch.AgentPort == 0 || *patch.AgentPort > 65535 {
+			return nil, common.NewError400(fmt.Sprintf("Invalid agent port %d", *patch.AgentPort))
+		}
+		host.AgentPort = *patch.AgentPort
+	}
+	if patch.Labels != nil {
+		err = checkLabels(*patch.Labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var labels map[string]string
+	if patch.Labels != nil {
+		labels = *patch.Labels
+	}
+	log.Printf("Updating host %s (%d)", host.Name, host.ID)
+	err = topology.hosts.UpdateHost(ctx.Context, &host, labels)
 	if err != nil {
 		return nil, err
 	}
-	return hosts, nil
+	topology.events.record(common.HostUpdated, host)
+	return host, nil
 }
 
 // handleHostListPost handles addition of a host to the current datacenter.
@@ -149,10 +514,82 @@ func (topology *TopologySvc) handleHostListPost(input interface{}, ctx common.Re
 		}
 	}
 	log.Printf("Host will be added with agent port %d", host.AgentPort)
-	_, err := topology.store.addHost(host)
+	err := topology.checkZone(*host)
+	if err != nil {
+		return nil, err
+	}
+	_, err = topology.hosts.AddHost(ctx.Context, host)
+	if err != nil {
+		return nil, err
+	}
+	topology.events.record(common.HostAdded, *host)
+	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
+	agentLink := common.LinkResponse{Href: agentURL, Rel: "agent"}
+	hostLink := common.LinkResponse{Href: hostListPath + "/" + fmt.Sprintf("%d", host.ID), Rel: "self"}
+	collectionLink := common.LinkResponse{Href: hostListPath, Rel: "self"}
+	host.Links = []common.LinkResponse{agentLink, hostLink, collectionLink}
+	return host, nil
+}
+
+// handleHostRegister handles registration of a host by its agent,
+// authenticated by the bootstrap token. A host is identified by its
+// name; registering it again updates it and serves as a heartbeat.
+func (topology *TopologySvc) handleHostRegister(input interface{}, ctx common.RestContext) (interface{}, error) {
+	reg := input.(*common.HostRegistration)
+	if topology.bootstrapToken == "" {
+		return nil, common.NewHttpError(http.StatusForbidden, "Host registration is not enabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(reg.Token), []byte(topology.bootstrapToken)) != 1 {
+		log.Printf("Rejected registration of host %s with invalid token", reg.Host.Name)
+		return nil, common.NewHttpError(http.StatusForbidden, "Invalid bootstrap token")
+	}
+	host := reg.Host
+	if host.Name == "" || host.AgentPort == 0 {
+		return nil, common.NewError400("Host name and agent port are required")
+	}
+	if net.ParseIP(host.Ip) == nil {
+		return nil, common.NewError400(fmt.Sprintf("Invalid IP %s", host.Ip))
+	}
+	if _, _, err := net.ParseCIDR(host.RomanaIp); err != nil {
+		return nil, common.NewError400(fmt.Sprintf("Invalid Romana CIDR %s", host.RomanaIp))
+	}
+	if err := topology.checkZone(host); err != nil {
+		return nil, err
+	}
+	host.LastHeartbeat = time.Now().Unix()
+	host.Status = common.HostHealthy
+
+	existing, err := topology.hosts.FindHostByName(ctx.Context, host.Name)
+	if err != nil {
+		return nil, err
+	}
+	eventType := ""
+	if existing == nil {
+		log.Printf("Registering host %s (%s, %s)", host.Name, host.Ip, host.RomanaIp)
+		host.ID = 0
+		_, err = topology.hosts.AddHost(ctx.Context, &host)
+		eventType = common.HostAdded
+	} else {
+		if existing.Ip != host.Ip || existing.RomanaIp != host.RomanaIp || existing.AgentPort != host.AgentPort || existing.Zone != host.Zone {
+			log.Printf("Host %s changed from (%s, %s, %d) to (%s, %s, %d)", host.Name,
+				existing.Ip, existing.RomanaIp, existing.AgentPort, host.Ip, host.RomanaIp, host.AgentPort)
+			eventType = common.HostUpdated
+		}
+		host.ID = existing.ID
+		host.Version = existing.Version
+		// Draining and labels are up to the operator, not the agent,
+		// and a heartbeat does not conflict with their changes.
+		host.Draining = existing.Draining
+		host.Labels = existing.Labels
+		err = topology.hosts.HeartbeatHost(ctx.Context, &host)
+	}
 	if err != nil {
 		return nil, err
 	}
+	// Heartbeats alone are not worth an event.
+	if eventType != "" {
+		topology.events.record(eventType, host)
+	}
 	agentURL := fmt.Sprintf("http://%s:%d", host.Ip, host.AgentPort)
 	agentLink := common.LinkResponse{Href: agentURL, Rel: "agent"}
 	hostLink := common.LinkResponse{Href: hostListPath + "/" + fmt.Sprintf("%d", host.ID), Rel: "self"}
@@ -161,6 +598,121 @@ func (topology *TopologySvc) handleHostListPost(input interface{}, ctx common.Re
 	return host, nil
 }
 
+// hostFromPath returns the host with the ID in the request path.
+func (topology *TopologySvc) hostFromPath(ctx common.RestContext) (common.Host, error) {
+	idStr := ctx.PathVariables["hostId"]
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return common.Host{}, common.NewError400(fmt.Sprintf("Invalid host ID %s", idStr))
+	}
+	host, err := topology.hosts.FindHost(ctx.Context, id)
+	if err != nil || host.ID == 0 {
+		return host, common.NewError404("host", idStr)
+	}
+	host.Status = topology.health.status(host, time.Now())
+	return host, nil
+}
+
+// handleHostDrain marks the host as draining, after which ipam
+// allocates no more endpoints on it, so that it can be removed
+// (see handleHostDelete) once its endpoints are gone.
+func (topology *TopologySvc) handleHostDrain(input interface{}, ctx common.RestContext) (interface{}, error) {
+	host, err := topology.hostFromPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !host.Draining {
+		log.Printf("Draining host %s (%d)", host.Name, host.ID)
+		host.Draining = true
+		err = topology.hosts.UpdateHost(ctx.Context, &host, nil)
+		if err != nil {
+			return nil, err
+		}
+		topology.events.record(common.HostUpdated, host)
+	}
+	return host, nil
+}
+
+// handleHostDelete removes a drained host that has no endpoints
+// left, and tells agents of other hosts to withdraw routes to it.
+func (topology *TopologySvc) handleHostDelete(input interface{}, ctx common.RestContext) (interface{}, error) {
+	host, err := topology.hostFromPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !host.Draining {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Host %s must be drained before it is removed", host.Name))
+	}
+	n, err := topology.countEndpoints(ctx.Context, host)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, common.NewErrorConflict(fmt.Sprintf("Host %s still has %d endpoint(s)", host.Name, n))
+	}
+	log.Printf("Removing host %s (%d)", host.Name, host.ID)
+	err = topology.hosts.DeleteHost(ctx.Context, host.ID)
+	if err != nil {
+		return nil, err
+	}
+	topology.events.record(common.HostRemoved, host)
+	topology.notifyAgents(ctx.Context, host)
+	return host, nil
+}
+
+// ipamEndpoints asks ipam how many endpoints are on the host.
+func (topology *TopologySvc) ipamEndpoints(ctx context.Context, host common.Host) (int, error) {
+	client := topology.client.WithContext(ctx)
+	ipamURL, err := client.GetServiceUrl("ipam")
+	if err != nil {
+		return 0, err
+	}
+	var endpoints []map[string]interface{}
+	err = client.Get(fmt.Sprintf("%s/hosts/%d/endpoints", ipamURL, host.ID), &endpoints)
+	if err != nil {
+		return 0, err
+	}
+	return len(endpoints), nil
+}
+
+// reconcileAgents asks agents of the remaining hosts to reconcile
+// their routes with topology, withdrawing routes to the removed host.
+// Agents that cannot be reached will do it on their own schedule.
+func (topology *TopologySvc) reconcileAgents(ctx context.Context, removed common.Host) {
+	hosts, err := topology.hosts.ListHosts(ctx)
+	if err != nil {
+		log.Printf("Cannot notify agents of removal of host %s: %s", removed.Name, err)
+		return
+	}
+	client := topology.client.WithContext(ctx)
+	for _, host := range hosts {
+		url := fmt.Sprintf("http://%s:%d/routes/reconcile", host.Ip, host.AgentPort)
+		result := make(map[string]interface{})
+		err = client.Post(url, nil, &result)
+		if err != nil {
+			log.Printf("Cannot notify agent at %s of removal of host %s: %s", host.Ip, removed.Name, err)
+		}
+	}
+}
+
+// expireHosts periodically deletes self-registered hosts
+// that stopped sending heartbeats.
+func (topology *TopologySvc) expireHosts() {
+	for {
+		time.Sleep(topology.hostTTL / 2)
+		before := time.Now().Add(-topology.hostTTL).Unix()
+		stale, err := topology.hosts.DeleteStaleHosts(context.Background(), before)
+		if err != nil {
+			log.Printf("Error deleting stale hosts: %s", err)
+		} else if len(stale) > 0 {
+			log.Printf("Deleted %d host(s) without heartbeats for %v", len(stale), topology.hostTTL)
+		}
+		for _, host := range stale {
+			topology.events.record(common.HostRemoved, host)
+		}
+	}
+}
+
 func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestContext) (interface{}, error) {
 	retval := common.IndexResponse{}
 	retval.ServiceName = "topology"
@@ -170,11 +722,15 @@ func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestConte
 	aboutLink := common.LinkResponse{Href: infoListPath, Rel: "about"}
 	agentsLink := common.LinkResponse{Href: agentListPath, Rel: "agent-list"}
 	hostsLink := common.LinkResponse{Href: hostListPath, Rel: "host-list"}
+	hostRegLink := common.LinkResponse{Href: hostRegPath, Rel: "host-registration"}
+	eventsLink := common.LinkResponse{Href: eventsPath, Rel: "host-events"}
 	torsLink := common.LinkResponse{Href: torListPath, Rel: "tor-list"}
 	spinesLink := common.LinkResponse{Href: spineListPath, Rel: "spine-list"}
 	dcLink := common.LinkResponse{Href: dcPath, Rel: "datacenter"}
+	zonesLink := common.LinkResponse{Href: zoneListPath, Rel: "zone-list"}
+	exportLink := common.LinkResponse{Href: exportPath, Rel: "topology-export"}
 
-	retval.Links = []common.LinkResponse{selfLink, aboutLink, agentsLink, hostsLink, torsLink, spinesLink, dcLink}
+	retval.Links = []common.LinkResponse{selfLink, aboutLink, agentsLink, hostsLink, hostRegLink, torsLink, spinesLink, dcLink, zonesLink, eventsLink, exportLink}
 	return retval, nil
 }
 
@@ -183,13 +739,82 @@ func (topology *TopologySvc) handleIndex(input interface{}, ctx common.RestConte
 func (topology *TopologySvc) SetConfig(config common.ServiceConfig) error {
 	topology.config = config
 	dcMap := config.ServiceSpecific["datacenter"].(map[string]interface{})
+	dc, err := parseDatacenter(dcMap)
+	if err != nil {
+		return err
+	}
+	topology.datacenter = dc
+
+	topology.zones = make(map[string]*common.Datacenter)
+	zoneList, _ := config.ServiceSpecific["zones"].([]interface{})
+	for _, zoneConfig := range zoneList {
+		zoneMap, ok := zoneConfig.(map[string]interface{})
+		if !ok {
+			return common.NewError("Invalid zone %v", zoneConfig)
+		}
+		zone, err := parseDatacenter(zoneMap)
+		if err != nil {
+			return err
+		}
+		if zone.Name == "" || zone.Name == dc.Name || topology.zones[zone.Name] != nil {
+			return common.NewError("Zone name '%s' is empty or not unique", zone.Name)
+		}
+		topology.zones[zone.Name] = zone
+	}
+
+	topology.bootstrapToken, _ = config.ServiceSpecific["bootstrap_token"].(string)
+	topology.hostTTL = 0
+	if ttl, ok := config.ServiceSpecific["host_ttl"].(float64); ok {
+		if ttl < 0 {
+			return common.NewError("Invalid host_ttl %v", ttl)
+		}
+		topology.hostTTL = time.Duration(ttl * float64(time.Second))
+	}
+	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
+	if topology.events == nil {
+		topology.events = newHostEvents()
+	}
+	topology.health, err = parseHostHealth(config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	if topology.backend == nil {
+		store := &topoStore{}
+		store.ServiceStore = store
+		topology.SetStore(store)
+	}
+	return topology.backend.SetConfig(storeConfig)
+}
+
+// SetStore makes the service keep hosts in the store, such as
+// one of package topologytest, rather than in the database
+// configured. It must be called before SetConfig.
+func (topology *TopologySvc) SetStore(store Store) {
+	topology.backend = store
+	topology.hosts = store
+}
+
+// storeFinder finds entities in the store of the service, which
+// is only set up after routes are created.
+type storeFinder struct {
+	topology *TopologySvc
+}
+
+func (f storeFinder) Find(ctx context.Context, query url.Values, entities interface{}, flag common.FindFlag) (interface{}, error) {
+	return f.topology.backend.Find(ctx, query, entities, flag)
+}
+
+// parseDatacenter parses configuration of the datacenter or of a zone.
+func parseDatacenter(dcMap map[string]interface{}) (*common.Datacenter, error) {
 	dc := common.Datacenter{}
+	dc.Name, _ = dcMap["name"].(string)
 	dc.IpVersion = uint(dcMap["ip_version"].(float64))
 	dc.Cidr = dcMap["cidr"].(string)
-	_, ipNet, err := net.ParseCIDR(dc.Cidr)
+	ip, ipNet, err := net.ParseCIDR(dc.Cidr)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	dc.Prefix = common.IPv4ToInt(ip)
 	prefixBits, _ := ipNet.Mask.Size()
 	dc.PrefixBits = uint(prefixBits)
 
@@ -204,11 +829,7 @@ func (topology *TopologySvc) SetConfig(config common.ServiceConfig) error {
 	//		return err
 	//	}
 	log.Printf("Datacenter information: was %s, decoded to %+v\n", dcMap, dc)
-	topology.datacenter = &dc
-	storeConfig := config.ServiceSpecific["store"].(map[string]interface{})
-	topology.store = topoStore{}
-	topology.store.ServiceStore = &topology.store
-	return topology.store.SetConfig(storeConfig)
+	return &dc, nil
 }
 
 // Run configures and runs topology service.
@@ -221,6 +842,9 @@ func Run(rootServiceURL string, cred *common.Credential) (*common.RestServiceInf
 	}
 	topSvc := &TopologySvc{}
 	topSvc.client = client
+	topSvc.countEndpoints = topSvc.ipamEndpoints
+	topSvc.notifyAgents = topSvc.reconcileAgents
+	topSvc.listSegments = topSvc.tenantSegments
 	config, err := client.GetServiceConfig(topSvc.Name())
 	if err != nil {
 		return nil, err
@@ -231,13 +855,22 @@ func Run(rootServiceURL string, cred *common.Credential) (*common.RestServiceInf
 
 // Initialize the topology service
 func (topology *TopologySvc) Initialize() error {
-	log.Println("Parsing", topology.datacenter)
-	ip, _, err := net.ParseCIDR(topology.datacenter.Cidr)
+	err := topology.backend.Connect()
 	if err != nil {
 		return err
 	}
-	topology.datacenter.Prefix = common.IPv4ToInt(ip)
-	return topology.store.Connect()
+	bus, err := common.NewEventBus(topology.Name(), topology.config.ServiceSpecific)
+	if err != nil {
+		return err
+	}
+	topology.events.mu.Lock()
+	topology.events.bus = bus
+	topology.events.mu.Unlock()
+	if topology.hostTTL > 0 {
+		go topology.expireHosts()
+	}
+	go topology.monitorHealth()
+	return nil
 }
 
 // CreateSchema creates schema for topology service.
@@ -258,5 +891,5 @@ func CreateSchema(rootServiceURL string, overwrite bool) error {
 	if err != nil {
 		return err
 	}
-	return topologyService.store.CreateSchema(overwrite)
+	return topologyService.backend.CreateSchema(overwrite)
 }
@@ -17,13 +17,19 @@
 package topology
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-check/check"
 	"github.com/romana/core/common"
 	"github.com/romana/core/root"
+	"github.com/romana/core/tenant"
 	//	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -173,4 +179,375 @@ func (s *MySuite) TestTopology(c *check.C) {
 	myLog(c, "Host list: ", hostList2)
 	c.Assert(len(hostList2), check.Equals, 2)
 
+	// Hosts can register themselves with the bootstrap token.
+	regRelURL := topIndex.Links.FindByRel("host-registration")
+	reg := common.HostRegistration{
+		Host:  common.Host{Ip: "10.10.10.12", AgentPort: 9999, Name: "host12", RomanaIp: "10.12.0.0/16"},
+		Token: "wrong",
+	}
+	err = client.Post(regRelURL, reg, &newHostResp)
+	httpErr, ok := err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 403)
+
+	reg.Token = "bootstrap"
+	newHostResp = common.Host{}
+	err = client.Post(regRelURL, reg, &newHostResp)
+	c.Assert(err, check.IsNil)
+	c.Assert(newHostResp.ID, check.Equals, uint64(3))
+	c.Assert(newHostResp.LastHeartbeat > 0, check.Equals, true)
+
+	// Registering again updates the host, but not its version:
+	// heartbeats do not conflict with changes of operators.
+	version := newHostResp.Version
+	reg.Host.Ip = "10.10.10.13"
+	newHostResp = common.Host{}
+	err = client.Post(regRelURL, reg, &newHostResp)
+	c.Assert(err, check.IsNil)
+	c.Assert(newHostResp.ID, check.Equals, uint64(3))
+	c.Assert(newHostResp.Version, check.Equals, version)
+
+	var hostList3 []common.Host
+	client.Get(hostsRelURL, &hostList3)
+	c.Assert(len(hostList3), check.Equals, 3)
+	c.Assert(hostList3[2].Ip, check.Equals, "10.10.10.13")
+
+	// Hosts can be selected by labels.
+	err = client.Put(hostsRelURL+"/1/labels", map[string]string{"rack": "12", "gpu": "true"}, &newHostResp)
+	c.Assert(err, check.IsNil)
+	c.Assert(newHostResp.Labels["rack"], check.Equals, "12")
+	err = client.Put(hostsRelURL+"/2/labels", map[string]string{"rack": "13"}, &newHostResp)
+	c.Assert(err, check.IsNil)
+
+	var labeled []common.Host
+	err = client.Get(hostsRelURL+"?label=rack=12", &labeled)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(labeled), check.Equals, 1)
+	c.Assert(labeled[0].Name, check.Equals, "host10")
+	c.Assert(labeled[0].Labels, check.DeepEquals, map[string]string{"rack": "12", "gpu": "true"})
+
+	labeled = nil
+	err = client.Get(hostsRelURL+"?label=rack", &labeled)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(labeled), check.Equals, 2)
+
+	labeled = nil
+	err = client.Get(hostsRelURL+"?label=rack&label=gpu=false", &labeled)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(labeled), check.Equals, 0)
+
+	err = client.Get(hostsRelURL+"?label==12", &labeled)
+	httpErr, ok = err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 400)
+
+	// Zones other than the datacenter have their own parameters.
+	zonesRelURL := topIndex.Links.FindByRel("zone-list")
+	var zones []common.Datacenter
+	err = client.Get(zonesRelURL, &zones)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(zones), check.Equals, 2)
+	c.Assert(zones[0].Cidr, check.Equals, "10.0.0.0/8")
+	c.Assert(zones[1].Name, check.Equals, "east")
+
+	zone := common.Datacenter{}
+	err = client.Get(zonesRelURL+"/east", &zone)
+	c.Assert(err, check.IsNil)
+	c.Assert(zone.Cidr, check.Equals, "11.0.0.0/8")
+	c.Assert(zone.PrefixBits, check.Equals, uint(8))
+	c.Assert(zone.PortBits, check.Equals, uint(6))
+	c.Assert(zone.Prefix, check.Equals, common.IPv4ToInt(net.ParseIP("11.0.0.0")))
+
+	err = client.Get(zonesRelURL+"/west", &zone)
+	httpErr, ok = err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 404)
+
+	newHostReq = common.Host{Ip: "10.10.10.14", AgentPort: 9999, Name: "host14", RomanaIp: "11.4.0.0/14", Zone: "west"}
+	err = client.Post(hostsRelURL, newHostReq, &newHostResp)
+	httpErr, ok = err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 400)
+
+	newHostReq.Zone = "east"
+	newHostResp = common.Host{}
+	err = client.Post(hostsRelURL, newHostReq, &newHostResp)
+	c.Assert(err, check.IsNil)
+	c.Assert(newHostResp.Zone, check.Equals, "east")
+
+	// Changes to hosts are recorded as events.
+	eventsRelURL := topIndex.Links.FindByRel("host-events")
+	events := common.HostEventList{}
+	err = client.Get(eventsRelURL+"?since=0", &events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events.Seq, check.Equals, uint64(7))
+	c.Assert(len(events.Events), check.Equals, 7)
+	c.Assert(events.Events[0].Type, check.Equals, common.HostAdded)
+	c.Assert(events.Events[3].Type, check.Equals, common.HostUpdated)
+	c.Assert(events.Events[3].Host.Ip, check.Equals, "10.10.10.13")
+
+	events = common.HostEventList{}
+	err = client.Get(eventsRelURL+"?since=5", &events)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(events.Events), check.Equals, 2)
+
+	events = common.HostEventList{}
+	err = client.Get(eventsRelURL+"?since=100", &events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events.Reset, check.Equals, true)
+
+	// A watch waits for the next event.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		drainClient, _ := common.NewRestClient(common.GetDefaultRestClientConfig(addr))
+		drainClient.Post(hostsRelURL+"/4/drain", nil, &common.Host{})
+	}()
+	events = common.HostEventList{}
+	err = client.Get(eventsRelURL+"?watch=true&since=7", &events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events.Seq, check.Equals, uint64(8))
+	c.Assert(events.Events[0].Host.Name, check.Equals, "host14")
+	c.Assert(events.Events[0].Host.Draining, check.Equals, true)
+}
+
+// newTopology creates topology service (without running it)
+// with the configuration from root, overridden with the provided
+// settings, and its own database.
+func (s *MySuite) newTopology(c *check.C, database string, settings map[string]interface{}) *TopologySvc {
+	client, err := common.NewRestClient(common.GetDefaultRestClientConfig(s.rootURL))
+	c.Assert(err, check.IsNil)
+	config, err := client.GetServiceConfig("topology")
+	c.Assert(err, check.IsNil)
+	serviceSpecific := make(map[string]interface{})
+	for k, v := range config.ServiceSpecific {
+		serviceSpecific[k] = v
+	}
+	for k, v := range settings {
+		serviceSpecific[k] = v
+	}
+	serviceSpecific["store"] = map[string]interface{}{"type": "sqlite3", "database": database}
+	config.ServiceSpecific = serviceSpecific
+
+	topology := &TopologySvc{}
+	err = topology.SetConfig(*config)
+	c.Assert(err, check.IsNil)
+	err = topology.backend.CreateSchema(true)
+	c.Assert(err, check.IsNil)
+	err = topology.backend.Connect()
+	c.Assert(err, check.IsNil)
+	return topology
+}
+
+// TestHostDrain tests draining and removing a host.
+func (s *MySuite) TestHostDrain(c *check.C) {
+	topology := s.newTopology(c, "/var/tmp/topology_drain.sqlite3", nil)
+
+	endpoints := 1
+	var notified []common.Host
+	topology.countEndpoints = func(ctx context.Context, host common.Host) (int, error) {
+		return endpoints, nil
+	}
+	topology.notifyAgents = func(ctx context.Context, removed common.Host) {
+		notified = append(notified, removed)
+	}
+
+	ctx := context.Background()
+	host := common.Host{Ip: "10.10.10.10", AgentPort: 9999, Name: "host10", RomanaIp: "10.10.0.0/16"}
+	_, err := topology.hosts.AddHost(ctx, &host)
+	c.Assert(err, check.IsNil)
+	restCtx := common.RestContext{Context: ctx, PathVariables: map[string]string{"hostId": fmt.Sprintf("%d", host.ID)}}
+
+	// Host must be drained first.
+	_, err = topology.handleHostDelete(nil, restCtx)
+	httpErr, ok := err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+
+	result, err := topology.handleHostDrain(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(common.Host).Draining, check.Equals, true)
+
+	// ...and have no endpoints.
+	_, err = topology.handleHostDelete(nil, restCtx)
+	httpErr, ok = err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 409)
+	c.Assert(len(notified), check.Equals, 0)
+
+	endpoints = 0
+	_, err = topology.handleHostDelete(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(notified), check.Equals, 1)
+	c.Assert(notified[0].Name, check.Equals, "host10")
+
+	_, err = topology.handleHostDrain(nil, restCtx)
+	httpErr, ok = err.(common.HttpError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpErr.StatusCode, check.Equals, 404)
+}
+
+// TestHostHealth tests status of hosts.
+func (s *MySuite) TestHostHealth(c *check.C) {
+	topology := s.newTopology(c, "/var/tmp/topology_health.sqlite3", map[string]interface{}{
+		"unreachable_after": float64(60),
+		"down_after":        float64(120),
+	})
+	ctx := context.Background()
+	now := time.Now()
+	hosts := []common.Host{
+		{Ip: "10.10.10.10", AgentPort: 9999, Name: "host10", RomanaIp: "10.10.0.0/16"},
+		{Ip: "10.10.10.11", AgentPort: 9999, Name: "host11", RomanaIp: "10.11.0.0/16", LastHeartbeat: now.Unix()},
+	}
+	for i := range hosts {
+		_, err := topology.hosts.AddHost(ctx, &hosts[i])
+		c.Assert(err, check.IsNil)
+	}
+
+	statuses := func() []string {
+		result, err := topology.handleHostListGet(nil, common.RestContext{Context: ctx, QueryVariables: url.Values{}})
+		c.Assert(err, check.IsNil)
+		listed := result.([]common.Host)
+		retval := make([]string, len(listed))
+		for i, host := range listed {
+			retval[i] = host.Status
+		}
+		return retval
+	}
+	c.Assert(statuses(), check.DeepEquals, []string{"", common.HostHealthy})
+
+	// Transitions are recorded as events.
+	c.Assert(topology.checkHealth(ctx, now), check.IsNil)
+	c.Assert(topology.checkHealth(ctx, now.Add(90*time.Second)), check.IsNil)
+	c.Assert(topology.checkHealth(ctx, now.Add(150*time.Second)), check.IsNil)
+	events, _ := topology.events.since(0)
+	c.Assert(len(events.Events), check.Equals, 2)
+	c.Assert(events.Events[0].Host.Status, check.Equals, common.HostUnreachable)
+	c.Assert(events.Events[1].Host.Status, check.Equals, common.HostDown)
+
+	_, err := parseHostHealth(map[string]interface{}{"unreachable_after": float64(60), "down_after": float64(30)})
+	c.Assert(err, check.NotNil)
+}
+
+// TestExport tests exporting the topology as a graph.
+func (s *MySuite) TestExport(c *check.C) {
+	topology := s.newTopology(c, "/var/tmp/topology_export.sqlite3", nil)
+	topology.listSegments = func(ctx context.Context) ([]tenant.Tenant, []segmentHosts, error) {
+		tenants := []tenant.Tenant{
+			{ID: 1, Name: "t1", Segments: []tenant.Segment{{ID: 2, TenantID: 1, Name: "s1"}}},
+		}
+		usage := []segmentHosts{{HostID: "2", TenantID: "1", SegmentID: "2", Used: 3}}
+		return tenants, usage, nil
+	}
+	ctx := context.Background()
+	hosts := []common.Host{
+		{Ip: "10.10.10.10", AgentPort: 9999, Name: "host10", RomanaIp: "10.10.0.0/16"},
+		{Ip: "10.10.10.11", AgentPort: 9999, Name: "host11", RomanaIp: "11.4.0.0/14", Zone: "east"},
+	}
+	for i := range hosts {
+		_, err := topology.hosts.AddHost(ctx, &hosts[i])
+		c.Assert(err, check.IsNil)
+	}
+
+	restCtx := common.RestContext{Context: ctx, QueryVariables: url.Values{}}
+	result, err := topology.handleExport(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	export := result.(*TopologyExport)
+	c.Assert(len(export.Hosts), check.Equals, 2)
+	c.Assert(len(export.Zones), check.Equals, 1)
+	c.Assert(len(export.Nodes), check.Equals, 6)
+	c.Assert(export.Edges, check.DeepEquals, []ExportEdge{
+		{From: "datacenter:" + export.Datacenter.Name, To: "zone:east", Kind: "contains"},
+		{From: "datacenter:" + export.Datacenter.Name, To: "host:1", Kind: "contains"},
+		{From: "zone:east", To: "host:2", Kind: "contains"},
+		{From: "tenant:1", To: "segment:1/2", Kind: "owns"},
+		{From: "segment:1/2", To: "host:2", Kind: "spans", Endpoints: 3},
+	})
+
+	restCtx.QueryVariables.Set("format", "dot")
+	result, err = topology.handleExport(nil, restCtx)
+	c.Assert(err, check.IsNil)
+	dot := result.(common.Raw).Body
+	c.Assert(strings.HasPrefix(dot, "digraph romana {\n"), check.Equals, true)
+	c.Assert(strings.Contains(dot, `"segment:1/2" -> "host:2" [label="3 endpoints"];`), check.Equals, true)
+
+	restCtx.QueryVariables.Set("format", "svg")
+	_, err = topology.handleExport(nil, restCtx)
+	c.Assert(err, check.NotNil)
+}
+
+// TestHostUpdate tests changing attributes of a host.
+func (s *MySuite) TestHostUpdate(c *check.C) {
+	topology := s.newTopology(c, "/var/tmp/topology_update.sqlite3", nil)
+	ctx := context.Background()
+	host := common.Host{Ip: "10.10.10.10", AgentPort: 9999, Name: "host10", RomanaIp: "10.10.0.0/16", Labels: map[string]string{"rack": "r1"}}
+	_, err := topology.hosts.AddHost(ctx, &host)
+	c.Assert(err, check.IsNil)
+	c.Assert(host.CreatedAt, check.NotNil)
+	restCtx := common.RestContext{Context: ctx, PathVariables: map[string]string{"hostId": "1"}}
+
+	// PATCH changes only what is present.
+	ip := "10.10.20.10"
+	result, err := topology.handleHostPatch(&hostPatch{Ip: &ip, Version: 1}, restCtx)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.(common.Host).Ip, check.Equals, ip)
+	c.Assert(result.(common.Host).Version, check.Equals, uint64(2))
+	found, err := topology.hosts.FindHost(ctx, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Ip, check.Equals, ip)
+	// The store keeps when the host was added and last updated.
+	c.Assert(found.CreatedAt.Unix(), check.Equals, host.CreatedAt.Unix())
+	c.Assert(found.UpdatedAt.Before(*host.CreatedAt), check.Equals, false)
+	c.Assert(result.(common.Host).UpdatedAt.Unix(), check.Equals, found.UpdatedAt.Unix())
+	c.Assert(found.AgentPort, check.Equals, uint64(9999))
+	c.Assert(found.Labels, check.DeepEquals, map[string]string{"rack": "r1"})
+
+	// PUT replaces all mutable attributes.
+	_, err = topology.handleHostPut(&common.Host{Name: "host10", Ip: "10.10.30.10", AgentPort: 9998, RomanaIp: "10.10.0.0/16", Version: 2}, restCtx)
+	c.Assert(err, check.IsNil)
+	found, err = topology.hosts.FindHost(ctx, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Ip, check.Equals, "10.10.30.10")
+	c.Assert(found.AgentPort, check.Equals, uint64(9998))
+	c.Assert(len(found.Labels), check.Equals, 0)
+	c.Assert(found.Version, check.Equals, uint64(3))
+	events, _ := topology.events.since(0)
+	c.Assert(len(events.Events), check.Equals, 2)
+	c.Assert(events.Events[1].Type, check.Equals, common.HostUpdated)
+
+	// Updates must give the current version, in the body
+	// or the If-Match header.
+	_, err = topology.handleHostPatch(&hostPatch{Ip: &ip, Version: 2}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	_, err = topology.handleHostPatch(&hostPatch{Ip: &ip}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, common.StatusPreconditionRequired)
+	restCtx.IfMatch = `"2"`
+	_, err = topology.handleHostPatch(&hostPatch{Ip: &ip, Version: 3}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+	restCtx.IfMatch = `"3"`
+	_, err = topology.handleHostPatch(&hostPatch{Ip: &ip}, restCtx)
+	c.Assert(err, check.IsNil)
+	found, err = topology.hosts.FindHost(ctx, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Ip, check.Equals, ip)
+	c.Assert(found.Version, check.Equals, uint64(4))
+
+	// The store refuses an update of a version changed since.
+	found.Version = 3
+	err = topology.hosts.UpdateHost(ctx, &found, nil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	// If-Match: * updates whatever the version.
+	restCtx.IfMatch = "*"
+
+	// Romana CIDR cannot be changed.
+	cidr := "10.11.0.0/16"
+	_, err = topology.handleHostPatch(&hostPatch{RomanaIp: &cidr}, restCtx)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusConflict)
+
+	bad := "10.10.30"
+	_, err = topology.handleHostPatch(&hostPatch{Ip: &bad}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
+	_, err = topology.handleHostPut(&common.Host{Ip: "10.10.30.10"}, restCtx)
+	c.Assert(err.(common.HttpError).StatusCode, check.Equals, http.StatusBadRequest)
 }
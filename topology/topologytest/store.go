@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package topologytest provides an in-memory topology.Store, so that
+// the topology service can be tested without a database (see
+// topology.TopologySvc.SetStore).
+package topologytest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// Store keeps hosts in memory.
+type Store struct {
+	mu     sync.Mutex
+	nextID uint64
+	hosts  []common.Host
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// SetConfig implements topology.Store; the configuration is ignored.
+func (s *Store) SetConfig(config map[string]interface{}) error {
+	return nil
+}
+
+// Connect implements topology.Store.
+func (s *Store) Connect() error {
+	return nil
+}
+
+// CreateSchema implements topology.Store, emptying the store if force is set.
+func (s *Store) CreateSchema(force bool) error {
+	if force {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.hosts = nil
+	}
+	return nil
+}
+
+// Ping implements topology.Store.
+func (s *Store) Ping() error {
+	return nil
+}
+
+// Find implements topology.Store.
+func (s *Store) Find(ctx context.Context, query url.Values, entities interface{}, flag common.FindFlag) (interface{}, error) {
+	hosts, err := s.ListHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return common.FindIn(ctx, query, hosts, flag)
+}
+
+// copyHost returns a copy of the host that does not share its labels.
+func copyHost(host common.Host) common.Host {
+	if host.Labels != nil {
+		labels := make(map[string]string)
+		for k, v := range host.Labels {
+			labels[k] = v
+		}
+		host.Labels = labels
+	}
+	// As in the database, these are not stored.
+	host.Status = ""
+	host.Links = nil
+	return host
+}
+
+// AddHost implements topology.Store.
+func (s *Store) AddHost(ctx context.Context, host *common.Host) (string, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	host.ID = s.nextID
+	host.Version = 1
+	now := time.Now()
+	host.CreatedAt = &now
+	host.UpdatedAt = &now
+	s.hosts = append(s.hosts, copyHost(*host))
+	return strconv.FormatUint(host.ID, 10), nil
+}
+
+// index returns the index of the host with the ID, or -1.
+func (s *Store) index(id uint64) int {
+	for i, host := range s.hosts {
+		if host.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// FindHost implements topology.Store.
+func (s *Store) FindHost(ctx context.Context, id uint64) (common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return common.Host{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return common.Host{}, common.NewError404("host", strconv.FormatUint(id, 10))
+	}
+	return copyHost(s.hosts[i]), nil
+}
+
+// FindHostByName implements topology.Store.
+func (s *Store) FindHostByName(ctx context.Context, name string) (*common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range s.hosts {
+		if host.Name == name {
+			found := copyHost(host)
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// ListHosts implements topology.Store.
+func (s *Store) ListHosts(ctx context.Context) ([]common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]common.Host, len(s.hosts))
+	for i, host := range s.hosts {
+		hosts[i] = copyHost(host)
+	}
+	return hosts, nil
+}
+
+// UpdateHost implements topology.Store. Labels are kept if nil.
+func (s *Store) UpdateHost(ctx context.Context, host *common.Host, labels map[string]string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(host.ID)
+	if i < 0 {
+		return common.NewError404("host", strconv.FormatUint(host.ID, 10))
+	}
+	if s.hosts[i].Version != host.Version {
+		return common.NewErrorConflict(fmt.Sprintf("Host %d changed concurrently, reload it and retry", host.ID))
+	}
+	host.Version++
+	now := time.Now()
+	host.CreatedAt = s.hosts[i].CreatedAt
+	host.UpdatedAt = &now
+	if labels == nil {
+		labels = s.hosts[i].Labels
+	} else {
+		host.Labels = labels
+	}
+	s.hosts[i] = copyHost(*host)
+	s.hosts[i].Labels = copyHost(common.Host{Labels: labels}).Labels
+	return nil
+}
+
+// HeartbeatHost implements topology.Store. The version is kept.
+func (s *Store) HeartbeatHost(ctx context.Context, host *common.Host) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(host.ID)
+	if i < 0 {
+		return common.NewError404("host", strconv.FormatUint(host.ID, 10))
+	}
+	s.hosts[i].Ip = host.Ip
+	s.hosts[i].RomanaIp = host.RomanaIp
+	s.hosts[i].AgentPort = host.AgentPort
+	s.hosts[i].LastHeartbeat = host.LastHeartbeat
+	s.hosts[i].Zone = host.Zone
+	return nil
+}
+
+// DeleteHost implements topology.Store.
+func (s *Store) DeleteHost(ctx context.Context, id uint64) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.index(id); i >= 0 {
+		s.hosts = append(s.hosts[:i], s.hosts[i+1:]...)
+	}
+	return nil
+}
+
+// DeleteStaleHosts implements topology.Store.
+func (s *Store) DeleteStaleHosts(ctx context.Context, before int64) ([]common.Host, error) {
+	if err := common.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stale []common.Host
+	kept := s.hosts[:0]
+	for _, host := range s.hosts {
+		if host.LastHeartbeat > 0 && host.LastHeartbeat < before {
+			stale = append(stale, copyHost(host))
+		} else {
+			kept = append(kept, host)
+		}
+	}
+	s.hosts = kept
+	return stale, nil
+}
+
+// SetLabels implements topology.Store.
+func (s *Store) SetLabels(ctx context.Context, hostID uint64, labels map[string]string) error {
+	if err := common.CheckContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(hostID)
+	if i < 0 {
+		return common.NewError404("host", strconv.FormatUint(hostID, 10))
+	}
+	s.hosts[i].Labels = nil
+	if len(labels) > 0 {
+		s.hosts[i].Labels = copyHost(common.Host{Labels: labels}).Labels
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package topologytest
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/commontest"
+	"github.com/romana/core/topology"
+)
+
+var _ topology.Store = &Store{}
+
+// TestTopology tests the topology service with hosts kept in the store.
+func TestTopology(t *testing.T) {
+	store := NewStore()
+	svc := &topology.TopologySvc{}
+	svc.SetStore(store)
+	routes := svc.Routes()
+	config := common.ServiceConfig{ServiceSpecific: map[string]interface{}{
+		"datacenter": map[string]interface{}{
+			"ip_version": float64(4), "cidr": "10.0.0.0/8", "host_bits": float64(8),
+			"tenant_bits": float64(4), "segment_bits": float64(4),
+			"endpoint_bits": float64(8), "endpoint_space_bits": float64(0),
+		},
+		"store": map[string]interface{}{"type": "memory"},
+	}}
+	if err := svc.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := common.RestContext{Context: context.Background()}
+	for _, name := range []string{"host1", "host2"} {
+		host := &common.Host{Name: name, Ip: "192.168.0.1", RomanaIp: "10.1.0.0/16", AgentPort: 9604}
+		if _, err := commontest.Handler(t, routes, "POST", "/hosts")(host, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.QueryVariables = url.Values{"name": {"host2"}}
+	found, err := commontest.Handler(t, routes, "GET", "/"+common.FindExactlyOne+"/hosts")(nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := found.(common.Host); host.ID != 2 || host.Name != "host2" {
+		t.Errorf("Expected host2, got %+v", host)
+	}
+
+	if err := store.SetLabels(nil, 1, map[string]string{"rack": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := store.FindHost(nil, 1)
+	host.LastHeartbeat = 100
+	host.Labels["rack"] = "r2"
+	if err := store.UpdateHost(nil, &host, nil); err != nil {
+		t.Fatal(err)
+	}
+	host, _ = store.FindHost(nil, 1)
+	if host.Labels["rack"] != "r1" || host.LastHeartbeat != 100 {
+		t.Errorf("Expected host to be updated but not its labels, got %+v", host)
+	}
+	if err := store.UpdateHost(nil, &host, map[string]string{"rack": "r3"}); err != nil {
+		t.Fatal(err)
+	}
+	host, _ = store.FindHost(nil, 1)
+	if host.Labels["rack"] != "r3" {
+		t.Errorf("Expected labels of host to be updated, got %+v", host)
+	}
+	version := host.Version
+	host.LastHeartbeat = 150
+	if err := store.HeartbeatHost(nil, &host); err != nil {
+		t.Fatal(err)
+	}
+	host, _ = store.FindHost(nil, 1)
+	if host.LastHeartbeat != 150 || host.Version != version {
+		t.Errorf("Expected heartbeat at 150 at version %d, got %+v", version, host)
+	}
+	stale, err := store.DeleteStaleHosts(nil, 200)
+	if err != nil || len(stale) != 1 || stale[0].Name != "host1" {
+		t.Errorf("Expected host1 to be stale, got %v, %v", stale, err)
+	}
+	hosts, _ := store.ListHosts(nil)
+	if len(hosts) != 1 || hosts[0].Name != "host2" {
+		t.Errorf("Expected only host2 to be left, got %v", hosts)
+	}
+}